@@ -0,0 +1,420 @@
+//go:build !slim
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/vesaa/opentalon/internal/config"
+	"github.com/vesaa/opentalon/internal/ctl"
+	"golang.org/x/term"
+)
+
+// ctlCommand returns `opentalon ctl`, the command-line client of the
+// control plane: list devices, show one, read its metrics, run playbooks and
+// list alerts over SSH without the Web UI.
+func ctlCommand() *cobra.Command {
+	ctlCmd := &cobra.Command{
+		Use:   "ctl",
+		Short: "Manage the fleet from the command line through the control-plane API",
+	}
+	ctlConnFlags(ctlCmd.PersistentFlags())
+	ctlCmd.PersistentFlags().Bool("json", false, "Print JSON instead of a table")
+
+	// ── ctl devices list ──────────────────────────────────────────────────────
+	devicesCmd := &cobra.Command{Use: "devices", Short: "Device commands"}
+	devicesListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List devices",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := ctlClient(cmd)
+			if err != nil {
+				return err
+			}
+			var f ctl.DeviceFilter
+			f.Group, _ = cmd.Flags().GetString("group")
+			f.Tag, _ = cmd.Flags().GetString("tag")
+			f.Query, _ = cmd.Flags().GetString("search")
+			if cmd.Flags().Changed("online") {
+				online, _ := cmd.Flags().GetBool("online")
+				f.Online = strconv.FormatBool(online)
+			}
+			devices, err := c.Devices(f)
+			if err != nil {
+				return err
+			}
+			if ctlJSON(cmd) {
+				return ctl.PrintJSON(os.Stdout, devices)
+			}
+			return ctl.PrintDevices(os.Stdout, devices)
+		},
+	}
+	devicesListCmd.Flags().String("group", "", "Only devices in these groups (comma-separated)")
+	devicesListCmd.Flags().String("tag", "", "Only devices with all these tags (comma-separated)")
+	devicesListCmd.Flags().Bool("online", false, "Only online devices (--online=false: only offline ones)")
+	devicesListCmd.Flags().String("search", "", "Only devices whose hostname, remark, IP or MAC contains this")
+	devicesCmd.AddCommand(devicesListCmd)
+
+	// ── ctl device show ───────────────────────────────────────────────────────
+	deviceCmd := &cobra.Command{Use: "device", Short: "Single-device commands"}
+	deviceCmd.AddCommand(&cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a device",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseDeviceID(args[0])
+			if err != nil {
+				return err
+			}
+			c, err := ctlClient(cmd)
+			if err != nil {
+				return err
+			}
+			dev, err := c.Device(id)
+			if err != nil {
+				return err
+			}
+			if ctlJSON(cmd) {
+				return ctl.PrintJSON(os.Stdout, dev)
+			}
+			return ctl.PrintDevice(os.Stdout, dev)
+		},
+	})
+
+	// ── ctl metrics ───────────────────────────────────────────────────────────
+	metricsCmd := &cobra.Command{
+		Use:   "metrics <id>",
+		Short: "Show the latest metrics of a device",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseDeviceID(args[0])
+			if err != nil {
+				return err
+			}
+			c, err := ctlClient(cmd)
+			if err != nil {
+				return err
+			}
+			m, err := c.Metrics(id)
+			if err != nil {
+				return err
+			}
+			if ctlJSON(cmd) {
+				return ctl.PrintJSON(os.Stdout, m)
+			}
+			return ctl.PrintMetrics(os.Stdout, m)
+		},
+	}
+
+	// ── ctl exec ──────────────────────────────────────────────────────────────
+	execCmd := &cobra.Command{
+		Use:   "exec <id> [-- command...]",
+		Short: "Run a shell command or playbook on a device over the server's SSH credentials",
+		Example: `  opentalon ctl exec 12 -- uptime
+  opentalon ctl exec 12 --playbook restart-service --arg service=nginx`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseDeviceID(args[0])
+			if err != nil {
+				return err
+			}
+			playbook, _ := cmd.Flags().GetString("playbook")
+			command := strings.Join(args[1:], " ")
+			if playbook == "" && command == "" {
+				return fmt.Errorf("give a command after -- or a --playbook")
+			}
+			kv, _ := cmd.Flags().GetStringArray("arg")
+			pbArgs := map[string]string{}
+			for _, a := range kv {
+				k, v, ok := strings.Cut(a, "=")
+				if !ok {
+					return fmt.Errorf("--arg %q: want key=value", a)
+				}
+				pbArgs[k] = v
+			}
+			c, err := ctlClient(cmd)
+			if err != nil {
+				return err
+			}
+			res, err := c.Exec(id, playbook, pbArgs, command)
+			if err != nil {
+				return err
+			}
+			if ctlJSON(cmd) {
+				if err := ctl.PrintJSON(os.Stdout, res); err != nil {
+					return err
+				}
+			} else {
+				fmt.Print(res.Output)
+				if res.Output != "" && !strings.HasSuffix(res.Output, "\n") {
+					fmt.Println()
+				}
+			}
+			if !res.OK {
+				return fmt.Errorf("%s failed: %s", res.Playbook, res.Error)
+			}
+			return nil
+		},
+	}
+	execCmd.Flags().String("playbook", "", "Playbook to run (default shell; see GET /api/playbooks)")
+	execCmd.Flags().StringArray("arg", nil, "Playbook argument key=value (repeatable)")
+
+	// ── ctl alerts list ───────────────────────────────────────────────────────
+	alertsCmd := &cobra.Command{Use: "alerts", Short: "Alert commands"}
+	alertsListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List alerts, latest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := ctlClient(cmd)
+			if err != nil {
+				return err
+			}
+			var f ctl.AlertFilter
+			f.State, _ = cmd.Flags().GetString("state")
+			f.DeviceID, _ = cmd.Flags().GetUint("device")
+			f.Rule, _ = cmd.Flags().GetString("rule")
+			f.Limit, _ = cmd.Flags().GetInt("limit")
+			alerts, err := c.Alerts(f)
+			if err != nil {
+				return err
+			}
+			if ctlJSON(cmd) {
+				return ctl.PrintJSON(os.Stdout, alerts)
+			}
+			names := map[uint]string{}
+			if len(alerts) > 0 {
+				devices, err := c.Devices(ctl.DeviceFilter{})
+				if err != nil {
+					return err
+				}
+				for i := range devices {
+					names[devices[i].ID] = ctl.DeviceName(&devices[i])
+				}
+			}
+			return ctl.PrintAlerts(os.Stdout, alerts, names)
+		},
+	}
+	alertsListCmd.Flags().String("state", "", "Only firing or resolved alerts")
+	alertsListCmd.Flags().Uint("device", 0, "Only alerts of this device ID")
+	alertsListCmd.Flags().String("rule", "", "Only alerts of this rule")
+	alertsListCmd.Flags().Int("limit", 100, "Maximum number of alerts (up to 1000)")
+	alertsCmd.AddCommand(alertsListCmd)
+
+	// ── ctl login / logout ────────────────────────────────────────────────────
+	loginCmd := &cobra.Command{
+		Use:     "login",
+		Short:   "Log in and store the session in ~/.opentalon/credentials for the other ctl commands",
+		Example: `  opentalon ctl login --server https://talon.lan:6677 --user ops`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ctlLogin(cmd)
+		},
+	}
+	logoutCmd := &cobra.Command{
+		Use:   "logout",
+		Short: "End the stored session and remove it from ~/.opentalon/credentials",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ctlLogout(cmd)
+		},
+	}
+
+	ctlCmd.AddCommand(loginCmd, logoutCmd, devicesCmd, deviceCmd, metricsCmd, execCmd, alertsCmd)
+	return ctlCmd
+}
+
+// topCommand returns `opentalon top`, a terminal dashboard of the device
+// tree with live metrics from the control plane (not to be confused with
+// `opentalon agent top`, which shows the local host without a server).
+func topCommand() *cobra.Command {
+	topCmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show the device tree with live CPU, memory and bandwidth in the terminal",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := ctlClient(cmd)
+			if err != nil {
+				return err
+			}
+			if once, _ := cmd.Flags().GetBool("once"); once {
+				return ctl.PrintTop(os.Stdout, c)
+			}
+			interval, _ := cmd.Flags().GetDuration("interval")
+			if interval < time.Second {
+				return fmt.Errorf("--interval: want at least 1s")
+			}
+			return ctl.Top(c, interval)
+		},
+	}
+	ctlConnFlags(topCmd.Flags())
+	topCmd.Flags().Duration("interval", 5*time.Second, "Refresh interval")
+	topCmd.Flags().Bool("once", false, "Print a single frame as plain text and exit")
+	return topCmd
+}
+
+// ctlConnFlags adds the flags that select the server and account of ctl
+// and top.
+func ctlConnFlags(fs *pflag.FlagSet) {
+	fs.String("server", "", "Control-plane URL (default: the server of ctl login, else http://127.0.0.1:<control_port>)")
+	fs.String("user", "", "User name (default: the ctl login session, else the admin user from config)")
+	fs.String("password", "", "Password (default: the ctl login session, else the admin password from config)")
+	fs.String("token", "", "Personal API token to use instead of user and password (env TALON_CTL_TOKEN)")
+}
+
+// ctlClient returns a control-plane client: with --token (or
+// TALON_CTL_TOKEN) for that API token, with --user / --password for a new
+// login, else for the session stored by `ctl login`, falling back to the
+// admin account of the local config.
+func ctlClient(cmd *cobra.Command) (*ctl.Client, error) {
+	serverURL, _ := cmd.Flags().GetString("server")
+	user, _ := cmd.Flags().GetString("user")
+	pass, _ := cmd.Flags().GetString("password")
+	token, _ := cmd.Flags().GetString("token")
+	if token == "" {
+		token = os.Getenv("TALON_CTL_TOKEN")
+	}
+	cr, err := ctl.LoadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if token == "" && user == "" && pass == "" {
+		if c, err := cr.Client(serverURL); c != nil || err != nil {
+			return c, err
+		}
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	if serverURL == "" {
+		serverURL = cr.Server
+	}
+	if serverURL == "" {
+		serverURL = fmt.Sprintf("http://127.0.0.1:%d", cfg.ControlPort)
+	}
+	if token != "" {
+		return ctl.NewClient(serverURL, token), nil
+	}
+	if user == "" {
+		user = cfg.AdminUser
+	}
+	if pass == "" {
+		pass = cfg.AdminPass
+	}
+	return ctl.Login(serverURL, user, pass)
+}
+
+// ctlLogin signs in for `ctl login`, asking for the user name and password
+// the flags do not give, and stores the session.
+func ctlLogin(cmd *cobra.Command) error {
+	serverURL, _ := cmd.Flags().GetString("server")
+	if serverURL == "" {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("loading config: %w", err)
+		}
+		serverURL = fmt.Sprintf("http://127.0.0.1:%d", cfg.ControlPort)
+	}
+	in := bufio.NewReader(os.Stdin)
+	user, _ := cmd.Flags().GetString("user")
+	if user == "" {
+		fmt.Fprint(os.Stderr, "User: ")
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("reading user name: %w", err)
+		}
+		user = strings.TrimSpace(line)
+	}
+	pass, _ := cmd.Flags().GetString("password")
+	if pass == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+			b, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return fmt.Errorf("reading password: %w", err)
+			}
+			pass = string(b)
+		} else {
+			line, err := in.ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("reading password: %w", err)
+			}
+			pass = strings.TrimRight(line, "\r\n")
+		}
+	}
+	c, err := ctl.Login(serverURL, user, pass)
+	if err != nil {
+		return err
+	}
+	cr, err := ctl.LoadCredentials()
+	if err != nil {
+		return err
+	}
+	cr.Set(user, c)
+	if err := cr.Save(); err != nil {
+		return err
+	}
+	path, _ := ctl.CredentialsPath()
+	fmt.Printf("Logged in to %s as %s; session stored in %s\n", c.Server, user, path)
+	return nil
+}
+
+// ctlLogout ends the stored session of --server (default: the default
+// server) and forgets it.
+func ctlLogout(cmd *cobra.Command) error {
+	cr, err := ctl.LoadCredentials()
+	if err != nil {
+		return err
+	}
+	serverURL, _ := cmd.Flags().GetString("server")
+	if serverURL == "" {
+		serverURL = cr.Server
+	}
+	serverURL = strings.TrimRight(serverURL, "/")
+	if serverURL == "" {
+		return fmt.Errorf("not logged in")
+	}
+	s := cr.Sessions[serverURL]
+	if s == nil {
+		return fmt.Errorf("not logged in to %s", serverURL)
+	}
+	// The session is forgotten even when the server cannot be reached.
+	if err := ctl.NewClient(serverURL, s.Token).Do(http.MethodPost, "/api/logout", nil, nil, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: revoking the session on the server: %v\n", err)
+	}
+	delete(cr.Sessions, serverURL)
+	if cr.Server == serverURL {
+		cr.Server = ""
+	}
+	if err := cr.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Logged out of %s\n", serverURL)
+	return nil
+}
+
+// ctlJSON reports whether --json was given.
+func ctlJSON(cmd *cobra.Command) bool {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	return asJSON
+}
+
+// parseDeviceID parses a device ID argument.
+func parseDeviceID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid device id %q", s)
+	}
+	return uint(id), nil
+}
@@ -0,0 +1,56 @@
+//go:build !slim
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vesaa/opentalon/internal/agent"
+	"github.com/vesaa/opentalon/internal/config"
+	"github.com/vesaa/opentalon/internal/ctl"
+	"github.com/vesaa/opentalon/internal/server"
+)
+
+// doctorCommand returns `opentalon doctor`, which checks a server
+// installation and optionally writes a redacted diagnostics bundle.
+func doctorCommand() *cobra.Command {
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check config, ports, database, data plane, clock and certificates of this server",
+		Long: "Check the server installation on this host: config validity, whether the ports can be bound, " +
+			"database access and size, data-plane reachability as an agent sees it, clock skew and the expiry " +
+			"of the certificates the config points at. --bundle writes the findings, the config with its " +
+			"secrets masked and the end of log_file (scrubbed) to a tar.gz to attach to bug reports.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, loadErr := config.Load()
+			if loadErr != nil {
+				cfg, _ = config.FromMap(nil)
+			}
+			report := server.RunDoctor(cfg, loadErr, server.DoctorOptions{Version: version, ClockOffset: agent.SNTPOffset})
+			if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+				if err := ctl.PrintJSON(os.Stdout, report); err != nil {
+					return err
+				}
+			} else {
+				report.Print(os.Stdout)
+			}
+			if path, _ := cmd.Flags().GetString("bundle"); path != "" {
+				if err := server.WriteDoctorBundle(path, report, cfg); err != nil {
+					return fmt.Errorf("writing bundle: %w", err)
+				}
+				fmt.Fprintf(os.Stderr, "Diagnostics bundle written to %s\n", path)
+			}
+			if report.Failed() {
+				return fmt.Errorf("doctor found problems")
+			}
+			return nil
+		},
+	}
+	doctorCmd.Flags().String("bundle", "", "Also write a redacted diagnostics bundle (tar.gz) to this file")
+	doctorCmd.Flags().Bool("json", false, "Print the report as JSON")
+	return doctorCmd
+}
@@ -5,37 +5,52 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/vesaa/opentalon/internal/checks"
 	"github.com/vesaa/opentalon/internal/config"
-	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
 	"github.com/vesaa/opentalon/internal/scanner"
+	"github.com/vesaa/opentalon/internal/telemetry"
 )
 
 // RegisterPayload is sent once at startup to create/update the device record.
 type RegisterPayload struct {
-	Hostname    string             `json:"hostname"`
-	IP          string             `json:"ip"`
-	OS          string             `json:"os"`
-	GatewayIP   string             `json:"gateway_ip"`
-	Group       string             `json:"group"`
-	NetworkMode models.NetworkMode `json:"network_mode"`
-	ParentID    *uint              `json:"parent_id,omitempty"`
-	AgentVer    string             `json:"agent_ver"`
+	Hostname    string `json:"hostname"`
+	IP          string `json:"ip"`
+	OS          string `json:"os"`
+	GatewayIP   string `json:"gateway_ip"`
+	Group       string `json:"group"`
+	NetworkMode string `json:"network_mode"`
+	ParentID    *uint  `json:"parent_id,omitempty"`
+	AgentVer    string `json:"agent_ver"`
 	// LANIPs / WANIPs mirror Snapshot.LANIPs / Snapshot.WANIPs，方便 Server 做更精细的拓扑推导与展示。
 	LANIPs []string `json:"lan_ips,omitempty"`
 	WANIPs []string `json:"wan_ips,omitempty"`
+	// IPv6Addrs / GatewayIPv6 mirror the Snapshot fields.
+	IPv6Addrs   []string `json:"ipv6_addrs,omitempty"`
+	GatewayIPv6 string   `json:"gateway_ipv6,omitempty"`
+	// MachineID identifies the host across address changes (see machineid.go).
+	MachineID string `json:"machine_id,omitempty"`
 }
 
 // MetricsPayload wraps a Snapshot for HTTP transport.
 type MetricsPayload struct {
+	// SchemaVersion is metricsSchemaVersion: servers older than the agent
+	// keep the fields they do not know as custom metrics.
+	SchemaVersion  int     `json:"schema_version"`
 	Hostname       string  `json:"hostname"`
 	IP             string  `json:"ip"`
 	GatewayIP      string  `json:"gateway_ip"`
+	GatewayIPv6    string  `json:"gateway_ipv6,omitempty"`
 	CPUUsage       float64 `json:"cpu_usage"`
 	MemUsage       float64 `json:"mem_usage"`
 	MemTotal       uint64  `json:"mem_total"`
@@ -44,20 +59,92 @@ type MetricsPayload struct {
 	TxBytes        int64   `json:"tx_bytes"`
 	TCPConnections int     `json:"tcp_connections"`
 	UDPConnections int     `json:"udp_connections"`
+	Uptime         uint64  `json:"uptime"`    // seconds since boot
+	BootTime       int64   `json:"boot_time"` // unix seconds
+	// Temperatures carries per-sensor hardware temperatures (°C).
+	Temperatures []TemperatureReading `json:"temperatures,omitempty"`
+	// GPUs carries NVIDIA GPU utilization / VRAM / temperature when enabled.
+	GPUs []GPUReading `json:"gpus,omitempty"`
+	// Containers lists Docker containers on this host. null means the host has
+	// no Docker engine; an empty list means it has no containers (any more).
+	Containers []ContainerInfo `json:"containers"`
+	// Pods lists pods on this Kubernetes node; null when not a k8s node.
+	Pods []PodInfo `json:"pods"`
+
+	Processes []ProcessInfo `json:"processes,omitempty"`
+	Ports     []ListenPort  `json:"ports"`
+	// Interfaces lists the host's network interfaces.
+	Interfaces []NetInterface `json:"interfaces"`
+	// Neighbors lists LLDP / CDP neighbors; null when agent_lldp is off.
+	Neighbors []Neighbor `json:"neighbors"`
+	// Latency carries RTT / loss to the gateway, the server and an external target.
+	Latency []LatencyProbe `json:"latency,omitempty"`
+	// PublicIP is the WAN address seen by agent_public_ip_resolver; only
+	// root devices are asked to look it up.
+	PublicIP string `json:"public_ip,omitempty"`
+	// ClockOffsetMs is how far the local clock runs ahead of agent_ntp_server
+	// (negative: behind); nil until the first successful query.
+	ClockOffsetMs *float64 `json:"clock_offset_ms,omitempty"`
+	// DNS carries the results of resolving agent_dns_names.
+	DNS []DNSProbe `json:"dns,omitempty"`
+	// Peers carries the pings of the peers the server assigned; null when
+	// agent_peer_probes is off, so the server hands out no peers.
+	Peers []PeerProbe `json:"peers"`
+	// ReportTiming is how long the previous report took.
+	ReportTiming *ReportTiming `json:"report_timing,omitempty"`
+	// ServerOutage is set on the first report after reports failed.
+	ServerOutage *ServerOutage `json:"server_outage,omitempty"`
+	// IntervalSec is the report interval, so the server knows when the
+	// agent is overdue.
+	IntervalSec int `json:"interval_sec"`
+	// PreviousIP is set when the primary IP changed since the last report,
+	// so the server renumbers the device instead of adding a new one.
+	PreviousIP string `json:"previous_ip,omitempty"`
+	// MachineID is the host's identity, which the server prefers over IP to
+	// find the device (schema 4).
+	MachineID string `json:"machine_id,omitempty"`
+	// ARPTable carries the ARP / IPv6 neighbor caches when the server asked
+	// for them (gateway-class devices, for passive discovery).
+	ARPTable []scanner.Neighbor `json:"arp_table,omitempty"`
 }
 
+// metricsSchemaVersion is the version of MetricsPayload; bump it together
+// with the server's models.MetricsSchemaVersion when the payload gains
+// fields. The agent does not import models, which would link GORM into slim
+// builds.
+const metricsSchemaVersion = 4
+
 // agentVersion is set at build time via -ldflags "-X github.com/vesaa/opentalon/internal/agent.agentVersion=...".
 var agentVersion = "dev"
 
 // Run starts the agent main loop. It registers with the server data-plane, then
 // periodically collects and posts metrics.
 //
-// cfg.AgentJoinAddr is the data-plane address, e.g. "192.168.1.1:1616".
+// cfg.AgentJoinAddr is the data-plane address, e.g. "192.168.1.1:1616", or
+// "auto" to discover it via DNS SRV/TXT or mDNS (see join.go).
 // cfg.AgentOutboundToken is sent in every request as "Authorization: Bearer <token>".
 func Run(cfg *config.Config) error {
+	if strings.EqualFold(cfg.AgentJoinAddr, JoinAuto) {
+		cfg.AgentJoinAddr = discoverServer(cfg.AgentJoinDomain, cfg.DataPort, cfg.AgentJoinFingerprint)
+	}
 	base := fmt.Sprintf("http://%s", cfg.AgentJoinAddr)
-	collector := NewCollector()
+	if root := configureHostFS(cfg); root != "" {
+		fmt.Printf("[agent] container mode: reading host metrics from %s\n", root)
+	}
+	collector := NewCollector(cfg)
 	token := cfg.AgentOutboundToken
+	mid := machineID(cfg)
+
+	// A planned shutdown or reboot of the host is announced to the server
+	// on the way down (see shutdown_*.go).
+	var ipMu sync.Mutex
+	var currentIP, hostname string
+	go watchShutdown(func(kind, source string) {
+		ipMu.Lock()
+		n := ShutdownNotice{Hostname: hostname, IP: currentIP, Kind: kind, Source: source, MachineID: mid}
+		ipMu.Unlock()
+		announceShutdown(base, token, n, cfg.AgentDebugHTTP)
+	})
 
 	// Warmup: seed bandwidth baseline before first real report.
 	_, _ = collector.Collect()
@@ -81,11 +168,14 @@ func Run(cfg *config.Config) error {
 		OS:          snap.OS,
 		GatewayIP:   snap.GatewayIP,
 		Group:       cfg.AgentGroup,
-		NetworkMode: models.NetworkMode(cfg.AgentNetworkMode),
+		NetworkMode: cfg.AgentNetworkMode,
 		ParentID:    parentID,
 		AgentVer:    agentVersion,
 		LANIPs:      snap.LANIPs,
 		WANIPs:      snap.WANIPs,
+		IPv6Addrs:   snap.IPv6Addrs,
+		GatewayIPv6: snap.GatewayIPv6,
+		MachineID:   mid,
 	}
 
 	if err := postJSON(base+"/api/devices/register", token, reg, cfg.AgentDebugHTTP); err != nil {
@@ -94,6 +184,45 @@ func Run(cfg *config.Config) error {
 		fmt.Printf("[agent] registered as %s (%s) → server %s\n", snap.Hostname, snap.LocalIP, base)
 	}
 
+	// Synthetic checks assigned to this agent run in the background; the
+	// assignment list is refreshed from every metrics response.
+	runner := newCheckRunner()
+	ipMu.Lock()
+	currentIP, hostname = snap.LocalIP, snap.Hostname
+	ipMu.Unlock()
+	go runner.loop(base, token, mid, func() string {
+		ipMu.Lock()
+		defer ipMu.Unlock()
+		return currentIP
+	}, cfg.AgentDebugHTTP)
+
+	// Traceroutes to the server run on demand (traceroute=true in the metrics
+	// response) and optionally every agent_traceroute_interval_minutes.
+	serverHost, _, err := net.SplitHostPort(cfg.AgentJoinAddr)
+	if err != nil {
+		serverHost = cfg.AgentJoinAddr
+	}
+	var lastTrace time.Time
+	var publicIP backgroundLookup[string]
+	var clockOffset backgroundLookup[time.Duration]
+	var dnsResults backgroundLookup[[]DNSProbe]
+	var peerResults backgroundLookup[[]PeerProbe]
+	var peers []Peer
+	var outage *ServerOutage
+	var lastTiming *ReportTiming
+	var wantARP bool
+	// olderServerNoted is set once the server was found to read an older
+	// metrics schema, so that is logged once.
+	var olderServerNoted bool
+	// reportedIP is the address the server knows this host by.
+	reportedIP := snap.LocalIP
+	// jobs is cancelled when the server cancels the speed tests and
+	// traceroutes it handed out (cancel_tasks).
+	jobs, cancelJobs := context.WithCancel(context.Background())
+	if cfg.AgentMetricsListen != "" {
+		go serveMetrics(cfg.AgentMetricsListen)
+	}
+
 	// helper: send one metrics snapshot to server
 	reportOnce := func() {
 		snap, err := collector.Collect()
@@ -102,31 +231,108 @@ func Run(cfg *config.Config) error {
 			return
 		}
 
-		payload := MetricsPayload{
-			Hostname:       snap.Hostname,
-			IP:             snap.LocalIP,
-			GatewayIP:      snap.GatewayIP,
-			CPUUsage:       snap.CPUUsage,
-			MemUsage:       snap.MemUsage,
-			MemTotal:       snap.MemTotal,
-			DiskUsage:      snap.DiskUsage,
-			RxBytes:        snap.RxBytes,
-			TxBytes:        snap.TxBytes,
-			TCPConnections: snap.TCPConnections,
-			UDPConnections: snap.UDPConnections,
+		payload := newMetricsPayload(snap)
+		payload.IntervalSec = cfg.AgentInterval
+		payload.MachineID = mid
+		if snap.LocalIP != reportedIP {
+			payload.PreviousIP = reportedIP
+		}
+		payload.PublicIP, _ = publicIP.get()
+		if off, ok := clockOffset.get(); ok {
+			ms := float64(off.Microseconds()) / 1000
+			payload.ClockOffsetMs = &ms
+		}
+		payload.DNS, _ = dnsResults.take()
+		if cfg.AgentPeerProbes {
+			payload.Peers, _ = peerResults.take()
+			if payload.Peers == nil {
+				payload.Peers = []PeerProbe{}
+			}
+			// Peers are pinged while the server is unreachable too: that
+			// is when their answers matter.
+			if len(peers) > 0 {
+				list := peers
+				peerResults.refresh("peer probes", 0, cfg.AgentDebugHTTP, func() ([]PeerProbe, error) {
+					return peerProbes(list), nil
+				})
+			}
+		}
+		if outage != nil {
+			outage.Until = time.Now()
+			payload.ServerOutage = outage
+		}
+		if wantARP {
+			payload.ARPTable = scanner.NeighborTable()
 		}
+		payload.ReportTiming = lastTiming
+
+		ipMu.Lock()
+		currentIP = snap.LocalIP
+		ipMu.Unlock()
 
 		var metricsResp struct {
-			OK       bool `json:"ok"`
-			ScanTask bool `json:"scan_task"`
+			OK         bool                `json:"ok"`
+			ScanTask   bool                `json:"scan_task"`
+			Checks     []checks.Assignment `json:"checks"`
+			Traceroute bool                `json:"traceroute"`
+			PublicIP   bool                `json:"public_ip"`
+			SpeedTest  *SpeedTestRequest   `json:"speedtest"`
+			Peers      []Peer              `json:"peers"`
+			ARPTable   bool                `json:"arp_table"`
+			Cancel     bool                `json:"cancel_tasks"`
+			Schema     int                 `json:"schema_version"`
 		}
-		if err := postJSONResp(base+"/api/metrics", token, payload, &metricsResp, cfg.AgentDebugHTTP); err != nil {
+		var trace reportTrace
+		err = postJSONCtx(trace.context(context.Background()), base+"/api/metrics", token, payload, &metricsResp, cfg.AgentDebugHTTP)
+		exportSnapshot(snap, err == nil)
+		if err != nil {
 			fmt.Printf("[agent] report error: %v\n", err)
+			outage = outage.note(payload.Peers)
+			lastTiming = nil
 			return
 		}
+		lastTiming = trace.timing()
+		outage = nil
+		reportedIP = snap.LocalIP
+		if v := metricsResp.Schema; v < metricsSchemaVersion && !olderServerNoted {
+			olderServerNoted = true
+			if v == 0 {
+				v = 1
+			}
+			fmt.Printf("[agent] server reads metrics schema %d, agent sends %d: newer fields are kept as custom metrics\n", v, metricsSchemaVersion)
+		}
+		peers = metricsResp.Peers
+		wantARP = metricsResp.ARPTable && cfg.DiscoveryEnabled
+		if metricsResp.Cancel {
+			cancelJobs()
+			jobs, cancelJobs = context.WithCancel(context.Background())
+		}
+		runner.update(metricsResp.Checks)
 		if metricsResp.ScanTask && cfg.DiscoveryEnabled {
 			go runScan(base, token, snap.LocalIP, cfg.AgentDebugHTTP)
 		}
+		periodic := cfg.AgentTracerouteInterval > 0 &&
+			time.Since(lastTrace) >= time.Duration(cfg.AgentTracerouteInterval)*time.Minute
+		if metricsResp.Traceroute || periodic {
+			lastTrace = time.Now()
+			go runTraceroute(jobs, base, token, serverHost, snap.LocalIP, mid, cfg.AgentDebugHTTP)
+		}
+		if st := metricsResp.SpeedTest; st != nil {
+			go runSpeedTest(jobs, base, token, snap.LocalIP, mid, *st, cfg.AgentDebugHTTP)
+		}
+		if r := cfg.AgentPublicIPResolver; metricsResp.PublicIP && r != "" {
+			publicIP.refresh("public ip lookup via "+r, time.Duration(cfg.AgentPublicIPInterval)*time.Minute,
+				cfg.AgentDebugHTTP, func() (string, error) { return resolvePublicIP(r) })
+		}
+		if srv := cfg.AgentNTPServer; srv != "" {
+			clockOffset.refresh("ntp query to "+srv, time.Duration(cfg.AgentNTPInterval)*time.Minute,
+				cfg.AgentDebugHTTP, func() (time.Duration, error) { return SNTPOffset(srv) })
+		}
+		if len(cfg.AgentDNSNames) > 0 {
+			dnsResults.refresh("dns checks", 0, cfg.AgentDebugHTTP, func() ([]DNSProbe, error) {
+				return dnsProbes(cfg.AgentDNSNames, cfg.AgentDNSServers), nil
+			})
+		}
 	}
 
 	// Send first metrics immediately after registration so Web UI can show data
@@ -143,6 +349,37 @@ func Run(cfg *config.Config) error {
 	return nil
 }
 
+// newMetricsPayload carries the collected part of a report; the results of
+// background lookups and server requests are added by the caller.
+func newMetricsPayload(snap *Snapshot) MetricsPayload {
+	return MetricsPayload{
+		SchemaVersion:  metricsSchemaVersion,
+		Hostname:       snap.Hostname,
+		IP:             snap.LocalIP,
+		GatewayIP:      snap.GatewayIP,
+		GatewayIPv6:    snap.GatewayIPv6,
+		CPUUsage:       snap.CPUUsage,
+		MemUsage:       snap.MemUsage,
+		MemTotal:       snap.MemTotal,
+		DiskUsage:      snap.DiskUsage,
+		RxBytes:        snap.RxBytes,
+		TxBytes:        snap.TxBytes,
+		TCPConnections: snap.TCPConnections,
+		UDPConnections: snap.UDPConnections,
+		Uptime:         snap.Uptime,
+		BootTime:       snap.BootTime,
+		Temperatures:   snap.Temperatures,
+		GPUs:           snap.GPUs,
+		Containers:     snap.Containers,
+		Pods:           snap.Pods,
+		Processes:      snap.Processes,
+		Ports:          snap.Ports,
+		Interfaces:     snap.Interfaces,
+		Neighbors:      snap.Neighbors,
+		Latency:        snap.Latency,
+	}
+}
+
 // postJSON sends v as JSON via HTTP POST with Bearer token authentication.
 func postJSON(url, bearerToken string, v any, debug bool) error {
 	return postJSONResp(url, bearerToken, v, nil, debug)
@@ -150,6 +387,11 @@ func postJSON(url, bearerToken string, v any, debug bool) error {
 
 // postJSONResp sends v as JSON POST and optionally decodes the response body into out.
 func postJSONResp(url, bearerToken string, v any, out any, debug bool) error {
+	return postJSONCtx(context.Background(), url, bearerToken, v, out, debug)
+}
+
+// postJSONCtx is postJSONResp with a context, e.g. to trace the request.
+func postJSONCtx(ctx context.Context, url, bearerToken string, v any, out any, debug bool) error {
 	body, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -160,14 +402,14 @@ func postJSONResp(url, bearerToken string, v any, out any, debug bool) error {
 		fmt.Printf("[agent]   payload: %s\n", string(body))
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+bearerToken)
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := telemetry.HTTPClient(&http.Client{Timeout: 10 * time.Second, Transport: proxy.Transport(proxy.Report)})
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -0,0 +1,41 @@
+//go:build !slim
+
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/sensors"
+)
+
+// Slim is true in slim builds (go build -tags slim): agent-only binaries for
+// small routers without the temperature, GPU, Docker and Kubernetes
+// collectors.
+const Slim = false
+
+// temperatures reads hardware temperature sensors via gopsutil.
+// On Linux gopsutil may return partial results together with a Warnings error
+// (e.g. one unreadable hwmon file), so readings are kept whenever present.
+func temperatures() []TemperatureReading {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	stats, err := sensors.TemperaturesWithContext(ctx)
+	if err != nil && len(stats) == 0 {
+		return nil
+	}
+	out := make([]TemperatureReading, 0, len(stats))
+	for _, t := range stats {
+		// 部分虚拟机 / 驱动会给出 0 或明显异常的读数，直接丢弃。
+		if t.SensorKey == "" || t.Temperature <= 0 || t.Temperature > 150 {
+			continue
+		}
+		out = append(out, TemperatureReading{
+			SensorKey:   t.SensorKey,
+			Temperature: t.Temperature,
+			High:        t.High,
+			Critical:    t.Critical,
+		})
+	}
+	return out
+}
@@ -0,0 +1,11 @@
+//go:build slim
+
+package agent
+
+// Slim is true in slim builds (go build -tags slim): agent-only binaries for
+// small routers without the temperature, GPU, Docker and Kubernetes
+// collectors.
+const Slim = true
+
+// temperatures reads nothing in slim builds.
+func temperatures() []TemperatureReading { return nil }
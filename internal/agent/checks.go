@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/checks"
+)
+
+// checkRunner executes the synthetic checks assigned to this agent. The
+// assignment list arrives with every metrics response; each check then runs
+// on its own interval and results are posted to /api/checks/results.
+type checkRunner struct {
+	mu       sync.Mutex
+	assigned map[uint]checks.Assignment
+	lastRun  map[uint]time.Time
+	running  map[uint]bool
+}
+
+func newCheckRunner() *checkRunner {
+	return &checkRunner{
+		assigned: map[uint]checks.Assignment{},
+		lastRun:  map[uint]time.Time{},
+		running:  map[uint]bool{},
+	}
+}
+
+// update replaces the assignment set with the server's latest view. Checks
+// whose spec changed are re-run on the next tick.
+func (r *checkRunner) update(list []checks.Assignment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := make(map[uint]checks.Assignment, len(list))
+	for _, a := range list {
+		if old, ok := r.assigned[a.ID]; ok && old.Spec != a.Spec {
+			delete(r.lastRun, a.ID)
+		}
+		next[a.ID] = a
+	}
+	for id := range r.lastRun {
+		if _, ok := next[id]; !ok {
+			delete(r.lastRun, id)
+		}
+	}
+	r.assigned = next
+}
+
+// due returns the assignments whose interval elapsed and marks them running.
+func (r *checkRunner) due(now time.Time) []checks.Assignment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []checks.Assignment
+	for id, a := range r.assigned {
+		interval := time.Duration(a.IntervalSec) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		if r.running[id] || now.Sub(r.lastRun[id]) < interval {
+			continue
+		}
+		r.lastRun[id] = now
+		r.running[id] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+func (r *checkRunner) done(id uint) {
+	r.mu.Lock()
+	delete(r.running, id)
+	r.mu.Unlock()
+}
+
+// loop runs due checks every few seconds until the process exits.
+// localIP returns the agent's current primary IP, which with machineID
+// identifies the device.
+func (r *checkRunner) loop(base, token, machineID string, localIP func() string, debug bool) {
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		for _, a := range r.due(time.Now()) {
+			go func(a checks.Assignment) {
+				defer r.done(a.ID)
+				res := checks.Run(context.Background(), a)
+				payload := struct {
+					IP        string          `json:"ip"`
+					MachineID string          `json:"machine_id,omitempty"`
+					Results   []checks.Report `json:"results"`
+				}{IP: localIP(), MachineID: machineID, Results: []checks.Report{{CheckID: a.ID, Result: res}}}
+				if err := postJSON(base+"/api/checks/results", token, payload, debug); err != nil && debug {
+					fmt.Printf("[agent] check %d report error: %v\n", a.ID, err)
+				}
+			}(a)
+		}
+	}
+}
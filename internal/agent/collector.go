@@ -16,6 +16,8 @@ import (
 	"github.com/shirou/gopsutil/v4/host"
 	"github.com/shirou/gopsutil/v4/mem"
 	psnet "github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
+	"github.com/vesaa/opentalon/internal/config"
 )
 
 // Snapshot holds a single collection cycle's data.
@@ -30,8 +32,10 @@ type Snapshot struct {
 	DiskUsage      float64
 	TCPConnections int
 	UDPConnections int
-	RxBytes        int64 // bytes/s since last snapshot
-	TxBytes        int64 // bytes/s since last snapshot
+	RxBytes        int64  // bytes/s since last snapshot
+	TxBytes        int64  // bytes/s since last snapshot
+	Uptime         uint64 // seconds since boot
+	BootTime       int64  // unix seconds
 	CollectedAt    time.Time
 
 	// LANIPs holds all candidate "intranet" IPv4 addresses on this node
@@ -39,20 +43,74 @@ type Snapshot struct {
 	LANIPs []string
 	// WANIPs holds public / non-RFC1918 IPv4 addresses (典型为出口公网 IP)，仅用于展示。
 	WANIPs []string
+	// IPv6Addrs holds the IPv6 addresses, link-local ones included: routers
+	// usually advertise their link-local address as the v6 default gateway.
+	IPv6Addrs []string
+	// GatewayIPv6 is the next hop of the IPv6 default route.
+	GatewayIPv6 string
+
+	// Temperatures holds per-sensor hardware temperatures (CPU package, NVMe,
+	// chassis, ...). Empty on platforms / VMs without readable sensors.
+	Temperatures []TemperatureReading
+	// GPUs holds NVIDIA GPU samples; only collected when agent_gpu_enabled is set.
+	GPUs []GPUReading
+	// Containers lists local Docker containers; nil when no Docker socket exists.
+	Containers []ContainerInfo
+	// Pods lists pods on this Kubernetes node; nil when not a k8s node.
+	Pods []PodInfo
+	// Processes lists the top processes by CPU and memory.
+	Processes []ProcessInfo
+	// Ports lists listening TCP / UDP sockets.
+	Ports []ListenPort
+	// Interfaces lists the network interfaces with all their addresses.
+	Interfaces []NetInterface
+	// Neighbors lists LLDP / CDP neighbors; nil when agent_lldp is off.
+	Neighbors []Neighbor
+	// Latency holds RTT / loss to the gateway, the server and an external target.
+	Latency []LatencyProbe
+}
+
+// TemperatureReading is a single hardware sensor sample in degrees Celsius.
+type TemperatureReading struct {
+	SensorKey   string  `json:"sensor_key"`
+	Temperature float64 `json:"temperature"`
+	High        float64 `json:"high,omitempty"`
+	Critical    float64 `json:"critical,omitempty"`
 }
 
 // Collector gathers system metrics periodically.
 type Collector struct {
+	cfg *config.Config
+
 	mu          sync.Mutex
 	prevRx      uint64
 	prevTx      uint64
 	prevTime    time.Time
 	initialized bool
+
+	// procs keeps process handles between cycles for per-process CPU deltas.
+	procs map[int32]*process.Process
+
+	// probing is set while a latency probe round runs; latency holds the
+	// last finished round until the next snapshot takes it.
+	probing bool
+	latency []LatencyProbe
+
+	// lldp is nil when agent_lldp is off.
+	lldp *lldpCollector
 }
 
-// NewCollector creates a ready-to-use Collector.
-func NewCollector() *Collector {
-	return &Collector{}
+// NewCollector creates a ready-to-use Collector. cfg gates optional collectors
+// (e.g. GPU) and may be nil, in which case only the core metrics are gathered.
+func NewCollector(cfg *config.Config) *Collector {
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	c := &Collector{cfg: cfg}
+	if cfg.AgentLLDP {
+		c.lldp = &lldpCollector{}
+	}
+	return c
 }
 
 // Collect gathers the current system snapshot.
@@ -63,13 +121,30 @@ func (c *Collector) Collect() (*Snapshot, error) {
 	}
 
 	// Hostname
-	if h, err := os.Hostname(); err == nil {
-		snap.Hostname = h
-	}
+	snap.Hostname = hostname()
 
 	// Local IP + Gateway + LAN/WAN IP 集合
-	snap.LocalIP, snap.LANIPs, snap.WANIPs = classifyIPs()
+	snap.LocalIP, snap.LANIPs, snap.WANIPs, snap.IPv6Addrs = classifyIPs()
 	snap.GatewayIP = defaultGateway()
+	snap.GatewayIPv6 = defaultGatewayV6()
+
+	// Latency probes (gateway / server / external) run in the background so
+	// unreachable targets never delay the report; results lag one cycle.
+	// IPv6-only hosts probe their v6 gateway unless it is link-local, which
+	// would need the interface as zone.
+	probeGW := snap.GatewayIP
+	if ip := net.ParseIP(snap.GatewayIPv6); probeGW == "" && ip != nil && !ip.IsLinkLocalUnicast() {
+		probeGW = snap.GatewayIPv6
+	}
+	snap.Latency = c.takeLatency(probeGW)
+
+	// Boot time / uptime (from the host's /proc/stat btime in container mode)
+	if bt, err := host.BootTime(); err == nil && bt > 0 {
+		snap.BootTime = int64(bt)
+		if up := snap.CollectedAt.Unix() - int64(bt); up > 0 {
+			snap.Uptime = uint64(up)
+		}
+	}
 
 	// CPU
 	if pcts, err := cpu.Percent(500*time.Millisecond, false); err == nil && len(pcts) > 0 {
@@ -95,6 +170,49 @@ func (c *Collector) Collect() (*Snapshot, error) {
 	snap.RxBytes = rx
 	snap.TxBytes = tx
 
+	// Top-N processes by CPU / memory
+	if c.cfg.AgentTopProcesses > 0 {
+		snap.Processes = c.topProcesses(c.cfg.AgentTopProcesses)
+	}
+
+	// Listening ports (service inventory)
+	snap.Ports = listeningPorts()
+
+	// Network interfaces (NICs, bridges, bonds)
+	snap.Interfaces = netInterfaces()
+
+	// Switch ports and hosts at the other end of our links
+	if c.lldp != nil {
+		snap.Neighbors = c.lldp.neighbors()
+	}
+
+	// Hardware temperatures (best-effort)
+	snap.Temperatures = temperatures()
+
+	// NVIDIA GPUs (opt-in, skipped entirely on non-GPU devices)
+	if !Slim && c.cfg.AgentGPUEnabled {
+		snap.GPUs = gpuReadings()
+	}
+
+	// Slim builds do not look for containers and pods.
+	if Slim {
+		return snap, nil
+	}
+
+	// Docker containers (only when the engine socket is present)
+	if dc := newDockerClient(c.cfg.AgentDockerSocket); dc != nil {
+		if list, err := dc.containers(); err == nil {
+			snap.Containers = list
+		}
+	}
+
+	// Kubernetes pods (only on k8s / k3s nodes)
+	if kc := newKubeletClient(c.cfg); kc != nil {
+		if list, err := kc.pods(); err == nil {
+			snap.Pods = list
+		}
+	}
+
 	return snap, nil
 }
 
@@ -115,12 +233,14 @@ func detailedOS() string {
 // classifyIPs 遍历所有网卡，把 IPv4 地址划分为：
 //   - LANIPs: RFC1918 私网地址（排除常见虚拟/隧道网卡）
 //   - WANIPs: 其他非回环 IPv4（常用于公网/出口）
+// IPv6 地址（含链路本地地址）单独放在 v6 中。
 // 返回值中的 primaryLAN 则作为 "主 IP" 在 UI 中展示。
-func classifyIPs() (primaryLAN string, lanIPs []string, wanIPs []string) {
+func classifyIPs() (primaryLAN string, lanIPs, wanIPs, v6 []string) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return "", nil, nil
+		return "", nil, nil, nil
 	}
+	var primaryV6 string
 	for _, iface := range ifaces {
 		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
 			continue
@@ -137,10 +257,17 @@ func classifyIPs() (primaryLAN string, lanIPs []string, wanIPs []string) {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-			if ip == nil || ip.To4() == nil || ip.IsLoopback() {
+			if ip == nil || ip.IsLoopback() {
 				continue
 			}
 			ipStr := ip.String()
+			if ip.To4() == nil {
+				v6 = append(v6, ipStr)
+				if primaryV6 == "" && !ip.IsLinkLocalUnicast() {
+					primaryV6 = ipStr
+				}
+				continue
+			}
 			if isPrivateIPv4(ip) {
 				lanIPs = append(lanIPs, ipStr)
 				// 选第一个私网地址作为 primaryLAN（后续可根据接口名再做细分）
@@ -156,7 +283,11 @@ func classifyIPs() (primaryLAN string, lanIPs []string, wanIPs []string) {
 	if primaryLAN == "" && len(wanIPs) > 0 {
 		primaryLAN = wanIPs[0]
 	}
-	return primaryLAN, lanIPs, wanIPs
+	// 纯 IPv6 主机：使用第一个全局 / ULA 地址
+	if primaryLAN == "" {
+		primaryLAN = primaryV6
+	}
+	return primaryLAN, lanIPs, wanIPs, v6
 }
 
 // isVirtualInterface 依据接口名称粗略判断是否为虚拟/隧道设备，
@@ -208,7 +339,7 @@ func defaultGateway() string {
 
 // gatewayLinux reads /proc/net/route (kernel routing table) efficiently.
 func gatewayLinux() string {
-	data, err := os.ReadFile("/proc/net/route")
+	data, err := os.ReadFile(procPath("net/route"))
 	if err != nil {
 		return ""
 	}
@@ -236,6 +367,44 @@ func gatewayLinux() string {
 	return ""
 }
 
+// defaultGatewayV6 returns the next hop of the IPv6 default route. Only
+// Linux is supported (/proc/net/ipv6_route); elsewhere it returns "".
+func defaultGatewayV6() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	data, err := os.ReadFile(procPath("net/ipv6_route"))
+	if err != nil {
+		return ""
+	}
+	const zero = "00000000000000000000000000000000"
+	for _, line := range strings.Split(string(data), "\n") {
+		// dest prefix_len src src_prefix_len next_hop metric refcnt use flags iface
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[0] != zero || fields[1] != "00" || fields[4] == zero {
+			continue
+		}
+		if ip := parseHexIPv6(fields[4]); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// parseHexIPv6 decodes the 32-digit hex form used in /proc/net/ipv6_route.
+func parseHexIPv6(h string) net.IP {
+	if len(h) != 32 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i := range ip {
+		if _, err := fmt.Sscanf(h[i*2:i*2+2], "%02x", &ip[i]); err != nil {
+			return nil
+		}
+	}
+	return ip
+}
+
 // gatewayWindows uses gopsutil's route helpers on Windows.
 // Falls back to a simple ipconfig parse.
 func gatewayWindows() string {
@@ -264,7 +433,7 @@ func maxDiskUsage() float64 {
 	}
 	var max float64
 	for _, p := range partitions {
-		usage, err := disk.Usage(p.Mountpoint)
+		usage, err := disk.Usage(hostMountpoint(p.Mountpoint))
 		if err != nil {
 			continue
 		}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSSystem labels probes that went through the host's configured resolver.
+const DNSSystem = "system"
+
+// dnsProbeTimeout bounds one lookup (both queries against a specific server).
+const dnsProbeTimeout = 3 * time.Second
+
+// DNSProbe is the result of resolving one name against one server.
+type DNSProbe struct {
+	Name   string   `json:"name"`
+	Server string   `json:"server"` // "system" or the queried server address
+	OK     bool     `json:"ok"`
+	RTTMs  float64  `json:"rtt_ms"`
+	Addrs  []string `json:"addrs,omitempty"`
+	// Error is "nxdomain", "timeout" or the resolver error; "" when OK.
+	Error string `json:"error,omitempty"`
+}
+
+// errNXDomain is returned by queryDNS for a name that does not exist.
+var errNXDomain = errors.New("nxdomain")
+
+// queryDNS asks server directly for the A (then AAAA) records of name. Going
+// through net.Resolver would answer names like localhost from /etc/hosts
+// without ever contacting the server under test.
+func queryDNS(ctx context.Context, server, name string) ([]string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	fqdn, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		id := uint16(rand.Uint32())
+		msg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: fqdn, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		req, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 1232)
+		var resp dnsmessage.Message
+		for resp.ID != id || !resp.Response {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if resp.Unpack(buf[:n]) != nil {
+				resp = dnsmessage.Message{}
+			}
+		}
+		switch resp.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, errNXDomain
+		default:
+			return nil, fmt.Errorf("server answered %s", resp.RCode)
+		}
+		var addrs []string
+		for _, a := range resp.Answers {
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(r.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(r.AAAA[:]).String())
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, nil
+}
+
+// probeDNS resolves name once, through the host resolver when server is
+// "system", and classifies the outcome.
+func probeDNS(name, server string) DNSProbe {
+	p := DNSProbe{Name: name, Server: server}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	var addrs []string
+	var err error
+	if server == DNSSystem {
+		addrs, err = net.DefaultResolver.LookupHost(ctx, name)
+	} else {
+		addrs, err = queryDNS(ctx, server, name)
+	}
+	p.RTTMs = float64(time.Since(start).Microseconds()) / 1000
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil && len(addrs) > 0:
+		p.OK = true
+		if len(addrs) > 4 {
+			addrs = addrs[:4]
+		}
+		p.Addrs = addrs
+	case err == nil:
+		p.Error = "no addresses"
+	case errors.Is(err, errNXDomain), errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		p.Error = "nxdomain"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		p.Error = "timeout"
+	default:
+		p.Error = err.Error()
+	}
+	return p
+}
+
+// dnsProbes resolves every name against the system resolver and each of
+// servers concurrently.
+func dnsProbes(names, servers []string) []DNSProbe {
+	targets := append([]string{DNSSystem}, servers...)
+	out := make([]DNSProbe, len(names)*len(targets))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		for j, srv := range targets {
+			wg.Add(1)
+			go func(k int, name, srv string) {
+				defer wg.Done()
+				out[k] = probeDNS(name, srv)
+			}(i*len(targets)+j, name, srv)
+		}
+	}
+	wg.Wait()
+	return out
+}
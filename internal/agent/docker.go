@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContainerInfo describes one Docker container on this host.
+type ContainerInfo struct {
+	ID       string  `json:"id"` // short (12 char) container ID
+	Name     string  `json:"name"`
+	Image    string  `json:"image"`
+	State    string  `json:"state"` // running / exited / paused / ...
+	Status   string  `json:"status"`
+	IP       string  `json:"ip,omitempty"`
+	CPUUsage float64 `json:"cpu_usage"` // percent of total host CPU, 0-100
+	MemUsage uint64  `json:"mem_usage"` // bytes, excluding page cache
+	MemLimit uint64  `json:"mem_limit"` // bytes
+}
+
+// dockerClient talks to the Docker Engine API over its unix socket.
+type dockerClient struct {
+	http *http.Client
+}
+
+// newDockerClient returns a client for the given socket path, or nil when the
+// socket does not exist (Docker not installed / not running).
+func newDockerClient(socket string) *dockerClient {
+	if runtime.GOOS == "windows" || socket == "" {
+		return nil
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{http: &http.Client{Transport: tr, Timeout: 10 * time.Second}}
+}
+
+// get performs GET http://docker<path> and decodes the JSON body into out.
+func (d *dockerClient) get(path string, out any) error {
+	resp, err := d.http.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("docker %s: status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dockerContainer is the subset of GET /containers/json we use.
+type dockerContainer struct {
+	ID              string   `json:"Id"`
+	Names           []string `json:"Names"`
+	Image           string   `json:"Image"`
+	State           string   `json:"State"`
+	Status          string   `json:"Status"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerStats is the subset of GET /containers/{id}/stats?stream=false we use.
+type dockerStats struct {
+	CPUStats    dockerCPUStats `json:"cpu_stats"`
+	PreCPUStats dockerCPUStats `json:"precpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Limit uint64            `json:"limit"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+}
+
+type dockerCPUStats struct {
+	CPUUsage struct {
+		TotalUsage uint64 `json:"total_usage"`
+	} `json:"cpu_usage"`
+	SystemUsage uint64 `json:"system_cpu_usage"`
+}
+
+// containers lists all containers and, for running ones, samples CPU/memory.
+func (d *dockerClient) containers() ([]ContainerInfo, error) {
+	var list []dockerContainer
+	if err := d.get("/containers/json?all=1", &list); err != nil {
+		return nil, err
+	}
+	out := make([]ContainerInfo, len(list))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	for i, c := range list {
+		info := ContainerInfo{
+			ID:     shortID(c.ID),
+			Name:   strings.TrimPrefix(firstOr(c.Names, c.ID), "/"),
+			Image:  c.Image,
+			State:  c.State,
+			Status: c.Status,
+		}
+		for _, n := range c.NetworkSettings.Networks {
+			if n.IPAddress != "" {
+				info.IP = n.IPAddress
+				break
+			}
+		}
+		out[i] = info
+		if c.State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var st dockerStats
+			// stream=false makes the daemon take two samples ~1s apart so that
+			// precpu_stats is populated and a CPU percentage can be derived.
+			if err := d.get("/containers/"+id+"/stats?stream=false", &st); err != nil {
+				return
+			}
+			out[i].CPUUsage = containerCPUPercent(&st)
+			out[i].MemUsage, out[i].MemLimit = containerMemory(&st)
+		}(i, c.ID)
+	}
+	wg.Wait()
+	return out, nil
+}
+
+// containerCPUPercent returns the container's share of total host CPU time
+// between the two samples (0-100). Unlike `docker stats` it is not multiplied
+// by the CPU count, so it is directly comparable with the host cpu_usage.
+func containerCPUPercent(st *dockerStats) float64 {
+	cpuDelta := float64(st.CPUStats.CPUUsage.TotalUsage) - float64(st.PreCPUStats.CPUUsage.TotalUsage)
+	sysDelta := float64(st.CPUStats.SystemUsage) - float64(st.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || sysDelta <= 0 {
+		return 0
+	}
+	return cpuDelta / sysDelta * 100
+}
+
+// containerMemory returns (used, limit) bytes. Like `docker stats`, page cache
+// is subtracted: "inactive_file" on cgroup v2, "cache" on cgroup v1.
+func containerMemory(st *dockerStats) (uint64, uint64) {
+	used := st.MemoryStats.Usage
+	cache := st.MemoryStats.Stats["inactive_file"]
+	if cache == 0 {
+		cache = st.MemoryStats.Stats["cache"]
+	}
+	if cache < used {
+		used -= cache
+	}
+	return used, st.MemoryStats.Limit
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func firstOr(list []string, fallback string) string {
+	if len(list) > 0 {
+		return list[0]
+	}
+	return fallback
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exported is the latest snapshot, served at /metrics when
+// agent_metrics_listen is set so an existing Prometheus can keep scraping
+// the host while it moves to OpenTalon.
+var exported struct {
+	sync.Mutex
+	snap *Snapshot
+	// reported tells whether the snapshot reached the server.
+	reported bool
+}
+
+// exportSnapshot makes snap what /metrics serves.
+func exportSnapshot(snap *Snapshot, reported bool) {
+	exported.Lock()
+	exported.snap, exported.reported = snap, reported
+	exported.Unlock()
+}
+
+// serveMetrics serves the latest snapshot in the Prometheus text format on
+// addr. Families node_exporter also has keep its names and labels, so
+// dashboards and rules built on it read them unchanged; the rest are
+// opentalon_*.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		exported.Lock()
+		snap, reported := exported.snap, exported.reported
+		exported.Unlock()
+		if snap == nil {
+			http.Error(w, "no snapshot collected yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, promText(snap, reported))
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("[agent] serving metrics at http://%s/metrics\n", addr)
+	if err := srv.ListenAndServe(); err != nil {
+		fmt.Printf("[agent] metrics endpoint: %v\n", err)
+	}
+}
+
+// promWriter writes gauges, each family's header once before its first
+// sample.
+type promWriter struct {
+	b    strings.Builder
+	seen map[string]bool
+}
+
+func (p *promWriter) gauge(name, help string, v float64, kv ...string) {
+	if p.seen == nil {
+		p.seen = map[string]bool{}
+	}
+	if !p.seen[name] {
+		p.seen[name] = true
+		fmt.Fprintf(&p.b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	p.b.WriteString(name)
+	if len(kv) > 0 {
+		parts := make([]string, 0, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			val := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+			parts = append(parts, kv[i]+`="`+val+`"`)
+		}
+		p.b.WriteString("{" + strings.Join(parts, ",") + "}")
+	}
+	p.b.WriteString(" ")
+	switch {
+	case math.IsNaN(v):
+		p.b.WriteString("NaN")
+	case math.IsInf(v, 0):
+		if v > 0 {
+			p.b.WriteString("+Inf")
+		} else {
+			p.b.WriteString("-Inf")
+		}
+	default:
+		p.b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	p.b.WriteString("\n")
+}
+
+// promText renders snap. Families with a sample per item are written
+// family by family, as the text format requires.
+func promText(snap *Snapshot, reported bool) string {
+	var p promWriter
+	p.gauge("node_time_seconds", "System time in seconds since epoch (1970).", float64(snap.CollectedAt.UnixMilli())/1000)
+	p.gauge("node_boot_time_seconds", "Node boot time, in unixtime.", float64(snap.BootTime))
+	p.gauge("node_memory_MemTotal_bytes", "Memory information field MemTotal_bytes.", float64(snap.MemTotal))
+	for _, t := range snap.Temperatures {
+		p.gauge("node_hwmon_temp_celsius", "Hardware monitor for temperature (input)", t.Temperature, "sensor", t.SensorKey)
+	}
+	for _, n := range snap.Interfaces {
+		up := 0.0
+		if n.State == "up" {
+			up = 1
+		}
+		p.gauge("node_network_up", "Value is 1 if operstate is 'up', 0 otherwise.", up, "device", n.Name)
+	}
+	for _, n := range snap.Interfaces {
+		p.gauge("node_network_mtu_bytes", "Network device property: mtu_bytes", float64(n.MTU), "device", n.Name)
+	}
+	for _, n := range snap.Interfaces {
+		if n.SpeedMbps > 0 {
+			p.gauge("node_network_speed_bytes", "Network device property: speed_bytes", float64(n.SpeedMbps)*125000, "device", n.Name)
+		}
+	}
+
+	p.gauge("opentalon_cpu_usage_percent", "CPU usage.", snap.CPUUsage)
+	p.gauge("opentalon_memory_usage_percent", "Memory usage.", snap.MemUsage)
+	p.gauge("opentalon_disk_usage_percent", "Usage of the fullest mount.", snap.DiskUsage)
+	p.gauge("opentalon_network_receive_bytes_per_second", "Ingress rate.", float64(snap.RxBytes))
+	p.gauge("opentalon_network_transmit_bytes_per_second", "Egress rate.", float64(snap.TxBytes))
+	p.gauge("opentalon_tcp_connections", "Open TCP connections.", float64(snap.TCPConnections))
+	p.gauge("opentalon_udp_connections", "Open UDP sockets.", float64(snap.UDPConnections))
+	p.gauge("opentalon_uptime_seconds", "Time since boot.", float64(snap.Uptime))
+	for _, l := range snap.Latency {
+		if l.Received > 0 {
+			p.gauge("opentalon_latency_rtt_seconds", "Average RTT to the probe target.", l.RTTAvg/1000, "target", l.Target, "addr", l.Addr)
+		}
+	}
+	for _, l := range snap.Latency {
+		p.gauge("opentalon_latency_loss_ratio", "Packet loss to the probe target.", l.LossPct/100, "target", l.Target, "addr", l.Addr)
+	}
+	for _, g := range snap.GPUs {
+		p.gauge("opentalon_gpu_utilization_percent", "GPU utilization.", g.Utilization, "gpu", strconv.Itoa(g.Index), "name", g.Name)
+	}
+	for _, g := range snap.GPUs {
+		p.gauge("opentalon_gpu_memory_used_bytes", "GPU memory in use.", float64(g.MemUsed), "gpu", strconv.Itoa(g.Index), "name", g.Name)
+	}
+	for _, g := range snap.GPUs {
+		p.gauge("opentalon_gpu_temperature_celsius", "GPU temperature.", g.Temperature, "gpu", strconv.Itoa(g.Index), "name", g.Name)
+	}
+	ok := 0.0
+	if reported {
+		ok = 1
+	}
+	p.gauge("opentalon_agent_report_success", "Whether the snapshot reached the OpenTalon server.", ok)
+	return p.b.String()
+}
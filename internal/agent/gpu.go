@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"encoding/csv"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GPUReading is a single NVIDIA GPU sample.
+type GPUReading struct {
+	Index       int     `json:"index"`
+	Name        string  `json:"name"`
+	Utilization float64 `json:"utilization"` // percent 0-100
+	MemUsed     uint64  `json:"mem_used"`    // bytes
+	MemTotal    uint64  `json:"mem_total"`   // bytes
+	Temperature float64 `json:"temperature"` // °C
+}
+
+// nvidiaSMIQuery is the field list passed to nvidia-smi --query-gpu; the order
+// must match parseNvidiaSMI.
+const nvidiaSMIQuery = "index,name,utilization.gpu,memory.used,memory.total,temperature.gpu"
+
+// gpuReadings queries all NVIDIA GPUs through nvidia-smi. It returns nil when
+// nvidia-smi is missing or fails, so hosts without a GPU simply report nothing.
+func gpuReadings() []GPUReading {
+	bin, err := exec.LookPath("nvidia-smi")
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, bin,
+		"--query-gpu="+nvidiaSMIQuery, "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil
+	}
+	return parseNvidiaSMI(string(out))
+}
+
+// parseNvidiaSMI parses `nvidia-smi --query-gpu=... --format=csv,noheader,nounits`
+// output, e.g.:
+//
+//	0, NVIDIA GeForce RTX 3060, 12, 1024, 12288, 45
+//
+// Memory values are reported in MiB and converted to bytes. Fields reported as
+// "[N/A]" (common on passthrough / datacenter cards) are left as zero.
+func parseNvidiaSMI(output string) []GPUReading {
+	r := csv.NewReader(strings.NewReader(output))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil
+	}
+	var list []GPUReading
+	for _, f := range records {
+		if len(f) < 6 {
+			continue
+		}
+		g := GPUReading{Name: strings.TrimSpace(f[1])}
+		g.Index, _ = strconv.Atoi(strings.TrimSpace(f[0]))
+		g.Utilization, _ = strconv.ParseFloat(strings.TrimSpace(f[2]), 64)
+		if mib, err := strconv.ParseUint(strings.TrimSpace(f[3]), 10, 64); err == nil {
+			g.MemUsed = mib << 20
+		}
+		if mib, err := strconv.ParseUint(strings.TrimSpace(f[4]), 10, 64); err == nil {
+			g.MemTotal = mib << 20
+		}
+		g.Temperature, _ = strconv.ParseFloat(strings.TrimSpace(f[5]), 64)
+		list = append(list, g)
+	}
+	return list
+}
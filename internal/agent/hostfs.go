@@ -0,0 +1,127 @@
+package agent
+
+// Container mode
+//
+// The agent can run as a container (Docker, or a Kubernetes DaemonSet) and
+// still report the metrics of the host rather than of its own cgroup. The
+// host's root filesystem is bind-mounted read-only (conventionally at /host)
+// and the collector reads /proc, /sys and /etc from below it; the container
+// must share the host network (and PID namespace, for process / port
+// ownership) so interface addresses, bandwidth and sockets are the host's.
+//
+//	docker run -d --name opentalon-agent --restart=always \
+//	  --network host --pid host \
+//	  -v /:/host:ro,rslave \
+//	  -v /var/run/docker.sock:/var/run/docker.sock:ro \
+//	  -e TALON_AGENT_JOIN_ADDR=192.168.1.1:1616 \
+//	  -e TALON_AGENT_OUTBOUND_TOKEN=<token> \
+//	  -e TALON_AGENT_HOST_ROOT=/host \
+//	  opentalon agent
+//
+// In a DaemonSet the same is achieved with hostNetwork: true, hostPID: true
+// and a hostPath volume for "/" mounted at /host. Every config key can be
+// given as a TALON_<KEY> environment variable, so no config file is needed.
+//
+// When agent_host_root is empty but the agent detects it runs in a container
+// and /host/proc exists, /host is used automatically. agent_host_proc,
+// agent_host_sys and agent_host_etc override the individual paths, e.g. when
+// only /proc and /sys are mounted.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vesaa/opentalon/internal/config"
+)
+
+// defaultHostMount is where container deployments conventionally mount the host root.
+const defaultHostMount = "/host"
+
+// hostFS holds the resolved host filesystem locations; zero value = bare metal.
+var hostFS struct {
+	root, proc, etc string
+}
+
+// inContainer reports whether the agent process itself runs in a container.
+func inContainer() bool {
+	for _, p := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// configureHostFS resolves the host paths from cfg and exports them through
+// the HOST_* environment variables understood by gopsutil, so every
+// collector reads host data. It returns the host root in use ("" = none).
+func configureHostFS(cfg *config.Config) string {
+	root := strings.TrimRight(cfg.AgentHostRoot, "/")
+	if root == "" && inContainer() {
+		if _, err := os.Stat(filepath.Join(defaultHostMount, "proc", "1")); err == nil {
+			root = defaultHostMount
+		}
+	}
+	pick := func(override, sub string) string {
+		if override != "" {
+			return override
+		}
+		if root != "" {
+			return filepath.Join(root, sub)
+		}
+		return ""
+	}
+	proc := pick(cfg.AgentHostProc, "proc")
+	sys := pick(cfg.AgentHostSys, "sys")
+	etc := pick(cfg.AgentHostEtc, "etc")
+	if proc == "" && sys == "" && etc == "" {
+		return ""
+	}
+
+	env := map[string]string{"HOST_PROC": proc, "HOST_SYS": sys, "HOST_ETC": etc}
+	if root != "" {
+		env["HOST_ROOT"] = root
+		env["HOST_VAR"] = filepath.Join(root, "var")
+		env["HOST_RUN"] = filepath.Join(root, "run")
+		env["HOST_DEV"] = filepath.Join(root, "dev")
+	}
+	for k, v := range env {
+		if v != "" && os.Getenv(k) == "" {
+			_ = os.Setenv(k, v)
+		}
+	}
+	hostFS.root, hostFS.proc, hostFS.etc = root, proc, etc
+	return root
+}
+
+// procPath returns the path of a /proc entry, using PID 1's view (the host's
+// network namespace) when running in container mode.
+func procPath(name string) string {
+	if hostFS.proc == "" {
+		return filepath.Join("/proc", name)
+	}
+	return filepath.Join(hostFS.proc, "1", name)
+}
+
+// hostMountpoint maps a host mount point to where it is visible to the agent.
+func hostMountpoint(mp string) string {
+	if hostFS.root == "" {
+		return mp
+	}
+	return filepath.Join(hostFS.root, mp)
+}
+
+// hostname returns the host's name, preferring <host etc>/hostname in
+// container mode where os.Hostname may return the container ID.
+func hostname() string {
+	if hostFS.etc != "" {
+		if b, err := os.ReadFile(filepath.Join(hostFS.etc, "hostname")); err == nil {
+			if h := strings.TrimSpace(string(b)); h != "" {
+				return h
+			}
+		}
+	}
+	h, _ := os.Hostname()
+	return h
+}
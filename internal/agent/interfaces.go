@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// NetInterface is one network interface of the host, e.g. a PVE bridge
+// (vmbr0) or a router's WAN / LAN port.
+type NetInterface struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac"`
+	// IPs are the addresses in CIDR notation, IPv4 first.
+	IPs []string `json:"ips"`
+	MTU int      `json:"mtu"`
+	// SpeedMbps is the negotiated link speed; 0 when unknown (Wi-Fi,
+	// bridges, non-Linux hosts).
+	SpeedMbps int `json:"speed_mbps"`
+	// State is the operational state: up / down / dormant / unknown, ...
+	State string `json:"state"`
+}
+
+// netInterfaces lists the host's interfaces, leaving out loopback and the
+// container / tunnel plumbing isVirtualInterface filters from the LAN IPs.
+func netInterfaces() []NetInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	out := []NetInterface{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+		ni := NetInterface{
+			Name:      iface.Name,
+			MAC:       iface.HardwareAddr.String(),
+			IPs:       []string{},
+			MTU:       iface.MTU,
+			SpeedMbps: linkSpeed(iface.Name),
+			State:     operState(iface),
+		}
+		addrs, _ := iface.Addrs()
+		var v6 []string
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipn.IP.To4() != nil {
+				ni.IPs = append(ni.IPs, ipn.String())
+			} else {
+				v6 = append(v6, ipn.String())
+			}
+		}
+		ni.IPs = append(ni.IPs, v6...)
+		out = append(out, ni)
+	}
+	return out
+}
+
+// sysNetPath returns /sys/class/net/<name>/<attr>. With host networking the
+// container's own sysfs already shows the host's interfaces.
+func sysNetPath(name, attr string) string {
+	return filepath.Join("/sys/class/net", name, attr)
+}
+
+// linkSpeed reads the link speed in Mbit/s on Linux; the kernel reports -1
+// (or fails the read) for links without one.
+func linkSpeed(name string) int {
+	if runtime.GOOS != "linux" {
+		return 0
+	}
+	b, err := os.ReadFile(sysNetPath(name, "speed"))
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// operState returns the kernel's operstate on Linux and falls back to the
+// administrative up / down flag elsewhere.
+func operState(iface net.Interface) string {
+	if runtime.GOOS == "linux" {
+		if b, err := os.ReadFile(sysNetPath(iface.Name, "operstate")); err == nil {
+			if s := strings.TrimSpace(string(b)); s != "" {
+				return s
+			}
+		}
+	}
+	if iface.Flags&net.FlagUp != 0 {
+		return "up"
+	}
+	return "down"
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/mdns"
+)
+
+// JoinAuto as agent_join_addr (--join auto) makes the agent look for its
+// server instead of using a fixed address.
+const JoinAuto = "auto"
+
+// joinService is the DNS-SD service type of the server's data plane.
+const joinService = "_opentalon._tcp"
+
+// discoverServer finds the server's data-plane address, retrying with
+// backoff until it does: devices often boot before the server or the
+// network is up. A non-empty fingerprint must match the one the server
+// reports on /healthz.
+func discoverServer(domain string, dataPort int, fingerprint string) string {
+	wait := 5 * time.Second
+	for {
+		addr, via, err := findServer(domain, dataPort, fingerprint)
+		if err == nil && fingerprint != "" {
+			err = checkFingerprint(addr, fingerprint)
+		}
+		if err == nil {
+			fmt.Printf("[agent] found server %s via %s\n", addr, via)
+			return addr
+		}
+		fmt.Printf("[agent] server discovery: %v; retrying in %s\n", err, wait)
+		time.Sleep(wait)
+		if wait < time.Minute {
+			wait *= 2
+		}
+	}
+}
+
+// findServer tries, for domain and each search domain of the host, a DNS
+// SRV record _opentalon._tcp.<domain>, then a TXT record of the same name
+// holding "addr=host[:port]"; then it browses mDNS on the LAN, skipping
+// servers that advertise another fingerprint. via names the record that
+// answered.
+func findServer(domain string, dataPort int, fingerprint string) (addr, via string, err error) {
+	domains := searchDomains(domain)
+	for _, d := range domains {
+		name := joinService + "." + d
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err == nil && len(srvs) > 0 {
+			cancel()
+			host := strings.TrimSuffix(srvs[0].Target, ".")
+			return net.JoinHostPort(host, strconv.Itoa(int(srvs[0].Port))), "DNS SRV " + name, nil
+		}
+		txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+		cancel()
+		if err != nil {
+			continue
+		}
+		for _, t := range txts {
+			if a := txtJoinAddr(t, dataPort); a != "" {
+				return a, "DNS TXT " + name, nil
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	svcs, err := mdns.Browse(ctx, joinService)
+	if err != nil {
+		return "", "", fmt.Errorf("mdns: %w", err)
+	}
+	for _, s := range svcs {
+		if fingerprint != "" && !slices.Contains(s.TXT, "fp="+fingerprint) {
+			continue
+		}
+		return net.JoinHostPort(s.IPs[0].String(), strconv.Itoa(s.Port)), "mDNS " + s.Instance, nil
+	}
+	if len(domains) == 0 {
+		return "", "", fmt.Errorf("no DNS search domain to look up %s in and no mDNS answer", joinService)
+	}
+	return "", "", fmt.Errorf("no %s SRV/TXT record in %s and no mDNS answer", joinService, strings.Join(domains, ", "))
+}
+
+// checkFingerprint asks the server at addr for its fingerprint.
+func checkFingerprint(addr, want string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s/healthz: %w", addr, err)
+	}
+	if body.Fingerprint != want {
+		return fmt.Errorf("server %s has fingerprint %q, want %q", addr, body.Fingerprint, want)
+	}
+	return nil
+}
+
+// txtJoinAddr parses a TXT string "addr=host[:port]" (or a bare
+// "host[:port]") into a data-plane address; other key=value strings are
+// ignored.
+func txtJoinAddr(txt string, dataPort int) string {
+	txt = strings.TrimSpace(txt)
+	if k, v, ok := strings.Cut(txt, "="); ok {
+		if !strings.EqualFold(k, "addr") {
+			return ""
+		}
+		txt = strings.TrimSpace(v)
+	}
+	if txt == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(txt); err != nil {
+		return net.JoinHostPort(txt, strconv.Itoa(dataPort))
+	}
+	return txt
+}
+
+// searchDomains returns domain (agent_join_domain) followed by the search
+// and domain entries of /etc/resolv.conf, without duplicates.
+func searchDomains(domain string) []string {
+	var out []string
+	seen := map[string]bool{}
+	add := func(d string) {
+		d = strings.Trim(strings.ToLower(d), ".")
+		if d != "" && !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	add(domain)
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return out
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || (fields[0] != "search" && fields[0] != "domain") {
+			continue
+		}
+		for _, d := range fields[1:] {
+			add(d)
+		}
+	}
+	return out
+}
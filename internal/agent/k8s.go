@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/config"
+)
+
+// PodInfo describes one pod running on this Kubernetes node.
+type PodInfo struct {
+	Namespace string  `json:"namespace"`
+	Name      string  `json:"name"`
+	UID       string  `json:"uid"`
+	Phase     string  `json:"phase"` // Pending / Running / Succeeded / Failed / Unknown
+	IP        string  `json:"ip,omitempty"`
+	Restarts  int     `json:"restarts"`
+	CPUMilli  float64 `json:"cpu_milli"` // millicores currently used
+	MemUsage  uint64  `json:"mem_usage"` // working set bytes
+}
+
+// k3s ships an admin client certificate accepted by its kubelet; it is used
+// automatically on single-node k3s boxes when no cert is configured.
+const (
+	k3sAdminCert = "/var/lib/rancher/k3s/server/tls/client-admin.crt"
+	k3sAdminKey  = "/var/lib/rancher/k3s/server/tls/client-admin.key"
+)
+
+// kubeletClient queries the local kubelet API (/pods, /stats/summary).
+type kubeletClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// onKubernetesNode reports whether this host looks like a k8s / k3s node, or
+// whether the agent itself runs inside a pod (DaemonSet deployment).
+func onKubernetesNode() bool {
+	for _, p := range []string{"/var/lib/kubelet", "/var/lib/rancher/k3s/agent"} {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// newKubeletClient returns nil when the host is not a Kubernetes node or the
+// pod collector is disabled (agent_kubelet_url = "").
+func newKubeletClient(cfg *config.Config) *kubeletClient {
+	if cfg.AgentKubeletURL == "" || !onKubernetesNode() {
+		return nil
+	}
+	// The kubelet serves a self-signed certificate on localhost.
+	tlsCfg := &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	certFile, keyFile := cfg.AgentKubeletCertFile, cfg.AgentKubeletKeyFile
+	if certFile == "" {
+		if _, err := os.Stat(k3sAdminCert); err == nil {
+			certFile, keyFile = k3sAdminCert, k3sAdminKey
+		}
+	}
+	if certFile != "" {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			tlsCfg.Certificates = []tls.Certificate{cert}
+		}
+	}
+	var token string
+	if cfg.AgentKubeletTokenFile != "" {
+		if raw, err := os.ReadFile(cfg.AgentKubeletTokenFile); err == nil {
+			token = strings.TrimSpace(string(raw))
+		}
+	}
+	return &kubeletClient{
+		base:  strings.TrimRight(cfg.AgentKubeletURL, "/"),
+		token: token,
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		},
+	}
+}
+
+func (k *kubeletClient) get(path string, out any) error {
+	req, err := http.NewRequest(http.MethodGet, k.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("kubelet %s: status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// kubeletPodList is the subset of the kubelet /pods response we use.
+type kubeletPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"metadata"`
+		Status struct {
+			Phase             string `json:"phase"`
+			PodIP             string `json:"podIP"`
+			ContainerStatuses []struct {
+				RestartCount int `json:"restartCount"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// kubeletSummary is the subset of the kubelet /stats/summary response we use.
+type kubeletSummary struct {
+	Pods []struct {
+		PodRef struct {
+			UID string `json:"uid"`
+		} `json:"podRef"`
+		CPU *struct {
+			UsageNanoCores uint64 `json:"usageNanoCores"`
+		} `json:"cpu"`
+		Memory *struct {
+			WorkingSetBytes uint64 `json:"workingSetBytes"`
+		} `json:"memory"`
+	} `json:"pods"`
+}
+
+// pods lists the pods scheduled on this node, enriched with usage figures
+// from /stats/summary when available.
+func (k *kubeletClient) pods() ([]PodInfo, error) {
+	var list kubeletPodList
+	if err := k.get("/pods", &list); err != nil {
+		return nil, err
+	}
+	out := make([]PodInfo, 0, len(list.Items))
+	index := make(map[string]int, len(list.Items))
+	for _, p := range list.Items {
+		info := PodInfo{
+			Namespace: p.Metadata.Namespace,
+			Name:      p.Metadata.Name,
+			UID:       p.Metadata.UID,
+			Phase:     p.Status.Phase,
+			IP:        p.Status.PodIP,
+		}
+		for _, cs := range p.Status.ContainerStatuses {
+			info.Restarts += cs.RestartCount
+		}
+		index[info.UID] = len(out)
+		out = append(out, info)
+	}
+	var sum kubeletSummary
+	if err := k.get("/stats/summary", &sum); err == nil {
+		for _, s := range sum.Pods {
+			i, ok := index[s.PodRef.UID]
+			if !ok {
+				continue
+			}
+			if s.CPU != nil {
+				out[i].CPUMilli = float64(s.CPU.UsageNanoCores) / 1e6
+			}
+			if s.Memory != nil {
+				out[i].MemUsage = s.Memory.WorkingSetBytes
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Probe targets reported with every snapshot.
+const (
+	ProbeGateway  = "gateway"
+	ProbeServer   = "server"
+	ProbeExternal = "external"
+)
+
+// latencyProbeTimeout bounds a single echo / connect attempt.
+const latencyProbeTimeout = time.Second
+
+// LatencyProbe is the result of pinging one target during a collection cycle.
+type LatencyProbe struct {
+	Target   string  `json:"target"` // gateway / server / external
+	Addr     string  `json:"addr"`   // probed IP address
+	Method   string  `json:"method"` // icmp / tcp
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	LossPct  float64 `json:"loss_pct"`
+	// RTT statistics in milliseconds over the answered attempts; 0 when none.
+	RTTAvg float64 `json:"rtt_avg"`
+	RTTMin float64 `json:"rtt_min"`
+	RTTMax float64 `json:"rtt_max"`
+}
+
+// icmpDenied is set once opening an ICMP socket failed for lack of
+// privileges, so later cycles go straight to the TCP fallback.
+var icmpDenied atomic.Bool
+
+// icmpSeq numbers echo requests so replies can be matched; unprivileged
+// sockets rewrite the echo ID, so the sequence is the only reliable key.
+var icmpSeq atomic.Uint32
+
+func init() {
+	icmpSeq.Store(rand.Uint32())
+}
+
+// icmpEcho sends one ICMP (or ICMPv6) echo request to ip and waits for the
+// reply. It prefers an unprivileged datagram socket (Linux
+// ping_group_range, macOS) and falls back to a raw socket, which needs
+// root / CAP_NET_RAW.
+func icmpEcho(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	udpNet, rawNet, laddr, proto := "udp4", "ip4:icmp", "0.0.0.0", 1 // 1 = ICMPv4
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		udpNet, rawNet, laddr, proto = "udp6", "ip6:ipv6-icmp", "::", 58 // 58 = ICMPv6
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	network, dst := udpNet, net.Addr(&net.UDPAddr{IP: ip})
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		network, dst = rawNet, &net.IPAddr{IP: ip}
+		if conn, err = icmp.ListenPacket(network, laddr); err != nil {
+			if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+				icmpDenied.Store(true)
+			}
+			return 0, err
+		}
+	}
+	defer conn.Close()
+
+	seq := int(icmpSeq.Add(1) & 0xffff)
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("opentalon")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(timeout)
+	_ = conn.SetDeadline(deadline)
+	start := time.Now()
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (network == rawNet && echo.ID != id) {
+			continue // a raw socket sees every echo reply on the host
+		}
+		return rtt, nil
+	}
+}
+
+// tcpEcho measures a TCP connect round trip to ip, trying ports in order. A
+// refused connection still proves the host answered, so it counts as well.
+func tcpEcho(ip net.IP, ports []int, timeout time.Duration) (time.Duration, error) {
+	err := errors.New("no probe port")
+	for _, port := range ports {
+		start := time.Now()
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+		rtt := time.Since(start)
+		if err == nil {
+			_ = conn.Close()
+			return rtt, nil
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return rtt, nil
+		}
+	}
+	return 0, err
+}
+
+// probeTarget pings host count times, ICMP first and TCP on tcpPorts when
+// ICMP is unavailable to this process. host may be a name or an address;
+// names resolve to IPv4 when they have such an address, else to IPv6.
+func probeTarget(target, host string, tcpPorts []int, count int) *LatencyProbe {
+	var ip net.IP
+	if ip = net.ParseIP(host); ip == nil {
+		if addrs, err := net.LookupIP(host); err == nil {
+			for _, a := range addrs {
+				if ip == nil || a.To4() != nil && ip.To4() == nil {
+					ip = a
+				}
+			}
+		}
+	}
+	p := &LatencyProbe{Target: target, Addr: host, Method: "icmp", Sent: count, LossPct: 100}
+	if ip == nil {
+		return p // unresolvable: report as fully lost
+	}
+	p.Addr = ip.String()
+
+	var sum time.Duration
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		var (
+			rtt time.Duration
+			err error
+		)
+		if !icmpDenied.Load() {
+			rtt, err = icmpEcho(ip, latencyProbeTimeout)
+		}
+		if icmpDenied.Load() {
+			p.Method = "tcp"
+			rtt, err = tcpEcho(ip, tcpPorts, latencyProbeTimeout)
+		}
+		if err != nil {
+			continue
+		}
+		ms := float64(rtt.Microseconds()) / 1000
+		if p.Received == 0 || ms < p.RTTMin {
+			p.RTTMin = ms
+		}
+		p.RTTMax = max(p.RTTMax, ms)
+		sum += rtt
+		p.Received++
+	}
+	if p.Received > 0 {
+		p.RTTAvg = float64(sum.Microseconds()) / 1000 / float64(p.Received)
+	}
+	p.LossPct = float64(count-p.Received) * 100 / float64(count)
+	return p
+}
+
+// takeLatency returns the results of the last finished probe round (nil if
+// none finished since the previous call) and starts a new round unless one
+// is still running.
+func (c *Collector) takeLatency(gateway string) []LatencyProbe {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.latency
+	c.latency = nil
+	if !c.probing && c.cfg.AgentProbeCount > 0 {
+		c.probing = true
+		go func() {
+			res := c.latencyProbes(gateway)
+			c.mu.Lock()
+			c.latency, c.probing = res, false
+			c.mu.Unlock()
+		}()
+	}
+	return out
+}
+
+// latencyProbes pings the default gateway, the OpenTalon server and the
+// configured external target concurrently. Targets that are unknown (no
+// gateway) or disabled (empty external target) are skipped.
+func (c *Collector) latencyProbes(gateway string) []LatencyProbe {
+	count := c.cfg.AgentProbeCount
+	if count <= 0 {
+		return nil
+	}
+	type spec struct {
+		target, host string
+		ports        []int
+	}
+	var specs []spec
+	if gateway != "" {
+		specs = append(specs, spec{ProbeGateway, gateway, []int{53, 80, 443, 22}})
+	}
+	if host, port, err := net.SplitHostPort(c.cfg.AgentJoinAddr); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			specs = append(specs, spec{ProbeServer, host, []int{p}})
+		}
+	}
+	if t := c.cfg.AgentProbeTarget; t != "" {
+		specs = append(specs, spec{ProbeExternal, t, []int{443, 80}})
+	}
+
+	out := make([]LatencyProbe, len(specs))
+	var wg sync.WaitGroup
+	for i, s := range specs {
+		wg.Add(1)
+		go func(i int, s spec) {
+			defer wg.Done()
+			out[i] = *probeTarget(s.target, s.host, s.ports, count)
+		}(i, s)
+	}
+	wg.Wait()
+	return out
+}
@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Neighbor is a directly attached device announced over LLDP or CDP: the
+// switch port (or host NIC) at the other end of one of our links.
+type Neighbor struct {
+	// LocalPort is our interface the announcement arrived on.
+	LocalPort string `json:"local_port"`
+	// Protocol is "lldp" or "cdp".
+	Protocol  string `json:"protocol"`
+	ChassisID string `json:"chassis_id"`
+	PortID    string `json:"port_id"`
+	PortDescr string `json:"port_descr,omitempty"`
+	SysName   string `json:"sys_name,omitempty"`
+	SysDescr  string `json:"sys_descr,omitempty"`
+	// MgmtIPs are the management addresses the neighbor advertises.
+	MgmtIPs []string `json:"mgmt_ips,omitempty"`
+}
+
+// lldpctlTTL is how long lldpctl output is reused; neighbors rarely change.
+const lldpctlTTL = time.Minute
+
+// lldpCollector reports LLDP / CDP neighbors, from lldpd (lldpctl) when it
+// is installed, which also decodes CDP, and otherwise from LLDP frames it
+// receives itself (Linux, root / CAP_NET_RAW; see lldp_linux.go).
+type lldpCollector struct {
+	mu       sync.Mutex
+	cached   []Neighbor
+	cachedAt time.Time
+	// heard holds neighbors seen by the raw listener, by local port and
+	// chassis / port ID, until their TTL runs out.
+	heard     map[string]heardNeighbor
+	listening bool
+}
+
+type heardNeighbor struct {
+	Neighbor
+	expires time.Time
+}
+
+// neighbors returns the current neighbors, sorted by local port. It never
+// returns nil, so the server can tell "none" from an agent without LLDP.
+func (l *lldpCollector) neighbors() []Neighbor {
+	if _, err := exec.LookPath("lldpctl"); err == nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if time.Since(l.cachedAt) >= lldpctlTTL {
+			list, err := lldpctlNeighbors()
+			if err != nil {
+				fmt.Printf("[agent] lldpctl: %v\n", err)
+			}
+			l.cached, l.cachedAt = list, time.Now()
+		}
+		return append([]Neighbor{}, l.cached...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.listening {
+		l.listening = true
+		l.heard = map[string]heardNeighbor{}
+		go listenLLDP(l.heardFrame)
+	}
+	out := []Neighbor{}
+	now := time.Now()
+	for k, h := range l.heard {
+		if now.After(h.expires) {
+			delete(l.heard, k)
+			continue
+		}
+		out = append(out, h.Neighbor)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LocalPort != out[j].LocalPort {
+			return out[i].LocalPort < out[j].LocalPort
+		}
+		return out[i].ChassisID < out[j].ChassisID
+	})
+	return out
+}
+
+// heardFrame records an LLDPDU received on iface.
+func (l *lldpCollector) heardFrame(iface string, pdu []byte) {
+	n, ttl, ok := parseLLDPDU(pdu)
+	if !ok {
+		return
+	}
+	n.LocalPort, n.Protocol = iface, "lldp"
+	key := iface + "|" + n.ChassisID + "|" + n.PortID
+	l.mu.Lock()
+	if ttl == 0 {
+		delete(l.heard, key) // shutdown LLDPDU: the neighbor is leaving
+	} else {
+		l.heard[key] = heardNeighbor{Neighbor: n, expires: time.Now().Add(ttl)}
+	}
+	l.mu.Unlock()
+}
+
+// LLDP TLV types (IEEE 802.1AB).
+const (
+	tlvEnd       = 0
+	tlvChassisID = 1
+	tlvPortID    = 2
+	tlvTTL       = 3
+	tlvPortDescr = 4
+	tlvSysName   = 5
+	tlvSysDescr  = 6
+	tlvMgmtAddr  = 8
+)
+
+// parseLLDPDU decodes the TLVs of an LLDP frame payload (after the
+// ethertype). ok is false when the mandatory chassis / port ID are missing.
+func parseLLDPDU(b []byte) (n Neighbor, ttl time.Duration, ok bool) {
+	for len(b) >= 2 {
+		hdr := binary.BigEndian.Uint16(b)
+		typ, length := int(hdr>>9), int(hdr&0x1ff)
+		if len(b) < 2+length {
+			break
+		}
+		v := b[2 : 2+length]
+		b = b[2+length:]
+		switch typ {
+		case tlvEnd:
+			return n, ttl, n.ChassisID != "" && n.PortID != ""
+		case tlvChassisID, tlvPortID:
+			if len(v) < 2 {
+				continue
+			}
+			id := lldpID(typ, v[0], v[1:])
+			if typ == tlvChassisID {
+				n.ChassisID = id
+			} else {
+				n.PortID = id
+			}
+		case tlvTTL:
+			if len(v) >= 2 {
+				ttl = time.Duration(binary.BigEndian.Uint16(v)) * time.Second
+			}
+		case tlvPortDescr:
+			n.PortDescr = string(v)
+		case tlvSysName:
+			n.SysName = string(v)
+		case tlvSysDescr:
+			n.SysDescr = string(v)
+		case tlvMgmtAddr:
+			// address string length (subtype + address), subtype, address
+			if len(v) < 2 || int(v[0]) < 1 || len(v) < 1+int(v[0]) {
+				continue
+			}
+			if ip := ianaAddr(v[1], v[2:1+int(v[0])]); ip != "" {
+				n.MgmtIPs = append(n.MgmtIPs, ip)
+			}
+		}
+	}
+	return n, ttl, n.ChassisID != "" && n.PortID != ""
+}
+
+// lldpID renders a chassis or port ID by its subtype: MAC addresses and
+// network addresses are formatted, names are taken as text.
+func lldpID(typ int, subtype byte, v []byte) string {
+	macSubtype := byte(4) // chassis: MAC address
+	addrSubtype := byte(5)
+	if typ == tlvPortID {
+		macSubtype, addrSubtype = 3, 4
+	}
+	switch subtype {
+	case macSubtype:
+		if len(v) == 6 {
+			return net.HardwareAddr(v).String()
+		}
+	case addrSubtype:
+		if len(v) > 1 {
+			if ip := ianaAddr(v[0], v[1:]); ip != "" {
+				return ip
+			}
+		}
+	}
+	return strings.TrimRight(string(v), "\x00")
+}
+
+// ianaAddr formats an address of IANA address family 1 (IPv4) or 2 (IPv6).
+func ianaAddr(family byte, v []byte) string {
+	if (family == 1 && len(v) == 4) || (family == 2 && len(v) == 16) {
+		return net.IP(v).String()
+	}
+	return ""
+}
+
+// lldpctlNeighbors reads the neighbors known to lldpd. The json0 format
+// keeps every value in a list, whatever the count, unlike "json".
+func lldpctlNeighbors() ([]Neighbor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "lldpctl", "-f", "json0").Output()
+	if err != nil {
+		return []Neighbor{}, err
+	}
+	type value struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	var doc struct {
+		LLDP []struct {
+			Interface []struct {
+				Name    string `json:"name"`
+				Via     string `json:"via"`
+				Chassis []struct {
+					ID     []value `json:"id"`
+					Name   []value `json:"name"`
+					Descr  []value `json:"descr"`
+					MgmtIP []value `json:"mgmt-ip"`
+				} `json:"chassis"`
+				Port []struct {
+					ID    []value `json:"id"`
+					Descr []value `json:"descr"`
+				} `json:"port"`
+			} `json:"interface"`
+		} `json:"lldp"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return []Neighbor{}, err
+	}
+	first := func(vs []value) string {
+		if len(vs) == 0 {
+			return ""
+		}
+		return vs[0].Value
+	}
+	list := []Neighbor{}
+	for _, l := range doc.LLDP {
+		for _, i := range l.Interface {
+			n := Neighbor{LocalPort: i.Name, Protocol: "lldp"}
+			if strings.HasPrefix(strings.ToUpper(i.Via), "CDP") {
+				n.Protocol = "cdp"
+			}
+			for _, c := range i.Chassis {
+				n.ChassisID, n.SysName, n.SysDescr = first(c.ID), first(c.Name), first(c.Descr)
+				for _, ip := range c.MgmtIP {
+					n.MgmtIPs = append(n.MgmtIPs, ip.Value)
+				}
+			}
+			for _, p := range i.Port {
+				n.PortID, n.PortDescr = first(p.ID), first(p.Descr)
+			}
+			list = append(list, n)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ethLLDP is the LLDP ethertype.
+const ethLLDP = 0x88cc
+
+// listenLLDP receives LLDP frames on every interface through a packet
+// socket and hands their payload to heard. Switches send LLDP to a
+// multicast address bridges do not forward, so only direct neighbors are
+// heard. Without CAP_NET_RAW it gives up quietly: the agent then reports
+// no neighbors.
+func listenLLDP(heard func(iface string, pdu []byte)) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(ethLLDP)))
+	if err != nil {
+		fmt.Printf("[agent] lldp: listening needs root or lldpd: %v\n", err)
+		return
+	}
+	defer unix.Close(fd)
+	joinLLDPMulticast(fd)
+	buf := make([]byte, 1600)
+	for {
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			fmt.Printf("[agent] lldp: %v\n", err)
+			return
+		}
+		// Outgoing frames are our own (e.g. systemd-networkd's EmitLLDP).
+		ll, ok := from.(*unix.SockaddrLinklayer)
+		if !ok || ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		iface, err := net.InterfaceByIndex(ll.Ifindex)
+		if err != nil || isVirtualInterface(iface.Name) {
+			continue
+		}
+		heard(iface.Name, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// joinLLDPMulticast lets the NICs pass frames sent to the LLDP nearest-bridge
+// address up to the socket; most drivers drop unsubscribed multicast.
+func joinLLDPMulticast(fd int) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		mreq := unix.PacketMreq{
+			Ifindex: int32(iface.Index),
+			Type:    unix.PACKET_MR_MULTICAST,
+			Alen:    6,
+			Address: [8]byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e},
+		}
+		_ = unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq)
+	}
+}
+
+// htons converts a short to network byte order.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package agent
+
+// listenLLDP is only implemented on Linux; elsewhere neighbors come from
+// lldpctl alone.
+func listenLLDP(func(iface string, pdu []byte)) {}
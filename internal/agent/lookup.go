@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// backgroundLookup caches the result of a slow periodic lookup (public IP,
+// NTP offset, DNS checks) between reports. Lookups run in the background so a slow or
+// unreachable service never delays a report; the result is sent with the
+// following one.
+type backgroundLookup[T any] struct {
+	mu      sync.Mutex
+	val     T
+	ok      bool
+	checked time.Time
+	running bool
+}
+
+// get returns the last successful result; ok is false until there is one.
+func (l *backgroundLookup[T]) get() (val T, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.val, l.ok
+}
+
+// take is get for per-cycle results: it also clears the result, so each
+// one is reported only once.
+func (l *backgroundLookup[T]) take() (val T, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	val, ok = l.val, l.ok
+	var zero T
+	l.val, l.ok = zero, false
+	return val, ok
+}
+
+// refresh starts fn when the last lookup is older than every. A failed
+// lookup keeps the previous result, so a flaky service is not mistaken for
+// a change; name labels the error in debug output.
+func (l *backgroundLookup[T]) refresh(name string, every time.Duration, debug bool, fn func() (T, error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running || time.Since(l.checked) < every {
+		return
+	}
+	l.running = true
+	go func() {
+		val, err := fn()
+		if err != nil && debug {
+			fmt.Printf("[agent] %s failed: %v\n", name, err)
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.running, l.checked = false, time.Now()
+		if err == nil {
+			l.val, l.ok = val, true
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/shirou/gopsutil/v4/host"
+	"github.com/vesaa/opentalon/internal/config"
+)
+
+// machineIDFile holds a generated machine ID, next to the agent binary, on
+// hosts that have none of their own.
+const machineIDFile = "opentalon-agent.id"
+
+// machineID returns the host's stable identity, which the server keys the
+// device on instead of its (changing) address: agent_machine_id when set
+// (e.g. for VMs cloned with the same /etc/machine-id), else the host's
+// /etc/machine-id (dbus' copy on older systems; the host's in container
+// mode), the OS's host ID elsewhere (MachineGuid on Windows, the platform
+// UUID on macOS), or failing all that a random ID generated once and kept
+// in machineIDFile.
+func machineID(cfg *config.Config) string {
+	if id := strings.TrimSpace(cfg.AgentMachineID); id != "" {
+		return id
+	}
+	if runtime.GOOS == "linux" {
+		etc := hostFS.etc
+		if etc == "" {
+			etc = "/etc"
+		}
+		for _, p := range []string{filepath.Join(etc, "machine-id"), hostMountpoint("/var/lib/dbus/machine-id")} {
+			if b, err := os.ReadFile(p); err == nil {
+				if id := strings.TrimSpace(string(b)); id != "" {
+					return id
+				}
+			}
+		}
+	} else if id, err := host.HostID(); err == nil && id != "" {
+		return strings.ToLower(id)
+	}
+	return generatedMachineID()
+}
+
+// generatedMachineID reads machineIDFile, creating it on first use. It
+// returns "" when the file can be neither read nor written; the server then
+// keys the device on its address as before.
+func generatedMachineID() string {
+	path := machineIDFile
+	if exe, err := os.Executable(); err == nil {
+		path = filepath.Join(filepath.Dir(exe), machineIDFile)
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+		return ""
+	}
+	return id
+}
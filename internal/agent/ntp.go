@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and
+// the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// ntpTime converts a 64-bit NTP timestamp (32.32 fixed point) to time.Time.
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(sec, frac*1e9>>32)
+}
+
+// putNTPTime writes t as a 64-bit NTP timestamp.
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32((int64(t.Nanosecond())<<32)/1e9))
+}
+
+// SNTPOffset queries server (host or host:port, UDP 123 by default) once
+// with SNTPv4 and returns how far the local clock is ahead of the server's
+// (negative when it is behind), corrected for the network round trip.
+func SNTPOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0<<6 | 4<<3 | 3 // LI = 0, version 4, mode 3 (client)
+	t1 := time.Now()
+	putNTPTime(req[40:48], t1) // transmit timestamp, echoed as "originate"
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return 0, err
+		}
+		t4 := time.Now()
+		if n < 48 || resp[0]&0x07 != 4 || string(resp[24:32]) != string(req[40:48]) {
+			continue // not a server reply to this request
+		}
+		if resp[1] == 0 {
+			return 0, errors.New("ntp server sent kiss-of-death (stratum 0)")
+		}
+		if resp[0]>>6 == 3 {
+			return 0, errors.New("ntp server is not synchronized")
+		}
+		t2 := ntpTime(resp[32:40]) // server receive
+		t3 := ntpTime(resp[40:48]) // server transmit
+		// Offset of the server relative to us, per RFC 4330; negate it so a
+		// positive value means the local clock runs ahead.
+		return -(t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+	}
+}
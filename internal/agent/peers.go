@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// ProbePeer is the target label of a peer ping.
+const ProbePeer = "peer"
+
+// peerProbePorts are tried when ICMP is unavailable; a refused connect
+// still proves the peer is up.
+var peerProbePorts = []int{22, 80, 443}
+
+// Peer is another agent on the same segment, handed out by the server.
+type Peer struct {
+	DeviceID uint   `json:"device_id"`
+	IP       string `json:"ip"`
+}
+
+// PeerProbe is the result of pinging one peer.
+type PeerProbe struct {
+	DeviceID uint    `json:"device_id"`
+	IP       string  `json:"ip"`
+	OK       bool    `json:"ok"`
+	RTTMs    float64 `json:"rtt_ms"`
+}
+
+// ServerOutage is sent with the first report that gets through after
+// reports failed: when the agent lost the server and how many of its peers
+// still answered meanwhile. Peers answering while many agents lost the
+// server points at the network path or the server, not at the devices.
+type ServerOutage struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Peers   int       `json:"peers"`
+	PeersOK int       `json:"peers_ok"`
+}
+
+// peerProbes pings every peer twice, concurrently.
+func peerProbes(peers []Peer) []PeerProbe {
+	out := make([]PeerProbe, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lp := probeTarget(ProbePeer, p.IP, peerProbePorts, 2)
+			out[i] = PeerProbe{DeviceID: p.DeviceID, IP: p.IP, OK: lp.Received > 0, RTTMs: lp.RTTAvg}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// note records a failed report in the outage o (nil: none yet), counting
+// the peers that answered in probes, and returns it.
+func (o *ServerOutage) note(probes []PeerProbe) *ServerOutage {
+	if o == nil {
+		o = &ServerOutage{Since: time.Now()}
+	}
+	if len(probes) > 0 {
+		o.Peers, o.PeersOK = len(probes), 0
+		for _, p := range probes {
+			if p.OK {
+				o.PeersOK++
+			}
+		}
+	}
+	return o
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"sort"
+
+	psnet "github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// ListenPort is a TCP port in LISTEN state or a bound, unconnected UDP port.
+type ListenPort struct {
+	Proto   string `json:"proto"` // tcp / udp
+	Addr    string `json:"addr"`  // bind address, e.g. 0.0.0.0, ::, 127.0.0.1
+	Port    uint32 `json:"port"`
+	PID     int32  `json:"pid"`
+	Process string `json:"process"` // owning process name, "" when unknown
+}
+
+// listeningPorts enumerates listening sockets with their owning process.
+// Resolving the owner of sockets held by other users requires root.
+func listeningPorts() []ListenPort {
+	names := map[int32]string{}
+	procName := func(pid int32) string {
+		if pid <= 0 {
+			return ""
+		}
+		if n, ok := names[pid]; ok {
+			return n
+		}
+		var n string
+		if p, err := process.NewProcess(pid); err == nil {
+			n, _ = p.Name()
+		}
+		names[pid] = n
+		return n
+	}
+
+	seen := map[ListenPort]bool{}
+	out := []ListenPort{}
+	for _, proto := range []string{"tcp", "udp"} {
+		conns, err := psnet.Connections(proto)
+		if err != nil {
+			continue
+		}
+		for _, cs := range conns {
+			if proto == "tcp" && cs.Status != "LISTEN" {
+				continue
+			}
+			if proto == "udp" && cs.Raddr.IP != "" && cs.Raddr.Port != 0 {
+				continue // connected UDP socket (client side)
+			}
+			lp := ListenPort{Proto: proto, Addr: cs.Laddr.IP, Port: cs.Laddr.Port, PID: cs.Pid}
+			if lp.Port == 0 || seen[lp] {
+				continue
+			}
+			seen[lp] = true
+			lp.Process = procName(cs.Pid)
+			out = append(out, lp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Port != out[j].Port {
+			return out[i].Port < out[j].Port
+		}
+		if out[i].Proto != out[j].Proto {
+			return out[i].Proto < out[j].Proto
+		}
+		return out[i].Addr < out[j].Addr
+	})
+	return out
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"runtime"
+	"sort"
+
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// ProcessInfo describes one of the busiest processes on the host.
+type ProcessInfo struct {
+	PID        int32   `json:"pid"`
+	Name       string  `json:"name"`
+	User       string  `json:"user"`
+	CPUPercent float64 `json:"cpu_percent"` // percent of the whole host, 0-100
+	RSS        uint64  `json:"rss"`         // resident set size, bytes
+}
+
+// topProcesses returns the union of the n processes using the most CPU and
+// the n using the most memory, sorted by CPU. CPU usage is measured since the
+// previous call, so *process.Process handles are kept in c.procs between
+// cycles; the very first report therefore shows 0% everywhere.
+func (c *Collector) topProcesses(n int) []ProcessInfo {
+	pids, err := process.Pids()
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.procs == nil {
+		c.procs = map[int32]*process.Process{}
+	}
+
+	type sample struct {
+		p   *process.Process
+		cpu float64
+		rss uint64
+	}
+	numCPU := float64(runtime.NumCPU())
+	alive := make(map[int32]*process.Process, len(pids))
+	samples := make([]sample, 0, len(pids))
+	for _, pid := range pids {
+		p, ok := c.procs[pid]
+		if !ok {
+			if p, err = process.NewProcess(pid); err != nil {
+				continue
+			}
+		}
+		alive[pid] = p
+		cpu, err := p.Percent(0)
+		if err != nil {
+			continue
+		}
+		var rss uint64
+		if mi, err := p.MemoryInfo(); err == nil {
+			rss = mi.RSS
+		}
+		samples = append(samples, sample{p: p, cpu: cpu / numCPU, rss: rss})
+	}
+	c.procs = alive
+
+	picked := map[int32]sample{}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].cpu > samples[j].cpu })
+	for _, s := range samples[:min(n, len(samples))] {
+		if s.cpu > 0 {
+			picked[s.p.Pid] = s
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].rss > samples[j].rss })
+	for _, s := range samples[:min(n, len(samples))] {
+		if s.rss > 0 {
+			picked[s.p.Pid] = s
+		}
+	}
+
+	out := make([]ProcessInfo, 0, len(picked))
+	for _, s := range picked {
+		info := ProcessInfo{PID: s.p.Pid, CPUPercent: s.cpu, RSS: s.rss}
+		info.Name, _ = s.p.Name()
+		info.User, _ = s.p.Username()
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CPUPercent != out[j].CPUPercent {
+			return out[i].CPUPercent > out[j].CPUPercent
+		}
+		return out[i].RSS > out[j].RSS
+	})
+	return out
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/proxy"
+)
+
+// resolvePublicIP asks an external "what is my IP" service for the address
+// this host egresses from. Both plain-text answers (api.ipify.org,
+// ifconfig.me/ip) and JSON objects with an "ip" field are understood.
+func resolvePublicIP(resolver string) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: proxy.Transport(proxy.Integration)}
+	req, err := http.NewRequest(http.MethodGet, resolver, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "opentalon-agent")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolver returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(body))
+	if strings.HasPrefix(s, "{") {
+		var v struct {
+			IP string `json:"ip"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return "", err
+		}
+		s = v.IP
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", errors.New("resolver answer is not an IP address")
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+)
+
+// ReportTiming is how long a metrics report to the server took, sent with
+// the next report so the server can chart the path per device. Phases the
+// request skipped (no lookup for an IP address, none of them on a reused
+// keep-alive connection) are nil.
+type ReportTiming struct {
+	DNSMs     *float64 `json:"dns_ms,omitempty"`
+	ConnectMs *float64 `json:"connect_ms,omitempty"`
+	TLSMs     *float64 `json:"tls_ms,omitempty"`
+	// TotalMs runs from sending the request to reading the whole response.
+	TotalMs float64 `json:"total_ms"`
+	Reused  bool    `json:"reused"`
+}
+
+// reportTrace records the phases of one request via httptrace.
+type reportTrace struct {
+	start                         time.Time
+	dnsStart, connStart, tlsStart time.Time
+	dns, conn, tls                time.Duration
+	reused                        bool
+}
+
+// context returns ctx with the trace attached and starts the clock.
+func (t *reportTrace) context(ctx context.Context) context.Context {
+	t.start = time.Now()
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn:  func(info httptrace.GotConnInfo) { t.reused = info.Reused },
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.dns = time.Since(t.dnsStart) },
+		ConnectStart: func(string, string) {
+			if t.connStart.IsZero() {
+				t.connStart = time.Now()
+			}
+		},
+		// With several addresses the connect time covers the failed
+		// attempts too: that is what the report waited for.
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				t.conn = time.Since(t.connStart)
+			}
+		},
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.tls = time.Since(t.tlsStart)
+		},
+	})
+}
+
+// timing returns what the trace saw; call it once the response was read.
+func (t *reportTrace) timing() *ReportTiming {
+	ms := func(d time.Duration) *float64 {
+		v := float64(d.Microseconds()) / 1000
+		return &v
+	}
+	rt := &ReportTiming{TotalMs: *ms(time.Since(t.start)), Reused: t.reused}
+	if !t.dnsStart.IsZero() {
+		rt.DNSMs = ms(t.dns)
+	}
+	if !t.connStart.IsZero() {
+		rt.ConnectMs = ms(t.conn)
+	}
+	if !t.tlsStart.IsZero() {
+		rt.TLSMs = ms(t.tls)
+	}
+	return rt
+}
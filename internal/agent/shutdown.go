@@ -0,0 +1,32 @@
+package agent
+
+import "fmt"
+
+// Kinds of a planned host shutdown.
+const (
+	ShutdownPowerOff = "shutdown"
+	ShutdownReboot   = "reboot"
+)
+
+// ShutdownNotice tells the server the host is going down on purpose, so the
+// silence that follows is shown as planned instead of as an outage.
+type ShutdownNotice struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	// Kind is ShutdownPowerOff or ShutdownReboot.
+	Kind string `json:"kind"`
+	// Source names what announced it: systemd, openrc or windows.
+	Source string `json:"source"`
+	// MachineID tells the server which device this is when several share IP.
+	MachineID string `json:"machine_id,omitempty"`
+}
+
+// announceShutdown sends n to the server. It runs while the host is going
+// down, so it is tried once with the usual request timeout.
+func announceShutdown(base, token string, n ShutdownNotice, debug bool) {
+	if err := postJSON(base+"/api/devices/shutdown", token, n, debug); err != nil {
+		fmt.Printf("[agent] shutdown notice: %v\n", err)
+		return
+	}
+	fmt.Printf("[agent] announced planned %s (%s)\n", n.Kind, n.Source)
+}
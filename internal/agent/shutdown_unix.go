@@ -0,0 +1,74 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchShutdown waits for the agent to be stopped (SIGTERM or Ctrl+C). When
+// the init system is bringing the host down at that point, notify is called
+// with the kind before the process exits.
+//
+// No systemd inhibitor lock is needed: the agent unit is ordered after
+// network-online.target, so on shutdown systemd stops the agent, and waits
+// for it, before the network goes away.
+func watchShutdown(notify func(kind, source string)) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	if kind, source := shutdownIntent(); kind != "" {
+		notify(kind, source)
+	}
+	os.Exit(0)
+}
+
+// shutdownIntent reports whether the host is shutting down or rebooting,
+// asking systemd first and then OpenRC; "" when it is not (the agent alone
+// is being stopped).
+func shutdownIntent() (kind, source string) {
+	if kind := systemdShutdownIntent(); kind != "" {
+		return kind, "systemd"
+	}
+	// OpenRC switches to the "shutdown" or "reboot" runlevel before it
+	// stops services.
+	if b, err := os.ReadFile("/run/openrc/softlevel"); err == nil {
+		switch strings.TrimSpace(string(b)) {
+		case "reboot":
+			return ShutdownReboot, "openrc"
+		case "shutdown":
+			return ShutdownPowerOff, "openrc"
+		}
+	}
+	return "", ""
+}
+
+// systemdShutdownIntent returns the kind when systemd is stopping the
+// system, telling reboots from power-offs by the target job queued.
+func systemdShutdownIntent() string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	// is-system-running exits non-zero for every state but "running".
+	out, _ := exec.CommandContext(ctx, "systemctl", "is-system-running").Output()
+	if strings.TrimSpace(string(out)) != "stopping" {
+		return ""
+	}
+	jobs, _ := exec.CommandContext(ctx, "systemctl", "list-jobs", "--no-legend", "--plain").Output()
+	for _, line := range strings.Split(string(jobs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[1] {
+		case "reboot.target", "kexec.target", "soft-reboot.target":
+			return ShutdownReboot
+		}
+	}
+	return ShutdownPowerOff
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+package agent
+
+import (
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// watchShutdown runs the agent's side of the Windows service protocol when
+// it was started by the service manager: the service accepts preshutdown,
+// which Windows sends ahead of the regular shutdown while the network is
+// still up, and calls notify then. Windows does not tell services whether
+// the host will restart, so the kind is always a shutdown. Run from a
+// console, it only waits for Ctrl+C.
+func watchShutdown(notify func(kind, source string)) {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		os.Exit(0)
+	}
+	_ = svc.Run("OpenTalonAgent", serviceHandler{notify: notify})
+	os.Exit(0)
+}
+
+type serviceHandler struct {
+	notify func(kind, source string)
+}
+
+// Execute implements svc.Handler.
+func (h serviceHandler) Execute(_ []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown}
+	for r := range req {
+		switch r.Cmd {
+		case svc.Interrogate:
+			status <- r.CurrentStatus
+		case svc.PreShutdown, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			h.notify(ShutdownPowerOff, "windows")
+			return false, 0
+		case svc.Stop:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
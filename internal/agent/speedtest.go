@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/proxy"
+)
+
+// speedTestRunning guards against overlapping speed tests.
+var speedTestRunning atomic.Bool
+
+// SpeedTestRequest arrives in the metrics response when an operator asked
+// for a speed test. Empty URLs mean the server's data plane.
+type SpeedTestRequest struct {
+	Target      string `json:"target"`
+	DownloadURL string `json:"download_url"`
+	UploadURL   string `json:"upload_url"`
+	DurationSec int    `json:"duration_sec"`
+	Streams     int    `json:"streams"`
+}
+
+// SpeedTestResult is posted to /api/speedtest/report.
+type SpeedTestResult struct {
+	IP           string  `json:"ip"`
+	Target       string  `json:"target"`
+	URL          string  `json:"url"`
+	LatencyMs    float64 `json:"latency_ms"`
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	BytesDown    int64   `json:"bytes_down"`
+	BytesUp      int64   `json:"bytes_up"`
+	Streams      int     `json:"streams"`
+	DurationSec  int     `json:"duration_sec"`
+	Error        string  `json:"error,omitempty"`
+	MachineID    string  `json:"machine_id,omitempty"`
+}
+
+// runSpeedTest measures latency, then download and upload throughput with
+// parallel streams for req.DurationSec each, and reports the result. When ctx
+// is cancelled (the server cancelled the task) it stops and reports what it
+// measured so far.
+func runSpeedTest(ctx context.Context, base, token, localIP, machineID string, req SpeedTestRequest, debug bool) {
+	if !speedTestRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer speedTestRunning.Store(false)
+
+	purpose := proxy.Integration
+	if req.DownloadURL == "" {
+		purpose = proxy.Report
+		req.DownloadURL = fmt.Sprintf("%s/api/speedtest/download?bytes=%d", base, 1<<30)
+		req.UploadURL = base + "/api/speedtest/upload"
+	}
+	window := time.Duration(max(req.DurationSec, 1)) * time.Second
+	streams := max(req.Streams, 1)
+	res := SpeedTestResult{
+		IP: localIP, MachineID: machineID, Target: req.Target, URL: req.DownloadURL,
+		Streams: streams, DurationSec: int(window / time.Second),
+	}
+
+	// A dedicated HTTP/1.1 transport, so each stream is its own connection
+	// (HTTP/2 would multiplex them onto one).
+	tr := proxy.Transport(purpose).Clone()
+	tr.ForceAttemptHTTP2 = false
+	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	tr.MaxIdleConnsPerHost = streams
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	auth := func(r *http.Request) {
+		if purpose == proxy.Report {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	var errs []string
+	if ms, err := connectLatency(req.DownloadURL); err != nil {
+		errs = append(errs, "latency: "+err.Error())
+	} else {
+		res.LatencyMs = ms
+	}
+	res.BytesDown, res.DownloadMbps = measure(ctx, streams, window, func(ctx context.Context, count *atomic.Int64) error {
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, req.DownloadURL, nil)
+		if err != nil {
+			return err
+		}
+		auth(r)
+		resp, err := client.Do(r)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("download: status %d", resp.StatusCode)
+		}
+		_, err = io.Copy(io.Discard, &countingReader{r: resp.Body, n: count})
+		return err
+	}, &errs)
+	if req.UploadURL != "" && ctx.Err() == nil {
+		res.BytesUp, res.UploadMbps = measure(ctx, streams, window, func(ctx context.Context, count *atomic.Int64) error {
+			r, err := http.NewRequestWithContext(ctx, http.MethodPost, req.UploadURL,
+				&countingReader{r: zeroReader{ctx}, n: count})
+			if err != nil {
+				return err
+			}
+			r.Header.Set("Content-Type", "application/octet-stream")
+			auth(r)
+			resp, err := client.Do(r)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("upload: status %d", resp.StatusCode)
+			}
+			return nil
+		}, &errs)
+	}
+	if len(errs) > 0 && (res.BytesDown == 0 || req.UploadURL != "" && res.BytesUp == 0) {
+		res.Error = strings.Join(errs, "; ")
+	}
+	if ctx.Err() != nil {
+		res.Error = "cancelled by the server"
+	}
+	if debug {
+		fmt.Printf("[agent] speed test %s: %.1f ms, ↓ %.1f Mbit/s, ↑ %.1f Mbit/s %s\n",
+			req.Target, res.LatencyMs, res.DownloadMbps, res.UploadMbps, res.Error)
+	}
+	if err := postJSON(base+"/api/speedtest/report", token, res, debug); err != nil && debug {
+		fmt.Printf("[agent] speed test report error: %v\n", err)
+	}
+}
+
+// measure runs fn on streams goroutines, restarting it when a transfer ends
+// early, until window elapses or parent is cancelled; it returns the bytes counted and the rate in
+// Mbit/s. Distinct errors other than the window closing are collected into
+// errs.
+func measure(parent context.Context, streams int, window time.Duration, fn func(context.Context, *atomic.Int64) error, errs *[]string) (int64, float64) {
+	ctx, cancel := context.WithTimeout(parent, window)
+	defer cancel()
+	var count atomic.Int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := fn(ctx, &count); err != nil && ctx.Err() == nil {
+					mu.Lock()
+					if !slices.Contains(*errs, err.Error()) {
+						*errs = append(*errs, err.Error())
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	n := count.Load()
+	return n, float64(n) * 8 / time.Since(start).Seconds() / 1e6
+}
+
+// connectLatency returns the fastest of three TCP connects to rawURL's host.
+func connectLatency(rawURL string) (float64, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	best := time.Duration(-1)
+	var lastErr error
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rtt := time.Since(start)
+		conn.Close()
+		if best < 0 || rtt < best {
+			best = rtt
+		}
+	}
+	if best < 0 {
+		return 0, lastErr
+	}
+	return float64(best.Microseconds()) / 1000, nil
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// zeroReader yields zeros until ctx is done.
+type zeroReader struct{ ctx context.Context }
+
+func (z zeroReader) Read(p []byte) (int, error) {
+	if err := z.ctx.Err(); err != nil {
+		return 0, err
+	}
+	clear(p)
+	return len(p), nil
+}
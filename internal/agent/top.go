@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/config"
+)
+
+// Top collects metrics locally every interval and renders the payload a
+// report would carry (the collected part: no server round trip, so public
+// IP, NTP, DNS and peer results are left out) as a refreshing terminal view,
+// to check what the server should be receiving. With once it prints a
+// single frame; with asJSON it prints the payload as JSON instead.
+func Top(cfg *config.Config, interval time.Duration, once, asJSON bool) error {
+	if root := configureHostFS(cfg); root != "" {
+		fmt.Fprintf(os.Stderr, "[agent] container mode: reading host metrics from %s\n", root)
+	}
+	collector := NewCollector(cfg)
+	// Seed the bandwidth baseline so the first frame has rates.
+	if _, err := collector.Collect(); err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+	for {
+		snap, err := collector.Collect()
+		if err != nil {
+			return err
+		}
+		payload := newMetricsPayload(snap)
+		if asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(payload); err != nil {
+				return err
+			}
+		} else {
+			if !once {
+				fmt.Print("\033[H\033[2J")
+			}
+			renderTop(os.Stdout, &payload, snap.OS)
+			if !once {
+				fmt.Printf("\nrefreshing every %s — Ctrl+C to quit\n", interval)
+			}
+		}
+		if once {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+// renderTop writes one frame of `opentalon agent top`.
+func renderTop(w io.Writer, p *MetricsPayload, osName string) {
+	fmt.Fprintf(w, "%s  %s  gw %s", p.Hostname, p.IP, orDash(p.GatewayIP))
+	if p.GatewayIPv6 != "" {
+		fmt.Fprintf(w, " / %s", p.GatewayIPv6)
+	}
+	fmt.Fprintf(w, "\n%s, up %s, %s\n\n", osName, time.Duration(p.Uptime)*time.Second, time.Now().Format("15:04:05"))
+
+	fmt.Fprintf(w, "CPU  %s %5.1f%%\n", bar(p.CPUUsage), p.CPUUsage)
+	fmt.Fprintf(w, "MEM  %s %5.1f%% of %s\n", bar(p.MemUsage), p.MemUsage, humanBytes(p.MemTotal))
+	fmt.Fprintf(w, "DISK %s %5.1f%%\n", bar(p.DiskUsage), p.DiskUsage)
+	fmt.Fprintf(w, "NET  rx %s/s  tx %s/s   tcp %d  udp %d\n",
+		humanBytes(uint64(p.RxBytes)), humanBytes(uint64(p.TxBytes)), p.TCPConnections, p.UDPConnections)
+
+	if len(p.Temperatures) > 0 {
+		temps := make([]string, 0, len(p.Temperatures))
+		for _, t := range p.Temperatures {
+			temps = append(temps, fmt.Sprintf("%s %.0f°C", t.SensorKey, t.Temperature))
+		}
+		fmt.Fprintf(w, "TEMP %s\n", strings.Join(temps, "  "))
+	}
+	for _, g := range p.GPUs {
+		fmt.Fprintf(w, "GPU%d %s %5.1f%%  %s / %s  %.0f°C  %s\n", g.Index, bar(g.Utilization), g.Utilization,
+			humanBytes(g.MemUsed), humanBytes(g.MemTotal), g.Temperature, g.Name)
+	}
+
+	if len(p.Latency) > 0 {
+		fmt.Fprintln(w, "\nLATENCY")
+		for _, l := range p.Latency {
+			fmt.Fprintf(w, "  %-9s %-39s %-4s avg %7.2fms  loss %3.0f%%\n", l.Target, l.Addr, l.Method, l.RTTAvg, l.LossPct)
+		}
+	}
+
+	if len(p.Interfaces) > 0 {
+		fmt.Fprintln(w, "\nINTERFACES")
+		for _, i := range p.Interfaces {
+			speed := ""
+			if i.SpeedMbps > 0 {
+				speed = fmt.Sprintf("%dMb/s", i.SpeedMbps)
+			}
+			fmt.Fprintf(w, "  %-16s %-8s %-8s %s\n", i.Name, i.State, speed, strings.Join(i.IPs, " "))
+		}
+	}
+
+	if len(p.Processes) > 0 {
+		fmt.Fprintln(w, "\nPROCESSES")
+		procs := append([]ProcessInfo(nil), p.Processes...)
+		sort.SliceStable(procs, func(i, j int) bool { return procs[i].CPUPercent > procs[j].CPUPercent })
+		for _, pr := range procs {
+			fmt.Fprintf(w, "  %7d %-12s %5.1f%% %9s  %s\n", pr.PID, pr.User, pr.CPUPercent, humanBytes(pr.RSS), pr.Name)
+		}
+	}
+
+	if len(p.Containers) > 0 {
+		fmt.Fprintln(w, "\nCONTAINERS")
+		for _, c := range p.Containers {
+			fmt.Fprintf(w, "  %-24s %-10s %5.1f%% %9s  %s\n", c.Name, c.State, c.CPUUsage, humanBytes(c.MemUsage), c.Image)
+		}
+	}
+	if len(p.Pods) > 0 {
+		fmt.Fprintln(w, "\nPODS")
+		for _, pod := range p.Pods {
+			fmt.Fprintf(w, "  %-40s %-10s %6.0fm %9s\n", pod.Namespace+"/"+pod.Name, pod.Phase, pod.CPUMilli, humanBytes(pod.MemUsage))
+		}
+	}
+	if len(p.Neighbors) > 0 {
+		fmt.Fprintln(w, "\nLLDP / CDP")
+		for _, n := range p.Neighbors {
+			fmt.Fprintf(w, "  %-16s → %s %s\n", n.LocalPort, orDash(n.SysName), n.PortDescr)
+		}
+	}
+	fmt.Fprintf(w, "\n%d listening ports\n", len(p.Ports))
+}
+
+// bar draws pct (0-100) as a 20-cell gauge.
+func bar(pct float64) string {
+	n := int(pct/5 + 0.5)
+	n = max(0, min(n, 20))
+	return "[" + strings.Repeat("#", n) + strings.Repeat(".", 20-n) + "]"
+}
+
+// humanBytes formats n with a binary unit, e.g. 1.5G.
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
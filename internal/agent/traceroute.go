@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	tracerouteMaxHops = 16
+	tracerouteTimeout = time.Second
+)
+
+// TraceHop is one TTL step of a traceroute.
+type TraceHop struct {
+	TTL int    `json:"ttl"`
+	IP  string `json:"ip"` // "" when the hop did not answer
+	// RTTMs is the round trip to this hop in milliseconds; 0 when it timed out.
+	RTTMs float64 `json:"rtt_ms"`
+}
+
+// TraceResult is a traceroute from this agent, as reported to the server.
+type TraceResult struct {
+	IP      string     `json:"ip"`     // reporting agent
+	Target  string     `json:"target"` // probed address
+	Hops    []TraceHop `json:"hops"`
+	Reached bool       `json:"reached"`
+	Error   string     `json:"error,omitempty"`
+	// MachineID identifies the reporting agent when several share IP.
+	MachineID string `json:"machine_id,omitempty"`
+}
+
+// tracerouteRunning guards against overlapping runs (on-demand + periodic).
+var tracerouteRunning atomic.Bool
+
+// traceroute sends ICMP echo requests with increasing TTL to dst and records
+// which router answered each step with "time exceeded". It needs a raw ICMP
+// socket, i.e. root or CAP_NET_RAW. It stops early when ctx is cancelled.
+func traceroute(ctx context.Context, dst net.IP) ([]TraceHop, bool, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, false, fmt.Errorf("traceroute needs root or CAP_NET_RAW: %w", err)
+		}
+		return nil, false, err
+	}
+	defer conn.Close()
+	pc := conn.IPv4PacketConn()
+
+	id := os.Getpid() & 0xffff
+	var hops []TraceHop
+	buf := make([]byte, 1500)
+	for ttl := 1; ttl <= tracerouteMaxHops; ttl++ {
+		if err := ctx.Err(); err != nil {
+			return hops, false, errors.New("cancelled by the server")
+		}
+		seq := int(icmpSeq.Add(1) & 0xffff)
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("opentalon-trace")},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return hops, false, err
+		}
+		if err := pc.SetTTL(ttl); err != nil {
+			return hops, false, err
+		}
+		start := time.Now()
+		if _, err := conn.WriteTo(b, &net.IPAddr{IP: dst}); err != nil {
+			return hops, false, err
+		}
+		_ = conn.SetReadDeadline(start.Add(tracerouteTimeout))
+
+		hop := TraceHop{TTL: ttl}
+		reached := false
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // timeout: hop stays anonymous
+			}
+			reply, err := icmp.ParseMessage(1, buf[:n])
+			if err != nil {
+				continue
+			}
+			var ok bool
+			switch body := reply.Body.(type) {
+			case *icmp.Echo:
+				ok = reply.Type == ipv4.ICMPTypeEchoReply && body.ID == id && body.Seq == seq
+				reached = ok
+			case *icmp.TimeExceeded:
+				ok = quotedEcho(body.Data, id, seq)
+			case *icmp.DstUnreach:
+				ok = quotedEcho(body.Data, id, seq)
+				reached = ok
+			}
+			if !ok {
+				continue
+			}
+			hop.IP = peer.String()
+			hop.RTTMs = float64(time.Since(start).Microseconds()) / 1000
+			break
+		}
+		hops = append(hops, hop)
+		if reached {
+			return hops, true, nil
+		}
+	}
+	return hops, false, nil
+}
+
+// quotedEcho reports whether an ICMP error quotes our echo request: the
+// payload holds the original IPv4 header followed by its first 8 ICMP bytes.
+func quotedEcho(data []byte, id, seq int) bool {
+	if len(data) < ipv4.HeaderLen {
+		return false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+8 || data[ihl] != byte(ipv4.ICMPTypeEcho) {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(data[ihl+4:])) == id &&
+		int(binary.BigEndian.Uint16(data[ihl+6:])) == seq
+}
+
+// runTraceroute traces the path to the server host and reports the hops to
+// /api/traceroute/report. Concurrent requests are collapsed into one run.
+func runTraceroute(ctx context.Context, base, token, serverHost, localIP, machineID string, debug bool) {
+	if !tracerouteRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer tracerouteRunning.Store(false)
+
+	res := TraceResult{IP: localIP, MachineID: machineID, Target: serverHost}
+	addrs, err := net.LookupIP(serverHost)
+	var dst net.IP
+	for _, a := range addrs {
+		if a.To4() != nil {
+			dst = a
+			break
+		}
+	}
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case dst == nil:
+		res.Error = "server has no IPv4 address"
+	default:
+		res.Target = dst.String()
+		res.Hops, res.Reached, err = traceroute(ctx, dst)
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+	if err := postJSON(base+"/api/traceroute/report", token, res, debug); err != nil && debug {
+		fmt.Printf("[agent] traceroute report error: %v\n", err)
+	}
+}
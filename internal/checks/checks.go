@@ -0,0 +1,78 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Assignment is a check definition handed to an agent in the metrics response.
+type Assignment struct {
+	ID          uint   `json:"id"`
+	Type        string `json:"type"`
+	Spec        string `json:"spec"`
+	IntervalSec int    `json:"interval_sec"`
+}
+
+// Report is one check run result posted back by an agent.
+type Report struct {
+	CheckID uint `json:"check_id"`
+	Result
+}
+
+// Definition holds the fields every check type shares.
+type Definition struct {
+	Name     string
+	Type     string
+	Interval time.Duration
+	// Agents lists the devices whose agents run the check; empty means the
+	// server runs it.
+	Agents []uint
+}
+
+// Parse validates a YAML check of any type. The type key selects it:
+// "http" or "tcp" (see Probe); scenarios may omit it.
+func Parse(src []byte) (Definition, error) {
+	var head struct {
+		Type string `yaml:"type"`
+	}
+	if err := yaml.Unmarshal(src, &head); err != nil {
+		return Definition{}, fmt.Errorf("parsing check: %w", err)
+	}
+	switch head.Type {
+	case "", TypeScenario:
+		sc, err := ParseScenario(src)
+		if err != nil {
+			return Definition{}, err
+		}
+		return Definition{Name: sc.Name, Type: TypeScenario, Interval: sc.Interval, Agents: sc.Agents}, nil
+	default:
+		p, err := ParseProbe(src)
+		if err != nil {
+			return Definition{}, err
+		}
+		return Definition{Name: p.Name, Type: p.Type, Interval: p.Interval, Agents: p.Agents}, nil
+	}
+}
+
+// Run parses an assignment's spec and executes it.
+func Run(ctx context.Context, a Assignment) Result {
+	switch a.Type {
+	case TypeScenario:
+		sc, err := ParseScenario([]byte(a.Spec))
+		if err != nil {
+			return Result{Error: err.Error()}
+		}
+		return RunScenario(ctx, sc)
+	case TypeHTTP, TypeTCP:
+		p, err := ParseProbe([]byte(a.Spec))
+		if err != nil {
+			return Result{Error: err.Error()}
+		}
+		return RunProbe(ctx, p)
+	default:
+		return Result{Error: fmt.Sprintf("unsupported check type %q", a.Type)}
+	}
+}
@@ -0,0 +1,232 @@
+// Package checks implements synthetic service checks shared by the server
+// (which validates and stores definitions) and the agents that execute them;
+// checks not assigned to any agent are executed by the server itself. Besides
+// scenarios there are single http / tcp probes (see Probe).
+//
+// A scenario is a multi-step HTTP transaction defined in YAML, e.g.:
+//
+//	name: nas-login
+//	interval: 60s
+//	timeout: 15s
+//	agents: [3]          # device IDs of the agents that run it
+//	insecure: true       # accept self-signed certificates
+//	steps:
+//	  - name: login
+//	    method: POST
+//	    url: https://192.168.1.10:5667/api/login
+//	    headers: {Content-Type: application/json}
+//	    body: '{"username":"monitor","password":"secret"}'
+//	    expect_status: 200
+//	    extract: {token: '"token":"([^"]+)"'}
+//	  - name: dashboard
+//	    url: https://192.168.1.10:5667/dashboard
+//	    headers: {Authorization: "Bearer ${token}"}
+//	    expect_contains: "Storage"
+//
+// Steps share a cookie jar, so session-cookie logins work without extract.
+// Values captured by extract are substituted as ${name} in later steps' URL,
+// headers and body.
+package checks
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TypeScenario identifies multi-step HTTP scenario checks.
+const TypeScenario = "scenario"
+
+// maxBodyBytes bounds how much of each response body is read for assertions.
+const maxBodyBytes = 1 << 20
+
+// Scenario is a multi-step HTTP synthetic transaction.
+type Scenario struct {
+	Name     string        `yaml:"name" json:"name"`
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
+	Agents   []uint        `yaml:"agents" json:"agents"`
+	Insecure bool          `yaml:"insecure" json:"insecure"`
+	Steps    []Step        `yaml:"steps" json:"steps"`
+}
+
+// Step is one HTTP request of a scenario plus its assertions.
+type Step struct {
+	Name    string            `yaml:"name" json:"name"`
+	Method  string            `yaml:"method" json:"method"`
+	URL     string            `yaml:"url" json:"url"`
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+	Body    string            `yaml:"body" json:"body,omitempty"`
+
+	// ExpectStatus is the required status code; 0 accepts any 2xx/3xx.
+	ExpectStatus      int    `yaml:"expect_status" json:"expect_status,omitempty"`
+	ExpectContains    string `yaml:"expect_contains" json:"expect_contains,omitempty"`
+	ExpectNotContains string `yaml:"expect_not_contains" json:"expect_not_contains,omitempty"`
+	// Extract maps a variable name to a regexp whose first capture group is
+	// taken from the response body.
+	Extract map[string]string `yaml:"extract" json:"extract,omitempty"`
+}
+
+// ParseScenario decodes and validates a YAML scenario, filling defaults.
+func ParseScenario(src []byte) (*Scenario, error) {
+	var sc Scenario
+	if err := yaml.Unmarshal(src, &sc); err != nil {
+		return nil, fmt.Errorf("parsing scenario: %w", err)
+	}
+	if strings.TrimSpace(sc.Name) == "" {
+		return nil, fmt.Errorf("scenario name is required")
+	}
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("scenario %q has no steps", sc.Name)
+	}
+	if sc.Interval <= 0 {
+		sc.Interval = time.Minute
+	}
+	if sc.Interval < 10*time.Second {
+		return nil, fmt.Errorf("scenario %q: interval must be at least 10s", sc.Name)
+	}
+	if sc.Timeout <= 0 {
+		sc.Timeout = 30 * time.Second
+	}
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		if st.Name == "" {
+			st.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		if st.Method == "" {
+			st.Method = http.MethodGet
+		}
+		st.Method = strings.ToUpper(st.Method)
+		if !strings.HasPrefix(st.URL, "http://") && !strings.HasPrefix(st.URL, "https://") {
+			return nil, fmt.Errorf("step %q: url must start with http:// or https://", st.Name)
+		}
+		for name, expr := range st.Extract {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("step %q: extract %q: %w", st.Name, name, err)
+			}
+			if re.NumSubexp() < 1 {
+				return nil, fmt.Errorf("step %q: extract %q needs a capture group", st.Name, name)
+			}
+		}
+	}
+	return &sc, nil
+}
+
+// StepResult is the outcome of one scenario step.
+type StepResult struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Status     int    `json:"status,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Result is the outcome of a whole check run.
+type Result struct {
+	OK         bool         `json:"ok"`
+	DurationMs int64        `json:"duration_ms"`
+	Error      string       `json:"error,omitempty"`
+	Steps      []StepResult `json:"steps,omitempty"`
+}
+
+// varRe matches ${name} placeholders.
+var varRe = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+// RunScenario executes the steps in order and stops at the first failure.
+func RunScenario(ctx context.Context, sc *Scenario) Result {
+	ctx, cancel := context.WithTimeout(ctx, sc.Timeout)
+	defer cancel()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: sc.Insecure}, //nolint:gosec // opt-in for self-signed NAS UIs
+		},
+	}
+	vars := map[string]string{}
+	expand := func(s string) string {
+		return varRe.ReplaceAllStringFunc(s, func(m string) string {
+			return vars[varRe.FindStringSubmatch(m)[1]]
+		})
+	}
+
+	start := time.Now()
+	res := Result{OK: true}
+	for _, st := range sc.Steps {
+		sr := runStep(ctx, client, &st, expand, vars)
+		res.Steps = append(res.Steps, sr)
+		if !sr.OK {
+			res.OK = false
+			res.Error = fmt.Sprintf("step %q: %s", sr.Name, sr.Error)
+			break
+		}
+	}
+	res.DurationMs = time.Since(start).Milliseconds()
+	return res
+}
+
+// runStep performs a single request, checks assertions and extracts variables.
+func runStep(ctx context.Context, client *http.Client, st *Step, expand func(string) string, vars map[string]string) (sr StepResult) {
+	sr.Name = st.Name
+	t0 := time.Now()
+	defer func() { sr.DurationMs = time.Since(t0).Milliseconds() }()
+
+	var body io.Reader
+	if st.Body != "" {
+		body = strings.NewReader(expand(st.Body))
+	}
+	req, err := http.NewRequestWithContext(ctx, st.Method, expand(st.URL), body)
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+	req.Header.Set("User-Agent", "OpenTalon-Check/1.0")
+	for k, v := range st.Headers {
+		req.Header.Set(k, expand(v))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+	defer resp.Body.Close()
+	sr.Status = resp.StatusCode
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	text := string(raw)
+
+	switch {
+	case st.ExpectStatus != 0 && resp.StatusCode != st.ExpectStatus:
+		sr.Error = fmt.Sprintf("status %d, expected %d", resp.StatusCode, st.ExpectStatus)
+		return sr
+	case st.ExpectStatus == 0 && resp.StatusCode >= 400:
+		sr.Error = fmt.Sprintf("status %d", resp.StatusCode)
+		return sr
+	case st.ExpectContains != "" && !strings.Contains(text, expand(st.ExpectContains)):
+		sr.Error = fmt.Sprintf("body does not contain %q", st.ExpectContains)
+		return sr
+	case st.ExpectNotContains != "" && strings.Contains(text, expand(st.ExpectNotContains)):
+		sr.Error = fmt.Sprintf("body contains %q", st.ExpectNotContains)
+		return sr
+	}
+	for name, expr := range st.Extract {
+		m := regexp.MustCompile(expr).FindStringSubmatch(text)
+		if len(m) < 2 {
+			sr.Error = fmt.Sprintf("extract %q: no match", name)
+			return sr
+		}
+		vars[name] = m[1]
+	}
+	sr.OK = true
+	return sr
+}
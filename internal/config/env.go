@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// envPrefix is prepended to every config key to form its environment variable.
+const envPrefix = "TALON"
+
+// envKeyReplacer maps nested keys ("alerts.smtp_host") to env-safe names.
+var envKeyReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// secretKeys are read from <VAR>_FILE as well and are never printed with
+// their default value, so Kubernetes Secrets can be mounted as files.
+var secretKeys = map[string]bool{
+	"jwt_secret":           true,
+	"agent_token":          true,
+	"agent_outbound_token": true,
+	"admin_pass":           true,
+	"db_dsn":               true,
+	"federation_token":     true,
+	"smtp_pass":            true,
+	"telegram_bot_token":   true,
+}
+
+// EnvName returns the environment variable that overrides a config key.
+func EnvName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(envKeyReplacer.Replace(key))
+}
+
+// Keys lists every config key of Config in declaration order. Nested structs
+// contribute "<parent>.<child>" keys (or flat ones when tagged ",squash").
+func Keys() []string {
+	return structKeys(reflect.TypeOf(Config{}), "")
+}
+
+func structKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("mapstructure")
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}) {
+			if opts == "squash" {
+				keys = append(keys, structKeys(ft, prefix)...)
+			} else {
+				keys = append(keys, structKeys(ft, prefix+name+".")...)
+			}
+			continue
+		}
+		keys = append(keys, prefix+name)
+	}
+	return keys
+}
+
+// bindEnv registers every key with viper so TALON_* variables apply even to
+// keys that have neither a default nor a value in the config file —
+// AutomaticEnv alone only covers keys viper already knows about.
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(envKeyReplacer)
+	v.AutomaticEnv()
+	for _, k := range Keys() {
+		_ = v.BindEnv(k)
+	}
+}
+
+// decodeHook is viper's default decode hook plus stringToMap, so map keys
+// can be set from the environment as well.
+var decodeHook = viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+	stringToMap,
+))
+
+// stringToMap parses "key=value,key=value" (as envValue prints maps) into
+// a map; viper converts the values to the map's element type.
+func stringToMap(from, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Map {
+		return data, nil
+	}
+	out := map[string]string{}
+	for _, pair := range strings.Split(reflect.ValueOf(data).String(), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
+
+// applySecretFiles reads <VAR>_FILE for every key, e.g.
+// TALON_JWT_SECRET_FILE=/run/secrets/jwt_secret. The file content, minus
+// trailing newlines, becomes the value; setting both forms is an error.
+func applySecretFiles(v *viper.Viper) error {
+	for _, k := range Keys() {
+		env := EnvName(k)
+		path := os.Getenv(env + "_FILE")
+		if path == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(env); ok {
+			return fmt.Errorf("both %s and %s_FILE are set", env, env)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s_FILE: %w", env, err)
+		}
+		v.Set(k, strings.TrimRight(string(b), "\r\n"))
+	}
+	return nil
+}
+
+// PrintEnvTemplate writes every config key as a TALON_* assignment with its
+// default value, ready for a .env file or a Helm values / ConfigMap block.
+// Secrets are emitted commented out, pointing at the _FILE variant.
+func PrintEnvTemplate(w io.Writer) error {
+	v := viper.New()
+	setDefaults(v)
+	fmt.Fprintln(w, "# OpenTalon environment configuration (defaults).")
+	fmt.Fprintln(w, "# Every key can also be read from a file via <VAR>_FILE, e.g. mounted Kubernetes Secrets.")
+	for _, k := range Keys() {
+		env := EnvName(k)
+		if secretKeys[k] {
+			fmt.Fprintf(w, "# %s=\n# %s_FILE=/run/secrets/%s\n", env, env, k)
+			continue
+		}
+		fmt.Fprintf(w, "%s=%s\n", env, envValue(v.Get(k)))
+	}
+	return nil
+}
+
+// envValue formats a default the way viper parses it back from the
+// environment: lists comma-separated, maps as key=value pairs.
+func envValue(val any) string {
+	switch x := val.(type) {
+	case nil:
+		return ""
+	case []string:
+		return strings.Join(x, ",")
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Map {
+		return fmt.Sprint(val)
+	}
+	pairs := make([]string, 0, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", iter.Key(), iter.Value()))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvValue(t *testing.T) {
+	tests := []struct {
+		name string
+		val  any
+		want string
+	}{
+		{"nil", nil, ""},
+		{"int", 1616, "1616"},
+		{"bool", true, "true"},
+		{"list", []string{"a:b:admin", "c:d:viewer"}, "a:b:admin,c:d:viewer"},
+		{"empty list", []string{}, ""},
+		{"map", map[string]int{"lab": 7, "core": 30}, "core=30,lab=7"},
+		{"empty map", map[string]int{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := envValue(tt.val); got != tt.want {
+				t.Errorf("envValue(%v) = %q, want %q", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEnvTemplateRoundTrip feeds the printed template back as the
+// environment: it must load, and give the defaults.
+func TestEnvTemplateRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	var buf bytes.Buffer
+	if err := PrintEnvTemplate(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, val, ok := strings.Cut(line, "=")
+		if !ok {
+			t.Fatalf("malformed template line %q", line)
+		}
+		t.Setenv(name, val)
+	}
+
+	got, err := Load()
+	if err != nil {
+		t.Fatalf("loading the template: %v", err)
+	}
+	want, err := FromMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		gv, wv := reflect.ValueOf(got).Elem(), reflect.ValueOf(want).Elem()
+		for i := 0; i < gv.NumField(); i++ {
+			if !reflect.DeepEqual(gv.Field(i).Interface(), wv.Field(i).Interface()) {
+				t.Errorf("%s = %#v, want %#v", gv.Type().Field(i).Name, gv.Field(i).Interface(), wv.Field(i).Interface())
+			}
+		}
+	}
+}
+
+func TestEnvUsersList(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("TALON_USERS", envValue([]string{"a:b:admin", "c:d:viewer"}))
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a:b:admin", "c:d:viewer"}; !reflect.DeepEqual(cfg.Users, want) {
+		t.Errorf("Users = %q, want %q", cfg.Users, want)
+	}
+}
+
+func TestEnvGroupRetentionMap(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	want := map[string]int{"lab": 7, "core": 90}
+	t.Setenv("TALON_METRICS_GROUP_RETENTION_DAYS", envValue(want))
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.MetricsGroupRetentionDays, want) {
+		t.Errorf("MetricsGroupRetentionDays = %v, want %v", cfg.MetricsGroupRetentionDays, want)
+	}
+
+	t.Setenv("TALON_METRICS_GROUP_RETENTION_DAYS", "lab")
+	if _, err := Load(); err == nil {
+		t.Error("Load accepted a pair without =")
+	}
+}
@@ -0,0 +1,251 @@
+// Package ctl is the client side of `opentalon ctl`: it talks to a server's
+// control-plane API and prints the answers as tables or JSON, so the fleet
+// can be managed from a shell without the Web UI.
+package ctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Client calls the control-plane API as one user. Token is a session JWT
+// (see Login) or a personal API token.
+type Client struct {
+	Server string
+	Token  string
+	HTTP   *http.Client
+	// IssuedAt and Expires bound the session token from Login or Refresh.
+	IssuedAt, Expires time.Time
+}
+
+// NewClient returns a client for the control plane at server.
+func NewClient(server, token string) *Client {
+	return &Client{Server: strings.TrimRight(server, "/"), Token: token, HTTP: &http.Client{Timeout: 2 * time.Minute}}
+}
+
+// Login signs in to the control plane at server with a user name and
+// password and returns a client holding the session token.
+func Login(server, user, pass string) (*Client, error) {
+	c := NewClient(server, "")
+	if err := c.session(http.MethodPost, "/api/login", map[string]string{"username": user, "password": pass}); err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	return c, nil
+}
+
+// Refresh swaps the session token for a fresh one (POST /api/refresh); the
+// old one stops working.
+func (c *Client) Refresh() error {
+	return c.session(http.MethodPost, "/api/refresh", nil)
+}
+
+// session makes a request answered with a session token and keeps it.
+func (c *Client) session(method, path string, body any) error {
+	var out struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	now := time.Now()
+	if err := c.Do(method, path, nil, body, &out); err != nil {
+		return err
+	}
+	if out.Token == "" {
+		return fmt.Errorf("no token in the answer")
+	}
+	c.Token, c.IssuedAt, c.Expires = out.Token, now, now.Add(time.Duration(out.ExpiresIn)*time.Second)
+	return nil
+}
+
+// Do sends a request with body (JSON, unless nil) and decodes the answer
+// into out. A non-2xx status returns the server's error message.
+func (c *Client) Do(method, path string, query url.Values, body, out any) error {
+	u := c.Server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s (HTTP %d)", e.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("%s %s: HTTP %d", method, path, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// get fetches path and decodes the "data" member of the answer into data.
+func (c *Client) get(path string, query url.Values, data any) error {
+	return c.Do(http.MethodGet, path, query, nil, &struct {
+		Data any `json:"data"`
+	}{data})
+}
+
+// DeviceFilter narrows Devices like the query parameters of GET
+// /api/devices; empty fields do not filter.
+type DeviceFilter struct {
+	Group  string
+	Tag    string
+	Online string // "true" or "false"
+	Query  string
+}
+
+// Devices lists the devices matching f, fetching every page.
+func (c *Client) Devices(f DeviceFilter) ([]models.Device, error) {
+	q := url.Values{"per_page": {"500"}}
+	for k, v := range map[string]string{"group": f.Group, "tag": f.Tag, "online": f.Online, "q": f.Query} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	all := []models.Device{}
+	for page := 1; ; page++ {
+		q.Set("page", strconv.Itoa(page))
+		var out struct {
+			Data  []models.Device `json:"data"`
+			Total int             `json:"total"`
+		}
+		if err := c.Do(http.MethodGet, "/api/devices", q, nil, &out); err != nil {
+			return nil, err
+		}
+		all = append(all, out.Data...)
+		if len(out.Data) == 0 || len(all) >= out.Total {
+			return all, nil
+		}
+	}
+}
+
+// Device returns the device with the given ID.
+func (c *Client) Device(id uint) (*models.Device, error) {
+	devices, err := c.Devices(DeviceFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		if devices[i].ID == id {
+			return &devices[i], nil
+		}
+	}
+	return nil, fmt.Errorf("device %d not found", id)
+}
+
+// DeviceMetrics is the answer of GET /api/devices/:id/metrics: the latest
+// report and the readings that come with it.
+type DeviceMetrics struct {
+	Metrics *models.Metrics        `json:"data"`
+	Sensors []models.SensorReading `json:"sensors"`
+	GPUs    []models.GPUReading    `json:"gpus"`
+	Latency []models.LatencySample `json:"latency"`
+}
+
+// Metrics returns the latest metrics of a device.
+func (c *Client) Metrics(id uint) (*DeviceMetrics, error) {
+	var m DeviceMetrics
+	if err := c.Do(http.MethodGet, fmt.Sprintf("/api/devices/%d/metrics", id), nil, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ExecResult is the outcome of a playbook run by Exec.
+type ExecResult struct {
+	Playbook   string `json:"playbook"`
+	Output     string `json:"output"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Exec runs a playbook on a device and waits for it; a non-empty command
+// runs the shell playbook with it.
+func (c *Client) Exec(id uint, playbook string, args map[string]string, command string) (*ExecResult, error) {
+	body := map[string]any{"playbook": playbook, "args": args, "command": command}
+	var res ExecResult
+	err := c.Do(http.MethodPost, fmt.Sprintf("/api/devices/%d/exec", id), nil, body, &struct {
+		Data *ExecResult `json:"data"`
+	}{&res})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AlertFilter narrows Alerts like the query parameters of GET /api/alerts.
+type AlertFilter struct {
+	State    string // firing or resolved
+	DeviceID uint
+	Rule     string
+	Limit    int
+}
+
+// Alerts lists alerts, latest first.
+func (c *Client) Alerts(f AlertFilter) ([]models.Alert, error) {
+	q := url.Values{}
+	if f.State != "" {
+		q.Set("state", f.State)
+	}
+	if f.DeviceID != 0 {
+		q.Set("device_id", strconv.FormatUint(uint64(f.DeviceID), 10))
+	}
+	if f.Rule != "" {
+		q.Set("rule", f.Rule)
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	alerts := []models.Alert{}
+	if err := c.get("/api/alerts", q, &alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// Tree returns the device tree with each device's latest metrics and open
+// alert count.
+func (c *Client) Tree() ([]*models.DeviceTree, error) {
+	tree := []*models.DeviceTree{}
+	if err := c.get("/api/devices/tree", url.Values{"include": {"metrics,alerts"}}, &tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
@@ -0,0 +1,133 @@
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Session is a stored `opentalon ctl login` to one server.
+type Session struct {
+	User      string    `json:"user"`
+	Token     string    `json:"token"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Credentials is ~/.opentalon/credentials: the stored sessions by server
+// URL, and the server ctl uses when --server is not given. The file holds
+// bearer tokens, so it is kept readable by its owner only.
+type Credentials struct {
+	Server   string              `json:"server"`
+	Sessions map[string]*Session `json:"sessions"`
+}
+
+// CredentialsPath returns the path of the credentials file.
+func CredentialsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".opentalon", "credentials"), nil
+}
+
+// LoadCredentials reads the credentials file; a missing file is empty.
+func LoadCredentials() (*Credentials, error) {
+	cr := &Credentials{Sessions: map[string]*Session{}}
+	path, err := CredentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cr); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cr.Sessions == nil {
+		cr.Sessions = map[string]*Session{}
+	}
+	return cr, nil
+}
+
+// Save writes the credentials file (mode 0600, in a 0700 directory),
+// replacing it atomically.
+func (cr *Credentials) Save() error {
+	path, err := CredentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cr, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Set stores the session of c's login as the one for its server and makes
+// that server the default.
+func (cr *Credentials) Set(user string, c *Client) {
+	cr.Server = c.Server
+	cr.Sessions[c.Server] = &Session{User: user, Token: c.Token, IssuedAt: c.IssuedAt, ExpiresAt: c.Expires}
+}
+
+// Client returns a client for the stored session of server (the default
+// server when empty), or nil when there is none. Once half of the
+// session's lifetime has passed the token is refreshed and saved, so a
+// session in regular use does not expire.
+func (cr *Credentials) Client(server string) (*Client, error) {
+	if server == "" {
+		server = cr.Server
+	}
+	server = strings.TrimRight(server, "/")
+	s := cr.Sessions[server]
+	if s == nil {
+		return nil, nil
+	}
+	now := time.Now()
+	if !now.Before(s.ExpiresAt) {
+		return nil, fmt.Errorf("the session for %s expired; run opentalon ctl login again", server)
+	}
+	c := NewClient(server, s.Token)
+	if now.Before(s.IssuedAt.Add(s.ExpiresAt.Sub(s.IssuedAt) / 2)) {
+		return c, nil
+	}
+	if err := c.Refresh(); err != nil {
+		return nil, fmt.Errorf("refreshing the session for %s: %w; run opentalon ctl login again", server, err)
+	}
+	def := cr.Server
+	cr.Set(s.User, c)
+	cr.Server = def
+	if err := cr.Save(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,175 @@
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// PrintJSON writes v as indented JSON, for --json and scripts.
+func PrintJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// table starts a tab-separated table with the given header row.
+func table(w io.Writer, header ...string) *tabwriter.Writer {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	return tw
+}
+
+// row writes one table row.
+func row(tw *tabwriter.Writer, cells ...any) {
+	for i, c := range cells {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, c)
+	}
+	fmt.Fprintln(tw)
+}
+
+// DeviceName is the name the Web UI shows: the remark, else the hostname.
+func DeviceName(d *models.Device) string {
+	if d.Remark != "" {
+		return d.Remark
+	}
+	return d.Hostname
+}
+
+// PrintDevices writes devices as a table.
+func PrintDevices(w io.Writer, devices []models.Device) error {
+	tw := table(w, "ID", "NAME", "IP", "OS", "GROUP", "STATUS", "LAST SEEN")
+	for i := range devices {
+		d := &devices[i]
+		row(tw, d.ID, DeviceName(d), d.IP, orDash(d.OS), d.Group, status(d.IsOnline), ago(d.LastSeen))
+	}
+	return tw.Flush()
+}
+
+// PrintDevice writes the details of one device.
+func PrintDevice(w io.Writer, d *models.Device) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	parent := "-"
+	if d.ParentID != nil {
+		parent = fmt.Sprint(*d.ParentID)
+	}
+	for _, f := range [][2]string{
+		{"ID", fmt.Sprint(d.ID)},
+		{"Name", DeviceName(d)},
+		{"Hostname", d.Hostname},
+		{"Status", status(d.IsOnline)},
+		{"Last seen", ago(d.LastSeen)},
+		{"IP", d.IP},
+		{"MAC", orDash(d.MAC)},
+		{"OS", orDash(d.OS)},
+		{"Group", d.Group},
+		{"Tags", orDash(strings.Join(d.Tags, ", "))},
+		{"Parent", parent},
+		{"Gateway", orDash(d.GatewayIP)},
+		{"Public IP", orDash(d.PublicIP)},
+		{"Agent", orDash(d.AgentVer)},
+		{"Added", d.CreatedAt.Local().Format(time.DateTime)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", f[0], f[1])
+	}
+	return tw.Flush()
+}
+
+// PrintMetrics writes the latest metrics of a device.
+func PrintMetrics(w io.Writer, m *DeviceMetrics) error {
+	if m.Metrics == nil {
+		_, err := fmt.Fprintln(w, "no metrics reported yet")
+		return err
+	}
+	p := m.Metrics
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Reported:\t%s (%s)\n", p.ReportedAt.Local().Format(time.DateTime), ago(p.ReportedAt))
+	fmt.Fprintf(tw, "CPU:\t%.1f%%\n", p.CPUUsage)
+	fmt.Fprintf(tw, "Memory:\t%.1f%% of %s\n", p.MemUsage, humanBytes(p.MemTotal))
+	fmt.Fprintf(tw, "Disk:\t%.1f%%\n", p.DiskUsage)
+	fmt.Fprintf(tw, "Network:\trx %s/s  tx %s/s\n", humanBytes(uint64(max(p.RxBytes, 0))), humanBytes(uint64(max(p.TxBytes, 0))))
+	fmt.Fprintf(tw, "Connections:\ttcp %d  udp %d\n", p.TCPConnections, p.UDPConnections)
+	fmt.Fprintf(tw, "Uptime:\t%s\n", time.Duration(p.Uptime)*time.Second)
+	for _, s := range m.Sensors {
+		fmt.Fprintf(tw, "Temp %s:\t%.0f°C\n", s.SensorKey, s.Temperature)
+	}
+	for _, g := range m.GPUs {
+		fmt.Fprintf(tw, "GPU%d %s:\t%.1f%%  %s / %s  %.0f°C\n", g.Index, g.Name, g.Utilization,
+			humanBytes(g.MemUsed), humanBytes(g.MemTotal), g.Temperature)
+	}
+	for _, l := range m.Latency {
+		fmt.Fprintf(tw, "Latency %s:\t%.1f ms, %.0f%% loss (%s %s)\n", l.Target, l.RTTAvg, l.LossPct, l.Method, l.Addr)
+	}
+	return tw.Flush()
+}
+
+// PrintAlerts writes alerts as a table; names maps device IDs to names.
+func PrintAlerts(w io.Writer, alerts []models.Alert, names map[uint]string) error {
+	tw := table(w, "ID", "STATUS", "SEVERITY", "RULE", "DEVICE", "VALUE", "FIRED", "ACKED BY")
+	for i := range alerts {
+		a := &alerts[i]
+		dev := names[a.DeviceID]
+		if dev == "" {
+			dev = fmt.Sprintf("#%d", a.DeviceID)
+		}
+		st := a.Status
+		if a.Silenced {
+			st += " (silenced)"
+		}
+		row(tw, a.ID, st, orDash(a.Severity), a.RuleName, dev,
+			fmt.Sprintf("%s %s %g (%.4g)", a.Metric, a.Operator, a.Threshold, a.Value), ago(a.FiredAt), orDash(a.AckedBy))
+	}
+	return tw.Flush()
+}
+
+func status(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+// ago renders t relative to now, e.g. "3m ago".
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,266 @@
+package ctl
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// topColumns are the columns of `opentalon top`; the metric ones are
+// right-aligned.
+var topColumns = []struct {
+	title string
+	right bool
+}{
+	{"NAME", false}, {"IP", false}, {"STATUS", false}, {"CPU", true}, {"MEM", true},
+	{"DISK", true}, {"RX/s", true}, {"TX/s", true}, {"ALERTS", true},
+}
+
+// topRow is a device tree node flattened for display.
+type topRow struct {
+	node   *models.DeviceTree
+	prefix string // the tree lines in front of the name
+	folded bool   // the node has children that are hidden
+}
+
+// topRows flattens tree depth-first, leaving out the children of the
+// devices in folded.
+func topRows(tree []*models.DeviceTree, folded map[uint]bool) []topRow {
+	var rows []topRow
+	var walk func(nodes []*models.DeviceTree, indent string, top bool)
+	walk = func(nodes []*models.DeviceTree, indent string, top bool) {
+		for i, n := range nodes {
+			last := i == len(nodes)-1
+			prefix, next := indent, indent
+			if !top {
+				if last {
+					prefix, next = indent+"└─ ", indent+"   "
+				} else {
+					prefix, next = indent+"├─ ", indent+"│  "
+				}
+			}
+			hide := folded[n.ID] && n.Kind == "" && len(n.Children) > 0
+			rows = append(rows, topRow{node: n, prefix: prefix, folded: hide})
+			if !hide {
+				walk(n.Children, next, false)
+			}
+		}
+	}
+	walk(tree, "", true)
+	return rows
+}
+
+// topCells returns the column texts of a row.
+func topCells(r topRow) []string {
+	n := r.node
+	name := n.Remark
+	if name == "" {
+		name = n.Hostname
+	}
+	switch {
+	case n.Kind != "":
+		name += " [" + n.Kind + "]"
+	case n.Site != "":
+		name += " @" + n.Site
+	}
+	if r.folded {
+		name += fmt.Sprintf(" (+%d)", countNodes(n.Children))
+	}
+	cells := []string{r.prefix + name, orDash(n.IP), orDash(n.Status), "-", "-", "-", "-", "-", "-"}
+	if m := n.Metrics; m != nil {
+		cells[3] = fmt.Sprintf("%.1f%%", m.CPUUsage)
+		cells[4] = fmt.Sprintf("%.1f%%", m.MemUsage)
+		cells[5] = fmt.Sprintf("%.1f%%", m.DiskUsage)
+		cells[6] = humanBytes(uint64(max(m.RxBytes, 0)))
+		cells[7] = humanBytes(uint64(max(m.TxBytes, 0)))
+	}
+	if n.OpenAlerts != nil {
+		cells[8] = fmt.Sprint(*n.OpenAlerts)
+	}
+	return cells
+}
+
+func countNodes(nodes []*models.DeviceTree) int {
+	n := len(nodes)
+	for _, c := range nodes {
+		n += countNodes(c.Children)
+	}
+	return n
+}
+
+// topSummary is the status line: device counts and the refresh time.
+func topSummary(server string, tree []*models.DeviceTree, at time.Time) string {
+	var total, online int
+	var walk func(nodes []*models.DeviceTree)
+	walk = func(nodes []*models.DeviceTree) {
+		for _, n := range nodes {
+			if n.Kind == "" && n.Site == "" {
+				total++
+				if n.IsOnline {
+					online++
+				}
+			}
+			walk(n.Children)
+		}
+	}
+	walk(tree)
+	return fmt.Sprintf("%s  %d devices, %d online  updated %s", server, total, online, at.Format("15:04:05"))
+}
+
+// PrintTop writes one frame of `opentalon top --once` as plain text.
+func PrintTop(w io.Writer, c *Client) error {
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	rows := topRows(tree, nil)
+	titles := make([]string, len(topColumns))
+	for i, col := range topColumns {
+		titles[i] = col.title
+	}
+	tw := table(w, titles...)
+	for _, r := range rows {
+		cells := topCells(r)
+		args := make([]any, len(cells))
+		for i, s := range cells {
+			args[i] = s
+		}
+		row(tw, args...)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "\n"+topSummary(c.Server, tree, time.Now()))
+	return err
+}
+
+// Top runs the interactive terminal dashboard: the device tree with live
+// metrics, refetched every interval. Enter folds or unfolds a device's
+// subtree, r refreshes at once, q quits.
+func Top(c *Client, interval time.Duration) error {
+	app := tview.NewApplication()
+	tbl := tview.NewTable().SetFixed(1, 0).SetSelectable(true, false)
+	status := tview.NewTextView().SetDynamicColors(true)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(tbl, 0, 1, true).
+		AddItem(status, 1, 0, false)
+
+	// tree, folded and rows are only touched on the UI goroutine.
+	var (
+		tree   []*models.DeviceTree
+		folded = map[uint]bool{}
+		rows   []topRow
+	)
+	// render redraws the table from tree, keeping the selected device.
+	render := func() {
+		var selected uint
+		if r, _ := tbl.GetSelection(); r > 0 && r-1 < len(rows) {
+			selected = rows[r-1].node.ID
+		}
+		rows = topRows(tree, folded)
+		tbl.Clear()
+		for i, col := range topColumns {
+			cell := tview.NewTableCell(col.title).SetSelectable(false).SetAttributes(tcell.AttrBold).
+				SetTextColor(tcell.ColorYellow).SetExpansion(1)
+			if col.right {
+				cell.SetAlign(tview.AlignRight)
+			}
+			tbl.SetCell(0, i, cell)
+		}
+		for i, r := range rows {
+			for j, text := range topCells(r) {
+				cell := tview.NewTableCell(tview.Escape(text)).SetExpansion(1)
+				if topColumns[j].right {
+					cell.SetAlign(tview.AlignRight)
+				}
+				cell.SetTextColor(topCellColor(r.node, j))
+				tbl.SetCell(i+1, j, cell)
+			}
+			if r.node.ID == selected {
+				tbl.Select(i+1, 0)
+			}
+		}
+	}
+
+	refresh := make(chan struct{}, 1)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			got, err := c.Tree()
+			app.QueueUpdateDraw(func() {
+				if err != nil {
+					status.SetText(fmt.Sprintf("[red]%s[-]  q quit  r refresh", tview.Escape(err.Error())))
+					return
+				}
+				tree = got
+				render()
+				status.SetText(tview.Escape(topSummary(c.Server, tree, time.Now())) + "  [gray]enter fold  r refresh  q quit[-]")
+			})
+			select {
+			case <-t.C:
+			case <-refresh:
+			}
+		}
+	}()
+
+	tbl.SetSelectedFunc(func(r, _ int) {
+		if r < 1 || r-1 >= len(rows) {
+			return
+		}
+		if n := rows[r-1].node; n.Kind == "" && len(n.Children) > 0 {
+			folded[n.ID] = !folded[n.ID]
+			render()
+		}
+	})
+	app.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEscape || ev.Rune() == 'q':
+			app.Stop()
+			return nil
+		case ev.Rune() == 'r':
+			select {
+			case refresh <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+		return ev
+	})
+	status.SetText("loading " + tview.Escape(c.Server) + " …")
+	return app.SetRoot(layout, true).Run()
+}
+
+// topCellColor colors the status by state and the usage columns by load.
+func topCellColor(n *models.DeviceTree, col int) tcell.Color {
+	switch col {
+	case 2:
+		switch n.Status {
+		case "online":
+			return tcell.ColorGreen
+		case "flapping", "shutdown":
+			return tcell.ColorYellow
+		case "offline":
+			return tcell.ColorRed
+		}
+	case 3, 4, 5:
+		if m := n.Metrics; m != nil {
+			v := []float64{m.CPUUsage, m.MemUsage, m.DiskUsage}[col-3]
+			switch {
+			case v >= 90:
+				return tcell.ColorRed
+			case v >= 70:
+				return tcell.ColorYellow
+			}
+		}
+	case 8:
+		if n.OpenAlerts != nil && *n.OpenAlerts > 0 {
+			return tcell.ColorRed
+		}
+	}
+	return tcell.ColorDefault
+}
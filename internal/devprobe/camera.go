@@ -0,0 +1,143 @@
+package devprobe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RTSPPort is the RTSP port cameras stream on.
+const RTSPPort = 554
+
+// onvifPorts are where cameras commonly serve the ONVIF device service:
+// the web port, and the alternates of Hikvision / Dahua (8000, 8080) and
+// TP-Link Tapo (2020).
+var onvifPorts = []int{80, 8000, 8080, 2020}
+
+// Camera is how an IP camera answers its streaming and management
+// protocols.
+type Camera struct {
+	// RTSP is true when the RTSP server answered OPTIONS; RTSPStatus is its
+	// status code (401 still means the stream server is up).
+	RTSP          bool   `json:"rtsp"`
+	RTSPStatus    int    `json:"rtsp_status,omitempty"`
+	RTSPLatencyMs int64  `json:"rtsp_latency_ms,omitempty"`
+	RTSPError     string `json:"rtsp_error,omitempty"`
+	// ONVIF is true when the ONVIF device service answered
+	// GetSystemDateAndTime, which needs no credentials.
+	ONVIF    bool   `json:"onvif"`
+	ONVIFURL string `json:"onvif_url,omitempty"`
+	// ClockSkewSec is the camera clock minus ours, from ONVIF; recording
+	// timestamps drift with it.
+	ClockSkewSec *int64 `json:"clock_skew_sec,omitempty"`
+}
+
+// ProbeCamera checks the RTSP server and the ONVIF device service of the
+// camera at host.
+func ProbeCamera(ctx context.Context, client *http.Client, host string, timeout time.Duration) *Camera {
+	c := &Camera{}
+	start := time.Now()
+	status, err := rtspOptions(ctx, host, timeout)
+	if err != nil {
+		c.RTSPError = err.Error()
+	} else {
+		c.RTSP, c.RTSPStatus, c.RTSPLatencyMs = true, status, time.Since(start).Milliseconds()
+	}
+	for _, port := range onvifPorts {
+		u := "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/onvif/device_service"
+		if skew, ok := onvifDateTime(ctx, client, u); ok {
+			c.ONVIF, c.ONVIFURL, c.ClockSkewSec = true, u, skew
+			break
+		}
+	}
+	return c
+}
+
+// rtspOptions sends an RTSP OPTIONS request and returns the status code.
+func rtspOptions(ctx context.Context, host string, timeout time.Duration) (int, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(RTSPPort))
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintf(conn, "OPTIONS rtsp://%s/ RTSP/1.0\r\nCSeq: 1\r\nUser-Agent: OpenTalon\r\n\r\n", addr); err != nil {
+		return 0, err
+	}
+	line, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil {
+		return 0, err
+	}
+	// "RTSP/1.0 200 OK"
+	f := strings.Fields(line)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "RTSP/") {
+		return 0, fmt.Errorf("not an RTSP server: %q", line)
+	}
+	code, err := strconv.Atoi(f[1])
+	if err != nil {
+		return 0, fmt.Errorf("bad RTSP status line %q", line)
+	}
+	return code, nil
+}
+
+const onvifDateTimeRequest = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body xmlns:tds="http://www.onvif.org/ver10/device/wsdl"><tds:GetSystemDateAndTime/></s:Body></s:Envelope>`
+
+// onvifDateTime calls GetSystemDateAndTime at the device service URL u and
+// returns the camera's clock skew if its answer carries the UTC time.
+func onvifDateTime(ctx context.Context, client *http.Client, u string) (skew *int64, ok bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(onvifDateTimeRequest))
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "GetSystemDateAndTimeResponse") {
+		return nil, false
+	}
+	if t, ok := onvifUTC(string(body)); ok {
+		s := int64(t.Sub(time.Now()).Seconds())
+		skew = &s
+	}
+	return skew, true
+}
+
+// onvifUTC extracts the UTCDateTime of a GetSystemDateAndTime response.
+func onvifUTC(body string) (time.Time, bool) {
+	_, utc, ok := strings.Cut(body, "UTCDateTime>")
+	if !ok {
+		return time.Time{}, false
+	}
+	field := func(name string) int {
+		_, rest, ok := strings.Cut(utc, name+">")
+		if !ok {
+			return -1
+		}
+		v, _, _ := strings.Cut(rest, "<")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	y, mo, d := field("Year"), field("Month"), field("Day")
+	h, mi, s := field("Hour"), field("Minute"), field("Second")
+	if y < 0 || mo < 0 || d < 0 || h < 0 || mi < 0 || s < 0 {
+		return time.Time{}, false
+	}
+	return time.Date(y, time.Month(mo), d, h, mi, s, 0, time.UTC), true
+}
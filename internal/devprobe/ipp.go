@@ -0,0 +1,249 @@
+// Package devprobe implements protocol-specific health probes for common
+// household devices without an agent: IPP for printers (state and toner
+// levels) and RTSP / ONVIF for IP cameras.
+package devprobe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IPPPort is the IPP port printers listen on.
+const IPPPort = 631
+
+// ippPaths are the printer URI paths tried in order: the IPP Everywhere
+// default, then those of older HP / Brother / CUPS-style firmware.
+var ippPaths = []string{"/ipp/print", "/ipp", "/ipp/printer", "/"}
+
+// Marker is one printer supply: toner, ink or drum.
+type Marker struct {
+	Name  string `json:"name"`
+	Color string `json:"color,omitempty"`
+	Type  string `json:"type,omitempty"`
+	// Level is the remaining percentage, -1 when the printer cannot tell.
+	Level int `json:"level"`
+}
+
+// Printer is the health a printer reports over IPP.
+type Printer struct {
+	URI   string `json:"uri"`
+	Model string `json:"model,omitempty"`
+	// State is idle, processing or stopped; Reasons says why, e.g.
+	// "media-empty-error" or "toner-low-report" ("none" when fine).
+	State   string   `json:"state"`
+	Reasons []string `json:"reasons,omitempty"`
+	Markers []Marker `json:"markers,omitempty"`
+}
+
+// IPP encoding, RFC 8010.
+const (
+	ippGetPrinterAttributes = 0x000b
+
+	ippTagOperation = 0x01
+	ippTagEnd       = 0x03
+	ippTagInteger   = 0x21
+	ippTagEnum      = 0x23
+	ippTagKeyword   = 0x44
+	ippTagURI       = 0x45
+	ippTagCharset   = 0x47
+	ippTagLanguage  = 0x48
+)
+
+var ippStates = map[int]string{3: "idle", 4: "processing", 5: "stopped"}
+
+// ippRequested are the printer attributes the probe asks for.
+var ippRequested = []string{
+	"printer-state", "printer-state-reasons", "printer-make-and-model",
+	"marker-names", "marker-colors", "marker-types", "marker-levels",
+}
+
+// ProbePrinter asks the printer at host for its state and supply levels
+// with an IPP Get-Printer-Attributes request.
+func ProbePrinter(ctx context.Context, client *http.Client, host string) (*Printer, error) {
+	var lastErr error
+	for _, path := range ippPaths {
+		uri := "ipp://" + net.JoinHostPort(host, strconv.Itoa(IPPPort)) + path
+		attrs, err := ippGetAttributes(ctx, client, uri)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return newPrinter(uri, attrs), nil
+	}
+	return nil, lastErr
+}
+
+func newPrinter(uri string, attrs map[string][]any) *Printer {
+	p := &Printer{URI: uri, State: "unknown"}
+	if v := ippStrings(attrs["printer-make-and-model"]); len(v) > 0 {
+		p.Model = v[0]
+	}
+	if v := ippInts(attrs["printer-state"]); len(v) > 0 {
+		if s, ok := ippStates[v[0]]; ok {
+			p.State = s
+		}
+	}
+	p.Reasons = ippStrings(attrs["printer-state-reasons"])
+	names, colors, types := ippStrings(attrs["marker-names"]), ippStrings(attrs["marker-colors"]), ippStrings(attrs["marker-types"])
+	for i, level := range ippInts(attrs["marker-levels"]) {
+		m := Marker{Level: level}
+		if level < 0 || level > 100 {
+			// -2 unknown, -3 "some remaining".
+			m.Level = -1
+		}
+		if i < len(names) {
+			m.Name = names[i]
+		}
+		if i < len(colors) {
+			m.Color = colors[i]
+		}
+		if i < len(types) {
+			m.Type = types[i]
+		}
+		p.Markers = append(p.Markers, m)
+	}
+	return p
+}
+
+// ippGetAttributes sends Get-Printer-Attributes to uri over HTTP and
+// returns the printer attributes by name.
+func ippGetAttributes(ctx context.Context, client *http.Client, uri string) (map[string][]any, error) {
+	var b bytes.Buffer
+	b.Write([]byte{2, 0}) // IPP 2.0
+	binary.Write(&b, binary.BigEndian, uint16(ippGetPrinterAttributes))
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	b.WriteByte(ippTagOperation)
+	ippWriteAttr(&b, ippTagCharset, "attributes-charset", "utf-8")
+	ippWriteAttr(&b, ippTagLanguage, "attributes-natural-language", "en")
+	ippWriteAttr(&b, ippTagURI, "printer-uri", uri)
+	for i, name := range ippRequested {
+		if i == 0 {
+			ippWriteAttr(&b, ippTagKeyword, "requested-attributes", name)
+		} else {
+			// Further values of the same attribute have an empty name.
+			ippWriteAttr(&b, ippTagKeyword, "", name)
+		}
+	}
+	b.WriteByte(ippTagEnd)
+
+	target := "http" + strings.TrimPrefix(uri, "ipp")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, &b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ipp")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ipp %s: HTTP %d", uri, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256<<10))
+	if err != nil {
+		return nil, err
+	}
+	return ippParse(body)
+}
+
+func ippWriteAttr(b *bytes.Buffer, tag byte, name, value string) {
+	b.WriteByte(tag)
+	binary.Write(b, binary.BigEndian, uint16(len(name)))
+	b.WriteString(name)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.WriteString(value)
+}
+
+var errIPPShort = errors.New("ipp: truncated response")
+
+// ippParse decodes an IPP response into its attributes: integers and enums
+// as int, everything else as string. Only a successful status (0x00xx) is
+// accepted.
+func ippParse(data []byte) (map[string][]any, error) {
+	if len(data) < 8 {
+		return nil, errIPPShort
+	}
+	if status := binary.BigEndian.Uint16(data[2:4]); status > 0xff {
+		return nil, fmt.Errorf("ipp: status 0x%04x", status)
+	}
+	attrs := map[string][]any{}
+	var name string
+	for p := 8; p < len(data); {
+		tag := data[p]
+		p++
+		if tag == ippTagEnd {
+			return attrs, nil
+		}
+		if tag < 0x10 {
+			// Start of the next attribute group.
+			continue
+		}
+		if p+2 > len(data) {
+			return nil, errIPPShort
+		}
+		n := int(binary.BigEndian.Uint16(data[p:]))
+		p += 2
+		if p+n+2 > len(data) {
+			return nil, errIPPShort
+		}
+		if n > 0 {
+			name = string(data[p : p+n])
+		}
+		p += n
+		vn := int(binary.BigEndian.Uint16(data[p:]))
+		p += 2
+		if p+vn > len(data) {
+			return nil, errIPPShort
+		}
+		v := data[p : p+vn]
+		p += vn
+		switch {
+		case (tag == ippTagInteger || tag == ippTagEnum) && vn == 4:
+			attrs[name] = append(attrs[name], int(int32(binary.BigEndian.Uint32(v))))
+		case tag >= 0x40:
+			attrs[name] = append(attrs[name], string(v))
+		}
+	}
+	return attrs, nil
+}
+
+func ippStrings(vals []any) []string {
+	var out []string
+	for _, v := range vals {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func ippInts(vals []any) []int {
+	var out []int
+	for _, v := range vals {
+		if i, ok := v.(int); ok {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// PortOpen reports whether host accepts TCP connections on port.
+func PortOpen(ctx context.Context, host string, port int, timeout time.Duration) bool {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
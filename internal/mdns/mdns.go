@@ -0,0 +1,185 @@
+// Package mdns implements the small part of multicast DNS (RFC 6762) and
+// DNS-SD (RFC 6763) that OpenTalon needs to find its server on the LAN
+// without any configuration.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// Port is the mDNS port.
+const Port = 5353
+
+// groupV4 is the IPv4 mDNS multicast group.
+var groupV4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+
+// qu is the "unicast response" bit in a question's class (RFC 6762 §5.4).
+const qu = 1 << 15
+
+// Service is one instance of a service type found by Browse.
+type Service struct {
+	Instance string // e.g. "opentalon-nas._opentalon._tcp.local."
+	Host     string // SRV target, e.g. "nas.local."
+	// IPs are the A records of Host; when the responder sent none, the
+	// address the answer came from.
+	IPs  []net.IP
+	Port int
+	TXT  []string
+}
+
+// Browse asks for instances of service (e.g. "_opentalon._tcp") on every
+// multicast-capable IPv4 interface and collects answers until ctx's
+// deadline (2s without one). The query is sent from an ephemeral port, so
+// responders answer unicast and no socket on 5353 (often held by Avahi) is
+// needed.
+func Browse(ctx context.Context, service string) ([]Service, error) {
+	qname := strings.ToLower(strings.TrimSuffix(service, ".") + ".local.")
+	name, err := dnsmessage.NewName(qname)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET | qu,
+	}}}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+	sent := 0
+	ifaces, _ := net.Interfaces()
+	for i := range ifaces {
+		ifi := &ifaces[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if pc.SetMulticastInterface(ifi) != nil {
+			continue
+		}
+		if _, err := pc.WriteTo(query, nil, groupV4); err == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		// No usable interface list (containers): let the kernel route it.
+		if _, err := conn.WriteTo(query, groupV4); err != nil {
+			return nil, err
+		}
+	}
+
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(dl)
+	} else {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	}
+	r := newResults(qname)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return nil, err
+		}
+		var m dnsmessage.Message
+		if m.Unpack(buf[:n]) != nil || !m.Response {
+			continue
+		}
+		r.add(&m, src.IP)
+	}
+	return r.services(), nil
+}
+
+// results accumulates the records of all answers to one query.
+type results struct {
+	service string
+	order   []string // instance names in the order they were announced
+	srv     map[string]dnsmessage.SRVResource
+	txt     map[string][]string
+	addrs   map[string][]net.IP
+	from    map[string]net.IP
+}
+
+func newResults(service string) *results {
+	return &results{
+		service: service,
+		srv:     map[string]dnsmessage.SRVResource{},
+		txt:     map[string][]string{},
+		addrs:   map[string][]net.IP{},
+		from:    map[string]net.IP{},
+	}
+}
+
+func (r *results) add(m *dnsmessage.Message, src net.IP) {
+	records := append(append(m.Answers, m.Authorities...), m.Additionals...)
+	for _, rr := range records {
+		owner := strings.ToLower(rr.Header.Name.String())
+		switch b := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if owner != r.service {
+				continue
+			}
+			inst := strings.ToLower(b.PTR.String())
+			if _, seen := r.from[inst]; !seen {
+				r.order = append(r.order, inst)
+				r.from[inst] = src
+			}
+		case *dnsmessage.SRVResource:
+			r.srv[owner] = *b
+		case *dnsmessage.TXTResource:
+			r.txt[owner] = b.TXT
+		case *dnsmessage.AResource:
+			ip := net.IP(append([]byte(nil), b.A[:]...))
+			if !containsIP(r.addrs[owner], ip) {
+				r.addrs[owner] = append(r.addrs[owner], ip)
+			}
+		}
+	}
+}
+
+func (r *results) services() []Service {
+	var out []Service
+	for _, inst := range r.order {
+		srv, ok := r.srv[inst]
+		if !ok {
+			continue
+		}
+		host := strings.ToLower(srv.Target.String())
+		ips := r.addrs[host]
+		if len(ips) == 0 {
+			ips = []net.IP{r.from[inst]}
+		}
+		out = append(out, Service{
+			Instance: inst,
+			Host:     host,
+			IPs:      ips,
+			Port:     int(srv.Port),
+			TXT:      r.txt[inst],
+		})
+	}
+	return out
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, x := range list {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
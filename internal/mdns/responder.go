@@ -0,0 +1,224 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// Record TTLs: legacy unicast answers must not be cached long (RFC 6762
+// §6.7); the others use the RFC's recommended host-record TTL.
+const (
+	ttl       = 120
+	legacyTTL = 10
+)
+
+// servicesName is the DNS-SD meta-query that lists service types.
+const servicesName = "_services._dns-sd._udp.local."
+
+// Responder advertises one service instance on the LAN.
+type Responder struct {
+	Instance string // e.g. "OpenTalon on nas"; dots are replaced
+	Service  string // e.g. "_opentalon._tcp"
+	Port     int
+	TXT      []string // "key=value" strings
+}
+
+// Serve joins the mDNS group on every multicast interface, announces the
+// instance once and answers queries for it until ctx is done. The socket
+// shares port 5353 with other responders such as Avahi.
+func (r *Responder) Serve(ctx context.Context) error {
+	host, _ := os.Hostname()
+	host, _, _ = strings.Cut(host, ".")
+	if host == "" {
+		host = "opentalon"
+	}
+	svc := strings.ToLower(strings.TrimSuffix(r.Service, ".") + ".local.")
+	names := names{
+		service:  svc,
+		instance: strings.ReplaceAll(r.Instance, ".", "-") + "." + svc,
+		host:     strings.ToLower(host) + ".local.",
+	}
+
+	// A multicast local address makes the net package bind the wildcard
+	// address with SO_REUSEADDR.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: groupV4.IP, Port: Port})
+	if err != nil {
+		return err
+	}
+	pc := ipv4.NewPacketConn(conn)
+	_ = pc.SetControlMessage(ipv4.FlagInterface, true)
+	ifaces, _ := net.Interfaces()
+	var joined []*net.Interface
+	for i := range ifaces {
+		ifi := &ifaces[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if pc.JoinGroup(ifi, groupV4) == nil {
+			joined = append(joined, ifi)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for _, ifi := range joined {
+		if msg, err := r.response(names, ifaceIPs(ifi.Index), 0, nil, ttl); err == nil {
+			_, _ = pc.WriteTo(msg, &ipv4.ControlMessage{IfIndex: ifi.Index}, groupV4)
+		}
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var m dnsmessage.Message
+		if m.Unpack(buf[:n]) != nil || m.Response || len(m.Questions) == 0 {
+			continue
+		}
+		udp, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		// Queries from a port other than 5353 come from simple resolvers
+		// that expect a plain unicast DNS answer (RFC 6762 §6.7).
+		legacy := udp.Port != Port
+		unicast := legacy
+		matched := false
+		for _, q := range m.Questions {
+			if names.matches(q) {
+				matched = true
+				unicast = unicast || q.Class&qu != 0
+			}
+		}
+		if !matched {
+			continue
+		}
+		id, recordTTL := uint16(0), uint32(ttl)
+		var echo []dnsmessage.Question
+		if legacy {
+			id, recordTTL, echo = m.ID, legacyTTL, m.Questions
+		}
+		msg, err := r.response(names, ifaceIPs(ifIndex), id, echo, recordTTL)
+		if err != nil {
+			continue
+		}
+		dst := groupV4
+		if unicast {
+			dst = udp
+		}
+		_, _ = pc.WriteTo(msg, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+	}
+}
+
+// names are the owner names of the advertised records.
+type names struct {
+	service, instance, host string
+}
+
+func (n names) matches(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch name {
+	case n.service, servicesName:
+		return q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL
+	case strings.ToLower(n.instance):
+		return q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL
+	case n.host:
+		return q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL
+	}
+	return false
+}
+
+// response builds an answer carrying every record of the instance, so a
+// browser gets PTR, SRV, TXT and A in one round trip. The legacy form
+// echoes the query ID and questions.
+func (r *Responder) response(n names, ips []net.IP, id uint16, echo []dnsmessage.Question, recordTTL uint32) ([]byte, error) {
+	svc, err := dnsmessage.NewName(n.service)
+	if err != nil {
+		return nil, err
+	}
+	inst, err := dnsmessage.NewName(n.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(n.host)
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := dnsmessage.NewName(servicesName)
+	// The cache-flush bit marks records unique to this host (§10.2);
+	// legacy resolvers do not know it.
+	unique := dnsmessage.ClassINET | qu
+	if echo != nil {
+		unique = dnsmessage.ClassINET
+	}
+	hdr := func(name dnsmessage.Name, typ dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: recordTTL}
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: echo,
+		Answers: []dnsmessage.Resource{
+			{Header: hdr(svc, dnsmessage.TypePTR, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: inst}},
+			{Header: hdr(meta, dnsmessage.TypePTR, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: svc}},
+			{Header: hdr(inst, dnsmessage.TypeSRV, unique), Body: &dnsmessage.SRVResource{Target: host, Port: uint16(r.Port)}},
+			{Header: hdr(inst, dnsmessage.TypeTXT, unique), Body: &dnsmessage.TXTResource{TXT: txtOrEmpty(r.TXT)}},
+		},
+	}
+	for _, ip := range ips {
+		var a [4]byte
+		copy(a[:], ip.To4())
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: hdr(host, dnsmessage.TypeA, unique), Body: &dnsmessage.AResource{A: a},
+		})
+	}
+	return msg.Pack()
+}
+
+// txtOrEmpty returns txt, or the single empty string a TXT record without
+// data must carry (RFC 6763 §6.1).
+func txtOrEmpty(txt []string) []string {
+	if len(txt) == 0 {
+		return []string{""}
+	}
+	return txt
+}
+
+// ifaceIPs returns the IPv4 addresses of the interface with index idx, or
+// of every non-loopback interface when it is unknown.
+func ifaceIPs(idx int) []net.IP {
+	var ifaces []net.Interface
+	if ifi, err := net.InterfaceByIndex(idx); idx != 0 && err == nil {
+		ifaces = []net.Interface{*ifi}
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+	var out []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				out = append(out, ipn.IP.To4())
+			}
+		}
+	}
+	return out
+}
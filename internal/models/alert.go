@@ -0,0 +1,105 @@
+package models
+
+import "time"
+
+// Alert states.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert severities, lowest first.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// AlertRule is a threshold condition evaluated against every device in its
+// scope, e.g. cpu_usage > 90 for 5 minutes. Metric "offline" fires on
+// devices that stopped reporting for DurationSec.
+type AlertRule struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name      string  `gorm:"uniqueIndex;size:128;not null" json:"name"`
+	Metric    string  `gorm:"not null" json:"metric"`
+	Operator  string  `json:"operator"` // >, >=, <, <=, ==, !=
+	Threshold float64 `json:"threshold"`
+	// DurationSec is how long the condition must hold before it fires.
+	DurationSec int    `json:"duration_sec"`
+	Severity    string `json:"severity"`
+	// DeviceIDs (comma-separated, e.g. "3,7"), Group and Tag restrict the
+	// rule to some devices; all empty means every agent device.
+	DeviceIDs string `json:"device_ids"`
+	Group     string `json:"group"`
+	Tag       string `json:"tag"`
+	// Channel names the notification channel the rule's alerts go to.
+	Channel string `json:"channel"`
+	// Escalation lists the channels an unacknowledged alert goes to next
+	// and when, counted from its first notification, e.g.
+	// "oncall:15m,manager:1h".
+	Escalation string `json:"escalation"`
+	Enabled    bool   `gorm:"default:true" json:"enabled"`
+}
+
+// Alert is one firing of an alert rule on a device: it is created when the
+// rule's condition has held for its duration and resolved when the
+// condition clears.
+type Alert struct {
+	ID       uint   `gorm:"primarykey;autoIncrement" json:"id"`
+	RuleID   uint   `gorm:"index" json:"rule_id"`
+	RuleName string `gorm:"index;not null" json:"rule_name"`
+	DeviceID uint   `gorm:"index;not null" json:"device_id"`
+	Severity string `json:"severity"`
+	// Channel and Escalation are the rule's notification channel and
+	// escalation steps when the alert fired.
+	Channel    string `json:"channel,omitempty"`
+	Escalation string `json:"escalation,omitempty"`
+
+	Metric    string  `json:"metric"`
+	Operator  string  `json:"operator"`
+	Threshold float64 `json:"threshold"`
+	// Value is the metric value that fired the alert (seconds offline for
+	// the offline metric).
+	Value   float64 `json:"value"`
+	Message string  `json:"message"`
+
+	Status     string     `gorm:"index;not null" json:"status"`
+	FiredAt    time.Time  `gorm:"index" json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	// AckedAt / AckedBy record who acknowledged the alert while it fired.
+	AckedAt *time.Time `json:"acked_at,omitempty"`
+	AckedBy string     `json:"acked_by,omitempty"`
+	// Silenced is set while a silence mutes the alert; it notifies when
+	// the silence ends if it is still firing.
+	Silenced bool `gorm:"index" json:"silenced,omitempty"`
+	// NotifiedAt is when the alert first notified; Escalations counts the
+	// escalation steps taken since.
+	NotifiedAt  *time.Time `json:"notified_at,omitempty"`
+	Escalations int        `gorm:"not null;default:0" json:"escalations,omitempty"`
+}
+
+// AlertEvent types: the transitions of an alert.
+const (
+	AlertEventFired      = "fired"
+	AlertEventResolved   = "resolved"
+	AlertEventAcked      = "acked"
+	AlertEventEscalated  = "escalated"
+	AlertEventUnsilenced = "unsilenced"
+)
+
+// AlertEvent is one transition of an alert, its incident timeline: fired,
+// acknowledged (By), escalated (Channel), released from a silence or
+// resolved.
+type AlertEvent struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	AlertID   uint      `gorm:"index;not null" json:"alert_id"`
+	DeviceID  uint      `gorm:"index" json:"device_id"`
+	Type      string    `gorm:"not null" json:"type"`
+	By        string    `json:"by,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Message   string    `json:"message"`
+}
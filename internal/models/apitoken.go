@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// API token scopes: read allows GET requests, write every method.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// APIToken is a personal token a user created for scripts. It acts with
+// its owner's role, further limited by Scopes; only its hash is stored.
+type APIToken struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Username string `gorm:"index;not null" json:"username"`
+	Name     string `json:"name"`
+	// Prefix is the token's start, enough to tell tokens apart.
+	Prefix string `json:"prefix"`
+	Hash   string `gorm:"uniqueIndex;size:64;not null" json:"-"`
+	// Scopes is comma-separated, e.g. "read" or "read,write".
+	Scopes     string     `gorm:"not null" json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// MetricBaseline is what one metric of a device usually is at one hour of
+// the day, learned for anomaly alert rules: the exponentially weighted mean
+// and variance of the samples in that hour over recent days. Rows are kept
+// only for the devices and metrics an anomaly rule watches.
+type MetricBaseline struct {
+	ID       uint   `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint   `gorm:"uniqueIndex:idx_baseline;not null" json:"device_id"`
+	Metric   string `gorm:"uniqueIndex:idx_baseline;size:32;not null" json:"metric"`
+	// Hour is the hour of the day (0-23) in the server's time zone.
+	Hour     int     `gorm:"uniqueIndex:idx_baseline" json:"hour"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	// Days counts the days of samples learned so far.
+	Days      int       `json:"days"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
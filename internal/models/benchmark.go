@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Benchmark is the result of the benchmark playbook on a device: a
+// performance baseline to compare later runs and similar hosts against.
+// Throughputs are 0 when their step failed or could not run (Error says
+// why).
+type Benchmark struct {
+	RanAt time.Time `json:"ran_at"`
+	Cores int       `json:"cores"`
+	// CPUSingleMBps / CPUMultiMBps are SHA-256 throughput on one core and
+	// on all cores together.
+	CPUSingleMBps float64 `json:"cpu_single_mbps"`
+	CPUMultiMBps  float64 `json:"cpu_multi_mbps"`
+	// DiskWriteMBps is a 256 MiB sequential write, synced to disk.
+	DiskWriteMBps float64 `json:"disk_write_mbps"`
+	// NetDownloadMbps / NetUploadMbps are throughput to the server's data
+	// plane (its speed test endpoints).
+	NetDownloadMbps float64 `json:"net_download_mbps"`
+	NetUploadMbps   float64 `json:"net_upload_mbps"`
+	Error           string  `json:"error,omitempty"`
+}
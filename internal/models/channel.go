@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Kinds of notification channel stored in the database.
+const (
+	ChannelWebhook  = "webhook" // generic JSON webhook
+	ChannelSlack    = "slack"
+	ChannelDiscord  = "discord"
+	ChannelDingTalk = "dingtalk" // DingTalk custom robot
+	ChannelWeCom    = "wecom"    // WeCom (企业微信) group robot
+)
+
+// NotificationChannel is a notification channel managed through the API.
+// Alert rules select it by Name, like the channels from the config file.
+type NotificationChannel struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name string `gorm:"uniqueIndex;size:64;not null" json:"name"`
+	Type string `gorm:"not null" json:"type"` // webhook | slack | discord | dingtalk | wecom
+	// URL is the incoming webhook; it carries the credentials, so the API
+	// only shows its host.
+	URL string `gorm:"not null" json:"url"`
+	// Secret signs DingTalk requests ("加签"); the API never shows it.
+	Secret string `json:"secret,omitempty"`
+	// Template, when set, is the Go text/template rendering the request
+	// body instead of the type's built-in message.
+	Template string `gorm:"type:text" json:"template,omitempty"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Check is a synthetic service check definition. Spec holds the YAML source
+// (see package checks); AgentIDs lists the devices whose agents execute it,
+// empty for checks the server runs itself.
+type Check struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name        string `gorm:"uniqueIndex;size:128;not null" json:"name"`
+	Type        string `gorm:"index;not null" json:"type"` // "scenario", "http" or "tcp"
+	Spec        string `json:"spec"`
+	IntervalSec int    `json:"interval_sec"`
+	// AgentIDs is a comma-separated list of executing device IDs, e.g. "3,7".
+	AgentIDs string `json:"agent_ids"`
+	Enabled  bool   `json:"enabled"`
+
+	// Last observed state, denormalised for list views.
+	LastOK        *bool     `json:"last_ok"`
+	LastError     string    `json:"last_error"`
+	LastCheckedAt time.Time `json:"last_checked_at"`
+}
+
+// CheckResult records one execution of a Check by one agent.
+type CheckResult struct {
+	ID         uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CheckID    uint      `gorm:"index;not null" json:"check_id"`
+	DeviceID   uint      `gorm:"index" json:"device_id"` // executing agent; 0 = server
+	OK         bool      `json:"ok"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error"`
+	Detail     string    `json:"detail"` // JSON-encoded per-step results
+	CheckedAt  time.Time `gorm:"index" json:"checked_at"`
+}
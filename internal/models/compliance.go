@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Compliance rule sources: a fact the server already knows about the
+// device (mostly from its agent), or the output of a command run over SSH.
+const (
+	ComplianceFact = "fact"
+	ComplianceSSH  = "ssh"
+)
+
+// ComplianceRule states how devices of a group are expected to be
+// configured, e.g. "rp_filter must be 0 on bypass routers": the value of
+// Fact, or the trimmed output of Command, must satisfy Operator Expected.
+// Remediation tells the operator how to fix a violation; Playbook names a
+// playbook that does.
+type ComplianceRule struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name  string `gorm:"uniqueIndex;size:128;not null" json:"name"`
+	Group string `gorm:"index" json:"group"` // empty: every group
+
+	Source   string `gorm:"size:8;not null" json:"source"` // fact / ssh
+	Fact     string `json:"fact,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Operator string `gorm:"size:16;not null" json:"operator"`
+	Expected string `json:"expected"`
+
+	Severity    string `gorm:"size:16" json:"severity"`
+	Remediation string `json:"remediation"`
+	Playbook    string `json:"playbook,omitempty"`
+	Enabled     bool   `gorm:"default:true" json:"enabled"`
+}
+
+// ComplianceResult is the latest evaluation of a rule on a device. Error is
+// set when the value could not be read (e.g. SSH failed); the device then
+// counts as unknown, not as violating the rule.
+type ComplianceResult struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"-"`
+	RuleID    uint      `gorm:"uniqueIndex:idx_compliance_result;not null" json:"rule_id"`
+	DeviceID  uint      `gorm:"uniqueIndex:idx_compliance_result;index;not null" json:"device_id"`
+	Compliant bool      `json:"compliant"`
+	Actual    string    `json:"actual"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
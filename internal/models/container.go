@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Container is a Docker container reported by the agent on its host device.
+// Containers are not managed devices (they have no agent and their bridge IPs
+// are not unique across hosts), so they live in their own table and are only
+// attached as leaf nodes under the host in the device tree.
+type Container struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	DeviceID    uint   `gorm:"uniqueIndex:idx_container_host;not null" json:"device_id"`
+	ContainerID string `gorm:"uniqueIndex:idx_container_host;size:64;not null" json:"container_id"`
+
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	State  string `json:"state"`  // running / exited / paused / ...
+	Status string `json:"status"` // human readable, e.g. "Up 3 hours"
+	IP     string `json:"ip"`
+
+	CPUUsage float64 `json:"cpu_usage"` // percent of total host CPU
+	MemUsage uint64  `json:"mem_usage"` // bytes
+	MemLimit uint64  `json:"mem_limit"` // bytes
+
+	LastSeen time.Time `json:"last_seen"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// MetricsSchemaVersion is the version of the agent metrics report. Agents
+// send theirs as schema_version and the server answers with its own; bump it,
+// and the agent's metricsSchemaVersion, when the report gains fields.
+const MetricsSchemaVersion = 4
+
+// CustomMetrics holds the fields of one metrics report the server has no
+// column for: fields from agents newer than the server, or values of the
+// wrong type. Data is a JSON object keyed by field name, kept verbatim so
+// nothing a newer agent sends is lost. The server's printer and camera
+// probes store their results here too. Pruned rows are hard-deleted like
+// SensorReading.
+type CustomMetrics struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	// SchemaVersion is the agent's; 1 for agents that predate versioning,
+	// 0 for the server's printer / camera probes.
+	SchemaVersion int    `json:"schema_version"`
+	Data          string `gorm:"type:text" json:"-"`
+
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
@@ -27,8 +27,15 @@ type Device struct {
 	Hostname string `gorm:"index;not null" json:"hostname"`
 	// Remark is an optional human-friendly display name / note set from Web UI.
 	Remark   string `gorm:"index" json:"remark"`
-	IP       string `gorm:"uniqueIndex;not null" json:"ip"`
+	// IP is the primary address. Agents with a MachineID are found by that,
+	// so IP is just an attribute that follows DHCP / VPN changes; it is
+	// normally unique but may briefly repeat while hosts swap addresses.
+	IP       string `gorm:"index;size:64;not null" json:"ip"`
 	OS       string `json:"os"`
+	// MachineID is the host's stable identity reported by the agent
+	// (/etc/machine-id or the like); empty for agentless devices and
+	// agents that predate it.
+	MachineID string `gorm:"index;size:64" json:"machine_id,omitempty"`
 	// MAC is the layer-2 address if known. It is primarily populated for devices
 	// that were first discovered via ARP scan and later adopted into management.
 	MAC string `json:"mac"`
@@ -38,6 +45,12 @@ type Device struct {
 	ParentID *uint       `gorm:"index" json:"parent_id,omitempty"`
 	Parent   *Device     `gorm:"foreignKey:ParentID" json:"-"`
 	Children []*Device   `gorm:"foreignKey:ParentID" json:"children,omitempty"`
+	// TopologyLocked pins ParentID to the operator's choice: gateway
+	// auto-wiring, traceroute and agent-reported parents leave it alone.
+	TopologyLocked bool `gorm:"default:false" json:"topology_locked"`
+	// Tags are the names of the device's tags (DeviceTag); filled in by the
+	// API where listed, not stored on the device row.
+	Tags []string `gorm:"-" json:"tags,omitempty"`
 
 	// LANIPs stores all private IPv4 addresses (RFC1918) observed on this node,
 	// serialized as a comma-separated string. Used for multi-segment topology
@@ -47,9 +60,21 @@ type Device struct {
 	// WANIPs stores public / non-RFC1918 IPv4 addresses, also comma-separated,
 	// used primarily for display (e.g. router's WAN IP).
 	WANIPs string `json:"wan_ips"`
+	// PublicIP is the WAN address seen from the internet, looked up by the
+	// agent of a root device (behind NAT it differs from every local IP).
+	PublicIP string `gorm:"index;size:64" json:"public_ip"`
 
 	// GatewayIP reported by agent; server uses this to auto-wire parent links.
 	GatewayIP string `gorm:"index" json:"gateway_ip"`
+	// IPv6Addrs holds the node's IPv6 addresses (link-local included),
+	// comma-separated like LANIPs; GatewayIPv6 is its v6 default gateway,
+	// often a router's link-local address. Either family can wire the parent.
+	IPv6Addrs   string `json:"ipv6_addrs"`
+	GatewayIPv6 string `gorm:"index;size:64" json:"gateway_ipv6"`
+	// BindCIDR lists (comma-separated) the addresses or subnets besides the
+	// node's own IPs that its agent may report from when data_ip_binding is
+	// on, e.g. the NAT gateway it reports through.
+	BindCIDR string `gorm:"column:bind_cidr" json:"bind_cidr,omitempty"`
 
 	// Classification
 	NetworkMode NetworkMode `gorm:"default:'Bridged'" json:"network_mode"`
@@ -59,6 +84,40 @@ type Device struct {
 	LastSeen time.Time `json:"last_seen"`
 	AgentVer string    `json:"agent_ver"`
 	IsOnline bool      `gorm:"default:false" json:"is_online"`
+	// BootTime is the host boot time last reported by the agent; a forward
+	// jump means the host rebooted.
+	BootTime time.Time `json:"boot_time"`
+	// ClockOffsetMs is how far the host clock runs ahead of the agent's NTP
+	// server (negative: behind); nil until the agent measured it.
+	ClockOffsetMs *float64 `json:"clock_offset_ms,omitempty"`
+	// ShutdownAt is set when the agent announced a planned shutdown or
+	// reboot (ShutdownKind) and cleared by its next report, so the silence
+	// in between is not treated as an outage.
+	ShutdownAt   *time.Time `json:"shutdown_at,omitempty"`
+	ShutdownKind string     `gorm:"size:16" json:"shutdown_kind,omitempty"`
+
+	// ReportInterval is the agent's report interval in seconds (0: not
+	// reported, agent_interval_seconds is assumed). The device counts as
+	// offline after offline_after_intervals of them without a report.
+	ReportInterval int `json:"report_interval,omitempty"`
+
+	// Benchmark is the latest run of the benchmark playbook; nil until the
+	// first (POST /api/devices/:id/benchmark or benchmark_new_devices).
+	Benchmark *Benchmark `gorm:"serializer:json" json:"benchmark,omitempty"`
+
+	// Metadata holds free-form user fields (asset tag, purchase date, rack
+	// position, warranty, …), edited with PATCH /api/devices/:id/metadata.
+	Metadata map[string]any `gorm:"serializer:json" json:"metadata,omitempty"`
+
+	// FlapCount counts the device's offline transitions that came less than
+	// flap_window_minutes apart (LastFlapAt is the latest). Once it reaches
+	// flap_threshold the device is Flapping until it keeps its state for a
+	// whole window, and its individual online / offline changes are no
+	// longer recorded.
+	FlapCount     int        `gorm:"default:0" json:"flap_count"`
+	LastFlapAt    *time.Time `json:"last_flap_at,omitempty"`
+	Flapping      bool       `gorm:"index;default:false" json:"flapping"`
+	FlappingSince *time.Time `json:"flapping_since,omitempty"`
 
 	// TopologyDirty 标记该设备是否需要批量重算父子关系。
 	// true  表示需要根据 GatewayIP 重新挂父节点
@@ -69,12 +128,30 @@ type Device struct {
 // DeviceTree is the DTO used by the API to return the full topology.
 type DeviceTree struct {
 	ID          uint          `json:"id"`
+	// Key identifies the node within the whole tree, whereas ID is only
+	// unique among nodes of one Kind: "d:<id>" for a managed device,
+	// "container:<id>", "pod:<id>", "ns:<host id>/<namespace>",
+	// "site:<name>" and, below a site, "site:<name>/" and the key on the
+	// edge server.
+	Key         string        `json:"key,omitempty"`
+	// Kind distinguishes non-device nodes attached under a host:
+	// "" for managed devices, "container" for Docker containers (ID is then
+	// a Container.ID, not a Device.ID), "namespace" for a Kubernetes
+	// namespace (ID 0) and "pod" for its pods (ID is a Pod.ID). "site" is
+	// the root of a federated site (ID is a Site.ID).
+	Kind        string        `json:"kind,omitempty"`
+	// Site names the federated site a node was pushed from; IDs and parent
+	// IDs of such nodes are those on the edge server.
+	Site        string        `json:"site,omitempty"`
 	Hostname    string        `json:"hostname"`
 	Remark      string        `json:"remark"`
 	IP          string        `json:"ip"`
 	OS          string        `json:"os"`
 	MAC         string        `json:"mac"`
 	GatewayIP   string        `json:"gateway_ip"`
+	GatewayIPv6 string        `json:"gateway_ipv6,omitempty"`
+	IPv6Addrs   []string      `json:"ipv6_addrs,omitempty"`
+	PublicIP    string        `json:"public_ip,omitempty"`
 	NetworkMode NetworkMode   `json:"network_mode"`
 	Group       string        `json:"group"`
 	IsOnline    bool          `json:"is_online"`
@@ -82,11 +159,41 @@ type DeviceTree struct {
 	//   - "online"  : 有 metrics 且最近一次上报在心跳窗口内
 	//   - "offline" : 有 metrics 但超过心跳窗口未上报
 	//   - "unknown" : 尚无任何 metrics 记录（只注册过设备）
+	//   - "shutdown": 离线前 Agent 报告了计划内的关机 / 重启（见 ShutdownKind）
+	//   - "flapping": 频繁在线 / 离线来回切换（见 Device.Flapping）
 	Status   string        `json:"status"`
 	LastSeen time.Time     `json:"last_seen"`
+	BootTime time.Time     `json:"boot_time"`
+	// ClockOffsetMs is the host clock's offset to its NTP server (see Device).
+	ClockOffsetMs *float64 `json:"clock_offset_ms,omitempty"`
+	// ShutdownAt / ShutdownKind describe the planned shutdown of a device
+	// with status "shutdown".
+	ShutdownAt   *time.Time `json:"shutdown_at,omitempty"`
+	ShutdownKind string     `json:"shutdown_kind,omitempty"`
+	// FlapCount is the device's recent offline transitions (see Device).
+	FlapCount int `json:"flap_count,omitempty"`
 	// AgentVer 标记该节点是否已经安装 Agent（非空）以及 Agent 版本。
 	// 当值为 "discovered" 时，表示该节点是通过 ARP 扫描纳管的、尚未安装 Agent。
 	AgentVer string        `json:"agent_ver"`
 	ParentID *uint         `json:"parent_id,omitempty"`
+	// TopologyLocked: the parent was pinned by an operator (see Device).
+	TopologyLocked bool `json:"topology_locked,omitempty"`
+	// Tags are the names of the device's tags.
+	Tags []string `json:"tags,omitempty"`
+	// Latency is the latest RTT / loss to the gateway, server and external
+	// target reported by an online agent, for drawing link health.
+	Latency  []LatencySample `json:"latency,omitempty"`
+	// ReportTiming is how long the agent's latest report took, to compare
+	// the paths of branches to the server.
+	ReportTiming *ReportTiming `json:"report_timing,omitempty"`
+	// Interfaces lists the device's NICs, the primary one (holding IP) first.
+	Interfaces []Interface `json:"interfaces,omitempty"`
+	// Silences are the active silences muting the device's alerts (by
+	// device or group).
+	Silences []Silence `json:"silences,omitempty"`
+	// Metrics and OpenAlerts are only filled in on request
+	// (GET /api/devices/tree?include=metrics,alerts).
+	Metrics    *Metrics `json:"metrics,omitempty"`
+	OpenAlerts *int     `json:"open_alerts,omitempty"`
 	Children []*DeviceTree `json:"children,omitempty"`
 }
@@ -19,7 +19,7 @@ type DiscoveredDevice struct {
 	UpdatedAt time.Time      `json:"-"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 
-	IP        string    `gorm:"uniqueIndex;not null" json:"ip"`
+	IP        string    `gorm:"uniqueIndex;size:64;not null" json:"ip"`
 	MAC       string    `json:"mac"`
 	Hostname  string    `json:"hostname"`
 	Vendor    string    `json:"vendor"`     // OUI manufacturer name
@@ -27,4 +27,8 @@ type DiscoveredDevice struct {
 	ScannerIP string    `json:"scanner_ip"` // which device/server discovered this host
 	FirstSeen time.Time `json:"first_seen"`
 	LastSeen  time.Time `json:"last_seen"`
+
+	// Source is "scan" for ARP scans and "arp" for hosts only seen in the
+	// ARP / neighbor cache of a gateway-class agent (ScannerIP).
+	Source string `gorm:"size:16;default:'scan'" json:"source"`
 }
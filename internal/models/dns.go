@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// DNSSample is one DNS check reported by an agent: resolving Name through
+// the host's resolver ("system") or a specific server in a single cycle.
+// Pruned rows are hard-deleted like LatencySample.
+type DNSSample struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	Name   string   `gorm:"index;size:255" json:"name"`
+	Server string   `gorm:"size:64" json:"server"` // "system" or ip[:port]
+	OK     bool     `json:"ok"`
+	RTTMs  float64  `json:"rtt_ms"`
+	Addrs  []string `gorm:"serializer:json" json:"addrs"`
+	Error  string   `json:"error,omitempty"` // nxdomain / timeout / resolver error
+
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
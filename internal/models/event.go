@@ -0,0 +1,81 @@
+package models
+
+import "time"
+
+// Event types recorded in the device timeline.
+const (
+	EventDeviceRebooted  = "device_rebooted"
+	EventPublicIPChanged = "public_ip_changed"
+	EventClockDrift      = "clock_drift"
+	EventClockDriftOK    = "clock_drift_resolved"
+	EventCheckFailed     = "check_failed"
+	EventCheckRecovered  = "check_recovered"
+	// EventServerPartition: agents lost the server while their peers still
+	// answered each other (see agent_peer_probes).
+	EventServerPartition   = "server_partition"
+	EventServerPartitionOK = "server_partition_resolved"
+	// EventDeviceShutdown: the agent announced a planned shutdown or reboot.
+	EventDeviceShutdown = "device_shutdown"
+	// EventTasksStopped: an operator hit the emergency stop for remote
+	// executions; EventTasksResumed lifts it.
+	EventTasksStopped = "tasks_stopped"
+	EventTasksResumed = "tasks_resumed"
+	// EventDeviceOffline: an agent missed offline_after_intervals reports;
+	// EventDeviceOnline: it reported again.
+	EventDeviceOffline = "device_offline"
+	EventDeviceOnline  = "device_online"
+	// EventDeviceFlapping: the device went offline flap_threshold times in
+	// quick succession; EventDeviceFlappingOK: it has kept its state since.
+	EventDeviceFlapping   = "device_flapping"
+	EventDeviceFlappingOK = "device_flapping_resolved"
+	// EventDeviceRegistered: a device was added (agent or adopted scan
+	// result); EventParentChanged / EventIPChanged: it moved in the tree or
+	// got a new address. EventDeviceDeleted / EventDeviceRestored: it was
+	// moved to the trash or came back (restored, or its agent registered
+	// again). EventDeviceMerged: a duplicate of it was merged into it.
+	EventDeviceRegistered = "device_registered"
+	EventParentChanged    = "parent_changed"
+	EventIPChanged        = "ip_changed"
+	EventDeviceDeleted    = "device_deleted"
+	EventDeviceRestored   = "device_restored"
+	EventDeviceMerged     = "device_merged"
+	// EventAlertFiring / EventAlertResolved: an alert rule fired on the
+	// device or its condition cleared. EventAlertAcked: someone
+	// acknowledged a firing alert. EventAlertEscalated: it stayed
+	// unacknowledged and went to the rule's next escalation channel.
+	EventAlertFiring    = "alert_firing"
+	EventAlertResolved  = "alert_resolved"
+	EventAlertAcked     = "alert_acked"
+	EventAlertEscalated = "alert_escalated"
+	// EventPowerWake / EventPowerSleep: a power schedule (or an operator)
+	// sent the device a Wake-on-LAN packet or ran its shutdown playbook.
+	EventPowerWake  = "power_wake"
+	EventPowerSleep = "power_sleep"
+	// EventBenchmark: the benchmark playbook ran on the device; Data holds
+	// the result.
+	EventBenchmark = "benchmark"
+	// EventPlaybookRun: an operator ran a playbook or shell command on the
+	// device by hand (POST /api/devices/:id/exec); Data says who and which.
+	EventPlaybookRun = "playbook_run"
+	// EventAPITokenCreated / EventAPITokenRevoked: a user created or
+	// revoked a personal API token.
+	EventAPITokenCreated = "api_token_created"
+	EventAPITokenRevoked = "api_token_revoked"
+	// EventComplianceFailed / EventComplianceOK: a device started to
+	// violate a compliance rule, or complies with it again.
+	EventComplianceFailed = "compliance_failed"
+	EventComplianceOK     = "compliance_ok"
+)
+
+// Event is one entry of the device state-change timeline ("what happened
+// overnight"). DeviceID is nil for fleet-wide events. Data holds
+// type-specific details as a JSON object.
+type Event struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	DeviceID *uint  `gorm:"index" json:"device_id,omitempty"`
+	Type     string `gorm:"index;not null" json:"type"`
+	Message  string `json:"message"`
+	Data     string `json:"data,omitempty"`
+}
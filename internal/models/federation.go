@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Site is a remote OpenTalon server (an "edge") that forwards its device tree
+// and hourly rollups to this server through the federation endpoint, so its
+// LAN shows up as a subtree without exposing its agents over the WAN. The
+// tree is replaced on every push; rows are hard-deleted.
+type Site struct {
+	ID         uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	Name       string    `gorm:"uniqueIndex;size:128;not null" json:"name"`
+	RemoteAddr string    `json:"remote_addr"` // address the last push came from
+	CreatedAt  time.Time `json:"created_at"`
+	LastSync   time.Time `json:"last_sync"`
+	// Devices is the number of managed devices in the last pushed tree.
+	Devices int `json:"devices"`
+
+	Tree []*DeviceTree `gorm:"serializer:json" json:"-"`
+}
+
+// SiteRollup is an hourly metrics rollup of a device at a federated site.
+// DeviceID is the device's ID on the edge server, as in the site's tree.
+type SiteRollup struct {
+	ID          uint      `gorm:"primarykey;autoIncrement" json:"-"`
+	SiteID      uint      `gorm:"uniqueIndex:idx_site_rollup_bucket;not null" json:"site_id"`
+	DeviceID    uint      `gorm:"uniqueIndex:idx_site_rollup_bucket;not null" json:"device_id"`
+	BucketStart time.Time `gorm:"uniqueIndex:idx_site_rollup_bucket;not null" json:"bucket_start"`
+	RollupStats
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// DeviceGroup describes a device group. Devices still name their group by
+// string (Device.Group); the record adds a description, a color, a parent
+// group for nesting (e.g. "lab/pve" under "lab") and an ordering. Groups
+// that devices use are created automatically.
+type DeviceGroup struct {
+	ID          uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `gorm:"uniqueIndex;size:64;not null" json:"name"`
+	Description string    `json:"description,omitempty"`
+	Color       string    `gorm:"size:16" json:"color,omitempty"` // e.g. "#1e88e5"
+	ParentID    *uint     `gorm:"index" json:"parent_id"`
+	Position    int       `gorm:"default:0" json:"position"` // sort order among siblings
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Interface is a network interface of a device as last reported by its
+// agent: the NICs of a PVE host (vmbr0, vmbr1) or a router's WAN / LAN
+// ports. Primary marks the one holding Device.IP. Rows are replaced as the
+// agent reports and hard-deleted with the device.
+type Interface struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	DeviceID uint   `gorm:"uniqueIndex:idx_iface_name;not null" json:"device_id"`
+	Name     string `gorm:"uniqueIndex:idx_iface_name;size:64;not null" json:"name"`
+	MAC      string `gorm:"index;size:32" json:"mac"`
+	// IPs are the addresses in CIDR notation, IPv4 first.
+	IPs       []string `gorm:"serializer:json" json:"ips"`
+	MTU       int      `json:"mtu"`
+	SpeedMbps int      `json:"speed_mbps"`
+	State     string   `gorm:"size:16" json:"state"`
+	Primary   bool     `gorm:"column:is_primary" json:"primary"`
+}
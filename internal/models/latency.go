@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// LatencySample is one latency probe reported by an agent: RTT and packet
+// loss from the device to its default gateway, the OpenTalon server or an
+// external target in a single cycle. Pruned rows are hard-deleted like
+// SensorReading.
+type LatencySample struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	Target   string  `gorm:"index" json:"target"` // gateway / server / external
+	Addr     string  `json:"addr"`
+	Method   string  `json:"method"` // icmp / tcp
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	LossPct  float64 `json:"loss_pct"`
+	RTTAvg   float64 `json:"rtt_avg"` // ms
+	RTTMin   float64 `json:"rtt_min"` // ms
+	RTTMax   float64 `json:"rtt_max"` // ms
+
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
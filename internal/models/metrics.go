@@ -28,6 +28,10 @@ type Metrics struct {
 	TCPConnections int `json:"tcp_connections"`
 	UDPConnections int `json:"udp_connections"`
 
+	// ── Uptime ───────────────────────────────────────────────────────────────
+	Uptime   uint64 `json:"uptime"`    // seconds since boot
+	BootTime int64  `json:"boot_time"` // unix seconds
+
 	// ── Topology context (reported by agent) ─────────────────────────────────
 	GatewayIP string    `json:"gateway_ip"` // default gateway at time of report
 	LocalIP   string    `json:"local_ip"`   // primary local IP
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Neighbor is an LLDP / CDP neighbor reported by a device's agent: the
+// device at the other end of the cable plugged into LocalPort, usually a
+// switch port. PeerDeviceID is the managed device it was matched to (by
+// management IP, chassis MAC or system name), nil when unknown. Rows are
+// replaced as the agent reports and hard-deleted with the device.
+type Neighbor struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	DeviceID  uint   `gorm:"index;not null" json:"device_id"`
+	LocalPort string `gorm:"size:64" json:"local_port"`
+	// Protocol is "lldp" or "cdp".
+	Protocol  string   `gorm:"size:8" json:"protocol"`
+	ChassisID string   `gorm:"size:128;index" json:"chassis_id"`
+	PortID    string   `gorm:"size:128" json:"port_id"`
+	PortDescr string   `json:"port_descr,omitempty"`
+	SysName   string   `gorm:"size:128" json:"sys_name,omitempty"`
+	SysDescr  string   `json:"sys_descr,omitempty"`
+	MgmtIPs   []string `gorm:"serializer:json" json:"mgmt_ips"`
+
+	PeerDeviceID *uint `gorm:"index" json:"peer_device_id,omitempty"`
+}
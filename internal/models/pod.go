@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Pod is a Kubernetes pod reported by the agent on the node (device) it is
+// scheduled on. Like Container, pods are not managed devices; the device tree
+// shows them grouped under a namespace node below their node.
+type Pod struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	DeviceID uint   `gorm:"uniqueIndex:idx_pod_node;not null" json:"device_id"`
+	UID      string `gorm:"uniqueIndex:idx_pod_node;size:64;not null" json:"uid"`
+
+	Namespace string `gorm:"index" json:"namespace"`
+	Name      string `json:"name"`
+	Phase     string `json:"phase"`
+	IP        string `json:"ip"`
+	Restarts  int    `json:"restarts"`
+
+	CPUMilli float64 `json:"cpu_milli"` // millicores
+	MemUsage uint64  `json:"mem_usage"` // working set bytes
+
+	LastSeen time.Time `json:"last_seen"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Built-in roles. RoleAdmin (the admin_user account) may do everything and
+// needs no policy; other roles only get what their policies grant.
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+// Policy grants a role the control-plane requests matching Methods and
+// Path, optionally only for devices in Groups.
+type Policy struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Role string `gorm:"index;not null" json:"role"`
+	// Methods is comma-separated, e.g. "GET" or "GET,POST"; "*" allows any.
+	Methods string `gorm:"not null" json:"methods"`
+	// Path is matched against the request path; a trailing * matches any
+	// suffix, e.g. "/api/devices/*".
+	Path string `gorm:"not null" json:"path"`
+	// Groups (comma-separated) restricts the grant to devices of these
+	// groups; empty means every device.
+	Groups      string `json:"groups"`
+	Description string `json:"description"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// ListeningPort is one entry of a device's service inventory: a TCP port in
+// LISTEN state or a bound UDP port, together with the owning process.
+// CreatedAt records when the port was first seen open.
+type ListeningPort struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"first_seen"`
+
+	DeviceID uint   `gorm:"uniqueIndex:idx_port_socket;not null" json:"device_id"`
+	Proto    string `gorm:"uniqueIndex:idx_port_socket;size:8;not null" json:"proto"`
+	Addr     string `gorm:"uniqueIndex:idx_port_socket;size:64" json:"addr"`
+	Port     uint32 `gorm:"uniqueIndex:idx_port_socket;index;not null" json:"port"`
+
+	PID     int32  `json:"pid"`
+	Process string `gorm:"index" json:"process"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// PowerSchedule wakes devices with Wake-on-LAN in the morning and shuts
+// them down with the shutdown playbook at night, for lab hosts that need
+// not run around the clock. Times are "HH:MM" in the server's time zone;
+// either may be empty to only wake or only sleep.
+type PowerSchedule struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Name string `gorm:"uniqueIndex;size:128;not null" json:"name"`
+	// DeviceIDs (comma-separated) and Group select the devices, like an
+	// alert rule's scope; one of them is set.
+	DeviceIDs string `json:"device_ids"`
+	Group     string `json:"group"`
+
+	WakeAt  string `json:"wake_at"`
+	SleepAt string `json:"sleep_at"`
+	// Days lists the weekdays it runs on ("mon,tue,…"); empty means daily.
+	Days string `json:"days"`
+	// Holidays lists dates ("2026-10-01") and ranges
+	// ("2026-12-24..2026-12-26") on which it does nothing.
+	Holidays string `json:"holidays"`
+	// OverrideUntil pauses the schedule, e.g. to keep a host up for a
+	// late job.
+	OverrideUntil *time.Time `json:"override_until,omitempty"`
+	Enabled       bool       `gorm:"default:true" json:"enabled"`
+
+	// LastWake / LastSleep are when the actions last ran.
+	LastWake  *time.Time `json:"last_wake,omitempty"`
+	LastSleep *time.Time `json:"last_sleep,omitempty"`
+}
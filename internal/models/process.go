@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// ProcessSample is one of the top processes (by CPU or memory) reported by an
+// agent in a single cycle. A short rolling window is kept per device so the
+// culprit behind a CPU spike can still be looked up after the fact. Pruned
+// rows are hard-deleted like SensorReading.
+type ProcessSample struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	PID        int32   `json:"pid"`
+	Name       string  `json:"name"`
+	User       string  `json:"user"`
+	CPUPercent float64 `json:"cpu_percent"` // percent of the whole host
+	RSS        uint64  `json:"rss"`         // bytes
+
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// RemediationHook binds an alert rule to an automatic playbook execution on
+// the affected device, e.g. "cpu pegged" → restart a known runaway service.
+//
+// RuleName matches the name of the alert rule that fires; DeviceID optionally
+// restricts the hook to a single device (nil = any device the rule fires on).
+type RemediationHook struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	RuleName string `gorm:"index;not null" json:"rule_name"`
+	DeviceID *uint  `gorm:"index" json:"device_id,omitempty"`
+	// Playbook is the name of a registered playbook (see server.Playbooks).
+	Playbook string `gorm:"not null" json:"playbook"`
+	// Args is a JSON object of string arguments passed to the playbook,
+	// e.g. {"service":"sing-box"}.
+	Args string `json:"args"`
+
+	// CooldownSec is the minimum gap between two runs on the same device.
+	CooldownSec int `gorm:"default:600" json:"cooldown_sec"`
+	// MaxPerHour caps runs per device within a sliding hour (0 = unlimited).
+	MaxPerHour int  `gorm:"default:3" json:"max_per_hour"`
+	Enabled    bool `gorm:"default:true" json:"enabled"`
+}
+
+// Remediation run states.
+const (
+	RemediationSucceeded = "succeeded"
+	RemediationFailed    = "failed"
+	RemediationSkipped   = "skipped"   // suppressed by cooldown / rate limit
+	RemediationEscalated = "escalated" // failed and handed to a human
+)
+
+// RemediationRun records one (attempted) remediation execution.
+type RemediationRun struct {
+	ID       uint   `gorm:"primarykey;autoIncrement" json:"id"`
+	HookID   uint   `gorm:"index;not null" json:"hook_id"`
+	DeviceID uint   `gorm:"index;not null" json:"device_id"`
+	RuleName string `json:"rule_name"`
+	Playbook string `json:"playbook"`
+
+	Status string `gorm:"index" json:"status"`
+	Output string `json:"output"`
+	Reason string `json:"reason,omitempty"` // why it was skipped / escalated
+
+	StartedAt  time.Time `gorm:"index" json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
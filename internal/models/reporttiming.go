@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// ReportTiming is how long one metrics report from an agent to the server
+// took, measured by the agent and sent with its next report: DNS lookup,
+// TCP connect, TLS handshake and the whole request. The phases are nil
+// when the request reused a keep-alive connection (or needed no lookup).
+// Pruned rows are hard-deleted like LatencySample.
+type ReportTiming struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	DNSMs     *float64 `json:"dns_ms,omitempty"`
+	ConnectMs *float64 `json:"connect_ms,omitempty"`
+	TLSMs     *float64 `json:"tls_ms,omitempty"`
+	TotalMs   float64  `json:"total_ms"`
+	Reused    bool     `json:"reused"`
+
+	// ReportedAt is when the timing arrived, one report interval after
+	// the request it describes.
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Rollup resolutions.
+const (
+	RollupHour = "hour"
+	RollupDay  = "day"
+)
+
+// MetricsRollup aggregates the raw metrics samples of one device over one
+// hour or one day (UTC buckets), so long-range charts do not need raw rows.
+// Hourly rows are kept up to date from new samples; daily rows are merged
+// from the hourly ones.
+// Rows are keyed by (device, resolution, bucket start) and hard-deleted.
+type MetricsRollup struct {
+	ID          uint      `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID    uint      `gorm:"uniqueIndex:idx_rollup_bucket;not null" json:"device_id"`
+	Resolution  string    `gorm:"uniqueIndex:idx_rollup_bucket;size:8;not null" json:"resolution"`
+	BucketStart time.Time `gorm:"uniqueIndex:idx_rollup_bucket;not null" json:"bucket_start"`
+	// Through is the newest raw sample the background aggregator folded
+	// into an hourly row; zero for imported rows.
+	Through time.Time `gorm:"index" json:"-"`
+	RollupStats
+}
+
+// RollupStats are the aggregates of one rollup bucket: the sample count and
+// avg / min / max of every metric.
+type RollupStats struct {
+	Samples int `json:"samples"`
+
+	CPUAvg  float64 `json:"cpu_avg"`
+	CPUMin  float64 `json:"cpu_min"`
+	CPUMax  float64 `json:"cpu_max"`
+	MemAvg  float64 `json:"mem_avg"`
+	MemMin  float64 `json:"mem_min"`
+	MemMax  float64 `json:"mem_max"`
+	DiskAvg float64 `json:"disk_avg"`
+	DiskMin float64 `json:"disk_min"`
+	DiskMax float64 `json:"disk_max"`
+	RxAvg   float64 `json:"rx_avg"`
+	RxMin   float64 `json:"rx_min"`
+	RxMax   float64 `json:"rx_max"`
+	TxAvg   float64 `json:"tx_avg"`
+	TxMin   float64 `json:"tx_min"`
+	TxMax   float64 `json:"tx_max"`
+	TCPAvg  float64 `json:"tcp_avg"`
+	TCPMin  float64 `json:"tcp_min"`
+	TCPMax  float64 `json:"tcp_max"`
+	UDPAvg  float64 `json:"udp_avg"`
+	UDPMin  float64 `json:"udp_min"`
+	UDPMax  float64 `json:"udp_max"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// SensorReading stores one hardware temperature sample reported by an agent
+// (CPU package, NVMe, chassis, ...). One row is written per sensor per report;
+// the server keeps only a short rolling window per device.
+//
+// Rows are hard-deleted when pruned, so no gorm.Model / DeletedAt is embedded.
+type SensorReading struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	SensorKey   string  `gorm:"index" json:"sensor_key"`
+	Temperature float64 `json:"temperature"`        // °C
+	High        float64 `json:"high,omitempty"`     // vendor "high" threshold, 0 if unknown
+	Critical    float64 `json:"critical,omitempty"` // vendor "critical" threshold, 0 if unknown
+
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
+
+// GPUReading stores one NVIDIA GPU sample reported by an agent with the GPU
+// collector enabled (PVE hosts, workstations). Pruned like SensorReading.
+type GPUReading struct {
+	ID       uint `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint `gorm:"index;not null" json:"-"`
+
+	Index       int     `json:"index"`
+	Name        string  `json:"name"`
+	Utilization float64 `json:"utilization"` // percent 0-100
+	MemUsed     uint64  `json:"mem_used"`    // bytes
+	MemTotal    uint64  `json:"mem_total"`   // bytes
+	Temperature float64 `json:"temperature"` // °C
+
+	ReportedAt time.Time `gorm:"index" json:"reported_at"`
+}
@@ -0,0 +1,8 @@
+package models
+
+// Setting is a server-wide key/value pair that must survive restarts but is
+// not worth its own table, such as the server fingerprint.
+type Setting struct {
+	Key   string `gorm:"primarykey;size:64" json:"key"`
+	Value string `json:"value"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Silence mutes the alerts of a device, a group or a rule between StartsAt
+// and EndsAt, e.g. during a planned upgrade. The set fields must all match;
+// at least one is set. Silenced alerts are still recorded but neither
+// notify nor trigger remediation.
+type Silence struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+
+	DeviceID *uint  `gorm:"index" json:"device_id,omitempty"`
+	Group    string `json:"group,omitempty"`
+	RuleID   *uint  `json:"rule_id,omitempty"`
+
+	StartsAt time.Time `gorm:"index" json:"starts_at"`
+	EndsAt   time.Time `gorm:"index" json:"ends_at"`
+	Comment  string    `json:"comment"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Speed test targets.
+const (
+	SpeedTestServer = "server" // the OpenTalon server's data plane
+	SpeedTestPublic = "public" // speedtest_public_download_url / _upload_url
+)
+
+// SpeedTest is one throughput measurement run by a device's agent on
+// request. Only the most recent runs per device are kept; pruned rows are
+// hard-deleted.
+type SpeedTest struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	DeviceID  uint      `gorm:"index;not null" json:"device_id"`
+
+	Target       string  `json:"target"` // server / public
+	URL          string  `json:"url"`    // download URL used
+	LatencyMs    float64 `json:"latency_ms"`
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	BytesDown    int64   `json:"bytes_down"`
+	BytesUp      int64   `json:"bytes_up"`
+	Streams      int     `json:"streams"`
+	DurationSec  int     `json:"duration_sec"` // per direction
+	Error        string  `json:"error"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Subscription is a user's wish to receive the alerts of a device, a group
+// or a minimum severity on one notification channel. The set filters must
+// all match; none set subscribes to every alert the user may see. A channel
+// that has subscriptions no longer receives the alerts of rules that name
+// no channel, only those a subscription matches.
+type Subscription struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Username string `gorm:"index;not null" json:"username"`
+	Channel  string `gorm:"index;not null" json:"channel"`
+
+	DeviceID *uint  `gorm:"index" json:"device_id,omitempty"`
+	Group    string `json:"group,omitempty"`
+	// MinSeverity is the least severe alert delivered: info, warning or
+	// critical; empty for all.
+	MinSeverity string `json:"min_severity,omitempty"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Tag is a free-form label on devices. Unlike the single Group a device
+// can carry any number of tags, e.g. "critical", "proxmox" and "has-gpu".
+type Tag struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `gorm:"uniqueIndex;size:64;not null" json:"name"`
+	Color     string    `gorm:"size:16" json:"color,omitempty"` // e.g. "#e53935"
+}
+
+// DeviceTag assigns a tag to a device.
+type DeviceTag struct {
+	DeviceID uint `gorm:"primaryKey;autoIncrement:false" json:"device_id"`
+	TagID    uint `gorm:"primaryKey;autoIncrement:false;index" json:"tag_id"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// TopologySnapshot is the device tree at TakenAt, for playing back how the
+// network looked at a past time. Nodes is the flat list of managed devices
+// (parent links, addresses, status; no children, metrics or containers).
+// A snapshot is only taken when that list changed; rows are hard-deleted
+// after topology_history_days.
+type TopologySnapshot struct {
+	ID      uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	TakenAt time.Time `gorm:"index" json:"taken_at"`
+	// Hash identifies Nodes, to skip snapshots without changes.
+	Hash  string        `gorm:"size:64" json:"-"`
+	Nodes []*DeviceTree `gorm:"serializer:json" json:"-"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// Traceroute verdicts: how the traced path relates to the device's parent.
+const (
+	TraceVerdictConfirmed = "confirmed" // first managed hop is the current parent
+	TraceVerdictRefined   = "refined"   // device had no parent and was wired to the first managed hop
+	TraceVerdictMismatch  = "mismatch"  // first managed hop differs from the current parent
+	TraceVerdictUnknown   = "unknown"   // no managed device on the path
+)
+
+// TraceHop is one TTL step of a traceroute. DeviceID is set when the hop's
+// address belongs to a managed device.
+type TraceHop struct {
+	TTL      int     `json:"ttl"`
+	IP       string  `json:"ip"` // "" when the hop did not answer
+	RTTMs    float64 `json:"rtt_ms"`
+	DeviceID *uint   `json:"device_id,omitempty"`
+}
+
+// Traceroute is a traceroute from a device's agent to the server, used to
+// validate or refine the gateway-based parent wiring. Only the most recent
+// runs per device are kept; pruned rows are hard-deleted.
+type Traceroute struct {
+	ID        uint      `gorm:"primarykey;autoIncrement" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	DeviceID  uint      `gorm:"index;not null" json:"device_id"`
+
+	Target  string     `json:"target"`
+	Hops    []TraceHop `gorm:"serializer:json" json:"hops"`
+	Reached bool       `json:"reached"`
+	Error   string     `json:"error"`
+
+	// ParentID is the device's parent when the trace arrived; SuggestedParentID
+	// the nearest managed device on the path.
+	ParentID          *uint  `json:"parent_id"`
+	SuggestedParentID *uint  `json:"suggested_parent_id"`
+	Verdict           string `json:"verdict"`
+}
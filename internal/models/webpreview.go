@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// WebPreview is what the server found at a device's web UI: the page
+// title and favicon, refreshed periodically to make devices easy to
+// recognize in the topology view. URL is empty when no web UI answered.
+type WebPreview struct {
+	ID       uint   `gorm:"primarykey;autoIncrement" json:"-"`
+	DeviceID uint   `gorm:"uniqueIndex;not null" json:"device_id"`
+	URL      string `json:"url"`
+	Title    string `json:"title"`
+	// Icon is the favicon (IconType its MIME type), at most a few KB.
+	Icon      []byte    `json:"-"`
+	IconType  string    `json:"-"`
+	Error     string    `json:"error,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
@@ -0,0 +1,205 @@
+// Package proxy decides how OpenTalon's outbound HTTP requests leave the
+// host. By default it follows HTTP_PROXY / HTTPS_PROXY / NO_PROXY like any
+// Go program; http_proxy / https_proxy / no_proxy in config override them,
+// and proxy_rules send single destinations (optionally of a single purpose)
+// through another proxy or directly. On networks whose egress goes through
+// a side-router proxy, that keeps e.g. the LAN and domestic APIs direct
+// while webhooks to Telegram go through the proxy.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Purposes of outbound requests; a rule prefixed with one applies only to it.
+const (
+	Report      = "report"      // agent → server, edge → central server
+	Webhook     = "webhook"     // alert and event notifications
+	Download    = "download"    // scripts fetched by playbooks on remote devices
+	Integration = "integration" // third-party APIs such as the public IP resolver
+)
+
+// Direct as a rule's proxy bypasses every proxy.
+const Direct = "direct"
+
+var purposes = map[string]bool{Report: true, Webhook: true, Download: true, Integration: true}
+
+type rule struct {
+	purpose string     // "" applies to every purpose
+	host    string     // lower-case host or glob; "" when cidr is set
+	cidr    *net.IPNet // IP or CIDR pattern
+	proxy   *url.URL   // nil: direct
+}
+
+func (r *rule) matches(host string, ip net.IP) bool {
+	if r.cidr != nil {
+		return ip != nil && r.cidr.Contains(ip)
+	}
+	ok, _ := path.Match(r.host, host)
+	return ok
+}
+
+var (
+	mu         sync.RWMutex
+	rules      []rule
+	fallback   = httpproxy.FromEnvironment().ProxyFunc()
+	transports = map[string]*http.Transport{}
+)
+
+// Configure installs the proxy settings from config. Empty httpProxy,
+// httpsProxy and noProxy keep the matching environment variable. Each rule
+// is "[purpose:]pattern proxy": pattern is a host, a host glob (*.corp.lan,
+// * for everything), an IP or a CIDR; proxy is an http, https or socks5 URL
+// or "direct". The first matching rule wins; without one the defaults apply.
+func Configure(httpProxy, httpsProxy, noProxy string, specs []string) error {
+	var parsed []rule
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		r, err := parseRule(spec)
+		if err != nil {
+			return fmt.Errorf("proxy rule %q: %w", spec, err)
+		}
+		parsed = append(parsed, r)
+	}
+	env := httpproxy.FromEnvironment()
+	if httpProxy != "" {
+		env.HTTPProxy = httpProxy
+	}
+	if httpsProxy != "" {
+		env.HTTPSProxy = httpsProxy
+	}
+	if noProxy != "" {
+		env.NoProxy = noProxy
+	}
+	for _, p := range []string{env.HTTPProxy, env.HTTPSProxy} {
+		if p == "" {
+			continue
+		}
+		if _, err := parseProxyURL(p); err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	rules, fallback = parsed, env.ProxyFunc()
+	return nil
+}
+
+func parseRule(spec string) (rule, error) {
+	var r rule
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return r, fmt.Errorf(`want "[purpose:]pattern proxy"`)
+	}
+	pattern := strings.ToLower(fields[0])
+	if p, rest, ok := strings.Cut(pattern, ":"); ok && purposes[p] {
+		r.purpose, pattern = p, rest
+	}
+	switch {
+	case strings.Contains(pattern, "/"):
+		_, cidr, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return r, err
+		}
+		r.cidr = cidr
+	case net.ParseIP(pattern) != nil:
+		ip := net.ParseIP(pattern)
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return r, err
+		}
+		r.host = pattern
+	}
+	if !strings.EqualFold(fields[1], Direct) {
+		u, err := parseProxyURL(fields[1])
+		if err != nil {
+			return r, err
+		}
+		r.proxy = u
+	}
+	return r, nil
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", s)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("proxy %q: scheme must be http, https or socks5", s)
+}
+
+// Lookup returns the proxy for a request of purpose to target, or nil when
+// it goes direct.
+func Lookup(purpose string, target *url.URL) (*url.URL, error) {
+	mu.RLock()
+	rs, fb := rules, fallback
+	mu.RUnlock()
+	host := strings.ToLower(target.Hostname())
+	ip := net.ParseIP(host)
+	for i := range rs {
+		if rs[i].purpose != "" && rs[i].purpose != purpose {
+			continue
+		}
+		if rs[i].matches(host, ip) {
+			return rs[i].proxy, nil
+		}
+	}
+	return fb(target)
+}
+
+// Func returns Lookup for purpose in the form of http.Transport.Proxy.
+func Func(purpose string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		return Lookup(purpose, req.URL)
+	}
+}
+
+// Transport returns the shared transport of purpose: http.DefaultTransport
+// with its proxy chosen by Lookup. Sharing it per purpose keeps connection
+// reuse across the short-lived clients built for each request.
+func Transport(purpose string) *http.Transport {
+	mu.Lock()
+	defer mu.Unlock()
+	t, ok := transports[purpose]
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = Func(purpose)
+		transports[purpose] = t
+	}
+	return t
+}
+
+// Env returns the shell assignment (https_proxy=… http_proxy=…) that makes
+// curl on another host fetch rawURL the way Lookup routes it, or "" when it
+// goes direct. Playbooks prefix their downloads with it.
+func Env(purpose, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	p, err := Lookup(purpose, u)
+	if err != nil || p == nil {
+		return ""
+	}
+	q := "'" + strings.ReplaceAll(p.String(), "'", `'\''`) + "'"
+	return "https_proxy=" + q + " http_proxy=" + q
+}
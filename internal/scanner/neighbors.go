@@ -0,0 +1,75 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Neighbor is one entry of the host's ARP (IPv4) or neighbor (IPv6) cache.
+type Neighbor struct {
+	IP     string `json:"ip"`
+	MAC    string `json:"mac"`
+	Vendor string `json:"vendor,omitempty"`
+}
+
+// NeighborTable returns the host's ARP cache and, on Linux, its IPv6
+// neighbor cache as they are, without probing anything. A gateway's caches
+// hold every host that talked through it recently, which makes them a
+// passive alternative to scanning.
+func NeighborTable() []Neighbor {
+	out := []Neighbor{}
+	for ip, mac := range readARPTable() {
+		out = append(out, Neighbor{IP: ip, MAC: mac, Vendor: lookupVendor(mac)})
+	}
+	if runtime.GOOS == "linux" {
+		out = append(out, readNeighborsV6()...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
+
+// readNeighborsV6 parses `ip -6 neigh show`, e.g.
+//
+//	2001:db8::5 dev eth0 lladdr aa:bb:cc:dd:ee:ff REACHABLE
+//
+// Link-local addresses are left out: they cannot identify a device outside
+// its link.
+func readNeighborsV6() []Neighbor {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ip", "-6", "neigh", "show").Output()
+	if err != nil {
+		return nil
+	}
+	var list []Neighbor
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		state := fields[len(fields)-1]
+		if state == "FAILED" || state == "INCOMPLETE" {
+			continue
+		}
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "lladdr" {
+				mac := strings.ToUpper(fields[i+1])
+				list = append(list, Neighbor{IP: ip.String(), MAC: mac, Vendor: lookupVendor(mac)})
+				break
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/config"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Levels of agent config issues: an error keeps the agent from working as
+// configured, a warning probably does not do what was meant.
+const (
+	issueError   = "error"
+	issueWarning = "warning"
+	issueInfo    = "info"
+)
+
+// configIssue is one finding of handleValidateAgentConfig.
+type configIssue struct {
+	Field   string `json:"field"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// agentConfigOSes are the OSes the agent is built for.
+var agentConfigOSes = map[string]bool{"linux": true, "windows": true, "darwin": true, "freebsd": true}
+
+// defaultAgentToken is the token both sides use until it is changed.
+const defaultAgentToken = "opentalon-secret-key-123"
+
+// validateAgentConfig checks the agent settings of cfg for an agent on os;
+// set names the keys the proposed config sets, the others are defaults.
+func validateAgentConfig(cfg *config.Config, goos string, set map[string]bool) []configIssue {
+	var issues []configIssue
+	add := func(field, level, format string, args ...any) {
+		issues = append(issues, configIssue{Field: field, Level: level, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Report interval: the server's offline detection and history depend on it.
+	switch iv := cfg.AgentInterval; {
+	case iv <= 0:
+		add("agent_interval_seconds", issueError, "must be at least 1")
+	case iv < 5:
+		add("agent_interval_seconds", issueWarning, "%ds reports cost CPU on the host and rows on the server; 5s or more is plenty for dashboards", iv)
+	default:
+		timeout := time.Duration(float64(iv)*offlineAfterIntervals) * time.Second
+		if timeout > 15*time.Minute {
+			add("agent_interval_seconds", issueWarning, "the device is only marked offline after %s silent (%g intervals)", timeout, offlineAfterIntervals)
+		}
+		if keep := time.Duration(iv*maxSnapshotsPerDevice) * time.Second; maxSnapshotsPerDevice > 0 && keep > 24*time.Hour {
+			add("agent_interval_seconds", issueInfo, "the %d raw samples kept per device span %s", maxSnapshotsPerDevice, keep)
+		}
+	}
+
+	// Joining and authenticating.
+	if !strings.EqualFold(cfg.AgentJoinAddr, "auto") {
+		host, port, err := net.SplitHostPort(cfg.AgentJoinAddr)
+		if err != nil || host == "" {
+			add("agent_join_addr", issueError, "want host:port or \"auto\", got %q", cfg.AgentJoinAddr)
+		} else if p, _ := strconv.Atoi(port); dataPort != 0 && p != dataPort {
+			add("agent_join_addr", issueWarning, "port %s is not this server's data port %d", port, dataPort)
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			add("agent_join_addr", issueWarning, "%s only reaches a server on the same host", host)
+		}
+	}
+	switch {
+	case subtle.ConstantTimeCompare([]byte(cfg.AgentOutboundToken), []byte(agentToken)) != 1:
+		if set["agent_outbound_token"] {
+			add("agent_outbound_token", issueError, "this server rejects the token")
+		} else {
+			add("agent_outbound_token", issueError, "the default token is not this server's agent_token; set it")
+		}
+	case agentToken == defaultAgentToken:
+		add("agent_outbound_token", issueWarning, "the server still uses the default agent_token, which anyone can read in the docs")
+	}
+	if cfg.AgentParentID != 0 {
+		if err := DB.Select("id").First(&models.Device{}, cfg.AgentParentID).Error; err != nil {
+			add("agent_parent_id", issueError, "device %d not found", cfg.AgentParentID)
+		}
+	}
+	if set["agent_group"] && cfg.AgentGroup != "" {
+		var n int64
+		DB.Model(&models.Device{}).Where(&models.Device{Group: cfg.AgentGroup}).Count(&n)
+		if n == 0 {
+			add("agent_group", issueInfo, "group %q has no devices yet; it is created with the first", cfg.AgentGroup)
+		}
+	}
+	if m := cfg.AgentNetworkMode; m != "Bridged" && m != "NAT" {
+		add("agent_network_mode", issueError, "want Bridged or NAT, got %q", m)
+	}
+
+	// Collectors that need something the target OS may not have.
+	if cfg.AgentGPUEnabled {
+		if goos == "darwin" || goos == "freebsd" {
+			add("agent_gpu_enabled", issueWarning, "nvidia-smi does not exist on %s; no GPUs will be reported", goos)
+		} else {
+			add("agent_gpu_enabled", issueInfo, "needs the NVIDIA driver's nvidia-smi on the PATH")
+		}
+	}
+	if set["agent_docker_socket"] && goos == "windows" {
+		add("agent_docker_socket", issueWarning, "Docker is read through a unix socket; containers are not reported on windows")
+	}
+	if set["agent_kubelet_url"] && goos != "linux" {
+		add("agent_kubelet_url", issueWarning, "Kubernetes nodes run linux; pods are not reported on %s", goos)
+	}
+	for _, f := range []struct {
+		key, v string
+	}{{"agent_host_root", cfg.AgentHostRoot}, {"agent_host_proc", cfg.AgentHostProc}, {"agent_host_sys", cfg.AgentHostSys}, {"agent_host_etc", cfg.AgentHostEtc}} {
+		if f.v != "" && goos != "linux" {
+			add(f.key, issueWarning, "host paths only apply to linux")
+		}
+	}
+	if cfg.AgentLLDP && goos != "linux" {
+		add("agent_lldp", issueInfo, "on %s neighbors are only read from lldpd's lldpctl", goos)
+	}
+	if cfg.AgentTracerouteInterval > 0 {
+		add("agent_traceroute_interval_minutes", issueInfo, "needs root (CAP_NET_RAW) or Administrator")
+	}
+	if cfg.AgentProbeCount < 0 || cfg.AgentProbeCount > 20 {
+		add("agent_probe_count", issueError, "must be between 0 and 20")
+	} else if cfg.AgentProbeCount > 0 && cfg.AgentProbeCount*2 > cfg.AgentInterval {
+		add("agent_probe_count", issueWarning, "%d probes per target may not finish within a %ds interval", cfg.AgentProbeCount, cfg.AgentInterval)
+	}
+	if cfg.AgentTopProcesses < 0 {
+		add("agent_top_processes", issueError, "must be >= 0")
+	}
+	if cfg.AgentNTPServer != "" && cfg.AgentNTPInterval <= 0 {
+		add("agent_ntp_interval_minutes", issueError, "must be > 0 while agent_ntp_server is set")
+	}
+	for _, s := range cfg.AgentDNSServers {
+		host := s
+		if h, _, err := net.SplitHostPort(s); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			add("agent_dns_servers", issueError, "%q is not an IP address with an optional port", s)
+		}
+	}
+	if len(cfg.AgentDNSServers) > 0 && len(cfg.AgentDNSNames) == 0 {
+		add("agent_dns_servers", issueWarning, "nothing is resolved without agent_dns_names")
+	}
+	if addr := cfg.AgentMetricsListen; addr != "" {
+		host, _, err := net.SplitHostPort(addr)
+		switch {
+		case err != nil:
+			add("agent_metrics_listen", issueError, "want host:port, got %q", addr)
+		case host == "" || !isLoopbackHost(host):
+			add("agent_metrics_listen", issueWarning, "the metrics endpoint has no authentication; %s exposes it beyond the host", addr)
+		}
+	}
+	return issues
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleValidateAgentConfig checks a proposed agent config before it is
+// rolled out: {"os":"linux","config":{"agent_interval_seconds":10,…}}, keys
+// as in config.yaml. Nothing is stored; valid is false when an issue is an
+// error.
+func handleValidateAgentConfig(c *gin.Context) {
+	var body struct {
+		OS     string         `json:"os"`
+		Config map[string]any `json:"config"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	goos := strings.ToLower(strings.TrimSpace(body.OS))
+	if goos == "" {
+		goos = "linux"
+	}
+	if !agentConfigOSes[goos] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "os must be linux, windows, darwin or freebsd"})
+		return
+	}
+
+	var issues []configIssue
+	known := map[string]bool{}
+	for _, k := range config.Keys() {
+		known[k] = true
+	}
+	set := map[string]bool{}
+	keys := make([]string, 0, len(body.Config))
+	for k := range body.Config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !known[k] {
+			issues = append(issues, configIssue{Field: k, Level: issueWarning, Message: "unknown key, ignored"})
+		}
+		set[k] = true
+	}
+	cfg, err := config.FromMap(body.Config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	issues = append(issues, validateAgentConfig(cfg, goos, set)...)
+	valid := true
+	for _, i := range issues {
+		if i.Level == issueError {
+			valid = false
+		}
+	}
+	if issues == nil {
+		issues = []configIssue{}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"valid": valid, "os": goos, "issues": issues}})
+}
@@ -0,0 +1,784 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// MetricOffline is the pseudo-metric of rules that fire on devices that
+// stopped reporting; its value is the number of seconds since the last report.
+const MetricOffline = "offline"
+
+// ParseAlertRule parses the alert_rules syntax
+//
+//	name: metric [operator threshold] [for duration] [severity] [device=id,…] [group=name] [escalate=channel:delay,…]
+//
+// e.g. "cpu-high: cpu_usage > 90 for 5m critical" or
+// "router-down: offline for 2m critical device=1 escalate=oncall:15m". The
+// offline metric takes no operator and threshold. The anomaly operator
+// compares against the device's learned baseline, its threshold in standard
+// deviations: "tx-spike: tx_bytes anomaly 4 for 10m". The severity defaults
+// to warning.
+func ParseAlertRule(s string) (models.AlertRule, error) {
+	name, expr, ok := strings.Cut(s, ":")
+	r := models.AlertRule{Name: strings.TrimSpace(name), Enabled: true}
+	if !ok || r.Name == "" {
+		return r, fmt.Errorf("alert rule %q: want \"name: metric …\"", s)
+	}
+	f := strings.Fields(expr)
+	if len(f) == 0 {
+		return r, fmt.Errorf("alert rule %q: missing metric", r.Name)
+	}
+	r.Metric, f = f[0], f[1:]
+	if r.Metric != MetricOffline {
+		if len(f) < 2 {
+			return r, fmt.Errorf("alert rule %q: want \"%s <operator> <threshold>\"", r.Name, r.Metric)
+		}
+		v, err := strconv.ParseFloat(f[1], 64)
+		if err != nil {
+			return r, fmt.Errorf("alert rule %q: threshold %q: %w", r.Name, f[1], err)
+		}
+		r.Operator, r.Threshold, f = f[0], v, f[2:]
+	}
+	var ids []uint
+	for len(f) > 0 {
+		tok := f[0]
+		f = f[1:]
+		switch {
+		case tok == "for":
+			if len(f) == 0 {
+				return r, fmt.Errorf("alert rule %q: \"for\" needs a duration", r.Name)
+			}
+			d, err := time.ParseDuration(f[0])
+			if err != nil {
+				return r, fmt.Errorf("alert rule %q: %w", r.Name, err)
+			}
+			r.DurationSec, f = int(d/time.Second), f[1:]
+		case tok == models.SeverityInfo || tok == models.SeverityWarning || tok == models.SeverityCritical:
+			r.Severity = tok
+		case strings.HasPrefix(tok, "device="):
+			for _, v := range strings.Split(strings.TrimPrefix(tok, "device="), ",") {
+				id, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					return r, fmt.Errorf("alert rule %q: device id %q", r.Name, v)
+				}
+				ids = append(ids, uint(id))
+			}
+		case strings.HasPrefix(tok, "group="):
+			r.Group = strings.TrimPrefix(tok, "group=")
+		case strings.HasPrefix(tok, "tag="):
+			r.Tag = strings.TrimPrefix(tok, "tag=")
+		case strings.HasPrefix(tok, "escalate="):
+			r.Escalation = strings.TrimPrefix(tok, "escalate=")
+		default:
+			return r, fmt.Errorf("alert rule %q: unexpected %q", r.Name, tok)
+		}
+	}
+	r.DeviceIDs = joinIDs(ids)
+	if err := normalizeAlertRule(&r); err != nil {
+		return r, fmt.Errorf("alert rule %q: %w", r.Name, err)
+	}
+	return r, nil
+}
+
+// normalizeAlertRule validates r and fills in defaults.
+func normalizeAlertRule(r *models.AlertRule) error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Metric == MetricOffline {
+		// The condition is "silent for DurationSec"; keep it readable.
+		r.Operator, r.Threshold = ">=", float64(r.DurationSec)
+	} else {
+		if _, ok := metricValue(&models.Metrics{}, r.Metric); !ok {
+			return fmt.Errorf("unknown metric %q", r.Metric)
+		}
+		if !validOperator(r.Operator) {
+			return fmt.Errorf("invalid operator %q (use >, >=, <, <=, ==, != or anomaly)", r.Operator)
+		}
+		if r.Operator == opAnomaly && r.Threshold <= 0 {
+			return fmt.Errorf("anomaly threshold is in standard deviations and must be > 0")
+		}
+	}
+	switch r.Severity {
+	case "":
+		r.Severity = models.SeverityWarning
+	case models.SeverityInfo, models.SeverityWarning, models.SeverityCritical:
+	default:
+		return fmt.Errorf("invalid severity %q (use info, warning or critical)", r.Severity)
+	}
+	if r.DurationSec < 0 {
+		return fmt.Errorf("duration_sec must be >= 0")
+	}
+	steps, err := parseEscalation(r.Escalation)
+	if err != nil {
+		return err
+	}
+	parts := make([]string, len(steps))
+	for i, st := range steps {
+		parts[i] = st.channel + ":" + st.after.String()
+	}
+	r.Escalation = strings.Join(parts, ",")
+	return nil
+}
+
+func validOperator(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=", opAnomaly:
+		return true
+	}
+	return false
+}
+
+// metricValue returns the named field of a sample.
+func metricValue(m *models.Metrics, metric string) (float64, bool) {
+	switch metric {
+	case "cpu_usage":
+		return m.CPUUsage, true
+	case "mem_usage":
+		return m.MemUsage, true
+	case "disk_usage":
+		return m.DiskUsage, true
+	case "rx_bytes":
+		return float64(m.RxBytes), true
+	case "tx_bytes":
+		return float64(m.TxBytes), true
+	case "tcp_connections":
+		return float64(m.TCPConnections), true
+	case "udp_connections":
+		return float64(m.UDPConnections), true
+	}
+	return 0, false
+}
+
+// alertRule is an enabled rule as the engine evaluates it. tagged holds
+// the devices carrying the rule's tag.
+type alertRule struct {
+	models.AlertRule
+	devices []uint
+	tagged  map[uint]bool
+}
+
+// matches reports whether value meets the rule's condition.
+func (r *alertRule) matches(value float64) bool {
+	switch r.Operator {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case "==":
+		return value == r.Threshold
+	case "!=":
+		return value != r.Threshold
+	}
+	return false
+}
+
+// applies reports whether dev is in the rule's scope.
+func (r *alertRule) applies(dev *models.Device) bool {
+	if dev.AgentVer == "discovered" {
+		return false
+	}
+	if r.Group != "" && dev.Group != r.Group {
+		return false
+	}
+	if r.Tag != "" && !r.tagged[dev.ID] {
+		return false
+	}
+	if len(r.devices) == 0 {
+		return true
+	}
+	for _, id := range r.devices {
+		if id == dev.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// alerting holds the enabled rules and, per rule and device, since when the
+// condition holds and the firing alert, if any.
+var alerting = struct {
+	sync.Mutex
+	rules  []alertRule
+	state  map[string]*alertState // "ruleID/deviceID"
+	loaded bool
+}{state: map[string]*alertState{}}
+
+type alertState struct {
+	since   time.Time
+	alertID uint
+	rule    string
+}
+
+// SeedAlertRules creates the alert_rules from config that are not in the
+// database yet (by name); from then on they are managed through the API.
+func SeedAlertRules(specs []string) error {
+	for _, s := range specs {
+		r, err := ParseAlertRule(s)
+		if err != nil {
+			return err
+		}
+		var n int64
+		DB.Model(&models.AlertRule{}).Where("name = ?", r.Name).Count(&n)
+		if n > 0 {
+			continue
+		}
+		if err := DB.Create(&r).Error; err != nil {
+			return fmt.Errorf("alert rule %q: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// reloadAlertRulesLocked loads the enabled rules and resolves the firing
+// alerts of rules that were deleted or disabled. On the first load it
+// picks up the alerts still firing from before a restart.
+func reloadAlertRulesLocked(now time.Time) {
+	var list []models.AlertRule
+	if err := DB.Where("enabled = ?", true).Find(&list).Error; err != nil {
+		log.Printf("[alerts] load rules: %v", err)
+		return
+	}
+	alerting.rules = alerting.rules[:0]
+	active := map[uint]bool{}
+	for _, r := range list {
+		rule := alertRule{AlertRule: r, devices: splitIDs(r.DeviceIDs)}
+		if r.Tag != "" {
+			rule.tagged = map[uint]bool{}
+			var ids []uint
+			DB.Model(&models.DeviceTag{}).Where("tag_id IN (?)", DB.Model(&models.Tag{}).Select("id").Where("name = ?", r.Tag)).
+				Pluck("device_id", &ids)
+			for _, id := range ids {
+				rule.tagged[id] = true
+			}
+		}
+		alerting.rules = append(alerting.rules, rule)
+		active[r.ID] = true
+	}
+	if !alerting.loaded {
+		alerting.loaded = true
+		var firing []models.Alert
+		if err := DB.Where("status = ?", models.AlertFiring).Find(&firing).Error; err != nil {
+			log.Printf("[alerts] load firing alerts: %v", err)
+		}
+		for _, a := range firing {
+			alerting.state[alertKey(a.RuleID, a.DeviceID)] = &alertState{since: a.FiredAt, alertID: a.ID, rule: a.RuleName}
+		}
+	}
+	for key, st := range alerting.state {
+		ruleID, deviceID := parseAlertKey(key)
+		if active[ruleID] {
+			continue
+		}
+		if st.alertID != 0 {
+			resolveAlert(st.alertID, deviceID, st.rule, st.rule+" resolved: rule removed or disabled", now)
+		}
+		delete(alerting.state, key)
+	}
+}
+
+// ReloadAlertRules makes rule changes take effect.
+func ReloadAlertRules() {
+	alerting.Lock()
+	defer alerting.Unlock()
+	reloadAlertRulesLocked(time.Now())
+}
+
+func alertKey(ruleID, deviceID uint) string {
+	return strconv.FormatUint(uint64(ruleID), 10) + "/" + strconv.FormatUint(uint64(deviceID), 10)
+}
+
+func parseAlertKey(key string) (ruleID, deviceID uint) {
+	r, d, _ := strings.Cut(key, "/")
+	ids := splitIDs(r + "," + d)
+	if len(ids) != 2 {
+		return 0, 0
+	}
+	return ids[0], ids[1]
+}
+
+// EvaluateAlerts runs the metric rules against a sample dev just reported;
+// the report also clears dev's offline alerts.
+func EvaluateAlerts(dev *models.Device, m *models.Metrics) {
+	now := time.Now()
+	alerting.Lock()
+	defer alerting.Unlock()
+	if !alerting.loaded {
+		reloadAlertRulesLocked(now)
+	}
+	learn := map[string]float64{}
+	for i := range alerting.rules {
+		r := &alerting.rules[i]
+		if !r.applies(dev) {
+			continue
+		}
+		if r.Metric == MetricOffline {
+			// A flapping device stays down until it settles, so its
+			// alert does not resolve and fire again on every return.
+			updateAlertLocked(r, dev, dev.Flapping, 0, now)
+			continue
+		}
+		v, _ := metricValue(m, r.Metric)
+		if r.Operator == opAnomaly {
+			// Judged against the baseline before the sample joins it.
+			z, _, ok := anomalyScore(dev.ID, r.Metric, v, now)
+			learn[r.Metric] = v
+			updateAlertLocked(r, dev, ok && math.Abs(z) >= r.Threshold, v, now)
+			continue
+		}
+		updateAlertLocked(r, dev, r.matches(v), v, now)
+	}
+	for metric, v := range learn {
+		observeBaseline(dev.ID, metric, v, now)
+	}
+}
+
+// RunAlertEngine evaluates the offline rules every 10 seconds; metric rules
+// run on ingest (EvaluateAlerts). It never returns.
+func RunAlertEngine() {
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		// With several instances sharing Redis only one evaluates, or
+		// each would fire its own alert.
+		if leads("alerts", 30*time.Second) {
+			evaluateOfflineAlerts(time.Now())
+			releaseSilencedAlerts(time.Now())
+			escalateAlerts(time.Now())
+		}
+	}
+}
+
+func evaluateOfflineAlerts(now time.Time) {
+	var devices []models.Device
+	if err := DB.Where("agent_ver <> ?", "discovered").Find(&devices).Error; err != nil {
+		log.Printf("[alerts] load devices: %v", err)
+		return
+	}
+	alerting.Lock()
+	defer alerting.Unlock()
+	if !alerting.loaded {
+		reloadAlertRulesLocked(now)
+	}
+	for i := range alerting.rules {
+		r := &alerting.rules[i]
+		if r.Metric != MetricOffline {
+			continue
+		}
+		for j := range devices {
+			d := &devices[j]
+			if !r.applies(d) || d.LastSeen.IsZero() {
+				continue
+			}
+			// A planned shutdown is not an outage; flapping counts as down.
+			down := (!d.IsOnline && d.ShutdownAt == nil) || d.Flapping
+			updateAlertLocked(r, d, down, now.Sub(d.LastSeen).Seconds(), now)
+		}
+	}
+}
+
+// updateAlertLocked advances the rule's state on dev: the alert fires once
+// the condition has held for the rule's duration and resolves when it
+// clears.
+func updateAlertLocked(r *alertRule, dev *models.Device, cond bool, value float64, now time.Time) {
+	key := alertKey(r.ID, dev.ID)
+	st := alerting.state[key]
+	if !cond {
+		if st != nil && st.alertID != 0 {
+			resolveAlert(st.alertID, dev.ID, r.Name, deviceName(dev)+": "+r.Name+" resolved", now)
+		}
+		delete(alerting.state, key)
+		return
+	}
+	if st == nil {
+		st = &alertState{since: now, rule: r.Name}
+		alerting.state[key] = st
+	}
+	if st.alertID != 0 || now.Sub(st.since) < time.Duration(r.DurationSec)*time.Second {
+		return
+	}
+	a := models.Alert{
+		RuleID: r.ID, RuleName: r.Name, DeviceID: dev.ID, Severity: r.Severity,
+		Channel: r.Channel, Escalation: r.Escalation,
+		Metric: r.Metric, Operator: r.Operator, Threshold: r.Threshold, Value: value,
+		Status: models.AlertFiring, FiredAt: now,
+	}
+	if r.Metric == MetricOffline && dev.Flapping {
+		a.Message = fmt.Sprintf("%s: %s — flapping (%d offline transitions)", deviceName(dev), r.Name, dev.FlapCount)
+	} else if r.Metric == MetricOffline {
+		a.Message = fmt.Sprintf("%s: %s — offline for %s", deviceName(dev), r.Name, time.Duration(value*float64(time.Second)).Round(time.Second))
+	} else if r.Operator == opAnomaly {
+		a.Message = anomalyMessage(dev, r, value, now)
+	} else {
+		a.Message = fmt.Sprintf("%s: %s — %s %.1f %s %g", deviceName(dev), r.Name, r.Metric, value, r.Operator, r.Threshold)
+	}
+	if a.Silenced = silenced(r.ID, dev, now); !a.Silenced {
+		a.NotifiedAt = &now
+	}
+	if err := DB.Create(&a).Error; err != nil {
+		log.Printf("[alerts] save alert %s: %v", key, err)
+		return
+	}
+	st.alertID = a.ID
+	data := map[string]any{"alert_id": a.ID, "rule": r.Name, "severity": r.Severity, "value": value}
+	if a.Silenced {
+		// Recorded for the history, but nobody is paged and nothing is
+		// remediated during a maintenance window.
+		log.Printf("[alerts] FIRING %s (%s, silenced)", a.Message, a.Severity)
+		data["silenced"] = true
+		RecordEvent(dev.ID, models.EventAlertFiring, a.Message, data)
+		recordAlertEvent(&a, models.AlertEventFired, "", "", a.Message+" (silenced)")
+		return
+	}
+	log.Printf("[alerts] FIRING %s (%s)", a.Message, a.Severity)
+	RecordEvent(dev.ID, models.EventAlertFiring, a.Message, data)
+	recordAlertEvent(&a, models.AlertEventFired, "", a.Channel, a.Message)
+	TriggerRemediation(r.Name, dev.ID)
+	notifyAlert(&a, "")
+}
+
+// resolveAlert ends a firing alert. Another instance may have resolved it
+// already; then it does nothing.
+func resolveAlert(alertID, deviceID uint, rule, message string, now time.Time) {
+	res := DB.Model(&models.Alert{}).Where("id = ? AND status = ?", alertID, models.AlertFiring).
+		Updates(map[string]any{"status": models.AlertResolved, "resolved_at": now})
+	if res.Error != nil {
+		log.Printf("[alerts] resolve alert %d: %v", alertID, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		return
+	}
+	log.Printf("[alerts] resolved %s on device %d", rule, deviceID)
+	RecordEvent(deviceID, models.EventAlertResolved, message, map[string]any{"alert_id": alertID, "rule": rule})
+	var a models.Alert
+	if DB.First(&a, alertID).Error != nil {
+		return
+	}
+	recordAlertEvent(&a, models.AlertEventResolved, "", "", message)
+	// A silenced alert never notified, so its end does not either.
+	if !a.Silenced {
+		notifyAlert(&a, message)
+		notifyEscalated(&a, message)
+	}
+}
+
+// recordAlertEvent appends a transition to the alert's timeline.
+func recordAlertEvent(a *models.Alert, typ, by, channel, message string) {
+	ev := models.AlertEvent{AlertID: a.ID, DeviceID: a.DeviceID, Type: typ, By: by, Channel: channel, Message: message}
+	if err := DB.Create(&ev).Error; err != nil {
+		log.Printf("[alerts] record %s of alert %d: %v", typ, a.ID, err)
+	}
+}
+
+// AckAlert acknowledges a firing alert on behalf of by (a user name or
+// "telegram:<user>").
+func AckAlert(alertID uint, by string) (*models.Alert, error) {
+	var a models.Alert
+	if err := DB.First(&a, alertID).Error; err != nil {
+		return nil, fmt.Errorf("alert %d not found", alertID)
+	}
+	if a.Status != models.AlertFiring {
+		return nil, fmt.Errorf("alert %d is %s", alertID, a.Status)
+	}
+	if a.AckedAt != nil {
+		return nil, fmt.Errorf("alert %d was acknowledged by %s", alertID, a.AckedBy)
+	}
+	now := time.Now()
+	res := DB.Model(&a).Where("acked_at IS NULL").Updates(map[string]any{"acked_at": now, "acked_by": by})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("alert %d was acknowledged already", alertID)
+	}
+	a.AckedAt, a.AckedBy = &now, by
+	msg := fmt.Sprintf("%s acknowledged by %s", a.RuleName, by)
+	RecordEvent(a.DeviceID, models.EventAlertAcked, msg, map[string]any{"alert_id": a.ID, "rule": a.RuleName, "by": by})
+	recordAlertEvent(&a, models.AlertEventAcked, by, "", msg)
+	return &a, nil
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListAlertRules returns all alert rules.
+func handleListAlertRules(c *gin.Context) {
+	var list []models.AlertRule
+	if err := DB.Order("name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// alertRuleBody is the create / update body for an alert rule.
+type alertRuleBody struct {
+	Name        *string  `json:"name"`
+	Metric      *string  `json:"metric"`
+	Operator    *string  `json:"operator"`
+	Threshold   *float64 `json:"threshold"`
+	DurationSec *int     `json:"duration_sec"`
+	Severity    *string  `json:"severity"`
+	DeviceIDs   []uint   `json:"device_ids"`
+	Group       *string  `json:"group"`
+	Tag         *string  `json:"tag"`
+	Channel     *string  `json:"channel"`
+	Escalation  *string  `json:"escalation"`
+	Enabled     *bool    `json:"enabled"`
+}
+
+// apply copies the provided fields onto r and validates the result. An
+// empty device_ids list removes the device scope.
+func (b *alertRuleBody) apply(r *models.AlertRule) error {
+	if b.Name != nil {
+		r.Name = strings.TrimSpace(*b.Name)
+	}
+	if b.Metric != nil {
+		r.Metric = *b.Metric
+	}
+	if b.Operator != nil {
+		r.Operator = *b.Operator
+	}
+	if b.Threshold != nil {
+		r.Threshold = *b.Threshold
+	}
+	if b.DurationSec != nil {
+		r.DurationSec = *b.DurationSec
+	}
+	if b.Severity != nil {
+		r.Severity = *b.Severity
+	}
+	if b.DeviceIDs != nil {
+		r.DeviceIDs = joinIDs(b.DeviceIDs)
+	}
+	if b.Group != nil {
+		r.Group = *b.Group
+	}
+	if b.Tag != nil {
+		r.Tag = strings.TrimSpace(*b.Tag)
+	}
+	if b.Channel != nil {
+		r.Channel = *b.Channel
+	}
+	if b.Escalation != nil {
+		r.Escalation = *b.Escalation
+	}
+	if b.Enabled != nil {
+		r.Enabled = *b.Enabled
+	}
+	return normalizeAlertRule(r)
+}
+
+// handleCreateAlertRule creates a rule.
+func handleCreateAlertRule(c *gin.Context) {
+	var body alertRuleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r := models.AlertRule{Enabled: true}
+	if err := body.apply(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// GORM 会把零值字段回落为列默认值（enabled=false → true），创建后显式写回。
+	enabled := r.Enabled
+	if err := DB.Create(&r).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !enabled {
+		DB.Model(&r).Update("enabled", false)
+		r.Enabled = false
+	}
+	shared.Publish(topicAlertRules, nil)
+	c.JSON(http.StatusOK, gin.H{"data": r})
+}
+
+// handleUpdateAlertRule updates the provided fields of a rule.
+func handleUpdateAlertRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var r models.AlertRule
+	if err := DB.First(&r, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert rule not found"})
+		return
+	}
+	var body alertRuleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&r).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicAlertRules, nil)
+	c.JSON(http.StatusOK, gin.H{"data": r})
+}
+
+// alertView is an alert with its timeline.
+type alertView struct {
+	models.Alert
+	Events []models.AlertEvent `json:"events,omitempty"`
+}
+
+// handleListAlerts lists alerts, latest first. ?state=firing|resolved
+// filters by status, ?from= / ?to= (RFC 3339 or unix seconds) keep the
+// alerts that were firing at some point in that range, ?device_id= and
+// ?rule= narrow further; ?events=true adds each alert's timeline. limit
+// defaults to 100.
+func handleListAlerts(c *gin.Context) {
+	q := DB.Model(&models.Alert{})
+	if v := c.Query("state"); v != "" {
+		if v != models.AlertFiring && v != models.AlertResolved {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state must be firing or resolved"})
+			return
+		}
+		q = q.Where("status = ?", v)
+	}
+	if v := c.Query("from"); v != "" {
+		ts, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from: " + err.Error()})
+			return
+		}
+		q = q.Where("resolved_at IS NULL OR resolved_at >= ?", ts)
+	}
+	if v := c.Query("to"); v != "" {
+		ts, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to: " + err.Error()})
+			return
+		}
+		q = q.Where("fired_at < ?", ts)
+	}
+	if v := c.Query("device_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+			return
+		}
+		q = q.Where("device_id = ?", id)
+	}
+	if v := c.Query("rule"); v != "" {
+		q = q.Where("rule_name = ?", v)
+	}
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = min(n, 1000)
+		}
+	}
+	var list []models.Alert
+	if err := q.Order("fired_at desc").Limit(limit).Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	views := make([]alertView, len(list))
+	ids := make([]uint, len(list))
+	for i := range list {
+		views[i].Alert, ids[i] = list[i], list[i].ID
+	}
+	if c.Query("events") == "true" && len(ids) > 0 {
+		var events []models.AlertEvent
+		if err := DB.Where("alert_id IN ?", ids).Order("id").Find(&events).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		byAlert := map[uint][]models.AlertEvent{}
+		for _, ev := range events {
+			byAlert[ev.AlertID] = append(byAlert[ev.AlertID], ev)
+		}
+		for i := range views {
+			views[i].Events = byAlert[views[i].ID]
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": views})
+}
+
+// handleGetAlert returns an alert with its timeline.
+func handleGetAlert(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var v alertView
+	if err := DB.First(&v.Alert, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		var dev models.Device
+		if DB.Select("id", "group").First(&dev, v.DeviceID).Error != nil || !groups[dev.Group] {
+			c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+			return
+		}
+	}
+	if err := DB.Where("alert_id = ?", id).Order("id").Find(&v.Events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": v})
+}
+
+// handleAckAlert acknowledges a firing alert as the caller, which stops its
+// escalation.
+func handleAckAlert(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Select("id").First(&models.Alert{}, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+	a, err := AckAlert(uint(id), c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": a})
+}
+
+// handleDeleteAlertRule removes a rule and resolves its firing alerts (the
+// alert history is kept).
+func handleDeleteAlertRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.AlertRule{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicAlertRules, nil)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
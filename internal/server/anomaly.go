@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// opAnomaly is the operator of anomaly rules: the rule fires when a
+// sample is more than Threshold standard deviations away from what the
+// device's metric usually is at that hour, e.g. "tx_bytes anomaly 4".
+const opAnomaly = "anomaly"
+
+// Baseline learning: each hour's samples are folded into that hour's
+// baseline with weight anomalyAlpha (about a week of memory), and a
+// baseline judges samples once it has seen anomalyMinDays days.
+const (
+	anomalyAlpha   = 0.25
+	anomalyMinDays = 3
+)
+
+// hourAcc accumulates the samples of the current hour (Welford).
+type hourAcc struct {
+	hour     time.Time
+	n        int
+	mean, m2 float64
+}
+
+func (a *hourAcc) add(v float64) {
+	a.n++
+	d := v - a.mean
+	a.mean += d / float64(a.n)
+	a.m2 += d * (v - a.mean)
+}
+
+// baselines holds the learned baselines of the devices seen since start
+// and the current hour's samples, keyed by "deviceID/metric".
+var baselines = struct {
+	sync.Mutex
+	loaded map[uint]bool
+	rows   map[string]*[24]*models.MetricBaseline
+	acc    map[string]*hourAcc
+}{loaded: map[uint]bool{}, rows: map[string]*[24]*models.MetricBaseline{}, acc: map[string]*hourAcc{}}
+
+func baselineKey(deviceID uint, metric string) string {
+	return strconv.FormatUint(uint64(deviceID), 10) + "/" + metric
+}
+
+// loadBaselinesLocked reads a device's learned baselines once.
+func loadBaselinesLocked(deviceID uint) {
+	if baselines.loaded[deviceID] {
+		return
+	}
+	baselines.loaded[deviceID] = true
+	var list []models.MetricBaseline
+	if err := DB.Where("device_id = ?", deviceID).Find(&list).Error; err != nil {
+		log.Printf("[anomaly] load baselines of device %d: %v", deviceID, err)
+		return
+	}
+	for i := range list {
+		b := &list[i]
+		if b.Hour < 0 || b.Hour > 23 {
+			continue
+		}
+		key := baselineKey(deviceID, b.Metric)
+		if baselines.rows[key] == nil {
+			baselines.rows[key] = &[24]*models.MetricBaseline{}
+		}
+		baselines.rows[key][b.Hour] = b
+	}
+}
+
+// observeBaseline learns from a sample. When the hour changes the previous
+// hour's samples are folded into that hour's baseline and stored.
+func observeBaseline(deviceID uint, metric string, v float64, now time.Time) {
+	baselines.Lock()
+	defer baselines.Unlock()
+	loadBaselinesLocked(deviceID)
+	key := baselineKey(deviceID, metric)
+	hour := now.Truncate(time.Hour)
+	a := baselines.acc[key]
+	if a != nil && !a.hour.Equal(hour) {
+		foldBaselineLocked(deviceID, metric, a)
+		a = nil
+	}
+	if a == nil {
+		a = &hourAcc{hour: hour}
+		baselines.acc[key] = a
+	}
+	a.add(v)
+}
+
+func foldBaselineLocked(deviceID uint, metric string, a *hourAcc) {
+	key := baselineKey(deviceID, metric)
+	if baselines.rows[key] == nil {
+		baselines.rows[key] = &[24]*models.MetricBaseline{}
+	}
+	h := a.hour.Local().Hour()
+	b := baselines.rows[key][h]
+	if b == nil {
+		b = &models.MetricBaseline{DeviceID: deviceID, Metric: metric, Hour: h}
+		baselines.rows[key][h] = b
+	}
+	within := a.m2 / float64(a.n)
+	if b.Days == 0 {
+		b.Mean, b.Variance = a.mean, within
+	} else {
+		// The variance covers both the spread inside the hour and how the
+		// hour's level moves from day to day.
+		d := a.mean - b.Mean
+		b.Mean += anomalyAlpha * d
+		b.Variance = (1-anomalyAlpha)*b.Variance + anomalyAlpha*(within+d*d)
+	}
+	b.Days++
+	if err := DB.Save(b).Error; err != nil {
+		log.Printf("[anomaly] save baseline %s hour %d: %v", key, h, err)
+	}
+}
+
+// forgetBaselines drops a deleted device's baselines from memory.
+func forgetBaselines(deviceID uint) {
+	baselines.Lock()
+	defer baselines.Unlock()
+	delete(baselines.loaded, deviceID)
+	prefix := baselineKey(deviceID, "")
+	for key := range baselines.rows {
+		if strings.HasPrefix(key, prefix) {
+			delete(baselines.rows, key)
+		}
+	}
+	for key := range baselines.acc {
+		if strings.HasPrefix(key, prefix) {
+			delete(baselines.acc, key)
+		}
+	}
+}
+
+// anomalyScore returns how many standard deviations v is from the metric's
+// baseline at now's hour, and that baseline's mean; ok is false while the
+// baseline is still learning. The deviation is at least 10% of the mean
+// (and 1), so a metric that never moved does not alert on every wiggle.
+func anomalyScore(deviceID uint, metric string, v float64, now time.Time) (z, mean float64, ok bool) {
+	baselines.Lock()
+	defer baselines.Unlock()
+	loadBaselinesLocked(deviceID)
+	rows := baselines.rows[baselineKey(deviceID, metric)]
+	if rows == nil {
+		return 0, 0, false
+	}
+	b := rows[now.Local().Hour()]
+	if b == nil || b.Days < anomalyMinDays {
+		return 0, 0, false
+	}
+	sd := math.Max(math.Sqrt(b.Variance), math.Max(0.1*math.Abs(b.Mean), 1))
+	return (v - b.Mean) / sd, b.Mean, true
+}
+
+// anomalyMessage describes an anomaly alert.
+func anomalyMessage(dev *models.Device, r *alertRule, v float64, now time.Time) string {
+	z, mean, _ := anomalyScore(dev.ID, r.Metric, v, now)
+	return fmt.Sprintf("%s: %s — %s %.4g is %.1fσ from its usual %.4g at %02d:00",
+		deviceName(dev), r.Name, r.Metric, v, z, mean, now.Local().Hour())
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleDeviceBaselines returns the learned baselines of a device, by
+// metric and hour.
+func handleDeviceBaselines(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var list []models.MetricBaseline
+	if err := DB.Where("device_id = ?", id).Order("metric, hour").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -5,14 +5,18 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vesaa/opentalon/internal/models"
 	"github.com/vesaa/opentalon/internal/scanner"
+	"github.com/vesaa/opentalon/internal/telemetry"
 )
 
 // adminCredentials are set at startup from config.
@@ -24,51 +28,256 @@ func SetAdminCredentials(user, pass string) {
 	adminPass = pass
 }
 
+// account is a non-admin login from the users config.
+type account struct{ password, role string }
+
+// accounts maps username to the users config entries.
+var accounts = map[string]account{}
+
+// SetUsers stores the additional logins, "name:password:role" each; the
+// role picks the policies that apply to them.
+func SetUsers(specs []string) error {
+	m := map[string]account{}
+	for _, spec := range specs {
+		name, rest, _ := strings.Cut(spec, ":")
+		i := strings.LastIndex(rest, ":")
+		if name == "" || i <= 0 || i == len(rest)-1 {
+			return fmt.Errorf("user %q: want name:password:role", name)
+		}
+		if name == adminUser || m[name] != (account{}) {
+			return fmt.Errorf("user %q: duplicate name", name)
+		}
+		m[name] = account{password: rest[:i], role: rest[i+1:]}
+	}
+	accounts = m
+	return nil
+}
+
 // RegisterControlRoutes wires up the control-plane API on the given engine.
 func RegisterControlRoutes(r *gin.Engine) {
 	api := r.Group("/api")
 
 	// Public endpoints
 	api.POST("/login", handleLogin)
+	// Authenticates itself: the JWT comes as ?token= (see live.go).
+	api.GET("/ws", handleLiveWS)
+	api.GET("/openapi.json", handleOpenAPI)
+	api.GET("/docs", handleAPIDocs)
 	api.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok", "time": time.Now().UTC()})
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "time": time.Now().UTC(), "fingerprint": Fingerprint()})
 	})
 
 	// JWT-protected endpoints
-	auth := api.Group("/", JWTMiddleware())
+	auth := api.Group("/", JWTMiddleware(), PolicyMiddleware())
 	{
+		auth.POST("/logout", handleLogout)
+		auth.POST("/refresh", handleRefresh)
+		auth.GET("/devices", handleListDevices)
 		auth.GET("/devices/tree", handleDeviceTree)
+		auth.GET("/events", handleListEvents)
+		auth.GET("/events/stream", handleEventStream)
+		auth.GET("/topology/path", handleTopologyPath)
+		auth.GET("/topology/flows", handleTopologyFlows)
+		auth.GET("/topology/links", handleTopologyLinks)
+		auth.GET("/topology/at", handleTopologyAt)
+		auth.GET("/topology/history", handleTopologyHistory)
 		auth.GET("/devices/:id/metrics", handleDeviceMetrics)
+		auth.DELETE("/devices/:id/metrics", handlePurgeMetrics)
+		auth.GET("/devices/:id/metrics/export", handleMetricsExport)
+		auth.GET("/compare", handleCompare)
+		auth.GET("/search", handleSearch)
+		auth.GET("/graphql", handleGraphQL)
+		auth.POST("/graphql", handleGraphQL)
+		auth.GET("/groups", handleListGroups)
+		auth.GET("/groups/:name/metrics", handleGroupMetrics)
+		auth.POST("/groups", handleCreateGroup)
+		auth.PATCH("/groups/:name", handleUpdateGroup)
+		auth.DELETE("/groups/:name", handleDeleteGroup)
+		auth.POST("/devices/:id/metrics/import", handleMetricsImport)
+		auth.GET("/devices/:id/metrics/rollups", handleDeviceRollups)
+		auth.GET("/devices/:id/metrics/history", handleMetricsHistory)
+		auth.GET("/devices/:id/metrics/custom", handleDeviceCustomMetrics)
+		auth.GET("/devices/:id/baselines", handleDeviceBaselines)
+		auth.POST("/devices/:id/health-probe", handleHealthProbe)
+		auth.POST("/devices/:id/wake", handlePowerAction(powerWake))
+		auth.POST("/devices/:id/sleep", handlePowerAction(powerSleep))
+		auth.POST("/devices/:id/benchmark", handleBenchmark)
+		auth.POST("/devices/:id/exec", handleDeviceExec)
+		auth.GET("/devices/:id/compliance", handleDeviceCompliance)
+		auth.GET("/devices/:id/preview", handleDeviceWebPreview)
+		auth.POST("/devices/:id/preview", handleRefreshWebPreview)
+		auth.GET("/previews", handleListWebPreviews)
+		auth.GET("/devices/:id/containers", handleDeviceContainers)
+		auth.GET("/devices/:id/pods", handleDevicePods)
+		auth.GET("/devices/:id/processes", handleDeviceProcesses)
+		auth.GET("/devices/:id/ports", handleDevicePorts)
+		auth.GET("/devices/:id/interfaces", handleDeviceInterfaces)
+		auth.GET("/devices/:id/neighbors", handleDeviceNeighbors)
+		auth.GET("/devices/:id/latency", handleDeviceLatency)
+		auth.GET("/devices/:id/report-timing", handleDeviceReportTiming)
+		auth.GET("/devices/:id/dns", handleDeviceDNS)
+		auth.GET("/devices/:id/peers", handleDevicePeers)
+		auth.GET("/devices/:id/traceroute", handleDeviceTraceroutes)
+		auth.POST("/devices/:id/traceroute", handleRequestTraceroute)
+		auth.GET("/devices/:id/speedtest", handleDeviceSpeedTests)
+		auth.POST("/devices/:id/speedtest", handleRequestSpeedTest)
+		auth.GET("/ports", handleSearchPorts)
 		auth.POST("/devices/:id/probe", handleDeviceProbe)
 		auth.DELETE("/devices/:id", handleDeviceDelete)
 		auth.PATCH("/devices/:id", handleDeviceUpdate)
+		auth.GET("/devices/trash", handleDeviceTrash)
+		auth.GET("/devices/duplicates", handleDeviceDuplicates)
+		auth.POST("/devices/:id/merge", handleMergeDevice)
+		auth.POST("/devices/:id/restore", handleDeviceRestore)
+		auth.DELETE("/devices/trash/:id", handleDevicePurge)
+		auth.POST("/devices/:id/parent", handleSetParent)
+		auth.PATCH("/devices/:id/metadata", handleDeviceMetadata)
+		auth.GET("/devices/:id/tags", handleDeviceTags)
+		auth.POST("/devices/:id/tags", handleTagDevice(false))
+		auth.PUT("/devices/:id/tags", handleTagDevice(true))
+		auth.DELETE("/devices/:id/tags/:tag", handleUntagDevice)
+		auth.GET("/tags", handleListTags)
+		auth.POST("/tags", handleCreateTag)
+		auth.PATCH("/tags/:id", handleUpdateTag)
+		auth.DELETE("/tags/:id", handleDeleteTag)
 
 		// LAN discovery
 		auth.GET("/discovered", handleGetDiscovered)
 		auth.POST("/discovered/adopt", handleAdoptDiscovered)
+		auth.POST("/discovered/:id/install", handleInstallDiscovered)
+		auth.POST("/agents/validate-config", handleValidateAgentConfig)
 		auth.POST("/scan/trigger", handleScanTrigger)
 		auth.POST("/scan/stop", handleScanStop)
 		auth.GET("/scan/status", handleScanStatus)
+
+		// Auto-remediation
+		auth.GET("/playbooks", handleListPlaybooks)
+		auth.GET("/remediation/hooks", handleListRemediationHooks)
+		auth.POST("/remediation/hooks", handleCreateRemediationHook)
+		auth.PATCH("/remediation/hooks/:id", handleUpdateRemediationHook)
+		auth.DELETE("/remediation/hooks/:id", handleDeleteRemediationHook)
+		auth.GET("/remediation/runs", handleListRemediationRuns)
+		auth.POST("/remediation/trigger", handleTriggerRemediation)
+
+		// Running remote executions and the emergency stop
+		auth.GET("/tasks/running", handleRunningTasks)
+		auth.POST("/tasks/:id/cancel", handleCancelTask)
+		auth.POST("/tasks/stop", handleEmergencyStop)
+		auth.POST("/tasks/resume", handleResumeTasks)
+
+		// Alerting
+		auth.GET("/alerts/rules", handleListAlertRules)
+		auth.POST("/alerts/rules", handleCreateAlertRule)
+		auth.PATCH("/alerts/rules/:id", handleUpdateAlertRule)
+		auth.DELETE("/alerts/rules/:id", handleDeleteAlertRule)
+		auth.GET("/alerts", handleListAlerts)
+		auth.GET("/alerts/:id", handleGetAlert)
+		auth.POST("/alerts/:id/ack", handleAckAlert)
+		auth.GET("/silences", handleListSilences)
+		auth.POST("/silences", handleCreateSilence)
+		auth.PATCH("/silences/:id", handleUpdateSilence)
+		auth.DELETE("/silences/:id", handleDeleteSilence)
+
+		// Notification channels (webhook / Slack / Discord / …) stored in the database
+		auth.GET("/channels", handleListChannels)
+		auth.POST("/channels", handleCreateChannel)
+		auth.PATCH("/channels/:id", handleUpdateChannel)
+		auth.DELETE("/channels/:id", handleDeleteChannel)
+		auth.POST("/channels/test", handleTestChannel)
+		auth.POST("/channels/render", handleRenderTemplate)
+
+		// Power schedules (Wake-on-LAN / shutdown)
+		auth.GET("/power-schedules", handleListPowerSchedules)
+		auth.POST("/power-schedules", handleCreatePowerSchedule)
+		auth.PATCH("/power-schedules/:id", handleUpdatePowerSchedule)
+		auth.DELETE("/power-schedules/:id", handleDeletePowerSchedule)
+
+		// Synthetic checks
+		auth.GET("/checks", handleListChecks)
+		auth.POST("/checks", handleCreateCheck)
+		auth.PUT("/checks/:id", handleUpdateCheck)
+		auth.DELETE("/checks/:id", handleDeleteCheck)
+		auth.GET("/checks/:id/results", handleCheckResults)
+		auth.POST("/checks/:id/run", handleRunCheck)
+
+		// Compliance rules and the per-device report
+		auth.GET("/compliance", handleComplianceReport)
+		auth.POST("/compliance/run", handleRunCompliance)
+		auth.GET("/compliance/rules", handleListComplianceRules)
+		auth.POST("/compliance/rules", handleCreateComplianceRule)
+		auth.PATCH("/compliance/rules/:id", handleUpdateComplianceRule)
+		auth.DELETE("/compliance/rules/:id", handleDeleteComplianceRule)
+
+		// Federation (sites pushed by edge servers)
+		auth.GET("/federation/sites", handleListSites)
+		auth.DELETE("/federation/sites/:id", handleDeleteSite)
+		auth.GET("/federation/sites/:id/rollups", handleSiteRollups)
+
+		// Authorization policies of the non-admin roles
+		auth.GET("/policies", handleListPolicies)
+		auth.POST("/policies", handleCreatePolicy)
+		auth.PATCH("/policies/:id", handleUpdatePolicy)
+		auth.DELETE("/policies/:id", handleDeletePolicy)
+
+		// Grafana JSON datasource
+		auth.GET("/grafana", handleGrafanaTest)
+		auth.POST("/grafana/search", handleGrafanaSearch)
+		auth.POST("/grafana/query", handleGrafanaQuery)
+		auth.POST("/grafana/annotations", handleGrafanaAnnotations)
+
+		// Personal API tokens of the logged-in user
+		auth.GET("/tokens", handleListAPITokens)
+		auth.POST("/tokens", handleCreateAPIToken)
+		auth.DELETE("/tokens/:id", handleRevokeAPIToken)
+
+		// Notification subscriptions of the logged-in user
+		auth.GET("/subscriptions", handleListSubscriptions)
+		auth.POST("/subscriptions", handleCreateSubscription)
+		auth.PATCH("/subscriptions/:id", handleUpdateSubscription)
+		auth.DELETE("/subscriptions/:id", handleDeleteSubscription)
 	}
 }
 
 // RegisterDataRoutes wires up the data-plane API on the given engine.
 func RegisterDataRoutes(r *gin.Engine) {
+	r.Use(DataAllowlistMiddleware())
 	api := r.Group("/api", AgentTokenMiddleware())
 	{
 		api.POST("/devices/register", handleDeviceRegister)
 		api.POST("/metrics", handleMetricsIngest)
+		api.POST("/devices/shutdown", handleShutdownNotice)
 		api.POST("/discovered/report", handleDiscoveredReport)
+		api.POST("/checks/results", handleCheckReport)
+		api.POST("/traceroute/report", handleTracerouteReport)
+		api.GET("/speedtest/download", handleSpeedTestDownload)
+		api.POST("/speedtest/upload", handleSpeedTestUpload)
+		api.POST("/speedtest/report", handleSpeedTestReport)
 	}
+	// Edge servers authenticate with the federation token, not the agent token.
+	r.POST("/api/federation/push", FederationTokenMiddleware(), handleFederationPush)
 
 	r.GET("/healthz", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "fingerprint": Fingerprint()})
 	})
 }
 
 // ── Handlers ──────────────────────────────────────────────────────────────────
 
+// Failed logins allowed per client IP and window before /api/login refuses
+// that IP for the rest of the window.
+const (
+	maxLoginFailures   = 10
+	loginFailureWindow = 15 * time.Minute
+)
+
+// handleLogin exchanges a username and password for a JWT. Repeated failures
+// block the client IP for a while.
 func handleLogin(c *gin.Context) {
+	ip := c.ClientIP()
+	if _, blocked := shared.Get("login_block:" + ip); blocked {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, try again later"})
+		return
+	}
 	var body struct {
 		Username string `json:"username" binding:"required"`
 		Password string `json:"password" binding:"required"`
@@ -77,40 +286,141 @@ func handleLogin(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password required"})
 		return
 	}
-	if body.Username != adminUser || body.Password != adminPass {
+	role := models.RoleAdmin
+	ok := body.Username == adminUser && body.Password == adminPass
+	if a, found := accounts[body.Username]; found && !ok {
+		role, ok = a.role, body.Password == a.password
+	}
+	if !ok {
+		if shared.Incr("login_failures:"+ip, loginFailureWindow) >= maxLoginFailures {
+			shared.Set("login_block:"+ip, []byte("1"), loginFailureWindow)
+			log.Printf("[auth] %s blocked after %d failed logins", ip, maxLoginFailures)
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
-	token, err := GenerateJWT(body.Username)
+	token, err := GenerateJWT(body.Username, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_in": 86400, "type": "Bearer"})
+}
+
+// handleRefresh swaps a session token for a fresh one, so a client that
+// stays in use (opentalon ctl) does not have to store the password. The
+// role is looked up again, and a user removed since the login is refused.
+func handleRefresh(c *gin.Context) {
+	if _, ok := c.Get("api_token"); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API tokens do not need refreshing"})
+		return
+	}
+	claims := c.MustGet("claims").(*Claims)
+	role := models.RoleAdmin
+	if claims.Username != adminUser {
+		a, found := accounts[claims.Username]
+		if !found {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "user no longer exists"})
+			return
+		}
+		role = a.role
+	}
+	token, err := GenerateJWT(claims.Username, role)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
+	RevokeJWT(c.GetString("token"), claims)
 	c.JSON(http.StatusOK, gin.H{"token": token, "expires_in": 86400, "type": "Bearer"})
 }
 
+// handleLogout revokes the presented token until it expires.
+func handleLogout(c *gin.Context) {
+	if _, ok := c.Get("api_token"); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API tokens are revoked with DELETE /api/tokens/:id"})
+		return
+	}
+	RevokeJWT(c.GetString("token"), c.MustGet("claims").(*Claims))
+	c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+}
+
+// handleDeviceTree returns the topology tree; ?include=metrics,alerts embeds
+// each device's latest metrics and open alert count.
 func handleDeviceTree(c *gin.Context) {
 	tree, err := GetDeviceTree()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if groups := deviceGroups(c); groups != nil {
+		tree = filterTreeGroups(tree, groups)
+	}
+	if err := EmbedTreeExtras(tree, ParseTreeInclude(c.Query("include"))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": tree})
 }
 
+// handleDeviceDelete moves a device to the trash (soft delete): it leaves
+// the tree, the list and alerting but keeps its history, so it can be
+// restored (POST /api/devices/:id/restore) or purged for good.
 func handleDeviceDelete(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	if err := DB.Unscoped().Delete(&models.Device{}, id).Error; err != nil {
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if err := DB.Delete(&dev).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	forgetLatestMetrics(dev.ID)
+	latestLatency.Delete(dev.ID)
+	latestReportTiming.Delete(dev.ID)
+	RecordEvent(dev.ID, models.EventDeviceDeleted, deviceName(&dev)+" moved to the trash", nil)
 	c.JSON(http.StatusOK, gin.H{"deleted": id})
 }
 
+// purgeDevice deletes a device for good, together with everything stored
+// about it.
+func purgeDevice(id uint) error {
+	if err := DB.Unscoped().Delete(&models.Device{}, id).Error; err != nil {
+		return err
+	}
+	DB.Where("device_id = ?", id).Delete(&models.Container{})
+	DB.Where("device_id = ?", id).Delete(&models.Pod{})
+	DB.Where("device_id = ?", id).Delete(&models.ListeningPort{})
+	DB.Where("device_id = ?", id).Delete(&models.Interface{})
+	DB.Where("device_id = ?", id).Delete(&models.Neighbor{})
+	DB.Model(&models.Neighbor{}).Where("peer_device_id = ?", id).Update("peer_device_id", nil)
+	DB.Where("device_id = ?", id).Delete(&models.MetricsRollup{})
+	DB.Where("device_id = ?", id).Delete(&models.LatencySample{})
+	DB.Where("device_id = ?", id).Delete(&models.ReportTiming{})
+	DB.Where("device_id = ?", id).Delete(&models.DNSSample{})
+	DB.Where("device_id = ?", id).Delete(&models.Traceroute{})
+	DB.Where("device_id = ?", id).Delete(&models.SpeedTest{})
+	DB.Where("device_id = ?", id).Delete(&models.MetricBaseline{})
+	DB.Where("device_id = ?", id).Delete(&models.Subscription{})
+	DB.Where("device_id = ?", id).Delete(&models.ComplianceResult{})
+	DB.Where("device_id = ?", id).Delete(&models.DeviceTag{})
+	if _, err := metricsStore.DeleteBefore(id, time.Time{}); err != nil {
+		log.Printf("[metrics] delete samples of device %d: %v", id, err)
+	}
+	forgetLatestMetrics(id)
+	latestLatency.Delete(id)
+	latestReportTiming.Delete(id)
+	forgetBaselines(id)
+	return nil
+}
+
+// handleDeviceUpdate changes the group, remark, network mode, parent,
+// topology lock or bind_cidr of a device (only the provided fields).
 func handleDeviceUpdate(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
@@ -123,9 +433,18 @@ func handleDeviceUpdate(c *gin.Context) {
 		return
 	}
 	var body struct {
-		Group    *string `json:"group"`
-		Remark   *string `json:"remark"`
-		ParentID *uint   `json:"parent_id"` // 仅对 agent_ver=discovered 的设备生效
+		Group       *string             `json:"group"`
+		Remark      *string             `json:"remark"`
+		NetworkMode *models.NetworkMode `json:"network_mode"`
+		// ParentID moves the device (null: make it a root); only applied
+		// when present in the body.
+		ParentID json.RawMessage `json:"parent_id"`
+		// TopologyLocked pins the parent so that gateway auto-wiring and
+		// agent reports never override a manual assignment.
+		TopologyLocked *bool `json:"topology_locked"`
+		// BindCIDR: addresses / subnets the agent may report from besides
+		// the device's own (data_ip_binding), e.g. ["10.0.0.0/24"].
+		BindCIDR *[]string `json:"bind_cidr"`
 	}
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -138,12 +457,38 @@ func handleDeviceUpdate(c *gin.Context) {
 	if body.Remark != nil {
 		updates["remark"] = *body.Remark
 	}
-	// 仅扫描纳管（无 Agent）设备允许在详情页修改父节点；有 Agent 的设备由上报决定，不在此修改
-	if dev.AgentVer == "discovered" && body.ParentID != nil {
-		updates["parent_id"] = *body.ParentID
+	if body.NetworkMode != nil {
+		switch *body.NetworkMode {
+		case models.NetworkModeBridged, models.NetworkModeNAT, models.NetworkModeUnknown:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "network_mode must be Bridged, NAT or Unknown"})
+			return
+		}
+		updates["network_mode"] = *body.NetworkMode
+	}
+	if body.TopologyLocked != nil {
+		updates["topology_locked"] = *body.TopologyLocked
+	}
+	if body.BindCIDR != nil {
+		if _, err := parseNets(*body.BindCIDR); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bind_cidr: " + err.Error()})
+			return
+		}
+		updates["bind_cidr"] = strings.Join(*body.BindCIDR, ",")
+	}
+	setsParent := len(body.ParentID) > 0
+	var parentID *uint
+	if setsParent {
+		if err := json.Unmarshal(body.ParentID, &parentID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "parent_id: want a device id or null"})
+			return
+		}
+		if err := checkParent(dev.ID, parentID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
-	clearParent := dev.AgentVer == "discovered" && body.ParentID == nil
-	if len(updates) == 0 && !clearParent {
+	if len(updates) == 0 && !setsParent {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
 		return
 	}
@@ -153,43 +498,130 @@ func handleDeviceUpdate(c *gin.Context) {
 			return
 		}
 	}
-	// 清除父节点：GORM 的 Updates(map) 对 nil 可能不写 NULL，单独执行
-	if clearParent {
-		DB.Model(&dev).Update("parent_id", nil)
+	if setsParent {
+		setParent(&dev, parentID, "manual")
 	}
 	if err := DB.First(&dev, id).Error; err != nil {
 		c.JSON(http.StatusOK, gin.H{"updated": id})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
-		"id":       dev.ID,
-		"hostname": dev.Hostname,
-		"remark":   dev.Remark,
-		"group":    dev.Group,
+		"id":              dev.ID,
+		"hostname":        dev.Hostname,
+		"remark":          dev.Remark,
+		"group":           dev.Group,
+		"network_mode":    dev.NetworkMode,
+		"parent_id":       dev.ParentID,
+		"topology_locked": dev.TopologyLocked,
+		"bind_cidr":       dev.BindCIDR,
 	})
 }
 
+// handleSetParent moves a device in the tree, e.g. after drag-and-drop:
+// {"parent_id": 3} or null for a root. The parent is locked (topology_locked)
+// unless "lock": false, so later agent reports and gateway wiring keep it.
+func handleSetParent(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		ParentID *uint `json:"parent_id"`
+		Lock     *bool `json:"lock"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if err := checkParent(dev.ID, body.ParentID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	lock := body.Lock == nil || *body.Lock
+	topoMu.Lock()
+	defer topoMu.Unlock()
+	if err := DB.Model(&dev).Update("topology_locked", lock).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	setParent(&dev, body.ParentID, "manual")
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"id": dev.ID, "parent_id": dev.ParentID, "topology_locked": dev.TopologyLocked}})
+}
+
+// checkParent validates parentID as the new parent of device id: it must
+// exist and must not be the device itself or one of its descendants.
+func checkParent(id uint, parentID *uint) error {
+	if parentID == nil {
+		return nil
+	}
+	if *parentID == id {
+		return fmt.Errorf("a device cannot be its own parent")
+	}
+	var devices []models.Device
+	if err := DB.Select("id", "parent_id").Find(&devices).Error; err != nil {
+		return err
+	}
+	byID := make(map[uint]*models.Device, len(devices))
+	for i := range devices {
+		byID[devices[i].ID] = &devices[i]
+	}
+	if byID[*parentID] == nil {
+		return fmt.Errorf("parent device %d not found", *parentID)
+	}
+	if contains(ancestry(*parentID, byID), id) {
+		return fmt.Errorf("device %d is a descendant of device %d", *parentID, id)
+	}
+	return nil
+}
+
+// handleDeviceRegister registers the agent's host, or updates the device it
+// was registered as, and returns the device ID.
 func handleDeviceRegister(c *gin.Context) {
 	var payload RegisterPayload
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	known, err := findDevice(payload.MachineID, payload.IP, false)
+	if err == nil && known.IP != payload.IP && !machineIDAllowed(c, &known) {
+		payload.MachineID = ""
+		known, err = findDevice("", payload.IP, false)
+	}
+	if err == nil && !checkReportSource(c, &known) {
+		return
+	}
 	dev, err := UpsertDevice(payload)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if known.ID == 0 {
+		learnReportSource(c, dev)
+	}
 	c.JSON(http.StatusOK, gin.H{"id": dev.ID, "hostname": dev.Hostname})
 }
 
 // handleMetricsIngest accepts a metrics report and responds with scan_task when
-// this agent is the elected LAN scanner for its subnet.
+// this agent is the elected LAN scanner for its subnet. Fields it does not
+// know, or cannot decode, are kept as custom metrics (see decodeReport).
+//
+//openapi:body payload
 func handleMetricsIngest(c *gin.Context) {
 	var payload struct {
+		// SchemaVersion is the agent's models.MetricsSchemaVersion; 0 for
+		// agents that predate it.
+		SchemaVersion int `json:"schema_version"`
+
 		Hostname       string  `json:"hostname"`
 		IP             string  `json:"ip"`
 		GatewayIP      string  `json:"gateway_ip"`
+		GatewayIPv6    string  `json:"gateway_ipv6"`
 		CPUUsage       float64 `json:"cpu_usage"`
 		MemUsage       float64 `json:"mem_usage"`
 		MemTotal       uint64  `json:"mem_total"`
@@ -198,28 +630,97 @@ func handleMetricsIngest(c *gin.Context) {
 		TxBytes        int64   `json:"tx_bytes"`
 		TCPConnections int     `json:"tcp_connections"`
 		UDPConnections int     `json:"udp_connections"`
+		Uptime         uint64  `json:"uptime"`
+		BootTime       int64   `json:"boot_time"`
+
+		Temperatures []models.SensorReading `json:"temperatures"`
+		GPUs         []models.GPUReading    `json:"gpus"`
+		// Containers is nil when the host has no Docker engine.
+		Containers []ContainerReport `json:"containers"`
+		// Pods is nil when the host is not a Kubernetes node.
+		Pods []PodReport `json:"pods"`
+
+		Processes []models.ProcessSample `json:"processes"`
+		// Ports is nil for agents that predate the port inventory.
+		Ports []PortReport `json:"ports"`
+		// Interfaces is nil for agents that predate the interface inventory.
+		Interfaces []InterfaceReport `json:"interfaces"`
+		// Neighbors is nil unless the agent has agent_lldp on.
+		Neighbors []NeighborReport `json:"neighbors"`
+		// ARPTable is only sent when asked for (see arp_table below).
+		ARPTable []scanner.Neighbor `json:"arp_table"`
+		// Latency holds RTT / loss to the gateway, the server and an external target.
+		Latency []models.LatencySample `json:"latency"`
+		// PublicIP is only reported by root devices (see public_ip below).
+		PublicIP string `json:"public_ip"`
+		// ClockOffsetMs is the host clock's offset to the agent's NTP server.
+		ClockOffsetMs *float64 `json:"clock_offset_ms"`
+		// DNS holds the agent's lookups of agent_dns_names.
+		DNS []models.DNSSample `json:"dns"`
+		// Peers is null unless the agent has agent_peer_probes on.
+		Peers        []PeerProbe   `json:"peers"`
+		ServerOutage *ServerOutage `json:"server_outage"`
+		// ReportTiming is how long the agent's previous report took.
+		ReportTiming *models.ReportTiming `json:"report_timing"`
+		// IntervalSec is the agent's report interval; 0 for older agents.
+		IntervalSec int `json:"interval_sec"`
+		// PreviousIP is the address of the last report when it changed.
+		PreviousIP string `json:"previous_ip"`
+		// MachineID identifies the host across address changes (schema 4).
+		MachineID string `json:"machine_id"`
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if err := c.ShouldBindJSON(&payload); err != nil {
+	extra, err := decodeReport(body, &payload)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if payload.SchemaVersion == 0 {
+		payload.SchemaVersion = 1
+	}
 
-	var dev models.Device
-	if err := DB.Where("ip = ?", payload.IP).First(&dev).Error; err != nil {
+	// Spans per stage show which part of a report is slow; the queries
+	// inside are only traced on their own when they exceed the slow threshold.
+	ctx := c.Request.Context()
+	_, span := telemetry.Start(ctx, "ingest.device")
+	if payload.PreviousIP != "" && payload.PreviousIP != payload.IP && renumberAllowed(c, payload.PreviousIP) {
+		RenumberDevice(payload.PreviousIP, payload.IP)
+	}
+	dev, err := findDevice(payload.MachineID, payload.IP, false)
+	if err == nil && dev.IP != payload.IP {
+		if machineIDAllowed(c, &dev) {
+			changeDeviceIP(&dev, payload.IP)
+		} else {
+			payload.MachineID = ""
+			dev, err = findDevice("", payload.IP, false)
+		}
+	}
+	if err != nil {
 		reg := RegisterPayload{
 			Hostname:    payload.Hostname,
 			IP:          payload.IP,
 			GatewayIP:   payload.GatewayIP,
+			GatewayIPv6: payload.GatewayIPv6,
 			Group:       "auto",
 			NetworkMode: models.NetworkModeBridged,
 			AgentVer:    "unknown",
+			MachineID:   payload.MachineID,
 		}
 		d, err2 := UpsertDevice(reg)
 		if err2 != nil {
+			telemetry.End(span, err2)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "device lookup failed"})
 			return
 		}
+		learnReportSource(c, d)
 		dev = *d
+	} else if !checkReportSource(c, &dev) {
+		span.End()
+		return
 	} else if dev.AgentVer == "discovered" {
 		// 该设备原是扫描纳管，现由 Agent 上报 → 升级为 Agent 设备，覆盖 hostname/gateway，前端会显示 Agent 抽屉
 		DB.Model(&dev).Updates(map[string]any{
@@ -230,10 +731,21 @@ func handleMetricsIngest(c *gin.Context) {
 		dev.Hostname = payload.Hostname
 		dev.GatewayIP = payload.GatewayIP
 		dev.AgentVer = "unknown"
+	} else {
+		TrackReturn(&dev)
+	}
+	if payload.IntervalSec > 0 && payload.IntervalSec != dev.ReportInterval {
+		DB.Model(&dev).Update("report_interval", payload.IntervalSec)
+		dev.ReportInterval = payload.IntervalSec
 	}
 
-	MaybeWireParentByGateway(&dev, payload.GatewayIP)
+	MaybeWireParentByGateway(&dev, payload.GatewayIP, payload.GatewayIPv6)
+	TrackBootTime(&dev, payload.BootTime)
+	TrackPublicIP(&dev, payload.PublicIP)
+	TrackClockOffset(&dev, payload.ClockOffsetMs)
+	span.End()
 
+	_, span = telemetry.Start(ctx, "ingest.metrics")
 	m := &models.Metrics{
 		CPUUsage:       payload.CPUUsage,
 		MemUsage:       payload.MemUsage,
@@ -243,15 +755,79 @@ func handleMetricsIngest(c *gin.Context) {
 		TxBytes:        payload.TxBytes,
 		TCPConnections: payload.TCPConnections,
 		UDPConnections: payload.UDPConnections,
+		Uptime:         payload.Uptime,
+		BootTime:       payload.BootTime,
 		GatewayIP:      payload.GatewayIP,
 		LocalIP:        payload.IP,
 	}
 	if err := SaveMetrics(dev.ID, m); err != nil {
+		telemetry.End(span, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	exportInflux(&dev, m)
+	exportOTLP(&dev, m)
+	EvaluateAlerts(&dev, m)
+	span.End()
+
+	_, span = telemetry.Start(ctx, "ingest.details")
+	if err := SaveSensorReadings(dev.ID, payload.Temperatures); err != nil {
+		log.Printf("[metrics] save sensor readings for device %d: %v", dev.ID, err)
+	}
+	if err := SaveGPUReadings(dev.ID, payload.GPUs); err != nil {
+		log.Printf("[metrics] save gpu readings for device %d: %v", dev.ID, err)
+	}
+	if err := SaveProcessSamples(dev.ID, payload.Processes); err != nil {
+		log.Printf("[metrics] save processes for device %d: %v", dev.ID, err)
+	}
+	if err := SaveLatencySamples(dev.ID, payload.Latency); err != nil {
+		log.Printf("[metrics] save latency probes for device %d: %v", dev.ID, err)
+	}
+	if err := SaveDNSSamples(dev.ID, payload.DNS); err != nil {
+		log.Printf("[metrics] save dns checks for device %d: %v", dev.ID, err)
+	}
+	if err := SaveReportTiming(dev.ID, payload.ReportTiming); err != nil {
+		log.Printf("[metrics] save report timing for device %d: %v", dev.ID, err)
+	}
+	SavePeerProbes(dev.ID, payload.Peers)
+	TrackServerOutage(&dev, payload.ServerOutage)
+	if err := SaveCustomMetrics(dev.ID, payload.SchemaVersion, extra); err != nil {
+		log.Printf("[metrics] save custom metrics for device %d: %v", dev.ID, err)
+	}
+	span.End()
 
+	_, span = telemetry.Start(ctx, "ingest.inventory")
+	if payload.Ports != nil {
+		if err := SyncListeningPorts(dev.ID, payload.Ports); err != nil {
+			log.Printf("[metrics] sync ports for device %d: %v", dev.ID, err)
+		}
+	}
+	if payload.Interfaces != nil {
+		if err := SyncInterfaces(dev.ID, dev.IP, payload.Interfaces); err != nil {
+			log.Printf("[metrics] sync interfaces for device %d: %v", dev.ID, err)
+		}
+	}
+	if payload.Neighbors != nil {
+		if err := SyncNeighbors(dev.ID, payload.Neighbors); err != nil {
+			log.Printf("[metrics] sync lldp neighbors for device %d: %v", dev.ID, err)
+		}
+	}
+	if payload.Containers != nil {
+		if err := SyncContainers(dev.ID, payload.Containers); err != nil {
+			log.Printf("[metrics] sync containers for device %d: %v", dev.ID, err)
+		}
+	}
+	if payload.Pods != nil {
+		if err := SyncPods(dev.ID, payload.Pods); err != nil {
+			log.Printf("[metrics] sync pods for device %d: %v", dev.ID, err)
+		}
+	}
+	SaveARPTable(&dev, payload.ARPTable)
+	span.End()
+
+	_, span = telemetry.Start(ctx, "ingest.scanners")
 	ElectScanners()
+	span.End()
 
 	// 有扫描资格的设备，在一次“触发扫描”周期内只会拿到一次 scan_task=true：
 	// - /api/scan/trigger 会调用 SetScanActive 初始化一轮新的扫描任务（Running=true, TaskIssued=false）；
@@ -259,9 +835,39 @@ func handleMetricsIngest(c *gin.Context) {
 	//   并将 TaskIssued 置为 true，避免重复触发 runScan。
 	scanTask := ShouldAssignScanTask(payload.IP)
 
+	var peers []Peer
+	if payload.Peers != nil {
+		peers = AssignedPeers(&dev)
+	}
+
+	// On-demand jobs are listed as running tasks until the agent reports.
+	traceroute := TakeTracerouteRequest(dev.ID)
+	if traceroute {
+		startAgentTask(TaskTraceroute, "traceroute to server", &dev, 2*time.Minute)
+	}
+	speedTest := TakeSpeedTestRequest(dev.ID)
+	if speedTest != nil {
+		startAgentTask(TaskSpeedTest, "speed test ("+speedTest.Target+")", &dev,
+			time.Duration(2*speedTest.DurationSec)*time.Second+time.Minute)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"ok":        true,
-		"scan_task": scanTask,
+		"ok":         true,
+		"scan_task":  scanTask,
+		"checks":     AssignedChecks(dev.ID),
+		"traceroute": traceroute,
+		"speedtest":  speedTest,
+		"peers":      peers,
+		// cancel_tasks asks the agent to abort its running speed tests and
+		// traceroutes (a cancelled task or the emergency stop).
+		"cancel_tasks": TakeAgentCancel(dev.ID),
+		// Root devices are usually the site's gateway: they look up the WAN address.
+		"public_ip": dev.ParentID == nil,
+		// Gateway-class devices send their ARP / neighbor caches now and then.
+		"arp_table": WantARPTable(&dev),
+		// schema_version tells newer agents which fields this server reads
+		// natively; the rest end up in custom metrics.
+		"schema_version": models.MetricsSchemaVersion,
 	})
 }
 
@@ -371,18 +977,23 @@ func handleScanStatus(c *gin.Context) {
 }
 
 // handleDeviceMetrics returns the latest metrics for a device (control-plane).
+// "sensors" / "gpus" / "latency" carry the temperatures, GPU samples and
+// latency probes from the most recent report.
 func handleDeviceMetrics(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
+	sensors := GetLatestSensorReadings(uint(id))
+	gpus := GetLatestGPUReadings(uint(id))
+	latency := GetLatestLatency(uint(id))
 	m, err := GetLatestMetrics(uint(id))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"data": nil})
+		c.JSON(http.StatusOK, gin.H{"data": nil, "sensors": sensors, "gpus": gpus, "latency": latency})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"data": m})
+	c.JSON(http.StatusOK, gin.H{"data": m, "sensors": sensors, "gpus": gpus, "latency": latency})
 }
 
 // handleDeviceProbe runs a lightweight TCP port probe (22 / 3389) against the
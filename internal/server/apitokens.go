@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// apiTokenPrefix starts every personal API token, telling them apart from
+// JWTs in the Authorization header.
+const apiTokenPrefix = "otk_"
+
+// API token lifetimes: the default when the request names none, and the
+// longest allowed.
+const (
+	apiTokenDefaultTTL = 90 * 24 * time.Hour
+	apiTokenMaxTTL     = 365 * 24 * time.Hour
+)
+
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenOwner   = errors.New("token owner no longer exists")
+)
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// userRole returns the role of a login, false when it is not configured.
+func userRole(username string) (string, bool) {
+	if username == adminUser {
+		return models.RoleAdmin, true
+	}
+	a, ok := accounts[username]
+	return a.role, ok
+}
+
+// parseAPIToken validates a personal API token and returns claims for its
+// owner with the owner's current role.
+func parseAPIToken(token string) (*Claims, *models.APIToken, error) {
+	var t models.APIToken
+	if err := DB.Where("hash = ?", hashAPIToken(token)).Take(&t).Error; err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	switch {
+	case t.RevokedAt != nil:
+		return nil, nil, errTokenRevoked
+	case now.After(t.ExpiresAt):
+		return nil, nil, errTokenExpired
+	}
+	role, ok := userRole(t.Username)
+	if !ok {
+		return nil, nil, errTokenOwner
+	}
+	// Record use at most once a minute.
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > time.Minute {
+		DB.Model(&t).UpdateColumn("last_used_at", now)
+	}
+	claims := &Claims{
+		Username:         t.Username,
+		Role:             role,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: t.Username, ExpiresAt: jwt.NewNumericDate(t.ExpiresAt)},
+	}
+	return claims, &t, nil
+}
+
+// apiTokenAllows reports whether t's scopes cover a request. API tokens
+// cannot manage API tokens, so a leaked one cannot mint more. GraphQL
+// queries only read, so a read scope covers POST /api/graphql too.
+func apiTokenAllows(t *models.APIToken, method, path string) bool {
+	if strings.HasPrefix(path, "/api/tokens") {
+		return false
+	}
+	if path == "/api/graphql" {
+		method = http.MethodGet
+	}
+	scopes := map[string]bool{}
+	for _, s := range strings.Split(t.Scopes, ",") {
+		scopes[strings.TrimSpace(s)] = true
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return scopes[models.ScopeRead] || scopes[models.ScopeWrite]
+	}
+	return scopes[models.ScopeWrite]
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListAPITokens lists the caller's API tokens, revoked ones included;
+// ?all=true lists everyone's for the admin.
+func handleListAPITokens(c *gin.Context) {
+	q := DB.Order("id desc")
+	if c.Query("all") != "true" || c.GetString("role") != models.RoleAdmin {
+		q = q.Where("username = ?", c.GetString("username"))
+	}
+	var list []models.APIToken
+	if err := q.Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// handleCreateAPIToken creates a token for the caller. The token itself is
+// only in this response.
+func handleCreateAPIToken(c *gin.Context) {
+	var body struct {
+		Name      string   `json:"name" binding:"required"`
+		Scopes    []string `json:"scopes"`
+		ExpiresAt string   `json:"expires_at"` // RFC 3339 or unix seconds
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	t := models.APIToken{Username: c.GetString("username"), Name: strings.TrimSpace(body.Name), ExpiresAt: now.Add(apiTokenDefaultTTL)}
+	if len(body.Scopes) == 0 {
+		body.Scopes = []string{models.ScopeRead}
+	}
+	for _, s := range body.Scopes {
+		if s != models.ScopeRead && s != models.ScopeWrite {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown scope %q (use read or write)", s)})
+			return
+		}
+	}
+	t.Scopes = strings.Join(body.Scopes, ",")
+	if body.ExpiresAt != "" {
+		ts, err := parseTimeParam(body.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at: " + err.Error()})
+			return
+		}
+		if !ts.After(now) || ts.Sub(now) > apiTokenMaxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the next 365 days"})
+			return
+		}
+		t.ExpiresAt = ts
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token := apiTokenPrefix + hex.EncodeToString(buf)
+	t.Hash, t.Prefix = hashAPIToken(token), token[:len(apiTokenPrefix)+8]
+	if err := DB.Create(&t).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	RecordEvent(0, models.EventAPITokenCreated,
+		fmt.Sprintf("%s created API token %q (%s, %s…)", t.Username, t.Name, t.Scopes, t.Prefix),
+		map[string]any{"token_id": t.ID, "username": t.Username, "scopes": t.Scopes, "expires_at": t.ExpiresAt, "ip": c.ClientIP()})
+	c.JSON(http.StatusOK, gin.H{"data": t, "token": token})
+}
+
+// handleRevokeAPIToken revokes one of the caller's tokens (the admin may
+// revoke anyone's). The row is kept for the record.
+func handleRevokeAPIToken(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var t models.APIToken
+	if err := DB.First(&t, id).Error; err != nil ||
+		(t.Username != c.GetString("username") && c.GetString("role") != models.RoleAdmin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+	if t.RevokedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "token already revoked"})
+		return
+	}
+	now := time.Now()
+	if err := DB.Model(&t).Update("revoked_at", now).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	by := c.GetString("username")
+	RecordEvent(0, models.EventAPITokenRevoked,
+		fmt.Sprintf("%s revoked API token %q of %s (%s…)", by, t.Name, t.Username, t.Prefix),
+		map[string]any{"token_id": t.ID, "username": t.Username, "by": by, "ip": c.ClientIP()})
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
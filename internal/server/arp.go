@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/scanner"
+	"gorm.io/gorm"
+)
+
+// arpInterval is how often a gateway-class agent is asked for its ARP /
+// neighbor caches.
+const arpInterval = 5 * time.Minute
+
+var arpAsked sync.Map // device ID → time.Time of the last request
+
+// WantARPTable reports whether dev's agent should send its ARP / neighbor
+// caches with the next report: gateway-class devices (roots of the tree,
+// usually the site's router, and devices others hang under) are asked
+// every arpInterval while discovery is enabled.
+func WantARPTable(dev *models.Device) bool {
+	if !discoveryEnabled {
+		return false
+	}
+	if v, ok := arpAsked.Load(dev.ID); ok && time.Since(v.(time.Time)) < arpInterval {
+		return false
+	}
+	if dev.ParentID != nil {
+		var children int64
+		DB.Model(&models.Device{}).Where("parent_id = ?", dev.ID).Limit(1).Count(&children)
+		if children == 0 {
+			return false
+		}
+	}
+	arpAsked.Store(dev.ID, time.Now())
+	return true
+}
+
+// SaveARPTable lists the hosts in a gateway's ARP / neighbor caches that are
+// not managed devices as discovered, source "arp", so they can be adopted
+// like scan results. Unlike scans this writes no names: entries already
+// discovered keep theirs and only get their MAC and last_seen refreshed.
+func SaveARPTable(dev *models.Device, entries []scanner.Neighbor) {
+	if len(entries) == 0 {
+		return
+	}
+	var managedIPs []string
+	DB.Model(&models.Device{}).Pluck("ip", &managedIPs)
+	managed := make(map[string]struct{}, len(managedIPs))
+	for _, ip := range managedIPs {
+		managed[ip] = struct{}{}
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if _, ok := managed[e.IP]; ok || e.MAC == "" || !lanAddress(e.IP) {
+			continue
+		}
+		var d models.DiscoveredDevice
+		err := DB.Where("ip = ?", e.IP).First(&d).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+			DB.Create(&models.DiscoveredDevice{
+				IP: e.IP, MAC: e.MAC, Hostname: e.Vendor, Vendor: e.Vendor,
+				ScannerIP: dev.IP, Source: "arp", FirstSeen: now, LastSeen: now,
+			})
+		case err == nil:
+			updates := map[string]any{"mac": e.MAC, "last_seen": now}
+			if d.Vendor == "" && e.Vendor != "" {
+				updates["vendor"] = e.Vendor
+			}
+			DB.Model(&d).Updates(updates)
+		}
+	}
+}
+
+// lanAddress reports whether s can be a host on the site's LAN: a private
+// IPv4 address (a router's WAN-side neighbor is the ISP's) or a global or
+// ULA IPv6 address.
+func lanAddress(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	if ip.To4() != nil {
+		return ip.IsPrivate()
+	}
+	return ip.IsGlobalUnicast()
+}
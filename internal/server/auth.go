@@ -3,12 +3,16 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/vesaa/opentalon/internal/models"
 )
 
 // ─── JWT control-plane auth ───────────────────────────────────────────────────
@@ -24,13 +28,25 @@ func SetJWTSecret(secret string) {
 // Claims is the payload embedded in every JWT issued by /api/login.
 type Claims struct {
 	Username string `json:"username"`
+	// Role selects the policies that apply (see PolicyMiddleware).
+	Role string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// role returns the token's role. Tokens issued before roles existed have
+// none; only the admin could log in then.
+func (c *Claims) role() string {
+	if c.Role == "" {
+		return models.RoleAdmin
+	}
+	return c.Role
+}
+
 // GenerateJWT creates a signed HS256 JWT valid for 24 hours.
-func GenerateJWT(username string) (string, error) {
+func GenerateJWT(username, role string) (string, error) {
 	claims := Claims{
 		Username: username,
+		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    "opentalon",
 			Subject:   username,
@@ -42,6 +58,27 @@ func GenerateJWT(username string) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+// errTokenRevoked is returned for tokens ended by POST /api/logout.
+var errTokenRevoked = errors.New("token revoked")
+
+// revokedKey is the shared-store key marking a token as logged out.
+func revokedKey(tokenStr string) string {
+	sum := sha256.Sum256([]byte(tokenStr))
+	return "revoked:" + hex.EncodeToString(sum[:])
+}
+
+// RevokeJWT ends a session before its token expires, on every instance
+// sharing the store.
+func RevokeJWT(tokenStr string, claims *Claims) {
+	ttl := time.Hour
+	if claims.ExpiresAt != nil {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+	if ttl > 0 {
+		shared.Set(revokedKey(tokenStr), []byte("1"), ttl)
+	}
+}
+
 // parseJWT validates a token string and returns the claims.
 func parseJWT(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
@@ -54,12 +91,17 @@ func parseJWT(tokenStr string) (*Claims, error) {
 	if err != nil || !token.Valid {
 		return nil, err
 	}
+	if _, revoked := shared.Get(revokedKey(tokenStr)); revoked {
+		return nil, errTokenRevoked
+	}
 	return claims, nil
 }
 
 // JWTMiddleware is a Gin middleware that validates JWT tokens on the control plane.
 // It expects the header:  Authorization: Bearer <jwt>
-// On success it stores the username in the Gin context as "username".
+// On success it stores the username in the Gin context as "username", the
+// role as "role" and the token as "token". Personal API tokens (otk_…) are
+// accepted too, within their scopes; they are stored as "api_token".
 func JWTMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		raw := c.GetHeader("Authorization")
@@ -78,6 +120,28 @@ func JWTMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(parts[1], apiTokenPrefix) {
+			claims, t, err := parseAPIToken(parts[1])
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": "invalid, expired or revoked API token",
+				})
+				return
+			}
+			if !apiTokenAllows(t, c.Request.Method, c.Request.URL.Path) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"error": "outside the API token's scopes",
+				})
+				return
+			}
+			c.Set("username", claims.Username)
+			c.Set("role", claims.role())
+			c.Set("claims", claims)
+			c.Set("api_token", t)
+			c.Next()
+			return
+		}
+
 		claims, err := parseJWT(parts[1])
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
@@ -87,6 +151,9 @@ func JWTMiddleware() gin.HandlerFunc {
 		}
 
 		c.Set("username", claims.Username)
+		c.Set("role", claims.role())
+		c.Set("token", parts[1])
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
@@ -0,0 +1,537 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/config"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// backupFormat is the layout of backup archives; Restore refuses archives
+// of a later format.
+const backupFormat = 1
+
+// Members of a backup archive.
+const (
+	backupManifestName = "manifest.json"
+	backupDBName       = "opentalon.db"
+)
+
+// BackupManifest is manifest.json of a backup archive.
+type BackupManifest struct {
+	Format    int       `json:"format"`
+	Version   string    `json:"version"` // of the OpenTalon that wrote it
+	CreatedAt time.Time `json:"created_at"`
+	Hostname  string    `json:"hostname"`
+	// Driver is the database the backup was taken from; the archive always
+	// holds a SQLite file.
+	Driver string           `json:"driver"`
+	Tables map[string]int64 `json:"tables"` // rows per table
+	Size   int64            `json:"size"`
+	SHA256 string           `json:"sha256"` // of opentalon.db
+}
+
+// Backup writes a backup of the database to out: a tar.gz with
+// manifest.json and the database as a SQLite file. On sqlite it is taken
+// with VACUUM INTO, a consistent snapshot inside one read transaction, so
+// the server keeps running; on mysql every table is copied into the SQLite
+// file as `migrate-db` does. Raw metrics in ClickHouse are not included.
+func Backup(cfg *config.Config, out, version string) (*BackupManifest, error) {
+	tmp, err := os.MkdirTemp(filepath.Dir(out), ".opentalon-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	snap := filepath.Join(tmp, backupDBName)
+
+	driver := cfg.DBDriver
+	if driver == "" {
+		driver = "sqlite"
+	}
+	if driver == "sqlite" {
+		path, err := SQLitePath(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		src, err := OpenMigrationSource(path)
+		if err != nil {
+			return nil, err
+		}
+		err = src.Exec("VACUUM INTO ?", snap).Error
+		closeDB(src)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of %s: %w", path, err)
+		}
+	} else {
+		if err := backupCopy(cfg, snap); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &BackupManifest{Format: backupFormat, Version: version, CreatedAt: time.Now().UTC(), Driver: driver}
+	m.Hostname, _ = os.Hostname()
+	if m.Tables, err = checkBackupDB(snap); err != nil {
+		return nil, err
+	}
+	if m.Size, m.SHA256, err = fileSHA256(snap); err != nil {
+		return nil, err
+	}
+	if err := writeBackupArchive(out, m, snap); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// backupCopy copies the configured (non-SQLite) database into a new SQLite
+// file at dst. The copy reads in one REPEATABLE READ transaction, so every
+// table comes from the same snapshot while the server keeps writing, as
+// with mysqldump --single-transaction.
+func backupCopy(cfg *config.Config, dst string) error {
+	d, err := openDialector(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		return err
+	}
+	src, err := gorm.Open(d, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer closeDB(src)
+	target, err := OpenMigrationTarget("sqlite://" + dst)
+	if err != nil {
+		return err
+	}
+	defer closeDB(target)
+	return src.Transaction(func(tx *gorm.DB) error {
+		report, err := MigrateDatabase(tx, target, nil)
+		if err != nil {
+			return err
+		}
+		for _, t := range report {
+			if !t.Verified {
+				return fmt.Errorf("%s: copied %d of %d rows", t.Table, t.Target, t.Source)
+			}
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+}
+
+// checkBackupDB runs an integrity check on the SQLite file at path and
+// returns the rows per table.
+func checkBackupDB(path string) (map[string]int64, error) {
+	db, err := OpenMigrationSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB(db)
+	var check string
+	if err := db.Raw("PRAGMA integrity_check").Scan(&check).Error; err != nil {
+		return nil, err
+	}
+	if check != "ok" {
+		return nil, fmt.Errorf("integrity check of the backup failed: %s", check)
+	}
+	tables := map[string]int64{}
+	for _, model := range allModels {
+		table, err := tableName(db, model)
+		if err != nil {
+			return nil, err
+		}
+		if !db.Migrator().HasTable(table) {
+			continue
+		}
+		var n int64
+		if err := db.Table(table).Count(&n).Error; err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		tables[table] = n
+	}
+	return tables, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func fileSHA256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// writeBackupArchive writes manifest and the database file to out through
+// a temporary file, so out is either complete or untouched.
+func writeBackupArchive(out string, m *BackupManifest, dbPath string) error {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	db, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(out), ".opentalon-backup-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0o600, Size: int64(len(manifest)), ModTime: m.CreatedAt})
+	if err == nil {
+		_, err = tw.Write(manifest)
+	}
+	if err == nil {
+		err = tw.WriteHeader(&tar.Header{Name: backupDBName, Mode: 0o600, Size: m.Size, ModTime: m.CreatedAt})
+	}
+	if err == nil {
+		_, err = io.Copy(tw, db)
+	}
+	for _, c := range []io.Closer{tw, gz, f} {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), out)
+}
+
+// RestoreResult describes a finished Restore.
+type RestoreResult struct {
+	Manifest *BackupManifest
+	// Previous is where the replaced SQLite database was moved to, "" when
+	// there was none or the database is mysql.
+	Previous string
+}
+
+// Restore replaces the database with the backup archive at path. The
+// server must be stopped. The archive is checked first: its format, its
+// checksum and integrity, and that it was not written by a later OpenTalon
+// than version, whose schema this one may not know. When either version is
+// not a release (e.g. "dev") they cannot be compared and force is required;
+// force also skips the check itself. A SQLite database is kept next to the
+// restored one as <db>.before-restore-<time>; on mysql every table is
+// emptied and refilled in one transaction.
+// The schema is brought up to date when the server starts.
+func Restore(cfg *config.Config, path, version string, force bool) (*RestoreResult, error) {
+	if addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.ControlPort)); serverAnswers(addr) {
+		return nil, fmt.Errorf("a server is running on %s; stop it before restoring", addr)
+	}
+	driver := cfg.DBDriver
+	if driver == "" {
+		driver = "sqlite"
+	}
+	var dst string
+	dir := os.TempDir()
+	if driver == "sqlite" {
+		var err error
+		if dst, err = SQLitePath(cfg); err != nil {
+			return nil, err
+		}
+		dir = filepath.Dir(dst)
+	}
+
+	tmp, err := os.MkdirTemp(dir, ".opentalon-restore-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	snap := filepath.Join(tmp, backupDBName)
+	m, err := readBackupArchive(path, snap)
+	if err != nil {
+		return nil, err
+	}
+	if m.Format > backupFormat {
+		return nil, fmt.Errorf("%s has backup format %d, this OpenTalon reads up to %d; restore it with OpenTalon %s or later", path, m.Format, backupFormat, m.Version)
+	}
+	if err := checkBackupVersion(m.Version, version, force); err != nil {
+		return nil, fmt.Errorf("%s %w", path, err)
+	}
+	size, sum, err := fileSHA256(snap)
+	if err != nil {
+		return nil, err
+	}
+	if size != m.Size || sum != m.SHA256 {
+		return nil, fmt.Errorf("%s is corrupt: the database does not match its checksum", path)
+	}
+	if _, err := checkBackupDB(snap); err != nil {
+		return nil, err
+	}
+
+	res := &RestoreResult{Manifest: m}
+	if driver != "sqlite" {
+		return res, restoreCopy(cfg, snap)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		stamp := time.Now().Format("20060102-150405")
+		res.Previous = dst + ".before-restore-" + stamp
+		for i := 2; fileExists(res.Previous); i++ {
+			res.Previous = fmt.Sprintf("%s.before-restore-%s-%d", dst, stamp, i)
+		}
+		// The -wal and -shm files belong to the replaced database; left in
+		// place they would be applied to the restored one.
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Rename(dst+suffix, res.Previous+suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	if err := os.Rename(snap, dst); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readBackupArchive extracts the database of the archive at path to dbPath
+// and returns its manifest.
+func readBackupArchive(path, dbPath string) (*BackupManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a backup archive: %w", path, err)
+	}
+	tr := tar.NewReader(gz)
+	var m *BackupManifest
+	var haveDB bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		switch hdr.Name {
+		case backupManifestName:
+			m = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("%s: manifest: %w", path, err)
+			}
+		case backupDBName:
+			out, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, fmt.Errorf("extracting %s: %w", backupDBName, err)
+			}
+			haveDB = true
+		}
+	}
+	if m == nil || !haveDB {
+		return nil, fmt.Errorf("%s is not an OpenTalon backup: %s or %s is missing", path, backupManifestName, backupDBName)
+	}
+	return m, nil
+}
+
+// checkBackupVersion refuses, unless force, a backup written by OpenTalon
+// version backup when this is version running, and it is later or the two
+// cannot be compared.
+func checkBackupVersion(backup, running string, force bool) error {
+	if force {
+		return nil
+	}
+	newer, ok := versionNewer(backup, running)
+	switch {
+	case !ok:
+		return fmt.Errorf("was written by OpenTalon %s and this is %s; without release versions to compare, its schema may not fit (pass --force to restore anyway)", backup, running)
+	case newer:
+		return fmt.Errorf("was written by OpenTalon %s, newer than this %s; its schema may not fit, so upgrade first (or pass --force)", backup, running)
+	}
+	return nil
+}
+
+// restoreCopy empties the tables of the configured (non-SQLite) database
+// and copies the backup at src into them.
+func restoreCopy(cfg *config.Config, src string) error {
+	d, err := openDialector(cfg.DBDriver, cfg.DBDSN)
+	if err != nil {
+		return err
+	}
+	dst, err := gorm.Open(d, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer closeDB(dst)
+	if err := dst.AutoMigrate(allModels...); err != nil {
+		return fmt.Errorf("auto-migrate: %w", err)
+	}
+	source, err := OpenMigrationSource(src)
+	if err != nil {
+		return err
+	}
+	defer closeDB(source)
+	return restoreInto(dst, source)
+}
+
+// restoreInto replaces the rows of dst with those of source in one
+// transaction, so a failed restore leaves dst as it was.
+func restoreInto(dst, source *gorm.DB) error {
+	return dst.Transaction(func(tx *gorm.DB) error {
+		// Referencing tables come later in allModels, so empty them first.
+		for _, model := range slices.Backward(allModels) {
+			table, err := tableName(tx, model)
+			if err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM ?", clause.Table{Name: table}).Error; err != nil {
+				return fmt.Errorf("emptying %s: %w", table, err)
+			}
+		}
+		report, err := MigrateDatabase(source, tx, nil)
+		if err != nil {
+			return err
+		}
+		for _, t := range report {
+			if !t.Verified {
+				return fmt.Errorf("%s: restored %d of %d rows", t.Table, t.Target, t.Source)
+			}
+		}
+		return nil
+	})
+}
+
+// serverAnswers reports whether an OpenTalon control plane answers at addr.
+func serverAnswers(addr string) bool {
+	_, ok := doctorHealth(addr, "/api/health")
+	return ok
+}
+
+// versionNewer reports whether release version a (e.g. "v0.2.0") is later
+// than b; ok is false when either is not a release version, such as "dev".
+func versionNewer(a, b string) (newer, ok bool) {
+	pa, oka := parseVersion(a)
+	pb, okb := parseVersion(b)
+	if !oka || !okb {
+		return false, false
+	}
+	return slices.Compare(pa, pb) > 0, true
+}
+
+// parseVersion parses "v1.2.3" (the "v" optional, pre-release suffix
+// ignored) into its numbers.
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	out := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// backupFilePrefix starts the names of scheduled backups, which sort by time.
+const backupFilePrefix = "opentalon-"
+
+// BackupFileName is the name of a backup taken at t, as scheduled backups
+// and `server backup` without --out use.
+func BackupFileName(t time.Time) string {
+	return backupFilePrefix + t.Format("20060102-150405") + ".tar.gz"
+}
+
+// backupCheckInterval is how often RunBackups looks whether a backup is due.
+const backupCheckInterval = 10 * time.Minute
+
+// RunBackups writes a backup to dir whenever the newest one there is
+// interval old, and keeps the newest keep backups (0: all). Only one
+// instance backs up. It never returns.
+func RunBackups(cfg *config.Config, dir string, interval time.Duration, keep int, version string) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("[backup] %v", err)
+	}
+	for {
+		if leads("backup", 2*backupCheckInterval) {
+			backups := listBackups(dir)
+			due := len(backups) == 0
+			if !due {
+				if fi, err := os.Stat(filepath.Join(dir, backups[len(backups)-1])); err != nil || time.Since(fi.ModTime()) >= interval {
+					due = true
+				}
+			}
+			if due {
+				out := filepath.Join(dir, BackupFileName(time.Now()))
+				if m, err := Backup(cfg, out, version); err != nil {
+					log.Printf("[backup] %v", err)
+				} else {
+					log.Printf("[backup] wrote %s (%d bytes)", out, m.Size)
+					backups = append(backups, filepath.Base(out))
+				}
+				if keep > 0 && len(backups) > keep {
+					for _, name := range backups[:len(backups)-keep] {
+						if err := os.Remove(filepath.Join(dir, name)); err != nil {
+							log.Printf("[backup] pruning: %v", err)
+						}
+					}
+				}
+			}
+		}
+		time.Sleep(backupCheckInterval)
+	}
+}
+
+// listBackups returns the names of the scheduled backups in dir, oldest
+// first.
+func listBackups(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, ".tar.gz") {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vesaa/opentalon/internal/config"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+		ok   bool
+	}{
+		{"v1.2.3", []int{1, 2, 3}, true},
+		{"0.10.0", []int{0, 10, 0}, true},
+		{"v1.2.3-rc.1", []int{1, 2, 3}, true},
+		{"dev", nil, false},
+		{"", nil, false},
+		{"v1.2", nil, false},
+		{"v1.x.3", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersion(tt.in)
+		if ok != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckBackupVersion(t *testing.T) {
+	tests := []struct {
+		backup, running string
+		force           bool
+		wantErr         string
+	}{
+		{"v1.2.0", "v1.2.0", false, ""},
+		{"v1.1.9", "v1.2.0", false, ""},
+		{"v1.3.0", "v1.2.0", false, "newer"},
+		{"v1.3.0", "v1.2.0", true, ""},
+		{"dev", "v1.2.0", false, "--force"},
+		{"v1.2.0", "dev", false, "--force"},
+		{"dev", "dev", false, "--force"},
+		{"dev", "dev", true, ""},
+	}
+	for _, tt := range tests {
+		err := checkBackupVersion(tt.backup, tt.running, tt.force)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("checkBackupVersion(%q, %q, %v) = %v", tt.backup, tt.running, tt.force, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("checkBackupVersion(%q, %q, %v) = %v, want %q", tt.backup, tt.running, tt.force, err, tt.wantErr)
+		}
+	}
+}
+
+// freePort returns a local port nothing listens on, so Restore does not
+// take the test for a running server.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func hostnames(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var names []string
+	if err := db.Model(&models.Device{}).Order("id").Pluck("hostname", &names).Error; err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestBackupRestoreSQLite(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{DBPath: filepath.Join(dir, "opentalon.db"), ControlPort: freePort(t)}
+	db := openSQLite(t, cfg.DBPath)
+	if err := db.Create(&models.Device{Hostname: "kept", IP: "10.0.0.1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "backup.tar.gz")
+	m, err := Backup(cfg, archive, "v1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Tables["devices"] != 1 || m.Driver != "sqlite" {
+		t.Fatalf("manifest = %+v", m)
+	}
+	if err := db.Create(&models.Device{Hostname: "after-backup", IP: "10.0.0.2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	closeDB(db)
+
+	if _, err := Restore(cfg, archive, "v1.1.0", false); err == nil {
+		t.Fatal("restored a backup of a newer version without --force")
+	}
+	if _, err := Restore(cfg, archive, "dev", false); err == nil {
+		t.Fatal("restored into a dev build without --force")
+	}
+	res, err := Restore(cfg, archive, "v1.2.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hostnames(t, openSQLite(t, cfg.DBPath)); !slices.Equal(got, []string{"kept"}) {
+		t.Errorf("restored devices = %q, want [kept]", got)
+	}
+	if got := hostnames(t, openSQLite(t, res.Previous)); !slices.Equal(got, []string{"kept", "after-backup"}) {
+		t.Errorf("previous devices = %q, want [kept after-backup]", got)
+	}
+}
+
+func TestRestoreCorruptArchive(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{DBPath: filepath.Join(dir, "opentalon.db"), ControlPort: freePort(t)}
+	closeDB(openSQLite(t, cfg.DBPath))
+	archive := filepath.Join(dir, "garbage.tar.gz")
+	if err := os.WriteFile(archive, []byte("not a backup"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(cfg, archive, "v1.2.0", true); err == nil {
+		t.Fatal("restored a garbage archive")
+	}
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		t.Fatalf("database was moved away: %v", err)
+	}
+}
+
+func TestRestoreIntoRollsBack(t *testing.T) {
+	dir := t.TempDir()
+	dst := openSQLite(t, filepath.Join(dir, "dst.db"))
+	if err := dst.Create(&models.Device{Hostname: "existing", IP: "10.0.0.1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A column dst does not know makes copying devices fail after every
+	// table has been emptied.
+	source := openSQLite(t, filepath.Join(dir, "src.db"))
+	if err := source.Exec("ALTER TABLE devices ADD COLUMN unknown TEXT").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Create(&models.Device{Hostname: "restored", IP: "10.0.0.2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreInto(dst, source); err == nil {
+		t.Fatal("restoreInto succeeded")
+	}
+	if got := hostnames(t, dst); !slices.Equal(got, []string{"existing"}) {
+		t.Errorf("devices after a failed restore = %q, want [existing]", got)
+	}
+
+	if err := source.Exec("ALTER TABLE devices DROP COLUMN unknown").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreInto(dst, source); err != nil {
+		t.Fatal(err)
+	}
+	if got := hostnames(t, dst); !slices.Equal(got, []string{"restored"}) {
+		t.Errorf("devices after restore = %q, want [restored]", got)
+	}
+}
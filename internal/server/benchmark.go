@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// benchmarkScript is the benchmark playbook, run by sh on the device with
+// URL (the data plane as the device reaches it) and TOKEN set. It prints
+// key=value lines: elapsed milliseconds of each step, and bytes and seconds
+// of the transfers.
+const benchmarkScript = `
+ms() { t=$(date +%s%N 2>/dev/null); case "$t" in *N|"") echo $(( $(date +%s) * 1000 ));; *) echo $(( t / 1000000 ));; esac; }
+hash() { dd if=/dev/zero bs=1048576 count=256 2>/dev/null | (sha256sum 2>/dev/null || shasum -a 256) >/dev/null; }
+cores=$(nproc 2>/dev/null || getconf _NPROCESSORS_ONLN 2>/dev/null || echo 1)
+echo cores=$cores
+t0=$(ms); hash; echo cpu_single_ms=$(( $(ms) - t0 ))
+t0=$(ms); i=0; while [ $i -lt $cores ]; do hash & i=$((i + 1)); done; wait; echo cpu_multi_ms=$(( $(ms) - t0 ))
+f=$(mktemp /var/tmp/opentalon-bench.XXXXXX 2>/dev/null || mktemp)
+t0=$(ms); dd if=/dev/zero of="$f" bs=1048576 count=256 conv=fsync 2>/dev/null && echo disk_write_ms=$(( $(ms) - t0 )); rm -f "$f"
+if command -v curl >/dev/null 2>&1; then
+  echo net_down=$(curl -sf -m 60 -o /dev/null -H "Authorization: Bearer $TOKEN" -w '%{size_download} %{time_total}' "$URL/api/speedtest/download?bytes=268435456")
+  echo net_up=$(head -c 134217728 /dev/zero | curl -sf -m 60 -o /dev/null -H "Authorization: Bearer $TOKEN" -H 'Content-Type: application/octet-stream' --data-binary @- -w '%{size_upload} %{time_total}' "$URL/api/speedtest/upload")
+else
+  echo net=no curl
+fi
+`
+
+// benchmarkHashMiB / benchmarkDiskMiB are what the script hashes per core
+// and writes.
+const (
+	benchmarkHashMiB = 256
+	benchmarkDiskMiB = 256
+)
+
+// runBenchmarkScript runs the benchmark playbook. The network step talks to
+// the address this server has on the route to the device.
+func runBenchmarkScript(s *SSHClient, _ map[string]string) (string, error) {
+	local, _, _ := net.SplitHostPort(s.client.LocalAddr().String())
+	url := "http://" + net.JoinHostPort(local, strconv.Itoa(dataPort))
+	return s.RunWithInput(fmt.Sprintf("URL=%s TOKEN=%s sh -s", shellQuote(url), shellQuote(agentToken)), strings.NewReader(benchmarkScript))
+}
+
+// parseBenchmark turns the script's output into a result.
+func parseBenchmark(out string, at time.Time) *models.Benchmark {
+	b := &models.Benchmark{RanAt: at}
+	var problems []string
+	rate := func(mib float64, v string) float64 {
+		ms, err := strconv.ParseFloat(v, 64)
+		if err != nil || ms <= 0 {
+			return 0
+		}
+		return mib / (ms / 1000)
+	}
+	transfer := func(step, v string) float64 {
+		f := strings.Fields(v)
+		if len(f) != 2 {
+			problems = append(problems, step+" failed")
+			return 0
+		}
+		bytes, _ := strconv.ParseFloat(f[0], 64)
+		sec, _ := strconv.ParseFloat(f[1], 64)
+		if bytes <= 0 || sec <= 0 {
+			problems = append(problems, step+" failed")
+			return 0
+		}
+		return bytes * 8 / 1e6 / sec
+	}
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "cores":
+			b.Cores, _ = strconv.Atoi(v)
+		case "cpu_single_ms":
+			b.CPUSingleMBps = rate(benchmarkHashMiB, v)
+		case "cpu_multi_ms":
+			b.CPUMultiMBps = rate(float64(benchmarkHashMiB*max(b.Cores, 1)), v)
+		case "disk_write_ms":
+			b.DiskWriteMBps = rate(benchmarkDiskMiB, v)
+		case "net_down":
+			b.NetDownloadMbps = transfer("download", v)
+		case "net_up":
+			b.NetUploadMbps = transfer("upload", v)
+		case "net":
+			problems = append(problems, "network: "+v)
+		}
+	}
+	if b.DiskWriteMBps == 0 {
+		problems = append(problems, "disk write failed")
+	}
+	b.Error = strings.Join(problems, "; ")
+	return b
+}
+
+// benchmarking holds the IDs of the devices a benchmark runs on.
+var benchmarking sync.Map
+
+// RunBenchmark runs the benchmark playbook on dev, stores the result on the
+// device and records it on the timeline. by says who asked.
+func RunBenchmark(dev *models.Device, by string) (*models.Benchmark, error) {
+	if _, running := benchmarking.LoadOrStore(dev.ID, true); running {
+		return nil, fmt.Errorf("a benchmark is already running on %s", deviceName(dev))
+	}
+	defer benchmarking.Delete(dev.ID)
+
+	out, err := RunPlaybook("benchmark", dev.IP, dev.ID, nil)
+	if err != nil {
+		msg := fmt.Sprintf("%s: benchmark failed (%s): %v", deviceName(dev), by, err)
+		RecordEvent(dev.ID, models.EventBenchmark, msg, map[string]any{"by": by, "ok": false})
+		return nil, err
+	}
+	b := parseBenchmark(out, time.Now())
+	if err := DB.Model(dev).Select("benchmark").Updates(&models.Device{Benchmark: b}).Error; err != nil {
+		return nil, err
+	}
+	msg := fmt.Sprintf("%s: benchmark CPU %.0f MB/s (%d cores %.0f MB/s), disk %.0f MB/s, network ↓%.0f ↑%.0f Mbit/s (%s)",
+		deviceName(dev), b.CPUSingleMBps, b.Cores, b.CPUMultiMBps, b.DiskWriteMBps, b.NetDownloadMbps, b.NetUploadMbps, by)
+	RecordEvent(dev.ID, models.EventBenchmark, msg, map[string]any{"by": by, "ok": true, "result": b})
+	return b, nil
+}
+
+// benchmarkNewDevices is benchmark_new_devices: benchmark devices when
+// they register.
+var benchmarkNewDevices bool
+
+// benchmarkSettle is how long a new device is left alone before its
+// benchmark, so the install and first reports do not skew it.
+const benchmarkSettle = 2 * time.Minute
+
+// SetBenchmarkNewDevices turns the benchmark of newly registered devices
+// on or off.
+func SetBenchmarkNewDevices(on bool) { benchmarkNewDevices = on }
+
+// benchmarkNewDevice benchmarks a just registered device once it settled.
+func benchmarkNewDevice(id uint) {
+	time.Sleep(benchmarkSettle)
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil || !dev.IsOnline {
+		return
+	}
+	if _, err := RunBenchmark(&dev, "new device"); err != nil {
+		log.Printf("[benchmark] device %d: %v", id, err)
+	}
+}
+
+// handleBenchmark starts the benchmark playbook on a device. It runs in the
+// background (about a minute); the result appears as the device's
+// benchmark and on its timeline.
+func handleBenchmark(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if _, running := benchmarking.Load(dev.ID); running {
+		c.JSON(http.StatusConflict, gin.H{"error": "a benchmark is already running on this device"})
+		return
+	}
+	if TasksHalted() {
+		c.JSON(http.StatusConflict, gin.H{"error": errTasksHalted.Error()})
+		return
+	}
+	by := c.GetString("username")
+	go func() {
+		if _, err := RunBenchmark(&dev, by); err != nil {
+			log.Printf("[benchmark] device %d: %v", dev.ID, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"data": gin.H{"device_id": dev.ID, "status": "started"}})
+}
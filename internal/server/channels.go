@@ -0,0 +1,515 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// notificationIcon marks a notification's status and severity in chat
+// messages.
+func notificationIcon(n *Notification) string {
+	switch {
+	case n.Status == models.AlertResolved:
+		return "✅"
+	case n.Severity == models.SeverityWarning:
+		return "🟠"
+	case n.Severity == models.SeverityInfo:
+		return "🔵"
+	}
+	return "🔴"
+}
+
+// notificationCondition renders the rule condition, e.g. "cpu_usage > 90".
+func notificationCondition(n *Notification) string {
+	if n.Operator == "" {
+		return n.Metric
+	}
+	return fmt.Sprintf("%s %s %g", n.Metric, n.Operator, n.Threshold)
+}
+
+// ── Slack ────────────────────────────────────────────────────────────────────
+
+// slackChannel posts notifications to a Slack incoming webhook as Block Kit
+// messages, or as rendered by tmpl.
+type slackChannel struct {
+	url  string
+	tmpl *template.Template
+}
+
+// slackEscape escapes the characters Slack's mrkdwn treats as markup.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (s *slackChannel) send(n *Notification) error {
+	body, err := renderBody(s.tmpl, n, func() any { return slackMessage(n) })
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, body, nil)
+}
+
+func slackMessage(n *Notification) any {
+	title := fmt.Sprintf("%s %s · %s", notificationIcon(n), strings.ToUpper(n.Status), n.Severity)
+	field := func(name, value string) map[string]string {
+		return map[string]string{"type": "mrkdwn", "text": "*" + name + "*\n" + slackEscape.Replace(value)}
+	}
+	msg := map[string]any{
+		"text": title + ": " + n.Message, // shown in notifications
+		"blocks": []any{
+			map[string]any{"type": "header", "text": map[string]string{"type": "plain_text", "text": title}},
+			map[string]any{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": slackEscape.Replace(n.Message)}},
+			map[string]any{"type": "section", "fields": []any{
+				field("Device", fmt.Sprintf("%s (%s)", n.Device, n.IP)),
+				field("Rule", n.Rule),
+				field("Condition", notificationCondition(n)),
+				field("Value", fmt.Sprintf("%.2f", n.Value)),
+			}},
+			map[string]any{"type": "context", "elements": []any{
+				map[string]string{"type": "mrkdwn", "text": fmt.Sprintf("Alert #%d · fired %s · OpenTalon", n.AlertID, n.FiredAt.Local().Format("2006-01-02 15:04:05"))},
+			}},
+		},
+	}
+	return msg
+}
+
+// ── Discord ──────────────────────────────────────────────────────────────────
+
+// discordChannel posts notifications to a Discord webhook as embeds, or as
+// rendered by tmpl.
+type discordChannel struct {
+	url  string
+	tmpl *template.Template
+}
+
+func (d *discordChannel) send(n *Notification) error {
+	body, err := renderBody(d.tmpl, n, func() any { return discordMessage(n) })
+	if err != nil {
+		return err
+	}
+	return postJSON(d.url, body, nil)
+}
+
+func discordMessage(n *Notification) any {
+	color := 0x1565c0
+	switch {
+	case n.Status == models.AlertResolved:
+		color = 0x2e7d32
+	case n.Severity == models.SeverityCritical:
+		color = 0xc62828
+	case n.Severity == models.SeverityWarning:
+		color = 0xef6c00
+	}
+	// Discord rejects embed fields with empty values.
+	field := func(name, value string) map[string]any {
+		if value == "" {
+			value = "—"
+		}
+		return map[string]any{"name": name, "value": value, "inline": true}
+	}
+	msg := map[string]any{
+		"username": "OpenTalon",
+		"embeds": []any{map[string]any{
+			"title":       fmt.Sprintf("%s %s · %s", notificationIcon(n), strings.ToUpper(n.Status), n.Severity),
+			"description": n.Message,
+			"color":       color,
+			"fields": []any{
+				field("Device", fmt.Sprintf("%s (%s)", n.Device, n.IP)),
+				field("Rule", n.Rule),
+				field("Condition", notificationCondition(n)),
+				field("Value", fmt.Sprintf("%.2f", n.Value)),
+			},
+			"footer":    map[string]string{"text": fmt.Sprintf("Alert #%d · OpenTalon", n.AlertID)},
+			"timestamp": n.FiredAt.UTC().Format(time.RFC3339),
+		}},
+	}
+	return msg
+}
+
+// ── DingTalk / WeCom ─────────────────────────────────────────────────────────
+
+// cnStatus names a notification status in the DingTalk and WeCom messages.
+var cnStatus = map[string]string{models.AlertFiring: "告警", models.AlertResolved: "恢复", "test": "测试"}
+
+var cnFuncs = template.FuncMap{
+	"icon":      notificationIcon,
+	"condition": notificationCondition,
+	"status":    func(s string) string { return cnStatus[s] },
+	"time":      func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+	// font colors the WeCom markdown supports.
+	"wecomColor": func(n *Notification) string {
+		switch {
+		case n.Status == models.AlertResolved:
+			return "info"
+		case n.Severity == models.SeverityInfo:
+			return "comment"
+		}
+		return "warning"
+	},
+}
+
+var dingTalkTmpl = template.Must(template.New("dingtalk").Funcs(cnFuncs).Parse(`#### {{icon .}} [OpenTalon] {{status .Status}} · {{.Severity}}
+
+**{{.Message}}**
+
+- 设备：{{.Device}} ({{.IP}}){{if .Group}} · {{.Group}}{{end}}
+- 规则：{{.Rule}}
+- 条件：{{condition .}}
+- 当前值：{{printf "%.2f" .Value}}
+- 触发时间：{{time .FiredAt}}{{if .ResolvedAt}}
+- 恢复时间：{{time .ResolvedAt}}{{end}}
+
+###### 告警 #{{.AlertID}}`))
+
+var weComTmpl = template.Must(template.New("wecom").Funcs(cnFuncs).Parse(`{{icon .}} **[OpenTalon] <font color="{{wecomColor .}}">{{status .Status}} · {{.Severity}}</font>**
+{{.Message}}
+> 设备：<font color="comment">{{.Device}} ({{.IP}}){{if .Group}} · {{.Group}}{{end}}</font>
+> 规则：<font color="comment">{{.Rule}}</font>
+> 条件：<font color="comment">{{condition .}}</font>
+> 当前值：<font color="comment">{{printf "%.2f" .Value}}</font>
+> 触发时间：<font color="comment">{{time .FiredAt}}</font>{{if .ResolvedAt}}
+> 恢复时间：<font color="comment">{{time .ResolvedAt}}</font>{{end}}
+告警 #{{.AlertID}}`))
+
+// robotReply is the reply of the DingTalk and WeCom robots, which report
+// errors with HTTP 200.
+type robotReply struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// err returns nil on success; rateLimited is the code asking to slow down,
+// the only error worth retrying.
+func (r *robotReply) err(rateLimited int) error {
+	switch r.ErrCode {
+	case 0:
+		return nil
+	case rateLimited:
+		return fmt.Errorf("errcode %d: %s", r.ErrCode, r.ErrMsg)
+	}
+	return fmt.Errorf("errcode %d: %s: %w", r.ErrCode, r.ErrMsg, errPermanent)
+}
+
+// dingTalkChannel posts markdown messages to a DingTalk custom robot,
+// signed when the robot uses 加签. Robots secured by keyword should list
+// "OpenTalon", which every message title carries. tmpl replaces the whole
+// request body.
+type dingTalkChannel struct {
+	url    string
+	secret string
+	tmpl   *template.Template
+}
+
+func (d *dingTalkChannel) send(n *Notification) error {
+	var text bytes.Buffer
+	if d.tmpl == nil {
+		if err := dingTalkTmpl.Execute(&text, n); err != nil {
+			return fmt.Errorf("rendering message: %v: %w", err, errPermanent)
+		}
+	}
+	body, err := renderBody(d.tmpl, n, func() any {
+		return map[string]any{
+			"msgtype":  "markdown",
+			"markdown": map[string]string{"title": fmt.Sprintf("[OpenTalon] %s: %s", cnStatus[n.Status], n.Message), "text": text.String()},
+		}
+	})
+	if err != nil {
+		return err
+	}
+	target := d.url
+	if d.secret != "" {
+		target = dingTalkSign(target, d.secret, time.Now())
+	}
+	var r robotReply
+	if err := postJSON(target, body, &r); err != nil {
+		return err
+	}
+	return r.err(130101) // sending too fast
+}
+
+// dingTalkSign adds the timestamp and signature DingTalk checks: the
+// base64 HMAC-SHA256, keyed by secret, of timestamp, newline, secret.
+func dingTalkSign(target, secret string, now time.Time) string {
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n" + secret))
+	sign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	sep := "?"
+	if strings.Contains(target, "?") {
+		sep = "&"
+	}
+	return target + sep + "timestamp=" + ts + "&sign=" + url.QueryEscape(sign)
+}
+
+// weComChannel posts markdown messages to a WeCom group robot, whose key in
+// the URL is its only credential. tmpl replaces the whole request body.
+type weComChannel struct {
+	url  string
+	tmpl *template.Template
+}
+
+func (w *weComChannel) send(n *Notification) error {
+	var text bytes.Buffer
+	if w.tmpl == nil {
+		if err := weComTmpl.Execute(&text, n); err != nil {
+			return fmt.Errorf("rendering message: %v: %w", err, errPermanent)
+		}
+	}
+	body, err := renderBody(w.tmpl, n, func() any {
+		return map[string]any{"msgtype": "markdown", "markdown": map[string]string{"content": text.String()}}
+	})
+	if err != nil {
+		return err
+	}
+	var r robotReply
+	if err := postJSON(w.url, body, &r); err != nil {
+		return err
+	}
+	return r.err(45009) // API frequency limit
+}
+
+// ── Channels API ─────────────────────────────────────────────────────────────
+
+// maskChannel keeps only the scheme and host of a channel's webhook URL,
+// whose path and query hold the credentials, and hides its secret.
+func maskChannel(ch *models.NotificationChannel) {
+	if u, err := parseWebhookURL(ch.URL); err == nil {
+		ch.URL = u.Scheme + "://" + u.Host + "/…"
+	}
+	if ch.Secret != "" {
+		ch.Secret = "******"
+	}
+}
+
+// handleListChannels lists the channels stored in the database.
+func handleListChannels(c *gin.Context) {
+	var list []models.NotificationChannel
+	if err := DB.Order("name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range list {
+		maskChannel(&list[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// channelBody is the create/update request; omitted fields are left alone
+// on update.
+type channelBody struct {
+	Name     *string `json:"name"`
+	Type     *string `json:"type"`
+	URL      *string `json:"url"`
+	Secret   *string `json:"secret"`
+	Template *string `json:"template"`
+}
+
+func (b *channelBody) apply(ch *models.NotificationChannel) error {
+	if b.Name != nil {
+		ch.Name = strings.TrimSpace(*b.Name)
+	}
+	if b.Type != nil {
+		ch.Type = strings.ToLower(strings.TrimSpace(*b.Type))
+	}
+	if b.URL != nil {
+		u, err := parseWebhookURL(*b.URL)
+		if err != nil {
+			return fmt.Errorf("url: %v", err)
+		}
+		ch.URL = u.String()
+	}
+	if b.Secret != nil {
+		ch.Secret = strings.TrimSpace(*b.Secret)
+	}
+	if b.Template != nil {
+		if _, err := parseNotifyTemplate(*b.Template); err != nil {
+			return err
+		}
+		ch.Template = *b.Template
+	}
+	notifiers.RLock()
+	configured := notifiers.byName[ch.Name] != nil
+	notifiers.RUnlock()
+	switch {
+	case ch.Name == "" || len(ch.Name) > 64:
+		return fmt.Errorf("name must be 1-64 characters")
+	case configured:
+		return fmt.Errorf("name %q is used by a channel in the config file", ch.Name)
+	case ch.URL == "":
+		return fmt.Errorf("url is required")
+	case ch.Secret != "" && ch.Type != models.ChannelDingTalk:
+		return fmt.Errorf("only dingtalk channels take a secret")
+	}
+	if _, err := newStoredChannel(ch); err != nil {
+		return fmt.Errorf("type must be webhook, slack, discord, dingtalk or wecom")
+	}
+	return nil
+}
+
+// handleCreateChannel adds a channel.
+func handleCreateChannel(c *gin.Context) {
+	var body channelBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var ch models.NotificationChannel
+	if err := body.apply(&ch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&ch).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicChannels, nil)
+	maskChannel(&ch)
+	c.JSON(http.StatusOK, gin.H{"data": ch})
+}
+
+// handleUpdateChannel updates the provided fields of a channel. Alert rules
+// naming it by its old name stop notifying.
+func handleUpdateChannel(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var ch models.NotificationChannel
+	if err := DB.First(&ch, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "channel not found"})
+		return
+	}
+	var body channelBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&ch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&ch).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicChannels, nil)
+	maskChannel(&ch)
+	c.JSON(http.StatusOK, gin.H{"data": ch})
+}
+
+// handleDeleteChannel removes a channel.
+func handleDeleteChannel(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.NotificationChannel{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicChannels, nil)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleTestChannel sends a sample notification to a channel, configured or
+// stored, once and reports whether it was delivered.
+func handleTestChannel(c *gin.Context) {
+	var body struct {
+		Channel string `json:"channel" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	target := channelsByName(body.Channel)[body.Channel]
+	if target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "channel not found"})
+		return
+	}
+	if err := target.send(testNotification(time.Now())); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"channel": body.Channel, "delivered": true}})
+}
+
+// testNotification is the sample sent by the channel test and rendered by
+// the template test, with a made-up device and sample.
+func testNotification(now time.Time) *Notification {
+	dev := &models.Device{
+		Hostname: "test-device", IP: "192.0.2.1", OS: "linux", Group: "default",
+		AgentVer: "test", IsOnline: true, LastSeen: now,
+	}
+	return &Notification{
+		Status: "test", Rule: "test", Severity: models.SeverityInfo,
+		Device: dev.Hostname, IP: dev.IP, Group: dev.Group, Metric: "test",
+		Message: "Test notification from OpenTalon", FiredAt: now,
+		DeviceInfo: dev,
+		Metrics: &models.Metrics{
+			CPUUsage: 12.5, MemUsage: 40, MemTotal: 8 << 30, DiskUsage: 55,
+			RxBytes: 125000, TxBytes: 64000, TCPConnections: 42, Uptime: 86400, ReportedAt: now,
+		},
+	}
+}
+
+// handleRenderTemplate renders a notification template without sending
+// it: for the alert ?alert_id= names (as it would be sent now) or for the
+// test sample. The template comes in the body, or is that of a stored
+// channel. A parse or execution error is a 400 with the reason.
+func handleRenderTemplate(c *gin.Context) {
+	var body struct {
+		Template string `json:"template"`
+		Channel  string `json:"channel"`
+		AlertID  uint   `json:"alert_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	src := body.Template
+	if src == "" && body.Channel != "" {
+		var ch models.NotificationChannel
+		if err := DB.Where("name = ?", body.Channel).First(&ch).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "channel not found"})
+			return
+		}
+		src = ch.Template
+	}
+	if src == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "template is required (or a channel that has one)"})
+		return
+	}
+	tmpl, err := parseNotifyTemplate(src)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	n := testNotification(time.Now())
+	if body.AlertID != 0 {
+		var a models.Alert
+		if err := DB.First(&a, body.AlertID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+			return
+		}
+		n = alertNotification(&a, "", 0)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, n); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"body": out.String(), "json": json.Valid(out.Bytes())}})
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/checks"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// checkResultRetention bounds how long individual check results are kept.
+const checkResultRetention = 7 * 24 * time.Hour
+
+// joinIDs / splitIDs convert between []uint and the comma-separated form
+// stored in Check.AgentIDs.
+func joinIDs(ids []uint) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(s string) []uint {
+	var ids []uint
+	for _, p := range strings.Split(s, ",") {
+		if id, err := strconv.ParseUint(strings.TrimSpace(p), 10, 64); err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+// AssignedChecks returns the enabled checks that the given device's agent
+// must execute. It is delivered in the metrics response.
+func AssignedChecks(deviceID uint) []checks.Assignment {
+	var list []models.Check
+	id := strconv.FormatUint(uint64(deviceID), 10)
+	if err := DB.Where("enabled = ? AND (agent_ids = ? OR agent_ids LIKE ? OR agent_ids LIKE ? OR agent_ids LIKE ?)",
+		true, id, id+",%", "%,"+id, "%,"+id+",%").Find(&list).Error; err != nil {
+		return nil
+	}
+	out := make([]checks.Assignment, 0, len(list))
+	for _, c := range list {
+		out = append(out, checks.Assignment{ID: c.ID, Type: c.Type, Spec: c.Spec, IntervalSec: c.IntervalSec})
+	}
+	return out
+}
+
+// SaveCheckResult stores a result and refreshes the check's last state.
+// When the result differs from the previous one of the same executor, a
+// check_failed / check_recovered event is recorded; a failing first run
+// counts as a failure, a passing one is not an event.
+func SaveCheckResult(checkID, deviceID uint, r checks.Result) error {
+	var chk models.Check
+	if err := DB.Select("id", "name").First(&chk, checkID).Error; err != nil {
+		return fmt.Errorf("check %d: %w", checkID, err)
+	}
+	var prev models.CheckResult
+	hadPrev := DB.Where("check_id = ? AND device_id = ?", checkID, deviceID).
+		Order("checked_at desc").Limit(1).Find(&prev).RowsAffected > 0
+
+	detail, _ := json.Marshal(r.Steps)
+	now := time.Now()
+	row := models.CheckResult{
+		CheckID:    checkID,
+		DeviceID:   deviceID,
+		OK:         r.OK,
+		DurationMs: r.DurationMs,
+		Error:      r.Error,
+		Detail:     string(detail),
+		CheckedAt:  now,
+	}
+	if err := DB.Create(&row).Error; err != nil {
+		return err
+	}
+	ok := r.OK
+	DB.Model(&models.Check{}).Where("id = ?", checkID).Updates(map[string]any{
+		"last_ok":         &ok,
+		"last_error":      r.Error,
+		"last_checked_at": now,
+	})
+	DB.Where("check_id = ? AND checked_at < ?", checkID, now.Add(-checkResultRetention)).
+		Delete(&models.CheckResult{})
+
+	wasOK := !hadPrev || prev.OK
+	if wasOK == r.OK {
+		return nil
+	}
+	from := "the server"
+	if deviceID != 0 {
+		var dev models.Device
+		if DB.Select("id", "hostname", "remark").First(&dev, deviceID).Error == nil {
+			from = dev.Hostname
+			if dev.Remark != "" {
+				from = dev.Remark
+			}
+		}
+	}
+	data := map[string]any{"check_id": checkID, "check": chk.Name, "error": r.Error}
+	if r.OK {
+		RecordEvent(deviceID, models.EventCheckRecovered,
+			fmt.Sprintf("Check %s passes again from %s", chk.Name, from), data)
+	} else {
+		RecordEvent(deviceID, models.EventCheckFailed,
+			fmt.Sprintf("Check %s failed from %s: %s", chk.Name, from, r.Error), data)
+	}
+	return nil
+}
+
+// serverChecksRunning holds the IDs of server-run checks in progress.
+var serverChecksRunning sync.Map // map[uint]bool
+
+// RunServerChecks executes the enabled checks that are not assigned to any
+// agent, each on its own interval. It never returns.
+func RunServerChecks() {
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		var list []models.Check
+		if err := DB.Where("enabled = ? AND (agent_ids = '' OR agent_ids IS NULL)", true).Find(&list).Error; err != nil {
+			continue
+		}
+		now := time.Now()
+		for _, chk := range list {
+			interval := time.Duration(chk.IntervalSec) * time.Second
+			if interval <= 0 {
+				interval = time.Minute
+			}
+			if now.Sub(chk.LastCheckedAt) < interval {
+				continue
+			}
+			if _, busy := serverChecksRunning.LoadOrStore(chk.ID, true); busy {
+				continue
+			}
+			go func(chk models.Check) {
+				defer serverChecksRunning.Delete(chk.ID)
+				res := checks.Run(context.Background(), checks.Assignment{ID: chk.ID, Type: chk.Type, Spec: chk.Spec})
+				if err := SaveCheckResult(chk.ID, 0, res); err != nil {
+					log.Printf("[checks] save result of check %d: %v", chk.ID, err)
+				}
+			}(chk)
+		}
+	}
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// checkFromRequest builds / validates a check from the request body, which is
+// either raw YAML (Content-Type: application/yaml) or JSON of the form
+// {"spec": "<yaml>", "enabled": true}. Checks without agents run on the
+// server.
+func checkFromRequest(c *gin.Context, chk *models.Check) error {
+	var spec string
+	enabled := true
+	ct := c.ContentType()
+	if strings.Contains(ct, "yaml") || strings.HasPrefix(ct, "text/") {
+		raw, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		spec = string(raw)
+	} else {
+		var body struct {
+			Spec    string `json:"spec" binding:"required"`
+			Enabled *bool  `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			return err
+		}
+		spec = body.Spec
+		if body.Enabled != nil {
+			enabled = *body.Enabled
+		}
+	}
+	def, err := checks.Parse([]byte(spec))
+	if err != nil {
+		return err
+	}
+	chk.Name = def.Name
+	chk.Type = def.Type
+	chk.Spec = spec
+	chk.IntervalSec = int(def.Interval / time.Second)
+	chk.AgentIDs = joinIDs(def.Agents)
+	chk.Enabled = enabled
+	return nil
+}
+
+// handleListChecks returns all check definitions with their last state.
+func handleListChecks(c *gin.Context) {
+	var list []models.Check
+	if err := DB.Order("name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// handleCreateCheck creates a check from a YAML scenario or probe.
+func handleCreateCheck(c *gin.Context) {
+	var chk models.Check
+	if err := checkFromRequest(c, &chk); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&chk).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": chk})
+}
+
+// handleUpdateCheck replaces a check's definition.
+func handleUpdateCheck(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var chk models.Check
+	if err := DB.First(&chk, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "check not found"})
+		return
+	}
+	if err := checkFromRequest(c, &chk); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&chk).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": chk})
+}
+
+// handleDeleteCheck removes a check together with its results.
+func handleDeleteCheck(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.Check{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	DB.Where("check_id = ?", id).Delete(&models.CheckResult{})
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleCheckResults returns the most recent results of a check (?limit=, default 100).
+func handleCheckResults(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	q := DB.Where("check_id = ?", id)
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	var list []models.CheckResult
+	if err := q.Order("checked_at desc").Limit(limit).Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// handleRunCheck executes a check once from the server itself and returns the
+// result without storing it — handy while authoring a scenario.
+func handleRunCheck(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var chk models.Check
+	if err := DB.First(&chk, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "check not found"})
+		return
+	}
+	res := checks.Run(context.Background(), checks.Assignment{ID: chk.ID, Type: chk.Type, Spec: chk.Spec})
+	c.JSON(http.StatusOK, gin.H{"data": res})
+}
+
+// handleCheckReport receives check results from an agent (data-plane). A
+// result for a check that is not assigned to the agent rejects the report.
+func handleCheckReport(c *gin.Context) {
+	var payload struct {
+		IP        string          `json:"ip"`
+		MachineID string          `json:"machine_id"`
+		Results   []checks.Report `json:"results"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dev, ok := reportDevice(c, payload.MachineID, payload.IP)
+	if !ok {
+		return
+	}
+	// Only the agents a check is assigned to may report its results.
+	for _, r := range payload.Results {
+		var chk models.Check
+		err := DB.Select("id", "agent_ids").First(&chk, r.CheckID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !slices.Contains(splitIDs(chk.AgentIDs), dev.ID) {
+			log.Printf("[checks] %s (#%d) reported check %d, which is not assigned to it", dev.IP, dev.ID, r.CheckID)
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("check %d is not assigned to %s", r.CheckID, dev.IP)})
+			return
+		}
+	}
+	stored := 0
+	for _, r := range payload.Results {
+		err := SaveCheckResult(r.CheckID, dev.ID, r.Result)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue // deleted since the agent got its assignments
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stored++
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "stored": stored})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/checks"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestCheckReportAssignedAgentsOnly(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	agent := models.Device{Hostname: "agent", IP: "10.0.0.1"}
+	other := models.Device{Hostname: "other", IP: "10.0.0.2"}
+	for _, d := range []*models.Device{&agent, &other} {
+		if err := DB.Create(d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	chk := models.Check{Name: "web", Type: "http", AgentIDs: fmt.Sprint(agent.ID)}
+	if err := DB.Create(&chk).Error; err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/api/checks/results", handleCheckReport)
+
+	tests := []struct {
+		name    string
+		ip      string
+		checkID uint
+		status  int
+		stored  int64 // results of chk from ip afterwards
+	}{
+		{"assigned agent", agent.IP, chk.ID, http.StatusOK, 1},
+		{"other agent", other.IP, chk.ID, http.StatusForbidden, 0},
+		{"deleted check", agent.IP, chk.ID + 100, http.StatusOK, 1},
+		{"unknown device", "10.9.9.9", chk.ID, http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{
+				"ip":      tt.ip,
+				"results": []checks.Report{{CheckID: tt.checkID, Result: checks.Result{OK: true}}},
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/checks/results", bytes.NewReader(body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var n int64
+			DB.Model(&models.CheckResult{}).Where("check_id = ? AND device_id IN (?)",
+				chk.ID, DB.Model(&models.Device{}).Select("id").Where("ip = ?", tt.ip)).Count(&n)
+			if n != tt.stored {
+				t.Errorf("%d results stored for %s, want %d", n, tt.ip, tt.stored)
+			}
+		})
+	}
+}
+
+// TestSideReportsSharedIP sends reports from two hosts behind one address:
+// each must land on the device of its machine ID, not the lowest ID.
+func TestSideReportsSharedIP(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	first := models.Device{Hostname: "first", IP: "10.0.0.1", MachineID: "aaa"}
+	second := models.Device{Hostname: "second", IP: "10.0.0.1", MachineID: "bbb"}
+	for _, d := range []*models.Device{&first, &second} {
+		if err := DB.Create(d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	chk := models.Check{Name: "web", Type: "http", AgentIDs: fmt.Sprint(second.ID)}
+	if err := DB.Create(&chk).Error; err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/api/checks/results", handleCheckReport)
+	r.POST("/api/speedtest/report", handleSpeedTestReport)
+	post := func(path string, body map[string]any) int {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b)))
+		return w.Code
+	}
+
+	results := []checks.Report{{CheckID: chk.ID, Result: checks.Result{OK: true}}}
+	if code := post("/api/checks/results", map[string]any{"ip": "10.0.0.1", "machine_id": "bbb", "results": results}); code != http.StatusOK {
+		t.Fatalf("check results of the assigned agent: status %d", code)
+	}
+	if code := post("/api/checks/results", map[string]any{"ip": "10.0.0.1", "machine_id": "aaa", "results": results}); code != http.StatusForbidden {
+		t.Errorf("check results of the other agent: status %d, want 403", code)
+	}
+	var res models.CheckResult
+	if err := DB.Where("check_id = ?", chk.ID).First(&res).Error; err != nil || res.DeviceID != second.ID {
+		t.Errorf("check result stored for device %d (%v), want %d", res.DeviceID, err, second.ID)
+	}
+
+	if code := post("/api/speedtest/report", map[string]any{"ip": "10.0.0.1", "machine_id": "bbb", "download_mbps": 100}); code != http.StatusOK {
+		t.Fatalf("speed test report: status %d", code)
+	}
+	var st models.SpeedTest
+	if err := DB.First(&st).Error; err != nil || st.DeviceID != second.ID {
+		t.Errorf("speed test stored for device %d (%v), want %d", st.DeviceID, err, second.ID)
+	}
+}
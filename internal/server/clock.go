@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// clockDriftThresholdMs is the clock offset (either direction) beyond which a
+// device counts as drifting; 0 disables drift events.
+var clockDriftThresholdMs float64 = 1000
+
+// SetClockDriftThreshold stores clock_drift_threshold_ms from config.
+func SetClockDriftThreshold(ms float64) {
+	clockDriftThresholdMs = ms
+}
+
+// TrackClockOffset stores the NTP offset reported by a device's agent and
+// records clock_drift when it crosses the threshold, clock_drift_resolved
+// when it comes back. Only crossings are recorded, not every drifting report.
+// A nil offset (no NTP server configured or reachable) is ignored.
+func TrackClockOffset(dev *models.Device, offsetMs *float64) {
+	if offsetMs == nil {
+		return
+	}
+	var prev *float64
+	if dev.ClockOffsetMs != nil {
+		v := *dev.ClockOffsetMs // copied: Update writes through the pointer
+		prev = &v
+	}
+	DB.Model(dev).Update("clock_offset_ms", *offsetMs)
+	dev.ClockOffsetMs = offsetMs
+	if clockDriftThresholdMs <= 0 {
+		return
+	}
+	drifting := func(ms *float64) bool { return ms != nil && math.Abs(*ms) > clockDriftThresholdMs }
+	was, is := drifting(prev), drifting(offsetMs)
+	if was == is {
+		return
+	}
+	name := dev.Hostname
+	if dev.Remark != "" {
+		name = dev.Remark
+	}
+	data := map[string]any{"offset_ms": *offsetMs, "threshold_ms": clockDriftThresholdMs}
+	if is {
+		dir := "ahead"
+		if *offsetMs < 0 {
+			dir = "behind"
+		}
+		RecordEvent(dev.ID, models.EventClockDrift,
+			fmt.Sprintf("%s clock is %.0f ms %s of NTP", name, math.Abs(*offsetMs), dir), data)
+		return
+	}
+	RecordEvent(dev.ID, models.EventClockDriftOK,
+		fmt.Sprintf("%s clock is back within %.0f ms of NTP", name, clockDriftThresholdMs), data)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Limits of a comparison: devices per request, and points per series of
+// a comparison or history.
+const (
+	maxCompareDevices = 50
+	maxSeriesPoints   = 1000
+)
+
+// parseRangeParam parses a lookback such as "90m", "24h" or "7d".
+func parseRangeParam(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid range %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid range %q, want e.g. 90m, 24h or 7d", s)
+	}
+	return d, nil
+}
+
+// parseSeriesRange reads the time range and bucket width of a series
+// request: ?from= / ?to= or ?range= (default 24h) back from now, and ?step=
+// (default range/300, at least 10s).
+func parseSeriesRange(c *gin.Context) (grafanaRange, time.Duration, error) {
+	return seriesRange(c.Query)
+}
+
+// seriesRange is parseSeriesRange reading the parameters through param,
+// which returns "" for the unset ones.
+func seriesRange(param func(name string) string) (grafanaRange, time.Duration, error) {
+	r := grafanaRange{To: time.Now()}
+	var err error
+	if s := param("to"); s != "" {
+		if r.To, err = parseTimeParam(s); err != nil {
+			return r, 0, fmt.Errorf("to: %v", err)
+		}
+	}
+	if s := param("from"); s != "" {
+		if r.From, err = parseTimeParam(s); err != nil {
+			return r, 0, fmt.Errorf("from: %v", err)
+		}
+	} else {
+		rng := param("range")
+		if rng == "" {
+			rng = "24h"
+		}
+		lookback, err := parseRangeParam(rng)
+		if err != nil {
+			return r, 0, err
+		}
+		r.From = r.To.Add(-lookback)
+	}
+	if !r.From.Before(r.To) {
+		return r, 0, fmt.Errorf("from must be before to")
+	}
+	step := max(r.To.Sub(r.From)/300, 10*time.Second).Truncate(time.Second)
+	if s := param("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step < time.Second {
+			return r, 0, fmt.Errorf("step: want a duration of at least 1s")
+		}
+	}
+	if r.To.Sub(r.From)/step > maxSeriesPoints {
+		return r, 0, fmt.Errorf("step too small: more than %d points", maxSeriesPoints)
+	}
+	return r, step, nil
+}
+
+// handleCompare returns one metric of several devices on a common time
+// axis: GET /api/compare?devices=1,2,3&metric=cpu_usage&range=24h. Samples
+// are averaged into buckets of ?step= (default: range/300, at least 10s);
+// ?from= / ?to= may replace range. values[i] belongs to timestamps[i] and is
+// null where a device has no data.
+func handleCompare(c *gin.Context) {
+	metric := c.DefaultQuery("metric", "cpu_usage")
+	if _, _, err := parseGrafanaTarget(metric); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error() + " (use " + strings.Join(grafanaMetrics, ", ") + ")"})
+		return
+	}
+	var ids []uint
+	seen := map[uint]bool{}
+	for _, s := range strings.Split(c.Query("devices"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid device id %q", s)})
+			return
+		}
+		if !seen[uint(id)] {
+			seen[uint(id)] = true
+			ids = append(ids, uint(id))
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxCompareDevices {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devices: want 1 to %d comma-separated ids", maxCompareDevices)})
+		return
+	}
+
+	r, step, err := parseSeriesRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	q := DB.Where("id IN ?", ids)
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	var devices []models.Device
+	if err := q.Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byID := make(map[uint]*models.Device, len(devices))
+	for i := range devices {
+		byID[devices[i].ID] = &devices[i]
+	}
+
+	start := r.From.Truncate(step)
+	n := int(r.To.Sub(start)/step) + 1
+	timestamps := make([]int64, n)
+	for i := range timestamps {
+		timestamps[i] = start.Add(time.Duration(i) * step).UnixMilli()
+	}
+	series := make([]gin.H, 0, len(ids))
+	for _, id := range ids {
+		dev := byID[id]
+		if dev == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device %d not found", id)})
+			return
+		}
+		points, err := grafanaSeries(id, metric, r, step)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		values := make([]*float64, n)
+		for _, p := range points {
+			// Rollup points sit mid-hour; they land in the bucket holding it.
+			i := int(time.UnixMilli(int64(p[1])).Sub(start) / step)
+			if i >= 0 && i < n && values[i] == nil {
+				v := p[0]
+				values[i] = &v
+			}
+		}
+		series = append(series, gin.H{"device_id": id, "name": deviceName(dev), "group": dev.Group, "values": values})
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"metric": metric, "from": r.From, "to": r.To, "step_seconds": int(step / time.Second),
+		"timestamps": timestamps, "series": series,
+	}})
+}
+
+// handleMetricsHistory returns a device's metrics over time, averaged into
+// buckets for charts: GET /api/devices/:id/metrics/history?range=7d, or
+// ?from= / ?to=, with ?step= as for /api/compare. Steps of an hour or more
+// read the hourly / daily rollups, so long ranges stay cheap; ?metrics=
+// picks metrics (comma-separated, default all). Only buckets holding data
+// are returned; values[metric][i] belongs to timestamps[i].
+func handleMetricsHistory(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	metrics := grafanaMetrics
+	if s := c.Query("metrics"); s != "" {
+		metrics = nil
+		for _, m := range strings.Split(s, ",") {
+			metric, _, err := parseGrafanaTarget(m)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error() + " (use " + strings.Join(grafanaMetrics, ", ") + ")"})
+				return
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+	r, step, err := parseSeriesRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("id").First(&models.Device{}, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	timestamps, values, source, err := deviceSeries(uint(id), metrics, r, step)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	series := make(map[string][]float64, len(metrics))
+	for i, m := range metrics {
+		series[m] = values[i]
+		if series[m] == nil {
+			series[m] = []float64{}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"device_id": id, "from": r.From, "to": r.To, "step_seconds": int(step / time.Second),
+		"source": source, "timestamps": timestamps, "values": series,
+	}})
+}
@@ -0,0 +1,559 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// complianceOperators are the comparisons a rule may use. The ordering
+// operators compare numerically; == and != do when both sides are numbers.
+var complianceOperators = []string{"==", "!=", "<", "<=", ">", ">=", "contains", "!contains", "~", "!~"}
+
+// complianceFacts are the values a "fact" rule can check, read from what
+// the server already knows about the device (mostly reported by its agent).
+var complianceFacts = map[string]func(d *models.Device) string{
+	"hostname":        func(d *models.Device) string { return d.Hostname },
+	"os":              func(d *models.Device) string { return d.OS },
+	"agent_ver":       func(d *models.Device) string { return d.AgentVer },
+	"group":           func(d *models.Device) string { return d.Group },
+	"network_mode":    func(d *models.Device) string { return string(d.NetworkMode) },
+	"public_ip":       func(d *models.Device) string { return d.PublicIP },
+	"report_interval": func(d *models.Device) string { return strconv.Itoa(d.ReportInterval) },
+	"flapping":        func(d *models.Device) string { return strconv.FormatBool(d.Flapping) },
+	"clock_offset_ms": func(d *models.Device) string {
+		if d.ClockOffsetMs == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*d.ClockOffsetMs, 'f', -1, 64)
+	},
+	// listening_ports is the sorted, comma-separated list of the device's
+	// listening ports, e.g. "22,53,80"; check it with contains / !contains.
+	"listening_ports": func(d *models.Device) string {
+		var ports []uint32
+		DB.Model(&models.ListeningPort{}).Where("device_id = ?", d.ID).Distinct().Order("port").Pluck("port", &ports)
+		s := make([]string, len(ports))
+		for i, p := range ports {
+			s[i] = strconv.FormatUint(uint64(p), 10)
+		}
+		return strings.Join(s, ",")
+	},
+}
+
+// complianceWorkers bounds the devices checked concurrently (SSH rules).
+const complianceWorkers = 8
+
+// complianceRunning serializes evaluations; a full run that overlaps
+// another one is skipped instead of checking every device twice.
+var complianceRunning sync.Mutex
+
+// RunCompliance evaluates every enabled compliance rule each interval.
+func RunCompliance(interval time.Duration) {
+	for {
+		if leads("compliance", 2*interval) {
+			EvaluateCompliance(0)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// EvaluateCompliance checks the enabled rules (or only rule ruleID) on every
+// device of their group and stores the results. A rule starting to fail on
+// a device records compliance_failed, passing again compliance_ok.
+func EvaluateCompliance(ruleID uint) {
+	if ruleID != 0 {
+		complianceRunning.Lock()
+	} else if !complianceRunning.TryLock() {
+		return
+	}
+	defer complianceRunning.Unlock()
+
+	q := DB.Where("enabled = ?", true)
+	if ruleID != 0 {
+		q = q.Where("id = ?", ruleID)
+	}
+	var rules []models.ComplianceRule
+	if err := q.Order("id").Find(&rules).Error; err != nil {
+		log.Printf("[compliance] load rules: %v", err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		log.Printf("[compliance] load devices: %v", err)
+		return
+	}
+
+	sem := make(chan struct{}, complianceWorkers)
+	var wg sync.WaitGroup
+	for i := range devices {
+		dev := &devices[i]
+		var applicable []*models.ComplianceRule
+		for j := range rules {
+			if rules[j].Group == "" || rules[j].Group == dev.Group {
+				applicable = append(applicable, &rules[j])
+			}
+		}
+		if len(applicable) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			for _, r := range applicable {
+				evaluateComplianceRule(r, dev)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Results of devices that left a rule's group are no longer meaningful.
+	for _, r := range rules {
+		if r.Group != "" {
+			DB.Where("rule_id = ? AND device_id NOT IN (?)", r.ID,
+				DB.Model(&models.Device{}).Select("id").Where(map[string]any{"group": r.Group})).
+				Delete(&models.ComplianceResult{})
+		}
+	}
+}
+
+// evaluateComplianceRule checks one rule on one device and stores the result.
+// When the value cannot be read the previous verdict is kept alongside the
+// error, so a flaky SSH connection does not toggle the compliance events.
+func evaluateComplianceRule(r *models.ComplianceRule, dev *models.Device) {
+	var prev models.ComplianceResult
+	found := DB.Where("rule_id = ? AND device_id = ?", r.ID, dev.ID).First(&prev).Error == nil
+	// known: prev holds a verdict, not just an error of the first check.
+	known := found && (prev.Error == "" || prev.Compliant || prev.Actual != "")
+
+	res := models.ComplianceResult{ID: prev.ID, RuleID: r.ID, DeviceID: dev.ID, CheckedAt: time.Now()}
+	actual, err := complianceValue(r, dev)
+	if err == nil {
+		res.Compliant, err = complianceMatch(r.Operator, actual, r.Expected)
+		res.Actual = actual
+	}
+	if err != nil {
+		res.Error = err.Error()
+		res.Compliant, res.Actual = prev.Compliant, prev.Actual
+	}
+	if err := DB.Select("*").Save(&res).Error; err != nil {
+		log.Printf("[compliance] store %q on device %d: %v", r.Name, dev.ID, err)
+		return
+	}
+	if res.Error != "" || known && res.Compliant == prev.Compliant || !known && res.Compliant {
+		return
+	}
+	data := map[string]any{"rule": r.Name, "actual": res.Actual, "operator": r.Operator, "expected": r.Expected}
+	if res.Compliant {
+		RecordEvent(dev.ID, models.EventComplianceOK,
+			fmt.Sprintf("%s complies with rule %q again", deviceName(dev), r.Name), data)
+		return
+	}
+	data["remediation"] = r.Remediation
+	RecordEvent(dev.ID, models.EventComplianceFailed,
+		fmt.Sprintf("%s violates compliance rule %q (got %q)", deviceName(dev), r.Name, res.Actual), data)
+}
+
+// complianceValue reads the value a rule checks on dev.
+func complianceValue(r *models.ComplianceRule, dev *models.Device) (string, error) {
+	if r.Source == models.ComplianceFact {
+		return complianceFacts[r.Fact](dev), nil
+	}
+	if !dev.IsOnline {
+		return "", fmt.Errorf("device offline")
+	}
+	out, err := RunPlaybook("shell", dev.IP, dev.ID, map[string]string{"command": r.Command})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// complianceMatch reports whether actual op expected holds.
+func complianceMatch(op, actual, expected string) (bool, error) {
+	a, errA := strconv.ParseFloat(strings.TrimSpace(actual), 64)
+	e, errE := strconv.ParseFloat(strings.TrimSpace(expected), 64)
+	numeric := errA == nil && errE == nil
+	switch op {
+	case "==":
+		if numeric {
+			return a == e, nil
+		}
+		return actual == expected, nil
+	case "!=":
+		if numeric {
+			return a != e, nil
+		}
+		return actual != expected, nil
+	case "<", "<=", ">", ">=":
+		if errA != nil {
+			return false, fmt.Errorf("value %q is not a number", actual)
+		}
+		if errE != nil {
+			return false, fmt.Errorf("expected %q is not a number", expected)
+		}
+		switch op {
+		case "<":
+			return a < e, nil
+		case "<=":
+			return a <= e, nil
+		case ">":
+			return a > e, nil
+		}
+		return a >= e, nil
+	case "contains":
+		return complianceContains(actual, expected), nil
+	case "!contains":
+		return !complianceContains(actual, expected), nil
+	case "~", "!~":
+		re, err := regexp.Compile(expected)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(actual) == (op == "~"), nil
+	}
+	return false, fmt.Errorf("unknown operator %q", op)
+}
+
+// complianceContains reports whether the comma-separated list actual holds
+// expected, or else whether it is a substring of actual.
+func complianceContains(actual, expected string) bool {
+	for _, item := range strings.Split(actual, ",") {
+		if strings.TrimSpace(item) == expected {
+			return true
+		}
+	}
+	return strings.Contains(actual, expected)
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListComplianceRules returns all compliance rules.
+func handleListComplianceRules(c *gin.Context) {
+	var rules []models.ComplianceRule
+	if err := DB.Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+// complianceRuleBody is the create / update body for a compliance rule.
+type complianceRuleBody struct {
+	Name        *string `json:"name"`
+	Group       *string `json:"group"`
+	Source      *string `json:"source"`
+	Fact        *string `json:"fact"`
+	Command     *string `json:"command"`
+	Operator    *string `json:"operator"`
+	Expected    *string `json:"expected"`
+	Severity    *string `json:"severity"`
+	Remediation *string `json:"remediation"`
+	Playbook    *string `json:"playbook"`
+	Enabled     *bool   `json:"enabled"`
+}
+
+// apply copies the provided fields onto r and validates the result.
+func (b *complianceRuleBody) apply(r *models.ComplianceRule) error {
+	for dst, src := range map[*string]*string{
+		&r.Name: b.Name, &r.Group: b.Group, &r.Source: b.Source, &r.Fact: b.Fact,
+		&r.Command: b.Command, &r.Operator: b.Operator, &r.Expected: b.Expected,
+		&r.Severity: b.Severity, &r.Remediation: b.Remediation, &r.Playbook: b.Playbook,
+	} {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		}
+	}
+	if b.Enabled != nil {
+		r.Enabled = *b.Enabled
+	}
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch r.Source {
+	case models.ComplianceFact:
+		if complianceFacts[r.Fact] == nil {
+			names := make([]string, 0, len(complianceFacts))
+			for n := range complianceFacts {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown fact %q (use %s)", r.Fact, strings.Join(names, ", "))
+		}
+		r.Command = ""
+	case models.ComplianceSSH:
+		if r.Command == "" {
+			return fmt.Errorf("command is required for ssh rules")
+		}
+		r.Fact = ""
+	default:
+		return fmt.Errorf("source must be %q or %q", models.ComplianceFact, models.ComplianceSSH)
+	}
+	known := false
+	for _, op := range complianceOperators {
+		known = known || op == r.Operator
+	}
+	if !known {
+		return fmt.Errorf("operator must be one of %s", strings.Join(complianceOperators, " "))
+	}
+	if r.Operator == "~" || r.Operator == "!~" {
+		if _, err := regexp.Compile(r.Expected); err != nil {
+			return fmt.Errorf("expected: %v", err)
+		}
+	}
+	switch r.Severity {
+	case "":
+		r.Severity = models.SeverityWarning
+	case models.SeverityInfo, models.SeverityWarning, models.SeverityCritical:
+	default:
+		return fmt.Errorf("severity must be info, warning or critical")
+	}
+	if r.Playbook != "" {
+		if _, ok := Playbooks[r.Playbook]; !ok {
+			return fmt.Errorf("unknown playbook %q", r.Playbook)
+		}
+	}
+	return nil
+}
+
+// handleCreateComplianceRule creates a rule and evaluates it right away.
+func handleCreateComplianceRule(c *gin.Context) {
+	var body complianceRuleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r := models.ComplianceRule{Operator: "==", Enabled: true}
+	if err := body.apply(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// GORM 会把零值字段回落为列默认值（enabled=false → true），创建后显式写回。
+	enabled := r.Enabled
+	if err := DB.Create(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !enabled {
+		DB.Model(&r).Update("enabled", false)
+		r.Enabled = false
+	} else {
+		go EvaluateCompliance(r.ID)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": r})
+}
+
+// handleUpdateComplianceRule updates the provided fields of a rule.
+func handleUpdateComplianceRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var r models.ComplianceRule
+	if err := DB.First(&r, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	var body complianceRuleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// The old results were measured against the previous definition.
+	DB.Where("rule_id = ?", r.ID).Delete(&models.ComplianceResult{})
+	if r.Enabled {
+		go EvaluateCompliance(r.ID)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": r})
+}
+
+// handleDeleteComplianceRule removes a rule and its results.
+func handleDeleteComplianceRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.ComplianceRule{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	DB.Where("rule_id = ?", id).Delete(&models.ComplianceResult{})
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleRunCompliance evaluates all rules (or ?rule_id=) in the background.
+func handleRunCompliance(c *gin.Context) {
+	var ruleID uint64
+	if s := c.Query("rule_id"); s != "" {
+		var err error
+		if ruleID, err = strconv.ParseUint(s, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule_id"})
+			return
+		}
+	}
+	go EvaluateCompliance(uint(ruleID))
+	c.JSON(http.StatusAccepted, gin.H{"ok": true})
+}
+
+// complianceCheck is one rule's result on a device as the report shows it.
+type complianceCheck struct {
+	RuleID      uint      `json:"rule_id"`
+	Rule        string    `json:"rule"`
+	Severity    string    `json:"severity"`
+	Status      string    `json:"status"` // pass / fail / unknown
+	Actual      string    `json:"actual"`
+	Operator    string    `json:"operator"`
+	Expected    string    `json:"expected"`
+	Error       string    `json:"error,omitempty"`
+	Remediation string    `json:"remediation,omitempty"`
+	Playbook    string    `json:"playbook,omitempty"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// complianceReport is the compliance of one device.
+type complianceReport struct {
+	DeviceID  uint              `json:"device_id"`
+	Name      string            `json:"name"`
+	Group     string            `json:"group"`
+	Compliant bool              `json:"compliant"`
+	Passed    int               `json:"passed"`
+	Failed    int               `json:"failed"`
+	Unknown   int               `json:"unknown"`
+	Checks    []complianceCheck `json:"checks"`
+}
+
+// complianceReports builds the reports of devices from their stored results.
+// Suggestions (remediation, playbook) are only filled in for failed checks.
+func complianceReports(devices []models.Device) ([]complianceReport, error) {
+	ids := make([]uint, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	var rules []models.ComplianceRule
+	if err := DB.Where("enabled = ?", true).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	ruleByID := make(map[uint]*models.ComplianceRule, len(rules))
+	for i := range rules {
+		ruleByID[rules[i].ID] = &rules[i]
+	}
+	var results []models.ComplianceResult
+	if err := DB.Where("device_id IN ?", ids).Order("rule_id").Find(&results).Error; err != nil {
+		return nil, err
+	}
+	byDevice := map[uint][]models.ComplianceResult{}
+	for _, res := range results {
+		byDevice[res.DeviceID] = append(byDevice[res.DeviceID], res)
+	}
+
+	reports := make([]complianceReport, 0, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		rep := complianceReport{DeviceID: d.ID, Name: deviceName(d), Group: d.Group, Checks: []complianceCheck{}}
+		for _, res := range byDevice[d.ID] {
+			r := ruleByID[res.RuleID]
+			if r == nil {
+				continue
+			}
+			chk := complianceCheck{
+				RuleID: r.ID, Rule: r.Name, Severity: r.Severity, Actual: res.Actual,
+				Operator: r.Operator, Expected: r.Expected, Error: res.Error, CheckedAt: res.CheckedAt,
+			}
+			switch {
+			case res.Error != "":
+				chk.Status = "unknown"
+				rep.Unknown++
+			case res.Compliant:
+				chk.Status = "pass"
+				rep.Passed++
+			default:
+				chk.Status = "fail"
+				chk.Remediation, chk.Playbook = r.Remediation, r.Playbook
+				rep.Failed++
+			}
+			rep.Checks = append(rep.Checks, chk)
+		}
+		rep.Compliant = rep.Failed == 0
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
+
+// handleComplianceReport returns the compliance of every device that has
+// results, optionally limited to ?group= or to failing devices
+// (?failing=true).
+func handleComplianceReport(c *gin.Context) {
+	q := DB.Where("id IN (?)", DB.Model(&models.ComplianceResult{}).Distinct().Select("device_id")).Order("id")
+	if g := c.Query("group"); g != "" {
+		q = q.Where(map[string]any{"group": g})
+	}
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	var devices []models.Device
+	if err := q.Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	reports, err := complianceReports(devices)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	failing := c.Query("failing") == "true"
+	out := reports[:0]
+	compliant := 0
+	for _, rep := range reports {
+		if rep.Compliant {
+			compliant++
+		}
+		if !failing || !rep.Compliant {
+			out = append(out, rep)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": out, "summary": gin.H{
+		"devices": len(reports), "compliant": compliant, "non_compliant": len(reports) - compliant,
+	}})
+}
+
+// handleDeviceCompliance returns the compliance of one device.
+func handleDeviceCompliance(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	reports, err := complianceReports([]models.Device{dev})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": reports[0]})
+}
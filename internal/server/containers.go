@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// ContainerReport mirrors agent.ContainerInfo to avoid circular imports.
+type ContainerReport struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Image    string  `json:"image"`
+	State    string  `json:"state"`
+	Status   string  `json:"status"`
+	IP       string  `json:"ip"`
+	CPUUsage float64 `json:"cpu_usage"`
+	MemUsage uint64  `json:"mem_usage"`
+	MemLimit uint64  `json:"mem_limit"`
+}
+
+// SyncContainers replaces the container inventory of a host with the list the
+// agent just reported: known containers are updated, new ones inserted and
+// containers no longer present (removed with `docker rm`) deleted.
+func SyncContainers(deviceID uint, reports []ContainerReport) error {
+	now := time.Now()
+	return DB.Transaction(func(tx *gorm.DB) error {
+		seen := make([]string, 0, len(reports))
+		for _, r := range reports {
+			if r.ID == "" {
+				continue
+			}
+			seen = append(seen, r.ID)
+			fields := map[string]any{
+				"name":      r.Name,
+				"image":     r.Image,
+				"state":     r.State,
+				"status":    r.Status,
+				"ip":        r.IP,
+				"cpu_usage": r.CPUUsage,
+				"mem_usage": r.MemUsage,
+				"mem_limit": r.MemLimit,
+				"last_seen": now,
+			}
+			res := tx.Model(&models.Container{}).
+				Where("device_id = ? AND container_id = ?", deviceID, r.ID).
+				Updates(fields)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				c := models.Container{
+					DeviceID:    deviceID,
+					ContainerID: r.ID,
+					Name:        r.Name,
+					Image:       r.Image,
+					State:       r.State,
+					Status:      r.Status,
+					IP:          r.IP,
+					CPUUsage:    r.CPUUsage,
+					MemUsage:    r.MemUsage,
+					MemLimit:    r.MemLimit,
+					LastSeen:    now,
+				}
+				if err := tx.Create(&c).Error; err != nil {
+					return err
+				}
+			}
+		}
+		del := tx.Where("device_id = ?", deviceID)
+		if len(seen) > 0 {
+			del = del.Where("container_id NOT IN ?", seen)
+		}
+		return del.Delete(&models.Container{}).Error
+	})
+}
+
+// GetContainers returns the containers last reported by a host.
+func GetContainers(deviceID uint) ([]models.Container, error) {
+	var list []models.Container
+	err := DB.Where("device_id = ?", deviceID).Order("name").Find(&list).Error
+	return list, err
+}
+
+// attachContainerNodes adds every known container as a leaf child of its host
+// node. A container is "online" only while running on an online host.
+func attachContainerNodes(nodeMap map[uint]*models.DeviceTree) {
+	var list []models.Container
+	if err := DB.Find(&list).Error; err != nil {
+		return
+	}
+	for _, c := range list {
+		host, ok := nodeMap[c.DeviceID]
+		if !ok {
+			continue
+		}
+		status := "offline"
+		if c.State == "running" && host.IsOnline {
+			status = "online"
+		}
+		hostID := host.ID
+		host.Children = append(host.Children, &models.DeviceTree{
+			ID:          c.ID,
+			Key:         treeKey("container", c.ID),
+			Kind:        "container",
+			Hostname:    c.Name,
+			Remark:      c.Image,
+			IP:          c.IP,
+			OS:          "docker",
+			NetworkMode: models.NetworkModeNAT,
+			Group:       host.Group,
+			IsOnline:    status == "online",
+			Status:      status,
+			LastSeen:    c.LastSeen,
+			ParentID:    &hostID,
+		})
+	}
+}
+
+// handleDeviceContainers returns the Docker containers (with their latest
+// CPU / memory usage) reported by a host device.
+func handleDeviceContainers(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	list, err := GetContainers(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
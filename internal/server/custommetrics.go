@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// customMetricsHistoryWindow bounds how long custom metrics are kept per
+// device, like the latency history.
+const customMetricsHistoryWindow = 24 * time.Hour
+
+// decodeReport decodes a JSON object into the struct v points to, field by
+// field, and returns the top-level fields v has no place for: names it does
+// not know (a newer agent's) and values of the wrong type. Only malformed
+// JSON is an error, so a report is never rejected for what it adds. Unknown
+// fields nested inside known ones are still dropped.
+func decodeReport(body []byte, v any) (extra map[string]json.RawMessage, err error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(v).Elem()
+	byName := make(map[string]int, rv.NumField())
+	for i := 0; i < rv.NumField(); i++ {
+		name, _, _ := strings.Cut(rv.Type().Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			byName[name] = i
+		}
+	}
+	for name, raw := range fields {
+		if i, ok := byName[name]; ok {
+			f := rv.Field(i)
+			if json.Unmarshal(raw, f.Addr().Interface()) == nil {
+				continue
+			}
+			f.SetZero()
+		}
+		if extra == nil {
+			extra = map[string]json.RawMessage{}
+		}
+		extra[name] = raw
+	}
+	return extra, nil
+}
+
+// SaveCustomMetrics stores the fields of a report the server does not
+// understand and prunes rows older than customMetricsHistoryWindow.
+func SaveCustomMetrics(deviceID uint, schemaVersion int, extra map[string]json.RawMessage) error {
+	if len(extra) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(extra)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	row := models.CustomMetrics{DeviceID: deviceID, SchemaVersion: schemaVersion, Data: string(data), ReportedAt: now}
+	if err := DB.Create(&row).Error; err != nil {
+		return err
+	}
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-customMetricsHistoryWindow)).
+		Delete(&models.CustomMetrics{})
+	return nil
+}
+
+// customMetricsRow is a CustomMetrics row with its data as a JSON object.
+type customMetricsRow struct {
+	SchemaVersion int             `json:"schema_version"`
+	Data          json.RawMessage `json:"data"`
+	ReportedAt    time.Time       `json:"reported_at"`
+}
+
+// handleDeviceCustomMetrics returns the report fields of a device the server
+// keeps raw, oldest first. ?field= narrows each row to one field (rows
+// without it are left out) and ?from= / ?to= (RFC 3339 or unix seconds) the
+// time range within the retained window.
+func handleDeviceCustomMetrics(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	q := DB.Where("device_id = ?", id)
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			ts, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("reported_at "+op+" ?", ts)
+		}
+	}
+	var list []models.CustomMetrics
+	if err := q.Order("reported_at").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	field := c.Query("field")
+	rows := []customMetricsRow{}
+	for _, m := range list {
+		data := json.RawMessage(m.Data)
+		if field != "" {
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(data, &fields) != nil || fields[field] == nil {
+				continue
+			}
+			data, _ = json.Marshal(map[string]json.RawMessage{field: fields[field]})
+		}
+		rows = append(rows, customMetricsRow{SchemaVersion: m.SchemaVersion, Data: data, ReportedAt: m.ReportedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"data": rows})
+}
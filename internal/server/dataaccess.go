@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// IP binding modes (data_ip_binding).
+const (
+	BindingOff     = "off"
+	BindingWarn    = "warn"    // log reports from unexpected addresses
+	BindingEnforce = "enforce" // and reject them
+)
+
+// dataAllowlist holds the networks allowed to reach the data plane; empty
+// allows any.
+var dataAllowlist []*net.IPNet
+
+// ipBinding is the data_ip_binding mode.
+var ipBinding = BindingOff
+
+// SetDataPlaneAccess installs the data-plane source checks: allow lists
+// addresses or CIDRs that may reach the data plane at all, and binding
+// (off, warn or enforce) whether a report about a device must come from an
+// address bound to that device.
+func SetDataPlaneAccess(allow []string, binding string) error {
+	nets, err := parseNets(allow)
+	if err != nil {
+		return fmt.Errorf("data_allowlist: %w", err)
+	}
+	switch binding {
+	case "", BindingOff:
+		binding = BindingOff
+	case BindingWarn, BindingEnforce:
+	default:
+		return fmt.Errorf("unsupported data_ip_binding %q (use off, warn or enforce)", binding)
+	}
+	dataAllowlist, ipBinding = nets, binding
+	return nil
+}
+
+// parseNets parses addresses and CIDRs; a bare address is a /32 (/128).
+func parseNets(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DataAllowlistMiddleware rejects data-plane requests from addresses outside
+// data_allowlist.
+func DataAllowlistMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(dataAllowlist) == 0 {
+			c.Next()
+			return
+		}
+		ip := net.ParseIP(c.ClientIP())
+		if ip == nil || !netsContain(dataAllowlist, ip) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "source address not allowed"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// boundTo reports whether src is one of dev's addresses or inside its
+// BindCIDR.
+func boundTo(dev *models.Device, src net.IP) bool {
+	for _, list := range []string{dev.IP, dev.LANIPs, dev.WANIPs, dev.IPv6Addrs} {
+		for _, s := range strings.Split(list, ",") {
+			if ip := net.ParseIP(strings.TrimSpace(s)); ip != nil && ip.Equal(src) {
+				return true
+			}
+		}
+	}
+	nets, _ := parseNets(strings.Split(dev.BindCIDR, ","))
+	return netsContain(nets, src)
+}
+
+// sourceBound reports whether a report about dev may come from the
+// request's source. Loopback is always accepted: an agent on the server
+// host.
+func sourceBound(c *gin.Context, dev *models.Device) bool {
+	if ipBinding == BindingOff {
+		return true
+	}
+	src := net.ParseIP(c.ClientIP())
+	return src != nil && (src.IsLoopback() || boundTo(dev, src))
+}
+
+// checkReportSource applies data_ip_binding to a report about dev. In
+// enforce mode it rejects a mismatch with 403 and returns false.
+func checkReportSource(c *gin.Context, dev *models.Device) bool {
+	if sourceBound(c, dev) {
+		return true
+	}
+	log.Printf("[data] report for %s from unexpected address %s (%s)", dev.IP, c.ClientIP(), c.FullPath())
+	if ipBinding != BindingEnforce {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "report for " + dev.IP + " from unexpected address " + c.ClientIP()})
+	return false
+}
+
+// reportDevice finds the device a side report (check results, a speed
+// test, a traceroute, a shutdown notice) comes from by the agent's machine
+// ID or IP, as findDevice does, and applies checkReportSource to it. It
+// answers 404 when there is none and returns false when it answered.
+func reportDevice(c *gin.Context, machineID, ip string) (models.Device, bool) {
+	dev, err := findDevice(machineID, ip, false)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not registered"})
+		return dev, false
+	}
+	return dev, checkReportSource(c, &dev)
+}
+
+// renumberAllowed reports whether a report may move the device at oldIP to
+// its new address. In enforce mode the source must be bound to the old
+// device too (a BindCIDR covering the subnet), or anyone could take over a
+// device by naming it as their previous address.
+func renumberAllowed(c *gin.Context, oldIP string) bool {
+	if ipBinding != BindingEnforce {
+		return true
+	}
+	var old models.Device
+	if err := DB.Where("ip = ?", oldIP).First(&old).Error; err != nil {
+		return true
+	}
+	if sourceBound(c, &old) {
+		return true
+	}
+	log.Printf("[data] not renumbering %s: report from unbound address %s", oldIP, c.ClientIP())
+	return false
+}
+
+// machineIDAllowed reports whether a report's machine ID may carry dev to
+// the report's new address. In enforce mode the source must be bound to dev,
+// as for renumberAllowed: the machine ID is only the agent's word.
+func machineIDAllowed(c *gin.Context, dev *models.Device) bool {
+	if ipBinding != BindingEnforce || sourceBound(c, dev) {
+		return true
+	}
+	log.Printf("[data] ignoring machine ID of %s: report from unbound address %s", dev.IP, c.ClientIP())
+	return false
+}
+
+// learnReportSource binds a device registered by this report to the
+// source address when that is not one of its own, e.g. an agent behind NAT,
+// so later reports must come the same way.
+func learnReportSource(c *gin.Context, dev *models.Device) {
+	if ipBinding == BindingOff || dev.BindCIDR != "" {
+		return
+	}
+	src := net.ParseIP(c.ClientIP())
+	if src == nil || src.IsLoopback() || boundTo(dev, src) {
+		return
+	}
+	dev.BindCIDR = src.String()
+	DB.Model(dev).Update("bind_cidr", dev.BindCIDR)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Page sizes of the flat device list.
+const (
+	defaultDevicesPerPage = 50
+	maxDevicesPerPage     = 500
+)
+
+// deviceSortColumns are the columns GET /api/devices can sort by.
+var deviceSortColumns = map[string]bool{
+	"id": true, "hostname": true, "remark": true, "ip": true, "os": true, "group": true,
+	"agent_ver": true, "last_seen": true, "created_at": true, "is_online": true,
+}
+
+// handleListDevices returns a flat, paginated device list:
+// GET /api/devices?group=&tag=&online=&os=&q=&page=&per_page=&sort=. group
+// takes a comma-separated list, tag too (devices carrying all of them), os
+// and q match substrings (q: hostname, remark, IP, MAC), sort names a
+// column, prefixed with "-" for descending (default id). The total count of
+// matching devices comes along for paging.
+func handleListDevices(c *gin.Context) {
+	q := DB.Model(&models.Device{})
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	if s := c.Query("group"); s != "" {
+		q = q.Where(map[string]any{"group": strings.Split(s, ",")})
+	}
+	if s := c.Query("tag"); s != "" {
+		for _, tag := range strings.Split(s, ",") {
+			q = q.Where("id IN (?)", taggedDeviceIDs(strings.TrimSpace(tag)))
+		}
+	}
+	if s := c.Query("online"); s != "" {
+		online, err := strconv.ParseBool(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "online: want true or false"})
+			return
+		}
+		q = q.Where("is_online = ?", online)
+	}
+	if s := c.Query("os"); s != "" {
+		q = q.Where("LOWER(os) LIKE ?", "%"+strings.ToLower(s)+"%")
+	}
+	if s := strings.TrimSpace(c.Query("q")); s != "" {
+		like := "%" + strings.ToLower(s) + "%"
+		q = q.Where("LOWER(hostname) LIKE ? OR LOWER(remark) LIKE ? OR ip LIKE ? OR LOWER(mac) LIKE ?", like, like, like, like)
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page: want a positive number"})
+		return
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultDevicesPerPage)))
+	if err != nil || perPage < 1 || perPage > maxDevicesPerPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "per_page: want 1 to " + strconv.Itoa(maxDevicesPerPage)})
+		return
+	}
+	sort := c.DefaultQuery("sort", "id")
+	column, desc := strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+	if !deviceSortColumns[column] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort: unknown column " + strconv.Quote(column)})
+		return
+	}
+
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	devices := []models.Device{}
+	err = q.Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc}).Order("id").
+		Offset((page - 1) * perPage).Limit(perPage).Find(&devices).Error
+	if err == nil {
+		err = fillDeviceTags(devices)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": devices, "total": total, "page": page, "per_page": perPage})
+}
+
+// reviveDevice takes a device out of the trash; what completes the event
+// message, e.g. "restored from the trash".
+func reviveDevice(dev *models.Device, what string) error {
+	if err := DB.Unscoped().Model(dev).Update("deleted_at", nil).Error; err != nil {
+		return err
+	}
+	dev.DeletedAt = gorm.DeletedAt{}
+	RecordEvent(dev.ID, models.EventDeviceRestored, deviceName(dev)+" "+what, nil)
+	return nil
+}
+
+// handleDeviceTrash lists the deleted devices, most recently deleted first.
+func handleDeviceTrash(c *gin.Context) {
+	q := DB.Unscoped().Model(&models.Device{}).Where("deleted_at IS NOT NULL")
+	if groups := deviceGroups(c); groups != nil {
+		names := make([]string, 0, len(groups))
+		for g := range groups {
+			names = append(names, g)
+		}
+		q = q.Where(map[string]any{"group": names})
+	}
+	devices := []models.Device{}
+	if err := q.Order("deleted_at DESC").Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": devices})
+}
+
+// trashedDevice loads the deleted device named by the :id parameter,
+// answering 404 for unknown or live devices and 403 for devices outside the
+// request's groups.
+func trashedDevice(c *gin.Context) (*models.Device, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var dev models.Device
+	if err := DB.Unscoped().Where("deleted_at IS NOT NULL").First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not in the trash"})
+		return nil, false
+	}
+	if groups := deviceGroups(c); groups != nil && !groups[dev.Group] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return nil, false
+	}
+	return &dev, true
+}
+
+// handleDeviceRestore takes a device out of the trash.
+func handleDeviceRestore(c *gin.Context) {
+	dev, ok := trashedDevice(c)
+	if !ok {
+		return
+	}
+	if err := reviveDevice(dev, "restored from the trash"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": dev})
+}
+
+// handleDevicePurge deletes a device in the trash for good, with its
+// metrics and everything else stored about it.
+func handleDevicePurge(c *gin.Context) {
+	dev, ok := trashedDevice(c)
+	if !ok {
+		return
+	}
+	if err := purgeDevice(dev.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": dev.ID})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/devprobe"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Device probe limits: each port check and request gets devProbeTimeout.
+const (
+	devProbeTimeout = 3 * time.Second
+	devProbeWorkers = 4
+)
+
+// devProbeClient talks IPP and ONVIF to LAN devices; neither follows
+// redirects.
+var devProbeClient = &http.Client{
+	Timeout: devProbeTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// RunDeviceProbes probes the printers and cameras among the devices each
+// interval. Only one instance probes. It never returns.
+func RunDeviceProbes(interval time.Duration) {
+	for {
+		if leads("devprobe", interval) {
+			probeDevices()
+		}
+		time.Sleep(interval)
+	}
+}
+
+func probeDevices() {
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		log.Printf("[devprobe] load devices: %v", err)
+		return
+	}
+	work := make(chan *models.Device)
+	var wg sync.WaitGroup
+	for i := 0; i < devProbeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				if _, err := ProbeDevice(d); err != nil {
+					log.Printf("[devprobe] device %d: %v", d.ID, err)
+				}
+			}
+		}()
+	}
+	for i := range devices {
+		work <- &devices[i]
+	}
+	close(work)
+	wg.Wait()
+}
+
+// ProbeDevice runs the probes that fit dev: IPP when it listens on the IPP
+// port, RTSP / ONVIF when it listens on the RTSP port. The results are
+// stored as the device's custom metrics "printer" and "camera"; nil when
+// the device is neither.
+func ProbeDevice(d *models.Device) (map[string]json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results := map[string]any{}
+	if devprobe.PortOpen(ctx, d.IP, devprobe.IPPPort, devProbeTimeout) {
+		p, err := devprobe.ProbePrinter(ctx, devProbeClient, d.IP)
+		if err != nil {
+			results["printer"] = gin.H{"error": err.Error()}
+		} else {
+			results["printer"] = p
+		}
+	}
+	if devprobe.PortOpen(ctx, d.IP, devprobe.RTSPPort, devProbeTimeout) {
+		results["camera"] = devprobe.ProbeCamera(ctx, devProbeClient, d.IP, devProbeTimeout)
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	extra := make(map[string]json.RawMessage, len(results))
+	for k, v := range results {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		extra[k] = raw
+	}
+	// Schema version 0 marks rows from server probes rather than agents.
+	return extra, SaveCustomMetrics(d.ID, 0, extra)
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleHealthProbe runs the printer and camera probes on a device now.
+func handleHealthProbe(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var d models.Device
+	if err := DB.First(&d, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	res, err := ProbeDevice(&d)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if res == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no printer or camera service found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": res})
+}
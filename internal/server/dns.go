@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// dnsHistoryWindow bounds how long DNS checks are kept per device.
+const dnsHistoryWindow = 24 * time.Hour
+
+// SaveDNSSamples persists one report's worth of DNS checks for a device and
+// prunes samples older than dnsHistoryWindow.
+func SaveDNSSamples(deviceID uint, samples []models.DNSSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range samples {
+		samples[i].ID = 0
+		samples[i].DeviceID = deviceID
+		samples[i].ReportedAt = now
+	}
+	if err := DB.Create(&samples).Error; err != nil {
+		return err
+	}
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-dnsHistoryWindow)).
+		Delete(&models.DNSSample{})
+	return nil
+}
+
+// handleDeviceDNS returns the DNS check history of a device, oldest first.
+// ?name= and ?server= narrow it to one name / resolver ("system" for the
+// host's own) and ?from= / ?to= (RFC 3339 or unix seconds) to a time range
+// within the retained window.
+func handleDeviceDNS(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	q := DB.Where("device_id = ?", id)
+	for _, col := range []string{"name", "server"} {
+		if v := c.Query(col); v != "" {
+			q = q.Where(col+" = ?", v)
+		}
+	}
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			ts, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("reported_at "+op+" ?", ts)
+		}
+	}
+	list := []models.DNSSample{}
+	if err := q.Order("reported_at, name, server").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,669 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/config"
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Statuses of a DoctorCheck.
+const (
+	DoctorOK      = "ok"
+	DoctorWarning = "warning"
+	DoctorError   = "error"
+	DoctorSkipped = "skipped"
+)
+
+// certWarnBefore is how close to expiry a certificate gets a warning.
+const certWarnBefore = 14 * 24 * time.Hour
+
+// doctorTimeout bounds each network probe of the doctor.
+const doctorTimeout = 5 * time.Second
+
+// DoctorCheck is one finding of `opentalon doctor`.
+type DoctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// DoctorReport is the outcome of RunDoctor, with enough about the host to
+// make sense of it in a bug report.
+type DoctorReport struct {
+	Version    string        `json:"version"`
+	GoVersion  string        `json:"go_version"`
+	OS         string        `json:"os"`
+	Arch       string        `json:"arch"`
+	Hostname   string        `json:"hostname"`
+	Time       time.Time     `json:"time"`
+	ConfigFile string        `json:"config_file"`
+	Checks     []DoctorCheck `json:"checks"`
+}
+
+// DoctorOptions are what RunDoctor needs from outside the server package.
+type DoctorOptions struct {
+	Version string
+	// ClockOffset measures the local clock against an NTP server; the
+	// clock check is skipped when nil.
+	ClockOffset func(server string) (time.Duration, error)
+}
+
+func (r *DoctorReport) add(name, status, format string, args ...any) {
+	r.Checks = append(r.Checks, DoctorCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// Failed reports whether any check found an error.
+func (r *DoctorReport) Failed() bool {
+	return slices.ContainsFunc(r.Checks, func(c DoctorCheck) bool { return c.Status == DoctorError })
+}
+
+// Print writes the report for a terminal.
+func (r *DoctorReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "OpenTalon %s (%s, %s/%s) on %s at %s\n", r.Version, r.GoVersion, r.OS, r.Arch, r.Hostname, r.Time.Format(time.RFC3339))
+	cf := r.ConfigFile
+	if cf == "" {
+		cf = "(none, defaults and TALON_* environment)"
+	}
+	fmt.Fprintf(w, "Config: %s\n\n", cf)
+	marks := map[string]string{DoctorOK: "✓", DoctorWarning: "!", DoctorError: "✗", DoctorSkipped: "-"}
+	counts := map[string]int{}
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "  %s %-12s %s\n", marks[c.Status], c.Name, c.Message)
+		counts[c.Status]++
+	}
+	fmt.Fprintf(w, "\n%d ok, %d warnings, %d errors, %d skipped\n",
+		counts[DoctorOK], counts[DoctorWarning], counts[DoctorError], counts[DoctorSkipped])
+}
+
+// RunDoctor checks a server installation: the configuration, whether the
+// ports can be bound, the database, the data plane as an agent would reach
+// it, the clock and the certificates of the HTTPS endpoints in the config.
+// loadErr is the error loading the config, if any; cfg then holds the
+// defaults. It only reads: the database is neither created nor migrated.
+func RunDoctor(cfg *config.Config, loadErr error, opts DoctorOptions) *DoctorReport {
+	host, _ := os.Hostname()
+	r := &DoctorReport{
+		Version: opts.Version, GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH,
+		Hostname: host, Time: time.Now(), ConfigFile: config.File(),
+	}
+	if loadErr != nil {
+		r.add("config", DoctorError, "%v (the other checks use the defaults)", loadErr)
+	} else {
+		doctorConfig(r, cfg)
+	}
+	running := doctorPorts(r, cfg)
+	fingerprint := doctorDatabase(r, cfg)
+	doctorDataPlane(r, cfg, running, fingerprint)
+	doctorClock(r, cfg, opts.ClockOffset)
+	doctorCertificates(r, cfg)
+	return r
+}
+
+// doctorConfig checks the config file for unknown keys and the values the
+// server would refuse at startup, and warns about built-in credentials.
+func doctorConfig(r *DoctorReport, cfg *config.Config) {
+	problems := 0
+	bad := func(format string, args ...any) {
+		r.add("config", DoctorError, format, args...)
+		problems++
+	}
+
+	if f := config.File(); f != "" {
+		if b, err := os.ReadFile(f); err == nil {
+			var m map[string]any
+			if err := yaml.Unmarshal(b, &m); err != nil {
+				bad("%s: %v", f, err)
+			}
+			known := map[string]bool{}
+			for _, k := range config.Keys() {
+				known[k] = true
+			}
+			var unknown []string
+			for k := range m {
+				if !known[k] {
+					unknown = append(unknown, k)
+				}
+			}
+			if len(unknown) > 0 {
+				slices.Sort(unknown)
+				r.add("config", DoctorWarning, "unknown keys (ignored): %s", strings.Join(unknown, ", "))
+			}
+		}
+	}
+
+	for _, p := range []struct {
+		key  string
+		port int
+	}{{"control_port", cfg.ControlPort}, {"data_port", cfg.DataPort}} {
+		if p.port < 1 || p.port > 65535 {
+			bad("%s %d is not a valid port", p.key, p.port)
+		}
+	}
+	if cfg.ControlPort == cfg.DataPort {
+		bad("control_port and data_port are both %d", cfg.ControlPort)
+	}
+	if _, err := openDialector(cfg.DBDriver, cfg.DBDSN); err != nil {
+		bad("%v", err)
+	}
+	switch cfg.MetricsDriver {
+	case "", "db", "clickhouse":
+	default:
+		bad("unsupported metrics_driver %q (use 'db' or 'clickhouse')", cfg.MetricsDriver)
+	}
+	if cfg.FederationUpstream != "" && cfg.FederationToken == "" {
+		bad("federation_upstream requires federation_token")
+	}
+	for _, s := range cfg.AlertRules {
+		if _, err := ParseAlertRule(s); err != nil {
+			bad("alert_rules: %v", err)
+		}
+	}
+	// The setters validate while they apply; doctor runs in its own process,
+	// so applying is harmless.
+	for _, err := range []error{
+		SetUsers(cfg.Users),
+		SetDataPlaneAccess(cfg.DataAllowlist, cfg.DataIPBinding),
+		SetWebhooks(cfg.Webhooks, cfg.WebhookTemplate),
+		SetEmailChannels(SMTPConfig{Host: cfg.SMTPHost, Port: cfg.SMTPPort, User: cfg.SMTPUser, Pass: cfg.SMTPPass, From: cfg.SMTPFrom}, cfg.EmailChannels),
+		SetTelegram(cfg.TelegramBotToken, cfg.TelegramAPIURL, cfg.TelegramChannels),
+		proxy.Configure(cfg.HTTPProxy, cfg.HTTPSProxy, cfg.NoProxy, cfg.ProxyRules),
+	} {
+		if err != nil {
+			bad("%v", err)
+		}
+	}
+	for _, tp := range []struct {
+		key  string
+		list []string
+	}{{"data_trusted_proxies", cfg.DataTrustedProxies}, {"control_trusted_proxies", cfg.ControlTrustedProxies}} {
+		for _, p := range tp.list {
+			if net.ParseIP(p) == nil {
+				if _, _, err := net.ParseCIDR(p); err != nil {
+					bad("%s: %q is not an address or CIDR", tp.key, p)
+				}
+			}
+		}
+	}
+	if problems == 0 {
+		r.add("config", DoctorOK, "valid")
+	}
+
+	def, _ := config.FromMap(nil)
+	if def != nil && cfg.JWTSecret == def.JWTSecret {
+		r.add("security", DoctorWarning, "jwt_secret is the built-in default; anyone can forge a login")
+	}
+	if cfg.AgentToken == defaultAgentToken {
+		r.add("security", DoctorWarning, "agent_token is the built-in default; anyone can report as an agent")
+	}
+	if cfg.AdminPass == "admin" {
+		r.add("security", DoctorWarning, "admin_pass is the built-in default")
+	}
+}
+
+// doctorPorts checks that the control and data ports can be bound. A port
+// taken by a running OpenTalon server is fine; it reports whether one is
+// running.
+func doctorPorts(r *DoctorReport, cfg *config.Config) (running bool) {
+	for _, p := range []struct {
+		name, health string
+		port         int
+	}{{"control port", "/api/health", cfg.ControlPort}, {"data port", "/healthz", cfg.DataPort}} {
+		addr := net.JoinHostPort(cfg.ServerHost, strconv.Itoa(p.port))
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			ln.Close()
+			r.add(p.name, DoctorOK, "%s is free", addr)
+			continue
+		}
+		if _, ok := doctorHealth(net.JoinHostPort("127.0.0.1", strconv.Itoa(p.port)), p.health); ok {
+			r.add(p.name, DoctorOK, "%s is in use by a running OpenTalon server", addr)
+			running = true
+			continue
+		}
+		r.add(p.name, DoctorError, "cannot listen on %s: %v", addr, err)
+	}
+	return running
+}
+
+// doctorClient talks plain HTTP to this server's ports, bypassing the proxy
+// settings.
+var doctorClient = &http.Client{Timeout: doctorTimeout, Transport: &http.Transport{Proxy: nil}}
+
+// doctorHealth asks an OpenTalon health endpoint at addr for the server
+// fingerprint; ok is false when no OpenTalon server answers.
+func doctorHealth(addr, path string) (fingerprint string, ok bool) {
+	resp, err := doctorClient.Get("http://" + addr + path)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status      string `json:"status"`
+		Fingerprint string `json:"fingerprint"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil || body.Status != "ok" {
+		return "", false
+	}
+	return body.Fingerprint, true
+}
+
+// doctorDatabase opens the database read-only in spirit (no migration,
+// no fingerprint written) and reports its size and the device count. It
+// returns the server fingerprint stored there, if any.
+func doctorDatabase(r *DoctorReport, cfg *config.Config) (fingerprint string) {
+	var where string
+	var files []string
+	dsn := cfg.DBDSN
+	if cfg.DBDriver == "" || cfg.DBDriver == "sqlite" {
+		path, err := SQLitePath(cfg)
+		if err != nil {
+			r.add("database", DoctorError, "%v", err)
+			return ""
+		}
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			r.add("database", DoctorWarning, "sqlite %s does not exist yet; the server creates it on first start", path)
+			return ""
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			r.add("database", DoctorError, "sqlite %s is not writable: %v", path, err)
+			return ""
+		}
+		f.Close()
+		dsn, where = path, "sqlite "+path
+		files = []string{path, path + "-wal", path + "-shm"}
+	} else {
+		where = "mysql"
+	}
+	d, err := openDialector(cfg.DBDriver, dsn)
+	if err != nil {
+		r.add("database", DoctorError, "%v", err)
+		return ""
+	}
+	db, err := gorm.Open(d, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		r.add("database", DoctorError, "%s: %v", where, err)
+		return ""
+	}
+	sqlDB, err := db.DB()
+	if err == nil {
+		defer sqlDB.Close()
+		err = sqlDB.Ping()
+	}
+	if err != nil {
+		r.add("database", DoctorError, "%s: %v", where, err)
+		return ""
+	}
+
+	var size int64
+	if files != nil {
+		for _, f := range files {
+			if fi, err := os.Stat(f); err == nil {
+				size += fi.Size()
+			}
+		}
+	} else {
+		db.Raw("SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()").Scan(&size)
+	}
+	msg := fmt.Sprintf("%s, %.1f MiB", where, float64(size)/(1<<20))
+	status := DoctorOK
+	var devices int64
+	if err := db.Model(&models.Device{}).Count(&devices).Error; err != nil {
+		msg += ", no devices table yet"
+	} else {
+		msg += fmt.Sprintf(", devices: %d", devices)
+	}
+	if files != nil {
+		var check string
+		if err := db.Raw("PRAGMA quick_check").Scan(&check).Error; err != nil || check != "ok" {
+			status = DoctorError
+			msg += fmt.Sprintf(", integrity check failed: %s%v", check, errOrNil(err))
+		} else {
+			msg += ", integrity ok"
+		}
+	}
+	r.add("database", status, "%s", msg)
+
+	var s models.Setting
+	if db.Where(&models.Setting{Key: fingerprintKey}).Take(&s).Error == nil {
+		fingerprint = s.Value
+	}
+	return fingerprint
+}
+
+// errOrNil renders err for appending to a message, nothing when nil.
+func errOrNil(err error) string {
+	if err == nil {
+		return ""
+	}
+	return " " + err.Error()
+}
+
+// doctorDataPlane reaches the data plane the way agents do: at
+// agent_join_addr when it names a remote host, else at this host's LAN
+// addresses. It checks
+// that this server answers there and accepts agent_token.
+func doctorDataPlane(r *DoctorReport, cfg *config.Config, running bool, fingerprint string) {
+	if !running {
+		r.add("data plane", DoctorSkipped, "no server running here to reach")
+		return
+	}
+	// A loopback agent_join_addr (the default) only serves local agents.
+	var addrs []string
+	host, _, _ := net.SplitHostPort(cfg.AgentJoinAddr)
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsLoopback()) {
+		addrs = []string{cfg.AgentJoinAddr}
+	} else {
+		addrs = doctorLANAddrs(cfg.DataPort)
+	}
+	if len(addrs) == 0 {
+		r.add("data plane", DoctorWarning, "this host has no LAN address agents could reach")
+		return
+	}
+	for _, addr := range addrs {
+		fp, ok := doctorHealth(addr, "/healthz")
+		switch {
+		case !ok:
+			r.add("data plane", DoctorError, "%s: no OpenTalon server answers (firewall, server_host or data_allowlist?)", addr)
+			continue
+		case fingerprint != "" && fp != fingerprint:
+			r.add("data plane", DoctorWarning, "%s is another OpenTalon server (fingerprint %s, this one %s)", addr, fp, fingerprint)
+			continue
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/api/speedtest/download?bytes=0", nil)
+		req.Header.Set("Authorization", "Bearer "+cfg.AgentToken)
+		resp, err := doctorClient.Do(req)
+		if err != nil {
+			r.add("data plane", DoctorError, "%s: %v", addr, err)
+			continue
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			r.add("data plane", DoctorOK, "%s reachable, agent_token accepted", addr)
+		case http.StatusUnauthorized:
+			r.add("data plane", DoctorError, "%s rejects agent_token; the running server uses another one", addr)
+		default:
+			r.add("data plane", DoctorError, "%s: agent request got %s", addr, resp.Status)
+		}
+	}
+}
+
+// doctorLANAddrs returns addr:port for the first few non-loopback IPv4
+// addresses of this host's up interfaces.
+func doctorLANAddrs(port int) []string {
+	ifaces, _ := net.Interfaces()
+	var out []string
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil && !ipn.IP.IsLinkLocalUnicast() {
+				out = append(out, net.JoinHostPort(ipn.IP.String(), strconv.Itoa(port)))
+			}
+		}
+		if len(out) >= 3 {
+			break
+		}
+	}
+	return out
+}
+
+// doctorClock compares the local clock with agent_ntp_server against
+// clock_drift_threshold_ms, the threshold the server flags devices by.
+func doctorClock(r *DoctorReport, cfg *config.Config, offset func(string) (time.Duration, error)) {
+	if offset == nil || cfg.AgentNTPServer == "" {
+		r.add("clock", DoctorSkipped, "no agent_ntp_server configured")
+		return
+	}
+	off, err := offset(cfg.AgentNTPServer)
+	if err != nil {
+		r.add("clock", DoctorWarning, "could not query %s: %v", cfg.AgentNTPServer, err)
+		return
+	}
+	ms := float64(off) / float64(time.Millisecond)
+	if limit := cfg.ClockDriftThresholdMs; limit > 0 && (ms > limit || ms < -limit) {
+		r.add("clock", DoctorWarning, "%+.0f ms off %s (threshold %.0f ms); metrics timestamps and JWT expiry are affected", ms, cfg.AgentNTPServer, limit)
+		return
+	}
+	r.add("clock", DoctorOK, "%+.0f ms off %s", ms, cfg.AgentNTPServer)
+}
+
+// doctorCertificates checks the certificates of the HTTPS endpoints and
+// the SMTP server of the config for validity and upcoming expiry.
+func doctorCertificates(r *DoctorReport, cfg *config.Config) {
+	type endpoint struct{ key, raw string }
+	eps := []endpoint{
+		{"federation_upstream", cfg.FederationUpstream},
+		{"influx_url", cfg.InfluxURL},
+		{"otlp_endpoint", cfg.OTLPEndpoint},
+		{"tracing_otlp_endpoint", cfg.TracingEndpoint},
+		{"speedtest_public_download_url", cfg.SpeedTestPublicDownloadURL},
+		{"speedtest_public_upload_url", cfg.SpeedTestPublicUploadURL},
+	}
+	if len(cfg.TelegramChannels) > 0 {
+		eps = append(eps, endpoint{"telegram_api_url", cfg.TelegramAPIURL})
+	}
+	for _, w := range cfg.Webhooks {
+		name, raw, _ := strings.Cut(w, "=")
+		eps = append(eps, endpoint{"webhook " + name, raw})
+	}
+
+	checked := map[string]bool{}
+	for _, ep := range eps {
+		u, err := url.Parse(ep.raw)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			continue
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		if checked[addr] {
+			continue
+		}
+		checked[addr] = true
+		doctorCert(r, ep.key, addr, u.Hostname(), false)
+	}
+	if cfg.SMTPHost != "" && len(cfg.EmailChannels) > 0 {
+		addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+		doctorCert(r, "smtp_host", addr, cfg.SMTPHost, cfg.SMTPPort != 465)
+		checked[addr] = true
+	}
+	if len(checked) == 0 {
+		r.add("certificate", DoctorSkipped, "no HTTPS or SMTP endpoints configured")
+	}
+}
+
+// doctorCert reports the certificate that addr presents for host. With
+// starttls the connection is upgraded from plain SMTP first.
+func doctorCert(r *DoctorReport, key, addr, host string, starttls bool) {
+	conn, err := net.DialTimeout("tcp", addr, doctorTimeout)
+	if err != nil {
+		r.add("certificate", DoctorWarning, "%s %s: %v", key, addr, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(doctorTimeout))
+	if starttls {
+		if err := doctorStartTLS(conn); err != nil {
+			r.add("certificate", DoctorWarning, "%s %s: STARTTLS: %v", key, addr, err)
+			return
+		}
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tc.Handshake(); err != nil {
+		var inv x509.CertificateInvalidError
+		if errors.As(err, &inv) && inv.Reason == x509.Expired {
+			r.add("certificate", DoctorError, "%s %s: the certificate expired on %s", key, addr, inv.Cert.NotAfter.Format(time.DateOnly))
+			return
+		}
+		r.add("certificate", DoctorError, "%s %s: %v", key, addr, err)
+		return
+	}
+	cert := tc.ConnectionState().PeerCertificates[0]
+	left := time.Until(cert.NotAfter)
+	days := int(left.Hours() / 24)
+	if left < certWarnBefore {
+		r.add("certificate", DoctorWarning, "%s %s expires on %s, in %d days", key, addr, cert.NotAfter.Format(time.DateOnly), days)
+		return
+	}
+	r.add("certificate", DoctorOK, "%s %s valid until %s (%d days)", key, addr, cert.NotAfter.Format(time.DateOnly), days)
+}
+
+// doctorStartTLS runs the SMTP dialogue up to STARTTLS on conn.
+func doctorStartTLS(conn net.Conn) error {
+	buf := make([]byte, 4096)
+	// expect reads one (possibly multi-line) reply and checks its code.
+	expect := func(code string) error {
+		var reply []byte
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			reply = append(reply, buf[:n]...)
+			lines := strings.Split(strings.TrimRight(string(reply), "\r\n"), "\r\n")
+			if last := lines[len(lines)-1]; bytes.HasSuffix(reply, []byte("\r\n")) && len(last) >= 4 && last[3] == ' ' {
+				if !strings.HasPrefix(last, code) {
+					return fmt.Errorf("server said %q", last)
+				}
+				return nil
+			}
+		}
+	}
+	if err := expect("220"); err != nil {
+		return err
+	}
+	for _, step := range []struct{ cmd, code string }{{"EHLO opentalon-doctor", "250"}, {"STARTTLS", "220"}} {
+		if _, err := conn.Write([]byte(step.cmd + "\r\n")); err != nil {
+			return err
+		}
+		if err := expect(step.code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Patterns scrubbed from the log in a diagnostics bundle besides the
+// configured secrets: JWTs and API tokens.
+var (
+	jwtPattern      = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	apiTokenPattern = regexp.MustCompile(`otk_[A-Za-z0-9]+`)
+)
+
+// maxBundleLog is how much of the end of log_file a bundle includes.
+const maxBundleLog = 1 << 20
+
+// WriteDoctorBundle writes a diagnostics bundle for bug reports to path: a
+// tar.gz with the report (text and JSON), the config with its secrets
+// masked and the end of log_file with secrets and tokens scrubbed.
+func WriteDoctorBundle(path string, r *DoctorReport, cfg *config.Config) error {
+	var text bytes.Buffer
+	r.Print(&text)
+	js, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	conf, err := yaml.Marshal(config.Redacted(cfg))
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{{"report.txt", text.Bytes()}, {"report.json", js}, {"config.yaml", conf}}
+	if cfg.LogFile != "" {
+		if tail, err := logTail(cfg.LogFile, maxBundleLog); err == nil {
+			files = append(files, struct {
+				name string
+				data []byte
+			}{"server.log", scrubSecrets(tail, config.Secrets(cfg))})
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		hdr := &tar.Header{Name: "opentalon-doctor/" + file.name, Mode: 0o600, Size: int64(len(file.data)), ModTime: r.Time}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = tw.Write(file.data); err != nil {
+			break
+		}
+	}
+	for _, c := range []io.Closer{tw, gz, f} {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// logTail returns up to limit bytes from the end of the file at path,
+// starting at a line boundary.
+func logTail(path string, limit int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start := max(fi.Size()-limit, 0)
+	b := make([]byte, fi.Size()-start)
+	if _, err := f.ReadAt(b, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if start > 0 {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	return b, nil
+}
+
+// scrubSecrets replaces the secrets, JWTs and API tokens in b.
+func scrubSecrets(b []byte, secrets []string) []byte {
+	for _, s := range secrets {
+		if len(s) >= 4 {
+			b = bytes.ReplaceAll(b, []byte(s), []byte("xxxxx"))
+		}
+	}
+	b = jwtPattern.ReplaceAll(b, []byte("xxxxx"))
+	return apiTokenPattern.ReplaceAll(b, []byte("otk_xxxxx"))
+}
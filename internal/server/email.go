@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// SMTPConfig is the mail server alert emails go through. Port 465 uses
+// implicit TLS; other ports upgrade with STARTTLS when the server offers it.
+type SMTPConfig struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	From string
+}
+
+var smtpConfig SMTPConfig
+
+// SetEmailChannels installs the email channels: specs are
+// "name=addr[,addr…]", each a notification channel sending to its
+// recipients through smtp.
+func SetEmailChannels(cfg SMTPConfig, specs []string) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	if cfg.Host == "" {
+		return fmt.Errorf("email_channels need smtp_host")
+	}
+	if cfg.From == "" {
+		cfg.From = cfg.User
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return fmt.Errorf("smtp_from %q: %w", cfg.From, err)
+	}
+	smtpConfig = cfg
+	for _, spec := range specs {
+		name, list, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("email channel %q: want name=addr[,addr…]", spec)
+		}
+		addrs, err := mail.ParseAddressList(list)
+		if err != nil {
+			return fmt.Errorf("email channel %q: %w", name, err)
+		}
+		e := &emailChannel{}
+		for _, a := range addrs {
+			e.to = append(e.to, a.Address)
+		}
+		if err := addNotifier(name, e); err != nil {
+			return fmt.Errorf("email channel %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// emailChannel mails notifications to its recipients.
+type emailChannel struct {
+	to []string
+}
+
+func (e *emailChannel) send(n *Notification) error {
+	var body bytes.Buffer
+	if err := alertEmailTmpl.Execute(&body, n); err != nil {
+		return fmt.Errorf("rendering email: %v: %w", err, errPermanent)
+	}
+	subject := fmt.Sprintf("[OpenTalon] %s %s: %s", strings.ToUpper(n.Status), n.Severity, n.Message)
+	return sendMail(e.to, subject, body.Bytes())
+}
+
+// sendMail sends an HTML message. SMTP 5xx replies are permanent failures.
+func sendMail(to []string, subject string, html []byte) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpConfig.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.Write(html)
+
+	err := smtpSend(to, msg.Bytes())
+	var perr *textproto.Error
+	if errors.As(err, &perr) && perr.Code >= 500 {
+		return fmt.Errorf("%v: %w", err, errPermanent)
+	}
+	return err
+}
+
+func smtpSend(to []string, msg []byte) error {
+	addr := net.JoinHostPort(smtpConfig.Host, strconv.Itoa(smtpConfig.Port))
+	tlsConfig := &tls.Config{ServerName: smtpConfig.Host}
+	var conn net.Conn
+	var err error
+	if smtpConfig.Port == 465 {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 15 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 15*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, smtpConfig.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if smtpConfig.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", smtpConfig.User, smtpConfig.Pass, smtpConfig.Host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(smtpConfig.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// ── Daily digest ─────────────────────────────────────────────────────────────
+
+// digestSentKey is the Setting holding the date of the last digest, so a
+// restart or a second instance does not send it twice.
+const digestSentKey = "email_digest_sent"
+
+// Digest is the daily summary mailed to every email channel.
+type Digest struct {
+	Since   time.Time
+	Firing  []DigestAlert // still firing
+	Fired   []DigestAlert // fired in the last 24 hours
+	Offline []string      // agent devices offline now
+}
+
+// DigestAlert is an alert with its device name.
+type DigestAlert struct {
+	models.Alert
+	Device string
+}
+
+// RunEmailDigest mails the digest once a day at hour (local time) to the
+// recipients of every email channel. It never returns.
+func RunEmailDigest(hour int) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for now := range tick.C {
+		if now.Hour() != hour || !leads("digest", 5*time.Minute) {
+			continue
+		}
+		today := now.Format("2006-01-02")
+		var s models.Setting
+		if DB.Where(&models.Setting{Key: digestSentKey}).Take(&s).Error == nil && s.Value == today {
+			continue
+		}
+		if err := sendDigest(now); err != nil {
+			log.Printf("[email] digest: %v", err)
+			continue
+		}
+		DB.Save(&models.Setting{Key: digestSentKey, Value: today})
+	}
+}
+
+func sendDigest(now time.Time) error {
+	d := Digest{Since: now.Add(-24 * time.Hour)}
+	names := map[uint]string{}
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		return err
+	}
+	for i := range devices {
+		names[devices[i].ID] = deviceName(&devices[i])
+		if !devices[i].IsOnline && devices[i].AgentVer != "discovered" {
+			d.Offline = append(d.Offline, names[devices[i].ID])
+		}
+	}
+	var alerts []models.Alert
+	if err := DB.Where("status = ? OR fired_at >= ?", models.AlertFiring, d.Since).
+		Order("fired_at desc").Find(&alerts).Error; err != nil {
+		return err
+	}
+	for _, a := range alerts {
+		da := DigestAlert{Alert: a, Device: names[a.DeviceID]}
+		if a.Status == models.AlertFiring {
+			d.Firing = append(d.Firing, da)
+		}
+		if !a.FiredAt.Before(d.Since) {
+			d.Fired = append(d.Fired, da)
+		}
+	}
+
+	var body bytes.Buffer
+	if err := digestEmailTmpl.Execute(&body, d); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	var to []string
+	notifiers.RLock()
+	for _, n := range notifiers.byName {
+		if e, ok := n.(*emailChannel); ok {
+			for _, addr := range e.to {
+				if !seen[addr] {
+					seen[addr] = true
+					to = append(to, addr)
+				}
+			}
+		}
+	}
+	notifiers.RUnlock()
+	if len(to) == 0 {
+		return nil
+	}
+	subject := fmt.Sprintf("[OpenTalon] Daily digest: %d firing, %d fired, %d offline", len(d.Firing), len(d.Fired), len(d.Offline))
+	return sendMail(to, subject, body.Bytes())
+}
+
+// ── Templates ────────────────────────────────────────────────────────────────
+
+var emailFuncs = template.FuncMap{
+	"time": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+	"color": func(status, severity string) string {
+		switch {
+		case status == models.AlertResolved:
+			return "#2e7d32"
+		case severity == models.SeverityCritical:
+			return "#c62828"
+		case severity == models.SeverityWarning:
+			return "#ef6c00"
+		}
+		return "#1565c0"
+	},
+}
+
+var alertEmailTmpl = template.Must(template.New("alert").Funcs(emailFuncs).Parse(`<!DOCTYPE html>
+<html><body style="font-family:sans-serif;font-size:14px">
+<h2 style="color:{{color .Status .Severity}}">{{.Status}} · {{.Severity}}</h2>
+<p>{{.Message}}</p>
+<table cellpadding="4" style="border-collapse:collapse">
+<tr><td><b>Rule</b></td><td>{{.Rule}}</td></tr>
+<tr><td><b>Device</b></td><td>{{.Device}} ({{.IP}}){{if .Group}} · {{.Group}}{{end}}</td></tr>
+<tr><td><b>Condition</b></td><td>{{.Metric}}{{if .Operator}} {{.Operator}} {{.Threshold}}{{end}}</td></tr>
+<tr><td><b>Value</b></td><td>{{printf "%.2f" .Value}}</td></tr>
+<tr><td><b>Fired</b></td><td>{{time .FiredAt}}</td></tr>
+{{if .ResolvedAt}}<tr><td><b>Resolved</b></td><td>{{time .ResolvedAt}}</td></tr>{{end}}
+</table>
+<p style="color:#888">Alert #{{.AlertID}} · OpenTalon</p>
+</body></html>
+`))
+
+var digestEmailTmpl = template.Must(template.New("digest").Funcs(emailFuncs).Parse(`<!DOCTYPE html>
+<html><body style="font-family:sans-serif;font-size:14px">
+<h2>OpenTalon daily digest</h2>
+<p>Since {{time .Since}}</p>
+{{define "alerts"}}<table cellpadding="4" border="1" style="border-collapse:collapse">
+<tr><th>Severity</th><th>Rule</th><th>Device</th><th>Fired</th><th>Resolved</th></tr>
+{{range .}}<tr><td style="color:{{color .Status .Severity}}">{{.Severity}}</td><td>{{.RuleName}}</td><td>{{.Device}}</td><td>{{time .FiredAt}}</td><td>{{if .ResolvedAt}}{{time .ResolvedAt}}{{else}}—{{end}}</td></tr>
+{{end}}</table>{{end}}
+<h3>Firing now ({{len .Firing}})</h3>
+{{if .Firing}}{{template "alerts" .Firing}}{{else}}<p>None.</p>{{end}}
+<h3>Fired in the last 24 hours ({{len .Fired}})</h3>
+{{if .Fired}}{{template "alerts" .Fired}}{{else}}<p>None.</p>{{end}}
+<h3>Offline devices ({{len .Offline}})</h3>
+{{if .Offline}}<ul>{{range .Offline}}<li>{{.}}</li>{{end}}</ul>{{else}}<p>None.</p>{{end}}
+</body></html>
+`))
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// escalationStep sends a still unacknowledged alert to channel once it has
+// notified for after.
+type escalationStep struct {
+	channel string
+	after   time.Duration
+}
+
+// parseEscalation parses a rule's escalation, "channel:delay" steps
+// separated by commas with increasing delays, e.g. "oncall:15m,manager:1h".
+func parseEscalation(s string) ([]escalationStep, error) {
+	var steps []escalationStep
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, delay, ok := strings.Cut(part, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("escalation step %q: want channel:delay", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(delay))
+		if err != nil {
+			return nil, fmt.Errorf("escalation step %q: %w", part, err)
+		}
+		if d <= 0 || len(steps) > 0 && d <= steps[len(steps)-1].after {
+			return nil, fmt.Errorf("escalation step %q: delays must be positive and increasing", part)
+		}
+		steps = append(steps, escalationStep{channel: name, after: d})
+	}
+	return steps, nil
+}
+
+// escalateAlerts sends each firing, unacknowledged alert to its next
+// escalation channel once that step's delay has passed.
+func escalateAlerts(now time.Time) {
+	var alerts []models.Alert
+	if err := DB.Where("status = ? AND acked_at IS NULL AND notified_at IS NOT NULL AND escalation <> ?", models.AlertFiring, "").
+		Find(&alerts).Error; err != nil {
+		log.Printf("[alerts] load alerts to escalate: %v", err)
+		return
+	}
+	for i := range alerts {
+		a := &alerts[i]
+		steps, err := parseEscalation(a.Escalation)
+		if err != nil || a.Escalations >= len(steps) || now.Sub(*a.NotifiedAt) < steps[a.Escalations].after {
+			continue
+		}
+		step := steps[a.Escalations]
+		// Another instance, or an ack, may have got there first.
+		res := DB.Model(a).Where("escalations = ? AND acked_at IS NULL", a.Escalations).Update("escalations", a.Escalations+1)
+		if res.Error != nil || res.RowsAffected == 0 {
+			continue
+		}
+		a.Escalations++
+		msg := fmt.Sprintf("%s (unacknowledged for %s, escalated to %s)", a.Message, step.after, step.channel)
+		log.Printf("[alerts] ESCALATED %s", msg)
+		RecordEvent(a.DeviceID, models.EventAlertEscalated, msg,
+			map[string]any{"alert_id": a.ID, "rule": a.RuleName, "step": a.Escalations, "channel": step.channel})
+		recordAlertEvent(a, models.AlertEventEscalated, "", step.channel, msg)
+		notifyAlertVia(a, step.channel, msg, a.Escalations)
+	}
+}
+
+// notifyEscalated sends a resolved alert to the escalation channels it
+// reached, so whoever was paged also learns it is over.
+func notifyEscalated(a *models.Alert, message string) {
+	steps, _ := parseEscalation(a.Escalation)
+	for i := 0; i < a.Escalations && i < len(steps); i++ {
+		if steps[i].channel != a.Channel {
+			notifyAlertVia(a, steps[i].channel, message, i+1)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// RecordEvent appends an entry to the event timeline. deviceID 0 records a
+// fleet-wide event; data (optional) is stored as JSON. Failures are only
+// logged: events must never break the code path that emits them.
+func RecordEvent(deviceID uint, typ, message string, data map[string]any) {
+	ev := models.Event{Type: typ, Message: message}
+	if deviceID != 0 {
+		ev.DeviceID = &deviceID
+	}
+	if len(data) > 0 {
+		if b, err := json.Marshal(data); err == nil {
+			ev.Data = string(b)
+		}
+	}
+	if err := DB.Create(&ev).Error; err != nil {
+		log.Printf("[events] record %s for device %d: %v", typ, deviceID, err)
+		return
+	}
+	exportOTLPEvent(&ev)
+	if b, err := json.Marshal(ev); err == nil {
+		shared.Publish(topicEvents, b)
+	}
+}
+
+// deviceName is how events refer to a device: its remark, else hostname.
+func deviceName(d *models.Device) string {
+	if d.Remark != "" {
+		return d.Remark
+	}
+	return d.Hostname
+}
+
+// setParent moves dev under parentID (nil: make it a root) and records
+// parent_changed when that changes its place in the tree. source says who
+// decided: "agent", "gateway", "traceroute" or "manual"; only manual changes
+// apply to a device whose topology is locked.
+func setParent(dev *models.Device, parentID *uint, source string) {
+	if dev.TopologyLocked && source != "manual" {
+		return
+	}
+	old := dev.ParentID
+	if parentID == nil {
+		DB.Model(dev).Update("parent_id", nil)
+	} else {
+		DB.Model(dev).Update("parent_id", *parentID)
+	}
+	dev.ParentID = parentID
+	if old == nil && parentID == nil || old != nil && parentID != nil && *old == *parentID {
+		return
+	}
+	data := map[string]any{"from": old, "to": parentID, "source": source}
+	msg := deviceName(dev) + " is now a root device"
+	if parentID != nil {
+		var p models.Device
+		if DB.Select("id", "hostname", "remark").First(&p, *parentID).Error == nil {
+			msg = deviceName(dev) + " moved under " + deviceName(&p)
+		}
+	}
+	RecordEvent(dev.ID, models.EventParentChanged, msg+" ("+source+")", data)
+}
+
+// RenumberDevice moves the device at oldIP to newIP, keeping its history,
+// and records ip_changed. It does nothing when no device has oldIP or
+// another one already has newIP.
+func RenumberDevice(oldIP, newIP string) *models.Device {
+	var dev models.Device
+	if DB.Where("ip = ?", oldIP).First(&dev).Error != nil {
+		return nil
+	}
+	var taken int64 // devices in the trash keep their address too
+	if DB.Unscoped().Model(&models.Device{}).Where("ip = ?", newIP).Count(&taken); taken > 0 {
+		return nil
+	}
+	if !changeDeviceIP(&dev, newIP) {
+		return nil
+	}
+	return &dev
+}
+
+// changeDeviceIP moves dev to newIP and records ip_changed. Unlike
+// RenumberDevice it does not care whether another device has newIP: the
+// machine ID says which one the address belongs to now.
+func changeDeviceIP(dev *models.Device, newIP string) bool {
+	oldIP := dev.IP
+	if err := DB.Model(dev).Update("ip", newIP).Error; err != nil {
+		log.Printf("[events] renumber device %d %s → %s: %v", dev.ID, oldIP, newIP, err)
+		return false
+	}
+	dev.IP = newIP
+	RecordEvent(dev.ID, models.EventIPChanged, deviceName(dev)+" changed IP from "+oldIP+" to "+newIP,
+		map[string]any{"from": oldIP, "to": newIP})
+	return true
+}
+
+// handleListEvents returns the event timeline, newest first. Filters:
+// ?device_id=, ?type= (comma-separated), ?since= / ?until= (RFC 3339) and
+// ?limit= (default 100, at most 1000).
+func handleListEvents(c *gin.Context) {
+	q := DB.Order("id desc")
+	if v := c.Query("device_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+			return
+		}
+		q = q.Where("device_id = ?", id)
+	}
+	if v := c.Query("type"); v != "" {
+		q = q.Where("type IN ?", strings.Split(v, ","))
+	}
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	for param, cond := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param + ": want RFC 3339"})
+				return
+			}
+			q = q.Where(cond, t)
+		}
+	}
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = min(n, 1000)
+		}
+	}
+	list := []models.Event{}
+	if err := q.Limit(limit).Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// GET /api/events/stream serves the event timeline as Server-Sent Events
+// for clients without WebSockets (curl, shell scripts). Each event is sent
+// with its ID, so a client reconnecting with Last-Event-ID gets the ones it
+// missed first.
+const (
+	// streamBuffer is how many events may queue for a slow reader before
+	// it is dropped; it resumes by reconnecting with Last-Event-ID.
+	streamBuffer = 256
+	// streamReplay bounds how many missed events a resume replays.
+	streamReplay = 1000
+	// streamPing is how often an idle stream sends a comment, so proxies
+	// do not close it.
+	streamPing = 30 * time.Second
+)
+
+var streams = struct {
+	sync.Mutex
+	clients map[chan models.Event]struct{}
+}{clients: map[chan models.Event]struct{}{}}
+
+// streamEvent hands an event recorded on any instance to this instance's
+// SSE clients.
+func streamEvent(msg []byte) {
+	var ev models.Event
+	if err := json.Unmarshal(msg, &ev); err != nil {
+		log.Printf("[events] stream: %v", err)
+		return
+	}
+	streams.Lock()
+	defer streams.Unlock()
+	for ch := range streams.clients {
+		select {
+		case ch <- ev:
+		default:
+			delete(streams.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// streamFilter selects the events of one stream: ?device_id= and ?type=
+// (comma-separated) as for GET /api/events, and the device groups of a
+// restricted role, which only sees events of its devices.
+type streamFilter struct {
+	deviceID uint
+	types    []string
+	groups   map[string]bool
+}
+
+func (f *streamFilter) match(ev *models.Event) bool {
+	if f.deviceID != 0 && (ev.DeviceID == nil || *ev.DeviceID != f.deviceID) {
+		return false
+	}
+	if len(f.types) > 0 && !slices.Contains(f.types, ev.Type) {
+		return false
+	}
+	if f.groups != nil {
+		if ev.DeviceID == nil {
+			return false
+		}
+		var dev models.Device
+		if DB.Unscoped().Select("id", "group").First(&dev, *ev.DeviceID).Error != nil || !f.groups[dev.Group] {
+			return false
+		}
+	}
+	return true
+}
+
+// streamEventName is the SSE event field: "alert" for the alert transitions
+// (firing, acknowledged, escalated, resolved), "event" for the rest.
+func streamEventName(ev *models.Event) string {
+	if strings.HasPrefix(ev.Type, "alert_") {
+		return "alert"
+	}
+	return "event"
+}
+
+// handleEventStream streams events as they are recorded:
+// GET /api/events/stream?device_id=&type=. A Last-Event-ID header (or
+// ?last_event_id=) replays the events after that ID first.
+func handleEventStream(c *gin.Context) {
+	f := streamFilter{groups: deviceGroups(c)}
+	if v := c.Query("device_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+			return
+		}
+		f.deviceID = uint(id)
+	}
+	if v := c.Query("type"); v != "" {
+		f.types = strings.Split(v, ",")
+	}
+	var last uint64
+	v := c.GetHeader("Last-Event-ID")
+	if v == "" {
+		v = c.Query("last_event_id")
+	}
+	if v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		last = id
+	}
+
+	// Subscribe before replaying, so nothing recorded in between is lost;
+	// the IDs weed out what the replay sent already.
+	ch := make(chan models.Event, streamBuffer)
+	streams.Lock()
+	streams.clients[ch] = struct{}{}
+	streams.Unlock()
+	defer func() {
+		streams.Lock()
+		if _, ok := streams.clients[ch]; ok {
+			delete(streams.clients, ch)
+			close(ch)
+		}
+		streams.Unlock()
+	}()
+
+	var missed []models.Event
+	if last > 0 {
+		q := DB.Where("id > ?", last).Order("id").Limit(streamReplay)
+		if f.deviceID != 0 {
+			q = q.Where("device_id = ?", f.deviceID)
+		}
+		if len(f.types) > 0 {
+			q = q.Where("type IN ?", f.types)
+		}
+		if err := q.Find(&missed).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	h := c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no") // nginx: do not buffer the stream
+	c.Status(http.StatusOK)
+	send := func(ev *models.Event) bool {
+		if uint64(ev.ID) <= last || !f.match(ev) {
+			return true
+		}
+		last = uint64(ev.ID)
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, streamEventName(ev), b); err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+	// The comment tells the client the stream is up before any event.
+	fmt.Fprint(c.Writer, ": opentalon events\n\n")
+	c.Writer.Flush()
+	for i := range missed {
+		if !send(&missed[i]) {
+			return
+		}
+	}
+
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return // fell behind: the client resumes from last
+			}
+			if !send(&ev) {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
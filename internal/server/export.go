@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress/snappy"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// exportBatchSize is how many metrics rows are read per query while streaming.
+const exportBatchSize = 1000
+
+// MetricsRecord is the flat, storage-independent form of one metrics sample
+// used by the CSV / Parquet export. Column names follow the JSON API.
+type MetricsRecord struct {
+	ReportedAt     time.Time `parquet:"reported_at,timestamp(millisecond)"`
+	CPUUsage       float64   `parquet:"cpu_usage"`
+	MemUsage       float64   `parquet:"mem_usage"`
+	MemTotal       uint64    `parquet:"mem_total"`
+	DiskUsage      float64   `parquet:"disk_usage"`
+	RxBytes        int64     `parquet:"rx_bytes"`
+	TxBytes        int64     `parquet:"tx_bytes"`
+	TCPConnections int64     `parquet:"tcp_connections"`
+	UDPConnections int64     `parquet:"udp_connections"`
+}
+
+// metricsCSVHeader is the CSV column order; it matches MetricsRecord.
+var metricsCSVHeader = []string{
+	"reported_at", "cpu_usage", "mem_usage", "mem_total", "disk_usage",
+	"rx_bytes", "tx_bytes", "tcp_connections", "udp_connections",
+}
+
+func newMetricsRecord(m *models.Metrics) MetricsRecord {
+	return MetricsRecord{
+		ReportedAt:     m.ReportedAt.UTC(),
+		CPUUsage:       m.CPUUsage,
+		MemUsage:       m.MemUsage,
+		MemTotal:       m.MemTotal,
+		DiskUsage:      m.DiskUsage,
+		RxBytes:        m.RxBytes,
+		TxBytes:        m.TxBytes,
+		TCPConnections: int64(m.TCPConnections),
+		UDPConnections: int64(m.UDPConnections),
+	}
+}
+
+func (r MetricsRecord) csvRow() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return []string{
+		r.ReportedAt.Format(time.RFC3339Nano),
+		f(r.CPUUsage), f(r.MemUsage),
+		strconv.FormatUint(r.MemTotal, 10),
+		f(r.DiskUsage),
+		strconv.FormatInt(r.RxBytes, 10), strconv.FormatInt(r.TxBytes, 10),
+		strconv.FormatInt(r.TCPConnections, 10), strconv.FormatInt(r.UDPConnections, 10),
+	}
+}
+
+// parseTimeParam parses a query time given as RFC 3339 or unix seconds.
+func parseTimeParam(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, want RFC 3339 or unix seconds", s)
+	}
+	return t, nil
+}
+
+// streamMetrics calls emit for every stored sample of a device in [from, to),
+// oldest first, reading exportBatchSize rows at a time.
+func streamMetrics(deviceID uint, from, to time.Time, emit func([]MetricsRecord) error) error {
+	return metricsStore.QueryRange(deviceID, from, to, func(batch []models.Metrics) error {
+		recs := make([]MetricsRecord, len(batch))
+		for i := range batch {
+			recs[i] = newMetricsRecord(&batch[i])
+		}
+		return emit(recs)
+	})
+}
+
+// handleMetricsExport streams a device's stored metrics as CSV (default) or
+// Parquet: GET /api/devices/:id/metrics/export?from=&to=&format=csv|parquet.
+// Raw samples are pruned on a rolling basis (maxSnapshotsPerDevice), so
+// callers archiving history should export at least that often; the
+// X-Retention-Snapshots header reports the current limit (0: none, samples
+// are kept for the retention days).
+func handleMetricsExport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var from, to time.Time
+	for param, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if s := c.Query(param); s != "" {
+			if *dst, err = parseTimeParam(s); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+		}
+	}
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "parquet" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or parquet"})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	filename := fmt.Sprintf("opentalon-%s-metrics.%s", dev.Hostname, format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("X-Retention-Snapshots", strconv.Itoa(maxSnapshotsPerDevice))
+
+	switch format {
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		_ = w.Write(metricsCSVHeader)
+		err = streamMetrics(dev.ID, from, to, func(recs []MetricsRecord) error {
+			for _, r := range recs {
+				if err := w.Write(r.csvRow()); err != nil {
+					return err
+				}
+			}
+			w.Flush()
+			c.Writer.Flush()
+			return w.Error()
+		})
+		w.Flush()
+	default: // parquet
+		c.Header("Content-Type", "application/vnd.apache.parquet")
+		pw := parquet.NewGenericWriter[MetricsRecord](c.Writer, parquet.Compression(&snappy.Codec{}))
+		err = streamMetrics(dev.ID, from, to, func(recs []MetricsRecord) error {
+			_, err := pw.Write(recs)
+			return err
+		})
+		if cerr := pw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		// Headers are already sent; abort so the client sees a truncated body.
+		_ = c.Error(err)
+		c.Abort()
+	}
+}
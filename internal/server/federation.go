@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// federationBackfill bounds how far back an edge sends rollups after a
+	// (re)start or an outage of the central server.
+	federationBackfill = 24 * time.Hour
+	// siteStaleAfter marks a site offline when it has not pushed for this long.
+	siteStaleAfter = 5 * time.Minute
+)
+
+// federationToken is the shared secret of edge → central pushes; empty
+// disables the federation endpoint.
+var federationToken string
+
+// SetFederationToken stores the token accepted by /api/federation/push.
+func SetFederationToken(token string) {
+	federationToken = token
+}
+
+// FederationTokenMiddleware authenticates edge servers on the data plane:
+// Authorization: Bearer <federation_token>. It is separate from the agent
+// token so a leaked agent token cannot inject whole sites.
+func FederationTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if federationToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "federation is not enabled on this server"})
+			return
+		}
+		if c.GetHeader("Authorization") != "Bearer "+federationToken {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing federation token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// FederationPush is what an edge server sends to its upstream.
+type FederationPush struct {
+	Site string               `json:"site"`
+	Tree []*models.DeviceTree `json:"tree"`
+	// Rollups are hourly, with device IDs as on the edge.
+	Rollups []models.MetricsRollup `json:"rollups"`
+}
+
+// ── Edge side ────────────────────────────────────────────────────────────────
+
+// RunFederation pushes this server's device tree and hourly rollups to the
+// data plane of upstream (e.g. https://central:1616) every interval. It
+// never returns. Rollups are sent from the start of the hour of the last
+// successful push, less the time RunRollups may take to fold the last
+// samples in, so an hour is re-sent until it is complete.
+func RunFederation(upstream, token, site string, interval time.Duration) {
+	url := strings.TrimRight(upstream, "/") + "/api/federation/push"
+	client := telemetry.HTTPClient(&http.Client{Timeout: 30 * time.Second, Transport: proxy.Transport(proxy.Report)})
+	var since time.Time
+	for {
+		start := time.Now()
+		if since.IsZero() || start.Sub(since) > federationBackfill {
+			since = start.Add(-federationBackfill)
+		}
+		if err := pushFederation(client, url, token, site, since); err != nil {
+			log.Printf("[federation] push to %s failed: %v", upstream, err)
+		} else {
+			since = start.Add(-rollupInterval - rollupLag)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func pushFederation(client *http.Client, url, token, site string, since time.Time) error {
+	tree, err := GetDeviceTree()
+	if err != nil {
+		return err
+	}
+	rollups, err := hourlyRollupsSince(since)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(FederationPush{Site: site, Tree: tree, Rollups: rollups})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// hourlyRollupsSince returns the hourly rollups RunRollups keeps, of every
+// device, from the start of since's hour. Raw samples are capped per device
+// and cover far less than federationBackfill, so they cannot be re-aggregated
+// here without truncating complete hours on the central server.
+func hourlyRollupsSince(since time.Time) ([]models.MetricsRollup, error) {
+	var out []models.MetricsRollup
+	err := DB.Where("resolution = ? AND bucket_start >= ?", models.RollupHour, since.UTC().Truncate(time.Hour)).
+		Order("bucket_start").Find(&out).Error
+	return out, err
+}
+
+// ── Central side ─────────────────────────────────────────────────────────────
+
+// SaveFederationPush stores a site's tree (replacing the previous one) and
+// upserts its rollups.
+func SaveFederationPush(p FederationPush, remoteAddr string) (*models.Site, error) {
+	var site models.Site
+	if err := DB.Where("name = ?", p.Site).FirstOrCreate(&site, models.Site{Name: p.Site}).Error; err != nil {
+		return nil, err
+	}
+	site.Tree = p.Tree
+	site.RemoteAddr = remoteAddr
+	site.LastSync = time.Now()
+	site.Devices = 0
+	walkTree(p.Tree, func(n *models.DeviceTree) {
+		if n.Kind == "" {
+			site.Devices++
+		}
+	})
+	if err := DB.Save(&site).Error; err != nil {
+		return nil, err
+	}
+
+	rows := make([]models.SiteRollup, 0, len(p.Rollups))
+	for _, r := range p.Rollups {
+		if r.Resolution != models.RollupHour {
+			continue
+		}
+		rows = append(rows, models.SiteRollup{
+			SiteID: site.ID, DeviceID: r.DeviceID,
+			BucketStart: r.BucketStart.UTC(), RollupStats: r.RollupStats,
+		})
+	}
+	if len(rows) > 0 {
+		if err := DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "site_id"}, {Name: "device_id"}, {Name: "bucket_start"}},
+			UpdateAll: true,
+		}).CreateInBatches(rows, 200).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &site, nil
+}
+
+func walkTree(nodes []*models.DeviceTree, fn func(*models.DeviceTree)) {
+	for _, n := range nodes {
+		fn(n)
+		walkTree(n.Children, fn)
+	}
+}
+
+// siteNodes returns one root node (Kind "site") per federated site with the
+// site's last pushed tree below it. The nodes below keep the edge's IDs and
+// carry the site name; when the site stopped pushing, they are shown offline.
+func siteNodes() []*models.DeviceTree {
+	var sites []models.Site
+	if err := DB.Find(&sites).Error; err != nil {
+		return nil
+	}
+	now := time.Now()
+	out := make([]*models.DeviceTree, 0, len(sites))
+	for _, s := range sites {
+		online := now.Sub(s.LastSync) <= siteStaleAfter
+		walkTree(s.Tree, func(n *models.DeviceTree) {
+			n.Site = s.Name
+			if !online && n.IsOnline {
+				n.IsOnline, n.Status = false, "offline"
+			}
+		})
+		siteKeys("site:"+s.Name+"/", "", s.Tree)
+		status := "offline"
+		if online {
+			status = "online"
+		}
+		out = append(out, &models.DeviceTree{
+			ID:       s.ID,
+			Key:      "site:" + s.Name,
+			Kind:     "site",
+			Site:     s.Name,
+			Hostname: s.Name,
+			IP:       s.RemoteAddr,
+			IsOnline: online,
+			Status:   status,
+			LastSeen: s.LastSync,
+			Children: s.Tree,
+		})
+	}
+	return out
+}
+
+// siteKeys prefixes the keys of a site's nodes, which are only unique on
+// the edge, with prefix. Nodes pushed by an edge predating keys get theirs
+// here; parent is the edge key of their parent.
+func siteKeys(prefix, parent string, nodes []*models.DeviceTree) {
+	for _, n := range nodes {
+		key := n.Key
+		switch {
+		case key != "":
+		case n.Kind == "namespace":
+			key = parent + "/ns:" + n.Hostname
+		default:
+			key = treeKey(n.Kind, n.ID)
+		}
+		n.Key = prefix + key
+		siteKeys(prefix, key, n.Children)
+	}
+}
+
+// handleFederationPush receives a push from an edge server (data-plane).
+func handleFederationPush(c *gin.Context) {
+	var p FederationPush
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if p.Site = strings.TrimSpace(p.Site); p.Site == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "site is required"})
+		return
+	}
+	site, err := SaveFederationPush(p, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "site_id": site.ID})
+}
+
+// handleListSites returns the federated sites, without their trees.
+func handleListSites(c *gin.Context) {
+	list := []models.Site{}
+	if err := DB.Omit("tree").Order("name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// handleDeleteSite forgets a site and its rollups. An edge that still pushes
+// re-creates it.
+func handleDeleteSite(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.Site{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	DB.Where("site_id = ?", id).Delete(&models.SiteRollup{})
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleSiteRollups returns the hourly rollups of one device at a site:
+// GET /federation/sites/:id/rollups?device_id=<edge id>&from=&to=.
+func handleSiteRollups(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	deviceID, err := strconv.ParseUint(c.Query("device_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id is required"})
+		return
+	}
+	q := DB.Where("site_id = ? AND device_id = ?", id, deviceID)
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			t, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("bucket_start "+op+" ?", t)
+		}
+	}
+	list := []models.SiteRollup{}
+	if err := q.Order("bucket_start").Limit(10000).Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestFederationBackfill(t *testing.T) {
+	openTestDB(t)
+	now := time.Now().UTC().Truncate(time.Hour)
+	rows := []models.MetricsRollup{
+		{DeviceID: 1, Resolution: models.RollupHour, BucketStart: now.Add(-30 * time.Hour), RollupStats: models.RollupStats{Samples: 120}},
+		{DeviceID: 1, Resolution: models.RollupHour, BucketStart: now.Add(-20 * time.Hour), RollupStats: models.RollupStats{Samples: 120, CPUMax: 90}},
+		{DeviceID: 2, Resolution: models.RollupHour, BucketStart: now.Add(-time.Hour), RollupStats: models.RollupStats{Samples: 60}},
+		{DeviceID: 1, Resolution: models.RollupDay, BucketStart: now.Add(-20 * time.Hour).Truncate(24 * time.Hour), RollupStats: models.RollupStats{Samples: 2880}},
+	}
+	if err := upsertRollups(rows); err != nil {
+		t.Fatal(err)
+	}
+	// A single raw sample, as the capped raw table would hold, must not
+	// stand in for the hour it falls in.
+	if err := metricsStore.Write(&models.Metrics{DeviceID: 1, ReportedAt: now.Add(-20 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := hourlyRollupsSince(time.Now().Add(-federationBackfill))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d rollups, want the 2 hourly ones within the backfill: %+v", len(got), got)
+	}
+	if _, err := SaveFederationPush(FederationPush{Site: "edge", Rollups: got}, "10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	var stored []models.SiteRollup
+	if err := DB.Order("bucket_start").Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		device  uint
+		samples int
+	}{{1, 120}, {2, 60}}
+	if len(stored) != len(want) {
+		t.Fatalf("central stored %d rollups, want %d", len(stored), len(want))
+	}
+	for i, w := range want {
+		if stored[i].DeviceID != w.device || stored[i].Samples != w.samples {
+			t.Errorf("rollup %d: device %d with %d samples, want device %d with %d", i, stored[i].DeviceID, stored[i].Samples, w.device, w.samples)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// A device that goes offline flapThreshold times, each less than
+// flapWindow after the previous, is flapping (flap_threshold,
+// flap_window_minutes); 0 turns detection off.
+var (
+	flapThreshold = 4
+	flapWindow    = 30 * time.Minute
+)
+
+// SetFlapDetection stores flap_threshold and flap_window_minutes from
+// config.
+func SetFlapDetection(threshold, windowMinutes int) {
+	flapThreshold = threshold
+	if windowMinutes > 0 {
+		flapWindow = time.Duration(windowMinutes) * time.Minute
+	}
+}
+
+// countFlap counts an offline transition of d and reports whether d is
+// flapping, in which case its device_offline event is left out. The
+// transition that makes it flap records device_flapping instead.
+func countFlap(d *models.Device, now time.Time) bool {
+	if flapThreshold <= 0 {
+		return false
+	}
+	// GORM sets the columns in name order, so flap_count still sees the
+	// previous last_flap_at on MySQL too.
+	err := DB.Model(&models.Device{}).Where("id = ?", d.ID).Updates(map[string]any{
+		"flap_count":   gorm.Expr("CASE WHEN last_flap_at IS NULL OR last_flap_at < ? THEN 1 ELSE flap_count + 1 END", now.Add(-flapWindow)),
+		"last_flap_at": now,
+	}).Error
+	if err != nil {
+		log.Printf("[offline] count flap of device %d: %v", d.ID, err)
+		return false
+	}
+	var cur models.Device
+	if err := DB.Select("id", "flap_count", "flapping").First(&cur, d.ID).Error; err != nil {
+		return false
+	}
+	if cur.Flapping {
+		return true
+	}
+	if cur.FlapCount < flapThreshold {
+		return false
+	}
+	res := DB.Model(&models.Device{}).Where("id = ? AND flapping = ?", d.ID, false).
+		Updates(map[string]any{"flapping": true, "flapping_since": now})
+	if res.Error == nil && res.RowsAffected > 0 {
+		RecordEvent(d.ID, models.EventDeviceFlapping,
+			fmt.Sprintf("%s is flapping (%d offline transitions, each within %s of the last)", deviceName(d), cur.FlapCount, flapWindow),
+			map[string]any{"flap_count": cur.FlapCount})
+	}
+	return true
+}
+
+// settleFlapping clears the flapping state of devices that have kept their
+// state for a whole window, and the counts of those that never got there.
+func settleFlapping(now time.Time) {
+	cutoff := now.Add(-flapWindow)
+	var list []models.Device
+	if err := DB.Where("flapping = ? AND last_flap_at < ?", true, cutoff).Find(&list).Error; err != nil {
+		log.Printf("[offline] load flapping devices: %v", err)
+		return
+	}
+	for i := range list {
+		d := &list[i]
+		res := DB.Model(&models.Device{}).Where("id = ? AND flapping = ? AND last_flap_at < ?", d.ID, true, cutoff).
+			Updates(map[string]any{"flapping": false, "flapping_since": nil, "flap_count": 0})
+		if res.Error != nil || res.RowsAffected == 0 {
+			continue
+		}
+		state := "online"
+		if !d.IsOnline {
+			state = "offline"
+		}
+		var dur time.Duration
+		if d.FlappingSince != nil {
+			dur = now.Sub(*d.FlappingSince).Round(time.Second)
+		}
+		RecordEvent(d.ID, models.EventDeviceFlappingOK,
+			fmt.Sprintf("%s stopped flapping after %s (%d offline transitions), now %s", deviceName(d), dur, d.FlapCount, state),
+			map[string]any{"flap_count": d.FlapCount, "flapping_sec": dur.Seconds(), "online": d.IsOnline})
+	}
+	DB.Model(&models.Device{}).Where("flapping = ? AND flap_count > 0 AND last_flap_at < ?", false, cutoff).
+		Update("flap_count", 0)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// FlowNode is one side of a branch (subtree) of the topology in a flow
+// diagram. Every branch appears twice, as "<branch>/out" and
+// "<branch>/in", both carrying the branch's totals.
+type FlowNode struct {
+	Key      string `json:"key"`    // "<branch>/out" or "<branch>/in"
+	Branch   string `json:"branch"` // "dev:<id>" or "external"
+	Side     string `json:"side"`   // "out" or "in"
+	DeviceID uint   `json:"device_id,omitempty"`
+	Name     string `json:"name"`
+	RxBps    int64  `json:"rx_bps"`  // aggregated ingress of the subtree
+	TxBps    int64  `json:"tx_bps"`  // aggregated egress of the subtree
+	Devices  int    `json:"devices"` // online devices contributing
+}
+
+// FlowLink is an estimated traffic flow between two branches, in bytes/s.
+// Links run from the egress side of a branch ("<branch>/out") to the
+// ingress side of another ("<branch>/in"), which keeps the graph acyclic as sankey
+// renderers require even when two branches exchange traffic both ways.
+type FlowLink struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Value  int64  `json:"value"`
+}
+
+// TopologyFlows is a sankey-ready view of traffic between sibling branches.
+type TopologyFlows struct {
+	Root  *uint      `json:"root,omitempty"`
+	Nodes []FlowNode `json:"nodes"`
+	Links []FlowLink `json:"links"`
+}
+
+// subtreeRate returns the aggregated rx / tx of a device and its descendants.
+// A forwarding parent (router, PVE bridge) already sees its children's
+// traffic on its own interfaces, so the subtree rate is the larger of the
+// device's own counters and the sum of its children — not their total.
+func subtreeRate(id uint, children map[uint][]uint, own map[uint][2]int64, seen map[uint]bool) (rx, tx int64, n int) {
+	if seen[id] {
+		return 0, 0, 0
+	}
+	seen[id] = true
+	var crx, ctx int64
+	for _, c := range children[id] {
+		r, t, k := subtreeRate(c, children, own, seen)
+		crx, ctx, n = crx+r, ctx+t, n+k
+	}
+	o, ok := own[id]
+	if ok {
+		n++
+	}
+	return max(o[0], crx), max(o[1], ctx), n
+}
+
+// EstimateFlows aggregates rx / tx per branch below root (the top-level
+// roots when nil) and estimates inter-branch flows with a gravity model:
+// the egress of branch i is split over every other branch j proportionally to
+// j's ingress. Traffic that no sibling accounts for is attributed to an
+// "external" node (the Internet, or the uplink above root). Only devices
+// that are currently online contribute.
+func EstimateFlows(root *uint) (*TopologyFlows, error) {
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	byID := make(map[uint]*models.Device, len(devices))
+	children := map[uint][]uint{}
+	own := map[uint][2]int64{}
+	var branches []uint
+	for i := range devices {
+		d := &devices[i]
+		byID[d.ID] = d
+	}
+	if root != nil {
+		if _, ok := byID[*root]; !ok {
+			return nil, fmt.Errorf("device %d not found", *root)
+		}
+	}
+	for _, d := range byID {
+		parentKnown := d.ParentID != nil && byID[*d.ParentID] != nil
+		switch {
+		case parentKnown:
+			children[*d.ParentID] = append(children[*d.ParentID], d.ID)
+		case root == nil:
+			branches = append(branches, d.ID) // orphans count as roots
+		}
+		if root != nil && parentKnown && *d.ParentID == *root {
+			branches = append(branches, d.ID)
+		}
+		if s := liveStatus(d, now); s != "online" && s != "flapping" {
+			continue
+		}
+		if m, err := GetLatestMetrics(d.ID); err == nil && now.Sub(m.ReportedAt) <= offlineTimeout(d) {
+			own[d.ID] = [2]int64{m.RxBytes, m.TxBytes}
+		}
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i] < branches[j] })
+
+	var nodes []FlowNode // one per branch, sides expanded at the end
+	seen := map[uint]bool{}
+	if root != nil {
+		seen[*root] = true // never walk back up through the root
+	}
+	var sumRx, sumTx int64
+	for _, id := range branches {
+		rx, tx, n := subtreeRate(id, children, own, seen)
+		name := byID[id].Hostname
+		if byID[id].Remark != "" {
+			name = byID[id].Remark
+		}
+		nodes = append(nodes, FlowNode{
+			Branch: "dev:" + strconv.FormatUint(uint64(id), 10), DeviceID: id,
+			Name: name, RxBps: rx, TxBps: tx, Devices: n,
+		})
+		sumRx, sumTx = sumRx+rx, sumTx+tx
+	}
+	extName := "Internet"
+	if root != nil {
+		extName = "Upstream"
+	}
+	// External sends what the branches receive beyond what they send each
+	// other, and absorbs the surplus egress.
+	nodes = append(nodes, FlowNode{
+		Branch: "external", Name: extName,
+		TxBps: max(0, sumRx-sumTx), RxBps: max(0, sumTx-sumRx),
+	})
+
+	res := &TopologyFlows{Root: root, Nodes: []FlowNode{}, Links: []FlowLink{}}
+	for _, side := range []string{"out", "in"} {
+		for _, n := range nodes {
+			n.Key, n.Side = n.Branch+"/"+side, side
+			res.Nodes = append(res.Nodes, n)
+		}
+	}
+	for i, src := range nodes {
+		if src.TxBps == 0 {
+			continue
+		}
+		var others int64
+		for j, dst := range nodes {
+			if i != j {
+				others += dst.RxBps
+			}
+		}
+		if others == 0 {
+			continue
+		}
+		for j, dst := range nodes {
+			if i == j || dst.RxBps == 0 {
+				continue
+			}
+			if v := src.TxBps * dst.RxBps / others; v > 0 {
+				res.Links = append(res.Links, FlowLink{Source: src.Branch + "/out", Target: dst.Branch + "/in", Value: v})
+			}
+		}
+	}
+	return res, nil
+}
+
+// handleTopologyFlows returns estimated inter-branch traffic for a sankey
+// chart. ?root=<device id> zooms into the children of that device.
+func handleTopologyFlows(c *gin.Context) {
+	var root *uint
+	if s := c.Query("root"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid root"})
+			return
+		}
+		r := uint(id)
+		root = &r
+	}
+	res, err := EstimateFlows(root)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": res})
+}
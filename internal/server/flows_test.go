@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestEstimateFlowsLinksKnownNodes(t *testing.T) {
+	openTestDB(t)
+	now := time.Now()
+	for i, rate := range [][2]int64{{1000, 4000}, {3000, 500}} {
+		d := models.Device{Hostname: fmt.Sprintf("branch-%d", i), IP: fmt.Sprintf("10.0.0.%d", i+1), IsOnline: true, LastSeen: now}
+		if err := DB.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+		latestMetrics.Store(d.ID, &models.Metrics{DeviceID: d.ID, RxBytes: rate[0], TxBytes: rate[1], ReportedAt: now})
+		t.Cleanup(func() { latestMetrics.Delete(d.ID) })
+	}
+
+	res, err := EstimateFlows(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]bool{}
+	for _, n := range res.Nodes {
+		if n.Key != n.Branch+"/"+n.Side {
+			t.Errorf("node key %q, want %q", n.Key, n.Branch+"/"+n.Side)
+		}
+		keys[n.Key] = true
+	}
+	if len(keys) != 6 { // two branches and external, two sides each
+		t.Errorf("got %d nodes, want 6: %+v", len(keys), res.Nodes)
+	}
+	if len(res.Links) == 0 {
+		t.Fatal("no links")
+	}
+	for _, l := range res.Links {
+		if !keys[l.Source] || !keys[l.Target] {
+			t.Errorf("link %s -> %s points outside the nodes", l.Source, l.Target)
+		}
+		if !strings.HasSuffix(l.Source, "/out") || !strings.HasSuffix(l.Target, "/in") {
+			t.Errorf("link %s -> %s does not run out -> in", l.Source, l.Target)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// The Grafana JSON (SimpleJSON) datasource API under /api/grafana. A
+// target is a metric, e.g. "cpu_usage" (one series per device), narrowed to
+// a device by name or id ("cpu_usage:web-1") or to a group
+// ("cpu_usage:group=pve").
+
+// grafanaMetrics are the metrics a target can name.
+var grafanaMetrics = []string{"cpu_usage", "mem_usage", "disk_usage", "rx_bytes", "tx_bytes", "tcp_connections", "udp_connections"}
+
+// rollupAvg returns a rollup's average of metric.
+func rollupAvg(s *models.RollupStats, metric string) float64 {
+	switch metric {
+	case "cpu_usage":
+		return s.CPUAvg
+	case "mem_usage":
+		return s.MemAvg
+	case "disk_usage":
+		return s.DiskAvg
+	case "rx_bytes":
+		return s.RxAvg
+	case "tx_bytes":
+		return s.TxAvg
+	case "tcp_connections":
+		return s.TCPAvg
+	case "udp_connections":
+		return s.UDPAvg
+	}
+	return 0
+}
+
+// grafanaRange is the time range of a query or annotation request.
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// grafanaDevices returns the devices a target selector picks, within the
+// groups the request is limited to.
+func grafanaDevices(c *gin.Context, selector string) ([]models.Device, error) {
+	q := DB.Where("agent_ver <> ?", "discovered").Order("id")
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	switch {
+	case selector == "":
+	case strings.HasPrefix(selector, "group="):
+		q = q.Where(map[string]any{"group": strings.TrimPrefix(selector, "group=")})
+	default:
+		if id, err := strconv.ParseUint(selector, 10, 64); err == nil {
+			q = q.Where("id = ?", id)
+		} else {
+			q = q.Where("remark = ? OR (remark = '' AND hostname = ?)", selector, selector)
+		}
+	}
+	var list []models.Device
+	return list, q.Find(&list).Error
+}
+
+// parseGrafanaTarget splits a target into its metric and device selector.
+func parseGrafanaTarget(target string) (metric, selector string, err error) {
+	metric, selector, _ = strings.Cut(strings.TrimSpace(target), ":")
+	for _, m := range grafanaMetrics {
+		if m == metric {
+			return metric, selector, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown metric %q", metric)
+}
+
+// grafanaSeries returns the [value, unix ms] points of metric on a device
+// in r, averaged into buckets of step.
+func grafanaSeries(deviceID uint, metric string, r grafanaRange, step time.Duration) ([][2]float64, error) {
+	timestamps, values, _, err := deviceSeries(deviceID, []string{metric}, r, step)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][2]float64, len(timestamps))
+	for i, t := range timestamps {
+		out[i] = [2]float64{values[0][i], float64(t)}
+	}
+	return out, nil
+}
+
+// deviceSeries returns the buckets of step in r that hold data for a device
+// (unix ms) and, per metric, the average in each of them. Steps of an hour
+// or more read the hourly (a day or more: daily) rollups and raw samples
+// only after the last rollup; finer steps read raw samples and hourly
+// rollups before the first one. source names the resolution read mostly:
+// "raw", "hour" or "day".
+func deviceSeries(deviceID uint, metrics []string, r grafanaRange, step time.Duration) (timestamps []int64, values [][]float64, source string, err error) {
+	type point struct {
+		at time.Time
+		v  []float64
+	}
+	res, bucketLen := models.RollupHour, time.Hour
+	if step >= 24*time.Hour {
+		res, bucketLen = models.RollupDay, 24*time.Hour
+	}
+	loadRollups := func(to time.Time) ([]models.MetricsRollup, error) {
+		var rollups []models.MetricsRollup
+		err := DB.Where("device_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?",
+			deviceID, res, rollupBucket(res, r.From), to).Order("bucket_start").Find(&rollups).Error
+		return rollups, err
+	}
+	var raw []point
+	loadRaw := func(from time.Time) error {
+		return metricsStore.QueryRange(deviceID, from, r.To, func(batch []models.Metrics) error {
+			for i := range batch {
+				p := point{batch[i].ReportedAt, make([]float64, len(metrics))}
+				for j, metric := range metrics {
+					p.v[j], _ = metricValue(&batch[i], metric)
+				}
+				raw = append(raw, p)
+			}
+			return nil
+		})
+	}
+
+	var rollups []models.MetricsRollup
+	if step >= time.Hour {
+		if rollups, err = loadRollups(r.To); err != nil {
+			return nil, nil, "", err
+		}
+		rawFrom := r.From
+		if n := len(rollups); n > 0 && rollups[n-1].BucketStart.Add(bucketLen).After(rawFrom) {
+			rawFrom = rollups[n-1].BucketStart.Add(bucketLen)
+		}
+		if err := loadRaw(rawFrom); err != nil {
+			return nil, nil, "", err
+		}
+	} else {
+		if err := loadRaw(r.From); err != nil {
+			return nil, nil, "", err
+		}
+		rollupTo := r.To
+		if len(raw) > 0 {
+			rollupTo = raw[0].at
+		}
+		if rollups, err = loadRollups(rollupTo); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	source = "raw"
+	if len(rollups) > len(raw) {
+		source = res
+	}
+	points := make([]point, 0, len(rollups)+len(raw))
+	for i := range rollups {
+		// Buckets are drawn at their middle.
+		p := point{rollups[i].BucketStart.Add(bucketLen / 2), make([]float64, len(metrics))}
+		for j, metric := range metrics {
+			p.v[j] = rollupAvg(&rollups[i].RollupStats, metric)
+		}
+		points = append(points, p)
+	}
+	points = append(points, raw...)
+
+	timestamps = []int64{}
+	values = make([][]float64, len(metrics))
+	var bucket time.Time
+	sum := make([]float64, len(metrics))
+	var n int
+	flush := func() {
+		if n > 0 {
+			timestamps = append(timestamps, bucket.UnixMilli())
+			for j := range metrics {
+				values[j] = append(values[j], sum[j]/float64(n))
+				sum[j] = 0
+			}
+		}
+		n = 0
+	}
+	for _, p := range points {
+		b := p.at
+		if step > 0 {
+			b = p.at.Truncate(step)
+		}
+		if n > 0 && !b.Equal(bucket) {
+			flush()
+		}
+		bucket = b
+		for j, v := range p.v {
+			sum[j] += v
+		}
+		n++
+	}
+	flush()
+	return timestamps, values, source, nil
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleGrafanaTest answers the datasource's connection test.
+func handleGrafanaTest(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleGrafanaSearch lists the targets containing the typed text: the
+// metrics, and each metric per device.
+func handleGrafanaSearch(c *gin.Context) {
+	var body struct {
+		Target string `json:"target"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	devices, err := grafanaDevices(c, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	out := []string{}
+	for _, m := range grafanaMetrics {
+		targets := []string{m}
+		for i := range devices {
+			targets = append(targets, m+":"+deviceName(&devices[i]))
+		}
+		for _, t := range targets {
+			if strings.Contains(t, body.Target) {
+				out = append(out, t)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// handleGrafanaQuery returns the series of the requested targets, averaged
+// into buckets of intervalMs (widened to stay under maxDataPoints). Table
+// targets get the latest value per device.
+func handleGrafanaQuery(c *gin.Context) {
+	var body struct {
+		Range         grafanaRange `json:"range"`
+		IntervalMs    int64        `json:"intervalMs"`
+		MaxDataPoints int64        `json:"maxDataPoints"`
+		Targets       []struct {
+			Target string `json:"target"`
+			Type   string `json:"type"`
+			Hide   bool   `json:"hide"`
+		} `json:"targets"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r := body.Range
+	if r.To.IsZero() {
+		r.To = time.Now()
+	}
+	if r.From.IsZero() || !r.From.Before(r.To) {
+		r.From = r.To.Add(-time.Hour)
+	}
+	step := time.Duration(body.IntervalMs) * time.Millisecond
+	if body.MaxDataPoints > 0 {
+		step = max(step, r.To.Sub(r.From)/time.Duration(body.MaxDataPoints))
+	}
+
+	out := []any{}
+	for _, t := range body.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		metric, selector, err := parseGrafanaTarget(t.Target)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		devices, err := grafanaDevices(c, selector)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if t.Type == "table" {
+			rows := [][]any{}
+			for i := range devices {
+				m, err := GetLatestMetrics(devices[i].ID)
+				if err != nil {
+					continue
+				}
+				v, _ := metricValue(m, metric)
+				rows = append(rows, []any{m.ReportedAt.UnixMilli(), deviceName(&devices[i]), devices[i].Group, v})
+			}
+			out = append(out, gin.H{"type": "table", "rows": rows, "columns": []gin.H{
+				{"text": "Time", "type": "time"}, {"text": "Device", "type": "string"},
+				{"text": "Group", "type": "string"}, {"text": metric, "type": "number"},
+			}})
+			continue
+		}
+		for i := range devices {
+			points, err := grafanaSeries(devices[i].ID, metric, r, step)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			name := deviceName(&devices[i])
+			if selector == "" || strings.HasPrefix(selector, "group=") {
+				name = metric + " " + name
+			}
+			out = append(out, gin.H{"target": name, "datapoints": points})
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// handleGrafanaAnnotations returns the events in the range as annotations;
+// the annotation's query, when set, lists the event types to show,
+// comma-separated (e.g. "device_offline,device_online").
+func handleGrafanaAnnotations(c *gin.Context) {
+	var body struct {
+		Range      grafanaRange   `json:"range"`
+		Annotation map[string]any `json:"annotation"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Where("created_at >= ? AND created_at < ?", body.Range.From, body.Range.To).Order("created_at").Limit(1000)
+	if query, _ := body.Annotation["query"].(string); strings.TrimSpace(query) != "" {
+		var types []string
+		for _, t := range strings.Split(query, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+		q = q.Where("type IN ?", types)
+	}
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	var events []models.Event
+	if err := q.Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	names := map[uint]string{}
+	var ids []uint
+	for _, e := range events {
+		if e.DeviceID != nil {
+			ids = append(ids, *e.DeviceID)
+		}
+	}
+	if len(ids) > 0 {
+		var devices []models.Device
+		DB.Select("id", "hostname", "remark").Where("id IN ?", ids).Find(&devices)
+		for i := range devices {
+			names[devices[i].ID] = deviceName(&devices[i])
+		}
+	}
+	out := make([]gin.H, 0, len(events))
+	for _, e := range events {
+		tags := []string{e.Type}
+		if e.DeviceID != nil && names[*e.DeviceID] != "" {
+			tags = append(tags, names[*e.DeviceID])
+		}
+		out = append(out, gin.H{
+			"annotation": body.Annotation, "time": e.CreatedAt.UnixMilli(),
+			"title": e.Type, "text": e.Message, "tags": tags,
+		})
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// /api/graphql answers read-only GraphQL queries over the devices, their
+// tree, latest metrics, history and events, so a client fetches exactly the
+// fields and nesting it needs in one request, e.g.
+//
+//	{ tree { hostname metrics { cpu_usage } children { hostname } } }
+//
+// Field names are those of the REST API's JSON.
+
+// gqlRequestKey is the context key of the gqlRequest.
+type gqlRequestKey struct{}
+
+// gqlRequest holds what the resolvers of one query share: the devices the
+// caller may see, loaded once on first use.
+type gqlRequest struct {
+	groups   map[string]bool
+	once     sync.Once
+	err      error
+	devices  []models.Device
+	byID     map[uint]*models.Device
+	children map[uint][]*models.Device
+}
+
+func (r *gqlRequest) load() error {
+	r.once.Do(func() {
+		q := DB.Order("id")
+		if r.groups != nil {
+			q = q.Where("id IN (?)", groupDeviceIDs(r.groups))
+		}
+		if r.err = q.Find(&r.devices).Error; r.err != nil {
+			return
+		}
+		tags, err := deviceTagNames(nil)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.byID = make(map[uint]*models.Device, len(r.devices))
+		for i := range r.devices {
+			r.devices[i].Tags = tags[r.devices[i].ID]
+			r.byID[r.devices[i].ID] = &r.devices[i]
+		}
+		r.children = map[uint][]*models.Device{}
+		for i := range r.devices {
+			if p := r.devices[i].ParentID; p != nil && r.byID[*p] != nil {
+				r.children[*p] = append(r.children[*p], &r.devices[i])
+			}
+		}
+	})
+	return r.err
+}
+
+func gqlReq(p graphql.ResolveParams) (*gqlRequest, error) {
+	r := p.Context.Value(gqlRequestKey{}).(*gqlRequest)
+	return r, r.load()
+}
+
+// gqlJSON passes free-form values (device metadata) through as they are.
+var gqlJSON = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Any JSON value.",
+	Serialize:   func(v any) any { return v },
+})
+
+// gqlScalarFields maps the JSON-tagged scalar fields of a model struct to
+// GraphQL fields, which graphql-go resolves through the same tags. 64-bit
+// integers (byte counts, unix times) become Float: GraphQL's Int has 32 bits.
+func gqlScalarFields(t reflect.Type) graphql.Fields {
+	fields := graphql.Fields{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous || name == "" || name == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		var typ graphql.Output
+		switch ft.Kind() {
+		case reflect.String:
+			typ = graphql.String
+		case reflect.Bool:
+			typ = graphql.Boolean
+		case reflect.Float32, reflect.Float64, reflect.Int64, reflect.Uint64:
+			typ = graphql.Float
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+			typ = graphql.Int
+		case reflect.Struct:
+			if ft != reflect.TypeOf(time.Time{}) {
+				continue
+			}
+			typ = graphql.DateTime
+		default:
+			continue
+		}
+		fields[name] = &graphql.Field{Type: typ}
+	}
+	return fields
+}
+
+var gqlSchema = sync.OnceValues(buildGraphQLSchema)
+
+func buildGraphQLSchema() (graphql.Schema, error) {
+	metricsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Metrics", Fields: gqlScalarFields(reflect.TypeOf(models.Metrics{})),
+	})
+
+	eventType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Event", Fields: gqlScalarFields(reflect.TypeOf(models.Event{})),
+	})
+
+	seriesType := graphql.NewObject(graphql.ObjectConfig{Name: "Series", Fields: graphql.Fields{
+		"metric": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"values": &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.Float))},
+	}})
+	historyType := graphql.NewObject(graphql.ObjectConfig{Name: "History", Fields: graphql.Fields{
+		"from":         &graphql.Field{Type: graphql.DateTime},
+		"to":           &graphql.Field{Type: graphql.DateTime},
+		"step_seconds": &graphql.Field{Type: graphql.Int},
+		"source":       &graphql.Field{Type: graphql.String},
+		// Unix milliseconds; values[i] of every series belongs to timestamps[i].
+		"timestamps": &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.Float))},
+		"series":     &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(seriesType))},
+	}})
+
+	var deviceType *graphql.Object
+	deviceType = graphql.NewObject(graphql.ObjectConfig{Name: "Device", Fields: graphql.FieldsThunk(func() graphql.Fields {
+		fields := gqlScalarFields(reflect.TypeOf(models.Device{}))
+		dev := func(p graphql.ResolveParams) *models.Device { return p.Source.(*models.Device) }
+		fields["id"] = &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: func(p graphql.ResolveParams) (any, error) {
+			return dev(p).ID, nil
+		}}
+		fields["created_at"] = &graphql.Field{Type: graphql.DateTime, Resolve: func(p graphql.ResolveParams) (any, error) {
+			return dev(p).CreatedAt, nil
+		}}
+		fields["name"] = &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (any, error) {
+			return deviceName(dev(p)), nil
+		}}
+		fields["tags"] = &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Resolve: func(p graphql.ResolveParams) (any, error) {
+			if t := dev(p).Tags; t != nil {
+				return t, nil
+			}
+			return []string{}, nil
+		}}
+		fields["metadata"] = &graphql.Field{Type: gqlJSON, Resolve: func(p graphql.ResolveParams) (any, error) {
+			return dev(p).Metadata, nil
+		}}
+		fields["parent"] = &graphql.Field{Type: deviceType, Resolve: func(p graphql.ResolveParams) (any, error) {
+			r, err := gqlReq(p)
+			if err != nil || dev(p).ParentID == nil {
+				return nil, err
+			}
+			if d := r.byID[*dev(p).ParentID]; d != nil {
+				return d, nil
+			}
+			return nil, nil
+		}}
+		fields["children"] = &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(deviceType)), Resolve: func(p graphql.ResolveParams) (any, error) {
+			r, err := gqlReq(p)
+			if err != nil {
+				return nil, err
+			}
+			if kids := r.children[dev(p).ID]; kids != nil {
+				return kids, nil
+			}
+			return []*models.Device{}, nil
+		}}
+		fields["metrics"] = &graphql.Field{
+			Type:        metricsType,
+			Description: "The latest sample, null for devices without an agent.",
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				m, err := GetLatestMetrics(dev(p).ID)
+				if err != nil {
+					return nil, nil
+				}
+				return m, nil
+			},
+		}
+		fields["history"] = &graphql.Field{
+			Type:        historyType,
+			Description: "Metrics over time in buckets of step, as GET /api/devices/:id/metrics/history.",
+			Args: graphql.FieldConfigArgument{
+				"range":   &graphql.ArgumentConfig{Type: graphql.String, Description: "e.g. 90m, 24h or 7d (default 24h)"},
+				"from":    &graphql.ArgumentConfig{Type: graphql.String},
+				"to":      &graphql.ArgumentConfig{Type: graphql.String},
+				"step":    &graphql.ArgumentConfig{Type: graphql.String},
+				"metrics": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				r, step, err := seriesRange(func(name string) string {
+					s, _ := p.Args[name].(string)
+					return s
+				})
+				if err != nil {
+					return nil, err
+				}
+				metrics := grafanaMetrics
+				if list, ok := p.Args["metrics"].([]any); ok {
+					metrics = nil
+					for _, v := range list {
+						metric, _, err := parseGrafanaTarget(v.(string))
+						if err != nil {
+							return nil, err
+						}
+						metrics = append(metrics, metric)
+					}
+				}
+				timestamps, values, source, err := deviceSeries(dev(p).ID, metrics, r, step)
+				if err != nil {
+					return nil, err
+				}
+				series := make([]map[string]any, len(metrics))
+				for i, m := range metrics {
+					v := values[i]
+					if v == nil {
+						v = []float64{}
+					}
+					series[i] = map[string]any{"metric": m, "values": v}
+				}
+				if timestamps == nil {
+					timestamps = []int64{}
+				}
+				return map[string]any{
+					"from": r.From, "to": r.To, "step_seconds": int(step / time.Second),
+					"source": source, "timestamps": timestamps, "series": series,
+				}, nil
+			},
+		}
+		fields["events"] = &graphql.Field{
+			Type:        graphql.NewList(graphql.NewNonNull(eventType)),
+			Description: "The device's latest events, newest first.",
+			Args: graphql.FieldConfigArgument{
+				"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+				"types": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				q := DB.Where("device_id = ?", dev(p).ID).Order("id desc").Limit(min(max(p.Args["limit"].(int), 1), 1000))
+				if list, ok := p.Args["types"].([]any); ok {
+					q = q.Where("type IN ?", list)
+				}
+				events := []models.Event{}
+				return events, q.Find(&events).Error
+			},
+		}
+		return fields
+	})})
+
+	deviceList := graphql.NewList(graphql.NewNonNull(deviceType))
+	query := graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{
+		"devices": &graphql.Field{
+			Type:        deviceList,
+			Description: "All devices, optionally filtered.",
+			Args: graphql.FieldConfigArgument{
+				"group":  &graphql.ArgumentConfig{Type: graphql.String},
+				"tag":    &graphql.ArgumentConfig{Type: graphql.String},
+				"online": &graphql.ArgumentConfig{Type: graphql.Boolean},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				r, err := gqlReq(p)
+				if err != nil {
+					return nil, err
+				}
+				group, _ := p.Args["group"].(string)
+				tag, _ := p.Args["tag"].(string)
+				online, byOnline := p.Args["online"].(bool)
+				out := []*models.Device{}
+				for i := range r.devices {
+					d := &r.devices[i]
+					if (group == "" || d.Group == group) && (tag == "" || slices.Contains(d.Tags, tag)) &&
+						(!byOnline || d.IsOnline == online) {
+						out = append(out, d)
+					}
+				}
+				return out, nil
+			},
+		},
+		"device": &graphql.Field{
+			Type: deviceType,
+			Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				r, err := gqlReq(p)
+				if err != nil {
+					return nil, err
+				}
+				if d := r.byID[uint(p.Args["id"].(int))]; d != nil {
+					return d, nil
+				}
+				return nil, nil
+			},
+		},
+		"tree": &graphql.Field{
+			Type:        deviceList,
+			Description: "The root devices; nest children to walk the tree.",
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				r, err := gqlReq(p)
+				if err != nil {
+					return nil, err
+				}
+				out := []*models.Device{}
+				for i := range r.devices {
+					if p := r.devices[i].ParentID; p == nil || r.byID[*p] == nil {
+						out = append(out, &r.devices[i])
+					}
+				}
+				return out, nil
+			},
+		},
+	}})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// handleGraphQL runs a GraphQL query: POST {"query", "variables",
+// "operationName"}, or GET ?query=. Errors of the query itself come back
+// in "errors" with status 200, as GraphQL clients expect.
+func handleGraphQL(c *gin.Context) {
+	var body struct {
+		Query         string         `json:"query"`
+		Variables     map[string]any `json:"variables"`
+		OperationName string         `json:"operationName"`
+	}
+	if c.Request.Method == http.MethodGet {
+		body.Query = c.Query("query")
+		body.OperationName = c.Query("operationName")
+	} else if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	if err := gqlCheckDepth(body.Query); err != nil {
+		c.JSON(http.StatusOK, &graphql.Result{Errors: []gqlerrors.FormattedError{gqlerrors.NewFormattedError(err.Error())}})
+		return
+	}
+	schema, err := gqlSchema()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := context.WithValue(c.Request.Context(), gqlRequestKey{}, &gqlRequest{groups: deviceGroups(c)})
+	c.JSON(http.StatusOK, graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  body.Query,
+		VariableValues: body.Variables,
+		OperationName:  body.OperationName,
+		Context:        ctx,
+	}))
+}
+
+// gqlMaxDepth caps how deeply a query may nest fields. parent and children
+// let a query walk the tree back and forth without end; the introspection
+// query of GraphiQL and similar clients needs about 12 levels.
+const gqlMaxDepth = 15
+
+// gqlCheckDepth rejects a query that nests fields deeper than gqlMaxDepth.
+// A query that does not parse passes; graphql.Do reports its errors.
+func gqlCheckDepth(query string) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil
+	}
+	w := gqlDepthWalk{frags: map[string]*ast.FragmentDefinition{}, memo: map[string]int{}}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok && f.Name != nil {
+			w.frags[f.Name.Value] = f
+		}
+	}
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			if n := w.depth(op.SelectionSet); n > gqlMaxDepth {
+				return fmt.Errorf("query nests %d levels deep, more than the %d allowed", n, gqlMaxDepth)
+			}
+		}
+	}
+	return nil
+}
+
+// gqlDepthWalk measures selection sets, following fragment spreads. The
+// depth of each fragment is computed once, so repeated spreads cost nothing
+// and a cycle (which validation rejects later) counts as 0.
+type gqlDepthWalk struct {
+	frags map[string]*ast.FragmentDefinition
+	memo  map[string]int
+}
+
+func (w gqlDepthWalk) depth(set *ast.SelectionSet) int {
+	if set == nil {
+		return 0
+	}
+	deepest := 0
+	for _, sel := range set.Selections {
+		var d int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d = 1 + w.depth(sel.SelectionSet)
+		case *ast.InlineFragment:
+			d = w.depth(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			if sel.Name == nil {
+				continue
+			}
+			name := sel.Name.Value
+			n, ok := w.memo[name]
+			if !ok {
+				w.memo[name] = 0
+				if f := w.frags[name]; f != nil {
+					n = w.depth(f.SelectionSet)
+				}
+				w.memo[name] = n
+			}
+			d = n
+		}
+		deepest = max(deepest, d)
+	}
+	return deepest
+}
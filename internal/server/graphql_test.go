@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestGraphQLReadToken(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	prevAdmin := adminUser
+	t.Cleanup(func() { adminUser = prevAdmin })
+	adminUser = "admin"
+	const token = apiTokenPrefix + "read"
+	tok := models.APIToken{Username: "admin", Hash: hashAPIToken(token), Scopes: models.ScopeRead, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := DB.Create(&tok).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&models.Device{Hostname: "router", IP: "10.0.0.1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(JWTMiddleware(), PolicyMiddleware())
+	r.POST("/api/graphql", handleGraphQL)
+	r.POST("/api/devices/:id/reboot", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	post := func(path, query string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/api/graphql", "{ devices { hostname } }")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"router"`) {
+		t.Errorf("query with a read token: status %d: %s", w.Code, w.Body)
+	}
+	if w := post("/api/devices/1/reboot", ""); w.Code != http.StatusForbidden {
+		t.Errorf("write with a read token: status %d, want 403", w.Code)
+	}
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/graphql", handleGraphQL)
+	run := func(query string) (result struct {
+		Data   any `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}) {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/graphql", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	nested := func(levels int) string {
+		return "{ tree { " + strings.Repeat("children { ", levels-2) + "hostname" + strings.Repeat(" }", levels-1) + " }"
+	}
+
+	if res := run(nested(gqlMaxDepth)); len(res.Errors) != 0 {
+		t.Errorf("query %d levels deep: %v", gqlMaxDepth, res.Errors)
+	}
+	if res := run(nested(gqlMaxDepth + 1)); len(res.Errors) == 0 || res.Data != nil {
+		t.Errorf("query %d levels deep was run", gqlMaxDepth+1)
+	}
+	// Fragments count where they are spread.
+	frag := "fragment down on Device { children { children { children { children { children { children { children { children { hostname } } } } } } } } }\n" +
+		"{ tree { children { children { children { children { children { children { children { ...down } } } } } } } } }"
+	if res := run(frag); len(res.Errors) == 0 {
+		t.Error("query nested through a fragment was run")
+	}
+	if res := run(introspection); len(res.Errors) != 0 {
+		t.Errorf("introspection: %v", res.Errors)
+	}
+}
+
+// introspection is the query GraphiQL sends to load the schema.
+const introspection = `query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    types { ...FullType }
+  }
+}
+fragment FullType on __Type {
+  kind name
+  fields(includeDeprecated: true) { name args { ...InputValue } type { ...TypeRef } }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue { name type { ...TypeRef } defaultValue }
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name
+    ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } } }
+}`
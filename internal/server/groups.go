@@ -0,0 +1,391 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// groupMetrics is the aggregate of a device group's latest metrics. The
+// averages and sums cover the online devices that have reported metrics
+// (Reporting); bandwidth is in bytes per second like the per-device metrics.
+type groupMetrics struct {
+	Group     string    `json:"group"`
+	Devices   int       `json:"devices"`
+	Online    int       `json:"online"`
+	Offline   int       `json:"offline"`
+	Flapping  int       `json:"flapping"`
+	Reporting int       `json:"reporting"`
+	CPUAvg    float64   `json:"cpu_avg"`
+	MemAvg    float64   `json:"mem_avg"`
+	DiskAvg   float64   `json:"disk_avg"`
+	DiskMax   float64   `json:"disk_max"`
+	RxBytes   int64     `json:"rx_bytes"`
+	TxBytes   int64     `json:"tx_bytes"`
+	TCPConns  int       `json:"tcp_connections"`
+	UDPConns  int       `json:"udp_connections"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// aggregateGroups folds the latest metrics of devices into one aggregate
+// per group, sorted by name.
+func aggregateGroups(devices []models.Device) []*groupMetrics {
+	byGroup := map[string]*groupMetrics{}
+	for i := range devices {
+		d := &devices[i]
+		g := byGroup[d.Group]
+		if g == nil {
+			g = &groupMetrics{Group: d.Group}
+			byGroup[d.Group] = g
+		}
+		g.Devices++
+		if d.Flapping {
+			g.Flapping++
+		}
+		if !d.IsOnline {
+			g.Offline++
+			continue
+		}
+		g.Online++
+		m, err := GetLatestMetrics(d.ID)
+		if err != nil || m == nil {
+			continue
+		}
+		g.Reporting++
+		g.CPUAvg += m.CPUUsage
+		g.MemAvg += m.MemUsage
+		g.DiskAvg += m.DiskUsage
+		g.DiskMax = max(g.DiskMax, m.DiskUsage)
+		g.RxBytes += m.RxBytes
+		g.TxBytes += m.TxBytes
+		g.TCPConns += m.TCPConnections
+		g.UDPConns += m.UDPConnections
+		if m.ReportedAt.After(g.UpdatedAt) {
+			g.UpdatedAt = m.ReportedAt
+		}
+	}
+	out := make([]*groupMetrics, 0, len(byGroup))
+	for _, g := range byGroup {
+		if g.Reporting > 0 {
+			n := float64(g.Reporting)
+			g.CPUAvg, g.MemAvg, g.DiskAvg = g.CPUAvg/n, g.MemAvg/n, g.DiskAvg/n
+		}
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Group < out[j].Group })
+	return out
+}
+
+// SyncGroups creates a group record for every group name that devices use
+// and that has none yet, e.g. groups from before group records existed or
+// set by an agent's --group.
+func SyncGroups() error {
+	var used, known []string
+	if err := DB.Model(&models.Device{}).Distinct().Pluck("group", &used).Error; err != nil {
+		return err
+	}
+	if err := DB.Model(&models.DeviceGroup{}).Pluck("name", &known).Error; err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(known))
+	for _, name := range known {
+		have[name] = true
+	}
+	for _, name := range used {
+		if name == "" || have[name] {
+			continue
+		}
+		if err := DB.Create(&models.DeviceGroup{Name: name}).Error; err != nil {
+			return err
+		}
+		have[name] = true
+	}
+	return nil
+}
+
+// renameGroup moves everything that refers to group old by name over to
+// name: devices, alert / compliance rules, power schedules, silences,
+// subscriptions and the group lists of policies.
+func renameGroup(tx *gorm.DB, old, name string) error {
+	for _, m := range []any{&models.Device{}, &models.AlertRule{}, &models.ComplianceRule{}, &models.PowerSchedule{}, &models.Silence{}, &models.Subscription{}} {
+		if err := tx.Model(m).Where(map[string]any{"group": old}).Update("group", name).Error; err != nil {
+			return err
+		}
+	}
+	var list []models.Policy
+	if err := tx.Not(map[string]any{"groups": ""}).Find(&list).Error; err != nil {
+		return err
+	}
+	for _, p := range list {
+		groups := strings.Split(p.Groups, ",")
+		changed := false
+		for i, g := range groups {
+			if strings.TrimSpace(g) == old {
+				groups[i], changed = name, true
+			}
+		}
+		if changed {
+			if err := tx.Model(&p).Update("groups", strings.Join(groups, ",")).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkGroupParent validates parentID as the parent of group id (0: a new
+// group): it must exist and not be the group itself or one of its
+// descendants.
+func checkGroupParent(id uint, parentID *uint) error {
+	for cur, n := parentID, 0; cur != nil; n++ {
+		if *cur == id || n > 64 {
+			return fmt.Errorf("parent_id: would create a cycle")
+		}
+		var g models.DeviceGroup
+		if err := DB.Select("id", "parent_id").First(&g, *cur).Error; err != nil {
+			return fmt.Errorf("parent_id: group %d not found", *cur)
+		}
+		cur = g.ParentID
+	}
+	return nil
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// groupView is a group with the aggregate metrics of its devices.
+type groupView struct {
+	models.DeviceGroup
+	Metrics  *groupMetrics `json:"metrics"`
+	Children []*groupView  `json:"children,omitempty"`
+}
+
+// handleListGroups returns the groups the request may see, ordered by
+// position and name, each with the aggregate metrics of its devices;
+// ?tree=true nests them under their parents.
+func handleListGroups(c *gin.Context) {
+	if err := SyncGroups(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var list []models.DeviceGroup
+	if err := DB.Order("position, name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Model(&models.Device{})
+	allowed := deviceGroups(c)
+	if allowed != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(allowed))
+	}
+	var devices []models.Device
+	if err := q.Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	metrics := map[string]*groupMetrics{}
+	for _, m := range aggregateGroups(devices) {
+		metrics[m.Group] = m
+	}
+
+	views := make([]*groupView, 0, len(list))
+	byID := map[uint]*groupView{}
+	for _, g := range list {
+		if allowed != nil && !allowed[g.Name] {
+			continue
+		}
+		v := &groupView{DeviceGroup: g, Metrics: metrics[g.Name]}
+		if v.Metrics == nil {
+			v.Metrics = &groupMetrics{Group: g.Name}
+		}
+		views = append(views, v)
+		byID[g.ID] = v
+	}
+	if tree, _ := strconv.ParseBool(c.Query("tree")); tree {
+		roots := make([]*groupView, 0, len(views))
+		for _, v := range views {
+			if v.ParentID != nil && byID[*v.ParentID] != nil {
+				parent := byID[*v.ParentID]
+				parent.Children = append(parent.Children, v)
+				continue
+			}
+			roots = append(roots, v)
+		}
+		views = roots
+	}
+	c.JSON(http.StatusOK, gin.H{"data": views})
+}
+
+// groupBody is the create / update body for a group.
+type groupBody struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Color       *string `json:"color"`
+	// ParentID nests the group (null: top level); only applied when present.
+	ParentID json.RawMessage `json:"parent_id"`
+	Position *int            `json:"position"`
+}
+
+// apply copies the provided fields onto g and validates the result.
+func (b *groupBody) apply(g *models.DeviceGroup) error {
+	if b.Name != nil {
+		g.Name = strings.TrimSpace(*b.Name)
+	}
+	if b.Description != nil {
+		g.Description = *b.Description
+	}
+	if b.Color != nil {
+		g.Color = strings.TrimSpace(*b.Color)
+	}
+	if b.Position != nil {
+		g.Position = *b.Position
+	}
+	if len(b.ParentID) > 0 {
+		var parentID *uint
+		if err := json.Unmarshal(b.ParentID, &parentID); err != nil {
+			return fmt.Errorf("parent_id: want a group id or null")
+		}
+		if err := checkGroupParent(g.ID, parentID); err != nil {
+			return err
+		}
+		g.ParentID = parentID
+	}
+	if g.Name == "" || len(g.Name) > 64 || strings.Contains(g.Name, ",") {
+		return fmt.Errorf("name: want 1 to 64 characters, no commas")
+	}
+	return nil
+}
+
+// groupByName loads the group named by the :name parameter, answering 403
+// for groups outside the request's policy and 404 for unknown ones.
+func groupByName(c *gin.Context) (*models.DeviceGroup, bool) {
+	name := c.Param("name")
+	if groups := deviceGroups(c); groups != nil && !groups[name] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return nil, false
+	}
+	var g models.DeviceGroup
+	if err := DB.Where("name = ?", name).First(&g).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return nil, false
+	}
+	return &g, true
+}
+
+// handleCreateGroup creates a group.
+func handleCreateGroup(c *gin.Context) {
+	if deviceGroups(c) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+	var body groupBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var g models.DeviceGroup
+	if err := body.apply(&g); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&g).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": g})
+}
+
+// handleUpdateGroup changes a group (only the provided fields). A rename
+// carries over to its devices and to the rules, schedules, silences,
+// subscriptions and policies naming it.
+func handleUpdateGroup(c *gin.Context) {
+	g, ok := groupByName(c)
+	if !ok {
+		return
+	}
+	var body groupBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	old := g.Name
+	if err := body.apply(g); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("*").Save(g).Error; err != nil {
+			return err
+		}
+		if g.Name == old {
+			return nil
+		}
+		return renameGroup(tx, old, g.Name)
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if g.Name != old {
+		shared.Publish(topicAlertRules, nil)
+		shared.Publish(topicPolicies, nil)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": g})
+}
+
+// handleDeleteGroup deletes a group that no device is in any more; its
+// subgroups move up to its parent.
+func handleDeleteGroup(c *gin.Context) {
+	g, ok := groupByName(c)
+	if !ok {
+		return
+	}
+	var n int64
+	if err := DB.Model(&models.Device{}).Where(map[string]any{"group": g.Name}).Count(&n).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("group still has %d devices; move them first", n)})
+		return
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.DeviceGroup{}).Where("parent_id = ?", g.ID).Update("parent_id", g.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(g).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": g.Name})
+}
+
+// handleGroupMetrics returns the aggregate metrics of one device group:
+// summed bandwidth and connections, average CPU / memory / disk usage and
+// device counts.
+func handleGroupMetrics(c *gin.Context) {
+	name := c.Param("name")
+	if groups := deviceGroups(c); groups != nil && !groups[name] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+	var devices []models.Device
+	if err := DB.Where(map[string]any{"group": name}).Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": aggregateGroups(devices)[0]})
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// maxImportBytes bounds the size of an uploaded history file.
+var maxImportBytes int64 = 512 << 20
+
+// parquetMagic starts (and ends) every Parquet file.
+const parquetMagic = "PAR1"
+
+// errImportTooLarge is returned for files over maxImportBytes, rather than
+// importing the part that fit.
+var errImportTooLarge = errors.New("file exceeds the import size limit")
+
+// ImportSummary describes the outcome of a metrics history import.
+type ImportSummary struct {
+	Samples int       `json:"samples"`
+	Hours   int       `json:"hours"` // hourly rollup buckets written
+	Days    int       `json:"days"`  // daily rollup buckets written
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+}
+
+// readMetricsCSV decodes a CSV written by the export endpoint. Columns are
+// matched by header name, so files re-saved by pandas / spreadsheets work as
+// long as reported_at is present; missing metric columns read as zero.
+func readMetricsCSV(r io.Reader, emit func(MetricsRecord)) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading csv header: %w", err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := col["reported_at"]; !ok {
+		return errors.New("csv has no reported_at column")
+	}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		num := func(name string) float64 {
+			if i, ok := col[name]; ok && i < len(rec) {
+				v, _ := strconv.ParseFloat(strings.TrimSpace(rec[i]), 64)
+				return v
+			}
+			return 0
+		}
+		ts, err := parseTimeParam(strings.TrimSpace(rec[col["reported_at"]]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		emit(MetricsRecord{
+			ReportedAt:     ts,
+			CPUUsage:       num("cpu_usage"),
+			MemUsage:       num("mem_usage"),
+			MemTotal:       uint64(num("mem_total")),
+			DiskUsage:      num("disk_usage"),
+			RxBytes:        int64(num("rx_bytes")),
+			TxBytes:        int64(num("tx_bytes")),
+			TCPConnections: int64(num("tcp_connections")),
+			UDPConnections: int64(num("udp_connections")),
+		})
+	}
+}
+
+// readMetricsParquet decodes a Parquet file written by the export endpoint.
+func readMetricsParquet(f *os.File, emit func(MetricsRecord)) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pf, err := parquet.OpenFile(f, st.Size())
+	if err != nil {
+		return fmt.Errorf("opening parquet: %w", err)
+	}
+	pr := parquet.NewGenericReader[MetricsRecord](pf)
+	defer pr.Close()
+	buf := make([]MetricsRecord, exportBatchSize)
+	for {
+		n, err := pr.Read(buf)
+		for _, r := range buf[:n] {
+			emit(r)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ImportMetricsHistory aggregates previously exported samples into the hourly
+// and daily rollup tables of a device. Raw rows are not recreated: they would
+// be pruned immediately anyway. An hour RunRollups already keeps gets the
+// imported samples merged in; an hour holding only imported data is
+// replaced, so importing the same file twice is harmless. The days touched
+// are then re-merged from their hours.
+func ImportMetricsHistory(deviceID uint, format string, body io.Reader) (*ImportSummary, error) {
+	set := rollupSet{models.RollupHour: {}}
+	sum := &ImportSummary{}
+	emit := func(r MetricsRecord) {
+		if r.ReportedAt.IsZero() {
+			return
+		}
+		set.add(r)
+		sum.Samples++
+		if sum.From.IsZero() || r.ReportedAt.Before(sum.From) {
+			sum.From = r.ReportedAt
+		}
+		if r.ReportedAt.After(sum.To) {
+			sum.To = r.ReportedAt
+		}
+	}
+
+	// One byte past the limit tells a file that is too large from one that
+	// fits exactly.
+	limited := &io.LimitedReader{R: body, N: maxImportBytes + 1}
+	switch format {
+	case "csv":
+		err := readMetricsCSV(limited, emit)
+		if limited.N == 0 {
+			return nil, errImportTooLarge
+		}
+		if err != nil {
+			return nil, err
+		}
+	case "parquet":
+		// Parquet needs random access (footer first), so spool to disk.
+		tmp, err := os.CreateTemp("", "opentalon-import-*.parquet")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, limited); err != nil {
+			return nil, err
+		}
+		if limited.N == 0 {
+			return nil, errImportTooLarge
+		}
+		if err := readMetricsParquet(tmp, emit); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q (csv or parquet)", format)
+	}
+
+	hours := set[models.RollupHour]
+	rows := make([]models.MetricsRollup, 0, len(hours))
+	days := map[time.Time]bool{}
+	for b, acc := range hours {
+		var stored models.MetricsRollup
+		if err := DB.Where("device_id = ? AND resolution = ? AND bucket_start = ?", deviceID, models.RollupHour, b).
+			Limit(1).Find(&stored).Error; err != nil {
+			return nil, err
+		}
+		row := acc.row(deviceID, models.RollupHour, b)
+		if !stored.Through.IsZero() {
+			merged := accFromStats(stored.RollupStats)
+			merged.merge(acc)
+			row = merged.row(deviceID, models.RollupHour, b)
+			row.Through = stored.Through
+		}
+		rows = append(rows, row)
+		days[rollupBucket(models.RollupDay, b)] = true
+	}
+	if err := upsertRollups(rows); err != nil {
+		return nil, err
+	}
+	if err := rebuildDays(deviceID, days); err != nil {
+		return nil, err
+	}
+	sum.Hours, sum.Days = len(rows), len(days)
+	return sum, nil
+}
+
+// handleMetricsImport ingests an exported CSV / Parquet file into the rollup
+// tables of a device. The file is sent as the raw body or as the "file" field
+// of a multipart form; ?format= overrides detection by the file's leading
+// bytes (Parquet files start with PAR1).
+func handleMetricsImport(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	body := io.Reader(c.Request.Body)
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing file field"})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	format := c.Query("format")
+	if format == "" {
+		br := bufio.NewReader(body)
+		body, format = br, "csv"
+		if magic, _ := br.Peek(len(parquetMagic)); string(magic) == parquetMagic {
+			format = "parquet"
+		}
+	}
+
+	sum, err := ImportMetricsHistory(dev.ID, format, body)
+	if errors.Is(err, errImportTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": sum})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// metricsCSV renders samples at the given times with cpu_usage cpu.
+func metricsCSV(cpu float64, times ...time.Time) string {
+	var b strings.Builder
+	b.WriteString("reported_at,cpu_usage\n")
+	for _, ts := range times {
+		fmt.Fprintf(&b, "%s,%g\n", ts.Format(time.RFC3339), cpu)
+	}
+	return b.String()
+}
+
+func TestImportMetricsHistory(t *testing.T) {
+	hour := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// stored is the hourly row in place before the import.
+		stored      *models.MetricsRollup
+		imports     int // how many times the file is imported
+		wantSamples int
+		wantCPUAvg  float64
+	}{
+		{
+			name:        "new hour",
+			imports:     1,
+			wantSamples: 2, wantCPUAvg: 50,
+		},
+		{
+			name:        "re-import replaces imported hour",
+			imports:     2,
+			wantSamples: 2, wantCPUAvg: 50,
+		},
+		{
+			name: "merges into live hour",
+			stored: &models.MetricsRollup{DeviceID: 1, Resolution: models.RollupHour, BucketStart: hour,
+				Through: hour.Add(50 * time.Minute), RollupStats: models.RollupStats{Samples: 2, CPUAvg: 10, CPUMin: 10, CPUMax: 10}},
+			imports:     1,
+			wantSamples: 4, wantCPUAvg: 30,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			if tt.stored != nil {
+				if err := DB.Create(tt.stored).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			file := metricsCSV(50, hour.Add(5*time.Minute), hour.Add(55*time.Minute))
+			for i := 0; i < tt.imports; i++ {
+				if _, err := ImportMetricsHistory(1, "csv", strings.NewReader(file)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, res := range []string{models.RollupHour, models.RollupDay} {
+				var row models.MetricsRollup
+				if err := DB.Where("device_id = 1 AND resolution = ?", res).Take(&row).Error; err != nil {
+					t.Fatalf("%s: %v", res, err)
+				}
+				if row.Samples != tt.wantSamples || row.CPUAvg != tt.wantCPUAvg {
+					t.Errorf("%s: %d samples at %g avg, want %d at %g", res, row.Samples, row.CPUAvg, tt.wantSamples, tt.wantCPUAvg)
+				}
+			}
+		})
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	openTestDB(t)
+	prev := maxImportBytes
+	maxImportBytes = 64
+	t.Cleanup(func() { maxImportBytes = prev })
+
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	fits := metricsCSV(1, start)
+	if int64(len(fits)) > maxImportBytes {
+		t.Fatalf("test file of %d bytes does not fit", len(fits))
+	}
+	if _, err := ImportMetricsHistory(1, "csv", strings.NewReader(fits)); err != nil {
+		t.Fatalf("file within the limit: %v", err)
+	}
+	big := metricsCSV(1, start, start.Add(time.Hour), start.Add(2*time.Hour))
+	for _, format := range []string{"csv", "parquet"} {
+		if _, err := ImportMetricsHistory(1, format, strings.NewReader(big)); err != errImportTooLarge {
+			t.Errorf("%s: got %v, want errImportTooLarge", format, err)
+		}
+	}
+}
+
+func TestHandleMetricsImport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	openTestDB(t)
+	if err := DB.Create(&models.Device{Hostname: "web-1", IP: "10.0.0.1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	var pq bytes.Buffer
+	w := parquet.NewGenericWriter[MetricsRecord](&pq)
+	if _, err := w.Write([]MetricsRecord{{ReportedAt: start, CPUUsage: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/devices/:id/metrics/import", handleMetricsImport)
+	tests := []struct {
+		name, contentType string
+		body              []byte
+		wantStatus        int
+	}{
+		// Both are sent the way `opentalon import` and curl --data-binary
+		// send them; the content decides the format.
+		{"csv as octet-stream", "application/octet-stream", []byte(metricsCSV(5, start)), http.StatusOK},
+		{"parquet as text", "text/plain", pq.Bytes(), http.StatusOK},
+		{"neither", "application/octet-stream", []byte("garbage"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/devices/1/metrics/import", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+)
+
+// InfluxDB batching, as for ClickHouse: one write per influxBatchSize
+// points or influxFlushEvery; a failed batch is retried with the next one
+// while no more than influxMaxPending points wait.
+const (
+	influxBatchSize  = 1000
+	influxFlushEvery = 5 * time.Second
+	influxMaxPending = 50 * influxBatchSize
+)
+
+// influxSink forwards every ingested sample to an InfluxDB v2 bucket in the
+// line protocol, next to (not instead of) the metrics store.
+type influxSink struct {
+	writeURL string // .../api/v2/write?org=&bucket=&precision=ms
+	token    string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []string
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// influx is the sink started by StartInfluxExport; nil when off.
+var influx *influxSink
+
+// StartInfluxExport sends every sample to bucket of org at the InfluxDB v2
+// server baseURL (influx_url, e.g. http://influxdb:8086), authenticated
+// with token.
+func StartInfluxExport(baseURL, org, bucket, token string) error {
+	u, err := parseWebhookURL(baseURL)
+	if err != nil {
+		return fmt.Errorf("influx_url: %w", err)
+	}
+	if org == "" || bucket == "" {
+		return fmt.Errorf("influx_org and influx_bucket are required")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ms"}}.Encode()
+	influx = &influxSink{
+		writeURL: u.String(),
+		token:    token,
+		client:   telemetry.HTTPClient(&http.Client{Timeout: 30 * time.Second, Transport: proxy.Transport(proxy.Integration)}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go influx.flushLoop()
+	return nil
+}
+
+// exportInflux queues the sample m of dev for InfluxDB.
+func exportInflux(dev *models.Device, m *models.Metrics) {
+	if influx == nil {
+		return
+	}
+	line := influxLine(dev, m)
+	influx.mu.Lock()
+	influx.pending = append(influx.pending, line)
+	full := len(influx.pending) >= influxBatchSize
+	influx.mu.Unlock()
+	if full {
+		go influx.flushLogged()
+	}
+}
+
+// influxLine renders a sample as one point of the opentalon_metrics
+// measurement, tagged with the device.
+func influxLine(dev *models.Device, m *models.Metrics) string {
+	var b strings.Builder
+	b.WriteString("opentalon_metrics,device_id=")
+	b.WriteString(strconv.FormatUint(uint64(dev.ID), 10))
+	for _, t := range [][2]string{{"hostname", deviceName(dev)}, {"group", dev.Group}, {"ip", m.LocalIP}} {
+		if t[1] != "" {
+			b.WriteString("," + t[0] + "=" + influxEscape(t[1]))
+		}
+	}
+	fmt.Fprintf(&b, " cpu_usage=%s,mem_usage=%s,mem_total=%di,disk_usage=%s,rx_bytes=%di,tx_bytes=%di,"+
+		"tcp_connections=%di,udp_connections=%di,uptime=%di,boot_time=%di %d",
+		influxFloat(m.CPUUsage), influxFloat(m.MemUsage), m.MemTotal, influxFloat(m.DiskUsage), m.RxBytes, m.TxBytes,
+		m.TCPConnections, m.UDPConnections, m.Uptime, m.BootTime, m.ReportedAt.UnixMilli())
+	return b.String()
+}
+
+// influxEscape escapes a tag value per the line protocol.
+func influxEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", "").Replace(s)
+}
+
+func influxFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (s *influxSink) flushLoop() {
+	defer close(s.stopped)
+	tick := time.NewTicker(influxFlushEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			s.flushLogged()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *influxSink) flushLogged() {
+	if err := s.flush(); err != nil {
+		log.Printf("[influx] %v", err)
+	}
+}
+
+// flush writes the queued points. A failed batch is put back unless the
+// server rejected the points themselves (400), which no retry fixes.
+func (s *influxSink) flush() error {
+	s.mu.Lock()
+	lines := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(lines) == 0 {
+		return nil
+	}
+	status, err := s.write(lines)
+	if err != nil {
+		if status != http.StatusBadRequest {
+			s.mu.Lock()
+			if len(s.pending)+len(lines) <= influxMaxPending {
+				s.pending = append(lines, s.pending...)
+			}
+			s.mu.Unlock()
+		}
+		return fmt.Errorf("writing %d points: %w", len(lines), err)
+	}
+	return nil
+}
+
+func (s *influxSink) write(lines []string) (int, error) {
+	body := bytes.NewBufferString(strings.Join(lines, "\n"))
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.StatusCode, nil
+}
+
+// close stops the flush loop and writes what is still queued.
+func (s *influxSink) close() error {
+	close(s.stop)
+	<-s.stopped
+	return s.flush()
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// dataPort is the data-plane port agents installed over SSH join on.
+var dataPort int
+
+// SetDataPort stores the data-plane port for SSH agent installs.
+func SetDataPort(port int) {
+	dataPort = port
+}
+
+// agentBinaryPath is where SSH installs put the agent binary.
+const agentBinaryPath = "/usr/local/bin/opentalon"
+
+// unameArch maps `uname -m` to GOARCH.
+var unameArch = map[string]string{
+	"x86_64": "amd64", "amd64": "amd64",
+	"aarch64": "arm64", "arm64": "arm64",
+	"armv7l": "arm", "armv6l": "arm",
+	"i686": "386", "i386": "386",
+}
+
+// InstallAgentSSH installs this server's own binary as an agent on host over
+// SSH and registers it as a service joining this server, which only works
+// when host runs the same OS and architecture. It returns the installer's
+// output. Without password and key the default ssh_user / ssh_key_path are
+// used; users other than root need passwordless sudo. The install is listed
+// as a running task.
+func InstallAgentSSH(host, user, password, keyPEM, group string, parentID *uint) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	task, err := startTask(TaskInstall, "install agent", host, 0, cancel)
+	if err != nil {
+		return "", err
+	}
+	defer task.done()
+
+	var s *SSHClient
+	if password == "" && keyPEM == "" {
+		s, err = DialDeviceSSH(host)
+	} else {
+		s, err = NewSSHClient(host, user, password, keyPEM)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	s.ctx = ctx
+
+	out, err := s.Run("uname -sm")
+	if err != nil {
+		return out, fmt.Errorf("uname: %w", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 || strings.ToLower(fields[0]) != runtime.GOOS || unameArch[fields[1]] != runtime.GOARCH {
+		return out, fmt.Errorf("%s runs %s, this server is %s/%s: install the agent there by hand",
+			host, strings.TrimSpace(out), runtime.GOOS, runtime.GOARCH)
+	}
+
+	sudo := ""
+	if s.client.User() != "root" {
+		sudo = "sudo -n "
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tmp := agentBinaryPath + ".new"
+	if out, err := s.RunWithInput(fmt.Sprintf("%ssh -c 'cat > %s && chmod 755 %s && mv %s %s'",
+		sudo, tmp, tmp, tmp, agentBinaryPath), f); err != nil {
+		return out, fmt.Errorf("copying the binary: %w", err)
+	}
+
+	// The address the server has on the route to host is the one host can
+	// reach it on.
+	local, _, _ := net.SplitHostPort(s.client.LocalAddr().String())
+	cmd := fmt.Sprintf("%s%s install --mode agent --join %s --token %s", sudo, agentBinaryPath,
+		shellQuote(net.JoinHostPort(local, strconv.Itoa(dataPort))), shellQuote(agentToken))
+	if group != "" {
+		cmd += " --group " + shellQuote(group)
+	}
+	if parentID != nil {
+		cmd += fmt.Sprintf(" --parent %d", *parentID)
+	}
+	out, err = s.Run(cmd)
+	if err != nil {
+		return out, fmt.Errorf("installing the service: %w", err)
+	}
+	return out, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// handleInstallDiscovered installs the agent on a discovered host over SSH
+// (control-plane). On success the host leaves the discovered list; its
+// agent registers it as a managed device.
+func handleInstallDiscovered(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		User       string `json:"user"`
+		Password   string `json:"password"`
+		PrivateKey string `json:"private_key"`
+		Group      string `json:"group"`
+		ParentID   *uint  `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.User == "" {
+		body.User = "root"
+	}
+	var d models.DiscoveredDevice
+	if err := DB.First(&d, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "discovered device not found"})
+		return
+	}
+	out, err := InstallAgentSSH(d.IP, body.User, body.Password, body.PrivateKey, body.Group, body.ParentID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "output": out})
+		return
+	}
+	DB.Unscoped().Delete(&models.DiscoveredDevice{}, d.ID)
+	c.JSON(http.StatusOK, gin.H{"ok": true, "output": out})
+}
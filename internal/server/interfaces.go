@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// InterfaceReport mirrors agent.NetInterface to avoid circular imports.
+type InterfaceReport struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac"`
+	IPs       []string `json:"ips"`
+	MTU       int      `json:"mtu"`
+	SpeedMbps int      `json:"speed_mbps"`
+	State     string   `json:"state"`
+}
+
+// SyncInterfaces reconciles a device's interfaces with the agent's latest
+// list, keyed by name: new ones are inserted, vanished ones deleted and
+// changed ones updated; unchanged rows are not written.
+func SyncInterfaces(deviceID uint, primaryIP string, reports []InterfaceReport) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var existing []models.Interface
+		if err := tx.Where("device_id = ?", deviceID).Find(&existing).Error; err != nil {
+			return err
+		}
+		known := make(map[string]models.Interface, len(existing))
+		for _, i := range existing {
+			known[i.Name] = i
+		}
+		for _, r := range reports {
+			old, ok := known[r.Name]
+			delete(known, r.Name)
+			iface := models.Interface{
+				ID: old.ID, DeviceID: deviceID, Name: r.Name, MAC: r.MAC, IPs: r.IPs,
+				MTU: r.MTU, SpeedMbps: r.SpeedMbps, State: r.State,
+				Primary: holdsIP(r.IPs, primaryIP),
+			}
+			if iface.IPs == nil {
+				iface.IPs = []string{}
+			}
+			if ok && old.MAC == iface.MAC && slices.Equal(old.IPs, iface.IPs) && old.MTU == iface.MTU &&
+				old.SpeedMbps == iface.SpeedMbps && old.State == iface.State && old.Primary == iface.Primary {
+				continue
+			}
+			if err := tx.Save(&iface).Error; err != nil {
+				return err
+			}
+		}
+		if len(known) == 0 {
+			return nil
+		}
+		gone := make([]uint, 0, len(known))
+		for _, i := range known {
+			gone = append(gone, i.ID)
+		}
+		return tx.Delete(&models.Interface{}, gone).Error
+	})
+}
+
+// holdsIP reports whether one of the CIDR addresses is ip.
+func holdsIP(cidrs []string, ip string) bool {
+	want := net.ParseIP(ip)
+	if want == nil {
+		return false
+	}
+	for _, c := range cidrs {
+		if addr, _, err := net.ParseCIDR(c); err == nil && addr.Equal(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfacesByDevice loads every device's interfaces in one query for the
+// tree, the primary one first, then by name.
+func interfacesByDevice() map[uint][]models.Interface {
+	var all []models.Interface
+	if err := DB.Order("device_id, is_primary desc, name").Find(&all).Error; err != nil {
+		return nil
+	}
+	out := map[uint][]models.Interface{}
+	for _, i := range all {
+		out[i.DeviceID] = append(out[i.DeviceID], i)
+	}
+	return out
+}
+
+// handleDeviceInterfaces returns the network interfaces of a device.
+func handleDeviceInterfaces(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	list := []models.Interface{}
+	if err := DB.Where("device_id = ?", id).Order("is_primary desc, name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// latencyHistoryWindow bounds how long latency probes are kept per device,
+// enough for a one-day RTT / loss chart in the device drawer.
+const latencyHistoryWindow = 24 * time.Hour
+
+// latestLatency caches the most recent probe results per device.
+var latestLatency sync.Map // map[uint][]models.LatencySample
+
+// SaveLatencySamples persists one report's worth of latency probes for a
+// device and prunes samples older than latencyHistoryWindow.
+func SaveLatencySamples(deviceID uint, samples []models.LatencySample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range samples {
+		samples[i].ID = 0
+		samples[i].DeviceID = deviceID
+		samples[i].ReportedAt = now
+	}
+	if err := DB.Create(&samples).Error; err != nil {
+		return err
+	}
+	cached := make([]models.LatencySample, len(samples))
+	copy(cached, samples)
+	latestLatency.Store(deviceID, cached)
+
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-latencyHistoryWindow)).
+		Delete(&models.LatencySample{})
+	return nil
+}
+
+// GetLatestLatency returns the probes from the most recent report of a
+// device, or an empty slice when the agent does not run latency probes.
+func GetLatestLatency(deviceID uint) []models.LatencySample {
+	if v, ok := latestLatency.Load(deviceID); ok {
+		if ls, ok2 := v.([]models.LatencySample); ok2 {
+			return ls
+		}
+	}
+	var last models.LatencySample
+	if err := DB.Where("device_id = ?", deviceID).Order("reported_at desc").First(&last).Error; err != nil {
+		return []models.LatencySample{}
+	}
+	var list []models.LatencySample
+	DB.Where("device_id = ? AND reported_at = ?", deviceID, last.ReportedAt).
+		Order("target").
+		Find(&list)
+	latestLatency.Store(deviceID, list)
+	return list
+}
+
+// handleDeviceLatency returns the latency probe history of a device, oldest
+// first. ?target= (gateway / server / external) narrows it to one target and
+// ?from= / ?to= (RFC 3339 or unix seconds) to a time range within the
+// retained window.
+func handleDeviceLatency(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	q := DB.Where("device_id = ?", id)
+	if t := c.Query("target"); t != "" {
+		q = q.Where("target = ?", t)
+	}
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			ts, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("reported_at "+op+" ?", ts)
+		}
+	}
+	list := []models.LatencySample{}
+	if err := q.Order("reported_at, target").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"golang.org/x/net/websocket"
+)
+
+// Live tree updates: browsers connected to /api/ws get the device tree once
+// as flat nodes and then only patches (nodes added, removed, or the fields
+// that changed), instead of re-fetching the whole tree every few seconds.
+// The same stream carries the agents' fresh metrics and new events.
+const (
+	liveInterval = 3 * time.Second
+	// liveBuffer is how many messages may queue for a slow browser before
+	// it is dropped (it reconnects and starts over from a snapshot).
+	liveBuffer = 64
+)
+
+// LiveNode is one node of the flattened tree. Key is stable across updates
+// ("d:12" for a device, "d:12/container:3" for a container on it, ...);
+// Parent is the parent's key, "" for roots. Node is the models.DeviceTree
+// without its children.
+type LiveNode struct {
+	Key    string                     `json:"key"`
+	Parent string                     `json:"parent"`
+	Node   map[string]json.RawMessage `json:"node"`
+}
+
+// LiveOp is one change of a tree patch. Op is "add" (Parent and Node set),
+// "update" (Fields holds the changed node fields, null when a field
+// vanished; a re-parented node carries Parent) or "remove".
+type LiveOp struct {
+	Op     string                     `json:"op"`
+	Key    string                     `json:"key"`
+	Parent *string                    `json:"parent,omitempty"`
+	Node   map[string]json.RawMessage `json:"node,omitempty"`
+	Fields map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+// LiveMessage is sent over /api/ws: Type "tree" carries Nodes (in tree
+// order), "tree_patch" carries Ops to apply to the previous state. Seq
+// counts the tree states, so a client can tell it missed one. "metrics"
+// carries the samples reported since the last tick by device ID, "event"
+// one event just recorded; neither changes Seq.
+type LiveMessage struct {
+	Type    string                   `json:"type"`
+	Seq     uint64                   `json:"seq"`
+	Nodes   []LiveNode               `json:"nodes,omitempty"`
+	Ops     []LiveOp                 `json:"ops,omitempty"`
+	Metrics map[uint]*models.Metrics `json:"metrics,omitempty"`
+	Event   *models.Event            `json:"event,omitempty"`
+}
+
+var live = struct {
+	sync.Mutex
+	clients map[chan LiveMessage]struct{}
+	nodes   []LiveNode // last state sent, nil while nobody listens
+	seq     uint64
+	// reported is when the last sample pushed for each device was
+	// reported, nil while nobody listens.
+	reported map[uint]time.Time
+}{clients: map[chan LiveMessage]struct{}{}}
+
+// RunLiveUpdates rebuilds the tree every liveInterval while browsers are
+// connected and pushes the differences and the new metrics. It runs for
+// the life of the process.
+func RunLiveUpdates() {
+	tick := time.NewTicker(liveInterval)
+	defer tick.Stop()
+	for range tick.C {
+		live.Lock()
+		if len(live.clients) == 0 {
+			live.nodes = nil
+			live.reported = nil
+			live.Unlock()
+			continue
+		}
+		live.Unlock()
+
+		if fresh, err := liveMetrics(); err != nil {
+			log.Printf("[live] latest metrics: %v", err)
+		} else if len(fresh) > 0 {
+			live.Lock()
+			broadcastLocked(LiveMessage{Type: "metrics", Seq: live.seq, Metrics: fresh})
+			live.Unlock()
+		}
+
+		nodes, err := liveTree()
+		if err != nil {
+			log.Printf("[live] build tree: %v", err)
+			continue
+		}
+		live.Lock()
+		if ops := diffLiveNodes(live.nodes, nodes); len(ops) > 0 {
+			live.seq++
+			live.nodes = nodes
+			broadcastLocked(LiveMessage{Type: "tree_patch", Seq: live.seq, Ops: ops})
+		}
+		live.Unlock()
+	}
+}
+
+// broadcastLocked queues msg for every client, dropping the ones that fell
+// behind. The caller holds live.
+func broadcastLocked(msg LiveMessage) {
+	for ch := range live.clients {
+		select {
+		case ch <- msg:
+		default:
+			delete(live.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// liveMetrics returns the latest sample of every agent device that
+// reported since the previous call. The first call after nobody listened
+// only takes note of the current samples: new browsers fetch them anyway.
+func liveMetrics() (map[uint]*models.Metrics, error) {
+	var ids []uint
+	if err := DB.Model(&models.Device{}).Where("agent_ver <> ?", "discovered").Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	live.Lock()
+	defer live.Unlock()
+	first := live.reported == nil
+	if first {
+		live.reported = make(map[uint]time.Time, len(ids))
+	}
+	fresh := map[uint]*models.Metrics{}
+	for _, id := range ids {
+		m, ok := cachedLatestMetrics(id)
+		if !ok || !m.ReportedAt.After(live.reported[id]) {
+			continue
+		}
+		live.reported[id] = m.ReportedAt
+		if !first {
+			fresh[id] = m
+		}
+	}
+	return fresh, nil
+}
+
+// broadcastLiveEvent pushes an event recorded on any instance to the
+// browsers connected to this one.
+func broadcastLiveEvent(msg []byte) {
+	var ev models.Event
+	if err := json.Unmarshal(msg, &ev); err != nil {
+		log.Printf("[live] event: %v", err)
+		return
+	}
+	live.Lock()
+	broadcastLocked(LiveMessage{Type: "event", Seq: live.seq, Event: &ev})
+	live.Unlock()
+}
+
+// liveTree returns the current device tree, flattened.
+func liveTree() ([]LiveNode, error) {
+	tree, err := GetDeviceTree()
+	if err != nil {
+		return nil, err
+	}
+	var out []LiveNode
+	var walk func(parent string, list []*models.DeviceTree) error
+	walk = func(parent string, list []*models.DeviceTree) error {
+		for _, n := range list {
+			key := n.Key
+			node := *n
+			node.Children = nil
+			b, err := json.Marshal(node)
+			if err != nil {
+				return err
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(b, &fields); err != nil {
+				return err
+			}
+			out = append(out, LiveNode{Key: key, Parent: parent, Node: fields})
+			if err := walk(key, n.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return out, walk("", tree)
+}
+
+// treeKey is the Key of a tree node of kind ("" for a managed device)
+// and id.
+func treeKey(kind string, id uint) string {
+	if kind == "" {
+		kind = "d"
+	}
+	return kind + ":" + strconv.FormatUint(uint64(id), 10)
+}
+
+// diffLiveNodes returns the ops turning prev into next.
+func diffLiveNodes(prev, next []LiveNode) []LiveOp {
+	old := make(map[string]LiveNode, len(prev))
+	for _, n := range prev {
+		old[n.Key] = n
+	}
+	var ops []LiveOp
+	for _, n := range next {
+		o, ok := old[n.Key]
+		if !ok {
+			ops = append(ops, LiveOp{Op: "add", Key: n.Key, Parent: &n.Parent, Node: n.Node})
+			continue
+		}
+		delete(old, n.Key)
+		op := LiveOp{Op: "update", Key: n.Key, Fields: map[string]json.RawMessage{}}
+		for k, v := range n.Node {
+			if !bytes.Equal(o.Node[k], v) {
+				op.Fields[k] = v
+			}
+		}
+		for k := range o.Node {
+			if _, ok := n.Node[k]; !ok {
+				op.Fields[k] = json.RawMessage("null")
+			}
+		}
+		if o.Parent != n.Parent {
+			op.Parent = &n.Parent
+		}
+		if len(op.Fields) > 0 || op.Parent != nil {
+			ops = append(ops, op)
+		}
+	}
+	// Removals in the order of the previous tree.
+	for _, n := range prev {
+		if _, ok := old[n.Key]; ok {
+			ops = append(ops, LiveOp{Op: "remove", Key: n.Key})
+		}
+	}
+	return ops
+}
+
+// handleLiveWS upgrades to a WebSocket streaming LiveMessages. Browsers
+// cannot set headers on WebSockets, so the JWT is passed as ?token=.
+func handleLiveWS(c *gin.Context) {
+	claims, err := parseJWT(c.Query("token"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+		return
+	}
+	// The stream carries the whole tree, so roles limited to some device
+	// groups cannot use it.
+	if groups, ok := authorize(claims.role(), http.MethodGet, c.Request.URL.Path); !ok || groups != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+	websocket.Server{Handler: serveLive}.ServeHTTP(c.Writer, c.Request)
+}
+
+// serveLive sends the current tree and then the patches to one browser.
+func serveLive(ws *websocket.Conn) {
+	defer ws.Close()
+	ch := make(chan LiveMessage, liveBuffer)
+	live.Lock()
+	if live.nodes == nil {
+		nodes, err := liveTree()
+		if err != nil {
+			live.Unlock()
+			log.Printf("[live] build tree: %v", err)
+			return
+		}
+		live.seq++
+		live.nodes = nodes
+	}
+	// Queued under the lock, so the snapshot precedes any later patch.
+	ch <- LiveMessage{Type: "tree", Seq: live.seq, Nodes: live.nodes}
+	live.clients[ch] = struct{}{}
+	live.Unlock()
+	defer dropLiveClient(ch)
+
+	// The client sends nothing we use; a failed read means it went away.
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := ws.Read(buf); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return // fell behind
+			}
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// dropLiveClient unregisters a client unless it was dropped already.
+func dropLiveClient(ch chan LiveMessage) {
+	live.Lock()
+	if _, ok := live.clients[ch]; ok {
+		delete(live.clients, ch)
+		close(ch)
+	}
+	live.Unlock()
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// NeighborReport mirrors agent.Neighbor to avoid circular imports.
+type NeighborReport struct {
+	LocalPort string   `json:"local_port"`
+	Protocol  string   `json:"protocol"`
+	ChassisID string   `json:"chassis_id"`
+	PortID    string   `json:"port_id"`
+	PortDescr string   `json:"port_descr"`
+	SysName   string   `json:"sys_name"`
+	SysDescr  string   `json:"sys_descr"`
+	MgmtIPs   []string `json:"mgmt_ips"`
+}
+
+// SyncNeighbors reconciles a device's LLDP / CDP neighbors with the agent's
+// latest list, keyed by local port and remote chassis / port. New and
+// changed neighbors, and those not matched to a device yet, are matched
+// again; unchanged rows are not written.
+func SyncNeighbors(deviceID uint, reports []NeighborReport) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var existing []models.Neighbor
+		if err := tx.Where("device_id = ?", deviceID).Find(&existing).Error; err != nil {
+			return err
+		}
+		key := func(port, chassis, portID string) string { return port + "|" + chassis + "|" + portID }
+		known := make(map[string]models.Neighbor, len(existing))
+		for _, n := range existing {
+			known[key(n.LocalPort, n.ChassisID, n.PortID)] = n
+		}
+		for _, r := range reports {
+			k := key(r.LocalPort, r.ChassisID, r.PortID)
+			old, ok := known[k]
+			delete(known, k)
+			n := models.Neighbor{
+				ID: old.ID, DeviceID: deviceID, LocalPort: r.LocalPort, Protocol: r.Protocol,
+				ChassisID: r.ChassisID, PortID: r.PortID, PortDescr: r.PortDescr,
+				SysName: r.SysName, SysDescr: r.SysDescr, MgmtIPs: r.MgmtIPs,
+				PeerDeviceID: old.PeerDeviceID,
+			}
+			if n.MgmtIPs == nil {
+				n.MgmtIPs = []string{}
+			}
+			same := ok && old.Protocol == n.Protocol && old.PortDescr == n.PortDescr &&
+				old.SysName == n.SysName && old.SysDescr == n.SysDescr && slices.Equal(old.MgmtIPs, n.MgmtIPs)
+			if same && old.PeerDeviceID != nil {
+				continue
+			}
+			n.PeerDeviceID = matchNeighbor(tx, deviceID, r)
+			if same && n.PeerDeviceID == nil {
+				continue
+			}
+			if err := tx.Save(&n).Error; err != nil {
+				return err
+			}
+		}
+		if len(known) == 0 {
+			return nil
+		}
+		gone := make([]uint, 0, len(known))
+		for _, n := range known {
+			gone = append(gone, n.ID)
+		}
+		return tx.Delete(&models.Neighbor{}, gone).Error
+	})
+}
+
+// matchNeighbor finds the managed device behind a neighbor: by management
+// IP, then by a MAC address in the chassis or port ID (device MAC or any of
+// its interfaces), then by a system name only one device has as hostname.
+func matchNeighbor(tx *gorm.DB, deviceID uint, r NeighborReport) *uint {
+	var dev models.Device
+	if len(r.MgmtIPs) > 0 &&
+		tx.Select("id").Where("ip IN ? AND id <> ?", r.MgmtIPs, deviceID).Take(&dev).Error == nil {
+		return &dev.ID
+	}
+	for _, id := range []string{r.ChassisID, r.PortID} {
+		hw, err := net.ParseMAC(id)
+		if err != nil {
+			continue
+		}
+		mac := strings.ToLower(hw.String())
+		if tx.Select("id").Where("LOWER(mac) = ? AND id <> ?", mac, deviceID).Take(&dev).Error == nil {
+			return &dev.ID
+		}
+		var iface models.Interface
+		if tx.Select("device_id").Where("LOWER(mac) = ? AND device_id <> ?", mac, deviceID).Take(&iface).Error == nil {
+			return &iface.DeviceID
+		}
+	}
+	if r.SysName != "" {
+		var devs []models.Device
+		tx.Select("id").Where("LOWER(hostname) = ? AND id <> ?", strings.ToLower(r.SysName), deviceID).Limit(2).Find(&devs)
+		if len(devs) == 1 {
+			return &devs[0].ID
+		}
+	}
+	return nil
+}
+
+// L2Link is a physical link learned from LLDP / CDP. Confirmed is set when
+// both ends are agents that report each other; PeerDeviceID is nil for
+// neighbors that are not managed devices (e.g. an unmanaged switch), with
+// PeerName naming them.
+type L2Link struct {
+	DeviceID     uint   `json:"device_id"`
+	Port         string `json:"port"`
+	PeerDeviceID *uint  `json:"peer_device_id,omitempty"`
+	PeerName     string `json:"peer_name"`
+	PeerPort     string `json:"peer_port"`
+	Protocol     string `json:"protocol"`
+	Confirmed    bool   `json:"confirmed"`
+}
+
+// GetL2Links returns the layer-2 links between devices, one per cable: when
+// two agents report each other, their reports are merged.
+func GetL2Links() ([]L2Link, error) {
+	var list []models.Neighbor
+	if err := DB.Order("device_id, local_port, id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	// reverse[a][b] counts the reports of b by a not merged yet.
+	reverse := map[[2]uint]int{}
+	for _, n := range list {
+		if n.PeerDeviceID != nil {
+			reverse[[2]uint{n.DeviceID, *n.PeerDeviceID}]++
+		}
+	}
+	out := []L2Link{}
+	for _, n := range list {
+		l := L2Link{
+			DeviceID: n.DeviceID, Port: n.LocalPort, PeerDeviceID: n.PeerDeviceID,
+			PeerName: n.SysName, PeerPort: n.PortDescr, Protocol: n.Protocol,
+		}
+		if l.PeerName == "" {
+			l.PeerName = n.ChassisID
+		}
+		if l.PeerPort == "" {
+			l.PeerPort = n.PortID
+		}
+		if p := n.PeerDeviceID; p != nil {
+			if reverse[[2]uint{n.DeviceID, *p}] == 0 {
+				continue // merged into the peer's report of this link
+			}
+			back := [2]uint{*p, n.DeviceID}
+			if reverse[back] > 0 {
+				reverse[back]--
+				reverse[[2]uint{n.DeviceID, *p}]--
+				l.Confirmed = true
+			}
+		}
+		out = append(out, l)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out, nil
+}
+
+// handleDeviceNeighbors returns the LLDP / CDP neighbors of a device.
+func handleDeviceNeighbors(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	list := []models.Neighbor{}
+	if err := DB.Where("device_id = ?", id).Order("local_port, id").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// handleTopologyLinks returns the layer-2 links learned from LLDP / CDP.
+// A caller limited to device groups gets the links of those devices; a
+// peer outside them keeps the name its neighbor reported but not its ID.
+func handleTopologyLinks(c *gin.Context) {
+	links, err := GetL2Links()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		var ids []uint
+		if err := groupDeviceIDs(groups).Pluck("id", &ids).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		allowed := make(map[uint]bool, len(ids))
+		for _, id := range ids {
+			allowed[id] = true
+		}
+		kept := links[:0]
+		for _, l := range links {
+			if !allowed[l.DeviceID] {
+				continue
+			}
+			if l.PeerDeviceID != nil && !allowed[*l.PeerDeviceID] {
+				l.PeerDeviceID = nil
+			}
+			kept = append(kept, l)
+		}
+		links = kept
+	}
+	c.JSON(http.StatusOK, gin.H{"data": links})
+}
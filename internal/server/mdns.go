@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/vesaa/opentalon/internal/mdns"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// fingerprintKey is the Setting holding the server fingerprint.
+const fingerprintKey = "server_fingerprint"
+
+var (
+	fingerprintOnce sync.Once
+	fingerprint     string
+)
+
+// Fingerprint returns this server's identity: random hex generated on first
+// start and kept in the database, so clients that found the server on the
+// LAN can pin it and notice when another server answers instead.
+func Fingerprint() string {
+	fingerprintOnce.Do(func() {
+		var s models.Setting
+		err := DB.Where(&models.Setting{Key: fingerprintKey}).Take(&s).Error
+		if err == nil && s.Value != "" {
+			fingerprint = s.Value
+			return
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[mdns] loading fingerprint: %v", err)
+		}
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		fingerprint = hex.EncodeToString(b)
+		if err := DB.Save(&models.Setting{Key: fingerprintKey, Value: fingerprint}).Error; err != nil {
+			log.Printf("[mdns] saving fingerprint: %v", err)
+		}
+	})
+	return fingerprint
+}
+
+// AdvertiseMDNS announces the server as _opentalon._tcp on the LAN until
+// the process exits. The SRV record points at the data plane for agents;
+// the TXT record carries the data and control ports, the fingerprint and
+// the version for the UI and CLI clients. instance defaults to
+// "OpenTalon on <hostname>".
+func AdvertiseMDNS(instance string, dataPort, controlPort int, version string) {
+	if instance == "" {
+		host, _ := os.Hostname()
+		instance = "OpenTalon on " + host
+	}
+	r := &mdns.Responder{
+		Instance: instance,
+		Service:  "_opentalon._tcp",
+		Port:     dataPort,
+		TXT: []string{
+			fmt.Sprintf("port=%d", dataPort),
+			fmt.Sprintf("control_port=%d", controlPort),
+			"fp=" + Fingerprint(),
+			"version=" + version,
+		},
+	}
+	if err := r.Serve(context.Background()); err != nil {
+		log.Printf("[mdns] responder stopped: %v", err)
+	}
+}
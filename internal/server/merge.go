@@ -0,0 +1,315 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// Before agents reported machine IDs, a host that changed address could end
+// up as several devices. GET /api/devices/duplicates lists the likely
+// candidates and POST /api/devices/:id/merge folds them into one.
+
+// deviceHistory are the tables whose rows are history of a device and move
+// over as they are when merging.
+var deviceHistory = []any{
+	&models.Event{}, &models.Alert{}, &models.AlertEvent{}, &models.RemediationRun{}, &models.LatencySample{},
+	&models.ReportTiming{}, &models.DNSSample{}, &models.Traceroute{}, &models.SpeedTest{}, &models.SensorReading{},
+	&models.GPUReading{}, &models.CustomMetrics{}, &models.ProcessSample{}, &models.CheckResult{},
+}
+
+// deviceRefs are the tables that point at a device by an optional
+// device_id and follow it when merging.
+var deviceRefs = []any{&models.Silence{}, &models.Subscription{}, &models.RemediationHook{}}
+
+// duplicateSet is a group of devices that look like the same host.
+type duplicateSet struct {
+	Reason  string          `json:"reason"` // machine_id, hostname or mac
+	Key     string          `json:"key"`
+	Devices []models.Device `json:"devices"`
+}
+
+// findDuplicates groups the devices that share a machine ID, an agent
+// hostname or a MAC address, most recently seen first within a set.
+func findDuplicates(devices []models.Device) []duplicateSet {
+	var out []duplicateSet
+	seen := map[string]bool{}
+	for _, key := range []struct {
+		reason string
+		of     func(d *models.Device) string
+	}{
+		{"machine_id", func(d *models.Device) string { return d.MachineID }},
+		{"hostname", func(d *models.Device) string {
+			if d.AgentVer == "discovered" {
+				return ""
+			}
+			return strings.ToLower(d.Hostname)
+		}},
+		{"mac", func(d *models.Device) string { return strings.ToLower(d.MAC) }},
+	} {
+		byKey := map[string][]models.Device{}
+		for i := range devices {
+			if k := key.of(&devices[i]); k != "" {
+				byKey[k] = append(byKey[k], devices[i])
+			}
+		}
+		for k, list := range byKey {
+			if len(list) < 2 {
+				continue
+			}
+			ids := make([]string, len(list))
+			for i, d := range list {
+				ids[i] = strconv.FormatUint(uint64(d.ID), 10)
+			}
+			sort.Strings(ids)
+			if sig := strings.Join(ids, ","); !seen[sig] {
+				seen[sig] = true
+				sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+				out = append(out, duplicateSet{Reason: key.reason, Key: k, Devices: list})
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// replaceListID replaces id from by to in a comma-separated id list,
+// dropping the repeat when to is listed already.
+func replaceListID(list string, from, to uint) string {
+	if list == "" {
+		return list
+	}
+	f, t := strconv.FormatUint(uint64(from), 10), strconv.FormatUint(uint64(to), 10)
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == f {
+			s = t
+		}
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// mergeDevice folds device from into keep: its history (events, alerts,
+// rollups, raw samples when kept in the main database, probes, …), the
+// silences, subscriptions, hooks, rules, schedules and checks naming it, its
+// tags, children and metadata move over, then from is purged. When keep was
+// a child of from it takes from's place under from's parent.
+func mergeDevice(keep, from *models.Device) error {
+	msg := fmt.Sprintf("%s (#%d, %s) merged into %s", deviceName(from), from.ID, from.IP, deviceName(keep))
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for _, m := range deviceHistory {
+			if err := tx.Model(m).Where("device_id = ?", from.ID).Update("device_id", keep.ID).Error; err != nil {
+				return err
+			}
+		}
+		for _, m := range deviceRefs {
+			if err := tx.Model(m).Where("device_id = ?", from.ID).Update("device_id", keep.ID).Error; err != nil {
+				return err
+			}
+		}
+		if _, ok := metricsStore.(gormMetricsStore); ok {
+			if err := tx.Model(&models.Metrics{}).Where("device_id = ?", from.ID).Update("device_id", keep.ID).Error; err != nil {
+				return err
+			}
+		}
+		if err := mergeRollups(tx, keep.ID, from.ID); err != nil {
+			return err
+		}
+		for _, list := range []struct {
+			model  any
+			column string
+		}{
+			{&models.AlertRule{}, "device_ids"}, {&models.PowerSchedule{}, "device_ids"}, {&models.Check{}, "agent_ids"},
+		} {
+			var rows []struct {
+				ID   uint
+				List string
+			}
+			if err := tx.Model(list.model).Select("id", list.column+" AS list").Where(list.column+" <> ?", "").Scan(&rows).Error; err != nil {
+				return err
+			}
+			for _, r := range rows {
+				if ids := replaceListID(r.List, from.ID, keep.ID); ids != r.List {
+					if err := tx.Model(list.model).Where("id = ?", r.ID).Update(list.column, ids).Error; err != nil {
+						return err
+					}
+				}
+			}
+		}
+		var tagIDs []uint
+		if err := tx.Model(&models.DeviceTag{}).Where("device_id = ?", from.ID).Pluck("tag_id", &tagIDs).Error; err != nil {
+			return err
+		}
+		for _, t := range tagIDs {
+			if err := tx.Where(models.DeviceTag{DeviceID: keep.ID, TagID: t}).FirstOrCreate(&models.DeviceTag{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Model(&models.Device{}).Where("parent_id = ? AND id <> ?", from.ID, keep.ID).Update("parent_id", keep.ID).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]any{}
+		if keep.ParentID != nil && *keep.ParentID == from.ID {
+			updates["parent_id"] = from.ParentID
+		}
+		if keep.Remark == "" && from.Remark != "" {
+			updates["remark"] = from.Remark
+		}
+		if keep.MAC == "" && from.MAC != "" {
+			updates["mac"] = from.MAC
+		}
+		if keep.MachineID == "" && from.MachineID != "" {
+			updates["machine_id"] = from.MachineID
+		}
+		if from.CreatedAt.Before(keep.CreatedAt) {
+			updates["created_at"] = from.CreatedAt
+		}
+		if len(from.Metadata) > 0 {
+			meta := make(map[string]any, len(keep.Metadata)+len(from.Metadata))
+			for k, v := range from.Metadata {
+				meta[k] = v
+			}
+			for k, v := range keep.Metadata {
+				meta[k] = v
+			}
+			keep.Metadata = meta
+			if err := tx.Model(keep).Select("metadata").Updates(keep).Error; err != nil {
+				return err
+			}
+		}
+		if len(updates) > 0 {
+			return tx.Model(keep).Updates(updates).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := purgeDevice(from.ID); err != nil {
+		return err
+	}
+	shared.Publish(topicAlertRules, nil)
+	RecordEvent(keep.ID, models.EventDeviceMerged, msg, map[string]any{"merged_id": from.ID, "merged_ip": from.IP})
+	return nil
+}
+
+// mergeRollups moves the rollups of device from to keep, except for the
+// buckets keep already has.
+func mergeRollups(tx *gorm.DB, keep, from uint) error {
+	type bucket struct {
+		ID          uint
+		Resolution  string
+		BucketStart time.Time
+	}
+	var have []bucket
+	if err := tx.Model(&models.MetricsRollup{}).Select("id", "resolution", "bucket_start").
+		Where("device_id = ?", keep).Scan(&have).Error; err != nil {
+		return err
+	}
+	taken := make(map[string]bool, len(have))
+	for _, b := range have {
+		taken[b.Resolution+b.BucketStart.UTC().String()] = true
+	}
+	var rows []bucket
+	if err := tx.Model(&models.MetricsRollup{}).Select("id", "resolution", "bucket_start").
+		Where("device_id = ?", from).Scan(&rows).Error; err != nil {
+		return err
+	}
+	var move []uint
+	for _, b := range rows {
+		if !taken[b.Resolution+b.BucketStart.UTC().String()] {
+			move = append(move, b.ID)
+		}
+	}
+	for len(move) > 0 {
+		n := min(len(move), 500)
+		if err := tx.Model(&models.MetricsRollup{}).Where("id IN ?", move[:n]).Update("device_id", keep).Error; err != nil {
+			return err
+		}
+		move = move[n:]
+	}
+	return nil
+}
+
+// handleDeviceDuplicates lists the sets of devices that look like the same
+// host (same machine ID, agent hostname or MAC address).
+func handleDeviceDuplicates(c *gin.Context) {
+	q := DB.Model(&models.Device{})
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	var devices []models.Device
+	if err := q.Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sets := findDuplicates(devices)
+	if sets == nil {
+		sets = []duplicateSet{}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": sets})
+}
+
+// handleMergeDevice folds other devices into this one:
+// POST /api/devices/:id/merge {"from": [12, 15]}. The devices in from are
+// deleted for good once their history has moved.
+func handleMergeDevice(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		From []uint `json:"from" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var keep models.Device
+	if err := DB.First(&keep, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	groups := deviceGroups(c)
+	var others []models.Device
+	for _, fid := range body.From {
+		if fid == keep.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from: cannot merge a device into itself"})
+			return
+		}
+		var d models.Device
+		if DB.Unscoped().First(&d, fid).Error != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("from: device %d not found", fid)})
+			return
+		}
+		if groups != nil && !groups[d.Group] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		others = append(others, d)
+	}
+	for i := range others {
+		if err := mergeDevice(&keep, &others[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := DB.First(&keep, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": keep})
+}
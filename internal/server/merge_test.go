@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestReplaceListID(t *testing.T) {
+	tests := []struct {
+		list     string
+		from, to uint
+		want     string
+	}{
+		{"", 3, 7, ""},
+		{"3", 3, 7, "7"},
+		{"1, 3,5", 3, 7, "1,7,5"},
+		{"3,7", 3, 7, "7"},
+		{"13,31", 3, 7, "13,31"},
+	}
+	for _, tt := range tests {
+		if got := replaceListID(tt.list, tt.from, tt.to); got != tt.want {
+			t.Errorf("replaceListID(%q, %d, %d) = %q, want %q", tt.list, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestMergeDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		// keepUnderFrom puts keep below from; otherwise both hang off root.
+		keepUnderFrom bool
+		fromHasParent bool
+	}{
+		{"siblings", false, true},
+		{"keep below from", true, true},
+		{"keep below a top-level from", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			n := 0
+			create := func(parent *uint) *models.Device {
+				n++
+				d := &models.Device{Hostname: fmt.Sprintf("host-%d", n), IP: fmt.Sprintf("10.0.0.%d", n), ParentID: parent}
+				if err := DB.Create(d).Error; err != nil {
+					t.Fatal(err)
+				}
+				return d
+			}
+			root := create(nil)
+			var fromParent *uint
+			if tt.fromHasParent {
+				fromParent = &root.ID
+			}
+			from := create(fromParent)
+			keepParent := &root.ID
+			if tt.keepUnderFrom {
+				keepParent = &from.ID
+			}
+			keep := create(keepParent)
+			child := create(&from.ID)
+
+			check := models.Check{Name: "http", Type: "http", AgentIDs: fmt.Sprintf("%d,%d", root.ID, from.ID)}
+			if err := DB.Create(&check).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := DB.Create(&models.CheckResult{CheckID: check.ID, DeviceID: from.ID, OK: true}).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			if err := mergeDevice(keep, from); err != nil {
+				t.Fatal(err)
+			}
+
+			var got models.Device
+			if err := DB.First(&got, keep.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			wantParent := keepParent
+			if tt.keepUnderFrom {
+				wantParent = fromParent
+			}
+			if derefID(got.ParentID) != derefID(wantParent) {
+				t.Errorf("keep parent = %v, want %v", derefID(got.ParentID), derefID(wantParent))
+			}
+			var moved models.Device
+			if err := DB.First(&moved, child.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if derefID(moved.ParentID) != keep.ID {
+				t.Errorf("child parent = %v, want %d", derefID(moved.ParentID), keep.ID)
+			}
+			var results int64
+			DB.Model(&models.CheckResult{}).Where("device_id = ?", keep.ID).Count(&results)
+			if results != 1 {
+				t.Errorf("keep has %d check results, want 1", results)
+			}
+			DB.First(&check, check.ID)
+			if want := fmt.Sprintf("%d,%d", root.ID, keep.ID); check.AgentIDs != want {
+				t.Errorf("check agents = %q, want %q", check.AgentIDs, want)
+			}
+			if DB.Unscoped().First(&models.Device{}, from.ID).Error == nil {
+				t.Error("from was not purged")
+			}
+		})
+	}
+}
+
+// derefID shows a parent id, 0 for none.
+func derefID(id *uint) uint {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Limits of a device's custom metadata.
+const (
+	maxMetadataKeyLen = 64
+	maxMetadataBytes  = 16 << 10
+)
+
+// mergeMetadata applies patch to meta JSON-merge-patch style: keys set to
+// null are removed, all others are set (values may be any JSON).
+func mergeMetadata(meta, patch map[string]any) (map[string]any, error) {
+	out := make(map[string]any, len(meta)+len(patch))
+	for k, v := range meta {
+		out[k] = v
+	}
+	for k, v := range patch {
+		if k == "" || len(k) > maxMetadataKeyLen {
+			return nil, fmt.Errorf("metadata key %q: want 1 to %d characters", k, maxMetadataKeyLen)
+		}
+		if v == nil {
+			delete(out, k)
+			continue
+		}
+		out[k] = v
+	}
+	if b, _ := json.Marshal(out); len(b) > maxMetadataBytes {
+		return nil, fmt.Errorf("metadata exceeds %d bytes", maxMetadataBytes)
+	}
+	return out, nil
+}
+
+// handleDeviceMetadata edits a device's custom metadata:
+// PATCH /api/devices/:id/metadata {"rack": "A3", "warranty_until":
+// "2027-05-01", "old_key": null}. Listed keys are set, null removes a key,
+// the rest are kept. Returns the resulting metadata.
+func handleDeviceMetadata(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var patch map[string]any
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "want a JSON object: " + err.Error()})
+		return
+	}
+	var dev models.Device
+	if err := DB.Select("id", "metadata").First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	meta, err := mergeMetadata(dev.Metadata, patch)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dev.Metadata = meta
+	if err := DB.Model(&dev).Select("metadata").Updates(&dev).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"device_id": dev.ID, "metadata": meta}})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/config"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// MetricsStore keeps the raw metrics samples agents report. The handlers,
+// exports, rollups and alerting read and write samples only through it, so
+// a time-series backend can replace the main database for them.
+type MetricsStore interface {
+	// Write stores one sample; m.DeviceID and m.ReportedAt are set.
+	Write(m *models.Metrics) error
+	// Latest returns the newest sample of a device, or gorm.ErrRecordNotFound.
+	Latest(deviceID uint) (*models.Metrics, error)
+	// QueryRange calls emit with the samples reported in [from, to), oldest
+	// first and a batch at a time. deviceID 0 selects every device; a zero
+	// from or to leaves that end open.
+	QueryRange(deviceID uint, from, to time.Time, emit func([]models.Metrics) error) error
+	// Devices lists the devices that have at least one sample.
+	Devices() ([]uint, error)
+	// Prune drops all but the newest keep samples of a device. Stores with
+	// their own retention may ignore it.
+	Prune(deviceID uint, keep int) error
+	// DeleteBefore drops the samples of a device reported before before (a
+	// zero before: all of them) and returns how many there were.
+	DeleteBefore(deviceID uint, before time.Time) (int64, error)
+}
+
+// metricsStore is the active store, set by InitDB.
+var metricsStore MetricsStore
+
+// openMetricsStore returns the store metrics_driver selects: "db" (or empty)
+// keeps samples in the main database, "clickhouse" in ClickHouse.
+func openMetricsStore(cfg *config.Config, db *gorm.DB) (MetricsStore, error) {
+	switch cfg.MetricsDriver {
+	case "db", "":
+		return gormMetricsStore{db}, nil
+	case "clickhouse":
+		return newClickHouseStore(cfg.MetricsDSN, cfg.MetricsRetentionDays)
+	default:
+		return nil, fmt.Errorf("unsupported metrics_driver %q (use 'db' or 'clickhouse')", cfg.MetricsDriver)
+	}
+}
+
+// CloseMetricsStore sends the samples the store and the InfluxDB and OTLP
+// exports still buffer; call it on shutdown.
+func CloseMetricsStore() error {
+	if influx != nil {
+		if err := influx.close(); err != nil {
+			log.Printf("[influx] %v", err)
+		}
+	}
+	if otlp != nil {
+		if err := otlp.close(); err != nil {
+			log.Printf("[otlp] %v", err)
+		}
+	}
+	if c, ok := metricsStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// gormMetricsStore keeps samples in the metrics table of the main database.
+type gormMetricsStore struct{ db *gorm.DB }
+
+func (s gormMetricsStore) Write(m *models.Metrics) error { return s.db.Create(m).Error }
+
+// Latest 首选通过 DeviceID 查询；如果没有记录，则退化为按 LocalIP 匹配设备 IP，
+// 兼容历史或异常情况下 DeviceID 不一致的 metrics 行。
+func (s gormMetricsStore) Latest(deviceID uint) (*models.Metrics, error) {
+	var m models.Metrics
+	err := s.db.Where("device_id = ?", deviceID).Order("reported_at desc").First(&m).Error
+	if err == gorm.ErrRecordNotFound {
+		var dev models.Device
+		if e2 := s.db.First(&dev, deviceID).Error; e2 != nil {
+			return nil, err
+		}
+		err = s.db.Where("local_ip = ?", dev.IP).Order("reported_at desc").First(&m).Error
+	}
+	return &m, err
+}
+
+func (s gormMetricsStore) QueryRange(deviceID uint, from, to time.Time, emit func([]models.Metrics) error) error {
+	q := s.db
+	if deviceID != 0 {
+		q = q.Where("device_id = ?", deviceID)
+	}
+	if !from.IsZero() {
+		q = q.Where("reported_at >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("reported_at < ?", to)
+	}
+	var batch []models.Metrics
+	return q.FindInBatches(&batch, exportBatchSize, func(_ *gorm.DB, _ int) error {
+		return emit(batch)
+	}).Error
+}
+
+func (s gormMetricsStore) Devices() ([]uint, error) {
+	var ids []uint
+	err := s.db.Model(&models.Metrics{}).Distinct("device_id").Pluck("device_id", &ids).Error
+	return ids, err
+}
+
+func (s gormMetricsStore) DeleteBefore(deviceID uint, before time.Time) (int64, error) {
+	q := s.db.Unscoped().Where("device_id = ?", deviceID)
+	if !before.IsZero() {
+		q = q.Where("reported_at < ?", before)
+	}
+	res := q.Delete(&models.Metrics{})
+	return res.RowsAffected, res.Error
+}
+
+// Prune hard-deletes the pruned rows so the table really stays bounded.
+// GORM ignores Order/Offset on Delete, so it looks up the oldest row to keep
+// first.
+func (s gormMetricsStore) Prune(deviceID uint, keep int) error {
+	var cutoff models.Metrics
+	err := s.db.Select("reported_at").
+		Where("device_id = ?", deviceID).
+		Order("reported_at desc").
+		Offset(keep - 1).
+		Limit(1).
+		Take(&cutoff).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.db.Unscoped().
+		Where("device_id = ? AND reported_at < ?", deviceID, cutoff.ReportedAt).
+		Delete(&models.Metrics{}).Error
+}
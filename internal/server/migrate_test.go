@@ -0,0 +1,98 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestMigrateDatabase(t *testing.T) {
+	dir := t.TempDir()
+	src := openSQLite(t, filepath.Join(dir, "src.db"))
+	dev := models.Device{Hostname: "web-1", IP: "10.0.0.1"}
+	tag := models.Tag{Name: "prod"}
+	if err := src.Create(&dev).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Create(&tag).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Create(&models.DeviceTag{DeviceID: dev.ID, TagID: tag.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	dst := openSQLite(t, filepath.Join(dir, "dst.db"))
+
+	// The second run re-copies onto the rows of the first.
+	for run := 1; run <= 2; run++ {
+		report, err := MigrateDatabase(src, dst, nil)
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		want := map[string]int64{"devices": 1, "tags": 1, "device_tags": 1}
+		for _, tbl := range report {
+			if !tbl.Verified {
+				t.Errorf("run %d: %s not verified: %+v", run, tbl.Table, tbl)
+			}
+			if n, ok := want[tbl.Table]; ok && tbl.Target != n {
+				t.Errorf("run %d: %s has %d rows, want %d", run, tbl.Table, tbl.Target, n)
+			}
+		}
+	}
+}
+
+func TestMigrateDatabasePruned(t *testing.T) {
+	dir := t.TempDir()
+	src := openSQLite(t, filepath.Join(dir, "src.db"))
+	dev := models.Device{Hostname: "web-1", IP: "10.0.0.1"}
+	if err := src.Create(&dev).Error; err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		m := models.Metrics{DeviceID: dev.ID, ReportedAt: start.Add(time.Duration(i) * time.Minute)}
+		if err := src.Create(&m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	tags := []models.Tag{{Name: "prod"}, {Name: "web"}}
+	if err := src.Create(&tags).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := src.Create(&models.DeviceTag{DeviceID: dev.ID, TagID: tag.ID}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := openSQLite(t, filepath.Join(dir, "dst.db"))
+	if _, err := MigrateDatabase(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The live server prunes the oldest sample and a tag between runs.
+	if err := (gormMetricsStore{src}).Prune(dev.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Where("tag_id = ?", tags[0].ID).Delete(&models.DeviceTag{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := MigrateDatabase(src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct{ target, deleted int64 }{
+		"metrics":     {3, 1},
+		"device_tags": {1, 1},
+		"devices":     {1, 0},
+	}
+	for _, tbl := range report {
+		if !tbl.Verified {
+			t.Errorf("%s not verified: %+v", tbl.Table, tbl)
+		}
+		if w, ok := want[tbl.Table]; ok && (tbl.Target != w.target || tbl.Deleted != w.deleted) {
+			t.Errorf("%s: target %d, deleted %d; want %d, %d", tbl.Table, tbl.Target, tbl.Deleted, w.target, w.deleted)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+)
+
+// promSample is one sample of the Prometheus text format.
+type promSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parsePromText reads the Prometheus text exposition format, skipping
+// comments and samples it cannot parse.
+func parsePromText(r io.Reader) ([]promSample, error) {
+	var out []promSample
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		s := promSample{labels: map[string]string{}}
+		rest := line
+		if i := strings.IndexAny(line, "{ "); i < 0 {
+			continue
+		} else {
+			s.name, rest = line[:i], line[i:]
+		}
+		if rest[0] == '{' {
+			var ok bool
+			if rest, ok = parsePromLabels(rest[1:], s.labels); !ok {
+				continue
+			}
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		s.value = v
+		out = append(out, s)
+	}
+	return out, sc.Err()
+}
+
+// parsePromLabels parses `name="value",…}` into labels and returns what
+// follows the closing brace.
+func parsePromLabels(s string, labels map[string]string) (string, bool) {
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return "", false
+		}
+		if s[0] == '}' {
+			return s[1:], true
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return "", false
+		}
+		name := strings.TrimSpace(s[:eq])
+		var v strings.Builder
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					v.WriteByte('\n')
+				default:
+					v.WriteByte(s[i])
+				}
+				continue
+			}
+			v.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", false
+		}
+		labels[name] = v.String()
+		s = s[i+1:]
+	}
+}
+
+// nodeExporterTarget is one scraped node_exporter and what the previous
+// scrape saw, for the counters turned into rates.
+type nodeExporterTarget struct {
+	url      string
+	deviceID uint
+
+	at              time.Time
+	cpuIdle, cpuAll float64
+	rx, tx          float64
+}
+
+// virtualNICPrefixes are the interfaces left out of the traffic rates, as
+// the agent does.
+var virtualNICPrefixes = []string{"lo", "veth", "docker", "br-", "virbr", "cni", "flannel", "cali", "kube-"}
+
+// pseudoFSTypes are left out of the disk usage.
+var pseudoFSTypes = map[string]bool{
+	"tmpfs": true, "devtmpfs": true, "overlay": true, "squashfs": true, "ramfs": true,
+	"nsfs": true, "autofs": true, "fuse.lxcfs": true, "iso9660": true,
+}
+
+// RunNodeExporterScrapes scrapes every interval the node_exporter endpoints
+// in targets (node_exporter_targets, e.g. http://10.0.0.5:9100/metrics) and
+// stores them as devices of group, so already instrumented hosts need no
+// agent.
+func RunNodeExporterScrapes(targets []string, group string, interval time.Duration) {
+	list := make([]*nodeExporterTarget, 0, len(targets))
+	for _, t := range targets {
+		u, err := parseWebhookURL(t)
+		if err != nil {
+			log.Printf("[node_exporter] target %q: want an http(s) URL", t)
+			continue
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/metrics"
+		}
+		list = append(list, &nodeExporterTarget{url: u.String()})
+	}
+	client := telemetry.HTTPClient(&http.Client{Timeout: min(interval, 10*time.Second), Transport: proxy.Transport(proxy.Integration)})
+	for {
+		if leads("node-exporter", 2*interval) {
+			for _, t := range list {
+				if err := t.scrape(client, group, int(interval/time.Second)); err != nil {
+					log.Printf("[node_exporter] %s: %v", t.url, err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// scrape reads the target once and stores the sample.
+func (t *nodeExporterTarget) scrape(client *http.Client, group string, intervalSec int) error {
+	req, err := http.NewRequest(http.MethodGet, t.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	samples, err := parsePromText(resp.Body)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	m, temps, info := t.convert(samples, now)
+
+	dev, err := t.device(info, group, intervalSec)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		// The first scrape only sets the counters the rates start from.
+		return nil
+	}
+	TrackReturn(dev)
+	if err := SaveMetrics(dev.ID, m); err != nil {
+		return err
+	}
+	exportInflux(dev, m)
+	exportOTLP(dev, m)
+	EvaluateAlerts(dev, m)
+	if err := SaveSensorReadings(dev.ID, temps); err != nil {
+		log.Printf("[node_exporter] save sensor readings for device %d: %v", dev.ID, err)
+	}
+	return nil
+}
+
+// nodeInfo is what node_exporter says about the host.
+type nodeInfo struct {
+	hostname, os, version string
+}
+
+// convert maps node_exporter's metrics to a sample. It returns a nil
+// sample until a previous scrape gives the counters a base.
+func (t *nodeExporterTarget) convert(samples []promSample, now time.Time) (*models.Metrics, []models.SensorReading, nodeInfo) {
+	var info nodeInfo
+	var cpuIdle, cpuAll, rx, tx, memTotal, memAvail, nodeTime float64
+	var fsSize = map[string]float64{}
+	var fsAvail = map[string]float64{}
+	temps := map[string]*models.SensorReading{}
+	var tempKeys []string
+	m := &models.Metrics{}
+	for _, s := range samples {
+		switch s.name {
+		case "node_uname_info":
+			info.hostname, info.os = s.labels["nodename"], strings.ToLower(s.labels["sysname"])
+		case "node_exporter_build_info":
+			info.version = s.labels["version"]
+		case "node_cpu_seconds_total":
+			cpuAll += s.value
+			if mode := s.labels["mode"]; mode == "idle" || mode == "iowait" {
+				cpuIdle += s.value
+			}
+		case "node_memory_MemTotal_bytes":
+			memTotal = s.value
+		case "node_memory_MemAvailable_bytes":
+			memAvail = s.value
+		case "node_filesystem_size_bytes", "node_filesystem_avail_bytes":
+			if pseudoFSTypes[s.labels["fstype"]] {
+				continue
+			}
+			if s.name == "node_filesystem_size_bytes" {
+				fsSize[s.labels["mountpoint"]] = s.value
+			} else {
+				fsAvail[s.labels["mountpoint"]] = s.value
+			}
+		case "node_network_receive_bytes_total", "node_network_transmit_bytes_total":
+			if isVirtualNIC(s.labels["device"]) {
+				continue
+			}
+			if s.name == "node_network_receive_bytes_total" {
+				rx += s.value
+			} else {
+				tx += s.value
+			}
+		case "node_netstat_Tcp_CurrEstab":
+			m.TCPConnections = int(s.value)
+		case "node_sockstat_UDP_inuse":
+			m.UDPConnections = int(s.value)
+		case "node_boot_time_seconds":
+			m.BootTime = int64(s.value)
+		case "node_time_seconds":
+			nodeTime = s.value
+		case "node_hwmon_temp_celsius", "node_hwmon_temp_max_celsius", "node_hwmon_temp_crit_celsius":
+			key := s.labels["chip"] + "_" + s.labels["sensor"]
+			r := temps[key]
+			if r == nil {
+				r = &models.SensorReading{SensorKey: key}
+				temps[key] = r
+				tempKeys = append(tempKeys, key)
+			}
+			switch s.name {
+			case "node_hwmon_temp_celsius":
+				r.Temperature = s.value
+			case "node_hwmon_temp_max_celsius":
+				r.High = s.value
+			default:
+				r.Critical = s.value
+			}
+		}
+	}
+	if memTotal > 0 {
+		m.MemTotal = uint64(memTotal)
+		m.MemUsage = (1 - memAvail/memTotal) * 100
+	}
+	for mp, size := range fsSize {
+		if avail, ok := fsAvail[mp]; ok && size > 0 {
+			m.DiskUsage = max(m.DiskUsage, (1-avail/size)*100)
+		}
+	}
+	if nodeTime > 0 && m.BootTime > 0 {
+		m.Uptime = uint64(nodeTime) - uint64(m.BootTime)
+	}
+	readings := make([]models.SensorReading, 0, len(tempKeys))
+	for _, k := range tempKeys {
+		readings = append(readings, *temps[k])
+	}
+
+	prevAt, prevIdle, prevAll, prevRx, prevTx := t.at, t.cpuIdle, t.cpuAll, t.rx, t.tx
+	t.at, t.cpuIdle, t.cpuAll, t.rx, t.tx = now, cpuIdle, cpuAll, rx, tx
+	// A restarted exporter or host resets the counters: start over.
+	if prevAt.IsZero() || cpuAll < prevAll || rx < prevRx || tx < prevTx {
+		return nil, readings, info
+	}
+	if d := cpuAll - prevAll; d > 0 {
+		m.CPUUsage = (1 - (cpuIdle-prevIdle)/d) * 100
+	}
+	if sec := now.Sub(prevAt).Seconds(); sec > 0 {
+		m.RxBytes = int64((rx - prevRx) / sec)
+		m.TxBytes = int64((tx - prevTx) / sec)
+	}
+	return m, readings, info
+}
+
+func isVirtualNIC(name string) bool {
+	for _, p := range virtualNICPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// device returns the target's device, registering it by the target's
+// address on the first scrape.
+func (t *nodeExporterTarget) device(info nodeInfo, group string, intervalSec int) (*models.Device, error) {
+	if t.deviceID != 0 {
+		var dev models.Device
+		if err := DB.First(&dev, t.deviceID).Error; err == nil {
+			return &dev, nil
+		}
+		// Deleted meanwhile: register it again.
+		t.deviceID = 0
+	}
+	u, _ := url.Parse(t.url)
+	ip := u.Hostname()
+	if net.ParseIP(ip) == nil {
+		addrs, err := net.LookupHost(ip)
+		if err != nil || len(addrs) == 0 {
+			return nil, fmt.Errorf("resolving %s: %v", ip, err)
+		}
+		ip = addrs[0]
+	}
+	if info.hostname == "" {
+		info.hostname = u.Hostname()
+	}
+	ver := "node_exporter"
+	if info.version != "" {
+		ver += "/" + info.version
+	}
+	dev, err := UpsertDevice(RegisterPayload{
+		Hostname: info.hostname, IP: ip, OS: info.os, Group: group,
+		NetworkMode: models.NetworkModeBridged, AgentVer: ver,
+	})
+	if err != nil {
+		return nil, err
+	}
+	DB.Model(dev).Update("report_interval", intervalSec)
+	dev.ReportInterval = intervalSec
+	t.deviceID = dev.ID
+	return dev, nil
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+)
+
+// Notification is what a channel receives when an alert fires or resolves.
+// Templates see its fields, e.g. {{.Device}} or {{.Value}}, and the device
+// record and latest metrics, e.g. {{.DeviceInfo.OS}} or
+// {{with .Metrics}}{{.CPUUsage}}{{end}}.
+type Notification struct {
+	Status     string     `json:"status"` // firing | resolved | test
+	AlertID    uint       `json:"alert_id"`
+	Rule       string     `json:"rule"`
+	Severity   string     `json:"severity"`
+	DeviceID   uint       `json:"device_id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	Group      string     `json:"group"`
+	Metric     string     `json:"metric"`
+	Operator   string     `json:"operator"`
+	Threshold  float64    `json:"threshold"`
+	Value      float64    `json:"value"`
+	Message    string     `json:"message"`
+	FiredAt    time.Time  `json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	// Escalation is the escalation step that sent the notification; 0 for
+	// the rule's own channel.
+	Escalation int `json:"escalation,omitempty"`
+
+	// DeviceInfo and Metrics are the device and its latest sample, for
+	// templates; nil when unknown.
+	DeviceInfo *models.Device  `json:"-"`
+	Metrics    *models.Metrics `json:"-"`
+}
+
+// notifier delivers notifications to one channel.
+type notifier interface {
+	send(n *Notification) error
+}
+
+// errPermanent marks a delivery failure that retrying cannot fix, e.g. a
+// 404 from the receiver.
+var errPermanent = errors.New("not retried")
+
+var notifiers = struct {
+	sync.RWMutex
+	byName map[string]notifier
+	names  []string // configuration order
+	// stored are the channels kept in the database, reloaded when they
+	// change; their names never clash with the configured ones.
+	stored      map[string]notifier
+	storedNames []string
+	loaded      bool
+}{byName: map[string]notifier{}}
+
+// Delivery retries: up to notifyAttempts tries, waiting notifyBackoff before
+// the second and twice as long before each further one.
+const (
+	notifyAttempts = 5
+	notifyBackoff  = 2 * time.Second
+)
+
+// SetWebhooks installs the webhook channels: specs are "[name=]url" (the
+// name defaults to the URL's host) and tmpl, when set, is the Go
+// text/template rendering the request body.
+func SetWebhooks(specs []string, tmpl string) error {
+	t, err := parseNotifyTemplate(tmpl)
+	if err != nil {
+		return fmt.Errorf("webhook_template: %w", err)
+	}
+	for _, spec := range specs {
+		name, raw, ok := strings.Cut(spec, "=")
+		if !ok || strings.Contains(name, "/") {
+			name, raw = "", spec
+		}
+		u, err := parseWebhookURL(raw)
+		if err != nil {
+			return fmt.Errorf("webhook %q: want [name=]http(s)://host/path", spec)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			name = u.Hostname()
+		}
+		if err := addNotifier(name, &webhook{url: u.String(), tmpl: t}); err != nil {
+			return fmt.Errorf("webhook %q: %w", spec, err)
+		}
+	}
+	return nil
+}
+
+// parseWebhookURL accepts absolute http(s) URLs.
+func parseWebhookURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want an http(s) URL")
+	}
+	return u, nil
+}
+
+// addNotifier registers a channel under a name unique across all kinds.
+func addNotifier(name string, n notifier) error {
+	notifiers.Lock()
+	defer notifiers.Unlock()
+	if notifiers.byName[name] != nil {
+		return fmt.Errorf("duplicate channel name %q", name)
+	}
+	notifiers.byName[name] = n
+	notifiers.names = append(notifiers.names, name)
+	return nil
+}
+
+// ReloadChannels makes changes to the channels stored in the database take
+// effect.
+func ReloadChannels() {
+	var list []models.NotificationChannel
+	if err := DB.Order("id").Find(&list).Error; err != nil {
+		log.Printf("[notify] load channels: %v", err)
+		return
+	}
+	stored := map[string]notifier{}
+	var names []string
+	for i := range list {
+		ch := &list[i]
+		n, err := newStoredChannel(ch)
+		if err != nil {
+			log.Printf("[notify] channel %q: %v", ch.Name, err)
+			continue
+		}
+		stored[ch.Name] = n
+		names = append(names, ch.Name)
+	}
+	notifiers.Lock()
+	notifiers.stored, notifiers.storedNames, notifiers.loaded = stored, names, true
+	notifiers.Unlock()
+}
+
+// newStoredChannel builds the notifier of a channel kept in the database.
+func newStoredChannel(ch *models.NotificationChannel) (notifier, error) {
+	tmpl, err := parseNotifyTemplate(ch.Template)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	switch ch.Type {
+	case models.ChannelWebhook:
+		return &webhook{url: ch.URL, tmpl: tmpl}, nil
+	case models.ChannelSlack:
+		return &slackChannel{url: ch.URL, tmpl: tmpl}, nil
+	case models.ChannelDiscord:
+		return &discordChannel{url: ch.URL, tmpl: tmpl}, nil
+	case models.ChannelDingTalk:
+		return &dingTalkChannel{url: ch.URL, secret: ch.Secret, tmpl: tmpl}, nil
+	case models.ChannelWeCom:
+		return &weComChannel{url: ch.URL, tmpl: tmpl}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %q", ch.Type)
+}
+
+// channelsByName returns the named channel, or every channel when name is
+// empty, configured ones first.
+func channelsByName(name string) map[string]notifier {
+	notifiers.RLock()
+	if !notifiers.loaded {
+		notifiers.RUnlock()
+		ReloadChannels()
+		notifiers.RLock()
+	}
+	defer notifiers.RUnlock()
+	targets := map[string]notifier{}
+	if name != "" {
+		if n := notifiers.byName[name]; n != nil {
+			targets[name] = n
+		} else if n := notifiers.stored[name]; n != nil {
+			targets[name] = n
+		}
+		return targets
+	}
+	for _, name := range notifiers.names {
+		targets[name] = notifiers.byName[name]
+	}
+	for _, name := range notifiers.storedNames {
+		targets[name] = notifiers.stored[name]
+	}
+	return targets
+}
+
+// notifyFuncs are the helpers available to notification templates.
+var notifyFuncs = template.FuncMap{
+	// json renders a value as JSON, e.g. "text": {{json .Message}}.
+	"json": func(v any) (string, error) {
+		var b strings.Builder
+		err := newJSONEncoder(&b).Encode(v)
+		return strings.TrimSuffix(b.String(), "\n"), err
+	},
+}
+
+// parseNotifyTemplate parses a notification body template; nil when s is
+// empty.
+func parseNotifyTemplate(s string) (*template.Template, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	return template.New("notification").Funcs(notifyFuncs).Parse(s)
+}
+
+// renderBody renders the request body of n with tmpl, or encodes built as
+// JSON when there is no template.
+func renderBody(tmpl *template.Template, n *Notification, built func() any) (*bytes.Buffer, error) {
+	var body bytes.Buffer
+	if tmpl != nil {
+		if err := tmpl.Execute(&body, n); err != nil {
+			return nil, fmt.Errorf("rendering template: %v: %w", err, errPermanent)
+		}
+		return &body, nil
+	}
+	if err := newJSONEncoder(&body).Encode(built()); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// newJSONEncoder leaves <, > and & readable in messages such as "cpu > 90".
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// notifyAlert sends a fired or resolved alert to its rule's channel (every
+// channel when the rule names none) and to the channels subscribed to it
+// (see subscribedTargets) in the background. message describes the change;
+// it defaults to the alert's message.
+func notifyAlert(a *models.Alert, message string) {
+	notifyAlertVia(a, a.Channel, message, 0)
+}
+
+// notifyAlertVia is notifyAlert to the named channel, on behalf of
+// escalation step (0 for the rule's own channel).
+func notifyAlertVia(a *models.Alert, channel, message string, step int) {
+	targets := channelsByName(channel)
+	if len(targets) == 0 && channel != "" {
+		log.Printf("[notify] alert %d: unknown channel %q", a.ID, channel)
+	}
+
+	n := alertNotification(a, message, step)
+	if step == 0 {
+		targets = subscribedTargets(targets, channel, n.DeviceInfo, a.Severity)
+	}
+	for name, target := range targets {
+		go deliver(name, target, n)
+	}
+}
+
+// alertNotification describes a; message defaults to the alert's message.
+func alertNotification(a *models.Alert, message string, step int) *Notification {
+	if message == "" {
+		message = a.Message
+	}
+	n := &Notification{
+		Status: a.Status, AlertID: a.ID, Rule: a.RuleName, Severity: a.Severity,
+		DeviceID: a.DeviceID, Metric: a.Metric, Operator: a.Operator,
+		Threshold: a.Threshold, Value: a.Value, Message: message,
+		FiredAt: a.FiredAt, ResolvedAt: a.ResolvedAt, Escalation: step,
+	}
+	var dev models.Device
+	if DB.First(&dev, a.DeviceID).Error == nil {
+		n.Device, n.IP, n.Group = deviceName(&dev), dev.IP, dev.Group
+		n.DeviceInfo = &dev
+		if m, err := GetLatestMetrics(dev.ID); err == nil {
+			n.Metrics = m
+		}
+	}
+	return n
+}
+
+// deliver sends n to one channel, retrying with backoff.
+func deliver(name string, target notifier, n *Notification) {
+	wait := notifyBackoff
+	for attempt := 1; ; attempt++ {
+		err := target.send(n)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errPermanent) || attempt == notifyAttempts {
+			log.Printf("[notify] %s: alert %d (%s) not delivered after %d attempts: %v", name, n.AlertID, n.Status, attempt, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// ── Webhook ──────────────────────────────────────────────────────────────────
+
+// webhook POSTs the notification as JSON, or as rendered by tmpl.
+type webhook struct {
+	url  string
+	tmpl *template.Template
+}
+
+func (w *webhook) send(n *Notification) error {
+	body, err := renderBody(w.tmpl, n, func() any { return n })
+	if err != nil {
+		return err
+	}
+	return postJSON(w.url, body, nil)
+}
+
+// postJSON POSTs a JSON body to a webhook and decodes a successful reply
+// into out, when set. 429 and 5xx replies can be retried; other errors are
+// permanent.
+func postJSON(target string, body io.Reader, out any) error {
+	req, err := http.NewRequest(http.MethodPost, target, body)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, errPermanent)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "OpenTalon")
+	client := telemetry.HTTPClient(&http.Client{Timeout: 10 * time.Second, Transport: proxy.Transport(proxy.Webhook)})
+	resp, err := client.Do(req)
+	if err != nil {
+		// Webhook URLs often hold a key; keep it out of the logs.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		if out == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decoding reply: %v", err)
+		}
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("HTTP %d: %w", resp.StatusCode, errPermanent)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// offlineAfterIntervals is how many report intervals a device may miss
+// before it is marked offline (offline_after_intervals); defaultReportInterval
+// is assumed for agents that do not send theirs (agent_interval_seconds).
+var (
+	offlineAfterIntervals float64 = 3
+	defaultReportInterval         = 30
+)
+
+// SetOfflineDetection stores offline_after_intervals and the default report
+// interval from config.
+func SetOfflineDetection(intervals float64, defaultIntervalSec int) {
+	if intervals > 0 {
+		offlineAfterIntervals = intervals
+	}
+	if defaultIntervalSec > 0 {
+		defaultReportInterval = defaultIntervalSec
+	}
+}
+
+// offlineTimeout is how long d may stay silent before it counts as offline.
+func offlineTimeout(d *models.Device) time.Duration {
+	interval := d.ReportInterval
+	if interval <= 0 {
+		interval = defaultReportInterval
+	}
+	return time.Duration(float64(interval) * offlineAfterIntervals * float64(time.Second))
+}
+
+// RunOfflineDetection marks devices offline once they have been silent for
+// offlineTimeout and records a device_offline event for agent devices. Hosts
+// that announced a planned shutdown are already offline. It never returns.
+func RunOfflineDetection() {
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		markOfflineDevices(time.Now())
+	}
+}
+
+func markOfflineDevices(now time.Time) {
+	var list []models.Device
+	if err := DB.Where("is_online = ?", true).Find(&list).Error; err != nil {
+		log.Printf("[offline] load devices: %v", err)
+		return
+	}
+	for i := range list {
+		d := &list[i]
+		timeout := offlineTimeout(d)
+		if d.LastSeen.IsZero() || now.Sub(d.LastSeen) <= timeout {
+			continue
+		}
+		// A report may have come in since the list was loaded.
+		res := DB.Model(&models.Device{}).Where("id = ? AND is_online = ? AND last_seen < ?", d.ID, true, now.Add(-timeout)).
+			Update("is_online", false)
+		if res.Error != nil || res.RowsAffected == 0 || d.AgentVer == "discovered" {
+			continue
+		}
+		if countFlap(d, now) {
+			continue
+		}
+		RecordEvent(d.ID, models.EventDeviceOffline,
+			fmt.Sprintf("%s went offline (no report for %s)", deviceName(d), now.Sub(d.LastSeen).Round(time.Second)),
+			map[string]any{"last_seen": d.LastSeen, "timeout_sec": timeout.Seconds()})
+	}
+	settleFlapping(now)
+}
+
+// TrackReturn records device_online when an agent device marked offline
+// reports again; the return after a planned shutdown is recorded as a
+// reboot instead (see TrackBootTime), that of a flapping device not at all.
+func TrackReturn(dev *models.Device) {
+	if dev.IsOnline || dev.LastSeen.IsZero() || dev.ShutdownAt != nil || dev.Flapping || dev.AgentVer == "discovered" {
+		return
+	}
+	down := time.Since(dev.LastSeen).Round(time.Second)
+	RecordEvent(dev.ID, models.EventDeviceOnline, fmt.Sprintf("%s is back online after %s", deviceName(dev), down),
+		map[string]any{"offline_sec": down.Seconds()})
+}
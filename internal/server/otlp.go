@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLP batching, as for InfluxDB: one export per otlpBatchSize samples or
+// events, or every otlpFlushEvery; a failed batch is retried with the next
+// one while no more than otlpMaxPending wait.
+const (
+	otlpBatchSize  = 500
+	otlpFlushEvery = 10 * time.Second
+	otlpMaxPending = 50 * otlpBatchSize
+)
+
+// otlpGauges are the gauges exported per sample: name, unit and value.
+var otlpGauges = []struct {
+	name, unit string
+	value      func(m *models.Metrics) float64
+}{
+	{"opentalon.cpu.usage", "%", func(m *models.Metrics) float64 { return m.CPUUsage }},
+	{"opentalon.memory.usage", "%", func(m *models.Metrics) float64 { return m.MemUsage }},
+	{"opentalon.memory.total", "By", func(m *models.Metrics) float64 { return float64(m.MemTotal) }},
+	{"opentalon.disk.usage", "%", func(m *models.Metrics) float64 { return m.DiskUsage }},
+	{"opentalon.network.receive.rate", "By/s", func(m *models.Metrics) float64 { return float64(m.RxBytes) }},
+	{"opentalon.network.transmit.rate", "By/s", func(m *models.Metrics) float64 { return float64(m.TxBytes) }},
+	{"opentalon.tcp.connections", "{connection}", func(m *models.Metrics) float64 { return float64(m.TCPConnections) }},
+	{"opentalon.udp.connections", "{socket}", func(m *models.Metrics) float64 { return float64(m.UDPConnections) }},
+	{"opentalon.uptime", "s", func(m *models.Metrics) float64 { return float64(m.Uptime) }},
+}
+
+// otlpWarnEvents are the event types exported with severity WARN; the
+// others are INFO.
+var otlpWarnEvents = map[string]bool{
+	models.EventDeviceOffline: true, models.EventDeviceFlapping: true, models.EventDeviceRebooted: true,
+	models.EventAlertFiring: true, models.EventAlertEscalated: true, models.EventCheckFailed: true,
+	models.EventClockDrift: true, models.EventServerPartition: true, models.EventDeviceShutdown: true,
+}
+
+// otlpSample is a queued sample with the attributes of its device.
+type otlpSample struct {
+	attrs []*commonpb.KeyValue
+	at    uint64
+	m     models.Metrics
+}
+
+// otlpSink ships samples as OTLP gauges and events as OTLP log records to
+// an OpenTelemetry Collector over OTLP/HTTP (protobuf).
+type otlpSink struct {
+	metricsURL, logsURL string
+	headers             map[string]string
+	resource            *resourcepb.Resource
+	client              *http.Client
+
+	mu      sync.Mutex
+	samples []otlpSample
+	events  []*logspb.LogRecord
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// otlp is the sink started by StartOTLPExport; nil when off.
+var otlp *otlpSink
+
+// StartOTLPExport sends every sample and event to the OTLP/HTTP receiver at
+// endpoint (otlp_endpoint, e.g. http://otel-collector:4318; /v1/metrics and
+// /v1/logs are appended). headers (otlp_headers, "key=value,…" as in
+// OTEL_EXPORTER_OTLP_HEADERS) are added to each request, e.g. an API key.
+// version is reported as service.version.
+func StartOTLPExport(endpoint, headers, version string) error {
+	u, err := parseWebhookURL(endpoint)
+	if err != nil {
+		return fmt.Errorf("otlp_endpoint: %w", err)
+	}
+	hdr, err := otlpHeaderList(headers)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(u.String(), "/")
+	otlp = &otlpSink{
+		metricsURL: base + "/v1/metrics",
+		logsURL:    base + "/v1/logs",
+		headers:    hdr,
+		resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			otlpString("service.name", "opentalon-server"), otlpString("service.version", version),
+		}},
+		client:  telemetry.HTTPClient(&http.Client{Timeout: 30 * time.Second, Transport: proxy.Transport(proxy.Integration)}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go otlp.flushLoop()
+	return nil
+}
+
+func otlpString(key, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+func otlpInt(key string, v int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}}
+}
+
+// exportOTLP queues the sample m of dev for the collector.
+func exportOTLP(dev *models.Device, m *models.Metrics) {
+	if otlp == nil {
+		return
+	}
+	attrs := []*commonpb.KeyValue{otlpInt("device.id", int64(dev.ID)), otlpString("host.name", deviceName(dev))}
+	if dev.Group != "" {
+		attrs = append(attrs, otlpString("device.group", dev.Group))
+	}
+	if m.LocalIP != "" {
+		attrs = append(attrs, otlpString("host.ip", m.LocalIP))
+	}
+	at := m.ReportedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	otlp.queue(func(s *otlpSink) { s.samples = append(s.samples, otlpSample{attrs, uint64(at.UnixNano()), *m}) })
+}
+
+// exportOTLPEvent queues ev as a log record named after its type.
+func exportOTLPEvent(ev *models.Event) {
+	if otlp == nil {
+		return
+	}
+	at := uint64(ev.CreatedAt.UnixNano())
+	rec := &logspb.LogRecord{
+		TimeUnixNano: at, ObservedTimeUnixNano: at,
+		EventName:      ev.Type,
+		SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_INFO, SeverityText: "INFO",
+		Body:       &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: ev.Message}},
+		Attributes: []*commonpb.KeyValue{otlpString("event.type", ev.Type)},
+	}
+	if otlpWarnEvents[ev.Type] {
+		rec.SeverityNumber, rec.SeverityText = logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "WARN"
+	}
+	if ev.DeviceID != nil {
+		rec.Attributes = append(rec.Attributes, otlpInt("device.id", int64(*ev.DeviceID)))
+	}
+	if ev.Data != "" {
+		rec.Attributes = append(rec.Attributes, otlpString("event.data", ev.Data))
+	}
+	otlp.queue(func(s *otlpSink) { s.events = append(s.events, rec) })
+}
+
+// queue adds to the pending batch under the lock and flushes a full one.
+func (s *otlpSink) queue(add func(*otlpSink)) {
+	s.mu.Lock()
+	add(s)
+	full := len(s.samples) >= otlpBatchSize || len(s.events) >= otlpBatchSize
+	s.mu.Unlock()
+	if full {
+		go s.flushLogged()
+	}
+}
+
+func (s *otlpSink) flushLoop() {
+	defer close(s.stopped)
+	tick := time.NewTicker(otlpFlushEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			s.flushLogged()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *otlpSink) flushLogged() {
+	if err := s.flush(); err != nil {
+		log.Printf("[otlp] %v", err)
+	}
+}
+
+// flush exports the queued samples and events. A failed batch is put back
+// unless the collector rejected it as malformed (400), which no retry
+// fixes.
+func (s *otlpSink) flush() error {
+	s.mu.Lock()
+	samples, events := s.samples, s.events
+	s.samples, s.events = nil, nil
+	s.mu.Unlock()
+
+	var errs []string
+	if len(samples) > 0 {
+		if status, err := s.post(s.metricsURL, s.metricsRequest(samples)); err != nil {
+			errs = append(errs, fmt.Sprintf("exporting %d samples: %v", len(samples), err))
+			if status != http.StatusBadRequest {
+				s.mu.Lock()
+				if len(s.samples)+len(samples) <= otlpMaxPending {
+					s.samples = append(samples, s.samples...)
+				}
+				s.mu.Unlock()
+			}
+		}
+	}
+	if len(events) > 0 {
+		if status, err := s.post(s.logsURL, s.logsRequest(events)); err != nil {
+			errs = append(errs, fmt.Sprintf("exporting %d events: %v", len(events), err))
+			if status != http.StatusBadRequest {
+				s.mu.Lock()
+				if len(s.events)+len(events) <= otlpMaxPending {
+					s.events = append(events, s.events...)
+				}
+				s.mu.Unlock()
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// metricsRequest puts the samples into one gauge per metric, with a data
+// point per sample.
+func (s *otlpSink) metricsRequest(samples []otlpSample) proto.Message {
+	metrics := make([]*metricspb.Metric, 0, len(otlpGauges))
+	for _, g := range otlpGauges {
+		points := make([]*metricspb.NumberDataPoint, 0, len(samples))
+		for i := range samples {
+			points = append(points, &metricspb.NumberDataPoint{
+				Attributes:   samples[i].attrs,
+				TimeUnixNano: samples[i].at,
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: g.value(&samples[i].m)},
+			})
+		}
+		metrics = append(metrics, &metricspb.Metric{
+			Name: g.name, Unit: g.unit,
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: points}},
+		})
+	}
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource:     s.resource,
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: otlpScope(), Metrics: metrics}},
+	}}}
+}
+
+func (s *otlpSink) logsRequest(events []*logspb.LogRecord) proto.Message {
+	return &collogspb.ExportLogsServiceRequest{ResourceLogs: []*logspb.ResourceLogs{{
+		Resource:  s.resource,
+		ScopeLogs: []*logspb.ScopeLogs{{Scope: otlpScope(), LogRecords: events}},
+	}}}
+}
+
+func otlpScope() *commonpb.InstrumentationScope {
+	return &commonpb.InstrumentationScope{Name: "github.com/vesa/opentalon"}
+}
+
+func (s *otlpSink) post(url string, msg proto.Message) (int, error) {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.StatusCode, nil
+}
+
+// close stops the flush loop and exports what is still queued.
+func (s *otlpSink) close() error {
+	close(s.stop)
+	<-s.stopped
+	return s.flush()
+}
+
+// otlpHeaderList parses "key=value" pairs, comma-separated as in
+// OTEL_EXPORTER_OTLP_HEADERS.
+func otlpHeaderList(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("otlp_headers: %q: want key=value", kv)
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Peer gossip: agents with agent_peer_probes ping up to peerFanout other
+// agents of their segment each cycle. When the server loses many agents at
+// once, those pings tell a network path or server-side problem (the devices
+// still see each other) from a mass device failure.
+const (
+	peerFanout = 4
+	// peerViewTTL is how long an agent's last peer pings are considered.
+	peerViewTTL = 10 * time.Minute
+	// outageQuiet is how long outage reports of returning agents are
+	// collected before they are judged together.
+	outageQuiet = 30 * time.Second
+)
+
+// Peer is another agent an agent is asked to ping.
+type Peer struct {
+	DeviceID uint   `json:"device_id"`
+	IP       string `json:"ip"`
+}
+
+// PeerProbe is an agent's ping of one peer.
+type PeerProbe struct {
+	DeviceID uint    `json:"device_id"`
+	IP       string  `json:"ip"`
+	OK       bool    `json:"ok"`
+	RTTMs    float64 `json:"rtt_ms"`
+}
+
+// ServerOutage is reported by an agent whose reports failed between Since
+// and Until; PeersOK of its Peers answered pings meanwhile.
+type ServerOutage struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Peers   int       `json:"peers"`
+	PeersOK int       `json:"peers_ok"`
+}
+
+// peerView is the last set of peer pings of one agent.
+type peerView struct {
+	At     time.Time
+	Probes []PeerProbe
+}
+
+// outageReport is a ServerOutage waiting to be judged with the others.
+type outageReport struct {
+	deviceID uint
+	name     string
+	outage   ServerOutage
+	received time.Time
+}
+
+var peerState = struct {
+	sync.Mutex
+	views     map[uint]peerView
+	outages   []outageReport
+	partition bool // a live partition event is open
+}{views: map[uint]peerView{}}
+
+// AssignedPeers returns the agents dev should ping: the next peerFanout
+// agents by ID on its segment (same v4 or else v6 gateway, or same /24),
+// wrapping around, so every agent is pinged by about as many peers.
+func AssignedPeers(dev *models.Device) []Peer {
+	q := DB.Model(&models.Device{}).Where("agent_ver <> '' AND id <> ?", dev.ID)
+	if dev.GatewayIP != "" {
+		q = q.Where("gateway_ip = ?", dev.GatewayIP)
+	} else if dev.GatewayIPv6 != "" {
+		q = q.Where("gateway_ipv6 = ?", dev.GatewayIPv6)
+	} else if prefix := subnet24(dev.IP); prefix != "" {
+		q = q.Where("ip LIKE ?", prefix+"%")
+	} else {
+		return []Peer{}
+	}
+	var devs []models.Device
+	if err := q.Select("id", "ip").Order("id").Find(&devs).Error; err != nil {
+		return []Peer{}
+	}
+	start := sort.Search(len(devs), func(i int) bool { return devs[i].ID > dev.ID })
+	out := []Peer{}
+	for i := 0; i < len(devs) && len(out) < peerFanout; i++ {
+		d := devs[(start+i)%len(devs)]
+		out = append(out, Peer{DeviceID: d.ID, IP: d.IP})
+	}
+	return out
+}
+
+// subnet24 returns "a.b.c." for an IPv4 address, "" otherwise.
+func subnet24(ip string) string {
+	v4 := net.ParseIP(ip).To4()
+	if v4 == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.", v4[0], v4[1], v4[2])
+}
+
+// SavePeerProbes keeps the latest peer pings of a device in memory.
+func SavePeerProbes(deviceID uint, probes []PeerProbe) {
+	if len(probes) == 0 {
+		return
+	}
+	peerState.Lock()
+	peerState.views[deviceID] = peerView{At: time.Now(), Probes: probes}
+	peerState.Unlock()
+}
+
+// TrackServerOutage queues the outage reported by a returning agent. Short
+// outages, over before the device would have been shown offline, are
+// ignored.
+func TrackServerOutage(dev *models.Device, o *ServerOutage) {
+	if o == nil || o.Until.Sub(o.Since) < offlineTimeout(dev) {
+		return
+	}
+	name := dev.Hostname
+	if dev.Remark != "" {
+		name = dev.Remark
+	}
+	peerState.Lock()
+	peerState.outages = append(peerState.outages, outageReport{deviceID: dev.ID, name: name, outage: *o, received: time.Now()})
+	peerState.Unlock()
+}
+
+// WatchPeerGossip periodically looks for partitions between the server and
+// its agents. It runs for the life of the process.
+func WatchPeerGossip() {
+	tick := time.NewTicker(15 * time.Second)
+	defer tick.Stop()
+	for now := range tick.C {
+		judgeOutages(now)
+		judgeLivePartition(now)
+	}
+}
+
+// judgeOutages records the queued outage reports once no new one arrived
+// for outageQuiet: agents that lost the server while their peers answered
+// are recorded together as a fleet-wide server_partition, a single one on
+// its device.
+func judgeOutages(now time.Time) {
+	peerState.Lock()
+	reports := peerState.outages
+	if len(reports) == 0 || now.Sub(reports[len(reports)-1].received) < outageQuiet {
+		peerState.Unlock()
+		return
+	}
+	peerState.outages = nil
+	peerState.Unlock()
+
+	var names []string
+	var ids []uint
+	since, until := reports[0].outage.Since, reports[0].outage.Until
+	for _, r := range reports {
+		if r.outage.PeersOK == 0 {
+			continue // no peer answered either: nothing to tell apart
+		}
+		names = append(names, r.name)
+		ids = append(ids, r.deviceID)
+		if r.outage.Since.Before(since) {
+			since = r.outage.Since
+		}
+		if r.outage.Until.After(until) {
+			until = r.outage.Until
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	data := map[string]any{"devices": ids, "since": since, "until": until}
+	span := until.Sub(since).Round(time.Second)
+	if len(ids) == 1 {
+		RecordEvent(ids[0], models.EventServerPartition,
+			fmt.Sprintf("%s could not reach the server for %s while its peers answered", names[0], span), data)
+		return
+	}
+	RecordEvent(0, models.EventServerPartition,
+		fmt.Sprintf("%d agents could not reach the server for %s while their peers answered each other (%s): likely a network path or server-side problem, not device failures",
+			len(ids), span, strings.Join(names, ", ")), data)
+}
+
+// judgeLivePartition checks the agents that took part in peer gossip
+// recently: when at least half of them (and two or more) went silent but
+// agents still reporting reach most of the silent ones, it opens a
+// server_partition event, resolved once they are back.
+func judgeLivePartition(now time.Time) {
+	peerState.Lock()
+	views := make(map[uint]peerView, len(peerState.views))
+	for id, v := range peerState.views {
+		if now.Sub(v.At) > peerViewTTL {
+			delete(peerState.views, id)
+			continue
+		}
+		views[id] = v
+	}
+	open := peerState.partition
+	peerState.Unlock()
+	if len(views) == 0 && !open {
+		return
+	}
+
+	ids := make([]uint, 0, len(views))
+	for id := range views {
+		ids = append(ids, id)
+	}
+	var devs []models.Device
+	if len(ids) > 0 {
+		if err := DB.Select("id", "last_seen", "shutdown_at", "report_interval").Where("id IN ?", ids).Find(&devs).Error; err != nil {
+			return
+		}
+	}
+	silent := map[uint]bool{}
+	for _, d := range devs {
+		// Hosts shut down on purpose are expected to be silent.
+		if d.ShutdownAt == nil && now.Sub(d.LastSeen) > offlineTimeout(&d) {
+			silent[d.ID] = true
+		}
+	}
+	vouched := map[uint]bool{}
+	for id, v := range views {
+		if silent[id] || now.Sub(v.At) > heartbeatTimeout {
+			continue
+		}
+		for _, p := range v.Probes {
+			if p.OK && silent[p.DeviceID] {
+				vouched[p.DeviceID] = true
+			}
+		}
+	}
+	partitioned := len(silent) >= 2 && len(silent)*2 >= len(devs) && len(vouched)*2 >= len(silent)
+
+	if partitioned == open {
+		return
+	}
+	peerState.Lock()
+	peerState.partition = partitioned
+	peerState.Unlock()
+	if partitioned {
+		lost := make([]uint, 0, len(vouched))
+		for id := range vouched {
+			lost = append(lost, id)
+		}
+		sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+		RecordEvent(0, models.EventServerPartition,
+			fmt.Sprintf("%d of %d agents stopped reporting but their peers still reach them: likely a network path or server-side problem, not device failures",
+				len(silent), len(devs)), map[string]any{"devices": lost})
+		return
+	}
+	RecordEvent(0, models.EventServerPartitionOK, "Agents that lost the server are reporting again", nil)
+}
+
+// handleDevicePeers returns the device's last peer pings and the recent
+// pings of it by other agents (control-plane).
+func handleDevicePeers(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device id"})
+		return
+	}
+	type seenBy struct {
+		DeviceID uint      `json:"device_id"`
+		OK       bool      `json:"ok"`
+		RTTMs    float64   `json:"rtt_ms"`
+		At       time.Time `json:"reported_at"`
+	}
+	peerState.Lock()
+	own, ok := peerState.views[uint(id)]
+	seen := []seenBy{}
+	for observer, v := range peerState.views {
+		for _, p := range v.Probes {
+			if p.DeviceID == uint(id) {
+				seen = append(seen, seenBy{DeviceID: observer, OK: p.OK, RTTMs: p.RTTMs, At: v.At})
+			}
+		}
+	}
+	peerState.Unlock()
+	sort.Slice(seen, func(i, j int) bool { return seen[i].DeviceID < seen[j].DeviceID })
+	data := gin.H{"peers": []PeerProbe{}, "seen_by": seen}
+	if ok {
+		data["peers"], data["reported_at"] = own.Probes, own.At
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vesaa/opentalon/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Playbook is a named, server-initiated SSH procedure. args carries
+// playbook-specific string parameters; the returned string is the combined
+// command output recorded for operators.
+type Playbook struct {
+	Name        string                                                     `json:"name"`
+	Description string                                                     `json:"description"`
+	Run         func(s *SSHClient, args map[string]string) (string, error) `json:"-"`
+}
+
+// serviceNameRe restricts service names passed to restart-service so they can
+// be interpolated into a shell command safely.
+var serviceNameRe = regexp.MustCompile(`^[A-Za-z0-9@._-]+$`)
+
+// Playbooks is the registry of built-in playbooks, keyed by name.
+var Playbooks = map[string]Playbook{
+	"restart-service": {
+		Name:        "restart-service",
+		Description: "Restart a systemd / OpenRC service (args: service)",
+		Run: func(s *SSHClient, args map[string]string) (string, error) {
+			svc := args["service"]
+			if !serviceNameRe.MatchString(svc) {
+				return "", fmt.Errorf("invalid service name %q", svc)
+			}
+			return s.Run(fmt.Sprintf(`if command -v systemctl >/dev/null 2>&1; then systemctl restart %[1]s && systemctl is-active %[1]s; else rc-service %[1]s restart; fi`, svc))
+		},
+	},
+	"shell": {
+		Name:        "shell",
+		Description: "Run an arbitrary shell command (args: command)",
+		Run: func(s *SSHClient, args map[string]string) (string, error) {
+			cmd := strings.TrimSpace(args["command"])
+			if cmd == "" {
+				return "", fmt.Errorf("missing command argument")
+			}
+			return s.Run(cmd)
+		},
+	},
+	"shutdown": {
+		Name:        "shutdown",
+		Description: "Power the host off gracefully (power schedules)",
+		Run: func(s *SSHClient, _ map[string]string) (string, error) {
+			// Detached and delayed so the SSH session ends cleanly first.
+			return s.Run(`nohup sh -c 'sleep 2; if command -v systemctl >/dev/null 2>&1; then systemctl poweroff; else poweroff || shutdown -h now; fi' >/dev/null 2>&1 &`)
+		},
+	},
+	"benchmark": {
+		Name:        "benchmark",
+		Description: "Measure CPU, disk write and network throughput to the server (burn-in of new devices)",
+		Run:         runBenchmarkScript,
+	},
+	"fix-rp-filter": {
+		Name:        "fix-rp-filter",
+		Description: "Set rp_filter=0 on a RockyLinux bypass-router",
+		Run: func(s *SSHClient, _ map[string]string) (string, error) {
+			return "", s.FixRPFilter()
+		},
+	},
+	"update-fnos-script": {
+		Name:        "update-fnos-script",
+		Description: "Download and apply the latest fnos_fix script (FNOS >= V6.0)",
+		Run: func(s *SSHClient, _ map[string]string) (string, error) {
+			return "", s.UpdateFNOSScript()
+		},
+	},
+	"push-singbox-config": {
+		Name:        "push-singbox-config",
+		Description: "Push the standard sing-box 1.12.16 config and restart sing-box",
+		Run: func(s *SSHClient, _ map[string]string) (string, error) {
+			return "", s.PushSingBoxConfig()
+		},
+	},
+}
+
+// ListPlaybooks returns the registered playbooks sorted by name.
+func ListPlaybooks() []Playbook {
+	list := make([]Playbook, 0, len(Playbooks))
+	for _, p := range Playbooks {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// RunPlaybook executes the named playbook against device deviceID at host
+// over SSH using the server's default SSH credentials. The run is listed as
+// a running task and can be cancelled; it fails while the emergency stop is
+// on.
+func RunPlaybook(name, host string, deviceID uint, args map[string]string) (out string, err error) {
+	pb, ok := Playbooks[name]
+	if !ok {
+		return "", fmt.Errorf("unknown playbook %q", name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	task, err := startTask(TaskPlaybook, name, host, deviceID, cancel)
+	if err != nil {
+		return "", err
+	}
+	defer task.done()
+	ctx, span := telemetry.Start(ctx, "ssh.playbook "+name,
+		attribute.String("ssh.host", host))
+	defer func() { telemetry.End(span, err) }()
+
+	client, err := DialDeviceSSH(host)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	client.ctx = ctx
+	out, err = pb.Run(client, args)
+	if ctx.Err() != nil {
+		err = errors.New("cancelled")
+	}
+	return out, err
+}
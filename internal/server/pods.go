@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// PodReport mirrors agent.PodInfo to avoid circular imports.
+type PodReport struct {
+	Namespace string  `json:"namespace"`
+	Name      string  `json:"name"`
+	UID       string  `json:"uid"`
+	Phase     string  `json:"phase"`
+	IP        string  `json:"ip"`
+	Restarts  int     `json:"restarts"`
+	CPUMilli  float64 `json:"cpu_milli"`
+	MemUsage  uint64  `json:"mem_usage"`
+}
+
+// SyncPods replaces the pod inventory of a node with the agent's latest list,
+// the same way SyncContainers does for Docker containers.
+func SyncPods(deviceID uint, reports []PodReport) error {
+	now := time.Now()
+	return DB.Transaction(func(tx *gorm.DB) error {
+		seen := make([]string, 0, len(reports))
+		for _, r := range reports {
+			if r.UID == "" {
+				continue
+			}
+			seen = append(seen, r.UID)
+			fields := map[string]any{
+				"namespace": r.Namespace,
+				"name":      r.Name,
+				"phase":     r.Phase,
+				"ip":        r.IP,
+				"restarts":  r.Restarts,
+				"cpu_milli": r.CPUMilli,
+				"mem_usage": r.MemUsage,
+				"last_seen": now,
+			}
+			res := tx.Model(&models.Pod{}).
+				Where("device_id = ? AND uid = ?", deviceID, r.UID).
+				Updates(fields)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				p := models.Pod{
+					DeviceID:  deviceID,
+					UID:       r.UID,
+					Namespace: r.Namespace,
+					Name:      r.Name,
+					Phase:     r.Phase,
+					IP:        r.IP,
+					Restarts:  r.Restarts,
+					CPUMilli:  r.CPUMilli,
+					MemUsage:  r.MemUsage,
+					LastSeen:  now,
+				}
+				if err := tx.Create(&p).Error; err != nil {
+					return err
+				}
+			}
+		}
+		del := tx.Where("device_id = ?", deviceID)
+		if len(seen) > 0 {
+			del = del.Where("uid NOT IN ?", seen)
+		}
+		return del.Delete(&models.Pod{}).Error
+	})
+}
+
+// GetPods returns the pods last reported by a node.
+func GetPods(deviceID uint) ([]models.Pod, error) {
+	var list []models.Pod
+	err := DB.Where("device_id = ?", deviceID).Order("namespace, name").Find(&list).Error
+	return list, err
+}
+
+// attachPodNodes groups each node's pods by namespace: the node gets one
+// "namespace" child (ID 0, not a database row) per namespace, and pods hang
+// below it as leaf nodes. A namespace is online while any of its pods is.
+func attachPodNodes(nodeMap map[uint]*models.DeviceTree) {
+	var list []models.Pod
+	if err := DB.Order("namespace, name").Find(&list).Error; err != nil {
+		return
+	}
+	type nsKey struct {
+		host uint
+		ns   string
+	}
+	namespaces := map[nsKey]*models.DeviceTree{}
+	for _, p := range list {
+		host, ok := nodeMap[p.DeviceID]
+		if !ok {
+			continue
+		}
+		key := nsKey{p.DeviceID, p.Namespace}
+		ns, ok := namespaces[key]
+		if !ok {
+			hostID := host.ID
+			ns = &models.DeviceTree{
+				Key:         "ns:" + strconv.FormatUint(uint64(hostID), 10) + "/" + p.Namespace,
+				Kind:        "namespace",
+				Hostname:    p.Namespace,
+				OS:          "kubernetes",
+				NetworkMode: models.NetworkModeNAT,
+				Group:       host.Group,
+				Status:      "offline",
+				ParentID:    &hostID,
+			}
+			namespaces[key] = ns
+			host.Children = append(host.Children, ns)
+		}
+		status := "offline"
+		if p.Phase == "Running" && host.IsOnline {
+			status = "online"
+			ns.IsOnline, ns.Status = true, "online"
+		}
+		if p.LastSeen.After(ns.LastSeen) {
+			ns.LastSeen = p.LastSeen
+		}
+		ns.Children = append(ns.Children, &models.DeviceTree{
+			ID:          p.ID,
+			Key:         treeKey("pod", p.ID),
+			Kind:        "pod",
+			Hostname:    p.Name,
+			Remark:      p.Phase,
+			IP:          p.IP,
+			OS:          "kubernetes",
+			NetworkMode: models.NetworkModeNAT,
+			Group:       host.Group,
+			IsOnline:    status == "online",
+			Status:      status,
+			LastSeen:    p.LastSeen,
+			ParentID:    ns.ParentID,
+		})
+	}
+	for _, ns := range namespaces {
+		sort.Slice(ns.Children, func(i, j int) bool { return ns.Children[i].Hostname < ns.Children[j].Hostname })
+	}
+}
+
+// handleDevicePods returns the Kubernetes pods (with their latest CPU /
+// memory usage) reported by a node device.
+func handleDevicePods(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	list, err := GetPods(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// policySeedKey is the Setting recording that the default policies were
+// created, so deleting them sticks across restarts.
+const policySeedKey = "policies_seeded"
+
+// defaultPolicies are created on first start: viewers may read everything.
+var defaultPolicies = []models.Policy{
+	{Role: models.RoleViewer, Methods: "GET", Path: "/api/*", Description: "read-only access"},
+}
+
+// policyMethods are the methods a policy can name.
+var policyMethods = map[string]bool{"*": true, "GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+
+var policies = struct {
+	sync.RWMutex
+	list   []models.Policy
+	loaded bool
+}{}
+
+// SeedPolicies creates the default policies on first start.
+func SeedPolicies() error {
+	var s models.Setting
+	if DB.Where(&models.Setting{Key: policySeedKey}).Take(&s).Error == nil {
+		return nil
+	}
+	for i := range defaultPolicies {
+		p := defaultPolicies[i]
+		if err := DB.Create(&p).Error; err != nil {
+			return err
+		}
+	}
+	return DB.Save(&models.Setting{Key: policySeedKey, Value: "true"}).Error
+}
+
+// ReloadPolicies makes policy changes take effect.
+func ReloadPolicies() {
+	var list []models.Policy
+	if err := DB.Order("id").Find(&list).Error; err != nil {
+		log.Printf("[policy] load policies: %v", err)
+		return
+	}
+	policies.Lock()
+	policies.list, policies.loaded = list, true
+	policies.Unlock()
+}
+
+// policyMatches reports whether p covers a request.
+func policyMatches(p *models.Policy, method, path string) bool {
+	methodOK := false
+	for _, m := range strings.Split(p.Methods, ",") {
+		if m = strings.TrimSpace(m); m == "*" || strings.EqualFold(m, method) {
+			methodOK = true
+			break
+		}
+	}
+	if !methodOK {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(p.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == p.Path
+}
+
+// authorize reports whether role may make the request. groups lists the
+// device groups it is limited to, nil meaning every group.
+func authorize(role, method, path string) (groups map[string]bool, ok bool) {
+	if role == models.RoleAdmin {
+		return nil, true
+	}
+	policies.RLock()
+	if !policies.loaded {
+		policies.RUnlock()
+		ReloadPolicies()
+		policies.RLock()
+	}
+	defer policies.RUnlock()
+	for i := range policies.list {
+		p := &policies.list[i]
+		if p.Role != role || !policyMatches(p, method, path) {
+			continue
+		}
+		if p.Groups == "" {
+			return nil, true
+		}
+		if groups == nil {
+			groups = map[string]bool{}
+		}
+		for _, g := range strings.Split(p.Groups, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups[g] = true
+			}
+		}
+		ok = true
+	}
+	return groups, ok
+}
+
+// groupUnscoped are the routes whose answers span devices regardless of
+// their group (paths through and flows between branches of the whole
+// topology, network scans and the hosts they found, the emergency stop of
+// every task, federated sites); a grant limited to device groups does not
+// open them.
+var groupUnscoped = map[string]bool{
+	"/api/topology/path":                true,
+	"/api/topology/flows":               true,
+	"/api/discovered":                   true,
+	"/api/discovered/adopt":             true,
+	"/api/discovered/:id/install":       true,
+	"/api/scan/trigger":                 true,
+	"/api/scan/stop":                    true,
+	"/api/scan/status":                  true,
+	"/api/tasks/stop":                   true,
+	"/api/tasks/resume":                 true,
+	"/api/federation/sites":             true,
+	"/api/federation/sites/:id":         true,
+	"/api/federation/sites/:id/rollups": true,
+}
+
+// PolicyMiddleware authorizes control-plane requests by the role in the JWT
+// (see JWTMiddleware). A grant limited to device groups is enforced on the
+// /api/devices/:id routes, refused on groupUnscoped and filters the lists
+// of the other routes; the groups are stored in the Gin context as
+// "device_groups". Every user may refresh and end their session and manage
+// their own API tokens and notification subscriptions.
+func PolicyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if p := c.FullPath(); p == "/api/refresh" || p == "/api/logout" ||
+			strings.HasPrefix(p, "/api/tokens") || strings.HasPrefix(p, "/api/subscriptions") {
+			c.Next()
+			return
+		}
+		method := c.Request.Method
+		if c.FullPath() == "/api/graphql" {
+			method = http.MethodGet // queries only read, whichever the method
+		}
+		groups, ok := authorize(c.GetString("role"), method, c.Request.URL.Path)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		if groups != nil {
+			if groupUnscoped[c.FullPath()] {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden: not available to roles limited to device groups"})
+				return
+			}
+			c.Set("device_groups", groups)
+			if strings.HasPrefix(c.FullPath(), "/api/devices/:id") {
+				var dev models.Device
+				if err := DB.Unscoped().Select("id", "group").First(&dev, c.Param("id")).Error; err != nil || !groups[dev.Group] {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+					return
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// deviceGroups returns the device groups the request is limited to, or nil.
+func deviceGroups(c *gin.Context) map[string]bool {
+	groups, _ := c.Get("device_groups")
+	g, _ := groups.(map[string]bool)
+	return g
+}
+
+// groupDeviceIDs is a subquery selecting the IDs of the devices in groups.
+func groupDeviceIDs(groups map[string]bool) *gorm.DB {
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	return DB.Model(&models.Device{}).Select("id").Where(map[string]any{"group": names})
+}
+
+// scopeInGroups reports whether a device_ids / group scope, as power
+// schedules and silences have, only selects devices in groups. With both
+// set it selects their intersection; with neither, every device.
+func scopeInGroups(ids []uint, group string, groups map[string]bool) bool {
+	if group != "" {
+		return groups[group]
+	}
+	ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+	if len(ids) == 0 {
+		return false
+	}
+	var n int64
+	if err := groupDeviceIDs(groups).Where("id IN ?", ids).Count(&n).Error; err != nil {
+		return false
+	}
+	return n == int64(len(ids))
+}
+
+// filterTreeGroups drops the devices outside groups from tree, moving their
+// permitted descendants up in their place. Nodes hanging off a device
+// (containers, pods) follow it; federated sites are dropped.
+func filterTreeGroups(tree []*models.DeviceTree, groups map[string]bool) []*models.DeviceTree {
+	out := []*models.DeviceTree{}
+	for _, n := range tree {
+		if n.Kind != "" || n.Site != "" {
+			continue
+		}
+		if groups[n.Group] {
+			kids := n.Children[:0:0]
+			for _, k := range n.Children {
+				if k.Kind != "" {
+					kids = append(kids, k)
+				}
+			}
+			n.Children = append(kids, filterTreeGroups(n.Children, groups)...)
+			out = append(out, n)
+			continue
+		}
+		out = append(out, filterTreeGroups(n.Children, groups)...)
+	}
+	return out
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListPolicies lists the policies.
+func handleListPolicies(c *gin.Context) {
+	var list []models.Policy
+	if err := DB.Order("role, id").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// policyBody is the create/update request; omitted fields are left alone
+// on update.
+type policyBody struct {
+	Role        *string   `json:"role"`
+	Methods     *[]string `json:"methods"`
+	Path        *string   `json:"path"`
+	Groups      *[]string `json:"groups"`
+	Description *string   `json:"description"`
+}
+
+func (b *policyBody) apply(p *models.Policy) error {
+	if b.Role != nil {
+		p.Role = strings.TrimSpace(*b.Role)
+	}
+	if b.Methods != nil {
+		var methods []string
+		for _, m := range *b.Methods {
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if !policyMethods[m] {
+				return fmt.Errorf("unknown method %q", m)
+			}
+			methods = append(methods, m)
+		}
+		p.Methods = strings.Join(methods, ",")
+	}
+	if b.Path != nil {
+		p.Path = strings.TrimSpace(*b.Path)
+	}
+	if b.Groups != nil {
+		p.Groups = strings.Join(*b.Groups, ",")
+	}
+	if b.Description != nil {
+		p.Description = *b.Description
+	}
+	switch {
+	case p.Role == "":
+		return fmt.Errorf("role is required")
+	case p.Role == models.RoleAdmin:
+		return fmt.Errorf("the admin role needs no policies")
+	case p.Methods == "":
+		return fmt.Errorf("methods is required")
+	case !strings.HasPrefix(p.Path, "/api/"):
+		return fmt.Errorf("path must start with /api/")
+	}
+	return nil
+}
+
+// handleCreatePolicy adds a policy.
+func handleCreatePolicy(c *gin.Context) {
+	var body policyBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var p models.Policy
+	if err := body.apply(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicPolicies, nil)
+	c.JSON(http.StatusOK, gin.H{"data": p})
+}
+
+// handleUpdatePolicy updates the provided fields of a policy.
+func handleUpdatePolicy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var p models.Policy
+	if err := DB.First(&p, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+		return
+	}
+	var body policyBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicPolicies, nil)
+	c.JSON(http.StatusOK, gin.H{"data": p})
+}
+
+// handleDeletePolicy removes a policy.
+func handleDeletePolicy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.Policy{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	shared.Publish(topicPolicies, nil)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+func TestPolicyGroupScope(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	lab := models.Device{Hostname: "lab1", IP: "10.0.0.1", Group: "lab"}
+	prod := models.Device{Hostname: "prod1", IP: "10.0.1.1", Group: "prod"}
+	for _, d := range []*models.Device{&lab, &prod} {
+		if err := DB.Create(d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for _, d := range []*models.Device{&lab, &prod} {
+		id := d.ID
+		DB.Create(&models.Event{DeviceID: &id, Type: models.EventPlaybookRun})
+		DB.Create(&models.ListeningPort{DeviceID: id, Proto: "tcp", Port: 22})
+		DB.Create(&models.RemediationRun{HookID: 1, DeviceID: id, StartedAt: now})
+		DB.Create(&models.CheckResult{CheckID: 1, DeviceID: id, CheckedAt: now})
+	}
+	// lab1 and prod1 see each other over LLDP.
+	DB.Create(&models.Neighbor{DeviceID: lab.ID, LocalPort: "eth0", SysName: "prod1", PeerDeviceID: &prod.ID})
+	DB.Create(&models.Neighbor{DeviceID: prod.ID, LocalPort: "eth1", SysName: "lab1", PeerDeviceID: &lab.ID})
+	DB.Create(&models.Policy{Role: "labops", Methods: "GET", Path: "/api/*", Groups: "lab"})
+	DB.Create(&models.Policy{Role: "viewer", Methods: "GET", Path: "/api/*"})
+	ReloadPolicies()
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("role", c.GetHeader("X-Role")) }, PolicyMiddleware())
+	r.GET("/api/events", handleListEvents)
+	r.GET("/api/ports", handleSearchPorts)
+	r.GET("/api/remediation/runs", handleListRemediationRuns)
+	r.GET("/api/checks/:id/results", handleCheckResults)
+	r.GET("/api/topology/links", handleTopologyLinks)
+	r.GET("/api/topology/path", handleTopologyPath)
+	r.GET("/api/topology/flows", handleTopologyFlows)
+	r.GET("/api/discovered", handleGetDiscovered)
+	r.GET("/api/scan/status", handleScanStatus)
+	r.GET("/api/federation/sites", handleListSites)
+	r.GET("/api/federation/sites/:id/rollups", handleSiteRollups)
+	r.GET("/api/devices/:id", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"data": []any{}}) })
+
+	both := []uint{lab.ID, prod.ID}
+	tests := []struct {
+		role, path string
+		status     int
+		devices    []uint // device_id of the rows returned
+	}{
+		{"labops", "/api/events", http.StatusOK, []uint{lab.ID}},
+		{"viewer", "/api/events", http.StatusOK, both},
+		{"labops", "/api/ports", http.StatusOK, []uint{lab.ID}},
+		{"labops", "/api/remediation/runs", http.StatusOK, []uint{lab.ID}},
+		{"viewer", "/api/remediation/runs", http.StatusOK, both},
+		{"labops", "/api/checks/1/results", http.StatusOK, []uint{lab.ID}},
+		{"labops", "/api/topology/links", http.StatusOK, []uint{lab.ID}},
+		{"viewer", "/api/topology/links", http.StatusOK, []uint{lab.ID}}, // merged into one cable
+		{"labops", "/api/topology/path?from=1&to=2", http.StatusForbidden, nil},
+		{"labops", "/api/topology/flows", http.StatusForbidden, nil},
+		{"labops", "/api/discovered", http.StatusForbidden, nil},
+		{"viewer", "/api/discovered", http.StatusOK, nil},
+		{"labops", "/api/scan/status", http.StatusForbidden, nil},
+		{"labops", "/api/federation/sites", http.StatusForbidden, nil},
+		{"viewer", "/api/federation/sites", http.StatusOK, nil},
+		{"labops", "/api/federation/sites/1/rollups", http.StatusForbidden, nil},
+		{"labops", "/api/devices/2", http.StatusForbidden, nil},
+		{"labops", "/api/devices/1", http.StatusOK, nil},
+		{"nobody", "/api/events", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("X-Role", tt.role)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var body struct {
+				Data []struct {
+					DeviceID     uint  `json:"device_id"`
+					PeerDeviceID *uint `json:"peer_device_id"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			var got []uint
+			for _, d := range body.Data {
+				got = append(got, d.DeviceID)
+				if tt.role == "labops" && d.PeerDeviceID != nil && *d.PeerDeviceID != lab.ID {
+					t.Errorf("peer %d outside the lab group is exposed", *d.PeerDeviceID)
+				}
+			}
+			slices.Sort(got)
+			if tt.devices != nil && !slices.Equal(got, tt.devices) {
+				t.Errorf("devices %v, want %v", got, tt.devices)
+			}
+		})
+	}
+}
+
+// TestPolicyGroupScopeConfig covers the routes whose objects select devices
+// by ID or group: roles limited to device groups only see and change those
+// within their groups.
+func TestPolicyGroupScopeConfig(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	lab := models.Device{Hostname: "lab1", IP: "10.0.0.1", Group: "lab"}
+	prod := models.Device{Hostname: "prod1", IP: "10.0.1.1", Group: "prod"}
+	for _, d := range []*models.Device{&lab, &prod} {
+		if err := DB.Create(d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(list ...uint) string {
+		return joinIDs(list)
+	}
+	schedules := []models.PowerSchedule{
+		{Name: "lab-devices", DeviceIDs: ids(lab.ID), WakeAt: "08:00"},
+		{Name: "lab-group", Group: "lab", WakeAt: "08:00"},
+		{Name: "mixed", DeviceIDs: ids(lab.ID, prod.ID), WakeAt: "08:00"},
+		{Name: "prod-group", Group: "prod", WakeAt: "08:00"},
+	}
+	if err := DB.Create(&schedules).Error; err != nil {
+		t.Fatal(err)
+	}
+	alertRule := models.AlertRule{Name: "cpu-high", Metric: "cpu_usage", Operator: ">", Threshold: 90}
+	if err := DB.Create(&alertRule).Error; err != nil {
+		t.Fatal(err)
+	}
+	rule := alertRule.ID
+	now := time.Now()
+	silences := []models.Silence{
+		{DeviceID: &lab.ID, StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{DeviceID: &prod.ID, StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{Group: "lab", StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{RuleID: &rule, StartsAt: now, EndsAt: now.Add(time.Hour)}, // every device
+	}
+	if err := DB.Create(&silences).Error; err != nil {
+		t.Fatal(err)
+	}
+	var running []*Task
+	for _, id := range []uint{lab.ID, prod.ID, 0} {
+		task, err := startTask(TaskPlaybook, "uptime", "host", id, func() {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(task.done)
+		running = append(running, task)
+	}
+	DB.Create(&models.Policy{Role: "labops", Methods: "GET,POST,PATCH,DELETE", Path: "/api/*", Groups: "lab"})
+	DB.Create(&models.Policy{Role: "viewer", Methods: "GET", Path: "/api/*"})
+	ReloadPolicies()
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("role", c.GetHeader("X-Role")) }, PolicyMiddleware())
+	r.GET("/api/power-schedules", handleListPowerSchedules)
+	r.POST("/api/power-schedules", handleCreatePowerSchedule)
+	r.PATCH("/api/power-schedules/:id", handleUpdatePowerSchedule)
+	r.DELETE("/api/power-schedules/:id", handleDeletePowerSchedule)
+	r.GET("/api/silences", handleListSilences)
+	r.POST("/api/silences", handleCreateSilence)
+	r.DELETE("/api/silences/:id", handleDeleteSilence)
+	r.GET("/api/tasks/running", handleRunningTasks)
+	r.POST("/api/tasks/:id/cancel", handleCancelTask)
+	r.POST("/api/tasks/stop", handleEmergencyStop)
+
+	path := func(format string, id any) string { return fmt.Sprintf(format, id) }
+	tests := []struct {
+		role, method, path, body string
+		status                   int
+		ids                      []uint64 // ids of the rows listed
+	}{
+		{"labops", "GET", "/api/power-schedules", "", http.StatusOK, []uint64{1, 2}},
+		{"viewer", "GET", "/api/power-schedules", "", http.StatusOK, []uint64{1, 2, 3, 4}},
+		{"labops", "POST", "/api/power-schedules", `{"name":"p","device_ids":[2],"wake_at":"08:00"}`, http.StatusForbidden, nil},
+		{"labops", "POST", "/api/power-schedules", `{"name":"l","group":"lab","wake_at":"08:00"}`, http.StatusOK, nil},
+		{"labops", "PATCH", "/api/power-schedules/1", `{"device_ids":[1,2]}`, http.StatusForbidden, nil},
+		{"labops", "PATCH", "/api/power-schedules/4", `{"wake_at":"09:00"}`, http.StatusNotFound, nil},
+		{"labops", "DELETE", "/api/power-schedules/3", "", http.StatusNotFound, nil},
+		{"labops", "GET", "/api/silences", "", http.StatusOK, []uint64{1, 3}},
+		{"viewer", "GET", "/api/silences", "", http.StatusOK, []uint64{1, 2, 3, 4}},
+		{"labops", "POST", "/api/silences", `{"device_id":2,"duration":"1h"}`, http.StatusForbidden, nil},
+		{"labops", "POST", "/api/silences", `{"rule":"cpu-high","duration":"1h"}`, http.StatusForbidden, nil},
+		{"labops", "DELETE", "/api/silences/4", "", http.StatusNotFound, nil},
+		{"labops", "GET", "/api/tasks/running", "", http.StatusOK, []uint64{running[0].ID}},
+		{"viewer", "GET", "/api/tasks/running", "", http.StatusOK, []uint64{running[0].ID, running[1].ID, running[2].ID}},
+		{"labops", "POST", path("/api/tasks/%d/cancel", running[1].ID), "", http.StatusNotFound, nil},
+		{"labops", "POST", path("/api/tasks/%d/cancel", running[2].ID), "", http.StatusNotFound, nil},
+		{"labops", "POST", path("/api/tasks/%d/cancel", running[0].ID), "", http.StatusOK, nil},
+		{"labops", "POST", "/api/tasks/stop", "", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-Role", tt.role)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.ids == nil {
+				return
+			}
+			var body struct {
+				Data []struct {
+					ID uint64 `json:"id"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			var got []uint64
+			for _, d := range body.Data {
+				got = append(got, d.ID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.ids) {
+				t.Errorf("ids %v, want %v", got, tt.ids)
+			}
+		})
+	}
+}
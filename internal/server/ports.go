@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// PortReport mirrors agent.ListenPort to avoid circular imports.
+type PortReport struct {
+	Proto   string `json:"proto"`
+	Addr    string `json:"addr"`
+	Port    uint32 `json:"port"`
+	PID     int32  `json:"pid"`
+	Process string `json:"process"`
+}
+
+type portKey struct {
+	proto, addr string
+	port        uint32
+}
+
+// SyncListeningPorts reconciles a device's port inventory with the agent's
+// latest list. Unlike containers, ports rarely change, so only the
+// difference is written: new sockets are inserted, closed ones deleted and
+// rows whose owner changed (service restarted) updated.
+func SyncListeningPorts(deviceID uint, reports []PortReport) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var existing []models.ListeningPort
+		if err := tx.Where("device_id = ?", deviceID).Find(&existing).Error; err != nil {
+			return err
+		}
+		known := make(map[portKey]models.ListeningPort, len(existing))
+		for _, p := range existing {
+			known[portKey{p.Proto, p.Addr, p.Port}] = p
+		}
+		for _, r := range reports {
+			k := portKey{r.Proto, r.Addr, r.Port}
+			old, ok := known[k]
+			delete(known, k)
+			switch {
+			case !ok:
+				p := models.ListeningPort{DeviceID: deviceID, Proto: r.Proto, Addr: r.Addr, Port: r.Port, PID: r.PID, Process: r.Process}
+				if err := tx.Create(&p).Error; err != nil {
+					return err
+				}
+			case old.PID != r.PID || old.Process != r.Process:
+				if err := tx.Model(&old).Updates(map[string]any{"pid": r.PID, "process": r.Process}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if len(known) == 0 {
+			return nil
+		}
+		gone := make([]uint, 0, len(known))
+		for _, p := range known {
+			gone = append(gone, p.ID)
+		}
+		return tx.Delete(&models.ListeningPort{}, gone).Error
+	})
+}
+
+// handleDevicePorts returns the listening-port inventory of a device.
+func handleDevicePorts(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var list []models.ListeningPort
+	if err := DB.Where("device_id = ?", id).Order("port, proto, addr").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// portMatch is a fleet-wide port search hit.
+type portMatch struct {
+	models.ListeningPort
+	Hostname string `json:"hostname"`
+	Remark   string `json:"remark"`
+	IP       string `json:"ip"`
+}
+
+// handleSearchPorts answers "which devices listen on 9090?" across the fleet.
+// Filters: ?port=, ?proto=tcp|udp, ?process= (substring match).
+func handleSearchPorts(c *gin.Context) {
+	q := DB.Table("listening_ports").
+		Select("listening_ports.*, devices.hostname, devices.remark, devices.ip").
+		Joins("JOIN devices ON devices.id = listening_ports.device_id AND devices.deleted_at IS NULL")
+	if s := c.Query("port"); s != "" {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid port"})
+			return
+		}
+		q = q.Where("listening_ports.port = ?", port)
+	}
+	if s := c.Query("proto"); s != "" {
+		q = q.Where("listening_ports.proto = ?", strings.ToLower(s))
+	}
+	if s := c.Query("process"); s != "" {
+		q = q.Where("listening_ports.process LIKE ?", "%"+s+"%")
+	}
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("listening_ports.device_id IN (?)", groupDeviceIDs(groups))
+	}
+	list := []portMatch{}
+	if err := q.Order("listening_ports.port, devices.hostname").Limit(1000).Scan(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
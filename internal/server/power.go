@@ -0,0 +1,435 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Power schedule actions.
+const (
+	powerWake  = "wake"
+	powerSleep = "sleep"
+)
+
+// powerCatchUp is how late a scheduled action may still run, e.g. after a
+// server restart; older ones are skipped rather than waking hosts at noon.
+const powerCatchUp = time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// RunPowerSchedules runs the due wake and sleep actions of the power
+// schedules every minute. Only one instance runs them. It never returns.
+func RunPowerSchedules() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for range tick.C {
+		if leads("power", 2*time.Minute) {
+			runPowerSchedules(time.Now())
+		}
+	}
+}
+
+func runPowerSchedules(now time.Time) {
+	var list []models.PowerSchedule
+	if err := DB.Where("enabled = ?", true).Find(&list).Error; err != nil {
+		log.Printf("[power] load schedules: %v", err)
+		return
+	}
+	for i := range list {
+		s := &list[i]
+		if powerPaused(s, now) {
+			continue
+		}
+		for _, action := range []string{powerWake, powerSleep} {
+			at, last, column := s.WakeAt, s.LastWake, "last_wake"
+			if action == powerSleep {
+				at, last, column = s.SleepAt, s.LastSleep, "last_sleep"
+			}
+			due, ok := powerTimeOn(at, now)
+			if !ok || now.Before(due) || now.Sub(due) > powerCatchUp || last != nil && !last.Before(due) {
+				continue
+			}
+			DB.Model(s).UpdateColumn(column, now)
+			log.Printf("[power] schedule %s: %s", s.Name, action)
+			for _, d := range powerDevices(s) {
+				go powerAction(d, action, "schedule "+s.Name)
+			}
+		}
+	}
+}
+
+// powerPaused reports whether the schedule does nothing at now: on a
+// weekday it skips, a holiday or during a manual override.
+func powerPaused(s *models.PowerSchedule, now time.Time) bool {
+	if s.OverrideUntil != nil && now.Before(*s.OverrideUntil) {
+		return true
+	}
+	if s.Days != "" {
+		scheduled := false
+		for _, d := range strings.Split(s.Days, ",") {
+			if wd, ok := weekdays[d]; ok && wd == now.Weekday() {
+				scheduled = true
+			}
+		}
+		if !scheduled {
+			return true
+		}
+	}
+	today := now.Format(time.DateOnly)
+	for _, h := range strings.Split(s.Holidays, ",") {
+		from, to, isRange := strings.Cut(h, "..")
+		if !isRange {
+			to = from
+		}
+		if from != "" && today >= from && today <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// powerTimeOn returns the "HH:MM" time on now's day.
+func powerTimeOn(hhmm string, now time.Time) (time.Time, bool) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return time.Time{}, false
+	}
+	y, m, d := now.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, now.Location()), true
+}
+
+// powerDevices returns the devices in the schedule's scope.
+func powerDevices(s *models.PowerSchedule) []models.Device {
+	q := DB.Model(&models.Device{})
+	if ids := splitIDs(s.DeviceIDs); len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+	if s.Group != "" {
+		q = q.Where(map[string]any{"group": s.Group})
+	}
+	var list []models.Device
+	if err := q.Find(&list).Error; err != nil {
+		log.Printf("[power] schedule %s: load devices: %v", s.Name, err)
+	}
+	return list
+}
+
+// powerAction wakes or shuts down d on behalf of by and records the
+// outcome on the device's timeline. Devices already in the wanted state
+// are left alone.
+func powerAction(d models.Device, action, by string) error {
+	var err error
+	switch action {
+	case powerWake:
+		if d.IsOnline {
+			return nil
+		}
+		err = wakeDevice(&d)
+		msg := fmt.Sprintf("%s: Wake-on-LAN sent (%s)", deviceName(&d), by)
+		if err != nil {
+			msg = fmt.Sprintf("%s: Wake-on-LAN failed (%s): %v", deviceName(&d), by, err)
+		}
+		RecordEvent(d.ID, models.EventPowerWake, msg, map[string]any{"by": by, "ok": err == nil})
+	case powerSleep:
+		if !d.IsOnline {
+			return nil
+		}
+		_, err = RunPlaybook("shutdown", d.IP, d.ID, nil)
+		msg := fmt.Sprintf("%s: shutting down (%s)", deviceName(&d), by)
+		if err != nil {
+			msg = fmt.Sprintf("%s: shutdown failed (%s): %v", deviceName(&d), by, err)
+		}
+		RecordEvent(d.ID, models.EventPowerSleep, msg, map[string]any{"by": by, "ok": err == nil})
+	}
+	if err != nil {
+		log.Printf("[power] %s device %d: %v", action, d.ID, err)
+	}
+	return err
+}
+
+// wakeDevice broadcasts a Wake-on-LAN magic packet for d, both to the
+// local broadcast address and to the broadcast address of d's subnet (a
+// /24 unless the agent reported the prefix).
+func wakeDevice(d *models.Device) error {
+	mac, bcast := d.MAC, ""
+	var ifaces []models.Interface
+	DB.Where("device_id = ?", d.ID).Order("is_primary desc").Find(&ifaces)
+	for _, ifc := range ifaces {
+		if mac == "" {
+			mac = ifc.MAC
+		}
+		for _, cidr := range ifc.IPs {
+			if ip, n, err := net.ParseCIDR(cidr); err == nil && ip.String() == d.IP && ip.To4() != nil {
+				bcast = broadcastOf(n)
+			}
+		}
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("no usable MAC address for %s", deviceName(d))
+	}
+	if bcast == "" {
+		if ip := net.ParseIP(d.IP).To4(); ip != nil {
+			bcast = broadcastOf(&net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)})
+		}
+	}
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hw, 16)...)
+	var sent bool
+	for _, addr := range []string{"255.255.255.255", bcast} {
+		if addr == "" {
+			continue
+		}
+		conn, err := net.Dial("udp4", net.JoinHostPort(addr, "9"))
+		if err != nil {
+			continue
+		}
+		if _, err := conn.Write(packet); err == nil {
+			sent = true
+		}
+		conn.Close()
+	}
+	if !sent {
+		return fmt.Errorf("sending magic packet for %s failed", hw)
+	}
+	return nil
+}
+
+func broadcastOf(n *net.IPNet) string {
+	ip := n.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	b := make(net.IP, 4)
+	for i := range b {
+		b[i] = ip[i] | ^n.Mask[i]
+	}
+	return b.String()
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListPowerSchedules returns the power schedules; roles limited to
+// device groups see those whose devices all lie in their groups.
+func handleListPowerSchedules(c *gin.Context) {
+	var list []models.PowerSchedule
+	if err := DB.Order("name").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		list = slices.DeleteFunc(list, func(s models.PowerSchedule) bool { return !powerInGroups(&s, groups) })
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// powerInGroups reports whether a schedule only reaches devices in groups.
+func powerInGroups(s *models.PowerSchedule, groups map[string]bool) bool {
+	return scopeInGroups(splitIDs(s.DeviceIDs), s.Group, groups)
+}
+
+// powerScheduleBody is the create / update body for a power schedule.
+// override (e.g. "12h") pauses the schedule from now; "" or "0" resumes it.
+type powerScheduleBody struct {
+	Name      *string `json:"name"`
+	DeviceIDs []uint  `json:"device_ids"`
+	Group     *string `json:"group"`
+	WakeAt    *string `json:"wake_at"`
+	SleepAt   *string `json:"sleep_at"`
+	Days      *string `json:"days"`
+	Holidays  *string `json:"holidays"`
+	Override  *string `json:"override"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+func (b *powerScheduleBody) apply(s *models.PowerSchedule) error {
+	if b.Name != nil {
+		s.Name = strings.TrimSpace(*b.Name)
+	}
+	if b.DeviceIDs != nil {
+		s.DeviceIDs = joinIDs(b.DeviceIDs)
+	}
+	if b.Group != nil {
+		s.Group = strings.TrimSpace(*b.Group)
+	}
+	if b.WakeAt != nil {
+		s.WakeAt = strings.TrimSpace(*b.WakeAt)
+	}
+	if b.SleepAt != nil {
+		s.SleepAt = strings.TrimSpace(*b.SleepAt)
+	}
+	if b.Days != nil {
+		s.Days = strings.ToLower(strings.ReplaceAll(*b.Days, " ", ""))
+	}
+	if b.Holidays != nil {
+		s.Holidays = strings.ReplaceAll(*b.Holidays, " ", "")
+	}
+	if b.Override != nil {
+		s.OverrideUntil = nil
+		if v := strings.TrimSpace(*b.Override); v != "" && v != "0" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("override: want a duration such as 12h")
+			}
+			until := time.Now().Add(d)
+			s.OverrideUntil = &until
+		}
+	}
+	if b.Enabled != nil {
+		s.Enabled = *b.Enabled
+	}
+
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.DeviceIDs == "" && s.Group == "" {
+		return fmt.Errorf("set device_ids or group")
+	}
+	if s.WakeAt == "" && s.SleepAt == "" {
+		return fmt.Errorf("set wake_at or sleep_at")
+	}
+	for field, v := range map[string]string{"wake_at": s.WakeAt, "sleep_at": s.SleepAt} {
+		if _, err := time.Parse("15:04", v); v != "" && err != nil {
+			return fmt.Errorf("%s: want HH:MM", field)
+		}
+	}
+	if s.Days != "" {
+		for _, d := range strings.Split(s.Days, ",") {
+			if _, ok := weekdays[d]; !ok {
+				return fmt.Errorf("days: unknown day %q (use mon … sun)", d)
+			}
+		}
+	}
+	if s.Holidays != "" {
+		for _, h := range strings.Split(s.Holidays, ",") {
+			from, to, isRange := strings.Cut(h, "..")
+			if _, err := time.Parse(time.DateOnly, from); err != nil {
+				return fmt.Errorf("holidays: %q is not a YYYY-MM-DD date", h)
+			}
+			if _, err := time.Parse(time.DateOnly, to); isRange && (err != nil || to < from) {
+				return fmt.Errorf("holidays: %q is not a date range", h)
+			}
+		}
+	}
+	return nil
+}
+
+// handleCreatePowerSchedule creates a schedule.
+func handleCreatePowerSchedule(c *gin.Context) {
+	var body powerScheduleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s := models.PowerSchedule{Enabled: true}
+	if err := body.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil && !powerInGroups(&s, groups) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: the schedule reaches devices outside your groups"})
+		return
+	}
+	enabled := s.Enabled
+	if err := DB.Create(&s).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !enabled {
+		DB.Model(&s).Update("enabled", false)
+		s.Enabled = false
+	}
+	c.JSON(http.StatusOK, gin.H{"data": s})
+}
+
+// handleUpdatePowerSchedule updates the provided fields of a schedule.
+func handleUpdatePowerSchedule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	groups := deviceGroups(c)
+	var s models.PowerSchedule
+	if err := DB.First(&s, id).Error; err != nil || (groups != nil && !powerInGroups(&s, groups)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "power schedule not found"})
+		return
+	}
+	var body powerScheduleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if groups != nil && !powerInGroups(&s, groups) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: the schedule reaches devices outside your groups"})
+		return
+	}
+	if err := DB.Select("*").Save(&s).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": s})
+}
+
+// handleDeletePowerSchedule removes a schedule.
+func handleDeletePowerSchedule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		var s models.PowerSchedule
+		if err := DB.First(&s, id).Error; err != nil || !powerInGroups(&s, groups) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "power schedule not found"})
+			return
+		}
+	}
+	if err := DB.Delete(&models.PowerSchedule{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handlePowerAction wakes (POST /devices/:id/wake) or shuts down
+// (POST /devices/:id/sleep) a device now.
+func handlePowerAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var d models.Device
+		if err := DB.First(&d, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+			return
+		}
+		if (action == powerWake) == d.IsOnline {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("device is already %s", map[bool]string{true: "online", false: "offline"}[d.IsOnline])})
+			return
+		}
+		if err := powerAction(d, action, c.GetString("username")); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": gin.H{"device_id": d.ID, "action": action}})
+	}
+}
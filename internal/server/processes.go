@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// processHistoryWindow bounds how long top-process samples are kept, which
+// covers the sparkline window in the device drawer.
+const processHistoryWindow = time.Hour
+
+// latestProcesses caches the most recent top-process list per device.
+var latestProcesses sync.Map // map[uint][]models.ProcessSample
+
+// SaveProcessSamples persists one report's worth of top processes for a device
+// and prunes samples older than processHistoryWindow.
+func SaveProcessSamples(deviceID uint, samples []models.ProcessSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range samples {
+		samples[i].ID = 0
+		samples[i].DeviceID = deviceID
+		samples[i].ReportedAt = now
+	}
+	if err := DB.Create(&samples).Error; err != nil {
+		return err
+	}
+	cached := make([]models.ProcessSample, len(samples))
+	copy(cached, samples)
+	latestProcesses.Store(deviceID, cached)
+
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-processHistoryWindow)).
+		Delete(&models.ProcessSample{})
+	return nil
+}
+
+// GetProcessSamples returns the top processes of the report closest before at
+// (the latest report when at is zero), or an empty slice.
+func GetProcessSamples(deviceID uint, at time.Time) []models.ProcessSample {
+	if at.IsZero() {
+		if v, ok := latestProcesses.Load(deviceID); ok {
+			if ps, ok2 := v.([]models.ProcessSample); ok2 {
+				return ps
+			}
+		}
+		at = time.Now()
+	}
+	var last models.ProcessSample
+	if err := DB.Where("device_id = ? AND reported_at <= ?", deviceID, at).
+		Order("reported_at desc").First(&last).Error; err != nil {
+		return []models.ProcessSample{}
+	}
+	var list []models.ProcessSample
+	DB.Where("device_id = ? AND reported_at = ?", deviceID, last.ReportedAt).
+		Order("cpu_percent desc, rss desc").
+		Find(&list)
+	return list
+}
+
+// handleDeviceProcesses returns the busiest processes of a device. ?at=
+// (RFC 3339 or unix seconds) selects the report at or before that time, e.g.
+// the moment of a CPU spike in the sparkline.
+func handleDeviceProcesses(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var at time.Time
+	if s := c.Query("at"); s != "" {
+		if at, err = parseTimeParam(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": GetProcessSamples(uint(id), at)})
+}
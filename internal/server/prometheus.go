@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// RegisterPrometheus serves the latest metrics of all devices in the
+// Prometheus text format at path (prometheus_path), so one scrape of the
+// server replaces an exporter on every node. It takes the same tokens and
+// policies as the API; a read-only API token suits a scraper.
+func RegisterPrometheus(r *gin.Engine, path string) {
+	r.GET(path, JWTMiddleware(), PolicyMiddleware(), handlePrometheus)
+}
+
+// promDevice is one device with what is exported about it.
+type promDevice struct {
+	labels  string
+	dev     *models.Device
+	up      bool
+	m       *models.Metrics // nil unless a fresh sample exists
+	latency []models.LatencySample
+	timing  *models.ReportTiming
+}
+
+// promFamily is one exported gauge; value reports false to leave a device
+// out.
+type promFamily struct {
+	name, help string
+	value      func(d *promDevice) (float64, bool)
+}
+
+// fromMetrics exports a field of the latest sample.
+func fromMetrics(f func(m *models.Metrics) float64) func(d *promDevice) (float64, bool) {
+	return func(d *promDevice) (float64, bool) {
+		if d.m == nil {
+			return 0, false
+		}
+		return f(d.m), true
+	}
+}
+
+var promFamilies = []promFamily{
+	{"opentalon_device_up", "Whether the device is online (1) or not (0).", func(d *promDevice) (float64, bool) {
+		if d.up {
+			return 1, true
+		}
+		return 0, true
+	}},
+	{"opentalon_device_last_seen_timestamp_seconds", "When the device last reported.", func(d *promDevice) (float64, bool) {
+		if d.dev.LastSeen.IsZero() {
+			return 0, false
+		}
+		return float64(d.dev.LastSeen.Unix()), true
+	}},
+	{"opentalon_device_flap_count", "Recent offline transitions of the device.", func(d *promDevice) (float64, bool) {
+		return float64(d.dev.FlapCount), true
+	}},
+	{"opentalon_device_cpu_usage_percent", "CPU usage.", fromMetrics(func(m *models.Metrics) float64 { return m.CPUUsage })},
+	{"opentalon_device_memory_usage_percent", "Memory usage.", fromMetrics(func(m *models.Metrics) float64 { return m.MemUsage })},
+	{"opentalon_device_memory_total_bytes", "Physical memory.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.MemTotal) })},
+	{"opentalon_device_disk_usage_percent", "Usage of the fullest mount.", fromMetrics(func(m *models.Metrics) float64 { return m.DiskUsage })},
+	{"opentalon_device_network_receive_bytes_per_second", "Ingress rate.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.RxBytes) })},
+	{"opentalon_device_network_transmit_bytes_per_second", "Egress rate.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.TxBytes) })},
+	{"opentalon_device_tcp_connections", "Open TCP connections.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.TCPConnections) })},
+	{"opentalon_device_udp_connections", "Open UDP sockets.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.UDPConnections) })},
+	{"opentalon_device_uptime_seconds", "Time since boot.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.Uptime) })},
+	{"opentalon_device_boot_time_seconds", "Boot time.", fromMetrics(func(m *models.Metrics) float64 { return float64(m.BootTime) })},
+	{"opentalon_device_clock_offset_seconds", "How far the host clock runs ahead of its NTP server.", func(d *promDevice) (float64, bool) {
+		if d.m == nil || d.dev.ClockOffsetMs == nil {
+			return 0, false
+		}
+		return *d.dev.ClockOffsetMs / 1000, true
+	}},
+	{"opentalon_device_report_duration_seconds", "How long the agent's latest report to the server took.", func(d *promDevice) (float64, bool) {
+		if d.m == nil || d.timing == nil {
+			return 0, false
+		}
+		return d.timing.TotalMs / 1000, true
+	}},
+}
+
+// promLatencyFamilies are exported per probe target.
+var promLatencyFamilies = []struct {
+	name, help string
+	value      func(s *models.LatencySample) (float64, bool)
+}{
+	{"opentalon_device_latency_rtt_seconds", "Average RTT to the probe target.", func(s *models.LatencySample) (float64, bool) {
+		return s.RTTAvg / 1000, s.Received > 0
+	}},
+	{"opentalon_device_latency_loss_ratio", "Packet loss to the probe target.", func(s *models.LatencySample) (float64, bool) {
+		return s.LossPct / 100, true
+	}},
+}
+
+func handlePrometheus(c *gin.Context) {
+	q := DB.Where("agent_ver <> ?", "discovered").Order("id")
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	var devices []models.Device
+	if err := q.Find(&devices).Error; err != nil {
+		c.String(http.StatusInternalServerError, "# %s\n", err)
+		return
+	}
+	now := time.Now()
+	list := make([]promDevice, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		pd := &list[i]
+		pd.dev = d
+		pd.labels = promLabels("device_id", strconv.FormatUint(uint64(d.ID), 10),
+			"hostname", d.Hostname, "group", d.Group, "ip", d.IP)
+		s := liveStatus(d, now)
+		pd.up = s == "online" || s == "flapping" && d.IsOnline
+		// Stale samples are left out rather than repeated as flat lines.
+		if m, err := GetLatestMetrics(d.ID); err == nil && now.Sub(m.ReportedAt) <= offlineTimeout(d) {
+			pd.m = m
+			pd.latency = GetLatestLatency(d.ID)
+			if v, ok := latestReportTiming.Load(d.ID); ok {
+				t := v.(models.ReportTiming)
+				pd.timing = &t
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, f := range promFamilies {
+		header := false
+		for i := range list {
+			v, ok := f.value(&list[i])
+			if !ok {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", f.name, f.help, f.name)
+				header = true
+			}
+			fmt.Fprintf(&b, "%s{%s} %s\n", f.name, list[i].labels, promValue(v))
+		}
+	}
+	for _, f := range promLatencyFamilies {
+		header := false
+		for i := range list {
+			for j := range list[i].latency {
+				s := &list[i].latency[j]
+				v, ok := f.value(s)
+				if !ok {
+					continue
+				}
+				if !header {
+					fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", f.name, f.help, f.name)
+					header = true
+				}
+				fmt.Fprintf(&b, "%s{%s,%s} %s\n", f.name, list[i].labels, promLabels("target", s.Target), promValue(v))
+			}
+		}
+	}
+	writePromAlerts(&b, deviceGroups(c))
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+// writePromAlerts exports the firing alerts by severity.
+func writePromAlerts(b *strings.Builder, groups map[string]bool) {
+	q := DB.Model(&models.Alert{}).Where("status = ?", models.AlertFiring)
+	if groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	var rows []struct {
+		Severity string
+		N        int
+	}
+	if err := q.Select("severity, COUNT(*) AS n").Group("severity").Scan(&rows).Error; err != nil {
+		log.Printf("[prometheus] count alerts: %v", err)
+		return
+	}
+	counts := map[string]int{models.SeverityInfo: 0, models.SeverityWarning: 0, models.SeverityCritical: 0}
+	for _, r := range rows {
+		counts[r.Severity] = r.N
+	}
+	sevs := make([]string, 0, len(counts))
+	for s := range counts {
+		sevs = append(sevs, s)
+	}
+	sort.Strings(sevs)
+	b.WriteString("# HELP opentalon_alerts_firing Firing alerts.\n# TYPE opentalon_alerts_firing gauge\n")
+	for _, s := range sevs {
+		fmt.Fprintf(b, "opentalon_alerts_firing{%s} %d\n", promLabels("severity", s), counts[s])
+	}
+}
+
+// promLabels formats name/value pairs as a label set, escaped per the text
+// format.
+func promLabels(kv ...string) string {
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		parts = append(parts, kv[i]+`="`+v+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func promValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
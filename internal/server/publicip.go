@@ -0,0 +1,30 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// TrackPublicIP stores the public address reported by a root device's agent
+// and records a public_ip_changed event when the ISP handed out a new one.
+// An empty or malformed address (lookup disabled or failed) is ignored.
+func TrackPublicIP(dev *models.Device, ip string) {
+	if net.ParseIP(ip) == nil || ip == dev.PublicIP {
+		return
+	}
+	prev := dev.PublicIP
+	DB.Model(dev).Update("public_ip", ip)
+	dev.PublicIP = ip
+	if prev == "" {
+		return // first lookup
+	}
+	name := dev.Hostname
+	if dev.Remark != "" {
+		name = dev.Remark
+	}
+	RecordEvent(dev.ID, models.EventPublicIPChanged,
+		fmt.Sprintf("%s public IP changed from %s to %s", name, prev, ip),
+		map[string]any{"previous_ip": prev, "public_ip": ip})
+}
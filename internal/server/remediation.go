@@ -0,0 +1,381 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// remediationInFlight guards against running the same hook on the same device
+// twice concurrently (e.g. an alert re-firing while the playbook still runs).
+var remediationInFlight sync.Map // map[string]struct{}  "hookID:deviceID"
+
+// TriggerRemediation is called when the alert rule ruleName fires on a device.
+// Every enabled hook bound to the rule (and scoped to the device, if scoped)
+// is checked against its cooldown and hourly rate limit, then executed
+// asynchronously. Failed runs are escalated.
+func TriggerRemediation(ruleName string, deviceID uint) {
+	var hooks []models.RemediationHook
+	if err := DB.Where("rule_name = ? AND enabled = ? AND (device_id IS NULL OR device_id = ?)",
+		ruleName, true, deviceID).Find(&hooks).Error; err != nil {
+		log.Printf("[remediation] load hooks for rule %q: %v", ruleName, err)
+		return
+	}
+	for i := range hooks {
+		h := hooks[i]
+		go runRemediationHook(&h, deviceID)
+	}
+}
+
+// runRemediationHook applies rate limiting and runs a single hook.
+func runRemediationHook(h *models.RemediationHook, deviceID uint) {
+	key := fmt.Sprintf("%d:%d", h.ID, deviceID)
+	if _, busy := remediationInFlight.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	defer remediationInFlight.Delete(key)
+
+	run := models.RemediationRun{
+		HookID:    h.ID,
+		DeviceID:  deviceID,
+		RuleName:  h.RuleName,
+		Playbook:  h.Playbook,
+		StartedAt: time.Now(),
+	}
+
+	reason := remediationSuppressed(h, deviceID, run.StartedAt)
+	if TasksHalted() {
+		reason = "emergency stop active"
+	}
+	if reason != "" {
+		run.Status = models.RemediationSkipped
+		run.Reason = reason
+		run.FinishedAt = time.Now()
+		DB.Create(&run)
+		return
+	}
+
+	var dev models.Device
+	if err := DB.First(&dev, deviceID).Error; err != nil {
+		run.Status = models.RemediationFailed
+		run.Reason = "device not found"
+		run.FinishedAt = time.Now()
+		DB.Create(&run)
+		return
+	}
+
+	args := map[string]string{}
+	if h.Args != "" {
+		if err := json.Unmarshal([]byte(h.Args), &args); err != nil {
+			run.Status = models.RemediationFailed
+			run.Reason = "invalid hook args: " + err.Error()
+			run.FinishedAt = time.Now()
+			DB.Create(&run)
+			return
+		}
+	}
+
+	out, err := RunPlaybook(h.Playbook, dev.IP, dev.ID, args)
+	run.Output = out
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = models.RemediationFailed
+		run.Reason = err.Error()
+		DB.Create(&run)
+		escalateRemediation(&run, &dev)
+		return
+	}
+	run.Status = models.RemediationSucceeded
+	DB.Create(&run)
+	log.Printf("[remediation] %s on %s (%s) succeeded", h.Playbook, dev.Hostname, dev.IP)
+}
+
+// remediationSuppressed returns a non-empty reason when the hook must not run
+// on the device right now because of its cooldown or hourly cap.
+// Skipped runs do not count towards either limit.
+func remediationSuppressed(h *models.RemediationHook, deviceID uint, now time.Time) string {
+	executed := []string{models.RemediationSucceeded, models.RemediationFailed, models.RemediationEscalated}
+	if h.CooldownSec > 0 {
+		var last models.RemediationRun
+		err := DB.Where("hook_id = ? AND device_id = ? AND status IN ?", h.ID, deviceID, executed).
+			Order("started_at desc").First(&last).Error
+		if err == nil && now.Sub(last.StartedAt) < time.Duration(h.CooldownSec)*time.Second {
+			return fmt.Sprintf("cooldown (%ds) active since %s", h.CooldownSec, last.StartedAt.Format(time.RFC3339))
+		}
+	}
+	if h.MaxPerHour > 0 {
+		var n int64
+		DB.Model(&models.RemediationRun{}).
+			Where("hook_id = ? AND device_id = ? AND status IN ? AND started_at > ?", h.ID, deviceID, executed, now.Add(-time.Hour)).
+			Count(&n)
+		if int(n) >= h.MaxPerHour {
+			return fmt.Sprintf("rate limit reached (%d runs in the last hour)", n)
+		}
+	}
+	return ""
+}
+
+// escalateRemediation marks a failed run as escalated and hands it to the
+// operators: the alert that triggered it is notified again on its channel
+// (and to its subscribers) with the failure, and the escalation is recorded
+// on the alert and the device timeline.
+func escalateRemediation(run *models.RemediationRun, dev *models.Device) {
+	DB.Model(run).Update("status", models.RemediationEscalated)
+	run.Status = models.RemediationEscalated
+	log.Printf("[remediation] ESCALATED: %s on %s (%s) for rule %q failed: %s",
+		run.Playbook, dev.Hostname, dev.IP, run.RuleName, run.Reason)
+
+	msg := fmt.Sprintf("Automatic remediation %s on %s failed: %s", run.Playbook, deviceName(dev), run.Reason)
+	data := map[string]any{"rule": run.RuleName, "playbook": run.Playbook, "remediation_run_id": run.ID}
+	var a models.Alert
+	if err := DB.Where("rule_name = ? AND device_id = ?", run.RuleName, dev.ID).Order("fired_at desc").First(&a).Error; err != nil {
+		// The run outlived its alert (a purged device history, say):
+		// page every channel rather than nobody.
+		RecordEvent(dev.ID, models.EventAlertEscalated, msg, data)
+		a = models.Alert{RuleName: run.RuleName, DeviceID: dev.ID, Status: models.AlertFiring, Message: msg, FiredAt: run.StartedAt}
+		notifyAlertVia(&a, "", msg, 0)
+		return
+	}
+	data["alert_id"] = a.ID
+	RecordEvent(dev.ID, models.EventAlertEscalated, msg, data)
+	recordAlertEvent(&a, models.AlertEventEscalated, "", a.Channel, msg)
+	notifyAlert(&a, msg)
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListPlaybooks returns the built-in playbooks available to hooks.
+func handleListPlaybooks(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": ListPlaybooks()})
+}
+
+// handleDeviceExec runs a playbook on a device by hand and waits for it:
+// POST /api/devices/:id/exec {"playbook": "restart-service", "args":
+// {"service": "nginx"}}, or {"command": "uptime"} for the shell playbook.
+// The run is recorded on the device's timeline; a failed run still answers
+// 200 with its output and error.
+func handleDeviceExec(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		Playbook string            `json:"playbook"`
+		Args     map[string]string `json:"args"`
+		Command  string            `json:"command"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Command != "" {
+		if body.Playbook != "" && body.Playbook != "shell" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "command: only for the shell playbook"})
+			return
+		}
+		body.Playbook = "shell"
+		body.Args = map[string]string{"command": body.Command}
+	}
+	if _, ok := Playbooks[body.Playbook]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("playbook: unknown playbook %q", body.Playbook)})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if TasksHalted() {
+		c.JSON(http.StatusConflict, gin.H{"error": errTasksHalted.Error()})
+		return
+	}
+	by := c.GetString("username")
+	started := time.Now()
+	out, err := RunPlaybook(body.Playbook, dev.IP, dev.ID, body.Args)
+	res := gin.H{"playbook": body.Playbook, "output": out, "ok": err == nil, "duration_ms": time.Since(started).Milliseconds()}
+	data := map[string]any{"by": by, "playbook": body.Playbook, "ok": err == nil}
+	msg := fmt.Sprintf("%s: %s run by %s", deviceName(&dev), body.Playbook, by)
+	if body.Playbook == "shell" {
+		data["command"] = body.Args["command"]
+		msg = fmt.Sprintf("%s: %s ran %q", deviceName(&dev), by, body.Args["command"])
+	}
+	if err != nil {
+		res["error"] = err.Error()
+		msg += ": " + err.Error()
+	}
+	RecordEvent(dev.ID, models.EventPlaybookRun, msg, data)
+	c.JSON(http.StatusOK, gin.H{"data": res})
+}
+
+// handleListRemediationHooks returns all remediation hooks.
+func handleListRemediationHooks(c *gin.Context) {
+	var hooks []models.RemediationHook
+	if err := DB.Order("id").Find(&hooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": hooks})
+}
+
+// remediationHookBody is the create / update body for a remediation hook.
+type remediationHookBody struct {
+	RuleName    *string           `json:"rule_name"`
+	DeviceID    *uint             `json:"device_id"`
+	Playbook    *string           `json:"playbook"`
+	Args        map[string]string `json:"args"`
+	CooldownSec *int              `json:"cooldown_sec"`
+	MaxPerHour  *int              `json:"max_per_hour"`
+	Enabled     *bool             `json:"enabled"`
+}
+
+// apply copies the provided fields onto h and validates the result.
+func (b *remediationHookBody) apply(h *models.RemediationHook) error {
+	if b.RuleName != nil {
+		h.RuleName = *b.RuleName
+	}
+	if b.DeviceID != nil {
+		h.DeviceID = b.DeviceID
+		if *b.DeviceID == 0 {
+			h.DeviceID = nil
+		}
+	}
+	if b.Playbook != nil {
+		h.Playbook = *b.Playbook
+	}
+	if b.Args != nil {
+		raw, _ := json.Marshal(b.Args)
+		h.Args = string(raw)
+	}
+	if b.CooldownSec != nil {
+		h.CooldownSec = *b.CooldownSec
+	}
+	if b.MaxPerHour != nil {
+		h.MaxPerHour = *b.MaxPerHour
+	}
+	if b.Enabled != nil {
+		h.Enabled = *b.Enabled
+	}
+	if h.RuleName == "" {
+		return fmt.Errorf("rule_name is required")
+	}
+	if _, ok := Playbooks[h.Playbook]; !ok {
+		return fmt.Errorf("unknown playbook %q", h.Playbook)
+	}
+	if h.CooldownSec < 0 || h.MaxPerHour < 0 {
+		return fmt.Errorf("cooldown_sec and max_per_hour must be >= 0")
+	}
+	return nil
+}
+
+// handleCreateRemediationHook creates a hook.
+func handleCreateRemediationHook(c *gin.Context) {
+	var body remediationHookBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h := models.RemediationHook{CooldownSec: 600, MaxPerHour: 3, Enabled: true}
+	if err := body.apply(&h); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// GORM 会把零值字段回落为列默认值（enabled=false → true），创建后显式写回。
+	want := h
+	if err := DB.Create(&h).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	DB.Model(&h).Select("enabled", "cooldown_sec", "max_per_hour").Updates(map[string]any{
+		"enabled":      want.Enabled,
+		"cooldown_sec": want.CooldownSec,
+		"max_per_hour": want.MaxPerHour,
+	})
+	h.Enabled, h.CooldownSec, h.MaxPerHour = want.Enabled, want.CooldownSec, want.MaxPerHour
+	c.JSON(http.StatusOK, gin.H{"data": h})
+}
+
+// handleUpdateRemediationHook updates the provided fields of a hook.
+func handleUpdateRemediationHook(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var h models.RemediationHook
+	if err := DB.First(&h, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "hook not found"})
+		return
+	}
+	var body remediationHookBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&h); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&h).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": h})
+}
+
+// handleDeleteRemediationHook removes a hook (its run history is kept).
+func handleDeleteRemediationHook(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.RemediationHook{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleListRemediationRuns returns recent runs, optionally filtered by
+// ?device_id= and ?status=.
+func handleListRemediationRuns(c *gin.Context) {
+	q := DB.Order("started_at desc").Limit(200)
+	if v := c.Query("device_id"); v != "" {
+		q = q.Where("device_id = ?", v)
+	}
+	if v := c.Query("status"); v != "" {
+		q = q.Where("status = ?", v)
+	}
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	var runs []models.RemediationRun
+	if err := q.Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": runs})
+}
+
+// handleTriggerRemediation lets operators fire a rule's hooks by hand, e.g. to
+// verify a new hook before relying on it.
+func handleTriggerRemediation(c *gin.Context) {
+	var body struct {
+		RuleName string `json:"rule_name" binding:"required"`
+		DeviceID uint   `json:"device_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	TriggerRemediation(body.RuleName, body.DeviceID)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
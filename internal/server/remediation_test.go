@@ -0,0 +1,72 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// recordingNotifier passes what it is sent to a channel.
+type recordingNotifier chan *Notification
+
+func (r recordingNotifier) send(n *Notification) error {
+	r <- n
+	return nil
+}
+
+// testChannel registers a recording channel under name for the test.
+func testChannel(t *testing.T, name string) recordingNotifier {
+	t.Helper()
+	rec := make(recordingNotifier, 4)
+	if err := addNotifier(name, rec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		notifiers.Lock()
+		delete(notifiers.byName, name)
+		notifiers.names = slices.DeleteFunc(notifiers.names, func(s string) bool { return s == name })
+		notifiers.Unlock()
+	})
+	return rec
+}
+
+func TestEscalateRemediationNotifies(t *testing.T) {
+	openTestDB(t)
+	pager := testChannel(t, "pager")
+	dev := models.Device{Hostname: "web-1", IP: "10.0.0.1"}
+	if err := DB.Create(&dev).Error; err != nil {
+		t.Fatal(err)
+	}
+	alert := models.Alert{RuleName: "nginx-down", DeviceID: dev.ID, Status: models.AlertFiring, Channel: "pager", FiredAt: time.Now()}
+	if err := DB.Create(&alert).Error; err != nil {
+		t.Fatal(err)
+	}
+	run := models.RemediationRun{RuleName: "nginx-down", DeviceID: dev.ID, Playbook: "restart-service", Status: models.RemediationFailed, Reason: "exit status 1", StartedAt: time.Now()}
+	if err := DB.Create(&run).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	escalateRemediation(&run, &dev)
+
+	select {
+	case n := <-pager:
+		if n.AlertID != alert.ID || !strings.Contains(n.Message, "restart-service") || !strings.Contains(n.Message, "exit status 1") {
+			t.Errorf("notification = %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pager was not notified")
+	}
+	var stored models.RemediationRun
+	DB.First(&stored, run.ID)
+	if stored.Status != models.RemediationEscalated {
+		t.Errorf("run status = %q, want %q", stored.Status, models.RemediationEscalated)
+	}
+	var escalations int64
+	DB.Model(&models.AlertEvent{}).Where("alert_id = ? AND type = ?", alert.ID, models.AlertEventEscalated).Count(&escalations)
+	if escalations != 1 {
+		t.Errorf("%d escalations recorded on the alert, want 1", escalations)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// latestReportTiming caches the most recent report timing per device.
+var latestReportTiming sync.Map // map[uint]models.ReportTiming
+
+// SaveReportTiming persists the timing of a device's previous report and
+// prunes timings older than latencyHistoryWindow.
+func SaveReportTiming(deviceID uint, t *models.ReportTiming) error {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	t.ID, t.DeviceID, t.ReportedAt = 0, deviceID, now
+	if err := DB.Create(t).Error; err != nil {
+		return err
+	}
+	latestReportTiming.Store(deviceID, *t)
+
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-latencyHistoryWindow)).
+		Delete(&models.ReportTiming{})
+	return nil
+}
+
+// handleDeviceReportTiming returns how long a device's reports to the
+// server took, oldest first; ?from= / ?to= (RFC 3339 or unix seconds) limit
+// it to a time range within the retained window.
+func handleDeviceReportTiming(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	q := DB.Where("device_id = ?", id)
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			ts, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("reported_at "+op+" ?", ts)
+		}
+	}
+	list := []models.ReportTiming{}
+	if err := q.Order("reported_at").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
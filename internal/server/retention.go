@@ -0,0 +1,107 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// metricsRetentionInterval is how often RunMetricsRetention prunes.
+const metricsRetentionInterval = time.Hour
+
+// RunMetricsRetention drops raw samples older than the retention of their
+// device's group (groupDays, metrics_group_retention_days) or else
+// defaultDays (metrics_retention_days), and every sample of devices that no
+// longer exist. A store with its own TTL (ClickHouse) already expires
+// samples after defaultDays, so there only shorter group retentions are
+// applied.
+func RunMetricsRetention(defaultDays int, groupDays map[string]int) {
+	_, ttl := metricsStore.(*clickHouseStore)
+	for {
+		if leads("metrics-retention", 2*metricsRetentionInterval) {
+			pruneMetrics(time.Now(), defaultDays, groupDays, ttl)
+		}
+		time.Sleep(metricsRetentionInterval)
+	}
+}
+
+func pruneMetrics(now time.Time, defaultDays int, groupDays map[string]int, ttl bool) {
+	ids, err := metricsStore.Devices()
+	if err != nil {
+		log.Printf("[retention] list devices: %v", err)
+		return
+	}
+	// Devices in the trash keep their samples until purged.
+	var devices []models.Device
+	if err := DB.Unscoped().Select("id", "group").Where("id IN ?", ids).Find(&devices).Error; err != nil {
+		log.Printf("[retention] load devices: %v", err)
+		return
+	}
+	groupOf := make(map[uint]string, len(devices))
+	for _, d := range devices {
+		groupOf[d.ID] = d.Group
+	}
+	var total int64
+	for _, id := range ids {
+		var before time.Time
+		if group, ok := groupOf[id]; ok {
+			days, custom := groupDays[group]
+			if !custom {
+				days = defaultDays
+			}
+			if days <= 0 || (ttl && days >= defaultDays) {
+				continue
+			}
+			before = now.AddDate(0, 0, -days)
+		}
+		n, err := metricsStore.DeleteBefore(id, before)
+		if err != nil {
+			log.Printf("[retention] device %d: %v", id, err)
+			continue
+		}
+		total += n
+	}
+	if total > 0 {
+		log.Printf("[retention] dropped %d expired samples", total)
+	}
+}
+
+// forgetLatestMetrics drops the cached newest sample of a device.
+func forgetLatestMetrics(deviceID uint) {
+	latestMetrics.Delete(deviceID)
+	shared.Delete(latestMetricsKey(deviceID))
+}
+
+// handlePurgeMetrics deletes a device's raw samples: all of them, or those
+// reported before ?before= (RFC 3339 or unix seconds). Rollups are kept.
+func handlePurgeMetrics(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var before time.Time
+	if s := c.Query("before"); s != "" {
+		if before, err = parseTimeParam(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before: " + err.Error()})
+			return
+		}
+	}
+	if err := DB.Select("id").First(&models.Device{}, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	n, err := metricsStore.DeleteBefore(uint(id), before)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if before.IsZero() {
+		forgetLatestMetrics(uint(id))
+	}
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"device_id": id, "deleted_samples": n}})
+}
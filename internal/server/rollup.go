@@ -0,0 +1,290 @@
+package server
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm/clause"
+)
+
+// rollupBucket returns the UTC start of the bucket containing t.
+func rollupBucket(resolution string, t time.Time) time.Time {
+	t = t.UTC()
+	if resolution == models.RollupDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// stat accumulates avg / min / max of one metric.
+type stat struct{ sum, min, max float64 }
+
+func (s *stat) add(v float64, first bool) {
+	s.sum += v
+	if first {
+		s.min, s.max = v, v
+		return
+	}
+	s.min, s.max = math.Min(s.min, v), math.Max(s.max, v)
+}
+
+// rollupAcc accumulates samples for one rollup bucket.
+type rollupAcc struct {
+	n                                int
+	cpu, mem, disk, rx, tx, tcp, udp stat
+}
+
+func (a *rollupAcc) add(r MetricsRecord) {
+	first := a.n == 0
+	a.n++
+	a.cpu.add(r.CPUUsage, first)
+	a.mem.add(r.MemUsage, first)
+	a.disk.add(r.DiskUsage, first)
+	a.rx.add(float64(r.RxBytes), first)
+	a.tx.add(float64(r.TxBytes), first)
+	a.tcp.add(float64(r.TCPConnections), first)
+	a.udp.add(float64(r.UDPConnections), first)
+}
+
+func (a *rollupAcc) row(deviceID uint, resolution string, bucket time.Time) models.MetricsRollup {
+	return models.MetricsRollup{
+		DeviceID: deviceID, Resolution: resolution, BucketStart: bucket,
+		RollupStats: a.stats(),
+	}
+}
+
+func (a *rollupAcc) stats() models.RollupStats {
+	n := float64(a.n)
+	return models.RollupStats{
+		Samples: a.n,
+
+		CPUAvg: a.cpu.sum / n, CPUMin: a.cpu.min, CPUMax: a.cpu.max,
+		MemAvg: a.mem.sum / n, MemMin: a.mem.min, MemMax: a.mem.max,
+		DiskAvg: a.disk.sum / n, DiskMin: a.disk.min, DiskMax: a.disk.max,
+		RxAvg: a.rx.sum / n, RxMin: a.rx.min, RxMax: a.rx.max,
+		TxAvg: a.tx.sum / n, TxMin: a.tx.min, TxMax: a.tx.max,
+		TCPAvg: a.tcp.sum / n, TCPMin: a.tcp.min, TCPMax: a.tcp.max,
+		UDPAvg: a.udp.sum / n, UDPMin: a.udp.min, UDPMax: a.udp.max,
+	}
+}
+
+// rollupSet groups samples into hourly and daily buckets.
+type rollupSet map[string]map[time.Time]*rollupAcc
+
+func newRollupSet() rollupSet {
+	return rollupSet{models.RollupHour: {}, models.RollupDay: {}}
+}
+
+func (s rollupSet) add(r MetricsRecord) {
+	for res, buckets := range s {
+		b := rollupBucket(res, r.ReportedAt)
+		acc, ok := buckets[b]
+		if !ok {
+			acc = &rollupAcc{}
+			buckets[b] = acc
+		}
+		acc.add(r)
+	}
+}
+
+// rows returns the rollup rows of a device, oldest first.
+func (s rollupSet) rows(deviceID uint) []models.MetricsRollup {
+	var out []models.MetricsRollup
+	for res, buckets := range s {
+		for b, acc := range buckets {
+			out = append(out, acc.row(deviceID, res, b))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].BucketStart.Before(out[j].BucketStart) })
+	return out
+}
+
+// upsertRollups writes rollup rows, replacing existing rows of the same
+// bucket so that recomputing (or re-importing) a bucket is idempotent.
+func upsertRollups(rows []models.MetricsRollup) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}, {Name: "resolution"}, {Name: "bucket_start"}},
+		UpdateAll: true,
+	}).CreateInBatches(rows, 200).Error
+}
+
+// handleDeviceRollups returns a device's rollup rows
+// (?resolution=hour|day, default hour; optional ?from=&to=).
+func handleDeviceRollups(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	res := c.DefaultQuery("resolution", models.RollupHour)
+	if res != models.RollupHour && res != models.RollupDay {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resolution must be hour or day"})
+		return
+	}
+	q := DB.Where("device_id = ? AND resolution = ?", id, res)
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			t, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("bucket_start "+op+" ?", t)
+		}
+	}
+	list := []models.MetricsRollup{}
+	if err := q.Order("bucket_start").Limit(10000).Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// rollupInterval is how often RunRollups folds new raw samples in. It must
+// stay well under the time the raw samples are kept (maxSnapshotsPerDevice
+// reports). Samples younger than rollupLag wait for the next run, so ones
+// still being written are not skipped.
+const (
+	rollupInterval = time.Minute
+	rollupLag      = 10 * time.Second
+)
+
+// accFromStats turns a stored bucket back into an accumulator, so new
+// samples (or other buckets) can be merged into it.
+func accFromStats(s models.RollupStats) *rollupAcc {
+	n := float64(s.Samples)
+	st := func(avg, lo, hi float64) stat { return stat{sum: avg * n, min: lo, max: hi} }
+	return &rollupAcc{
+		n:    s.Samples,
+		cpu:  st(s.CPUAvg, s.CPUMin, s.CPUMax),
+		mem:  st(s.MemAvg, s.MemMin, s.MemMax),
+		disk: st(s.DiskAvg, s.DiskMin, s.DiskMax),
+		rx:   st(s.RxAvg, s.RxMin, s.RxMax),
+		tx:   st(s.TxAvg, s.TxMin, s.TxMax),
+		tcp:  st(s.TCPAvg, s.TCPMin, s.TCPMax),
+		udp:  st(s.UDPAvg, s.UDPMin, s.UDPMax),
+	}
+}
+
+// merge adds the samples of b to a.
+func (a *rollupAcc) merge(b *rollupAcc) {
+	if b.n == 0 {
+		return
+	}
+	if a.n == 0 {
+		*a = *b
+		return
+	}
+	for _, p := range []struct{ x, y *stat }{
+		{&a.cpu, &b.cpu}, {&a.mem, &b.mem}, {&a.disk, &b.disk}, {&a.rx, &b.rx},
+		{&a.tx, &b.tx}, {&a.tcp, &b.tcp}, {&a.udp, &b.udp},
+	} {
+		p.x.sum += p.y.sum
+		p.x.min, p.x.max = math.Min(p.x.min, p.y.min), math.Max(p.x.max, p.y.max)
+	}
+	a.n += b.n
+}
+
+// RunRollups keeps the hourly and daily rollups of every device up to date:
+// each minute the raw samples reported since the last run are folded into
+// their hourly rows, and the days those hours belong to are re-merged.
+func RunRollups() {
+	for {
+		if leads("rollups", 2*rollupInterval) {
+			ids, err := metricsStore.Devices()
+			if err != nil {
+				log.Printf("[rollup] list devices: %v", err)
+			}
+			for _, id := range ids {
+				if err := rollupDevice(id); err != nil {
+					log.Printf("[rollup] device %d: %v", id, err)
+				}
+			}
+		}
+		time.Sleep(rollupInterval)
+	}
+}
+
+// rollupDevice folds the samples of a device newer than its last folded one
+// into the hourly rows, then rebuilds the touched days.
+func rollupDevice(deviceID uint) error {
+	var through time.Time
+	var last models.MetricsRollup
+	if err := DB.Select("through").Where("device_id = ? AND resolution = ?", deviceID, models.RollupHour).
+		Order("through desc").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	if !last.Through.IsZero() {
+		through = last.Through.Add(time.Nanosecond)
+	}
+
+	hours := map[time.Time]*rollupAcc{}
+	var newest time.Time
+	err := metricsStore.QueryRange(deviceID, through, time.Now().Add(-rollupLag), func(batch []models.Metrics) error {
+		for i := range batch {
+			r := newMetricsRecord(&batch[i])
+			b := rollupBucket(models.RollupHour, r.ReportedAt)
+			if hours[b] == nil {
+				hours[b] = &rollupAcc{}
+			}
+			hours[b].add(r)
+			if r.ReportedAt.After(newest) {
+				newest = r.ReportedAt
+			}
+		}
+		return nil
+	})
+	if err != nil || len(hours) == 0 {
+		return err
+	}
+
+	rows := make([]models.MetricsRollup, 0, len(hours))
+	days := map[time.Time]bool{}
+	for b, acc := range hours {
+		var stored models.MetricsRollup
+		if err := DB.Where("device_id = ? AND resolution = ? AND bucket_start = ?", deviceID, models.RollupHour, b).
+			Limit(1).Find(&stored).Error; err != nil {
+			return err
+		}
+		merged := accFromStats(stored.RollupStats)
+		merged.merge(acc)
+		row := merged.row(deviceID, models.RollupHour, b)
+		row.Through = newest
+		rows = append(rows, row)
+		days[rollupBucket(models.RollupDay, b)] = true
+	}
+	if err := upsertRollups(rows); err != nil {
+		return err
+	}
+	return rebuildDays(deviceID, days)
+}
+
+// rebuildDays re-merges the daily rollups of a device's days from their
+// hourly rows.
+func rebuildDays(deviceID uint, days map[time.Time]bool) error {
+	var rows []models.MetricsRollup
+	for day := range days {
+		var hourRows []models.MetricsRollup
+		if err := DB.Where("device_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?",
+			deviceID, models.RollupHour, day, day.AddDate(0, 0, 1)).Find(&hourRows).Error; err != nil {
+			return err
+		}
+		acc := &rollupAcc{}
+		for i := range hourRows {
+			acc.merge(accFromStats(hourRows[i].RollupStats))
+		}
+		if acc.n > 0 {
+			rows = append(rows, acc.row(deviceID, models.RollupDay, day))
+		}
+	}
+	return upsertRollups(rows)
+}
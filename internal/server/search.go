@@ -0,0 +1,163 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Result counts of GET /api/search.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchFields are the device fields a search looks at, with their weight:
+// a name hit ranks above the same hit in the OS string.
+var searchFields = []struct {
+	name   string
+	weight float64
+	values func(d *models.Device) []string
+}{
+	{"hostname", 1, func(d *models.Device) []string { return []string{d.Hostname} }},
+	{"remark", 1, func(d *models.Device) []string { return []string{d.Remark} }},
+	{"ip", 0.9, func(d *models.Device) []string { return []string{d.IP} }},
+	{"tags", 0.8, func(d *models.Device) []string { return d.Tags }},
+	{"os", 0.5, func(d *models.Device) []string { return []string{d.OS} }},
+}
+
+// searchHit is a result of GET /api/search.
+type searchHit struct {
+	ID       uint     `json:"id"`
+	Name     string   `json:"name"`
+	Hostname string   `json:"hostname"`
+	Remark   string   `json:"remark,omitempty"`
+	IP       string   `json:"ip"`
+	OS       string   `json:"os,omitempty"`
+	Group    string   `json:"group"`
+	Tags     []string `json:"tags,omitempty"`
+	IsOnline bool     `json:"is_online"`
+	Score    float64  `json:"score"`
+	Matches  []string `json:"matches"` // the fields that matched
+}
+
+// matchScore rates how well term (lower case) matches s: 100 for the
+// whole value, 80 for a prefix, 60 for the start of a word, 40 anywhere
+// inside, up to 20 for a fuzzy match where the term's characters appear in
+// order (denser is better), 0 for none.
+func matchScore(term, s string) float64 {
+	s = strings.ToLower(s)
+	if s == "" {
+		return 0
+	}
+	switch i := strings.Index(s, term); {
+	case s == term:
+		return 100
+	case i == 0:
+		return 80
+	case i > 0 && strings.ContainsRune(" -_./:", rune(s[i-1])):
+		return 60
+	case i > 0:
+		return 40
+	}
+	first, last, j := -1, 0, 0
+	for i := 0; i < len(s) && j < len(term); i++ {
+		if s[i] == term[j] {
+			if first < 0 {
+				first = i
+			}
+			last = i
+			j++
+		}
+	}
+	if j < len(term) {
+		return 0
+	}
+	return 20 * float64(len(term)) / float64(last-first+1)
+}
+
+// scoreDevice rates d against the query terms; every term has to match
+// some field. It returns the score and the matching fields.
+func scoreDevice(d *models.Device, terms []string) (float64, []string) {
+	var total float64
+	var matched []string
+	for _, term := range terms {
+		best := 0.0
+		for _, f := range searchFields {
+			fieldBest := 0.0
+			for _, v := range f.values(d) {
+				fieldBest = max(fieldBest, matchScore(term, v)*f.weight)
+			}
+			if fieldBest > 0 && !slices.Contains(matched, f.name) {
+				matched = append(matched, f.name)
+			}
+			best = max(best, fieldBest)
+		}
+		if best == 0 {
+			return 0, nil
+		}
+		total += best
+	}
+	return total, matched
+}
+
+// handleSearch finds devices for a global search box:
+// GET /api/search?q=&limit=. The query's words are matched against
+// hostname, remark, IP, OS and tags — exactly, as prefix, substring or
+// fuzzily — and the devices matching all of them come back best first.
+func handleSearch(c *gin.Context) {
+	terms := strings.Fields(strings.ToLower(c.Query("q")))
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit: want 1 to " + strconv.Itoa(maxSearchLimit)})
+		return
+	}
+	q := DB.Model(&models.Device{}).Select("id", "hostname", "remark", "ip", "os", "group", "is_online")
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("id IN (?)", groupDeviceIDs(groups))
+	}
+	var devices []models.Device
+	if err := q.Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tags, err := deviceTagNames(nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	hits := []searchHit{}
+	for i := range devices {
+		d := &devices[i]
+		d.Tags = tags[d.ID]
+		score, matched := scoreDevice(d, terms)
+		if score == 0 {
+			continue
+		}
+		hits = append(hits, searchHit{
+			ID: d.ID, Name: deviceName(d), Hostname: d.Hostname, Remark: d.Remark, IP: d.IP, OS: d.OS,
+			Group: d.Group, Tags: d.Tags, IsOnline: d.IsOnline, Score: score, Matches: matched,
+		})
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	total := len(hits)
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"data": hits, "total": total})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// sensorHistoryWindow bounds how long temperature samples are kept per device.
+// 目前只用于抽屉中展示“最新温度”，无需长期保留。
+const sensorHistoryWindow = time.Hour
+
+// latestSensors caches the most recent temperature readings per device.
+var latestSensors sync.Map // map[uint][]models.SensorReading
+
+// latestGPUs caches the most recent GPU readings per device.
+var latestGPUs sync.Map // map[uint][]models.GPUReading
+
+// SaveSensorReadings persists one report's worth of temperature readings for a
+// device and prunes samples older than sensorHistoryWindow.
+func SaveSensorReadings(deviceID uint, readings []models.SensorReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range readings {
+		readings[i].ID = 0
+		readings[i].DeviceID = deviceID
+		readings[i].ReportedAt = now
+	}
+	if err := DB.Create(&readings).Error; err != nil {
+		return err
+	}
+	cached := make([]models.SensorReading, len(readings))
+	copy(cached, readings)
+	latestSensors.Store(deviceID, cached)
+
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-sensorHistoryWindow)).
+		Delete(&models.SensorReading{})
+	return nil
+}
+
+// GetLatestSensorReadings returns the readings from the most recent report of
+// a device, or an empty slice when the device never reported temperatures.
+func GetLatestSensorReadings(deviceID uint) []models.SensorReading {
+	if v, ok := latestSensors.Load(deviceID); ok {
+		if rs, ok2 := v.([]models.SensorReading); ok2 {
+			return rs
+		}
+	}
+	var last models.SensorReading
+	if err := DB.Where("device_id = ?", deviceID).Order("reported_at desc").First(&last).Error; err != nil {
+		return []models.SensorReading{}
+	}
+	var list []models.SensorReading
+	DB.Where("device_id = ? AND reported_at = ?", deviceID, last.ReportedAt).
+		Order("sensor_key").
+		Find(&list)
+	return list
+}
+
+// SaveGPUReadings persists one report's worth of GPU readings for a device and
+// prunes samples older than sensorHistoryWindow.
+func SaveGPUReadings(deviceID uint, readings []models.GPUReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range readings {
+		readings[i].ID = 0
+		readings[i].DeviceID = deviceID
+		readings[i].ReportedAt = now
+	}
+	if err := DB.Create(&readings).Error; err != nil {
+		return err
+	}
+	cached := make([]models.GPUReading, len(readings))
+	copy(cached, readings)
+	latestGPUs.Store(deviceID, cached)
+
+	DB.Where("device_id = ? AND reported_at < ?", deviceID, now.Add(-sensorHistoryWindow)).
+		Delete(&models.GPUReading{})
+	return nil
+}
+
+// GetLatestGPUReadings returns the GPU readings from the most recent report of
+// a device, or an empty slice for devices without a (enabled) GPU collector.
+func GetLatestGPUReadings(deviceID uint) []models.GPUReading {
+	if v, ok := latestGPUs.Load(deviceID); ok {
+		if rs, ok2 := v.([]models.GPUReading); ok2 {
+			return rs
+		}
+	}
+	var last models.GPUReading
+	if err := DB.Where("device_id = ?", deviceID).Order("reported_at desc").First(&last).Error; err != nil {
+		return []models.GPUReading{}
+	}
+	var list []models.GPUReading
+	DB.Where("device_id = ? AND reported_at = ?", deviceID, last.ReportedAt).
+		Order("`index`").
+		Find(&list)
+	return list
+}
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// sharedStore holds the short-lived state several server instances behind
+// one load balancer must agree on: the latest-metrics cache, jobs queued
+// for agents, revoked sessions and rate-limit counters, plus a pub/sub bus
+// for changes every instance must apply. The default keeps it in process;
+// with redis_url set it lives in Redis.
+type sharedStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, val []byte, ttl time.Duration)
+	// SetNX sets key only if it does not exist and reports whether it did.
+	SetNX(key string, val []byte, ttl time.Duration) bool
+	// Renew extends the expiry of key to ttl if it still holds val, and
+	// reports whether it did.
+	Renew(key string, val []byte, ttl time.Duration) bool
+	// Take returns and deletes the value of key.
+	Take(key string) ([]byte, bool)
+	// Delete deletes key.
+	Delete(key string)
+	// DeletePrefix deletes every key that starts with prefix.
+	DeletePrefix(prefix string)
+	// Incr increments the counter key and returns the new count; the
+	// counter starts over window after its first increment.
+	Incr(key string, window time.Duration) int64
+	// Publish sends msg to every instance's subscribers of topic,
+	// including this one's.
+	Publish(topic string, msg []byte)
+	Subscribe(topic string, fn func(msg []byte))
+}
+
+// shared is the active store; SetRedis replaces it.
+var shared sharedStore = newMemoryStore()
+
+// sharedPrefix namespaces the keys and channels in Redis.
+const sharedPrefix = "opentalon:"
+
+// Keys of the shared state.
+func latestMetricsKey(deviceID uint) string {
+	return "latest:" + strconv.FormatUint(uint64(deviceID), 10)
+}
+func speedTestKey(deviceID uint) string {
+	return "speedtest:" + strconv.FormatUint(uint64(deviceID), 10)
+}
+func tracerouteKey(deviceID uint) string {
+	return "traceroute:" + strconv.FormatUint(uint64(deviceID), 10)
+}
+func agentCancelKey(deviceID uint) string {
+	return "cancel:" + strconv.FormatUint(uint64(deviceID), 10)
+}
+
+// agentJobTTL bounds how long a job waits for its agent to report.
+const agentJobTTL = 24 * time.Hour
+
+// instanceID tells this process apart from other instances sharing the store.
+var instanceID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// leads reports whether this instance runs the background job that must run
+// on one instance only, e.g. evaluating offline alerts. The lease is held for
+// ttl and renewed by calling leads again within it; the renewal only
+// succeeds while the lease is still this instance's, so an instance whose
+// lease lapsed and was taken over cannot claim it back.
+func leads(job string, ttl time.Duration) bool {
+	key := "leader:" + job
+	return shared.SetNX(key, []byte(instanceID), ttl) || shared.Renew(key, []byte(instanceID), ttl)
+}
+
+// Pub/sub topics.
+const (
+	topicTasks      = "tasks"       // "stop" / "resume": the emergency stop
+	topicAlertRules = "alert_rules" // alert rules changed
+	topicPolicies   = "policies"    // authorization policies changed
+	topicChannels   = "channels"    // notification channels changed
+	topicEvents     = "events"      // an event was recorded (JSON models.Event)
+)
+
+// SubscribeShared applies the changes other instances publish (and this
+// one's). Call it once at startup, after SetRedis.
+func SubscribeShared() {
+	shared.Subscribe(topicTasks, func(msg []byte) {
+		switch string(msg) {
+		case "stop":
+			haltLocalTasks()
+		case "resume":
+			resumeLocalTasks()
+		}
+	})
+	shared.Subscribe(topicAlertRules, func([]byte) { ReloadAlertRules() })
+	shared.Subscribe(topicPolicies, func([]byte) { ReloadPolicies() })
+	shared.Subscribe(topicChannels, func([]byte) { ReloadChannels() })
+	shared.Subscribe(topicEvents, broadcastLiveEvent)
+	shared.Subscribe(topicEvents, streamEvent)
+}
+
+// latestMetricsTTL bounds how long a cached sample outlives its device's
+// last report.
+const latestMetricsTTL = 24 * time.Hour
+
+// cacheLatestMetrics stores the newest sample of a device.
+func cacheLatestMetrics(deviceID uint, m *models.Metrics) {
+	latestMetrics.Store(deviceID, m)
+	if _, local := shared.(*memoryStore); local {
+		return
+	}
+	if b, err := json.Marshal(m); err == nil {
+		shared.Set(latestMetricsKey(deviceID), b, latestMetricsTTL)
+	}
+}
+
+// cachedLatestMetrics returns the newest sample of a device from the cache.
+// With Redis, another instance may have received it.
+func cachedLatestMetrics(deviceID uint) (*models.Metrics, bool) {
+	if _, local := shared.(*memoryStore); !local {
+		if b, ok := shared.Get(latestMetricsKey(deviceID)); ok {
+			var m models.Metrics
+			if json.Unmarshal(b, &m) == nil {
+				return &m, true
+			}
+		}
+	}
+	if v, ok := latestMetrics.Load(deviceID); ok {
+		if m, ok := v.(*models.Metrics); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// ── In-process store ─────────────────────────────────────────────────────────
+
+type memoryEntry struct {
+	val     []byte
+	count   int64
+	expires time.Time // zero: never
+}
+
+type memoryStore struct {
+	mu     sync.Mutex
+	keys   map[string]*memoryEntry
+	topics map[string][]func([]byte)
+}
+
+// memorySweepInterval is how often the in-process store drops expired
+// keys nobody reads again, such as the login failures of a passing client.
+const memorySweepInterval = time.Minute
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{keys: map[string]*memoryEntry{}, topics: map[string][]func([]byte){}}
+	go func() {
+		for range time.Tick(memorySweepInterval) {
+			s.sweep(time.Now())
+		}
+	}()
+	return s
+}
+
+// sweep drops the keys expired at now.
+func (s *memoryStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.keys {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.keys, k)
+		}
+	}
+}
+
+// entryLocked returns the live entry of key, dropping it when expired.
+func (s *memoryStore) entryLocked(key string) *memoryEntry {
+	e, ok := s.keys[key]
+	if ok && !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(s.keys, key)
+		return nil
+	}
+	return e
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.entryLocked(key); e != nil {
+		return e.val, true
+	}
+	return nil, false
+}
+
+func (s *memoryStore) Set(key string, val []byte, ttl time.Duration) {
+	e := &memoryEntry{val: val}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	s.keys[key] = e
+	s.mu.Unlock()
+}
+
+func (s *memoryStore) SetNX(key string, val []byte, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entryLocked(key) != nil {
+		return false
+	}
+	e := &memoryEntry{val: val}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.keys[key] = e
+	return true
+}
+
+func (s *memoryStore) Renew(key string, val []byte, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entryLocked(key)
+	if e == nil || string(e.val) != string(val) {
+		return false
+	}
+	e.expires = time.Time{}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	return true
+}
+
+func (s *memoryStore) Take(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entryLocked(key)
+	if e == nil {
+		return nil, false
+	}
+	delete(s.keys, key)
+	return e.val, true
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+}
+
+func (s *memoryStore) DeletePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.keys {
+		if strings.HasPrefix(k, prefix) {
+			delete(s.keys, k)
+		}
+	}
+}
+
+func (s *memoryStore) Incr(key string, window time.Duration) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entryLocked(key)
+	if e == nil {
+		e = &memoryEntry{expires: time.Now().Add(window)}
+		s.keys[key] = e
+	}
+	e.count++
+	return e.count
+}
+
+func (s *memoryStore) Publish(topic string, msg []byte) {
+	s.mu.Lock()
+	fns := s.topics[topic]
+	s.mu.Unlock()
+	for _, fn := range fns {
+		fn(msg)
+	}
+}
+
+func (s *memoryStore) Subscribe(topic string, fn func([]byte)) {
+	s.mu.Lock()
+	s.topics[topic] = append(s.topics[topic], fn)
+	s.mu.Unlock()
+}
+
+// ── Redis ────────────────────────────────────────────────────────────────────
+
+// redisStore keeps the shared state in Redis. Errors are logged and read as
+// "not found": the state is best-effort, like the in-process maps it
+// replaces.
+type redisStore struct {
+	rdb *redis.Client
+}
+
+// SetRedis connects to url (redis://[:password@]host:6379/db) and makes it
+// the shared store, so several server instances sharing one database can
+// run behind a load balancer. It must be called before the server starts
+// handling requests.
+func SetRedis(url string) error {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("parsing redis_url: %w", err)
+	}
+	rdb := redis.NewClient(opt)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	shared = &redisStore{rdb: rdb}
+	return nil
+}
+
+// redisTimeout bounds a single shared-state operation.
+const redisTimeout = 2 * time.Second
+
+func (s *redisStore) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+func (s *redisStore) Get(key string) ([]byte, bool) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	b, err := s.rdb.Get(ctx, sharedPrefix+key).Bytes()
+	if err != nil && err != redis.Nil {
+		log.Printf("[redis] get %s: %v", key, err)
+	}
+	return b, err == nil
+}
+
+func (s *redisStore) Set(key string, val []byte, ttl time.Duration) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	if err := s.rdb.Set(ctx, sharedPrefix+key, val, ttl).Err(); err != nil {
+		log.Printf("[redis] set %s: %v", key, err)
+	}
+}
+
+func (s *redisStore) SetNX(key string, val []byte, ttl time.Duration) bool {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	ok, err := s.rdb.SetNX(ctx, sharedPrefix+key, val, ttl).Result()
+	if err != nil {
+		log.Printf("[redis] setnx %s: %v", key, err)
+	}
+	return ok
+}
+
+// renewScript extends a key's expiry only while it holds the caller's
+// value, in one step, so two instances cannot both renew a lease.
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+func (s *redisStore) Renew(key string, val []byte, ttl time.Duration) bool {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	n, err := renewScript.Run(ctx, s.rdb, []string{sharedPrefix + key}, val, ttl.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("[redis] renew %s: %v", key, err)
+	}
+	return n == 1
+}
+
+// Take reads and deletes the key in one MULTI rather than with GETDEL,
+// which needs Redis 6.2.
+func (s *redisStore) Take(key string) ([]byte, bool) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	pipe := s.rdb.TxPipeline()
+	get := pipe.Get(ctx, sharedPrefix+key)
+	pipe.Del(ctx, sharedPrefix+key)
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		log.Printf("[redis] take %s: %v", key, err)
+	}
+	b, err := get.Bytes()
+	return b, err == nil
+}
+
+func (s *redisStore) Delete(key string) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	if err := s.rdb.Del(ctx, sharedPrefix+key).Err(); err != nil {
+		log.Printf("[redis] delete %s: %v", key, err)
+	}
+}
+
+func (s *redisStore) DeletePrefix(prefix string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	iter := s.rdb.Scan(ctx, 0, sharedPrefix+prefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		s.rdb.Del(ctx, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("[redis] delete %s*: %v", prefix, err)
+	}
+}
+
+// Incr sets the expiry with a plain EXPIRE (EXPIRE NX needs Redis 7) on
+// the first increment, and on any later one that finds the counter without
+// an expiry, e.g. after a crash between the two commands.
+func (s *redisStore) Incr(key string, window time.Duration) int64 {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	pipe := s.rdb.TxPipeline()
+	n := pipe.Incr(ctx, sharedPrefix+key)
+	ttl := pipe.TTL(ctx, sharedPrefix+key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[redis] incr %s: %v", key, err)
+		return n.Val()
+	}
+	if n.Val() == 1 || ttl.Val() < 0 {
+		if err := s.rdb.Expire(ctx, sharedPrefix+key, window).Err(); err != nil {
+			log.Printf("[redis] expire %s: %v", key, err)
+		}
+	}
+	return n.Val()
+}
+
+func (s *redisStore) Publish(topic string, msg []byte) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	if err := s.rdb.Publish(ctx, sharedPrefix+topic, msg).Err(); err != nil {
+		log.Printf("[redis] publish %s: %v", topic, err)
+	}
+}
+
+// Subscribe delivers the topic's messages to fn until the process exits;
+// the client resubscribes by itself after a lost connection.
+func (s *redisStore) Subscribe(topic string, fn func([]byte)) {
+	sub := s.rdb.Subscribe(context.Background(), sharedPrefix+topic)
+	go func() {
+		for m := range sub.Channel() {
+			fn([]byte(m.Payload))
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	s := &memoryStore{keys: map[string]*memoryEntry{}, topics: map[string][]func([]byte){}}
+	s.Set("keep", []byte("x"), 0)
+	s.Set("session", []byte("x"), time.Hour)
+	s.Set("revoked:old", []byte("x"), time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if n := s.Incr("login_failures:10.0.0.1", time.Millisecond); n != int64(i+1) {
+			t.Fatalf("Incr = %d, want %d", n, i+1)
+		}
+	}
+
+	s.sweep(time.Now().Add(time.Second))
+	for key, want := range map[string]bool{
+		"keep": true, "session": true, "revoked:old": false, "login_failures:10.0.0.1": false,
+	} {
+		if _, ok := s.keys[key]; ok != want {
+			t.Errorf("%s kept = %v, want %v", key, ok, want)
+		}
+	}
+	// A counter starts over once its window has passed.
+	if n := s.Incr("login_failures:10.0.0.1", time.Minute); n != 1 {
+		t.Errorf("Incr after the window = %d, want 1", n)
+	}
+}
+
+func TestLeads(t *testing.T) {
+	prevShared, prevID := shared, instanceID
+	t.Cleanup(func() { shared, instanceID = prevShared, prevID })
+	shared = &memoryStore{keys: map[string]*memoryEntry{}, topics: map[string][]func([]byte){}}
+
+	as := func(id string) bool {
+		instanceID = id
+		return leads("job", 20*time.Millisecond)
+	}
+	steps := []struct {
+		instance string
+		sleep    time.Duration // before the call
+		want     bool
+	}{
+		{"a", 0, true},
+		{"b", 0, false},
+		{"a", 0, true}, // renews its lease
+		{"b", 30 * time.Millisecond, true},
+		// a's lease lapsed and b holds it now: a must not renew b's.
+		{"a", 0, false},
+		{"b", 0, true},
+	}
+	for i, st := range steps {
+		time.Sleep(st.sleep)
+		if got := as(st.instance); got != st.want {
+			t.Fatalf("step %d: leads as %s = %v, want %v", i, st.instance, got, st.want)
+		}
+	}
+}
+
+func TestForgetLatestMetrics(t *testing.T) {
+	prevShared := shared
+	t.Cleanup(func() { shared = prevShared })
+	shared = &memoryStore{keys: map[string]*memoryEntry{}, topics: map[string][]func([]byte){}}
+	for _, id := range []uint{1, 10, 11} {
+		shared.Set(latestMetricsKey(id), []byte("x"), time.Minute)
+	}
+
+	forgetLatestMetrics(1)
+	for id, want := range map[uint]bool{1: false, 10: true, 11: true} {
+		if _, ok := shared.Get(latestMetricsKey(id)); ok != want {
+			t.Errorf("device %d cached = %v, want %v", id, ok, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// ShutdownNotice mirrors agent.ShutdownNotice to avoid circular imports.
+type ShutdownNotice struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip" binding:"required"`
+	Kind     string `json:"kind" binding:"required,oneof=shutdown reboot"`
+	Source   string `json:"source"`
+	// MachineID picks the device when several share IP.
+	MachineID string `json:"machine_id"`
+}
+
+// handleShutdownNotice records an agent's announcement that its host is
+// going down on purpose (data-plane).
+func handleShutdownNotice(c *gin.Context) {
+	var n ShutdownNotice
+	if err := c.ShouldBindJSON(&n); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if n.Source == "" {
+		n.Source = "agent"
+	}
+	dev, ok := reportDevice(c, n.MachineID, n.IP)
+	if !ok {
+		return
+	}
+	if err := RecordPlannedShutdown(&dev, n); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// RecordPlannedShutdown marks the device as down on purpose, so it shows as
+// "shutdown" rather than "offline" until it reports again (SaveMetrics
+// clears the mark), and records a device_shutdown event.
+func RecordPlannedShutdown(dev *models.Device, n ShutdownNotice) error {
+	now := time.Now()
+	if err := DB.Model(dev).Updates(map[string]any{
+		"shutdown_at":   now,
+		"shutdown_kind": n.Kind,
+		"is_online":     false,
+	}).Error; err != nil {
+		return err
+	}
+	dev.ShutdownAt, dev.ShutdownKind, dev.IsOnline = &now, n.Kind, false
+	name := dev.Hostname
+	if dev.Remark != "" {
+		name = dev.Remark
+	}
+	verb := "is shutting down"
+	if n.Kind == "reboot" {
+		verb = "is rebooting"
+	}
+	RecordEvent(dev.ID, models.EventDeviceShutdown, fmt.Sprintf("%s %s (planned, announced by %s)", name, verb, n.Source),
+		map[string]any{"kind": n.Kind, "source": n.Source, "planned": true})
+	return nil
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// activeSilences returns the silences in effect at now.
+func activeSilences(now time.Time) []models.Silence {
+	var list []models.Silence
+	if err := DB.Where("starts_at <= ? AND ends_at > ?", now, now).Find(&list).Error; err != nil {
+		log.Printf("[alerts] load silences: %v", err)
+	}
+	return list
+}
+
+// silenceMatches reports whether s mutes the rule's alerts on dev.
+func silenceMatches(s *models.Silence, ruleID uint, dev *models.Device) bool {
+	return (s.DeviceID == nil || *s.DeviceID == dev.ID) &&
+		(s.Group == "" || s.Group == dev.Group) &&
+		(s.RuleID == nil || *s.RuleID == ruleID)
+}
+
+// silenced reports whether an active silence mutes the rule's alerts on dev.
+func silenced(ruleID uint, dev *models.Device, now time.Time) bool {
+	list := activeSilences(now)
+	for i := range list {
+		if silenceMatches(&list[i], ruleID, dev) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceSilences returns the silences of list that name dev or its group,
+// whether or not they are limited to a rule.
+func deviceSilences(list []models.Silence, dev *models.Device) []models.Silence {
+	var out []models.Silence
+	for _, s := range list {
+		if s.DeviceID == nil && s.Group == "" {
+			continue
+		}
+		if (s.DeviceID == nil || *s.DeviceID == dev.ID) && (s.Group == "" || s.Group == dev.Group) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// releaseSilencedAlerts notifies the alerts still firing whose silence has
+// ended, as if they fired now.
+func releaseSilencedAlerts(now time.Time) {
+	var alerts []models.Alert
+	if err := DB.Where("status = ? AND silenced = ?", models.AlertFiring, true).Find(&alerts).Error; err != nil || len(alerts) == 0 {
+		return
+	}
+	list := activeSilences(now)
+	for i := range alerts {
+		a := &alerts[i]
+		var dev models.Device
+		if DB.First(&dev, a.DeviceID).Error != nil {
+			continue
+		}
+		muted := false
+		for j := range list {
+			if silenceMatches(&list[j], a.RuleID, &dev) {
+				muted = true
+				break
+			}
+		}
+		if muted {
+			continue
+		}
+		// Another instance may have released it already.
+		res := DB.Model(a).Where("silenced = ?", true).Updates(map[string]any{"silenced": false, "notified_at": now})
+		if res.Error != nil || res.RowsAffected == 0 {
+			continue
+		}
+		log.Printf("[alerts] silence over, notifying %s", a.Message)
+		recordAlertEvent(a, models.AlertEventUnsilenced, "", a.Channel, a.Message+" (silence over)")
+		notifyAlert(a, "")
+	}
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// silenceInGroups reports whether a silence only mutes devices in groups;
+// one scoped by rule alone mutes every device.
+func silenceInGroups(s *models.Silence, groups map[string]bool) bool {
+	var ids []uint
+	if s.DeviceID != nil {
+		ids = []uint{*s.DeviceID}
+	}
+	return scopeInGroups(ids, s.Group, groups)
+}
+
+// handleListSilences lists the silences, latest ending first; ?active=true
+// keeps those in effect now. Roles limited to device groups see the
+// silences of their groups' devices.
+func handleListSilences(c *gin.Context) {
+	q := DB.Order("ends_at desc")
+	if c.Query("active") == "true" {
+		now := time.Now()
+		q = q.Where("starts_at <= ? AND ends_at > ?", now, now)
+	}
+	var list []models.Silence
+	if err := q.Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		list = slices.DeleteFunc(list, func(s models.Silence) bool { return !silenceInGroups(&s, groups) })
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// silenceBody is the create/update request; omitted fields are left alone
+// on update. rule names the rule instead of rule_id; duration (e.g. "2h")
+// sets ends_at from starts_at. 0 / "" clear device_id / rule_id.
+type silenceBody struct {
+	DeviceID *uint   `json:"device_id"`
+	Group    *string `json:"group"`
+	RuleID   *uint   `json:"rule_id"`
+	Rule     *string `json:"rule"`
+	StartsAt *string `json:"starts_at"` // RFC 3339 or unix seconds
+	EndsAt   *string `json:"ends_at"`
+	Duration *string `json:"duration"`
+	Comment  *string `json:"comment"`
+}
+
+func (b *silenceBody) apply(s *models.Silence) error {
+	if b.DeviceID != nil {
+		s.DeviceID = nil
+		if *b.DeviceID != 0 {
+			if err := DB.Select("id").First(&models.Device{}, *b.DeviceID).Error; err != nil {
+				return fmt.Errorf("device %d not found", *b.DeviceID)
+			}
+			s.DeviceID = b.DeviceID
+		}
+	}
+	if b.Group != nil {
+		s.Group = strings.TrimSpace(*b.Group)
+	}
+	if b.Rule != nil {
+		s.RuleID = nil
+		if name := strings.TrimSpace(*b.Rule); name != "" {
+			var r models.AlertRule
+			if err := DB.Where("name = ?", name).Take(&r).Error; err != nil {
+				return fmt.Errorf("alert rule %q not found", name)
+			}
+			s.RuleID = &r.ID
+		}
+	} else if b.RuleID != nil {
+		s.RuleID = nil
+		if *b.RuleID != 0 {
+			if err := DB.Select("id").First(&models.AlertRule{}, *b.RuleID).Error; err != nil {
+				return fmt.Errorf("alert rule %d not found", *b.RuleID)
+			}
+			s.RuleID = b.RuleID
+		}
+	}
+	if b.StartsAt != nil {
+		ts, err := parseTimeParam(*b.StartsAt)
+		if err != nil {
+			return fmt.Errorf("starts_at: %v", err)
+		}
+		s.StartsAt = ts
+	}
+	switch {
+	case b.Duration != nil:
+		d, err := time.ParseDuration(*b.Duration)
+		if err != nil {
+			return fmt.Errorf("duration: %v", err)
+		}
+		s.EndsAt = s.StartsAt.Add(d)
+	case b.EndsAt != nil:
+		ts, err := parseTimeParam(*b.EndsAt)
+		if err != nil {
+			return fmt.Errorf("ends_at: %v", err)
+		}
+		s.EndsAt = ts
+	}
+	if b.Comment != nil {
+		s.Comment = *b.Comment
+	}
+	switch {
+	case s.DeviceID == nil && s.Group == "" && s.RuleID == nil:
+		return fmt.Errorf("set device_id, group or rule")
+	case s.EndsAt.IsZero():
+		return fmt.Errorf("ends_at or duration is required")
+	case !s.EndsAt.After(s.StartsAt):
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// handleCreateSilence adds a silence, starting now unless starts_at says
+// otherwise.
+func handleCreateSilence(c *gin.Context) {
+	var body silenceBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s := models.Silence{CreatedBy: c.GetString("username"), StartsAt: time.Now()}
+	if err := body.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil && !silenceInGroups(&s, groups) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: the silence mutes devices outside your groups"})
+		return
+	}
+	if err := DB.Create(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": s})
+}
+
+// handleUpdateSilence updates the provided fields of a silence, e.g. to
+// extend it.
+func handleUpdateSilence(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	groups := deviceGroups(c)
+	var s models.Silence
+	if err := DB.First(&s, id).Error; err != nil || (groups != nil && !silenceInGroups(&s, groups)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "silence not found"})
+		return
+	}
+	var body silenceBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if groups != nil && !silenceInGroups(&s, groups) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: the silence mutes devices outside your groups"})
+		return
+	}
+	if err := DB.Select("*").Save(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": s})
+}
+
+// handleDeleteSilence removes a silence; alerts it muted that still fire
+// notify on the next alert engine run.
+func handleDeleteSilence(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		var s models.Silence
+		if err := DB.First(&s, id).Error; err != nil || !silenceInGroups(&s, groups) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "silence not found"})
+			return
+		}
+	}
+	if err := DB.Delete(&models.Silence{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
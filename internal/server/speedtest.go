@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+const (
+	// maxSpeedTestsPerDevice is how many speed test runs are kept per device.
+	maxSpeedTestsPerDevice = 20
+	// maxSpeedTestBytes caps one download stream from the data plane.
+	maxSpeedTestBytes = 1 << 30
+)
+
+// Public speed test endpoints, from speedtest_public_download_url /
+// speedtest_public_upload_url.
+var speedTestPublicDownload, speedTestPublicUpload string
+
+// SetSpeedTestPublicURLs stores the public speed test endpoints.
+func SetSpeedTestPublicURLs(download, upload string) {
+	speedTestPublicDownload, speedTestPublicUpload = download, upload
+}
+
+// SpeedTestRequest is handed to an agent in the metrics response. Empty URLs
+// mean the data plane's own /api/speedtest endpoints.
+type SpeedTestRequest struct {
+	Target      string `json:"target"`
+	DownloadURL string `json:"download_url,omitempty"`
+	UploadURL   string `json:"upload_url,omitempty"`
+	DurationSec int    `json:"duration_sec"`
+	Streams     int    `json:"streams"`
+}
+
+// TakeSpeedTestRequest returns (once) the speed test requested for a
+// device, or nil. Requests wait in the shared store (speedTestKey) for the
+// next metrics response.
+func TakeSpeedTestRequest(deviceID uint) *SpeedTestRequest {
+	b, ok := shared.Take(speedTestKey(deviceID))
+	if !ok {
+		return nil
+	}
+	var req SpeedTestRequest
+	if json.Unmarshal(b, &req) != nil {
+		return nil
+	}
+	return &req
+}
+
+// SpeedTestReport is the result posted by an agent (data-plane).
+type SpeedTestReport struct {
+	IP           string  `json:"ip"`
+	Target       string  `json:"target"`
+	URL          string  `json:"url"`
+	LatencyMs    float64 `json:"latency_ms"`
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	BytesDown    int64   `json:"bytes_down"`
+	BytesUp      int64   `json:"bytes_up"`
+	Streams      int     `json:"streams"`
+	DurationSec  int     `json:"duration_sec"`
+	Error        string  `json:"error"`
+	// MachineID picks the reporting device when several share IP.
+	MachineID string `json:"machine_id"`
+}
+
+// SaveSpeedTest stores a result and prunes old runs of the device.
+func SaveSpeedTest(deviceID uint, rep SpeedTestReport) (*models.SpeedTest, error) {
+	st := &models.SpeedTest{
+		DeviceID: deviceID, Target: rep.Target, URL: rep.URL,
+		LatencyMs: rep.LatencyMs, DownloadMbps: rep.DownloadMbps, UploadMbps: rep.UploadMbps,
+		BytesDown: rep.BytesDown, BytesUp: rep.BytesUp,
+		Streams: rep.Streams, DurationSec: rep.DurationSec, Error: rep.Error,
+	}
+	if err := DB.Create(st).Error; err != nil {
+		return nil, err
+	}
+	var keep models.SpeedTest
+	if err := DB.Select("id").Where("device_id = ?", deviceID).
+		Order("id desc").Offset(maxSpeedTestsPerDevice - 1).Limit(1).
+		Take(&keep).Error; err == nil {
+		DB.Where("device_id = ? AND id < ?", deviceID, keep.ID).Delete(&models.SpeedTest{})
+	}
+	return st, nil
+}
+
+// ── Data plane ───────────────────────────────────────────────────────────────
+
+// speedTestBlock is the random payload streamed by handleSpeedTestDownload,
+// random so compression on the path cannot inflate the result.
+var speedTestBlock = func() []byte {
+	b := make([]byte, 64<<10)
+	_, _ = rand.Read(b)
+	return b
+}()
+
+// handleSpeedTestDownload streams ?bytes= (capped at 1 GiB) bytes to an agent.
+func handleSpeedTestDownload(c *gin.Context) {
+	n, err := strconv.ParseInt(c.Query("bytes"), 10, 64)
+	if err != nil || n < 0 || n > maxSpeedTestBytes {
+		n = maxSpeedTestBytes
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", strconv.FormatInt(n, 10))
+	c.Status(http.StatusOK)
+	for n > 0 {
+		chunk := speedTestBlock
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := c.Writer.Write(chunk); err != nil {
+			return // agent closed the stream at the end of its window
+		}
+		n -= int64(len(chunk))
+	}
+}
+
+// handleSpeedTestUpload discards the request body and reports its size.
+func handleSpeedTestUpload(c *gin.Context) {
+	n, _ := io.Copy(io.Discard, c.Request.Body)
+	c.JSON(http.StatusOK, gin.H{"bytes": n})
+}
+
+// handleSpeedTestReport receives a speed test result from an agent.
+func handleSpeedTestReport(c *gin.Context) {
+	var rep SpeedTestReport
+	if err := c.ShouldBindJSON(&rep); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dev, ok := reportDevice(c, rep.MachineID, rep.IP)
+	if !ok {
+		return
+	}
+	finishAgentTask(TaskSpeedTest, dev.ID)
+	if _, err := SaveSpeedTest(dev.ID, rep); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// ── Control plane ────────────────────────────────────────────────────────────
+
+// handleRequestSpeedTest queues a speed test for a device's agent:
+// {"target": "server" | "public", "duration_sec": 10, "streams": 4}. The
+// agent picks it up with its next metrics report and the result appears in
+// GET /devices/:id/speedtest.
+func handleRequestSpeedTest(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		Target      string `json:"target"`
+		DurationSec int    `json:"duration_sec"`
+		Streams     int    `json:"streams"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	req := &SpeedTestRequest{
+		Target:      body.Target,
+		DurationSec: min(max(body.DurationSec, 0), 60),
+		Streams:     min(max(body.Streams, 0), 16),
+	}
+	if req.DurationSec == 0 {
+		req.DurationSec = 10
+	}
+	if req.Streams == 0 {
+		req.Streams = 4
+	}
+	switch req.Target {
+	case "", models.SpeedTestServer:
+		req.Target = models.SpeedTestServer
+	case models.SpeedTestPublic:
+		if speedTestPublicDownload == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "speedtest_public_download_url is not configured"})
+			return
+		}
+		req.DownloadURL, req.UploadURL = speedTestPublicDownload, speedTestPublicUpload
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": `target must be "server" or "public"`})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if dev.AgentVer == "discovered" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device has no agent"})
+		return
+	}
+	if TasksHalted() {
+		c.JSON(http.StatusConflict, gin.H{"error": errTasksHalted.Error()})
+		return
+	}
+	b, _ := json.Marshal(req)
+	shared.Set(speedTestKey(dev.ID), b, agentJobTTL)
+	c.JSON(http.StatusAccepted, gin.H{"queued": true, "data": req})
+}
+
+// handleDeviceSpeedTests returns the most recent speed tests of a device,
+// newest first, and whether a requested run is still pending.
+func handleDeviceSpeedTests(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	list := []models.SpeedTest{}
+	if err := DB.Where("device_id = ?", id).Order("id desc").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, pending := shared.Get(speedTestKey(uint(id)))
+	c.JSON(http.StatusOK, gin.H{"data": list, "pending": pending})
+}
@@ -5,17 +5,52 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
 )
 
+// sshUser / sshKeyPath are the default credentials used when the server itself
+// initiates SSH sessions (e.g. remediation playbooks). Set from config at startup.
+var sshUser, sshKeyPath string
+
+// SetSSHDefaults stores the default SSH user and private key path.
+func SetSSHDefaults(user, keyPath string) {
+	sshUser = user
+	sshKeyPath = keyPath
+}
+
+// DialDeviceSSH opens an SSH session to host using the configured default
+// user and key (ssh_user / ssh_key_path).
+func DialDeviceSSH(host string) (*SSHClient, error) {
+	path := sshKeyPath
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SSH key %s: %w", path, err)
+	}
+	return NewSSHClient(host, sshUser, "", string(keyPEM))
+}
+
 // SSHClient wraps an authenticated SSH connection.
 type SSHClient struct {
 	client *ssh.Client
 	host   string
+	// ctx carries the span commands are traced under (nil: new traces).
+	ctx context.Context
 }
 
 // NewSSHClient dials the target host with password or key authentication.
@@ -56,16 +91,59 @@ func (s *SSHClient) Close() error { return s.client.Close() }
 
 // Run executes a command and returns combined stdout+stderr.
 func (s *SSHClient) Run(cmd string) (string, error) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := telemetry.Start(ctx, "ssh.run", attribute.String("ssh.host", s.host))
+	sess, err := s.client.NewSession()
+	if err != nil {
+		telemetry.End(span, err)
+		return "", fmt.Errorf("new session: %w", err)
+	}
+	defer sess.Close()
+	defer s.killOnCancel(sess)()
+
+	out, err := sess.CombinedOutput(cmd)
+	telemetry.End(span, err)
+	return string(out), err
+}
+
+// RunWithInput executes a command with stdin read from in, e.g. to upload a
+// file through `cat > path`, and returns combined stdout+stderr.
+func (s *SSHClient) RunWithInput(cmd string, in io.Reader) (string, error) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := telemetry.Start(ctx, "ssh.run", attribute.String("ssh.host", s.host))
 	sess, err := s.client.NewSession()
 	if err != nil {
+		telemetry.End(span, err)
 		return "", fmt.Errorf("new session: %w", err)
 	}
 	defer sess.Close()
+	defer s.killOnCancel(sess)()
 
+	sess.Stdin = in
 	out, err := sess.CombinedOutput(cmd)
+	telemetry.End(span, err)
 	return string(out), err
 }
 
+// killOnCancel kills the remote command of sess and drops the connection
+// when s.ctx is cancelled (see tasks.go). Servers that ignore the signal
+// still see the session end. The returned func stops watching.
+func (s *SSHClient) killOnCancel(sess *ssh.Session) func() bool {
+	if s.ctx == nil {
+		return func() bool { return false }
+	}
+	return context.AfterFunc(s.ctx, func() {
+		_ = sess.Signal(ssh.SIGKILL)
+		s.client.Close()
+	})
+}
+
 // ── Specific Task Stubs ───────────────────────────────────────────────────────
 
 // FixRPFilter sets rp_filter=0 for tun and enp6s18 on a RockyLinux bypass-router.
@@ -93,16 +171,24 @@ EOF'`,
 	return nil
 }
 
-// UpdateFNOSScript downloads and applies the latest fnos_fix script.
+// fnosFixScriptURL is where UpdateFNOSScript fetches the fix script from.
+const fnosFixScriptURL = "https://raw.githubusercontent.com/vesaa/opentalon/main/scripts/fnos_fix.sh"
+
+// UpdateFNOSScript downloads and applies the latest fnos_fix script. The
+// download goes through the proxy that proxy_rules pick for it, if any.
 // NOTE: V5.0 (old FNOS) is explicitly excluded — the fix script breaks on it.
 //
 // Target: FNOS (Debian-based NAS OS) >= V6.0.
 func (s *SSHClient) UpdateFNOSScript() error {
+	curl := "curl"
+	if env := proxy.Env(proxy.Download, fnosFixScriptURL); env != "" {
+		curl = env + " curl"
+	}
 	cmds := []string{
 		// Guard: abort on FNOS V5.0
 		`bash -c 'v=$(cat /etc/fnos-release 2>/dev/null | grep VERSION_ID | cut -d= -f2 | tr -d "\""); if [[ "$v" == 5.* ]]; then echo "SKIP: fnos_fix incompatible with V5.0" ; exit 1; fi'`,
 		// Download latest fix script
-		`curl -fsSL https://raw.githubusercontent.com/vesaa/opentalon/main/scripts/fnos_fix.sh -o /tmp/fnos_fix.sh`,
+		curl + " -fsSL " + fnosFixScriptURL + " -o /tmp/fnos_fix.sh",
 		`chmod +x /tmp/fnos_fix.sh`,
 		`bash /tmp/fnos_fix.sh`,
 	}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// A static export is a read-only snapshot of the lab's status for a static
+// host (GitHub Pages, an S3 bucket, …): summary.json, tree.json,
+// uptime.json and an index.html rendering them. Nodes carry names, groups
+// and status only, no addresses, so the snapshot can be shared without
+// exposing the network or the live server.
+
+// staticSummary is summary.json.
+type staticSummary struct {
+	GeneratedAt  time.Time       `json:"generated_at"`
+	Devices      int             `json:"devices"`
+	Online       int             `json:"online"`
+	Offline      int             `json:"offline"`
+	FiringAlerts int             `json:"firing_alerts"`
+	Groups       []*groupMetrics `json:"groups"`
+}
+
+// staticNode is a node of tree.json.
+type staticNode struct {
+	Name        string             `json:"name"`
+	Kind        string             `json:"kind,omitempty"`
+	OS          string             `json:"os,omitempty"`
+	Group       string             `json:"group,omitempty"`
+	NetworkMode models.NetworkMode `json:"network_mode,omitempty"`
+	Status      string             `json:"status"`
+	Children    []*staticNode      `json:"children,omitempty"`
+}
+
+// DeviceUptime is a device's availability over a period, derived from its
+// device_offline / device_online events.
+type DeviceUptime struct {
+	DeviceID  uint    `json:"device_id"`
+	Name      string  `json:"name"`
+	Group     string  `json:"group"`
+	UptimePct float64 `json:"uptime_pct"`
+	Downtime  int64   `json:"downtime_seconds"`
+	Outages   int     `json:"outages"`
+	Online    bool    `json:"online"`
+}
+
+// staticUptime is uptime.json.
+type staticUptime struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Devices []DeviceUptime `json:"devices"`
+}
+
+// UptimeReport computes the availability of every agent-managed device
+// between since and now. A device counts from its registration if that is
+// later; planned shutdowns are not outages since they record no
+// device_offline event.
+func UptimeReport(since, now time.Time) ([]DeviceUptime, error) {
+	var devices []models.Device
+	if err := DB.Where("agent_ver <> ?", "discovered").Order("id").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	types := []string{models.EventDeviceOffline, models.EventDeviceOnline}
+	var events []models.Event
+	if err := DB.Where("type IN ? AND device_id IS NOT NULL AND created_at < ?", types, now).
+		Order("created_at").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	byDevice := map[uint][]models.Event{}
+	for _, ev := range events {
+		byDevice[*ev.DeviceID] = append(byDevice[*ev.DeviceID], ev)
+	}
+
+	out := make([]DeviceUptime, 0, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		from := since
+		if d.CreatedAt.After(from) {
+			from = d.CreatedAt
+		}
+		u := DeviceUptime{DeviceID: d.ID, Name: deviceName(d), Group: d.Group, UptimePct: 100, Online: d.IsOnline}
+		if !from.Before(now) {
+			out = append(out, u)
+			continue
+		}
+		var down time.Duration
+		var downSince *time.Time
+		for _, ev := range byDevice[d.ID] {
+			at := ev.CreatedAt
+			if ev.Type == models.EventDeviceOffline {
+				if downSince == nil {
+					downSince = &at
+					if !at.Before(from) {
+						u.Outages++
+					}
+				}
+				continue
+			}
+			if downSince != nil {
+				start := *downSince
+				if start.Before(from) {
+					start = from
+				}
+				if at.After(start) {
+					down += at.Sub(start)
+				}
+				downSince = nil
+			}
+		}
+		if downSince != nil {
+			start := *downSince
+			if start.Before(from) {
+				start = from
+			}
+			down += now.Sub(start)
+		}
+		total := now.Sub(from)
+		u.Downtime = int64(down.Seconds())
+		u.UptimePct = 100 * float64(total-down) / float64(total)
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// ExportStatic writes a static snapshot of the dashboard summary, the
+// device tree and the uptime report of the last days into dir.
+func ExportStatic(dir string, days int) error {
+	now := time.Now()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tree, err := GetDeviceTree()
+	if err != nil {
+		return fmt.Errorf("device tree: %w", err)
+	}
+	nodes := staticTree(tree)
+
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		return err
+	}
+	summary := staticSummary{GeneratedAt: now, Devices: len(devices), Groups: aggregateGroups(devices)}
+	for _, g := range summary.Groups {
+		summary.Online += g.Online
+		summary.Offline += g.Offline
+	}
+	var firing int64
+	if err := DB.Model(&models.Alert{}).Where("status = ?", models.AlertFiring).Count(&firing).Error; err != nil {
+		return err
+	}
+	summary.FiringAlerts = int(firing)
+
+	uptime := staticUptime{From: now.AddDate(0, 0, -days), To: now}
+	if uptime.Devices, err = UptimeReport(uptime.From, now); err != nil {
+		return fmt.Errorf("uptime report: %w", err)
+	}
+	sort.SliceStable(uptime.Devices, func(i, j int) bool { return uptime.Devices[i].UptimePct < uptime.Devices[j].UptimePct })
+
+	for name, v := range map[string]any{"summary.json": summary, "tree.json": nodes, "uptime.json": uptime} {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return staticPageTmpl.Execute(f, map[string]any{"Summary": summary, "Tree": nodes, "Uptime": uptime, "Days": days})
+}
+
+// staticTree strips a device tree down to what a public snapshot shows.
+func staticTree(tree []*models.DeviceTree) []*staticNode {
+	out := make([]*staticNode, 0, len(tree))
+	for _, n := range tree {
+		if n.Kind == "namespace" || n.Kind == "site" {
+			out = append(out, staticTree(n.Children)...)
+			continue
+		}
+		name := n.Remark
+		if name == "" {
+			name = n.Hostname
+		}
+		out = append(out, &staticNode{
+			Name: name, Kind: n.Kind, OS: n.OS, Group: n.Group, NetworkMode: n.NetworkMode,
+			Status: n.Status, Children: staticTree(n.Children),
+		})
+	}
+	return out
+}
+
+var staticPageTmpl = template.Must(template.New("static").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04") },
+	"pct":  func(f float64) string { return fmt.Sprintf("%.2f%%", f) },
+	"dur":  func(s int64) string { return (time.Duration(s) * time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>OpenTalon status</title>
+<style>
+body{font-family:sans-serif;font-size:14px;margin:2em;color:#222}
+table{border-collapse:collapse}td,th{border:1px solid #ddd;padding:4px 8px;text-align:left}
+ul{list-style:none;padding-left:1.2em}.online{color:#2e7d32}.offline,.flapping{color:#c62828}.shutdown,.unknown{color:#888}
+</style></head><body>
+<h1>OpenTalon status</h1>
+<p>Snapshot of {{time .Summary.GeneratedAt}} · {{.Summary.Devices}} devices, {{.Summary.Online}} online, {{.Summary.Offline}} offline, {{.Summary.FiringAlerts}} firing alerts</p>
+<h2>Groups</h2>
+<table><tr><th>Group</th><th>Devices</th><th>Online</th><th>Offline</th><th>CPU</th><th>Memory</th><th>Disk</th><th>Rx</th><th>Tx</th></tr>
+{{range .Summary.Groups}}<tr><td>{{.Group}}</td><td>{{.Devices}}</td><td>{{.Online}}</td><td>{{.Offline}}</td><td>{{pct .CPUAvg}}</td><td>{{pct .MemAvg}}</td><td>{{pct .DiskAvg}}</td><td>{{.RxBytes}} B/s</td><td>{{.TxBytes}} B/s</td></tr>
+{{end}}</table>
+<h2>Uptime, last {{.Days}} days</h2>
+<table><tr><th>Device</th><th>Group</th><th>Uptime</th><th>Downtime</th><th>Outages</th></tr>
+{{range .Uptime.Devices}}<tr><td>{{.Name}}</td><td>{{.Group}}</td><td>{{pct .UptimePct}}</td><td>{{dur .Downtime}}</td><td>{{.Outages}}</td></tr>
+{{end}}</table>
+<h2>Topology</h2>
+{{define "nodes"}}<ul>{{range .}}<li><span class="{{.Status}}">●</span> {{.Name}}{{if .Kind}} ({{.Kind}}){{else if .OS}} · {{.OS}}{{end}}{{if .Children}}{{template "nodes" .Children}}{{end}}</li>{{end}}</ul>{{end}}
+{{template "nodes" .Tree}}
+<p style="color:#888">Also available as <a href="summary.json">summary.json</a>, <a href="tree.json">tree.json</a> and <a href="uptime.json">uptime.json</a>.</p>
+</body></html>
+`))
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// severityLevel orders the alert severities for min_severity.
+var severityLevel = map[string]int{models.SeverityInfo: 1, models.SeverityWarning: 2, models.SeverityCritical: 3}
+
+// subscriptionMatches reports whether s asks for an alert of severity on
+// dev.
+func subscriptionMatches(s *models.Subscription, dev *models.Device, severity string) bool {
+	return (s.DeviceID == nil || *s.DeviceID == dev.ID) &&
+		(s.Group == "" || s.Group == dev.Group) &&
+		severityLevel[severity] >= severityLevel[s.MinSeverity]
+}
+
+// userSeesDevice reports whether username may read dev: subscriptions do
+// not widen what a user's policies show.
+func userSeesDevice(username string, dev *models.Device) bool {
+	role := models.RoleAdmin
+	if username != adminUser {
+		acct, ok := accounts[username]
+		if !ok {
+			return false
+		}
+		role = acct.role
+	}
+	groups, ok := authorize(role, http.MethodGet, "/api/devices")
+	return ok && (groups == nil || groups[dev.Group])
+}
+
+// subscribedTargets applies the subscriptions to the channels an alert on
+// dev goes to. When the rule names no channel (targets is every channel),
+// channels with subscriptions keep it only if one matches; channels with a
+// matching subscription receive it in any case.
+func subscribedTargets(targets map[string]notifier, ruleChannel string, dev *models.Device, severity string) map[string]notifier {
+	var list []models.Subscription
+	if err := DB.Find(&list).Error; err != nil {
+		log.Printf("[notify] load subscriptions: %v", err)
+		return targets
+	}
+	if len(list) == 0 {
+		return targets
+	}
+	subscribed, matched := map[string]bool{}, map[string]bool{}
+	for i := range list {
+		s := &list[i]
+		subscribed[s.Channel] = true
+		if dev != nil && !matched[s.Channel] && subscriptionMatches(s, dev, severity) && userSeesDevice(s.Username, dev) {
+			matched[s.Channel] = true
+		}
+	}
+	out := map[string]notifier{}
+	for name, target := range targets {
+		if ruleChannel != "" || !subscribed[name] || matched[name] {
+			out[name] = target
+		}
+	}
+	for name := range matched {
+		if out[name] == nil {
+			for n, target := range channelsByName(name) {
+				out[n] = target
+			}
+		}
+	}
+	return out
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleListSubscriptions lists the caller's subscriptions; ?all=true lists
+// everyone's for the admin.
+func handleListSubscriptions(c *gin.Context) {
+	q := DB.Order("id")
+	if c.Query("all") != "true" || c.GetString("role") != models.RoleAdmin {
+		q = q.Where("username = ?", c.GetString("username"))
+	}
+	var list []models.Subscription
+	if err := q.Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// subscriptionBody is the create/update request; omitted fields are left
+// alone on update. 0 / "" clear device_id / min_severity.
+type subscriptionBody struct {
+	Channel     *string `json:"channel"`
+	DeviceID    *uint   `json:"device_id"`
+	Group       *string `json:"group"`
+	MinSeverity *string `json:"min_severity"`
+}
+
+func (b *subscriptionBody) apply(s *models.Subscription) error {
+	if b.Channel != nil {
+		s.Channel = strings.TrimSpace(*b.Channel)
+	}
+	if s.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if len(channelsByName(s.Channel)) == 0 {
+		return fmt.Errorf("channel %q not found", s.Channel)
+	}
+	if b.DeviceID != nil {
+		s.DeviceID = nil
+		if *b.DeviceID != 0 {
+			if err := DB.Select("id").First(&models.Device{}, *b.DeviceID).Error; err != nil {
+				return fmt.Errorf("device %d not found", *b.DeviceID)
+			}
+			s.DeviceID = b.DeviceID
+		}
+	}
+	if b.Group != nil {
+		s.Group = strings.TrimSpace(*b.Group)
+	}
+	if b.MinSeverity != nil {
+		s.MinSeverity = strings.TrimSpace(*b.MinSeverity)
+		if s.MinSeverity != "" && severityLevel[s.MinSeverity] == 0 {
+			return fmt.Errorf("invalid min_severity %q (use info, warning or critical)", s.MinSeverity)
+		}
+	}
+	return nil
+}
+
+// handleCreateSubscription subscribes the caller.
+func handleCreateSubscription(c *gin.Context) {
+	var body subscriptionBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s := models.Subscription{Username: c.GetString("username")}
+	if err := body.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": s})
+}
+
+// ownSubscription loads the subscription :id of the caller (any, for the
+// admin).
+func ownSubscription(c *gin.Context) (*models.Subscription, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var s models.Subscription
+	if err := DB.First(&s, id).Error; err != nil ||
+		(s.Username != c.GetString("username") && c.GetString("role") != models.RoleAdmin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return nil, false
+	}
+	return &s, true
+}
+
+// handleUpdateSubscription updates the provided fields of a subscription.
+func handleUpdateSubscription(c *gin.Context) {
+	s, ok := ownSubscription(c)
+	if !ok {
+		return
+	}
+	var body subscriptionBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.apply(s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": s})
+}
+
+// handleDeleteSubscription removes a subscription.
+func handleDeleteSubscription(c *gin.Context) {
+	s, ok := ownSubscription(c)
+	if !ok {
+		return
+	}
+	if err := DB.Delete(s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": s.ID})
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"gorm.io/gorm"
+)
+
+// tagNameRe is what a tag name may look like: no spaces or commas, so tags
+// can be listed in query strings (?tag=critical,proxmox) and rule specs.
+var tagNameRe = regexp.MustCompile(`^[\p{L}\p{N}_.:/-]{1,64}$`)
+
+// deviceTagNames returns the tag names of the given devices (nil: of every
+// device), sorted.
+func deviceTagNames(ids []uint) (map[uint][]string, error) {
+	var rows []struct {
+		DeviceID uint
+		Name     string
+	}
+	q := DB.Table("device_tags").Select("device_tags.device_id, tags.name").
+		Joins("JOIN tags ON tags.id = device_tags.tag_id")
+	if ids != nil {
+		q = q.Where("device_tags.device_id IN ?", ids)
+	}
+	if err := q.Order("tags.name").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := map[uint][]string{}
+	for _, r := range rows {
+		out[r.DeviceID] = append(out[r.DeviceID], r.Name)
+	}
+	return out, nil
+}
+
+// fillDeviceTags sets the Tags of devices.
+func fillDeviceTags(devices []models.Device) error {
+	ids := make([]uint, len(devices))
+	for i := range devices {
+		ids[i] = devices[i].ID
+	}
+	tags, err := deviceTagNames(ids)
+	if err != nil {
+		return err
+	}
+	for i := range devices {
+		devices[i].Tags = tags[devices[i].ID]
+	}
+	return nil
+}
+
+// taggedDeviceIDs is a subquery selecting the IDs of the devices that carry
+// the tag name.
+func taggedDeviceIDs(name string) *gorm.DB {
+	return DB.Model(&models.DeviceTag{}).Select("device_id").
+		Where("tag_id IN (?)", DB.Model(&models.Tag{}).Select("id").Where("name = ?", name))
+}
+
+// ensureTags returns the tags named names, creating the missing ones.
+func ensureTags(names []string) ([]models.Tag, error) {
+	tags := make([]models.Tag, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !tagNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid tag name %q (letters, digits and _ . : / - only)", name)
+		}
+		t := models.Tag{Name: name}
+		if err := DB.Where(models.Tag{Name: name}).FirstOrCreate(&t).Error; err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// tagsChanged refreshes what depends on tag assignments (tag-scoped alert
+// rules).
+func tagsChanged() {
+	shared.Publish(topicAlertRules, nil)
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// tagView is a tag with the number of devices carrying it (within the
+// groups the request may see).
+type tagView struct {
+	models.Tag
+	Devices int64 `json:"devices"`
+}
+
+// handleListTags returns all tags with their device counts.
+func handleListTags(c *gin.Context) {
+	var tags []models.Tag
+	if err := DB.Order("name").Find(&tags).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	q := DB.Model(&models.DeviceTag{}).Select("tag_id, COUNT(*) AS n").Group("tag_id")
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	var counts []struct {
+		TagID uint
+		N     int64
+	}
+	if err := q.Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	n := make(map[uint]int64, len(counts))
+	for _, r := range counts {
+		n[r.TagID] = r.N
+	}
+	views := make([]tagView, len(tags))
+	for i, t := range tags {
+		views[i] = tagView{Tag: t, Devices: n[t.ID]}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": views})
+}
+
+// tagBody is the create / update body for a tag.
+type tagBody struct {
+	Name  *string `json:"name"`
+	Color *string `json:"color"`
+}
+
+// apply copies the provided fields onto t and validates the result.
+func (b *tagBody) apply(t *models.Tag) error {
+	if b.Name != nil {
+		t.Name = strings.TrimSpace(*b.Name)
+	}
+	if b.Color != nil {
+		t.Color = strings.TrimSpace(*b.Color)
+	}
+	if !tagNameRe.MatchString(t.Name) {
+		return fmt.Errorf("invalid tag name %q (letters, digits and _ . : / - only)", t.Name)
+	}
+	return nil
+}
+
+// handleCreateTag creates a tag.
+func handleCreateTag(c *gin.Context) {
+	var body tagBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var t models.Tag
+	if err := body.apply(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&t).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": t})
+}
+
+// handleUpdateTag renames or recolors a tag. Alert rules scoped to the old
+// name follow the rename.
+func handleUpdateTag(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var t models.Tag
+	if err := DB.First(&t, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+		return
+	}
+	var body tagBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	old := t.Name
+	if err := body.apply(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := DB.Select("*").Save(&t).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if t.Name != old {
+		DB.Model(&models.AlertRule{}).Where("tag = ?", old).Update("tag", t.Name)
+		tagsChanged()
+	}
+	c.JSON(http.StatusOK, gin.H{"data": t})
+}
+
+// handleDeleteTag removes a tag from every device and deletes it.
+func handleDeleteTag(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := DB.Delete(&models.Tag{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	DB.Where("tag_id = ?", id).Delete(&models.DeviceTag{})
+	tagsChanged()
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleDeviceTags returns the tags of a device.
+func handleDeviceTags(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var tags []models.Tag
+	err = DB.Where("id IN (?)", DB.Model(&models.DeviceTag{}).Select("tag_id").Where("device_id = ?", id)).
+		Order("name").Find(&tags).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": tags})
+}
+
+// handleTagDevice changes the tags of a device: POST adds {"tags": [...]},
+// PUT replaces them with it. Unknown tag names are created.
+func handleTagDevice(replace bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := DB.Select("id").First(&models.Device{}, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+			return
+		}
+		tags, err := ensureTags(body.Tags)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if replace {
+				if err := tx.Where("device_id = ?", id).Delete(&models.DeviceTag{}).Error; err != nil {
+					return err
+				}
+			}
+			for _, t := range tags {
+				if err := tx.Where(models.DeviceTag{DeviceID: uint(id), TagID: t.ID}).
+					FirstOrCreate(&models.DeviceTag{}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tagsChanged()
+		names, err := deviceTagNames([]uint{uint(id)})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list := names[uint(id)]
+		if list == nil {
+			list = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"data": gin.H{"device_id": id, "tags": list}})
+	}
+}
+
+// handleUntagDevice removes one tag (by name) from a device.
+func handleUntagDevice(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	err = DB.Where("device_id = ? AND tag_id IN (?)", id,
+		DB.Model(&models.Tag{}).Select("id").Where("name = ?", c.Param("tag"))).
+		Delete(&models.DeviceTag{}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tagsChanged()
+	c.JSON(http.StatusOK, gin.H{"deleted": c.Param("tag")})
+}
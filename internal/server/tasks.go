@@ -0,0 +1,277 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// Task kinds listed by GET /api/tasks/running.
+const (
+	TaskPlaybook   = "playbook"   // SSH playbook (remediation hooks)
+	TaskInstall    = "install"    // agent install over SSH
+	TaskSpeedTest  = "speedtest"  // speed test handed to an agent
+	TaskTraceroute = "traceroute" // traceroute handed to an agent
+)
+
+// Task is an in-flight remote execution: an SSH session the server drives,
+// or a job handed to an agent that has not reported back yet.
+type Task struct {
+	ID        uint64    `json:"id"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	DeviceID  uint      `json:"device_id,omitempty"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+	// DurationSec is how long the task has been running.
+	DurationSec float64 `json:"duration_sec"`
+
+	cancel func()
+}
+
+// errTasksHalted is returned for tasks started while the emergency stop
+// is on.
+var errTasksHalted = errors.New("remote execution is halted by the emergency stop (POST /api/tasks/resume)")
+
+// taskHaltKey is the Setting that keeps the emergency stop across restarts.
+const taskHaltKey = "tasks_halted"
+
+var tasks = struct {
+	sync.Mutex
+	next     uint64
+	running  map[uint64]*Task
+	haltOnce sync.Once
+	halted   bool
+}{running: map[uint64]*Task{}}
+
+// TasksHalted reports whether the emergency stop is on. Caller must not
+// hold tasks' lock.
+func TasksHalted() bool {
+	tasks.Lock()
+	defer tasks.Unlock()
+	return tasksHaltedLocked()
+}
+
+func tasksHaltedLocked() bool {
+	tasks.haltOnce.Do(func() {
+		var s models.Setting
+		if DB.Where(&models.Setting{Key: taskHaltKey}).Take(&s).Error == nil {
+			tasks.halted = s.Value == "true"
+		}
+	})
+	return tasks.halted
+}
+
+// startTask registers a remote execution; cancel must make it stop. It
+// fails while the emergency stop is on. The caller calls done when the
+// task ends.
+func startTask(kind, name, host string, deviceID uint, cancel func()) (*Task, error) {
+	tasks.Lock()
+	defer tasks.Unlock()
+	if tasksHaltedLocked() {
+		return nil, errTasksHalted
+	}
+	tasks.next++
+	t := &Task{
+		ID: tasks.next, Kind: kind, Name: name, DeviceID: deviceID, Host: host,
+		StartedAt: time.Now(), cancel: cancel,
+	}
+	tasks.running[t.ID] = t
+	return t, nil
+}
+
+// done unregisters a finished task.
+func (t *Task) done() {
+	tasks.Lock()
+	delete(tasks.running, t.ID)
+	tasks.Unlock()
+}
+
+// finishAgentTask ends the tasks of a kind handed to a device's agent, when
+// it reports the result.
+func finishAgentTask(kind string, deviceID uint) {
+	tasks.Lock()
+	defer tasks.Unlock()
+	for id, t := range tasks.running {
+		if t.Kind == kind && t.DeviceID == deviceID {
+			delete(tasks.running, id)
+		}
+	}
+}
+
+// startAgentTask tracks a job handed to a device's agent until it reports
+// back or timeout passes (the agent may have gone away). Cancelling it asks
+// the agent to abort its running jobs with the next metrics response.
+func startAgentTask(kind, name string, dev *models.Device, timeout time.Duration) {
+	t, err := startTask(kind, name, dev.IP, dev.ID, func() {
+		shared.Set(agentCancelKey(dev.ID), []byte("1"), agentJobTTL)
+	})
+	if err != nil {
+		return
+	}
+	time.AfterFunc(timeout, t.done)
+}
+
+// TakeAgentCancel reports (once) whether a device's agent should abort its
+// running speed tests and traceroutes.
+func TakeAgentCancel(deviceID uint) bool {
+	_, ok := shared.Take(agentCancelKey(deviceID))
+	return ok
+}
+
+// RunningTasks returns the in-flight tasks, oldest first.
+func RunningTasks() []Task {
+	tasks.Lock()
+	defer tasks.Unlock()
+	now := time.Now()
+	list := make([]Task, 0, len(tasks.running))
+	for _, t := range tasks.running {
+		c := *t
+		c.DurationSec = now.Sub(t.StartedAt).Seconds()
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CancelTask stops one task. It reports false when no such task runs.
+func CancelTask(id uint64) bool {
+	tasks.Lock()
+	t, ok := tasks.running[id]
+	delete(tasks.running, id)
+	tasks.Unlock()
+	if ok {
+		t.cancel()
+	}
+	return ok
+}
+
+// EmergencyStop cancels every running task, drops the speed tests and
+// traceroutes not handed out yet, and refuses new remote executions until
+// ResumeTasks. Other instances sharing the store stop theirs too. It
+// returns the number of tasks cancelled on this instance.
+func EmergencyStop() (int, error) {
+	if err := DB.Save(&models.Setting{Key: taskHaltKey, Value: "true"}).Error; err != nil {
+		return 0, err
+	}
+	n := haltLocalTasks()
+	shared.DeletePrefix("speedtest:")
+	shared.DeletePrefix("traceroute:")
+	shared.Publish(topicTasks, []byte("stop"))
+	log.Printf("[tasks] EMERGENCY STOP: %d running tasks cancelled", n)
+	RecordEvent(0, models.EventTasksStopped, "emergency stop: "+strconv.Itoa(n)+" remote tasks cancelled", nil)
+	return n, nil
+}
+
+// haltLocalTasks turns the emergency stop on in this process and cancels
+// the tasks it runs, returning their number.
+func haltLocalTasks() int {
+	tasks.Lock()
+	tasksHaltedLocked()
+	tasks.halted = true
+	running := tasks.running
+	tasks.running = map[uint64]*Task{}
+	tasks.Unlock()
+
+	for _, t := range running {
+		t.cancel()
+	}
+	return len(running)
+}
+
+// resumeLocalTasks lifts the emergency stop in this process.
+func resumeLocalTasks() {
+	tasks.Lock()
+	tasksHaltedLocked()
+	tasks.halted = false
+	tasks.Unlock()
+}
+
+// ResumeTasks lifts the emergency stop, on every instance.
+func ResumeTasks() error {
+	if err := DB.Save(&models.Setting{Key: taskHaltKey, Value: "false"}).Error; err != nil {
+		return err
+	}
+	resumeLocalTasks()
+	shared.Publish(topicTasks, []byte("resume"))
+	RecordEvent(0, models.EventTasksResumed, "remote execution resumed", nil)
+	return nil
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// groupTasks keeps the tasks on devices in groups; tasks on hosts that
+// are no device, such as agent installs, are left out.
+func groupTasks(list []Task, groups map[string]bool) ([]Task, error) {
+	var ids []uint
+	if err := groupDeviceIDs(groups).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(list, func(t Task) bool { return !slices.Contains(ids, t.DeviceID) }), nil
+}
+
+// handleRunningTasks lists the in-flight remote executions; roles limited
+// to device groups see those on their groups' devices.
+func handleRunningTasks(c *gin.Context) {
+	list := RunningTasks()
+	if groups := deviceGroups(c); groups != nil {
+		var err error
+		if list, err = groupTasks(list, groups); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list, "halted": TasksHalted()})
+}
+
+// handleCancelTask stops one remote execution.
+func handleCancelTask(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if groups := deviceGroups(c); groups != nil {
+		list, err := groupTasks(RunningTasks(), groups)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !slices.ContainsFunc(list, func(t Task) bool { return t.ID == id }) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "task not running"})
+			return
+		}
+	}
+	if !CancelTask(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "task not running"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// handleEmergencyStop cancels all remote executions and halts new ones.
+func handleEmergencyStop(c *gin.Context) {
+	n, err := EmergencyStop()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "cancelled": n})
+}
+
+// handleResumeTasks lifts the emergency stop.
+func handleResumeTasks(c *gin.Context) {
+	if err := ResumeTasks(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+	"github.com/vesaa/opentalon/internal/proxy"
+	"github.com/vesaa/opentalon/internal/telemetry"
+)
+
+// telegram is the bot the Telegram channels send through. chats are the
+// channels' chats, the only ones whose commands the bot answers.
+var telegram struct {
+	token string
+	api   string
+	chats map[int64]bool
+}
+
+// SetTelegram installs the Telegram channels: specs are "name=chat_id",
+// each a notification channel posting to that chat (a user, group or
+// channel; group IDs are negative) through the bot with token. apiURL is
+// the Bot API endpoint, e.g. a self-hosted Bot API server.
+func SetTelegram(token, apiURL string, specs []string) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("telegram_channels need telegram_bot_token")
+	}
+	telegram.token = token
+	telegram.api = strings.TrimSuffix(apiURL, "/")
+	telegram.chats = map[int64]bool{}
+	for _, spec := range specs {
+		name, id, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		chat, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if !ok || name == "" || err != nil {
+			return fmt.Errorf("telegram channel %q: want name=chat_id", spec)
+		}
+		telegram.chats[chat] = true
+		if err := addNotifier(name, &telegramChannel{chat: chat}); err != nil {
+			return fmt.Errorf("telegram channel %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// telegramChannel posts notifications to one chat.
+type telegramChannel struct {
+	chat int64
+}
+
+func (t *telegramChannel) send(n *Notification) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s <b>%s</b> · %s\n%s\n", notificationIcon(n), strings.ToUpper(n.Status), n.Severity, html.EscapeString(n.Message))
+	fmt.Fprintf(&b, "Device: %s (%s)\n", html.EscapeString(n.Device), n.IP)
+	fmt.Fprintf(&b, "Value: %.2f\n", n.Value)
+	if n.Status == models.AlertFiring {
+		fmt.Fprintf(&b, "Alert #%d · /ack %d", n.AlertID, n.AlertID)
+	} else {
+		fmt.Fprintf(&b, "Alert #%d", n.AlertID)
+	}
+	return telegramSend(t.chat, b.String())
+}
+
+// telegramSend posts an HTML message to chat.
+func telegramSend(chat int64, text string) error {
+	return telegramCall("sendMessage", map[string]any{
+		"chat_id": chat, "text": text, "parse_mode": "HTML", "disable_web_page_preview": true,
+	}, nil, 15*time.Second)
+}
+
+// telegramCall calls a Bot API method and decodes its result into out.
+// 429 and 5xx replies can be retried; other errors are permanent.
+func telegramCall(method string, params any, out any, timeout time.Duration) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	client := telemetry.HTTPClient(&http.Client{Timeout: timeout, Transport: proxy.Transport(proxy.Webhook)})
+	resp, err := client.Post(telegram.api+"/bot"+telegram.token+"/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL holds the token; keep it out of the logs.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	var r struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("telegram %s: HTTP %d", method, resp.StatusCode)
+	}
+	switch {
+	case r.OK:
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(r.Result, out)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("telegram %s: %s", method, r.Description)
+	default:
+		return fmt.Errorf("telegram %s: %s: %w", method, r.Description, errPermanent)
+	}
+}
+
+// ── Bot commands ─────────────────────────────────────────────────────────────
+
+// telegramOffsetKey keeps the next update to fetch, so another instance
+// taking over the bot does not answer commands twice.
+const telegramOffsetKey = "telegram:offset"
+
+type telegramMessage struct {
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	From struct {
+		ID        int64  `json:"id"`
+		Username  string `json:"username"`
+		FirstName string `json:"first_name"`
+	} `json:"from"`
+	Text string `json:"text"`
+}
+
+// RunTelegramBot answers the bot commands sent from the Telegram channels'
+// chats: /status, /devices [filter] and /ack <alert-id>. Only one instance
+// polls the bot. It never returns.
+func RunTelegramBot() {
+	for {
+		if !leads("telegram", 2*time.Minute) {
+			time.Sleep(30 * time.Second)
+			continue
+		}
+		var offset int64
+		if v, ok := shared.Get(telegramOffsetKey); ok {
+			offset, _ = strconv.ParseInt(string(v), 10, 64)
+		}
+		var updates []struct {
+			UpdateID int64            `json:"update_id"`
+			Message  *telegramMessage `json:"message"`
+		}
+		params := map[string]any{"offset": offset, "timeout": 50, "allowed_updates": []string{"message"}}
+		if err := telegramCall("getUpdates", params, &updates, 70*time.Second); err != nil {
+			log.Printf("[telegram] %v", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			shared.Set(telegramOffsetKey, []byte(strconv.FormatInt(u.UpdateID+1, 10)), 0)
+			if u.Message != nil {
+				handleTelegramMessage(u.Message)
+			}
+		}
+	}
+}
+
+func handleTelegramMessage(m *telegramMessage) {
+	args := strings.Fields(m.Text)
+	if len(args) == 0 || !strings.HasPrefix(args[0], "/") {
+		return
+	}
+	if !telegram.chats[m.Chat.ID] {
+		log.Printf("[telegram] ignoring %s from chat %d: not a configured channel", args[0], m.Chat.ID)
+		return
+	}
+	// In groups commands may be addressed as /status@SomeBot.
+	cmd, _, _ := strings.Cut(args[0], "@")
+	var reply string
+	switch cmd {
+	case "/status":
+		reply = telegramStatus()
+	case "/devices":
+		reply = telegramDevices(strings.Join(args[1:], " "))
+	case "/ack":
+		reply = telegramAck(m, args[1:])
+	default:
+		reply = "/status · firing alerts and device counts\n/devices [filter] · devices and their state\n/ack &lt;alert-id&gt; · acknowledge an alert"
+	}
+	if err := telegramSend(m.Chat.ID, reply); err != nil {
+		log.Printf("[telegram] reply to %s: %v", cmd, err)
+	}
+}
+
+// telegramMaxLen keeps replies below Telegram's 4096-character limit.
+const telegramMaxLen = 3800
+
+func telegramStatus() string {
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		return "Error: " + html.EscapeString(err.Error())
+	}
+	now := time.Now()
+	counts := map[string]int{}
+	for i := range devices {
+		counts[liveStatus(&devices[i], now)]++
+	}
+	var alerts []models.Alert
+	DB.Where("status = ?", models.AlertFiring).Order("fired_at desc").Find(&alerts)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<b>Devices</b>: %d online, %d offline", counts["online"], counts["offline"])
+	if counts["shutdown"] > 0 {
+		fmt.Fprintf(&b, ", %d shut down", counts["shutdown"])
+	}
+	if counts["flapping"] > 0 {
+		fmt.Fprintf(&b, ", %d flapping", counts["flapping"])
+	}
+	fmt.Fprintf(&b, "\n<b>Firing alerts</b>: %d\n", len(alerts))
+	for i, a := range alerts {
+		if b.Len() > telegramMaxLen {
+			fmt.Fprintf(&b, "… and %d more\n", len(alerts)-i)
+			break
+		}
+		fmt.Fprintf(&b, "#%d %s · %s", a.ID, a.Severity, html.EscapeString(a.Message))
+		if a.AckedBy != "" {
+			fmt.Fprintf(&b, " (acked by %s)", html.EscapeString(a.AckedBy))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// telegramDevices lists the devices whose name, IP or group contains filter.
+func telegramDevices(filter string) string {
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		return "Error: " + html.EscapeString(err.Error())
+	}
+	filter = strings.ToLower(filter)
+	var list []*models.Device
+	for i := range devices {
+		d := &devices[i]
+		if filter == "" || strings.Contains(strings.ToLower(deviceName(d)+" "+d.IP+" "+d.Group), filter) {
+			list = append(list, d)
+		}
+	}
+	if len(list) == 0 {
+		return "No devices."
+	}
+	sort.Slice(list, func(i, j int) bool { return deviceName(list[i]) < deviceName(list[j]) })
+	icons := map[string]string{"online": "🟢", "offline": "🔴", "shutdown": "⚪", "flapping": "🟡", "unknown": "❔"}
+	now := time.Now()
+	var b strings.Builder
+	for i, d := range list {
+		if b.Len() > telegramMaxLen {
+			fmt.Fprintf(&b, "… and %d more", len(list)-i)
+			break
+		}
+		fmt.Fprintf(&b, "%s %s · %s · %s\n", icons[liveStatus(d, now)], html.EscapeString(deviceName(d)), d.IP, html.EscapeString(d.Group))
+	}
+	return b.String()
+}
+
+func telegramAck(m *telegramMessage, args []string) string {
+	if len(args) != 1 {
+		return "Usage: /ack &lt;alert-id&gt;"
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(args[0], "#"), 10, 64)
+	if err != nil {
+		return "Usage: /ack &lt;alert-id&gt;"
+	}
+	who := m.From.Username
+	if who == "" {
+		who = m.From.FirstName
+	}
+	a, err := AckAlert(uint(id), "telegram:"+who)
+	if err != nil {
+		return html.EscapeString(err.Error())
+	}
+	return fmt.Sprintf("Alert #%d (%s) acknowledged.", a.ID, html.EscapeString(a.RuleName))
+}
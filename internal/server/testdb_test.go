@@ -0,0 +1,43 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openSQLite opens (creating) the SQLite file at path with the full schema
+// and closes it when the test ends.
+func openSQLite(t *testing.T, path string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(allModels...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeDB(db) })
+	return db
+}
+
+// openTestDB points DB (and the metrics store) at a fresh SQLite database
+// with the full schema for the duration of the test.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	db := openSQLite(t, filepath.Join(t.TempDir(), "test.db"))
+	prev, prevStore := DB, metricsStore
+	DB, metricsStore = db, gormMetricsStore{db}
+	t.Cleanup(func() {
+		DB, metricsStore = prev, prevStore
+		policies.Lock()
+		policies.list, policies.loaded = nil, false
+		policies.Unlock()
+		notifiers.Lock()
+		notifiers.stored, notifiers.storedNames, notifiers.loaded = nil, nil, false
+		notifiers.Unlock()
+	})
+}
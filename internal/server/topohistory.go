@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// topologySnapshotInterval is how often the tree is compared with the last
+// snapshot.
+const topologySnapshotInterval = time.Minute
+
+// RunTopologySnapshots records the device tree whenever it changed and
+// drops snapshots older than retentionDays. Only one instance records. It
+// never returns.
+func RunTopologySnapshots(retentionDays int) {
+	for {
+		if leads("topology-snapshot", 2*topologySnapshotInterval) {
+			now := time.Now()
+			if err := snapshotTopology(now); err != nil {
+				log.Printf("[topology] snapshot: %v", err)
+			}
+			DB.Where("taken_at < ?", now.AddDate(0, 0, -retentionDays)).Delete(&models.TopologySnapshot{})
+		}
+		time.Sleep(topologySnapshotInterval)
+	}
+}
+
+// snapshotTopology stores the current tree unless it equals the last
+// snapshot.
+func snapshotTopology(now time.Time) error {
+	tree, err := GetDeviceTree()
+	if err != nil {
+		return err
+	}
+	nodes := snapshotNodes(tree, nil)
+	raw, err := json.Marshal(nodes)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+	var last models.TopologySnapshot
+	if err := DB.Select("id", "hash").Order("taken_at desc").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	if last.Hash == hash {
+		return nil
+	}
+	return DB.Create(&models.TopologySnapshot{TakenAt: now, Hash: hash, Nodes: nodes}).Error
+}
+
+// snapshotNodes flattens the managed devices of tree into their stable
+// fields: what changes with every report (last seen, metrics, latency) is
+// left out so an unchanged network makes no new snapshot.
+func snapshotNodes(tree []*models.DeviceTree, out []*models.DeviceTree) []*models.DeviceTree {
+	for _, n := range tree {
+		if n.Kind != "" || n.Site != "" {
+			continue
+		}
+		out = append(out, &models.DeviceTree{
+			ID: n.ID, Hostname: n.Hostname, Remark: n.Remark, IP: n.IP, OS: n.OS, MAC: n.MAC,
+			GatewayIP: n.GatewayIP, GatewayIPv6: n.GatewayIPv6, NetworkMode: n.NetworkMode,
+			Group: n.Group, IsOnline: n.IsOnline, Status: n.Status, ShutdownKind: n.ShutdownKind,
+			AgentVer: n.AgentVer, ParentID: n.ParentID,
+		})
+		out = snapshotNodes(n.Children, out)
+	}
+	return out
+}
+
+// snapshotTree nests the flat nodes of a snapshot again.
+func snapshotTree(nodes []*models.DeviceTree) []*models.DeviceTree {
+	byID := make(map[uint]*models.DeviceTree, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	roots := []*models.DeviceTree{}
+	for _, n := range nodes {
+		if n.ParentID != nil {
+			if p, ok := byID[*n.ParentID]; ok {
+				p.Children = append(p.Children, n)
+				continue
+			}
+		}
+		roots = append(roots, n)
+	}
+	sortDeviceTree(roots)
+	return roots
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// handleTopologyAt returns the device tree as of the last snapshot at or
+// before ?t= (RFC 3339 or unix seconds), with the snapshot's time.
+func handleTopologyAt(c *gin.Context) {
+	t, err := parseTimeParam(c.Query("t"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "t: " + err.Error()})
+		return
+	}
+	var snap models.TopologySnapshot
+	if err := DB.Where("taken_at <= ?", t).Order("taken_at desc").Limit(1).Find(&snap).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if snap.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no topology snapshot at or before t"})
+		return
+	}
+	tree := snapshotTree(snap.Nodes)
+	if groups := deviceGroups(c); groups != nil {
+		tree = filterTreeGroups(tree, groups)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": tree, "taken_at": snap.TakenAt})
+}
+
+// handleTopologyHistory lists when the tree changed, oldest first, for a
+// time slider; ?from= / ?to= limit the range.
+func handleTopologyHistory(c *gin.Context) {
+	q := DB.Model(&models.TopologySnapshot{}).Select("id", "taken_at")
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if s := c.Query(param); s != "" {
+			ts, err := parseTimeParam(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + ": " + err.Error()})
+				return
+			}
+			q = q.Where("taken_at "+op+" ?", ts)
+		}
+	}
+	list := []models.TopologySnapshot{}
+	if err := q.Order("taken_at").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// pathProbePorts are tried in order to measure a TCP round trip to a hop.
+// A refused connection still proves the host answered, so it counts as well.
+var pathProbePorts = []int{22, 80, 443, 3389}
+
+// PathHop is one device on the path between two devices.
+type PathHop struct {
+	ID       uint   `json:"id"`
+	Hostname string `json:"hostname"`
+	Remark   string `json:"remark"`
+	IP       string `json:"ip"`
+	// Direction is "up" while climbing from the source towards the common
+	// ancestor, "top" for the common ancestor and "down" towards the target.
+	Direction string `json:"direction"`
+	Status    string `json:"status"` // online / offline / unknown
+	// LatencyMs is the TCP round trip from the server to this hop; nil when
+	// the hop did not answer on any probe port.
+	LatencyMs *float64 `json:"latency_ms"`
+}
+
+// TopologyPath is the path between two devices through the parent tree.
+type TopologyPath struct {
+	From uint      `json:"from"`
+	To   uint      `json:"to"`
+	Hops []PathHop `json:"hops"`
+	// Reachable is false when any hop is offline or the two devices share no
+	// common ancestor (disconnected subtrees).
+	Reachable bool `json:"reachable"`
+	// BrokenAt is the first hop that is not online, if any.
+	BrokenAt *uint `json:"broken_at,omitempty"`
+	// Slowest is the hop with the highest measured latency.
+	Slowest *uint `json:"slowest,omitempty"`
+}
+
+// ancestry returns the chain id, parent, grandparent, … up to the root.
+func ancestry(id uint, devices map[uint]*models.Device) []uint {
+	var chain []uint
+	seen := map[uint]bool{}
+	for cur := &id; cur != nil && !seen[*cur]; {
+		d, ok := devices[*cur]
+		if !ok {
+			break
+		}
+		seen[d.ID] = true
+		chain = append(chain, d.ID)
+		cur = d.ParentID
+	}
+	return chain
+}
+
+// liveStatus derives the UI status of a device the same way GetDeviceTree does.
+func liveStatus(d *models.Device, now time.Time) string {
+	switch {
+	case d.Flapping:
+		return "flapping"
+	case d.IsOnline && (d.LastSeen.IsZero() || now.Sub(d.LastSeen) <= offlineTimeout(d)):
+		return "online"
+	case d.ShutdownAt != nil:
+		return "shutdown"
+	case d.LastSeen.IsZero():
+		return "unknown"
+	default:
+		return "offline"
+	}
+}
+
+// tcpLatency measures a TCP connect round trip to ip, trying pathProbePorts.
+func tcpLatency(ip string, timeout time.Duration) *float64 {
+	for _, port := range pathProbePorts {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+		rtt := float64(time.Since(start).Microseconds()) / 1000
+		if err == nil {
+			_ = conn.Close()
+			return &rtt
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return &rtt
+		}
+	}
+	return nil
+}
+
+// FindTopologyPath computes the path between two devices via their lowest
+// common ancestor in the parent tree. With probe set, every hop is measured
+// concurrently from the server.
+func FindTopologyPath(from, to uint, probe bool) (*TopologyPath, error) {
+	var list []models.Device
+	if err := DB.Find(&list).Error; err != nil {
+		return nil, err
+	}
+	devices := make(map[uint]*models.Device, len(list))
+	for i := range list {
+		devices[list[i].ID] = &list[i]
+	}
+	for _, id := range []uint{from, to} {
+		if _, ok := devices[id]; !ok {
+			return nil, fmt.Errorf("device %d not found", id)
+		}
+	}
+
+	up, down := ancestry(from, devices), ancestry(to, devices)
+	pos := make(map[uint]int, len(down))
+	for i, id := range down {
+		pos[id] = i
+	}
+	lca, lcaUp, lcaDown := uint(0), -1, -1
+	for i, id := range up {
+		if j, ok := pos[id]; ok {
+			lca, lcaUp, lcaDown = id, i, j
+			break
+		}
+	}
+
+	res := &TopologyPath{From: from, To: to}
+	now := time.Now()
+	add := func(id uint, dir string) {
+		d := devices[id]
+		res.Hops = append(res.Hops, PathHop{
+			ID: d.ID, Hostname: d.Hostname, Remark: d.Remark, IP: d.IP,
+			Direction: dir, Status: liveStatus(d, now),
+		})
+	}
+	if lcaUp < 0 {
+		// Disconnected subtrees: return both chains up to their roots so the
+		// UI can still show where each side ends.
+		for _, id := range up {
+			add(id, "up")
+		}
+		for i := len(down) - 1; i >= 0; i-- {
+			add(down[i], "down")
+		}
+	} else {
+		for _, id := range up[:lcaUp] {
+			add(id, "up")
+		}
+		add(lca, "top")
+		for i := lcaDown - 1; i >= 0; i-- {
+			add(down[i], "down")
+		}
+	}
+
+	if probe {
+		var wg sync.WaitGroup
+		for i := range res.Hops {
+			wg.Add(1)
+			go func(h *PathHop) {
+				defer wg.Done()
+				h.LatencyMs = tcpLatency(h.IP, 700*time.Millisecond)
+			}(&res.Hops[i])
+		}
+		wg.Wait()
+	}
+
+	res.Reachable = lcaUp >= 0
+	var worst float64
+	for i := range res.Hops {
+		h := &res.Hops[i]
+		if h.Status != "online" && res.BrokenAt == nil {
+			id := h.ID
+			res.BrokenAt = &id
+			res.Reachable = false
+		}
+		if h.LatencyMs != nil && *h.LatencyMs > worst {
+			worst = *h.LatencyMs
+			id := h.ID
+			res.Slowest = &id
+		}
+	}
+	return res, nil
+}
+
+// resolveDeviceRef accepts a device ID or IP address. An address several
+// devices share is rejected rather than guessed.
+func resolveDeviceRef(ref string) (uint, error) {
+	if id, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		return uint(id), nil
+	}
+	var ids []uint
+	DB.Model(&models.Device{}).Where("ip = ?", ref).Limit(2).Pluck("id", &ids)
+	switch len(ids) {
+	case 0:
+		return 0, fmt.Errorf("device %q not found", ref)
+	case 1:
+		return ids[0], nil
+	}
+	return 0, fmt.Errorf("several devices have address %q; use the device ID", ref)
+}
+
+// handleTopologyPath returns the hop-by-hop path between two devices
+// (?from=&to=, device ID or IP). Pass probe=false to skip live latency probes.
+func handleTopologyPath(c *gin.Context) {
+	from, err := resolveDeviceRef(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := resolveDeviceRef(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	res, err := FindTopologyPath(from, to, c.DefaultQuery("probe", "true") != "false")
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": res})
+}
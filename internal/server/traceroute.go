@@ -0,0 +1,177 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// maxTraceroutesPerDevice is how many traceroute runs are kept per device.
+const maxTraceroutesPerDevice = 10
+
+// TraceReport is the traceroute result posted by an agent (data-plane).
+type TraceReport struct {
+	IP      string            `json:"ip"`
+	Target  string            `json:"target"`
+	Hops    []models.TraceHop `json:"hops"`
+	Reached bool              `json:"reached"`
+	Error   string            `json:"error"`
+	// MachineID picks the reporting device when several share IP.
+	MachineID string `json:"machine_id"`
+}
+
+// RequestTraceroute asks a device's agent to trace the path to the server.
+func RequestTraceroute(deviceID uint) { shared.Set(tracerouteKey(deviceID), []byte("1"), agentJobTTL) }
+
+// TakeTracerouteRequest reports (once) whether a traceroute was requested.
+func TakeTracerouteRequest(deviceID uint) bool {
+	_, ok := shared.Take(tracerouteKey(deviceID))
+	return ok
+}
+
+// SaveTraceroute maps the hops of a report onto managed devices and compares
+// the nearest one with the device's parent. A device without a parent (its
+// gateway is not managed, e.g. behind an unmanaged NAT hop) is wired to it;
+// a differing parent is only flagged, since it may have been set by hand.
+func SaveTraceroute(dev *models.Device, rep TraceReport) (*models.Traceroute, error) {
+	topoMu.Lock()
+	defer topoMu.Unlock()
+
+	var list []models.Device
+	if err := DB.Find(&list).Error; err != nil {
+		return nil, err
+	}
+	devices := make(map[uint]*models.Device, len(list))
+	byAddr := map[string]uint{}
+	for i := range list {
+		d := &list[i]
+		devices[d.ID] = d
+		for _, list := range []string{d.LANIPs, d.WANIPs, d.IPv6Addrs} {
+			for _, ip := range splitList(list) {
+				byAddr[ip] = d.ID
+			}
+		}
+	}
+	for i := range list {
+		byAddr[list[i].IP] = list[i].ID // primary IP wins over secondary ones
+	}
+
+	tr := &models.Traceroute{
+		DeviceID: dev.ID, Target: rep.Target, Hops: rep.Hops,
+		Reached: rep.Reached, Error: rep.Error, ParentID: dev.ParentID,
+		Verdict: models.TraceVerdictUnknown,
+	}
+	for i := range tr.Hops {
+		h := &tr.Hops[i]
+		id, ok := byAddr[h.IP]
+		if !ok || h.IP == "" {
+			continue
+		}
+		h.DeviceID = &id
+		// The last hop of a completed trace is the server itself, which is
+		// where the path ends rather than an upstream of the device.
+		last := rep.Reached && i == len(tr.Hops)-1
+		if tr.SuggestedParentID == nil && id != dev.ID && !last {
+			tr.SuggestedParentID = &id
+		}
+	}
+
+	if s := tr.SuggestedParentID; s != nil {
+		switch {
+		case dev.ParentID != nil && *dev.ParentID == *s:
+			tr.Verdict = models.TraceVerdictConfirmed
+		case dev.ParentID == nil && !dev.TopologyLocked && !contains(ancestry(*s, devices), dev.ID):
+			setParent(dev, s, "traceroute")
+			tr.Verdict = models.TraceVerdictRefined
+			log.Printf("[topology] %s wired under device %d by traceroute", dev.IP, *s)
+		default:
+			tr.Verdict = models.TraceVerdictMismatch
+		}
+	}
+
+	if err := DB.Create(tr).Error; err != nil {
+		return nil, err
+	}
+	var keep models.Traceroute
+	if err := DB.Select("id").Where("device_id = ?", dev.ID).
+		Order("id desc").Offset(maxTraceroutesPerDevice - 1).Limit(1).
+		Take(&keep).Error; err == nil {
+		DB.Where("device_id = ? AND id < ?", dev.ID, keep.ID).Delete(&models.Traceroute{})
+	}
+	return tr, nil
+}
+
+func contains(ids []uint, id uint) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTracerouteReport receives a traceroute from an agent (data-plane).
+func handleTracerouteReport(c *gin.Context) {
+	var rep TraceReport
+	if err := c.ShouldBindJSON(&rep); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dev, ok := reportDevice(c, rep.MachineID, rep.IP)
+	if !ok {
+		return
+	}
+	finishAgentTask(TaskTraceroute, dev.ID)
+	tr, err := SaveTraceroute(&dev, rep)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "verdict": tr.Verdict})
+}
+
+// handleRequestTraceroute queues an on-demand traceroute; the agent picks it
+// up with its next metrics report and the result appears in
+// GET /devices/:id/traceroute.
+func handleRequestTraceroute(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var dev models.Device
+	if err := DB.First(&dev, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if dev.AgentVer == "discovered" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device has no agent"})
+		return
+	}
+	if TasksHalted() {
+		c.JSON(http.StatusConflict, gin.H{"error": errTasksHalted.Error()})
+		return
+	}
+	RequestTraceroute(dev.ID)
+	c.JSON(http.StatusAccepted, gin.H{"queued": true})
+}
+
+// handleDeviceTraceroutes returns the most recent traceroutes of a device,
+// newest first, and whether a requested run is still pending.
+func handleDeviceTraceroutes(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	list := []models.Traceroute{}
+	if err := DB.Where("device_id = ?", id).Order("id desc").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, pending := shared.Get(tracerouteKey(uint(id)))
+	c.JSON(http.StatusOK, gin.H{"data": list, "pending": pending})
+}
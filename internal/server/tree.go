@@ -0,0 +1,97 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// TreeInclude selects the optional per-node data GET /api/devices/tree
+// embeds, so the basic tree stays light for frequent polling.
+type TreeInclude struct {
+	Metrics bool // latest cached metrics
+	Alerts  bool // open alert count
+}
+
+// ParseTreeInclude parses an include list such as "metrics,alerts";
+// unknown names are ignored.
+func ParseTreeInclude(s string) TreeInclude {
+	var inc TreeInclude
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "metrics":
+			inc.Metrics = true
+		case "alerts":
+			inc.Alerts = true
+		}
+	}
+	return inc
+}
+
+// EmbedTreeExtras fills in the data selected by inc on every managed-device
+// node of tree. Metrics come from the in-memory cache only, so a device that
+// has not reported since the server started has none; all open alert counts
+// are read in one query.
+func EmbedTreeExtras(tree []*models.DeviceTree, inc TreeInclude) error {
+	if !inc.Metrics && !inc.Alerts {
+		return nil
+	}
+	var alerts map[uint]int
+	if inc.Alerts {
+		var err error
+		if alerts, err = openAlertCounts(); err != nil {
+			return err
+		}
+	}
+	var walk func(nodes []*models.DeviceTree)
+	walk = func(nodes []*models.DeviceTree) {
+		for _, n := range nodes {
+			if n.Kind == "" && n.Site == "" {
+				if inc.Metrics {
+					n.Metrics, _ = cachedLatestMetrics(n.ID)
+				}
+				if inc.Alerts {
+					count := alerts[n.ID]
+					n.OpenAlerts = &count
+				}
+			}
+			walk(n.Children)
+		}
+	}
+	walk(tree)
+	return nil
+}
+
+// openAlertCounts returns the number of open alerts per device: the firing
+// alert rules and the enabled service checks whose latest run by the
+// device's agent failed.
+func openAlertCounts() (map[uint]int, error) {
+	var rows []struct {
+		DeviceID uint
+		Count    int
+	}
+	latest := DB.Model(&models.CheckResult{}).Select("MAX(id)").Where("device_id > 0").Group("check_id, device_id")
+	err := DB.Model(&models.CheckResult{}).
+		Select("check_results.device_id, COUNT(*) AS count").
+		Joins("JOIN checks ON checks.id = check_results.check_id AND checks.enabled = ?", true).
+		Where("check_results.id IN (?) AND check_results.ok = ?", latest, false).
+		Group("check_results.device_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[uint]int, len(rows))
+	for _, r := range rows {
+		counts[r.DeviceID] = r.Count
+	}
+	rows = rows[:0]
+	err = DB.Model(&models.Alert{}).Select("device_id, COUNT(*) AS count").
+		Where("status = ?", models.AlertFiring).Group("device_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		counts[r.DeviceID] += r.Count
+	}
+	return counts, nil
+}
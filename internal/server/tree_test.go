@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// treeKeys returns the keys of every node of tree.
+func treeKeys(t *testing.T, tree []*models.DeviceTree) map[string]bool {
+	t.Helper()
+	keys := map[string]bool{}
+	walkTree(tree, func(n *models.DeviceTree) {
+		if keys[n.Key] {
+			t.Errorf("duplicate key %q", n.Key)
+		}
+		keys[n.Key] = true
+	})
+	return keys
+}
+
+func TestDeviceTreeKeysUnique(t *testing.T) {
+	openTestDB(t)
+	host := models.Device{Hostname: "docker-host", IP: "10.0.0.1"}
+	if err := DB.Create(&host).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Row 1 of each table, like device 1: the IDs collide across kinds,
+	// and every namespace node has ID 0.
+	DB.Create(&models.Container{DeviceID: host.ID, ContainerID: "c1", Name: "web"})
+	DB.Create(&models.Pod{DeviceID: host.ID, UID: "p1", Namespace: "default", Name: "api"})
+	DB.Create(&models.Pod{DeviceID: host.ID, UID: "p2", Namespace: "kube-system", Name: "dns"})
+	site := models.Site{Name: "branch", Tree: []*models.DeviceTree{
+		{ID: 1, Hostname: "edge-router", Children: []*models.DeviceTree{ // pushed by an edge without keys
+			{Kind: "namespace", Hostname: "default"},
+		}},
+	}}
+	if err := DB.Create(&site).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := GetDeviceTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := treeKeys(t, tree)
+	want := []string{
+		"d:1", "container:1", "ns:1/default", "pod:1", "ns:1/kube-system", "pod:2",
+		"site:branch", "site:branch/d:1", "site:branch/d:1/ns:default",
+	}
+	for _, k := range want {
+		if !keys[k] {
+			t.Errorf("missing key %q in %v", k, keys)
+		}
+	}
+	if len(keys) != len(want) {
+		t.Errorf("keys = %v, want %d", keys, len(want))
+	}
+
+	// The live view is keyed by them too.
+	nodes, err := liveTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != len(want) {
+		t.Errorf("live tree has %d nodes, want %d", len(nodes), len(want))
+	}
+}
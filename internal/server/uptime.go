@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vesaa/opentalon/internal/models"
+)
+
+// bootTimeJitter absorbs small shifts of the kernel-reported boot time (clock
+// adjustments by NTP) so they are not mistaken for reboots.
+const bootTimeJitter = time.Minute
+
+// TrackBootTime stores the boot time reported by a device's agent and records
+// a device_rebooted event when it moved forward, i.e. the host restarted
+// since the previous report. It must run before the report refreshes
+// last_seen. bootUnix is seconds since the epoch; 0 (agents without uptime
+// reporting) is ignored.
+func TrackBootTime(dev *models.Device, bootUnix int64) {
+	if bootUnix <= 0 {
+		return
+	}
+	boot := time.Unix(bootUnix, 0)
+	prev := dev.BootTime
+	if !prev.IsZero() && boot.Sub(prev) < bootTimeJitter && prev.Sub(boot) < bootTimeJitter {
+		return
+	}
+	DB.Model(dev).Update("boot_time", boot)
+	dev.BootTime = boot
+	if prev.IsZero() || boot.Before(prev) {
+		return // first report, or the clock moved backwards
+	}
+	name := dev.Hostname
+	if dev.Remark != "" {
+		name = dev.Remark
+	}
+	data := map[string]any{
+		"previous_boot_time": prev.UTC(),
+		"boot_time":          boot.UTC(),
+	}
+	// When dev.LastSeen still predates the new boot (no re-registration in
+	// between) it bounds the previous uptime and the time the host was down.
+	if dev.LastSeen.After(prev) && dev.LastSeen.Before(boot) {
+		data["previous_uptime"] = int64(dev.LastSeen.Sub(prev).Seconds())
+		data["downtime"] = int64(boot.Sub(dev.LastSeen).Seconds())
+	}
+	msg := fmt.Sprintf("%s rebooted at %s", name, boot.Format(time.RFC3339))
+	// The agent announced the shutdown before this boot (ShutdownAt is only
+	// cleared after this runs).
+	if dev.ShutdownAt != nil && dev.ShutdownAt.Before(boot) {
+		data["planned"] = true
+		data["shutdown_kind"] = dev.ShutdownKind
+		msg += " (planned)"
+	}
+	RecordEvent(dev.ID, models.EventDeviceRebooted, msg, data)
+}
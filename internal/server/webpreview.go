@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vesaa/opentalon/internal/models"
+	"golang.org/x/net/html"
+)
+
+// webUIPorts are the TCP ports checked for a device's web UI, in order of
+// preference, with the scheme each usually serves: routers and NAS boxes
+// (80/443, Synology 5000/5001), Proxmox (8006) and the common alternates.
+var webUIPorts = []struct {
+	port   uint32
+	scheme string
+}{
+	{443, "https"}, {80, "http"}, {8006, "https"}, {5001, "https"}, {5000, "http"},
+	{8443, "https"}, {9443, "https"}, {8080, "http"}, {8000, "http"}, {3000, "http"}, {9090, "http"},
+}
+
+// Fetch limits: pages are read up to webPreviewMaxPage bytes (the title is
+// near the top) and larger favicons are skipped.
+const (
+	webPreviewMaxPage = 512 << 10
+	webPreviewMaxIcon = 32 << 10
+	webPreviewTimeout = 5 * time.Second
+	webPreviewWorkers = 4
+)
+
+var errNoWebUI = errors.New("no web UI found")
+
+// webPreviewClient talks to LAN devices directly, whose web UIs mostly use
+// self-signed certificates, and follows a few redirects (e.g. to /login).
+var webPreviewClient = &http.Client{
+	Timeout: webPreviewTimeout,
+	Transport: &http.Transport{
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // previews only, self-signed router / NAS UIs
+		DialContext:           (&net.Dialer{Timeout: 2 * time.Second}).DialContext,
+		ResponseHeaderTimeout: webPreviewTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	},
+}
+
+// RunWebPreviews refreshes the web UI previews of every device each
+// interval. Only one instance fetches. It never returns.
+func RunWebPreviews(interval time.Duration) {
+	for {
+		if leads("webpreview", interval) {
+			refreshWebPreviews()
+		}
+		time.Sleep(interval)
+	}
+}
+
+func refreshWebPreviews() {
+	var devices []models.Device
+	if err := DB.Find(&devices).Error; err != nil {
+		log.Printf("[webpreview] load devices: %v", err)
+		return
+	}
+	work := make(chan *models.Device)
+	var wg sync.WaitGroup
+	for i := 0; i < webPreviewWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				if _, err := UpdateWebPreview(d); err != nil {
+					log.Printf("[webpreview] device %d: %v", d.ID, err)
+				}
+			}
+		}()
+	}
+	for i := range devices {
+		work <- &devices[i]
+	}
+	close(work)
+	wg.Wait()
+}
+
+// UpdateWebPreview fetches the title and favicon of a device's web UI and
+// stores them. A device without one gets an empty preview; a failed fetch
+// of a known UI keeps the previous title and icon.
+func UpdateWebPreview(d *models.Device) (*models.WebPreview, error) {
+	var p models.WebPreview
+	DB.Where("device_id = ?", d.ID).Take(&p)
+	p.DeviceID, p.FetchedAt, p.Error = d.ID, time.Now(), ""
+
+	found := false
+	for _, u := range webUICandidates(d) {
+		title, icon, iconType, final, err := fetchWebUI(u)
+		if err != nil {
+			continue
+		}
+		p.URL, p.Title, p.Icon, p.IconType, found = final, title, icon, iconType, true
+		break
+	}
+	if !found {
+		if p.URL == "" {
+			p.Title, p.Icon, p.IconType = "", nil, ""
+		}
+		p.Error = errNoWebUI.Error()
+	}
+	if err := DB.Save(&p).Error; err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// webUICandidates lists the URLs to try: the web ports the device's agent
+// reported listening, else the well-known ports 443 and 80.
+func webUICandidates(d *models.Device) []string {
+	host := d.IP
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	var ports []models.ListeningPort
+	DB.Where("device_id = ? AND proto = ?", d.ID, "tcp").Find(&ports)
+	listening := map[uint32]bool{}
+	for _, lp := range ports {
+		if !strings.HasPrefix(lp.Addr, "127.") && lp.Addr != "::1" {
+			listening[lp.Port] = true
+		}
+	}
+	var urls []string
+	for _, w := range webUIPorts {
+		if len(ports) == 0 && w.port != 443 && w.port != 80 {
+			continue
+		}
+		if len(ports) > 0 && !listening[w.port] {
+			continue
+		}
+		u := w.scheme + "://" + host
+		if (w.scheme == "https" && w.port != 443) || (w.scheme == "http" && w.port != 80) {
+			u += ":" + strconv.FormatUint(uint64(w.port), 10)
+		}
+		urls = append(urls, u+"/")
+	}
+	return urls
+}
+
+// fetchWebUI loads a page and its favicon. Any HTTP answer counts as a web
+// UI (a login page behind 401 still has a title); final is the URL after
+// redirects.
+func fetchWebUI(target string) (title string, icon []byte, iconType, final string, err error) {
+	resp, err := webPreviewClient.Get(target)
+	if err != nil {
+		return "", nil, "", "", err
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(io.LimitReader(resp.Body, webPreviewMaxPage))
+	base := resp.Request.URL
+	final = base.String()
+
+	iconHref := "/favicon.ico"
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "text/html" || ct == "" {
+		var href string
+		title, href = parsePageHead(page)
+		if href != "" {
+			iconHref = href
+		}
+	}
+	if ref, err := url.Parse(iconHref); err == nil {
+		icon, iconType = fetchFavicon(base.ResolveReference(ref).String())
+	}
+	return title, icon, iconType, final, nil
+}
+
+// parsePageHead returns the page title and the href of its icon link.
+func parsePageHead(page []byte) (title, icon string) {
+	z := html.NewTokenizer(bytes.NewReader(page))
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return title, icon
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				inTitle = title == ""
+			case "link":
+				var rel, href string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "rel":
+						rel = strings.ToLower(a.Val)
+					case "href":
+						href = a.Val
+					}
+				}
+				// Prefer "icon" / "shortcut icon" over apple-touch-icon.
+				if href != "" && strings.Contains(rel, "icon") && (icon == "" || !strings.Contains(rel, "apple")) {
+					icon = href
+				}
+			case "body":
+				return title, icon
+			}
+		case html.TextToken:
+			if inTitle {
+				title = strings.Join(strings.Fields(string(z.Text())), " ")
+				if r := []rune(title); len(r) > 200 {
+					title = string(r[:200])
+				}
+				inTitle = false
+			}
+		case html.EndTagToken:
+			if z.Token().Data == "head" {
+				return title, icon
+			}
+		}
+	}
+}
+
+// fetchFavicon returns the icon at target if it is a small image.
+func fetchFavicon(target string) ([]byte, string) {
+	if strings.HasPrefix(target, "data:") {
+		return nil, ""
+	}
+	resp, err := webPreviewClient.Get(target)
+	if err != nil {
+		return nil, ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ""
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, webPreviewMaxIcon+1))
+	if err != nil || len(data) == 0 || len(data) > webPreviewMaxIcon {
+		return nil, ""
+	}
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(ct, "image/") {
+		// Many devices serve favicon.ico as text/plain or octet-stream.
+		if ct = http.DetectContentType(data); !strings.HasPrefix(ct, "image/") {
+			return nil, ""
+		}
+	}
+	return data, ct
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// webPreviewView is a WebPreview with its favicon as a data: URI, so the
+// UI can show it without another authenticated request.
+type webPreviewView struct {
+	models.WebPreview
+	Icon string `json:"icon,omitempty"`
+}
+
+func newWebPreviewView(p *models.WebPreview) webPreviewView {
+	v := webPreviewView{WebPreview: *p}
+	if len(p.Icon) > 0 {
+		v.Icon = "data:" + p.IconType + ";base64," + base64.StdEncoding.EncodeToString(p.Icon)
+	}
+	return v
+}
+
+// handleListWebPreviews returns the web UI previews of every device the
+// caller may see.
+func handleListWebPreviews(c *gin.Context) {
+	q := DB.Model(&models.WebPreview{})
+	if groups := deviceGroups(c); groups != nil {
+		q = q.Where("device_id IN (?)", groupDeviceIDs(groups))
+	}
+	var list []models.WebPreview
+	if err := q.Order("device_id").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	views := make([]webPreviewView, len(list))
+	for i := range list {
+		views[i] = newWebPreviewView(&list[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"data": views})
+}
+
+// handleDeviceWebPreview returns a device's web UI preview.
+func handleDeviceWebPreview(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var p models.WebPreview
+	if err := DB.Where("device_id = ?", id).Take(&p).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no preview yet"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": newWebPreviewView(&p)})
+}
+
+// handleRefreshWebPreview fetches a device's web UI preview now.
+func handleRefreshWebPreview(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var d models.Device
+	if err := DB.First(&d, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	p, err := UpdateWebPreview(&d)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("saving preview: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": newWebPreviewView(p)})
+}
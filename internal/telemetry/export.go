@@ -0,0 +1,70 @@
+//go:build !slim
+
+package telemetry
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// Setup installs a batching OTLP exporter as the global tracer provider and
+// W3C trace-context propagation, so agent → server requests join one
+// trace. The returned function flushes pending spans; call it on shutdown.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	var expOpts []otlptracehttp.Option
+	if opts.Endpoint != "" {
+		expOpts = append(expOpts, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	}
+	exp, err := otlptracehttp.New(ctx, expOpts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(opts.Service), semconv.ServiceVersion(opts.Version)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	enabled = true
+	return tp.Shutdown, nil
+}
+
+// GinMiddleware traces every request of an engine as a server span named
+// after its route, continuing traces propagated by the caller.
+func GinMiddleware(service string) gin.HandlerFunc {
+	return otelgin.Middleware(service)
+}
+
+// HTTPClient returns client with its transport traced and trace context
+// injected into outgoing requests; unchanged while tracing is off.
+func HTTPClient(client *http.Client) *http.Client {
+	if !enabled {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = otelhttp.NewTransport(base)
+	return client
+}
@@ -0,0 +1,19 @@
+//go:build slim
+
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Setup fails: slim builds carry no exporter.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	return nil, errors.New("tracing is not available in slim builds")
+}
+
+// HTTPClient returns client unchanged.
+func HTTPClient(client *http.Client) *http.Client {
+	return client
+}
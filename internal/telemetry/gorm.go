@@ -0,0 +1,97 @@
+//go:build !slim
+
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// slowQuery is the duration from which a query without a traced caller
+	// is still recorded, as a span of its own.
+	slowQuery = 100 * time.Millisecond
+	// maxStatementLen truncates recorded SQL (batch inserts can be huge).
+	maxStatementLen = 2000
+	gormStartKey    = "telemetry:start"
+)
+
+// GormPlugin records a span per SQL statement. Statements run with a traced
+// context (DB.WithContext(ctx)) become children of the caller's span;
+// statements without one are only recorded when slower than slowQuery, so
+// background queries do not flood the exporter with one trace each.
+type GormPlugin struct{}
+
+// Name implements gorm.Plugin.
+func (GormPlugin) Name() string { return "opentalon:telemetry" }
+
+// Initialize implements gorm.Plugin.
+func (p GormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	hooks := []struct {
+		op            string
+		before, after func(string, func(*gorm.DB)) error
+	}{
+		{"create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register},
+		{"query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register},
+		{"update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register},
+		{"delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register},
+		{"row", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register},
+		{"raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register},
+	}
+	for _, h := range hooks {
+		if err := h.before("telemetry:before_"+h.op, before); err != nil {
+			return err
+		}
+		if err := h.after("telemetry:after_"+h.op, after(h.op)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func before(db *gorm.DB) {
+	db.InstanceSet(gormStartKey, time.Now())
+}
+
+func after(op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		v, ok := db.InstanceGet(gormStartKey)
+		if !ok {
+			return
+		}
+		start := v.(time.Time)
+		ctx := db.Statement.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if !trace.SpanContextFromContext(ctx).IsValid() && time.Since(start) < slowQuery {
+			return
+		}
+		name := "db." + op
+		if t := db.Statement.Table; t != "" {
+			name += " " + t
+		}
+		sql := db.Statement.SQL.String()
+		if len(sql) > maxStatementLen {
+			sql = sql[:maxStatementLen] + "…"
+		}
+		_, span := otel.Tracer(instrumentation).Start(ctx, name,
+			trace.WithTimestamp(start), trace.WithSpanKind(trace.SpanKindClient))
+		span.SetAttributes(
+			attribute.String("db.system.name", db.Dialector.Name()),
+			attribute.String("db.query.text", sql),
+			attribute.Int64("db.response.returned_rows", db.Statement.RowsAffected),
+		)
+		if err := db.Error; err != nil && err != gorm.ErrRecordNotFound {
+			End(span, err)
+			return
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,24 @@
+// Package telemetry wires OpenTelemetry tracing into the server and agent.
+// Tracing is off unless enabled in config; spans are then exported over
+// OTLP/HTTP (Jaeger, Tempo, an OpenTelemetry Collector, …). While it is off
+// the global tracer provider is a no-op, so Start is nearly free and
+// instrumented code does not need to check Enabled. Slim builds (-tags slim)
+// leave the exporter out, so tracing stays off there.
+package telemetry
+
+var enabled bool
+
+// Options configures Setup.
+type Options struct {
+	Service string // service.name, e.g. "opentalon-server"
+	Version string
+	// Endpoint is the OTLP/HTTP base URL (e.g. http://jaeger:4318); empty
+	// uses OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318.
+	Endpoint string
+	// SampleRatio is the fraction of new traces that is recorded (0–1);
+	// traces started by a caller (e.g. an agent) follow its decision.
+	SampleRatio float64
+}
+
+// Enabled reports whether Setup installed an exporter.
+func Enabled() bool { return enabled }
@@ -17,6 +17,9 @@ Examples:
   # 安装指定版本的 Agent（必须指定 join/token）
   curl -fsSL https://raw.githubusercontent.com/${REPO}/main/scripts/install.sh | sh -s agent --version v0.1.18 --join 192.168.1.1:1616 --token opentalon-secret-key-123
 
+  # 在路由器（MIPS / ARM）上安装精简版 Agent（不含 Server / Web UI 及 Docker、K8s、GPU、温度采集；MIPS 只提供精简版）
+  curl -fsSL https://raw.githubusercontent.com/${REPO}/main/scripts/install.sh | sh -s agent --slim --join 192.168.1.1:1616 --token opentalon-secret-key-123
+
   # 卸载 Server 服务
   curl -fsSL https://raw.githubusercontent.com/${REPO}/main/scripts/install.sh | sh -s uninstall server
 
@@ -32,6 +35,7 @@ JOIN=""
 TOKEN=""
 GROUP=""
 PARENT=""
+SLIM=""
 
 if [ $# -lt 1 ]; then
   usage
@@ -88,6 +92,10 @@ while [ $# -gt 0 ]; do
       PARENT="${2:-}"
       shift 2 || true
       ;;
+    --slim)
+      SLIM="1"
+      shift
+      ;;
     *)
       echo "Unknown argument: $1"
       usage
@@ -128,6 +136,11 @@ if [ "${ACTION}" = "uninstall" ]; then
   exit 0
 fi
 
+if [ -n "${SLIM}" ] && [ "${MODE}" != "agent" ]; then
+  echo "--slim builds contain the agent only."
+  usage
+fi
+
 if [ "${MODE}" = "agent" ]; then
   if [ -z "${JOIN}" ] || [ -z "${TOKEN}" ]; then
     echo "Agent install requires: --join <server:1616> --token <agent_token>"
@@ -181,10 +194,27 @@ case "${UNAME_M}" in
   x86_64|amd64) ARCH="amd64" ;;
   aarch64|arm64) ARCH="arm64" ;;
   armv7l|armv7) ARCH="armv7" ;;
+  mips|mipsel|mipsle)
+    # uname -m says "mips" for both byte orders; MIPS builds are slim only.
+    if [ "$(printf 'I\000' | od -An -tx2 | tr -d ' ')" = "0049" ]; then
+      ARCH="mipsle"
+    else
+      ARCH="mips"
+    fi
+    if [ "${MODE}" != "agent" ]; then
+      echo "Only the agent is built for ${UNAME_M}."
+      exit 1
+    fi
+    SLIM="1"
+    ;;
   *) echo "Unsupported architecture: ${UNAME_M}"; exit 1 ;;
 esac
 
-BIN_NAME="opentalon-${OS}-${ARCH}"
+BIN_NAME="opentalon-${OS}-${ARCH}${SLIM:+-slim}"
+if [ -n "${SLIM}" ] && [ "${OS}" != "linux" ]; then
+  echo "Slim builds are only provided for Linux."
+  exit 1
+fi
 
 if [ "${VERSION}" = "latest" ]; then
   URL="https://github.com/${REPO}/releases/latest/download/${BIN_NAME}"
@@ -202,7 +232,7 @@ chmod +x "${TMP_BIN}"
 if [ "$(id -u)" -ne 0 ]; then
   echo "This script needs root to install to ${INSTALL_DIR} and register services."
   echo "Please re-run with sudo:"
-  echo "  sudo sh $0 install ${MODE} ${VERSION:+--version ${VERSION}} ${JOIN:+--join ${JOIN}} ${TOKEN:+--token ${TOKEN}}"
+  echo "  sudo sh $0 install ${MODE} ${VERSION:+--version ${VERSION}} ${JOIN:+--join ${JOIN}} ${TOKEN:+--token ${TOKEN}} ${SLIM:+--slim}"
   exit 1
 fi
 
@@ -0,0 +1,22 @@
+//go:build slim
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// serverCommands returns a stand-in for the server subcommand: slim builds
+// (go build -tags slim) carry the agent only.
+func serverCommands() []*cobra.Command {
+	return []*cobra.Command{{
+		Use:                "server",
+		Short:              "Not available in this slim agent-only build",
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return fmt.Errorf("this slim build contains the agent only; run the server from the full opentalon binary")
+		},
+	}}
+}
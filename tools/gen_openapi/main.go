@@ -0,0 +1,914 @@
+// gen_openapi writes internal/server/openapi.json, the OpenAPI 3 document
+// of the REST API, from the sources: the routes registered in
+// RegisterControlRoutes and RegisterDataRoutes and, for every handler, its
+// doc comment, the query parameters it reads, the JSON body it binds and the
+// JSON it responds with. The schemas of the models package become the
+// components the operations refer to.
+//
+// Run it after changing routes or handlers:
+//
+//	go generate ./internal/server
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type schema = map[string]any
+
+// httpStatus maps the net/http status constants the handlers use.
+var httpStatus = map[string]int{
+	"StatusOK": 200, "StatusCreated": 201, "StatusAccepted": 202, "StatusNoContent": 204,
+	"StatusPartialContent": 206, "StatusMovedPermanently": 301, "StatusFound": 302, "StatusNotModified": 304,
+	"StatusBadRequest": 400, "StatusUnauthorized": 401, "StatusForbidden": 403, "StatusNotFound": 404,
+	"StatusMethodNotAllowed": 405, "StatusConflict": 409, "StatusGone": 410, "StatusRequestEntityTooLarge": 413,
+	"StatusUnsupportedMediaType": 415, "StatusUnprocessableEntity": 422, "StatusTooManyRequests": 429,
+	"StatusInternalServerError": 500, "StatusNotImplemented": 501, "StatusBadGateway": 502,
+	"StatusServiceUnavailable": 503, "StatusGatewayTimeout": 504,
+}
+
+// security maps the middlewares of a route to its security scheme.
+var security = map[string]string{
+	"JWTMiddleware":             "bearerAuth",
+	"AgentTokenMiddleware":      "agentToken",
+	"FederationTokenMiddleware": "federationToken",
+}
+
+type gen struct {
+	funcs  map[string]*ast.FuncDecl // server package
+	types  map[string]ast.Expr      // server package
+	models map[string]ast.Expr
+	docs   map[string]string // models type doc comments
+	used   map[string]bool   // models types referenced so far
+}
+
+// route is one registered route.
+type route struct {
+	method, path string
+	security     string
+	dataPlane    bool
+	handler      ast.Expr
+}
+
+// handlerInfo is what the analysis of a handler found.
+type handlerInfo struct {
+	query     []string
+	body      schema
+	responses map[int]schema
+}
+
+func main() {
+	root, err := moduleRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	g := &gen{funcs: map[string]*ast.FuncDecl{}, types: map[string]ast.Expr{}, models: map[string]ast.Expr{},
+		docs: map[string]string{}, used: map[string]bool{}}
+	server := parseDir(fset, filepath.Join(root, "internal/server"))
+	for _, f := range server {
+		for _, d := range f.Decls {
+			switch d := d.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					g.funcs[d.Name.Name] = d
+				}
+			case *ast.GenDecl:
+				for _, s := range d.Specs {
+					if ts, ok := s.(*ast.TypeSpec); ok {
+						g.types[ts.Name.Name] = ts.Type
+					}
+				}
+			}
+		}
+	}
+	for _, f := range parseDir(fset, filepath.Join(root, "internal/models")) {
+		for _, d := range f.Decls {
+			if gd, ok := d.(*ast.GenDecl); ok {
+				for _, s := range gd.Specs {
+					if ts, ok := s.(*ast.TypeSpec); ok {
+						g.models[ts.Name.Name] = ts.Type
+						doc := ts.Doc
+						if doc == nil {
+							doc = gd.Doc
+						}
+						g.docs[ts.Name.Name] = doc.Text()
+					}
+				}
+			}
+		}
+	}
+
+	var routes []route
+	for _, name := range []string{"RegisterControlRoutes", "RegisterDataRoutes"} {
+		fn := g.funcs[name]
+		if fn == nil {
+			log.Fatalf("%s not found", name)
+		}
+		routes = append(routes, collectRoutes(fn, name == "RegisterDataRoutes")...)
+	}
+
+	paths := map[string]schema{}
+	for _, r := range routes {
+		p, params := openAPIPath(r.path)
+		if paths[p] == nil {
+			paths[p] = schema{}
+		}
+		paths[p][strings.ToLower(r.method)] = g.operation(r, params)
+	}
+
+	components := schema{
+		"Error": schema{"type": "object", "properties": schema{"error": schema{"type": "string"}}},
+	}
+	// Referenced models may refer to more models.
+	for done := map[string]bool{}; len(done) < len(g.used); {
+		names := make([]string, 0, len(g.used))
+		for n := range g.used {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if done[n] {
+				continue
+			}
+			done[n] = true
+			s := g.schemaOf(g.models[n], "models", nil)
+			if doc := g.docs[n]; doc != "" {
+				s["description"] = flatten(doc)
+			}
+			components[n] = s
+		}
+	}
+
+	doc := schema{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":   "OpenTalon API",
+			"version": makeVersion(root),
+			"description": "Control plane (port 6677): the Web UI's API, authenticated with a JWT from POST /api/login " +
+				"or an API token (otk_…). Data plane (port 1616): agent reports, authenticated with the agent token.",
+		},
+		"servers": []schema{{"url": "/", "description": "Control plane"}},
+		"paths":   paths,
+		"components": schema{
+			"schemas": components,
+			"securitySchemes": schema{
+				"bearerAuth":      schema{"type": "http", "scheme": "bearer", "description": "JWT from POST /api/login, or an API token"},
+				"agentToken":      schema{"type": "http", "scheme": "bearer", "description": "The agent token (agent_token)"},
+				"federationToken": schema{"type": "http", "scheme": "bearer", "description": "The federation token of an edge server"},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Fatal(err)
+	}
+	out := filepath.Join(root, "internal/server/openapi.json")
+	if err := os.WriteFile(out, buf.Bytes(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s: %d operations, %d schemas\n", out, len(routes), len(components))
+}
+
+// moduleRoot finds the directory holding go.mod from the working directory.
+func moduleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("go.mod not found")
+		}
+		dir = parent
+	}
+}
+
+// makeVersion reads VERSION from the Makefile.
+func makeVersion(root string) string {
+	b, err := os.ReadFile(filepath.Join(root, "Makefile"))
+	if err == nil {
+		if m := regexp.MustCompile(`(?m)^VERSION\s*:=\s*(\S+)`).FindSubmatch(b); m != nil {
+			return string(m[1])
+		}
+	}
+	return "dev"
+}
+
+func parseDir(fset *token.FileSet, dir string) []*ast.File {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var files []*ast.File
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".go") || strings.HasSuffix(e.Name(), "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, e.Name()), nil, parser.ParseComments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// collectRoutes follows the route groups of a Register*Routes function.
+func collectRoutes(fn *ast.FuncDecl, dataPlane bool) []route {
+	type group struct{ prefix, security string }
+	groups := map[string]group{fn.Type.Params.List[0].Names[0].Name: {}}
+	middlewareSecurity := func(args []ast.Expr) string {
+		for _, a := range args {
+			if call, ok := a.(*ast.CallExpr); ok {
+				if id, ok := call.Fun.(*ast.Ident); ok && security[id.Name] != "" {
+					return security[id.Name]
+				}
+			}
+		}
+		return ""
+	}
+	var routes []route
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			call, ok := n.Rhs[0].(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Group" {
+				return true
+			}
+			parent := groups[ident(sel.X)]
+			g := group{prefix: joinPath(parent.prefix, stringLit(call.Args[0])), security: parent.security}
+			if s := middlewareSecurity(call.Args[1:]); s != "" {
+				g.security = s
+			}
+			groups[ident(n.Lhs[0])] = g
+			return false
+		case *ast.CallExpr:
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			g, ok := groups[ident(sel.X)]
+			if !ok || !slices.Contains([]string{"GET", "POST", "PUT", "PATCH", "DELETE"}, sel.Sel.Name) {
+				return true
+			}
+			r := route{method: sel.Sel.Name, path: joinPath(g.prefix, stringLit(n.Args[0])), security: g.security,
+				dataPlane: dataPlane, handler: n.Args[len(n.Args)-1]}
+			if s := middlewareSecurity(n.Args[1 : len(n.Args)-1]); s != "" {
+				r.security = s
+			}
+			routes = append(routes, r)
+			return false
+		}
+		return true
+	})
+	return routes
+}
+
+func joinPath(prefix, rel string) string {
+	p := strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(rel, "/")
+	if p != "/" {
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// openAPIPath turns /devices/:id into /devices/{id} and returns the path
+// parameters.
+func openAPIPath(p string) (string, []string) {
+	var params []string
+	parts := strings.Split(p, "/")
+	for i, s := range parts {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			params = append(params, s[1:])
+			parts[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// operation builds the OpenAPI operation of a route.
+func (g *gen) operation(r route, pathParams []string) schema {
+	var fn *ast.FuncDecl
+	var name string
+	info := &handlerInfo{responses: map[int]schema{}}
+	switch h := r.handler.(type) {
+	case *ast.Ident:
+		name = h.Name
+	case *ast.CallExpr: // a handler factory, e.g. handlePowerAction(powerWake)
+		name = ident(h.Fun)
+	case *ast.FuncLit:
+		g.analyze(h.Body, funcParams(h.Type), info, map[string]bool{})
+	}
+	if fn = g.funcs[name]; fn != nil {
+		g.analyze(fn.Body, funcParams(fn.Type), info, map[string]bool{name: true})
+		g.directives(fn, info)
+	}
+
+	op := schema{"operationId": operationID(r.method, r.path)}
+	segs := strings.Split(strings.TrimPrefix(r.path, "/api/"), "/")
+	op["tags"] = []string{segs[0]}
+	if fn != nil && fn.Doc != nil {
+		doc := flatten(strings.TrimPrefix(fn.Doc.Text(), name+" "))
+		doc = string(unicode.ToUpper(rune(doc[0]))) + doc[1:]
+		op["summary"] = firstSentence(doc)
+		if doc != op["summary"] {
+			op["description"] = doc
+		}
+	} else {
+		op["summary"] = r.method + " " + r.path
+	}
+
+	var params []schema
+	for _, p := range pathParams {
+		s := schema{"type": "string"}
+		if p == "id" {
+			s = schema{"type": "integer"}
+		}
+		params = append(params, schema{"name": p, "in": "path", "required": true, "schema": s})
+	}
+	for _, q := range info.query {
+		params = append(params, schema{"name": q, "in": "query", "schema": schema{"type": "string"}})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if info.body != nil {
+		op["requestBody"] = schema{"required": true, "content": schema{"application/json": schema{"schema": info.body}}}
+	}
+
+	responses := schema{}
+	ok := false
+	for status, s := range info.responses {
+		desc := "OK"
+		if status >= 400 {
+			desc = "Error"
+			if props, _ := s["properties"].(schema); len(props) == 1 && props["error"] != nil {
+				s = schema{"$ref": "#/components/schemas/Error"}
+			}
+		} else {
+			ok = true
+		}
+		responses[strconv.Itoa(status)] = schema{"description": desc, "content": schema{"application/json": schema{"schema": s}}}
+	}
+	if !ok {
+		responses["200"] = schema{"description": "OK"}
+	}
+	op["responses"] = responses
+	switch {
+	case r.security != "":
+		op["security"] = []schema{{r.security: []string{}}}
+	default:
+		op["security"] = []schema{}
+	}
+	if r.dataPlane {
+		op["servers"] = []schema{{
+			"url":         "{scheme}://{host}:1616",
+			"description": "Data plane",
+			"variables": schema{
+				"scheme": schema{"default": "http", "enum": []string{"http", "https"}},
+				"host":   schema{"default": "localhost"},
+			},
+		}}
+	}
+	return op
+}
+
+// directives applies the //openapi: comments of a handler, for what the
+// analysis cannot see:
+//
+//	//openapi:body payload	the body is decoded into the variable payload
+func (g *gen) directives(fn *ast.FuncDecl, info *handlerInfo) {
+	if fn.Doc == nil {
+		return
+	}
+	for _, c := range fn.Doc.List {
+		arg, ok := strings.CutPrefix(c.Text, "//openapi:body ")
+		if !ok {
+			continue
+		}
+		vars := map[string]ast.Expr{}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			g.collectVar(n, vars)
+			return true
+		})
+		info.body = g.exprSchema(ast.NewIdent(strings.TrimSpace(arg)), vars)
+	}
+}
+
+// operationID derives a unique id from the route: GET /api/devices/:id/tags
+// is getDevicesIdTags.
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, s := range strings.FieldsFunc(strings.TrimPrefix(path, "/api"), func(r rune) bool {
+		return r == '/' || r == ':' || r == '*' || r == '-' || r == '.' || r == '_'
+	}) {
+		b.WriteString(strings.ToUpper(s[:1]) + s[1:])
+	}
+	return b.String()
+}
+
+// funcParams returns the gin.Context parameters and the function-typed
+// parameters (query readers such as c.Query passed along) of a function.
+func funcParams(ft *ast.FuncType) (ctx map[string]bool) {
+	ctx = map[string]bool{}
+	for _, f := range ft.Params.List {
+		switch t := f.Type.(type) {
+		case *ast.StarExpr:
+			if sel, ok := t.X.(*ast.SelectorExpr); ok && ident(sel.X) == "gin" && sel.Sel.Name == "Context" {
+				for _, n := range f.Names {
+					ctx[n.Name] = true
+				}
+			}
+		case *ast.FuncType:
+			for _, n := range f.Names {
+				ctx["func:"+n.Name] = true
+			}
+		}
+	}
+	return ctx
+}
+
+// analyze collects the query parameters, body and responses of a handler
+// body, following the functions the context is passed to.
+func (g *gen) analyze(body *ast.BlockStmt, ctx map[string]bool, info *handlerInfo, seen map[string]bool) {
+	if body == nil {
+		return
+	}
+	vars := map[string]ast.Expr{}
+	// Handler factories return a func literal taking the context.
+	ast.Inspect(body, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok {
+			for k := range funcParams(lit.Type) {
+				ctx[k] = true
+			}
+		}
+		g.collectVar(n, vars)
+		return true
+	})
+	isCtx := func(e ast.Expr) bool {
+		if sel, ok := e.(*ast.SelectorExpr); ok {
+			e = sel.X
+		}
+		return ctx[ident(e)]
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := call.Fun.(*ast.Ident); ok {
+			if ctx["func:"+id.Name] && len(call.Args) > 0 {
+				info.addQuery(stringLit(call.Args[0]))
+			}
+			if fn := g.funcs[id.Name]; fn != nil && !seen[id.Name] && slices.ContainsFunc(call.Args, isCtx) {
+				seen[id.Name] = true
+				sub := &handlerInfo{responses: info.responses}
+				g.analyze(fn.Body, funcParams(fn.Type), sub, seen)
+				for _, q := range sub.query {
+					info.addQuery(q)
+				}
+				if info.body == nil {
+					info.body = sub.body
+				}
+			}
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || !ctx[ident(sel.X)] {
+			return true
+		}
+		switch sel.Sel.Name {
+		case "Query", "DefaultQuery", "GetQuery", "QueryArray", "GetQueryArray":
+			info.addQuery(stringLit(call.Args[0]))
+		case "ShouldBindJSON", "BindJSON", "ShouldBind", "Bind":
+			if info.body == nil {
+				info.body = g.exprSchema(call.Args[0], vars)
+			}
+		case "JSON", "IndentedJSON", "PureJSON", "AbortWithStatusJSON":
+			status := statusCode(call.Args[0])
+			if status == 0 {
+				return true
+			}
+			s := g.exprSchema(call.Args[1], vars)
+			if prev := info.responses[status]; prev != nil {
+				s = mergeObjects(prev, s)
+			}
+			info.responses[status] = s
+		}
+		return true
+	})
+}
+
+func (info *handlerInfo) addQuery(q string) {
+	if q != "" && !slices.Contains(info.query, q) {
+		info.query = append(info.query, q)
+	}
+}
+
+// collectVar notes the type of a local variable declared by n.
+func (g *gen) collectVar(n ast.Node, vars map[string]ast.Expr) {
+	switch n := n.(type) {
+	case *ast.ValueSpec:
+		for i, name := range n.Names {
+			if n.Type != nil {
+				vars[name.Name] = n.Type
+			} else if i < len(n.Values) {
+				if t := g.exprType(n.Values[i]); t != nil {
+					vars[name.Name] = t
+				}
+			}
+		}
+	case *ast.AssignStmt:
+		if n.Tok != token.DEFINE {
+			return
+		}
+		if len(n.Rhs) == 1 {
+			if t := g.exprType(n.Rhs[0]); t != nil {
+				vars[ident(n.Lhs[0])] = t
+			}
+			return
+		}
+		for i, lhs := range n.Lhs {
+			if i < len(n.Rhs) {
+				if t := g.exprType(n.Rhs[i]); t != nil {
+					vars[ident(lhs)] = t
+				}
+			}
+		}
+	}
+}
+
+// exprType is the static type of simple expressions: composite literals,
+// new / make and calls of server functions.
+func (g *gen) exprType(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.CompositeLit:
+		return e.Type
+	case *ast.UnaryExpr:
+		if e.Op == token.AND {
+			return g.exprType(e.X)
+		}
+	case *ast.CallExpr:
+		switch id := ident(e.Fun); id {
+		case "new", "make":
+			return e.Args[0]
+		default:
+			if fn := g.funcs[id]; fn != nil && fn.Type.Results != nil {
+				return fn.Type.Results.List[0].Type
+			}
+		}
+	}
+	return nil
+}
+
+// exprSchema is the schema of a value written as JSON.
+func (g *gen) exprSchema(e ast.Expr, vars map[string]ast.Expr) schema {
+	switch e := e.(type) {
+	case *ast.Ident:
+		if t := vars[e.Name]; t != nil {
+			return g.schemaOf(t, "server", nil)
+		}
+		switch e.Name {
+		case "true", "false":
+			return schema{"type": "boolean"}
+		case "nil":
+			return schema{"nullable": true}
+		}
+	case *ast.UnaryExpr:
+		return g.exprSchema(e.X, vars)
+	case *ast.BasicLit:
+		if e.Kind == token.STRING {
+			return schema{"type": "string"}
+		}
+		return schema{"type": "number"}
+	case *ast.CompositeLit:
+		if sel, ok := e.Type.(*ast.SelectorExpr); ok && ident(sel.X) == "gin" && sel.Sel.Name == "H" {
+			props := schema{}
+			for _, el := range e.Elts {
+				if kv, ok := el.(*ast.KeyValueExpr); ok {
+					if k := stringLit(kv.Key); k != "" {
+						props[k] = g.exprSchema(kv.Value, vars)
+					}
+				}
+			}
+			return schema{"type": "object", "properties": props}
+		}
+		if e.Type != nil {
+			return g.schemaOf(e.Type, "server", nil)
+		}
+	case *ast.CallExpr:
+		if sel, ok := e.Fun.(*ast.SelectorExpr); ok {
+			switch {
+			case sel.Sel.Name == "Error", sel.Sel.Name == "String", ident(sel.X) == "fmt", ident(sel.X) == "strings":
+				return schema{"type": "string"}
+			case sel.Sel.Name == "Now", sel.Sel.Name == "UTC":
+				return schema{"type": "string", "format": "date-time"}
+			}
+		}
+		if ident(e.Fun) == "len" {
+			return schema{"type": "integer"}
+		}
+		if t := g.exprType(e); t != nil {
+			return g.schemaOf(t, "server", nil)
+		}
+	case *ast.SelectorExpr:
+		if t := vars[ident(e.X)]; t != nil {
+			if ft := g.fieldType(t, e.Sel.Name); ft != nil {
+				return g.schemaOf(ft.typ, ft.pkg, nil)
+			}
+		}
+	}
+	return schema{}
+}
+
+type typed struct {
+	typ ast.Expr
+	pkg string
+}
+
+// fieldType finds the type of field name in the struct type t.
+func (g *gen) fieldType(t ast.Expr, name string) *typed {
+	pkg := "server"
+	for {
+		switch x := t.(type) {
+		case *ast.StarExpr:
+			t = x.X
+			continue
+		case *ast.SelectorExpr:
+			if ident(x.X) != "models" {
+				return nil
+			}
+			t, pkg = g.models[x.Sel.Name], "models"
+			continue
+		case *ast.Ident:
+			if pkg == "models" {
+				t = g.models[x.Name]
+			} else {
+				t = g.types[x.Name]
+			}
+			if t == nil {
+				return nil
+			}
+			continue
+		case *ast.StructType:
+			for _, f := range x.Fields.List {
+				for _, n := range f.Names {
+					if n.Name == name {
+						return &typed{f.Type, pkg}
+					}
+				}
+				if sel, ok := f.Type.(*ast.SelectorExpr); ok && len(f.Names) == 0 && sel.Sel.Name == "Model" {
+					switch name {
+					case "ID":
+						return &typed{ast.NewIdent("uint"), pkg}
+					case "CreatedAt", "UpdatedAt":
+						return &typed{&ast.SelectorExpr{X: ast.NewIdent("time"), Sel: ast.NewIdent("Time")}, pkg}
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// schemaOf converts a Go type of package pkg ("server" or "models") into a
+// schema; models types become references to components.
+func (g *gen) schemaOf(t ast.Expr, pkg string, visiting map[string]bool) schema {
+	switch t := t.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return schema{"type": "string"}
+		case "bool":
+			return schema{"type": "boolean"}
+		case "int", "int8", "int16", "int32", "uint", "uint8", "uint16", "uint32", "byte", "rune":
+			return schema{"type": "integer"}
+		case "int64", "uint64":
+			return schema{"type": "integer", "format": "int64"}
+		case "float32", "float64":
+			return schema{"type": "number"}
+		case "any", "error":
+			return schema{}
+		}
+		if pkg == "models" {
+			return g.modelRef(t.Name)
+		}
+		if def := g.types[t.Name]; def != nil && !visiting[t.Name] {
+			if visiting == nil {
+				visiting = map[string]bool{}
+			}
+			visiting[t.Name] = true
+			defer delete(visiting, t.Name)
+			return g.schemaOf(def, pkg, visiting)
+		}
+		return schema{}
+	case *ast.SelectorExpr:
+		switch ident(t.X) + "." + t.Sel.Name {
+		case "time.Time":
+			return schema{"type": "string", "format": "date-time"}
+		case "time.Duration":
+			return schema{"type": "integer", "description": "nanoseconds"}
+		case "gorm.DeletedAt":
+			return schema{"type": "string", "format": "date-time", "nullable": true}
+		case "gin.H":
+			return schema{"type": "object"}
+		}
+		if ident(t.X) == "models" {
+			return g.modelRef(t.Sel.Name)
+		}
+		return schema{}
+	case *ast.StarExpr:
+		s := g.schemaOf(t.X, pkg, visiting)
+		if _, ref := s["$ref"]; !ref {
+			s["nullable"] = true
+		}
+		return s
+	case *ast.ArrayType:
+		if ident(t.Elt) == "byte" {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": g.schemaOf(t.Elt, pkg, visiting)}
+	case *ast.MapType:
+		return schema{"type": "object", "additionalProperties": g.schemaOf(t.Value, pkg, visiting)}
+	case *ast.StructType:
+		props := schema{}
+		g.structProps(t, pkg, props, visiting)
+		return schema{"type": "object", "properties": props}
+	}
+	return schema{}
+}
+
+// modelRef refers to a models type, or inlines it when it is not a struct
+// (e.g. type NetworkMode string).
+func (g *gen) modelRef(name string) schema {
+	def := g.models[name]
+	if def == nil {
+		return schema{}
+	}
+	if _, ok := def.(*ast.StructType); !ok {
+		return g.schemaOf(def, "models", nil)
+	}
+	g.used[name] = true
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+// structProps adds the JSON properties of a struct to props, as
+// encoding/json writes them.
+func (g *gen) structProps(st *ast.StructType, pkg string, props schema, visiting map[string]bool) {
+	for _, f := range st.Fields.List {
+		var tag reflect.StructTag
+		if f.Tag != nil {
+			tag = reflect.StructTag(strings.Trim(f.Tag.Value, "`"))
+		}
+		jsonName, _, _ := strings.Cut(tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+		if len(f.Names) == 0 && jsonName == "" { // embedded
+			switch x := f.Type.(type) {
+			case *ast.SelectorExpr:
+				if ident(x.X) == "gorm" && x.Sel.Name == "Model" {
+					props["ID"] = schema{"type": "integer"}
+					props["CreatedAt"] = schema{"type": "string", "format": "date-time"}
+					props["UpdatedAt"] = schema{"type": "string", "format": "date-time"}
+					props["DeletedAt"] = schema{"type": "string", "format": "date-time", "nullable": true}
+				} else if ident(x.X) == "models" {
+					if def, ok := g.models[x.Sel.Name].(*ast.StructType); ok {
+						g.structProps(def, "models", props, visiting)
+					}
+				}
+			case *ast.Ident:
+				defs := g.types
+				if pkg == "models" {
+					defs = g.models
+				}
+				if def, ok := defs[x.Name].(*ast.StructType); ok {
+					g.structProps(def, pkg, props, visiting)
+				}
+			}
+			continue
+		}
+		if _, ok := f.Type.(*ast.FuncType); ok {
+			continue
+		}
+		if _, ok := f.Type.(*ast.ChanType); ok {
+			continue
+		}
+		names := []string{jsonName}
+		if jsonName == "" {
+			names = nil
+			for _, n := range f.Names {
+				if n.IsExported() {
+					names = append(names, n.Name)
+				}
+			}
+		}
+		for _, n := range names {
+			s := g.schemaOf(f.Type, pkg, visiting)
+			c := f.Doc.Text()
+			if c == "" {
+				c = f.Comment.Text()
+			}
+			if c != "" {
+				if _, ref := s["$ref"]; !ref {
+					s["description"] = flatten(c)
+				}
+			}
+			props[n] = s
+		}
+	}
+}
+
+// mergeObjects merges the properties of two object schemas, e.g. the
+// responses of two c.JSON calls with the same status.
+func mergeObjects(a, b schema) schema {
+	pa, _ := a["properties"].(schema)
+	pb, _ := b["properties"].(schema)
+	if pa == nil || pb == nil {
+		return a
+	}
+	for k, v := range pb {
+		if _, ok := pa[k]; !ok || len(pa[k].(schema)) == 0 {
+			pa[k] = v
+		}
+	}
+	return a
+}
+
+func statusCode(e ast.Expr) int {
+	switch e := e.(type) {
+	case *ast.SelectorExpr:
+		return httpStatus[e.Sel.Name]
+	case *ast.BasicLit:
+		n, _ := strconv.Atoi(e.Value)
+		return n
+	}
+	return 0
+}
+
+func ident(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		return e.Sel.Name
+	}
+	return ""
+}
+
+func stringLit(e ast.Expr) string {
+	if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+		s, err := strconv.Unquote(lit.Value)
+		if err == nil {
+			return s
+		}
+	}
+	return ""
+}
+
+// flatten joins the lines of a comment, keeping blank lines as paragraph
+// breaks.
+func flatten(s string) string {
+	var paras []string
+	for _, p := range strings.Split(strings.TrimSpace(s), "\n\n") {
+		paras = append(paras, strings.Join(strings.Fields(p), " "))
+	}
+	return strings.Join(paras, "\n\n")
+}
+
+// firstSentence returns s up to the first full stop followed by a space.
+func firstSentence(s string) string {
+	s, _, _ = strings.Cut(s, "\n")
+	if i := strings.Index(s, ". "); i > 0 {
+		return s[:i+1]
+	}
+	return s
+}